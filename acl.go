@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Room permissions an ACL grants
+const (
+	// PermPost lets a user send messages and polls to the room
+	PermPost = "post"
+	// PermInvite lets a user manage the invites of an invite-only room
+	PermInvite = "invite"
+	// PermModerate lets a user manage the room's slow mode and
+	// integrations, exempts them from slow mode, and implies the other
+	// permissions
+	PermModerate = "moderate"
+)
+
+// maxGrantEntries caps the roles and users of one grant
+const maxGrantEntries = 100
+
+// Grant is who holds a permission: users with one of Roles, held for the
+// whole server or as "<role>:<room>" for the room, and the logged-in users
+// named in Users
+type Grant struct {
+	Roles []string `json:"roles,omitempty"`
+	Users []string `json:"users,omitempty"`
+}
+
+// RoomACL sets who may post to, invite to and moderate a room. A
+// permission left out keeps its default: everyone may post, and users with
+// the moderator role may moderate and invite. The room's owner key and the
+// admin token hold every permission.
+type RoomACL struct {
+	Post     *Grant `json:"post,omitempty"`
+	Invite   *Grant `json:"invite,omitempty"`
+	Moderate *Grant `json:"moderate,omitempty"`
+}
+
+// grantee is who asks for a permission. Username is only set for users
+// who logged in, so a guest can't pass for a listed user.
+type grantee struct {
+	username string
+	roles    []string
+}
+
+// Validate checks the roles and usernames of every grant
+func (a *RoomACL) Validate() error {
+	for perm, g := range map[string]*Grant{PermPost: a.Post, PermInvite: a.Invite, PermModerate: a.Moderate} {
+		if g == nil {
+			continue
+		}
+		if len(g.Roles)+len(g.Users) > maxGrantEntries {
+			return fmt.Errorf("%s: too many roles and users (max %d)", perm, maxGrantEntries)
+		}
+		if slices.Contains(g.Roles, "") {
+			return fmt.Errorf("%s: empty role", perm)
+		}
+		for _, user := range g.Users {
+			if !couldBeUsername(user) {
+				return fmt.Errorf("%s: invalid username %q", perm, user)
+			}
+		}
+	}
+	return nil
+}
+
+// grant returns who holds perm when the ACL doesn't say, nil meaning
+// everyone
+func (a *RoomACL) grant(perm string) *Grant {
+	switch perm {
+	case PermPost:
+		return a.Post
+	case PermInvite:
+		if a.Invite != nil {
+			return a.Invite
+		}
+		return &Grant{}
+	default:
+		if a.Moderate != nil {
+			return a.Moderate
+		}
+		return &Grant{Roles: []string{roleModerator}}
+	}
+}
+
+// includes reports whether the grant covers who in the named room
+func (g *Grant) includes(room string, who grantee) bool {
+	if who.username != "" && slices.Contains(g.Users, who.username) {
+		return true
+	}
+	for _, role := range g.Roles {
+		if slices.Contains(who.roles, role) || slices.Contains(who.roles, role+":"+room) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether who holds perm in the named room
+func (a *RoomACL) allows(perm, room string, who grantee) bool {
+	if perm != PermModerate && a.allows(PermModerate, room, who) {
+		return true
+	}
+	g := a.grant(perm)
+	return g == nil || g.includes(room, who)
+}
+
+// grantee describes the client to the room ACLs
+func (c *Client) grantee() grantee {
+	if !c.authenticated || c.guest {
+		return grantee{}
+	}
+	return grantee{username: c.username, roles: c.roles}
+}
+
+// permits reports whether who holds perm in room, or in the lobby if room
+// is nil
+func (cs *ChatServer) permits(room *Room, perm string, who grantee) bool {
+	if room == nil {
+		room = cs.lobby
+	}
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	return room.acl.allows(perm, room.Name, who)
+}
+
+// authorizeGrant returns who is acting on the room, if the request carries
+// the token of a logged-in user who holds perm in it
+func (cs *ChatServer) authorizeGrant(r *http.Request, room *Room, perm string) (string, bool) {
+	if cs.auth == nil {
+		return "", false
+	}
+	identity, err := cs.auth.Authenticate(r.Context(), requestToken(r))
+	if err != nil || identity.Guest {
+		return "", false
+	}
+	if cs.permits(room, perm, grantee{username: identity.Username, roles: identity.Roles}) {
+		return identity.Username, true
+	}
+	return "", false
+}
+
+// refusePost refuses a message from a client the room's ACL doesn't let
+// post, reporting whether it did
+func (cs *ChatServer) refusePost(ctx context.Context, client *Client, msg Message) bool {
+	if cs.permits(client.room, PermPost, client.grantee()) {
+		return false
+	}
+	err := protocolErrorf(codeForbidden, "you may not post in %s", roomOrLobby(client.roomName()))
+	client.logf("Refused %s from %s (trace %s): %v", msg.Type, client.username, msg.Trace, err)
+	cs.sendError(ctx, client, err, refFor(msg))
+	cs.noteRejection(client)
+	return true
+}
+
+// handleAdminACL serves the ACL of a room: GET /admin/acl?room=<name>
+// reports it, PUT replaces it and DELETE restores the defaults. The lobby
+// is managed with room=lobby.
+func (cs *ChatServer) handleAdminACL(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("room")
+	room := cs.stateRoom(name)
+	if room == nil {
+		http.Error(w, errRoomNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		cs.roomsMtx.Lock()
+		acl := room.acl
+		cs.roomsMtx.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(acl)
+
+	case http.MethodPut:
+		var acl RoomACL
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&acl); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := acl.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cs.roomsMtx.Lock()
+		room.acl = acl
+		cs.roomsMtx.Unlock()
+		summary, _ := json.Marshal(acl)
+		cs.audit(AuditACL, adminActor(r), roomOrLobby(name), string(summary))
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		cs.roomsMtx.Lock()
+		room.acl = RoomACL{}
+		cs.roomsMtx.Unlock()
+		cs.audit(AuditACL, adminActor(r), roomOrLobby(name), "{}")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
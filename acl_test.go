@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestRoomACL_Allows(t *testing.T) {
+	acl := RoomACL{
+		Post:   &Grant{Roles: []string{"speaker"}, Users: []string{"carol"}},
+		Invite: &Grant{Users: []string{"dave"}},
+	}
+	tests := []struct {
+		name string
+		perm string
+		who  grantee
+		want bool
+	}{
+		{"listed user posts", PermPost, grantee{username: "carol"}, true},
+		{"role posts", PermPost, grantee{username: "alice", roles: []string{"speaker"}}, true},
+		{"room role posts", PermPost, grantee{roles: []string{"speaker:ops"}}, true},
+		{"other room role", PermPost, grantee{roles: []string{"speaker:dev"}}, false},
+		{"unlisted user", PermPost, grantee{username: "bob"}, false},
+		{"guest", PermPost, grantee{}, false},
+		{"moderator posts", PermPost, grantee{roles: []string{roleModerator}}, true},
+		{"moderator invites", PermInvite, grantee{roles: []string{roleModerator + ":ops"}}, true},
+		{"listed inviter", PermInvite, grantee{username: "dave"}, true},
+		{"inviter can't moderate", PermModerate, grantee{username: "dave"}, false},
+		{"inviter can't post", PermPost, grantee{username: "dave"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := acl.allows(tt.perm, "ops", tt.who); got != tt.want {
+				t.Errorf("Expected %s allowed %v, got %v", tt.perm, tt.want, got)
+			}
+		})
+	}
+
+	var open RoomACL
+	if !open.allows(PermPost, "ops", grantee{}) {
+		t.Errorf("Expected everyone to post without an ACL")
+	}
+	if open.allows(PermInvite, "ops", grantee{username: "bob"}) {
+		t.Errorf("Expected only moderators to invite without an ACL")
+	}
+
+	bad := RoomACL{Moderate: &Grant{Users: []string{"not a name"}}}
+	if err := bad.Validate(); err == nil {
+		t.Errorf("Expected an invalid username to be refused")
+	}
+}
+
+func TestRoomACL(t *testing.T) {
+	server := NewChatServer(WithAdminToken("secret"), WithAuthenticator(tokenAuth{
+		"alice-token": {Username: "alice", Roles: []string{"speaker"}},
+		"bob-token":   {Username: "bob"},
+		"carol-token": {Username: "carol"},
+	}))
+	server.Run(t.Context())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", server.handleConnection)
+	mux.HandleFunc("/rooms", server.handleRooms)
+	mux.HandleFunc("/rooms/invites", server.handleRoomInvites)
+	server.registerAdminRoutes(mux)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	putACL := func(body string) int {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPut, s.URL+"/admin/acl?room=lobby", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to put ACL: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := putACL(`{"post":{"users":["bad name"]}}`); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid username, got %d", status)
+	}
+	if status := putACL(`{"post":{"roles":["speaker"]}}`); status != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", status)
+	}
+	resp := adminRequest(t, ctx, http.MethodGet, s.URL+"/admin/acl?room=lobby", "secret")
+	var acl RoomACL
+	json.NewDecoder(resp.Body).Decode(&acl)
+	resp.Body.Close()
+	if acl.Post == nil || len(acl.Post.Roles) != 1 || acl.Post.Roles[0] != "speaker" {
+		t.Errorf("Expected the speaker role to post, got %+v", acl)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+	dial := func(token string) *websocket.Conn {
+		c, _, err := websocket.Dial(ctx, wsURL+"?token="+token, &websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+		if err != nil {
+			t.Fatalf("Failed to connect with %s: %v", token, err)
+		}
+		t.Cleanup(func() { c.CloseNow() })
+		readUntilType(t, ctx, c, "system")
+		return c
+	}
+	alice, bob := dial("alice-token"), dial("bob-token")
+
+	if err := wsjson.Write(ctx, bob, Message{Type: "message", Content: "can I?"}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if msg := readUntilType(t, ctx, bob, "message"); msg.Type != "error" || msg.Code != codeForbidden {
+		t.Errorf("Expected a forbidden error for bob, got %+v", msg)
+	}
+	if err := wsjson.Write(ctx, alice, Message{Type: "message", Content: "I can"}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if msg := readUntilType(t, ctx, bob, "message"); msg.Content != "I can" {
+		t.Errorf("Expected alice's message, got %+v", msg)
+	}
+
+	// Restoring the defaults lets everyone post again
+	adminRequest(t, ctx, http.MethodDelete, s.URL+"/admin/acl?room=lobby", "secret").Body.Close()
+	if err := wsjson.Write(ctx, bob, Message{Type: "message", Content: "now I can"}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if msg := readUntilType(t, ctx, bob, "message"); msg.Content != "now I can" {
+		t.Errorf("Expected bob's message, got %+v", msg)
+	}
+
+	// Users an invite-only room's ACL lets invite manage its invites
+	body, _ := json.Marshal(RoomOptions{Name: "vip", InviteOnly: true, ACL: &RoomACL{Invite: &Grant{Users: []string{"bob"}}}})
+	resp, err := http.Post(s.URL+"/rooms", "application/json", bytes.NewReader(body))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to create room: %v %v", err, resp.Status)
+	}
+	resp.Body.Close()
+	for token, want := range map[string]int{"bob-token": http.StatusCreated, "carol-token": http.StatusUnauthorized} {
+		resp := adminRequest(t, ctx, http.MethodPost, s.URL+"/rooms/invites?room=vip", token)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("Expected %d inviting with %s, got %d", want, token, resp.StatusCode)
+		}
+	}
+}
+
+func TestRoomACL_Bridges(t *testing.T) {
+	server := NewChatServer()
+	xmpp := &XMPPBridge{cs: server}
+	mqtt := &MQTTBridge{cs: server, cfg: MQTTConfig{Bot: "sensors"}}
+	post := func() {
+		server.relayMatrixEvent("", "m.room.message", "@bob:example.org", "", "m.text", "hi", "")
+		xmpp.publish("", xmppUserPrefix+"bob", "message", "hi")
+		mqtt.post("", "alerts/door", []byte("open"), false)
+	}
+
+	server.lobby.acl = RoomACL{Post: &Grant{Roles: []string{"speaker"}}}
+	post()
+	if n := len(server.broadcast); n != 0 {
+		t.Errorf("Expected bridged messages the lobby's ACL refuses to be dropped, got %d", n)
+	}
+	// Presence isn't posting
+	xmpp.publish("", xmppUserPrefix+"bob", "join", "")
+	if n := len(server.broadcast); n != 1 {
+		t.Errorf("Expected the join to be relayed, got %d messages", n)
+	}
+	server.lobby.acl = RoomACL{}
+	post()
+	if n := len(server.broadcast); n != 4 {
+		t.Errorf("Expected every bridged message once everyone may post, got %d", n)
+	}
+}
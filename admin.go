@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+)
+
+// WithAdminToken enables the /admin endpoints, authenticated with token as
+// a bearer token. Without a token the admin API is disabled.
+func WithAdminToken(token string) Option {
+	return func(cs *ChatServer) {
+		cs.adminToken = token
+	}
+}
+
+// requireAdmin wraps an admin handler with bearer token authentication.
+// Failed attempts count as abuse strikes against the caller's address.
+func (cs *ChatServer) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cs.adminToken == "" {
+			http.Error(w, "admin API disabled", http.StatusNotFound)
+			return
+		}
+		if cs.rejectBanned(w, r) {
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cs.adminToken)) != 1 {
+			cs.audit(AuditAuthFailed, adminActor(r), r.Method+" "+r.URL.Path, "")
+			cs.strike(r, "failed admin authentication")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		cs.audit(AuditAdminAPI, adminActor(r), r.Method+" "+r.URL.RequestURI(), "")
+		h(w, r)
+	}
+}
+
+// ConnectionInfo describes a connected client for the admin API
+type ConnectionInfo struct {
+	ID       string   `json:"id"`
+	Username string   `json:"username"`
+	Protocol string   `json:"protocol"`
+	Remote   string   `json:"remote"`
+	Roles    []string `json:"roles,omitempty"`
+}
+
+// handleAdminConnections serves GET /admin/connections
+func (cs *ChatServer) handleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cs.clientsMtx.Lock()
+	conns := make([]ConnectionInfo, 0, len(cs.clients))
+	for client := range cs.clients {
+		conns = append(conns, ConnectionInfo{
+			ID:       client.id,
+			Username: client.username,
+			Protocol: client.protocol(),
+			Remote:   client.remoteAddr,
+			Roles:    client.roles,
+		})
+	}
+	cs.clientsMtx.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Username < conns[j].Username })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conns)
+}
+
+// registerAdminRoutes adds the admin endpoints to mux
+func (cs *ChatServer) registerAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/connections", cs.requireAdmin(cs.handleAdminConnections))
+	mux.HandleFunc("/admin/bandwidth", cs.requireAdmin(cs.handleAdminBandwidth))
+	mux.HandleFunc("/admin/tap", cs.requireAdmin(cs.handleAdminTap))
+	mux.HandleFunc("/admin/bans", cs.requireAdmin(cs.handleAdminBans))
+	mux.HandleFunc("/admin/renames", cs.requireAdmin(cs.handleAdminRenames))
+	mux.HandleFunc("/admin/audit", cs.requireAdmin(cs.handleAdminAudit))
+	mux.HandleFunc("/admin/erase", cs.requireAdmin(cs.handleAdminErase))
+	mux.HandleFunc("/admin/topic", cs.requireAdmin(cs.handleAdminTopic))
+	mux.HandleFunc("/admin/pins", cs.requireAdmin(cs.handleAdminPins))
+	mux.HandleFunc("/admin/acl", cs.requireAdmin(cs.handleAdminACL))
+	mux.HandleFunc("/admin/announce", cs.requireAdmin(cs.handleAdminAnnounce))
+	mux.HandleFunc("/admin/announcements", cs.requireAdmin(cs.handleAdminAnnouncements))
+	mux.HandleFunc("/admin/scheduled", cs.requireAdmin(cs.handleAdminScheduled))
+	mux.HandleFunc("/admin/motd", cs.requireAdmin(cs.handleAdminMOTD))
+	mux.HandleFunc("/admin/recurring", cs.requireAdmin(cs.handleAdminRecurring))
+	mux.HandleFunc("/admin/client-errors", cs.requireAdmin(cs.handleAdminClientErrors))
+	mux.HandleFunc("/admin/purge", cs.requireAdmin(cs.handleAdminPurge))
+	mux.HandleFunc("/admin/export", cs.requireAdmin(cs.handleAdminExport))
+	mux.HandleFunc("/admin/import", cs.requireAdmin(cs.handleAdminImport))
+	mux.HandleFunc("/admin/quarantine", cs.requireAdmin(cs.handleAdminQuarantine))
+	mux.HandleFunc("/admin/quarantine/release", cs.requireAdmin(cs.handleAdminRelease))
+	mux.HandleFunc("/admin/quarantine/remove", cs.requireAdmin(cs.handleAdminRemove))
+	mux.HandleFunc("/admin/shadowbans", cs.requireAdmin(cs.handleAdminShadowBans))
+	mux.HandleFunc("/admin/reload", cs.requireAdmin(cs.handleAdminReload))
+}
+
+// registerDebugRoutes adds the pprof endpoints to mux. They are only served
+// on the internal listener.
+func registerDebugRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
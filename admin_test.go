@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// newAdminTestServer serves the chat endpoint and admin API on one mux
+func newAdminTestServer(t *testing.T, server *ChatServer) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", server.handleConnection)
+	server.registerAdminRoutes(mux)
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// adminRequest performs an authenticated admin API request
+func adminRequest(t *testing.T, ctx context.Context, method, url, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	return resp
+}
+
+func TestAdmin_Authentication(t *testing.T) {
+	ctx := context.Background()
+
+	disabled := newAdminTestServer(t, NewChatServer())
+	resp := adminRequest(t, ctx, http.MethodGet, disabled.URL+"/admin/connections", "anything")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 with admin API disabled, got %d", resp.StatusCode)
+	}
+
+	s := newAdminTestServer(t, NewChatServer(WithAdminToken("secret")))
+	for token, want := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "secret": http.StatusOK} {
+		resp := adminRequest(t, ctx, http.MethodGet, s.URL+"/admin/connections", token)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("Token %q: expected %d, got %d", token, want, resp.StatusCode)
+		}
+	}
+}
+
+func TestAdmin_TapConnection(t *testing.T) {
+	server := NewChatServer(WithAdminToken("secret"))
+	server.Run(t.Context())
+	s := newAdminTestServer(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"/ws?username=alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+	var msg Message
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read welcome message: %v", err)
+	}
+
+	resp := adminRequest(t, ctx, http.MethodGet, s.URL+"/admin/connections", "secret")
+	var conns []ConnectionInfo
+	json.NewDecoder(resp.Body).Decode(&conns)
+	resp.Body.Close()
+	if len(conns) != 1 || conns[0].Username != "alice" || conns[0].ID == "" {
+		t.Fatalf("Unexpected connections: %+v", conns)
+	}
+
+	resp = adminRequest(t, ctx, http.MethodGet, s.URL+"/admin/tap?conn=nope", "secret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown connection, got %d", resp.StatusCode)
+	}
+
+	tapResp := adminRequest(t, ctx, http.MethodGet, s.URL+"/admin/tap?redact=true&conn="+conns[0].ID, "secret")
+	defer tapResp.Body.Close()
+	if ct := tapResp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected event stream, got %q", ct)
+	}
+
+	if err := wsjson.Write(ctx, c, Message{Type: "message", Content: "top secret"}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	// Expect the inbound frame followed by the broadcast going out
+	lines := bufio.NewScanner(tapResp.Body)
+	var frames []TapFrame
+	for len(frames) < 2 && lines.Scan() {
+		data, ok := strings.CutPrefix(lines.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var frame TapFrame
+		if err := json.Unmarshal([]byte(data), &frame); err != nil {
+			t.Fatalf("Invalid tap frame %q: %v", data, err)
+		}
+		frames = append(frames, frame)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("Expected 2 tapped frames, got %d", len(frames))
+	}
+	if frames[0].Direction != "in" || frames[1].Direction != "out" {
+		t.Errorf("Unexpected directions: %s, %s", frames[0].Direction, frames[1].Direction)
+	}
+	for _, frame := range frames {
+		if strings.Contains(string(frame.Payload), "top secret") {
+			t.Errorf("Expected content to be redacted: %s", frame.Payload)
+		}
+		if !strings.Contains(string(frame.Payload), `"type":"message"`) || frame.Size == 0 {
+			t.Errorf("Expected message metadata to survive redaction: %+v", frame)
+		}
+	}
+}
+
+func TestRegisterDebugRoutes(t *testing.T) {
+	mux := http.NewServeMux()
+	registerDebugRoutes(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "goroutine") {
+		t.Errorf("Expected pprof index, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// instanceHeader names the instance that served a WebSocket upgrade
+	instanceHeader = "X-Chat-Instance"
+	// defaultAffinityCookie is the cookie load balancers can use to route
+	// reconnects back to the same instance
+	defaultAffinityCookie = "chat_instance"
+	// affinityHeader carries a session's affinity token, on the upgrade
+	// response and on reconnects
+	affinityHeader = "X-Chat-Affinity"
+	// forwardedHeader marks a connection one instance forwarded to
+	// another, naming the instance it came through
+	forwardedHeader = "X-Chat-Forwarded-By"
+	// forwardedForHeader carries the address of the client behind a
+	// forwarded connection, signed with the affinity key, and
+	// forwardedForTTL is how long the signature holds
+	forwardedForHeader = "X-Chat-Forwarded-For"
+	forwardedForTTL    = time.Minute
+	// affinityTokenTTL is how long a session can be resumed after it began
+	affinityTokenTTL = time.Hour * 24
+)
+
+// WithAffinityCookie sets the name of the routing cookie issued on upgrade.
+// An empty name disables the cookie; the header is always sent.
+func WithAffinityCookie(name string) Option {
+	return func(cs *ChatServer) {
+		cs.affinityCookie = name
+	}
+}
+
+// WithAffinityTokens issues every session a token, signed with key, naming
+// the instance serving it. Every instance must share the key, so that a
+// reconnect landing on the wrong one is forwarded to the instance in its
+// token, or resumed where it lands if that instance is gone.
+func WithAffinityTokens(key []byte) Option {
+	return func(cs *ChatServer) {
+		cs.affinityKey = key
+	}
+}
+
+// setRoutingHints marks the upgrade response with this instance's ID so
+// layer-7 load balancers can pin reconnects to it
+func (cs *ChatServer) setRoutingHints(w http.ResponseWriter) {
+	w.Header().Set(instanceHeader, cs.instanceID)
+	cs.pinTo(w, cs.instanceID)
+}
+
+// pinTo sets the routing cookie to an instance
+func (cs *ChatServer) pinTo(w http.ResponseWriter, instance string) {
+	if cs.affinityCookie == "" {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cs.affinityCookie,
+		Value:    instance,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// AffinityToken is the session state an affinity token carries
+type AffinityToken struct {
+	// Node is the instance that served the session
+	Node     string `json:"n"`
+	Username string `json:"u"`
+	// Room is the session's room, empty for the lobby
+	Room    string `json:"r,omitempty"`
+	Guest   bool   `json:"g,omitempty"`
+	Expires int64  `json:"e"`
+}
+
+// AffinitySession hands a v2 client its affinity token after it joins.
+// Reconnecting with the token, in the X-Chat-Affinity header or the
+// affinity query parameter, resumes the session.
+type AffinitySession struct {
+	Type  string `json:"type"`
+	Token string `json:"token"`
+	Node  string `json:"node"`
+}
+
+// signAffinity returns the hex MAC of s under the affinity key
+func (cs *ChatServer) signAffinity(s string) string {
+	mac := hmac.New(sha256.New, cs.affinityKey)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// issueAffinity returns a token for the client's session, or "" without an
+// affinity key. Restricted rooms are left out, so the token can't stand in
+// for a password or invite.
+func (cs *ChatServer) issueAffinity(client *Client, now time.Time) string {
+	if cs.affinityKey == nil || client.canary {
+		return ""
+	}
+	tok := AffinityToken{
+		Node:     cs.instanceID,
+		Username: client.username,
+		Guest:    client.guest,
+		Expires:  now.Add(affinityTokenTTL).Unix(),
+	}
+	if client.room != nil && !client.room.restricted() {
+		tok.Room = client.room.Name
+	}
+	data, _ := json.Marshal(tok)
+	body := base64.RawURLEncoding.EncodeToString(data)
+	return body + "." + cs.signAffinity(body)
+}
+
+// affinityToken returns the valid, unexpired affinity token a reconnecting
+// client presents, if any
+func (cs *ChatServer) affinityToken(r *http.Request, now time.Time) (AffinityToken, bool) {
+	var tok AffinityToken
+	if cs.affinityKey == nil {
+		return tok, false
+	}
+	raw := r.Header.Get(affinityHeader)
+	if raw == "" {
+		raw = r.URL.Query().Get("affinity")
+	}
+	body, mac, ok := strings.Cut(raw, ".")
+	if !ok || !hmac.Equal([]byte(mac), []byte(cs.signAffinity(body))) {
+		return tok, false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil || json.Unmarshal(data, &tok) != nil {
+		return tok, false
+	}
+	return tok, now.Before(time.Unix(tok.Expires, 0))
+}
+
+// forwardSession sends a reconnect holding another instance's affinity
+// token back to that instance, reporting whether it did. Instances that
+// advertise a URL get the connection proxied to them; others are reached
+// by answering 421 Misdirected Request with the routing cookie pointing at
+// them. Reconnects for instances that are gone, and connections already
+// forwarded once, stay here.
+func (cs *ChatServer) forwardSession(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get(forwardedHeader) != "" {
+		return false
+	}
+	tok, ok := cs.affinityToken(r, cs.now())
+	if !ok || tok.Node == cs.instanceID {
+		return false
+	}
+	peers := cs.livePeers()
+	i := slices.IndexFunc(peers, func(p InstanceInfo) bool { return p.ID == tok.Node })
+	if i < 0 {
+		return false
+	}
+	metrics.Add(metricSessionsForwarded, 1)
+	target, err := url.Parse(peers[i].Advertise)
+	if peers[i].Advertise == "" || err != nil || target.Host == "" {
+		cs.pinTo(w, tok.Node)
+		http.Error(w, fmt.Sprintf("session belongs to instance %s", tok.Node), http.StatusMisdirectedRequest)
+		return true
+	}
+	switch target.Scheme {
+	case "ws":
+		target.Scheme = "http"
+	case "wss":
+		target.Scheme = "https"
+	}
+	log.Printf("Forwarding %s's session to instance %s", tok.Username, tok.Node)
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(&url.URL{Scheme: target.Scheme, Host: target.Host})
+			pr.SetXForwarded()
+			pr.Out.Header.Set(forwardedHeader, cs.instanceID)
+			if addr, ok := remoteIP(pr.In); ok {
+				pr.Out.Header.Set(forwardedForHeader, cs.signForwardedFor(addr, cs.now()))
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Forwarding session to instance %s failed: %v", tok.Node, err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+	return true
+}
+
+// signForwardedFor returns the forwarded-for header vouching for a
+// client's address as of now
+func (cs *ChatServer) signForwardedFor(addr netip.Addr, now time.Time) string {
+	body := addr.String() + "|" + strconv.FormatInt(now.Unix(), 10)
+	return body + "|" + cs.signAffinity("forwarded-for|"+body)
+}
+
+// trustForwarded gives a connection another instance forwarded the address
+// of the client behind it, if the forwarded-for header is signed with the
+// affinity key and fresh, so bans, strikes, the gate and bandwidth caps
+// apply to the client rather than the instance
+func (cs *ChatServer) trustForwarded(r *http.Request) {
+	if cs.affinityKey == nil || r.Header.Get(forwardedHeader) == "" {
+		return
+	}
+	raw := r.Header.Get(forwardedForHeader)
+	i := strings.LastIndexByte(raw, '|')
+	if i < 0 || !hmac.Equal([]byte(raw[i+1:]), []byte(cs.signAffinity("forwarded-for|"+raw[:i]))) {
+		return
+	}
+	host, stamp, _ := strings.Cut(raw[:i], "|")
+	addr, err := netip.ParseAddr(host)
+	unix, serr := strconv.ParseInt(stamp, 10, 64)
+	if err != nil || serr != nil {
+		return
+	}
+	if age := cs.now().Sub(time.Unix(unix, 0)); age > forwardedForTTL || age < -forwardedForTTL {
+		return
+	}
+	r.RemoteAddr = netip.AddrPortFrom(addr, 0).String()
+}
+
+// resumeRoom seats a resumed session back in its room, which it was
+// admitted to before. Rooms that are gone, full or restricted leave it in
+// the lobby; joining a restricted room again takes its password or invite.
+func (cs *ChatServer) resumeRoom(name string) *Room {
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	room, ok := cs.rooms[name]
+	if !ok || room.restricted() || room.MaxMembers > 0 && room.members >= room.MaxMembers {
+		return nil
+	}
+	seatLocked(room)
+	return room
+}
+
+// sendAffinity hands a v2 client its affinity token
+func (cs *ChatServer) sendAffinity(ctx context.Context, client *Client) {
+	if client.affinity == "" || client.version == protocolV1 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	err := client.write(ctx, AffinitySession{
+		Type:  "affinity",
+		Token: client.affinity,
+		Node:  cs.instanceID,
+	})
+	if err != nil {
+		client.logf("Error sending affinity token to %s: %v", client.username, err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+var testAffinityKey = []byte("affinity-test-key")
+
+// dialAffinity connects with an affinity token and returns the connection
+// and the upgrade response
+func dialAffinity(t *testing.T, ctx context.Context, s *httptest.Server, query, token string) (*websocket.Conn, *http.Response) {
+	t.Helper()
+	header := http.Header{}
+	if token != "" {
+		header.Set(affinityHeader, token)
+	}
+	c, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+query,
+		&websocket.DialOptions{Subprotocols: []string{subprotocolV2}, HTTPHeader: header})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { c.CloseNow() })
+	return c, resp
+}
+
+// sessionOf waits for username to be connected to server and returns its
+// room
+func sessionOf(t *testing.T, server *ChatServer, username string) string {
+	t.Helper()
+	var room string
+	waitFor(t, username+" to connect", func() bool {
+		client, ok := server.Client(username)
+		room = client.Room
+		return ok
+	})
+	return room
+}
+
+// signedAffinity signs tok as server would
+func signedAffinity(server *ChatServer, tok AffinityToken) string {
+	data, _ := json.Marshal(tok)
+	body := base64.RawURLEncoding.EncodeToString(data)
+	return body + "." + server.signAffinity(body)
+}
+
+func TestAffinityResume(t *testing.T) {
+	server := NewChatServer(WithInstanceID("a"), WithAffinityTokens(testAffinityKey))
+	server.Run(t.Context())
+	for _, opts := range []RoomOptions{{Name: "ops"}, {Name: "vault", Password: "secret"}} {
+		if _, _, err := server.createRoom(opts); err != nil {
+			t.Fatalf("Failed to create room: %v", err)
+		}
+	}
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c, resp := dialAffinity(t, ctx, s, "?room=ops", "")
+	token := resp.Header.Get(affinityHeader)
+	if token == "" {
+		t.Fatalf("Expected an affinity token on the upgrade response")
+	}
+	for {
+		var msg AffinitySession
+		if err := wsjson.Read(ctx, c, &msg); err != nil {
+			t.Fatalf("Failed to read the affinity token: %v", err)
+		}
+		if msg.Type == "affinity" {
+			if msg.Token != token || msg.Node != "a" {
+				t.Errorf("Expected the token sent after joining, got %+v", msg)
+			}
+			break
+		}
+	}
+	c.Close(websocket.StatusNormalClosure, "")
+
+	waitFor(t, "the guest to leave", func() bool {
+		return server.ClientCount() == 0
+	})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(affinityHeader, token)
+	tok, ok := server.affinityToken(r, time.Now())
+	if !ok || !tok.Guest || tok.Room != "ops" {
+		t.Fatalf("Expected a guest's token for ops, got %+v", tok)
+	}
+	guest := tok.Username
+
+	// The token stands in for the name and room
+	dialAffinity(t, ctx, s, "", token)
+	if room := sessionOf(t, server, guest); room != "ops" {
+		t.Errorf("Expected %s resumed in ops, got %q", guest, room)
+	}
+
+	// but not for a room's password
+	_, resp = dialAffinity(t, ctx, s, "?room=vault&password=secret", "")
+	r.Header.Set(affinityHeader, resp.Header.Get(affinityHeader))
+	if tok, ok := server.affinityToken(r, time.Now()); !ok || tok.Room != "" {
+		t.Errorf("Expected a token without the password-protected room, got %+v", tok)
+	}
+	forged := AffinityToken{Node: "a", Username: "eve", Room: "vault", Expires: time.Now().Add(time.Hour).Unix()}
+	dialAffinity(t, ctx, s, "?username=eve", signedAffinity(server, forged))
+	if room := sessionOf(t, server, "eve"); room != "" {
+		t.Errorf("Expected a token naming vault to resume in the lobby, got %q", room)
+	}
+
+	// Tampered tokens start a fresh session
+	dialAffinity(t, ctx, s, "?username=mallory", token[:len(token)-1]+"0")
+	if room := sessionOf(t, server, "mallory"); room != "" {
+		t.Errorf("Expected a tampered token to be ignored, got room %q", room)
+	}
+	if _, ok := server.affinityToken(r, time.Now().Add(affinityTokenTTL+time.Minute)); ok {
+		t.Errorf("Expected an expired token to be refused")
+	}
+}
+
+func TestAffinityForward(t *testing.T) {
+	serverB := NewChatServer(WithInstanceID("b"), WithAffinityTokens(testAffinityKey))
+	serverB.Run(t.Context())
+	b := httptest.NewServer(http.HandlerFunc(serverB.handleConnection))
+	defer b.Close()
+	serverA := NewChatServer(WithInstanceID("a"), WithAffinityTokens(testAffinityKey))
+	serverA.Run(t.Context())
+	// Clients reach a from a public address
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = "203.0.113.7:40000"
+		serverA.handleConnection(w, r)
+	}))
+	defer a.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c, resp := dialAffinity(t, ctx, b, "?username=bob", "")
+	token := resp.Header.Get(affinityHeader)
+	c.Close(websocket.StatusNormalClosure, "")
+
+	// An instance that doesn't know b resumes the session itself
+	c, resp = dialAffinity(t, ctx, a, "", token)
+	if got := resp.Header.Get(instanceHeader); got != "a" {
+		t.Errorf("Expected a to resume the session of an unknown instance, got %q", got)
+	}
+	sessionOf(t, serverA, "bob")
+	c.Close(websocket.StatusNormalClosure, "")
+	waitFor(t, "bob to leave a", func() bool {
+		serverA.clientsMtx.Lock()
+		defer serverA.clientsMtx.Unlock()
+		return len(serverA.usernames) == 0
+	})
+
+	// Once a knows where b is, the session is forwarded there
+	serverA.recordPeer(InstanceInfo{ID: "b", Advertise: "ws" + strings.TrimPrefix(b.URL, "http")})
+	c, resp = dialAffinity(t, ctx, a, "", token)
+	if got := resp.Header.Get(instanceHeader); got != "b" {
+		t.Errorf("Expected the session forwarded to b, got %q", got)
+	}
+	wsjson.Write(ctx, c, Message{Type: "message", Content: "hi"})
+	if msg := readUntilType(t, ctx, c, "message"); msg.Username != "bob" || msg.Content != "hi" {
+		t.Errorf("Expected bob chatting through the forwarded connection, got %+v", msg)
+	}
+	remoteOf := func(username string) string {
+		serverB.clientsMtx.Lock()
+		defer serverB.clientsMtx.Unlock()
+		return serverB.usernames[username].remoteAddr
+	}
+	if addr := remoteOf("bob"); !strings.HasPrefix(addr, "203.0.113.7:") {
+		t.Errorf("Expected b to see bob's own address, got %s", addr)
+	}
+	c.Close(websocket.StatusNormalClosure, "")
+
+	// Only a forwarded-for header signed with the key is believed
+	header := http.Header{}
+	header.Set(forwardedHeader, "a")
+	header.Set(forwardedForHeader, "198.51.100.1|"+strconv.FormatInt(time.Now().Unix(), 10)+"|forged")
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(b.URL, "http")+"?username=mallory", &websocket.DialOptions{HTTPHeader: header})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.CloseNow()
+	sessionOf(t, serverB, "mallory")
+	if addr := remoteOf("mallory"); strings.HasPrefix(addr, "198.51.100.1:") {
+		t.Errorf("Expected a forged forwarded-for header to be ignored, got %s", addr)
+	}
+
+	// Bans apply to the client behind a forwarded connection
+	if _, err := serverB.bans.Add(netip.MustParsePrefix("203.0.113.7/32"), "spam", 0); err != nil {
+		t.Fatalf("Failed to ban: %v", err)
+	}
+	_, resp, err = websocket.Dial(ctx, "ws"+strings.TrimPrefix(a.URL, "http"), &websocket.DialOptions{HTTPHeader: http.Header{affinityHeader: {token}}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected b to refuse a banned client forwarded by a, got %v", err)
+	}
+
+	// Without an address to forward to, the client is told where to go
+	serverA.recordPeer(InstanceInfo{ID: "b"})
+	_, resp, err = websocket.Dial(ctx, "ws"+strings.TrimPrefix(a.URL, "http")+"?affinity="+token, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusMisdirectedRequest {
+		t.Fatalf("Expected 421 for an instance without an address, got %v", err)
+	}
+	if cookies := resp.Cookies(); len(cookies) != 1 || cookies[0].Value != "b" {
+		t.Errorf("Expected the routing cookie to point at b, got %v", cookies)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// announcementLogSize is how many recent announcements /admin/announcements
+// reports on
+const announcementLogSize = 100
+
+// Segment selects the sessions an announcement goes to. Every criterion
+// that is set must match; an empty segment selects everyone.
+type Segment struct {
+	// Guests selects clients that didn't choose a username
+	Guests bool `json:"guests,omitempty"`
+	// IdleFor selects clients that haven't sent anything for this long,
+	// e.g. "1h"
+	IdleFor string `json:"idle_for,omitempty"`
+	// Rooms selects members of the named rooms ("lobby" for the lobby)
+	Rooms []string `json:"rooms,omitempty"`
+	// Users selects clients by username
+	Users []string `json:"users,omitempty"`
+}
+
+// Announcement records an announcement and how far it got
+type Announcement struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Content   string    `json:"content"`
+	Segment   Segment   `json:"segment"`
+	Targeted  int       `json:"targeted"`
+	Delivered int       `json:"delivered"`
+	// Expires is when the announcement is taken down, if it expires
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// announcementLog keeps the most recent announcements
+type announcementLog struct {
+	mu      sync.Mutex
+	entries []Announcement
+}
+
+// add records an announcement, dropping the oldest beyond the log size
+func (l *announcementLog) add(a Announcement) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, a)
+	if len(l.entries) > announcementLogSize {
+		l.entries = slices.Delete(l.entries, 0, len(l.entries)-announcementLogSize)
+	}
+}
+
+// list returns the recorded announcements, newest first
+func (l *announcementLog) list() []Announcement {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := slices.Clone(l.entries)
+	slices.Reverse(out)
+	if out == nil {
+		out = []Announcement{}
+	}
+	return out
+}
+
+// touch records that the client just sent something
+func (c *Client) touch(now time.Time) {
+	c.lastActive.Store(now.UnixNano())
+}
+
+// matches reports whether the client belongs to the segment at now, given
+// the parsed idle threshold. Callers hold ChatServer.clientsMtx.
+func (s Segment) matches(c *Client, idleFor time.Duration, now time.Time) bool {
+	if s.Guests && !c.guest {
+		return false
+	}
+	if idleFor > 0 && now.Sub(time.Unix(0, c.lastActive.Load())) < idleFor {
+		return false
+	}
+	if len(s.Rooms) > 0 && !slices.Contains(s.Rooms, roomOrLobby(c.roomName())) {
+		return false
+	}
+	if len(s.Users) > 0 && !slices.Contains(s.Users, c.username) {
+		return false
+	}
+	return true
+}
+
+// announce sends content to the local sessions in the segment and returns
+// how many were targeted and how many received it
+func (cs *ChatServer) announce(ctx context.Context, msg Message, seg Segment, idleFor time.Duration) (targeted, delivered int) {
+	now := cs.now()
+	cs.clientsMtx.Lock()
+	var recipients []*Client
+	for client := range cs.clients {
+		if !client.canary && seg.matches(client, idleFor, now) {
+			recipients = append(recipients, client)
+		}
+	}
+	cs.clientsMtx.Unlock()
+
+	for _, client := range recipients {
+		out := msg
+		out.Room = client.roomName()
+		wctx, cancel := context.WithTimeout(ctx, time.Second*5)
+		err := client.writeMessage(wctx, out)
+		cancel()
+		if err != nil {
+			client.logf("Error sending announcement %s: %v", msg.ID, err)
+			continue
+		}
+		delivered++
+	}
+	return len(recipients), delivered
+}
+
+// expireAnnouncement tells the sessions in the announcement's segment to
+// take it down once it expires, with an "unannounce" event carrying its ID
+func (cs *ChatServer) expireAnnouncement(a Announcement) {
+	if a.Expires.IsZero() {
+		return
+	}
+	cs.afterFunc(a.Expires.Sub(cs.now()), func() {
+		now := cs.now()
+		msg := Message{
+			Type:      "unannounce",
+			Username:  "Server",
+			Content:   "An announcement expired",
+			ID:        a.ID,
+			Time:      now.Format(time.RFC3339),
+			Timestamp: now.UnixMilli(),
+			Trace:     newTraceID(),
+		}
+		cs.announce(context.Background(), msg, a.Segment, 0)
+	})
+}
+
+// handleAdminAnnounce serves POST /admin/announce with
+// {"content": "...", "segment": {...}, "expires_in": "1h"}, sending an
+// announcement to the matching sessions on this instance
+func (cs *ChatServer) handleAdminAnnounce(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Content   string  `json:"content"`
+		Segment   Segment `json:"segment"`
+		ExpiresIn string  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if req.Content == "" || messageLength(req.Content) > cs.messageLimit {
+		http.Error(w, fmt.Sprintf("content is required and at most %d characters", cs.messageLimit), http.StatusBadRequest)
+		return
+	}
+	var idleFor time.Duration
+	if req.Segment.IdleFor != "" {
+		d, err := time.ParseDuration(req.Segment.IdleFor)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid idle_for", http.StatusBadRequest)
+			return
+		}
+		idleFor = d
+	}
+	ttl, err := parseExpiry(req.ExpiresIn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := cs.now()
+	a := Announcement{
+		ID:      newMessageID(),
+		Time:    now,
+		Actor:   adminActor(r),
+		Content: req.Content,
+		Segment: req.Segment,
+	}
+	msg := Message{
+		Type:      "announcement",
+		Username:  "Server",
+		Content:   req.Content,
+		ID:        a.ID,
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+		Trace:     newTraceID(),
+	}
+	if ttl > 0 {
+		a.Expires = now.Add(ttl)
+		msg.ExpiresAt = a.Expires.UTC().Format(time.RFC3339)
+	}
+	a.Targeted, a.Delivered = cs.announce(r.Context(), msg, req.Segment, idleFor)
+	cs.announcements.add(a)
+	cs.expireAnnouncement(a)
+	cs.audit(AuditAnnounce, a.Actor, a.ID, req.Content)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// handleAdminAnnouncements serves GET /admin/announcements, reporting the
+// delivery of recent announcements
+func (cs *ChatServer) handleAdminAnnouncements(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cs.announcements.list())
+}
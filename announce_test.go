@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestAdmin_Announce(t *testing.T) {
+	server := NewChatServer(WithAdminToken("secret"))
+	server.Run(t.Context())
+	s := newAdminTestServer(t, server)
+	if _, _, err := server.createRoom(RoomOptions{Name: "ops"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+	v2 := &websocket.DialOptions{Subprotocols: []string{subprotocolV2}}
+
+	dial := func(query string, joins int) *websocket.Conn {
+		t.Helper()
+		c, _, err := websocket.Dial(ctx, wsURL+query, v2)
+		if err != nil {
+			t.Fatalf("Failed to connect with %s: %v", query, err)
+		}
+		t.Cleanup(func() { c.Close(websocket.StatusNormalClosure, "") })
+		for i := 0; i < joins; i++ {
+			var msg Message
+			if err := wsjson.Read(ctx, c, &msg); err != nil {
+				t.Fatalf("Failed to read join notice: %v", err)
+			}
+		}
+		return c
+	}
+	bob := dial("?username=bob&room=ops", 1)
+	guest := dial("", 1)
+	alice := dial("?username=alice", 1)
+	var msg Message
+	wsjson.Read(ctx, guest, &msg) // alice's join notice
+
+	announce := func(body string) Announcement {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, s.URL+"/admin/announce", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to announce %s: %v %v", body, resp, err)
+		}
+		defer resp.Body.Close()
+		var a Announcement
+		json.NewDecoder(resp.Body).Decode(&a)
+		return a
+	}
+	expect := func(c *websocket.Conn, content string) {
+		t.Helper()
+		var msg Message
+		if err := wsjson.Read(ctx, c, &msg); err != nil {
+			t.Fatalf("Failed to read announcement: %v", err)
+		}
+		if msg.Type != "announcement" || msg.Content != content {
+			t.Errorf("Expected announcement %q, got %+v", content, msg)
+		}
+	}
+
+	for _, tc := range []struct {
+		body     string
+		conn     *websocket.Conn
+		targeted int
+	}{
+		{`{"content": "welcome, guests", "segment": {"guests": true}}`, guest, 1},
+		{`{"content": "ops only", "segment": {"rooms": ["ops"]}}`, bob, 1},
+		{`{"content": "hi alice", "segment": {"users": ["alice", "nobody"]}}`, alice, 1},
+		{`{"content": "wake up", "segment": {"idle_for": "1h"}}`, nil, 0},
+	} {
+		a := announce(tc.body)
+		if a.Targeted != tc.targeted || a.Delivered != tc.targeted {
+			t.Errorf("%s: expected %d targeted and delivered, got %+v", tc.body, tc.targeted, a)
+		}
+		if tc.conn != nil {
+			expect(tc.conn, a.Content)
+		}
+	}
+
+	// Everyone gets an unsegmented announcement, and nothing targeted at
+	// someone else before it
+	if a := announce(`{"content": "maintenance at noon"}`); a.Delivered != 3 {
+		t.Errorf("Expected delivery to all 3 sessions, got %+v", a)
+	}
+	for _, c := range []*websocket.Conn{alice, bob, guest} {
+		expect(c, "maintenance at noon")
+	}
+
+	resp := adminRequest(t, ctx, http.MethodGet, s.URL+"/admin/announcements", "secret")
+	defer resp.Body.Close()
+	var list []Announcement
+	json.NewDecoder(resp.Body).Decode(&list)
+	if len(list) != 5 || list[0].Content != "maintenance at noon" {
+		t.Errorf("Expected 5 announcements, newest first, got %+v", list)
+	}
+}
+
+func TestAdmin_AnnouncementExpires(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	server := NewChatServer(WithAdminToken("secret"), WithClock(clock))
+	server.Run(t.Context())
+	s := newAdminTestServer(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+	alice, _, err := websocket.Dial(ctx, wsURL+"?username=alice", &websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	readUntilType(t, ctx, alice, "system")
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, s.URL+"/admin/announce", strings.NewReader(`{"content": "deploy in progress", "expires_in": "30m"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to announce: %v %v", resp, err)
+	}
+	var a Announcement
+	json.NewDecoder(resp.Body).Decode(&a)
+	resp.Body.Close()
+	if !a.Expires.Equal(clock.Now().Add(time.Minute * 30)) {
+		t.Errorf("Expected the announcement to expire in 30m, got %+v", a)
+	}
+	if msg := readUntilType(t, ctx, alice, "announcement"); msg.ExpiresAt == "" {
+		t.Errorf("Expected the announcement to carry its expiry, got %+v", msg)
+	}
+
+	clock.Advance(time.Minute * 30)
+	if msg := readUntilType(t, ctx, alice, "unannounce"); msg.ID != a.ID {
+		t.Errorf("Expected announcement %s to be taken down, got %+v", a.ID, msg)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// auditMemorySize is how many recent entries /admin/audit can page through.
+// Older entries are only kept in the audit file.
+const auditMemorySize = 10000
+
+// Audit actions
+const (
+	AuditAdminAPI   = "admin_api"
+	AuditAuthFailed = "admin_auth_failed"
+	AuditBan        = "ban"
+	AuditUnban      = "unban"
+	AuditPurge      = "purge"
+	AuditQuarantine = "quarantine"
+	AuditRelease    = "release"
+	AuditRemove     = "remove"
+	AuditErase      = "erase"
+	AuditTopic      = "topic"
+	AuditPin        = "pin"
+	AuditUnpin      = "unpin"
+	AuditAnnounce   = "announce"
+	AuditSchedule   = "schedule"
+	AuditUnschedule = "unschedule"
+	AuditMOTD       = "motd"
+	AuditSpam       = "spam_penalty"
+	AuditSlowMode   = "slow_mode"
+	AuditShadowBan  = "shadow_ban"
+	AuditShadowLift = "shadow_unban"
+	AuditBandwidth  = "bandwidth_cap"
+	AuditReload     = "config_reload"
+	AuditACL        = "room_acl"
+
+	AuditIntegrationAdd    = "integration_add"
+	AuditIntegrationRemove = "integration_remove"
+	AuditRecurringAdd      = "recurring_add"
+	AuditRecurringRemove   = "recurring_remove"
+)
+
+// AuditEntry records one moderation or admin action
+type AuditEntry struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Actor  string    `json:"actor"`
+	Target string    `json:"target,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// AuditPage is one page of the audit log, oldest entry first
+type AuditPage struct {
+	Entries []AuditEntry `json:"entries"`
+	HasMore bool         `json:"has_more"`
+}
+
+// AuditLog is an append-only record of moderation and admin actions,
+// optionally written to a JSON lines file
+type AuditLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries []AuditEntry
+	lastSeq uint64
+	// now is the time entries are recorded at
+	now func() time.Time
+}
+
+// NewAuditLog opens the audit log at path, appending to any entries already
+// there. An empty path keeps the log in memory only.
+func NewAuditLog(path string) (*AuditLog, error) {
+	l := &AuditLog{now: time.Now}
+	if path == "" {
+		return l, nil
+	}
+
+	if err := l.load(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	l.file = f
+	return l, nil
+}
+
+// load reads existing entries so sequence numbers continue and recent
+// entries stay browsable after a restart
+func (l *AuditLog) load(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading audit log: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("reading audit log %s line %d: %w", path, line, err)
+		}
+		l.remember(e)
+		l.lastSeq = max(l.lastSeq, e.Seq)
+	}
+	return scanner.Err()
+}
+
+// WithAuditLog records moderation and admin actions to l instead of the
+// default in-memory log
+func WithAuditLog(l *AuditLog) Option {
+	return func(cs *ChatServer) {
+		cs.auditLog = l
+	}
+}
+
+// Record appends an entry, assigning its sequence number and time
+func (l *AuditLog) Record(action, actor, target, reason string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lastSeq++
+	e := AuditEntry{
+		Seq:    l.lastSeq,
+		Time:   l.now().UTC(),
+		Action: action,
+		Actor:  actor,
+		Target: target,
+		Reason: reason,
+	}
+	l.remember(e)
+	if l.file == nil {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(data, '\n'))
+	return err
+}
+
+func (l *AuditLog) remember(e AuditEntry) {
+	if len(l.entries) == auditMemorySize {
+		l.entries = append(l.entries[:0], l.entries[1:]...)
+	}
+	l.entries = append(l.entries, e)
+}
+
+// Before returns up to limit entries with sequence numbers below beforeSeq.
+// A zero beforeSeq returns the most recent entries.
+func (l *AuditLog) Before(beforeSeq uint64, limit int) AuditPage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	end := len(l.entries)
+	if beforeSeq != 0 {
+		for end > 0 && l.entries[end-1].Seq >= beforeSeq {
+			end--
+		}
+	}
+	start := max(end-limit, 0)
+	return AuditPage{
+		Entries: append([]AuditEntry{}, l.entries[start:end]...),
+		HasMore: start > 0,
+	}
+}
+
+// Close closes the audit file
+func (l *AuditLog) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// audit records an action, logging if the entry can't be written
+func (cs *ChatServer) audit(action, actor, target, reason string) {
+	if err := cs.auditLog.Record(action, actor, target, reason); err != nil {
+		log.Printf("Error writing audit log (%s %s by %s): %v", action, target, actor, err)
+	}
+}
+
+// adminActor names the caller of an admin endpoint in the audit log
+func adminActor(r *http.Request) string {
+	if addr, ok := remoteIP(r); ok {
+		return "admin@" + addr.String()
+	}
+	return "admin"
+}
+
+// handleAdminAudit serves GET /admin/audit?before_seq=N&limit=M
+func (cs *ChatServer) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var beforeSeq uint64
+	if v := r.URL.Query().Get("before_seq"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid before_seq", http.StatusBadRequest)
+			return
+		}
+		beforeSeq = n
+	}
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	page := cs.auditLog.Before(beforeSeq, clampHistoryLimit(limit))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog_PagesAndPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := NewAuditLog(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := l.Record(AuditBan, "admin", "10.0.0.1/32", "spam"); err != nil {
+			t.Fatalf("Failed to record entry: %v", err)
+		}
+	}
+	l.Close()
+
+	reopened, err := NewAuditLog(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen audit log: %v", err)
+	}
+	defer reopened.Close()
+	if err := reopened.Record(AuditUnban, "admin", "10.0.0.1/32", ""); err != nil {
+		t.Fatalf("Failed to record entry: %v", err)
+	}
+
+	page := reopened.Before(0, 4)
+	if len(page.Entries) != 4 || page.Entries[0].Seq != 3 || page.Entries[3].Seq != 6 || !page.HasMore {
+		t.Fatalf("Unexpected latest page: %+v", page)
+	}
+	if page.Entries[3].Action != AuditUnban {
+		t.Errorf("Expected newest entry to be the unban, got %+v", page.Entries[3])
+	}
+	page = reopened.Before(3, 4)
+	if len(page.Entries) != 2 || page.Entries[0].Seq != 1 || page.HasMore {
+		t.Errorf("Unexpected older page: %+v", page)
+	}
+}
+
+func TestAdmin_AuditRecordsAdminActions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	server := NewChatServer(WithAdminToken("secret"))
+	s := newAdminTestServer(t, server)
+
+	resp := adminRequest(t, ctx, http.MethodGet, s.URL+"/admin/connections", "wrong")
+	resp.Body.Close()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, s.URL+"/admin/bans",
+		strings.NewReader(`{"cidr":"192.0.2.0/24","reason":"abuse"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to add ban: %v", err)
+	}
+	resp.Body.Close()
+
+	resp = adminRequest(t, ctx, http.MethodGet, s.URL+"/admin/audit", "secret")
+	defer resp.Body.Close()
+	var page AuditPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatalf("Failed to decode audit page: %v", err)
+	}
+
+	var actions []string
+	for _, e := range page.Entries {
+		actions = append(actions, e.Action)
+		if e.Actor == "" || e.Time.IsZero() {
+			t.Errorf("Incomplete audit entry: %+v", e)
+		}
+	}
+	want := []string{AuditAuthFailed, AuditAdminAPI, AuditBan, AuditAdminAPI}
+	if strings.Join(actions, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected actions %v, got %v", want, actions)
+	}
+	if ban := page.Entries[2]; ban.Target != "192.0.2.0/24" || ban.Reason != "abuse" {
+		t.Errorf("Unexpected ban entry: %+v", ban)
+	}
+}
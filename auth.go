@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authentication fallbacks, applied when the verify endpoint can't be
+// reached or fails
+const (
+	// AuthFallbackDeny refuses the connection
+	AuthFallbackDeny = "deny"
+	// AuthFallbackStale accepts an expired cached identity for the token
+	AuthFallbackStale = "stale"
+	// AuthFallbackGuest admits the client as a guest without roles
+	AuthFallbackGuest = "guest"
+)
+
+const (
+	defaultAuthCacheTTL = time.Minute
+	// authNegativeTTL is how long a rejected token stays rejected without
+	// asking the endpoint again
+	authNegativeTTL = time.Second * 10
+	// authStaleTTL bounds how old a cached identity the stale fallback uses
+	authStaleTTL = time.Hour
+	// authCacheSize is how many tokens are cached before old entries are
+	// swept
+	authCacheSize = 10000
+	authTimeout   = time.Second * 5
+)
+
+var (
+	// errUnauthenticated means the token was checked and refused
+	errUnauthenticated = errors.New("invalid or missing token")
+	// errAuthUnavailable means the token couldn't be checked
+	errAuthUnavailable = errors.New("authentication unavailable")
+)
+
+// Identity is who a verified token belongs to
+type Identity struct {
+	Username string   `json:"username"`
+	Roles    []string `json:"roles,omitempty"`
+	// DisplayName, if set, becomes the display name of the client's
+	// profile
+	DisplayName string `json:"display_name,omitempty"`
+	// Guest is set when the client was admitted by the guest fallback
+	Guest bool `json:"-"`
+}
+
+// Authenticator verifies the token a client connects with
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (*Identity, error)
+}
+
+// WithAuthenticator requires clients to present a token that a accepts.
+// The identity it returns names the client, which can't rename itself.
+func WithAuthenticator(a Authenticator) Option {
+	return func(cs *ChatServer) {
+		cs.auth = a
+	}
+}
+
+// authCacheEntry is a cached verification result
+type authCacheEntry struct {
+	identity *Identity // nil if the token was refused
+	expires  time.Time
+	verified time.Time
+}
+
+// WebhookAuthenticator delegates token verification to an HTTP endpoint.
+// It POSTs {"token": "..."} to the endpoint, which answers 200 with an
+// Identity or 401/403 to refuse the token. Results are cached by token
+// hash.
+type WebhookAuthenticator struct {
+	url      string
+	client   *http.Client
+	ttl      time.Duration
+	fallback string
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]authCacheEntry
+	// now is the time cached results expire by
+	now func() time.Time
+}
+
+// NewWebhookAuthenticator verifies tokens against url, caching identities
+// for ttl and applying fallback when the endpoint fails
+func NewWebhookAuthenticator(url string, ttl time.Duration, fallback string) (*WebhookAuthenticator, error) {
+	switch fallback {
+	case AuthFallbackDeny, AuthFallbackStale, AuthFallbackGuest:
+	default:
+		return nil, fmt.Errorf("unknown auth fallback %q (deny, stale or guest)", fallback)
+	}
+	return &WebhookAuthenticator{
+		url:      url,
+		client:   &http.Client{Timeout: authTimeout},
+		ttl:      ttl,
+		fallback: fallback,
+		cache:    make(map[[sha256.Size]byte]authCacheEntry),
+		now:      time.Now,
+	}, nil
+}
+
+// Authenticate verifies token, answering from the cache when it can
+func (a *WebhookAuthenticator) Authenticate(ctx context.Context, token string) (*Identity, error) {
+	if token == "" {
+		return nil, errUnauthenticated
+	}
+	key := sha256.Sum256([]byte(token))
+	now := a.now()
+
+	a.mu.Lock()
+	entry, cached := a.cache[key]
+	a.mu.Unlock()
+	if cached && now.Before(entry.expires) {
+		if entry.identity == nil {
+			return nil, errUnauthenticated
+		}
+		return entry.identity, nil
+	}
+
+	identity, err := a.verify(ctx, token)
+	switch {
+	case errors.Is(err, errUnauthenticated):
+		a.store(key, authCacheEntry{expires: now.Add(authNegativeTTL), verified: now})
+		return nil, err
+	case err != nil:
+		return a.fallbackFor(entry, cached, now, err)
+	}
+	a.store(key, authCacheEntry{identity: identity, expires: now.Add(a.ttl), verified: now})
+	return identity, nil
+}
+
+// fallbackFor applies the fallback policy after the endpoint failed
+func (a *WebhookAuthenticator) fallbackFor(entry authCacheEntry, cached bool, now time.Time, err error) (*Identity, error) {
+	switch a.fallback {
+	case AuthFallbackStale:
+		if cached && entry.identity != nil && now.Sub(entry.verified) < authStaleTTL {
+			return entry.identity, nil
+		}
+	case AuthFallbackGuest:
+		return &Identity{Guest: true}, nil
+	}
+	return nil, fmt.Errorf("%w: %v", errAuthUnavailable, err)
+}
+
+// store caches a result. A full cache is swept of the entries that no
+// longer answer anything, and if live entries still fill it, arbitrary ones
+// are dropped, which only costs their tokens another check.
+func (a *WebhookAuthenticator) store(key [sha256.Size]byte, entry authCacheEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.cache) >= authCacheSize {
+		now := a.now()
+		for k, e := range a.cache {
+			if !a.useful(e, now) {
+				delete(a.cache, k)
+			}
+		}
+		for k := range a.cache {
+			if len(a.cache) < authCacheSize-authCacheSize/10 {
+				break
+			}
+			delete(a.cache, k)
+		}
+	}
+	a.cache[key] = entry
+}
+
+// useful reports whether a cached entry can still answer at now: it hasn't
+// expired, or it is an identity the stale fallback may fall back on
+func (a *WebhookAuthenticator) useful(e authCacheEntry, now time.Time) bool {
+	if now.Before(e.expires) {
+		return true
+	}
+	return a.fallback == AuthFallbackStale && e.identity != nil && now.Sub(e.verified) < authStaleTTL
+}
+
+// verify asks the endpoint about token
+func (a *WebhookAuthenticator) verify(ctx context.Context, token string) (*Identity, error) {
+	body, _ := json.Marshal(map[string]string{"token": token})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, errUnauthenticated
+	default:
+		return nil, fmt.Errorf("verify endpoint returned %s", resp.Status)
+	}
+	var identity Identity
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&identity); err != nil {
+		return nil, fmt.Errorf("invalid verify response: %w", err)
+	}
+	if identity.Username == "" {
+		return nil, errors.New("verify response has no username")
+	}
+	return &identity, nil
+}
+
+// requestToken returns the token a client connects with, from an
+// Authorization bearer header or, for browsers that can't set headers on
+// WebSocket requests, the token query parameter
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authenticate verifies the connecting client, writing an HTTP error and
+// returning nil if it is refused
+func (cs *ChatServer) authenticate(w http.ResponseWriter, r *http.Request) *Identity {
+	identity, err := cs.auth.Authenticate(r.Context(), requestToken(r))
+	switch {
+	case errors.Is(err, errUnauthenticated):
+		cs.strike(r, "failed authentication")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chat"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil
+	case err != nil:
+		log.Printf("Authentication failed for %s: %v", r.RemoteAddr, err)
+		http.Error(w, "authentication unavailable", http.StatusServiceUnavailable)
+		return nil
+	}
+	return identity
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// newVerifyServer stubs an operator's verify endpoint: "alice-token" is
+// alice, a moderator, and anything else is refused. While down is set it
+// fails with 500.
+func newVerifyServer(t *testing.T, calls *atomic.Int32, down *atomic.Bool) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if down.Load() {
+			http.Error(w, "oops", http.StatusInternalServerError)
+			return
+		}
+		var req struct{ Token string }
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Token != "alice-token" {
+			http.Error(w, "no", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(Identity{Username: "alice", Roles: []string{"moderator"}})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestWebhookAuthenticator(t *testing.T) {
+	var calls atomic.Int32
+	var down atomic.Bool
+	verify := newVerifyServer(t, &calls, &down)
+	ctx := context.Background()
+
+	auth, err := NewWebhookAuthenticator(verify.URL, time.Minute, AuthFallbackDeny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := auth.Authenticate(ctx, "alice-token")
+	if err != nil || id.Username != "alice" || len(id.Roles) != 1 {
+		t.Fatalf("Expected alice, got %+v (%v)", id, err)
+	}
+	auth.Authenticate(ctx, "alice-token")
+	if calls.Load() != 1 {
+		t.Errorf("Expected the identity to be cached, got %d calls", calls.Load())
+	}
+	for range 2 {
+		if _, err := auth.Authenticate(ctx, "mallory-token"); !errors.Is(err, errUnauthenticated) {
+			t.Errorf("Expected refusal, got %v", err)
+		}
+	}
+	if calls.Load() != 2 {
+		t.Errorf("Expected the refusal to be cached, got %d calls", calls.Load())
+	}
+	if _, err := auth.Authenticate(ctx, ""); !errors.Is(err, errUnauthenticated) {
+		t.Errorf("Expected a missing token to be refused, got %v", err)
+	}
+
+	// Fallbacks apply once cached identities expire and the endpoint fails
+	down.Store(true)
+	for fallback, wantGuest := range map[string]bool{AuthFallbackStale: false, AuthFallbackGuest: true} {
+		auth, _ := NewWebhookAuthenticator(verify.URL, time.Nanosecond, fallback)
+		down.Store(false)
+		auth.Authenticate(ctx, "alice-token")
+		down.Store(true)
+		id, err := auth.Authenticate(ctx, "alice-token")
+		if err != nil || id.Guest != wantGuest {
+			t.Errorf("%s: unexpected identity %+v (%v)", fallback, id, err)
+		}
+	}
+	auth, _ = NewWebhookAuthenticator(verify.URL, time.Nanosecond, AuthFallbackDeny)
+	if _, err := auth.Authenticate(ctx, "alice-token"); !errors.Is(err, errAuthUnavailable) {
+		t.Errorf("Expected deny fallback to fail, got %v", err)
+	}
+
+	if _, err := NewWebhookAuthenticator(verify.URL, time.Minute, "maybe"); err == nil {
+		t.Error("Expected an unknown fallback to be rejected")
+	}
+}
+
+func TestChatServer_Authentication(t *testing.T) {
+	var calls atomic.Int32
+	var down atomic.Bool
+	verify := newVerifyServer(t, &calls, &down)
+	auth, _ := NewWebhookAuthenticator(verify.URL, time.Minute, AuthFallbackDeny)
+
+	server := NewChatServer(WithAuthenticator(auth))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, resp, err := websocket.Dial(ctx, wsURL+"?username=alice&token=forged", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a bad token, got %v", resp)
+	}
+
+	// The identity names the client, whatever it asks for
+	c, _, err := websocket.Dial(ctx, wsURL+"?username=bob", &websocket.DialOptions{
+		HTTPHeader: http.Header{"Authorization": {"Bearer alice-token"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+	var msg Message
+	if err := wsjson.Read(ctx, c, &msg); err != nil || !strings.HasPrefix(msg.Content, "alice has joined") {
+		t.Fatalf("Expected alice to join, got %+v (%v)", msg, err)
+	}
+
+	wsjson.Write(ctx, c, Message{Type: "message", Content: "/nick bob"})
+	if err := wsjson.Read(ctx, c, &msg); err != nil || !strings.Contains(msg.Content, "can't be changed") {
+		t.Errorf("Expected the rename to be refused, got %+v (%v)", msg, err)
+	}
+}
+
+func TestWebhookAuthenticator_CacheBound(t *testing.T) {
+	auth, _ := NewWebhookAuthenticator("http://verify.invalid", time.Minute, AuthFallbackStale)
+	now := time.Unix(1700000000, 0)
+	auth.now = func() time.Time { return now }
+	keyOf := func(i int) [sha256.Size]byte { return sha256.Sum256([]byte(strconv.Itoa(i))) }
+
+	// Refusals and expired identities the stale fallback can't use go first
+	alice := keyOf(-1)
+	auth.cache[alice] = authCacheEntry{identity: &Identity{Username: "alice"}, expires: now.Add(-time.Second), verified: now.Add(-time.Minute)}
+	for i := range authCacheSize {
+		auth.cache[keyOf(i)] = authCacheEntry{expires: now.Add(-time.Second), verified: now.Add(-authNegativeTTL)}
+	}
+	auth.store(keyOf(authCacheSize), authCacheEntry{expires: now.Add(authNegativeTTL), verified: now})
+	if _, ok := auth.cache[alice]; !ok || len(auth.cache) != 2 {
+		t.Errorf("Expected only alice's stale identity and the new entry left, got %d entries", len(auth.cache))
+	}
+
+	// Live entries alone can't grow the cache past its size
+	for i := range authCacheSize * 2 {
+		auth.store(keyOf(i), authCacheEntry{expires: now.Add(authNegativeTTL), verified: now})
+	}
+	if n := len(auth.cache); n > authCacheSize {
+		t.Errorf("Expected at most %d cached tokens, got %d", authCacheSize, n)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// defaultBandwidthBurst is how many seconds of traffic at the capped rate
+// a client may send at once when no burst is configured
+const defaultBandwidthBurst = 5
+
+// trafficCounter counts payload bytes received from and sent to clients
+type trafficCounter struct {
+	in  atomic.Int64
+	out atomic.Int64
+}
+
+// BandwidthCap limits the bytes a client may send
+type BandwidthCap struct {
+	// BytesPerSecond is the sustained rate; zero disables the cap
+	BytesPerSecond int64
+	// Burst is how many bytes may be sent at once; zero allows five
+	// seconds' worth
+	Burst int64
+	// Disconnect drops clients over the cap instead of slowing them down
+	Disconnect bool
+}
+
+// tokenBucket meters a client's inbound bytes. Only the client's own
+// handler touches it.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// ClientBandwidth is a connection's traffic for the admin API
+type ClientBandwidth struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Room     string `json:"room"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+}
+
+// RoomBandwidth is the traffic of a room's connections on this instance
+type RoomBandwidth struct {
+	Room     string `json:"room"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+}
+
+// BandwidthReport is the answer to GET /admin/bandwidth
+type BandwidthReport struct {
+	Clients []ClientBandwidth `json:"clients"`
+	Rooms   []RoomBandwidth   `json:"rooms"`
+}
+
+// WithBandwidthCap throttles or disconnects clients that send more than
+// the cap allows
+func WithBandwidthCap(limit BandwidthCap) Option {
+	return func(cs *ChatServer) {
+		if limit.Burst <= 0 {
+			limit.Burst = limit.BytesPerSecond * defaultBandwidthBurst
+		}
+		cs.bandwidthCap.Store(&limit)
+	}
+}
+
+// countIn records n bytes received from the client
+func (c *Client) countIn(n int) {
+	c.traffic.in.Add(int64(n))
+	if c.roomTraffic != nil {
+		c.roomTraffic.in.Add(int64(n))
+	}
+	metrics.Add(metricPayloadBytesIn, int64(n))
+}
+
+// countOut records n bytes sent to the client
+func (c *Client) countOut(n int) {
+	c.traffic.out.Add(int64(n))
+	if c.roomTraffic != nil {
+		c.roomTraffic.out.Add(int64(n))
+	}
+	metrics.Add(metricPayloadBytesOut, int64(n))
+}
+
+// take removes n bytes' worth of tokens and returns how long the client
+// would have to wait for the bucket to cover them
+func (b *tokenBucket) take(n int64, limit BandwidthCap, now time.Time) time.Duration {
+	rate, burst := float64(limit.BytesPerSecond), float64(limit.Burst)
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+rate*now.Sub(b.last).Seconds())
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// meterIn charges n received bytes against the client's cap, slowing the
+// handler down until the client is back within it or disconnecting the
+// client. It reports whether the handler should carry on.
+func (cs *ChatServer) meterIn(ctx context.Context, client *Client, n int64) bool {
+	limit := cs.bandwidthCap.Load()
+	if limit == nil || limit.BytesPerSecond <= 0 {
+		return true
+	}
+	wait := client.inBucket.take(n, *limit, cs.now())
+	if wait <= 0 {
+		return true
+	}
+	if limit.Disconnect {
+		metrics.Add(metricBandwidthDisconnected, 1)
+		reason := fmt.Sprintf("over %d bytes per second", limit.BytesPerSecond)
+		client.logf("Disconnecting %s for bandwidth: %s", client.username, reason)
+		cs.audit(AuditBandwidth, "system", client.id, reason)
+		client.close(websocket.StatusPolicyViolation, "bandwidth cap exceeded")
+		return false
+	}
+
+	// Not reading applies backpressure all the way to the client
+	metrics.Add(metricBandwidthThrottled, 1)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// handleAdminBandwidth serves GET /admin/bandwidth, the bytes each
+// connection and each room has received and sent
+func (cs *ChatServer) handleAdminBandwidth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := BandwidthReport{Clients: []ClientBandwidth{}}
+	cs.clientsMtx.Lock()
+	for client := range cs.clients {
+		report.Clients = append(report.Clients, ClientBandwidth{
+			ID:       client.id,
+			Username: client.username,
+			Room:     roomOrLobby(client.roomName()),
+			BytesIn:  client.traffic.in.Load(),
+			BytesOut: client.traffic.out.Load(),
+		})
+	}
+	cs.clientsMtx.Unlock()
+
+	cs.roomsMtx.Lock()
+	rooms := []*Room{cs.lobby}
+	for _, room := range cs.rooms {
+		rooms = append(rooms, room)
+	}
+	cs.roomsMtx.Unlock()
+	for _, room := range rooms {
+		report.Rooms = append(report.Rooms, RoomBandwidth{
+			Room:     room.Name,
+			BytesIn:  room.traffic.in.Load(),
+			BytesOut: room.traffic.out.Load(),
+		})
+	}
+
+	sort.Slice(report.Clients, func(i, j int) bool {
+		a, b := report.Clients[i], report.Clients[j]
+		return a.BytesIn+a.BytesOut > b.BytesIn+b.BytesOut
+	})
+	sort.Slice(report.Rooms, func(i, j int) bool {
+		a, b := report.Rooms[i], report.Rooms[j]
+		return a.BytesIn+a.BytesOut > b.BytesIn+b.BytesOut
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestTokenBucket(t *testing.T) {
+	limit := BandwidthCap{BytesPerSecond: 100, Burst: 200}
+	var b tokenBucket
+	now := time.Now()
+	if wait := b.take(150, limit, now); wait != 0 {
+		t.Errorf("Expected a burst to pass, got a wait of %v", wait)
+	}
+	if wait := b.take(100, limit, now); wait != time.Millisecond*500 {
+		t.Errorf("Expected to wait 500ms for 50 missing bytes, got %v", wait)
+	}
+	if wait := b.take(50, limit, now.Add(time.Second)); wait != 0 {
+		t.Errorf("Expected the bucket to refill, got a wait of %v", wait)
+	}
+}
+
+func TestAdminBandwidth(t *testing.T) {
+	server := NewChatServer(WithAdminToken("secret"))
+	server.Run(t.Context())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.handleConnection)
+	server.registerAdminRoutes(mux)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: strings.Repeat("x", 1000)})
+	readUntilType(t, ctx, alice, "message")
+
+	resp := adminRequest(t, ctx, http.MethodGet, s.URL+"/admin/bandwidth", "secret")
+	defer resp.Body.Close()
+	var report BandwidthReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if len(report.Clients) != 1 || report.Clients[0].Username != "alice" || report.Clients[0].BytesIn < 1000 || report.Clients[0].BytesOut < 1000 {
+		t.Fatalf("Expected alice's traffic, got %+v", report.Clients)
+	}
+	if len(report.Rooms) != 1 || report.Rooms[0].Room != lobbyRoom || report.Rooms[0].BytesIn != report.Clients[0].BytesIn {
+		t.Errorf("Expected the lobby to carry alice's traffic, got %+v", report.Rooms)
+	}
+}
+
+func TestBandwidthCap_Disconnect(t *testing.T) {
+	server := NewChatServer(WithBandwidthCap(BandwidthCap{BytesPerSecond: 100, Burst: 500, Disconnect: true}))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "small"})
+	readUntilType(t, ctx, alice, "message")
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: strings.Repeat("x", 600)})
+	for {
+		var msg Message
+		if err := wsjson.Read(ctx, alice, &msg); err != nil {
+			if websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+				t.Fatalf("Expected a policy violation close, got %v", err)
+			}
+			break
+		}
+		if msg.Type == "message" && len(msg.Content) == 600 {
+			t.Fatalf("Expected the message over the cap to be dropped")
+		}
+	}
+	entries := server.auditLog.Before(0, 10).Entries
+	if len(entries) == 0 || entries[len(entries)-1].Action != AuditBandwidth {
+		t.Errorf("Expected the disconnect audited, got %+v", entries)
+	}
+}
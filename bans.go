@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BanEntry is one entry in the IP deny list
+type BanEntry struct {
+	CIDR    string    `json:"cidr"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	// Expires is zero for permanent bans
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// expired reports whether a temporary ban has run out
+func (e BanEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// BanList is an IP/CIDR deny list, optionally persisted to a JSON file.
+// It also counts abuse strikes per address and bans repeat offenders
+// temporarily.
+type BanList struct {
+	mu      sync.Mutex
+	entries map[netip.Prefix]BanEntry
+	path    string
+
+	// Automatic bans, disabled while strikeLimit is zero
+	strikeLimit  int
+	strikeWindow time.Duration
+	autoBanFor   time.Duration
+	strikes      map[netip.Addr][]time.Time
+
+	// now is the time bans are made and expire by
+	now func() time.Time
+}
+
+// NewBanList creates a deny list persisted to path, loading any entries
+// already stored there. An empty path keeps the list in memory only.
+func NewBanList(path string) (*BanList, error) {
+	b := newBanList(path)
+	if path == "" {
+		return b, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading ban list: %w", err)
+	}
+	var entries []BanEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parsing ban list %s: %w", path, err)
+	}
+	for _, e := range entries {
+		prefix, err := parseBanPrefix(e.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("parsing ban list %s: %w", path, err)
+		}
+		e.CIDR = prefix.String()
+		b.entries[prefix] = e
+	}
+	return b, nil
+}
+
+func newBanList(path string) *BanList {
+	return &BanList{
+		entries: make(map[netip.Prefix]BanEntry),
+		path:    path,
+		strikes: make(map[netip.Addr][]time.Time),
+		now:     time.Now,
+	}
+}
+
+// AutoBan bans an address for duration once it collects limit strikes
+// within window. A zero limit disables automatic bans.
+func (b *BanList) AutoBan(limit int, window, duration time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.strikeLimit = limit
+	b.strikeWindow = window
+	b.autoBanFor = duration
+}
+
+// WithBanList enforces b on incoming connections instead of the default
+// empty in-memory list
+func WithBanList(b *BanList) Option {
+	return func(cs *ChatServer) {
+		cs.bans = b
+	}
+}
+
+// parseBanPrefix accepts a CIDR or a single address
+func parseBanPrefix(s string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP or CIDR %q", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Add bans prefix, permanently if ttl is zero
+func (b *BanList) Add(prefix netip.Prefix, reason string, ttl time.Duration) (BanEntry, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.addLocked(prefix, reason, ttl)
+}
+
+func (b *BanList) addLocked(prefix netip.Prefix, reason string, ttl time.Duration) (BanEntry, error) {
+	now := b.now()
+	e := BanEntry{CIDR: prefix.String(), Reason: reason, Created: now}
+	if ttl > 0 {
+		e.Expires = now.Add(ttl)
+	}
+	b.entries[prefix] = e
+	return e, b.saveLocked()
+}
+
+// Remove lifts the ban on prefix, reporting whether there was one
+func (b *BanList) Remove(prefix netip.Prefix) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.entries[prefix]; !ok {
+		return false, nil
+	}
+	delete(b.entries, prefix)
+	return true, b.saveLocked()
+}
+
+// List returns the active bans ordered by CIDR
+func (b *BanList) List() []BanEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	list := make([]BanEntry, 0, len(b.entries))
+	for _, e := range b.entries {
+		if !e.expired(now) {
+			list = append(list, e)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CIDR < list[j].CIDR })
+	return list
+}
+
+// Banned returns the ban covering addr, if any
+func (b *BanList) Banned(addr netip.Addr) (BanEntry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	addr = addr.Unmap()
+	now := b.now()
+	for prefix, e := range b.entries {
+		if prefix.Contains(addr) && !e.expired(now) {
+			return e, true
+		}
+	}
+	return BanEntry{}, false
+}
+
+// Strike records an abuse event from addr and bans it once it reaches the
+// strike limit, returning the new ban
+func (b *BanList) Strike(addr netip.Addr, reason string) (BanEntry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.strikeLimit <= 0 {
+		return BanEntry{}, false
+	}
+
+	addr = addr.Unmap()
+	now := b.now()
+	recent := b.strikes[addr][:0]
+	for _, t := range b.strikes[addr] {
+		if now.Sub(t) < b.strikeWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < b.strikeLimit {
+		b.strikes[addr] = recent
+		return BanEntry{}, false
+	}
+
+	delete(b.strikes, addr)
+	prefix := netip.PrefixFrom(addr, addr.BitLen())
+	log.Printf("Banning %s for %s after %d strikes (%s)", addr, b.autoBanFor, len(recent), reason)
+	e, err := b.addLocked(prefix, "automatic: "+reason, b.autoBanFor)
+	if err != nil {
+		log.Printf("Error saving ban list: %v", err)
+	}
+	return e, true
+}
+
+// saveLocked writes the list to disk, dropping expired bans
+func (b *BanList) saveLocked() error {
+	now := b.now()
+	entries := make([]BanEntry, 0, len(b.entries))
+	for prefix, e := range b.entries {
+		if e.expired(now) {
+			delete(b.entries, prefix)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if b.path == "" {
+		return nil
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].CIDR < entries[j].CIDR })
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write then rename so a crash never leaves a truncated list
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), ".bans-*")
+	if err != nil {
+		return fmt.Errorf("saving ban list: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("saving ban list: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("saving ban list: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), b.path); err != nil {
+		return fmt.Errorf("saving ban list: %w", err)
+	}
+	return nil
+}
+
+// remoteIP extracts the client address from a request
+func remoteIP(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// rejectBanned answers 403 and returns true if the request comes from a
+// banned address
+func (cs *ChatServer) rejectBanned(w http.ResponseWriter, r *http.Request) bool {
+	addr, ok := remoteIP(r)
+	if !ok {
+		return false
+	}
+	if e, banned := cs.bans.Banned(addr); banned {
+		log.Printf("Rejected connection from banned address %s (%s)", addr, e.CIDR)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// strike records an abuse event from the request's address
+func (cs *ChatServer) strike(r *http.Request, reason string) {
+	addr, ok := remoteIP(r)
+	if !ok {
+		return
+	}
+	if e, banned := cs.bans.Strike(addr, reason); banned {
+		cs.audit(AuditBan, "system", e.CIDR, e.Reason)
+	}
+}
+
+// banRequest is the body of POST /admin/bans
+type banRequest struct {
+	CIDR   string `json:"cidr"`
+	Reason string `json:"reason"`
+	// Duration is a Go duration such as "1h"; empty bans permanently
+	Duration string `json:"duration"`
+}
+
+// handleAdminBans serves GET, POST and DELETE /admin/bans
+func (cs *ChatServer) handleAdminBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cs.bans.List())
+
+	case http.MethodPost:
+		var req banRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		prefix, err := parseBanPrefix(req.CIDR)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var ttl time.Duration
+		if req.Duration != "" {
+			if ttl, err = time.ParseDuration(req.Duration); err != nil || ttl <= 0 {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+		}
+		e, err := cs.bans.Add(prefix, req.Reason, ttl)
+		cs.audit(AuditBan, adminActor(r), e.CIDR, e.Reason)
+		if err != nil {
+			log.Printf("Error saving ban list: %v", err)
+			http.Error(w, "ban applied but not persisted", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Banned %s: %s", e.CIDR, e.Reason)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(e)
+
+	case http.MethodDelete:
+		prefix, err := parseBanPrefix(r.URL.Query().Get("cidr"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		removed, err := cs.bans.Remove(prefix)
+		if removed {
+			cs.audit(AuditUnban, adminActor(r), prefix.String(), r.URL.Query().Get("reason"))
+		}
+		if err != nil {
+			log.Printf("Error saving ban list: %v", err)
+			http.Error(w, "ban lifted but not persisted", http.StatusInternalServerError)
+			return
+		}
+		if !removed {
+			http.Error(w, "no such ban", http.StatusNotFound)
+			return
+		}
+		log.Printf("Lifted ban on %s", prefix)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
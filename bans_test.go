@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestParseBanPrefix(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", false},
+		{"10.1.2.3/8", "10.0.0.0/8", false},
+		{"192.168.1.5", "192.168.1.5/32", false},
+		{"::ffff:192.168.1.5", "192.168.1.5/32", false},
+		{"2001:db8::/32", "2001:db8::/32", false},
+		{"not-an-ip", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseBanPrefix(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseBanPrefix(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("parseBanPrefix(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestBanList_PersistsAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	b, err := NewBanList(path)
+	if err != nil {
+		t.Fatalf("Failed to create ban list: %v", err)
+	}
+	if _, err := b.Add(netip.MustParsePrefix("10.0.0.0/8"), "spam", 0); err != nil {
+		t.Fatalf("Failed to add ban: %v", err)
+	}
+	if _, err := b.Add(netip.MustParsePrefix("192.0.2.1/32"), "brief", time.Millisecond); err != nil {
+		t.Fatalf("Failed to add ban: %v", err)
+	}
+	time.Sleep(time.Millisecond * 5)
+
+	reloaded, err := NewBanList(path)
+	if err != nil {
+		t.Fatalf("Failed to reload ban list: %v", err)
+	}
+	if e, ok := reloaded.Banned(netip.MustParseAddr("10.20.30.40")); !ok || e.Reason != "spam" {
+		t.Errorf("Expected 10.20.30.40 to be banned after reload, got %+v, %v", e, ok)
+	}
+	if _, ok := reloaded.Banned(netip.MustParseAddr("192.0.2.1")); ok {
+		t.Error("Expected expired ban to be ignored")
+	}
+	if list := reloaded.List(); len(list) != 1 {
+		t.Errorf("Expected 1 active ban, got %+v", list)
+	}
+
+	if removed, err := reloaded.Remove(netip.MustParsePrefix("10.0.0.0/8")); !removed || err != nil {
+		t.Fatalf("Failed to remove ban: %v, %v", removed, err)
+	}
+	again, err := NewBanList(path)
+	if err != nil {
+		t.Fatalf("Failed to reload ban list: %v", err)
+	}
+	if len(again.List()) != 0 {
+		t.Errorf("Expected removal to be persisted, got %+v", again.List())
+	}
+}
+
+func TestBanList_AutoBan(t *testing.T) {
+	b := newBanList("")
+	b.AutoBan(3, time.Minute, time.Hour)
+	addr := netip.MustParseAddr("198.51.100.7")
+
+	for i := 0; i < 2; i++ {
+		b.Strike(addr, "test")
+	}
+	if _, ok := b.Banned(addr); ok {
+		t.Fatal("Expected no ban below the strike limit")
+	}
+	b.Strike(addr, "test")
+	e, ok := b.Banned(addr)
+	if !ok {
+		t.Fatal("Expected ban after reaching the strike limit")
+	}
+	if e.Expires.IsZero() || !strings.HasPrefix(e.Reason, "automatic") {
+		t.Errorf("Expected temporary automatic ban, got %+v", e)
+	}
+}
+
+func TestAdmin_Bans(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	server := NewChatServer(WithAdminToken("secret"))
+	server.Run(t.Context())
+	s := newAdminTestServer(t, server)
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, s.URL+"/admin/bans",
+		strings.NewReader(`{"cidr":"127.0.0.0/8","reason":"testing","duration":"1h"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to add ban: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", resp.StatusCode)
+	}
+
+	_, resp, err = websocket.Dial(ctx, wsURL+"?username=mallory", nil)
+	if err == nil {
+		t.Fatal("Expected banned address to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for banned address, got %v", resp)
+	}
+
+	// The admin API itself is closed to banned addresses, so lift the ban
+	// through the list directly
+	server.bans.Remove(netip.MustParsePrefix("127.0.0.0/8"))
+	resp = adminRequest(t, ctx, http.MethodGet, s.URL+"/admin/bans", "secret")
+	var list []BanEntry
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil || len(list) != 0 {
+		t.Errorf("Expected empty ban list, got %+v, %v", list, err)
+	}
+
+	c, _, err := websocket.Dial(ctx, wsURL+"?username=alice", nil)
+	if err != nil {
+		t.Fatalf("Expected connection after ban was lifted: %v", err)
+	}
+	c.Close(websocket.StatusNormalClosure, "")
+
+	resp = adminRequest(t, ctx, http.MethodDelete, s.URL+"/admin/bans?cidr=127.0.0.0/8", "secret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 deleting a missing ban, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdmin_FailedAuthTriggersAutoBan(t *testing.T) {
+	server := NewChatServer(WithAdminToken("secret"))
+	server.bans.AutoBan(2, time.Minute, time.Hour)
+	s := newAdminTestServer(t, server)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		resp := adminRequest(t, ctx, http.MethodGet, s.URL+"/admin/connections", "wrong")
+		resp.Body.Close()
+	}
+	resp := adminRequest(t, ctx, http.MethodGet, s.URL+"/admin/connections", "secret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 after repeated failed logins, got %d", resp.StatusCode)
+	}
+}
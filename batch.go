@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	// defaultBatchInterval is how often batched events are flushed
+	defaultBatchInterval = time.Millisecond * 250
+	// typingThrottle is how often one client's typing is passed on
+	typingThrottle = time.Second
+)
+
+// BatchConfig sets how high-frequency events are coalesced
+type BatchConfig struct {
+	// Interval is how often batches are sent, defaultBatchInterval if zero
+	Interval time.Duration
+	// Presence batches join and leave notices and status changes too.
+	// Typing indicators are always batched.
+	Presence bool
+}
+
+// Batch carries the events of one batch interval in a single frame
+type Batch struct {
+	Type string `json:"type"`
+	Room string `json:"room,omitempty"`
+	// Typing lists who typed in the room during the interval
+	Typing []string `json:"typing,omitempty"`
+	// Events are the batched notices, in the order they were sequenced
+	Events []Message `json:"events,omitempty"`
+}
+
+// batcher collects events until its next flush
+type batcher struct {
+	cfg BatchConfig
+
+	mu     sync.Mutex
+	typing map[string][]string
+	events []Message
+}
+
+// WithBatching coalesces typing indicators, and optionally presence churn,
+// into one frame per room every interval
+func WithBatching(cfg BatchConfig) Option {
+	return func(cs *ChatServer) {
+		if cfg.Interval <= 0 {
+			cfg.Interval = defaultBatchInterval
+		}
+		cs.batcher.cfg = cfg
+	}
+}
+
+// batched reports whether msg is held for the next batch rather than
+// sent on its own
+func (b *batcher) batched(msg Message) bool {
+	switch {
+	case msg.Type == "typing":
+		return true
+	case msg.Type == "status", msg.Type == "system" && msg.Username == "Server":
+		return b.cfg.Presence
+	}
+	return false
+}
+
+// add holds msg for the next batch
+func (b *batcher) add(msg Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if msg.Type != "typing" {
+		b.events = append(b.events, msg)
+		return
+	}
+	if b.typing == nil {
+		b.typing = make(map[string][]string)
+	}
+	if !slices.Contains(b.typing[msg.Room], msg.Username) {
+		b.typing[msg.Room] = append(b.typing[msg.Room], msg.Username)
+	}
+}
+
+// take empties the batcher, returning what it held
+func (b *batcher) take() (map[string][]string, []Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	typing, events := b.typing, b.events
+	b.typing, b.events = nil, nil
+	return typing, events
+}
+
+// runBatcher flushes batched events every interval until ctx is done
+func (cs *ChatServer) runBatcher(ctx context.Context) {
+	ticker := time.NewTicker(cs.batcher.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cs.flushBatch()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// flushBatch sends every client the batched events for its room
+func (cs *ChatServer) flushBatch() {
+	typing, events := cs.batcher.take()
+	if len(typing) == 0 && len(events) == 0 {
+		return
+	}
+	cs.clientsMtx.Lock()
+	defer cs.clientsMtx.Unlock()
+	for client := range cs.clients {
+		if client.canary {
+			continue
+		}
+		room := client.roomName()
+		batch := Batch{Type: "batch", Room: room, Typing: slices.DeleteFunc(slices.Clone(typing[room]), func(u string) bool { return u == client.username })}
+		for _, msg := range events {
+			global := isGlobal(msg)
+			if !global && msg.Room != room {
+				continue
+			}
+			if global && room != "" {
+				// Global events are sequenced in the lobby
+				msg.Seq = 0
+			}
+			batch.Events = append(batch.Events, msg)
+		}
+		if err := cs.writeBatch(client, batch); err != nil {
+			log.Printf("[conn %s] Error sending batch: %v", client.id, err)
+			client.close(websocket.StatusInternalError, "Failed to send message")
+			delete(cs.clients, client)
+		}
+	}
+}
+
+// writeBatch sends a batch to a client. v1 clients get the events one by
+// one, and no typing indicators.
+func (cs *ChatServer) writeBatch(client *Client, batch Batch) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if client.version != protocolV1 {
+		if len(batch.Typing) == 0 && len(batch.Events) == 0 {
+			return nil
+		}
+		return client.write(ctx, batch)
+	}
+	for _, msg := range batch.Events {
+		if err := client.writeMessage(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleTyping passes on that a client is typing, at most once per
+// typingThrottle. Invisible users type unseen.
+func (cs *ChatServer) handleTyping(client *Client) {
+	now := cs.now()
+	last := client.lastTyping.Load()
+	if now.UnixNano()-last < int64(typingThrottle) || !client.lastTyping.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	cs.clientsMtx.Lock()
+	invisible := client.status == statusInvisible
+	cs.clientsMtx.Unlock()
+	if invisible {
+		return
+	}
+	cs.publish(Message{
+		Type:      "typing",
+		Username:  client.username,
+		Room:      client.roomName(),
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+		Trace:     newTraceID(),
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// readBatch reads until the next batch frame
+func readBatch(t *testing.T, ctx context.Context, c *websocket.Conn) Batch {
+	t.Helper()
+	for {
+		var batch Batch
+		if err := wsjson.Read(ctx, c, &batch); err != nil {
+			t.Fatalf("Failed to read batch: %v", err)
+		}
+		if batch.Type == "batch" {
+			return batch
+		}
+	}
+}
+
+func TestBatchedTyping(t *testing.T) {
+	server := NewChatServer(WithBatching(BatchConfig{Interval: time.Millisecond * 50}))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+	bob := dialStatusTest(t, ctx, s, "bob")
+	carol := dialStatusTest(t, ctx, s, "carol")
+
+	// Repeated keystrokes within the throttle count once, and typists from
+	// one interval share a frame
+	for range 5 {
+		wsjson.Write(ctx, alice, Message{Type: "typing"})
+	}
+	wsjson.Write(ctx, bob, Message{Type: "typing"})
+	var typing []string
+	for len(typing) < 2 {
+		batch := readBatch(t, ctx, carol)
+		typing = append(typing, batch.Typing...)
+	}
+	slices.Sort(typing)
+	if !slices.Equal(typing, []string{"alice", "bob"}) {
+		t.Errorf("Expected alice and bob typing once each, got %v", typing)
+	}
+	if batch := readBatch(t, ctx, alice); slices.Contains(batch.Typing, "alice") {
+		t.Errorf("Expected a typist not to be listed in their own batch, got %v", batch.Typing)
+	}
+}
+
+func TestBatchedPresence(t *testing.T) {
+	server := NewChatServer(WithBatching(BatchConfig{Interval: time.Millisecond * 100, Presence: true}))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	watcher, _, err := websocket.Dial(ctx, wsURL+"?username=watcher", &websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer watcher.CloseNow()
+	readBatch(t, ctx, watcher)
+
+	for _, name := range []string{"a", "b", "c"} {
+		c, _, err := websocket.Dial(ctx, wsURL+"?username="+name, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		c.Close(websocket.StatusNormalClosure, "")
+	}
+	var events []Message
+	for len(events) < 6 {
+		batch := readBatch(t, ctx, watcher)
+		if len(batch.Events) == 0 {
+			t.Fatalf("Expected only non-empty batches")
+		}
+		events = append(events, batch.Events...)
+	}
+	if len(events) != 6 || !strings.Contains(events[0].Content, "a has joined") {
+		t.Errorf("Expected three joins and leaves in order, got %+v", events)
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].Seq <= events[i-1].Seq {
+			t.Errorf("Expected batched events in sequence order, got %d after %d", events[i].Seq, events[i-1].Seq)
+		}
+	}
+}
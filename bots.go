@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWelcome = "Welcome, {user}!"
+	maxDice        = 100
+	maxDieSides    = 1000
+	// maxReminderDelay is how far ahead a reminder may be set, and
+	// maxRemindersPerUser how many one user may have pending
+	maxReminderDelay    = time.Hour * 24
+	maxRemindersPerUser = 10
+)
+
+func init() {
+	RegisterPlugin("welcome", func(config string) (Plugin, error) {
+		if config == "" {
+			config = defaultWelcome
+		}
+		return &welcomeBot{greeting: config}, nil
+	})
+	RegisterPlugin("dice", func(string) (Plugin, error) {
+		return diceBot{}, nil
+	})
+	RegisterPlugin("reminder", func(string) (Plugin, error) {
+		return &reminderBot{pending: make(map[string]int)}, nil
+	})
+}
+
+// welcomeBot greets users privately as they connect. The greeting may
+// name the user with {user} and the room with {room}.
+type welcomeBot struct {
+	BasePlugin
+	greeting string
+}
+
+func (*welcomeBot) Name() string { return "welcome" }
+
+func (b *welcomeBot) OnConnect(_ context.Context, bot *Bot, ev PresenceEvent) {
+	greeting := strings.NewReplacer("{user}", ev.Username, "{room}", roomOrLobby(ev.Room)).Replace(b.greeting)
+	bot.Whisper(ev.Room, ev.Username, greeting)
+}
+
+// diceBot answers /roll NdM, rolling N dice with M sides, 1d6 by default
+type diceBot struct {
+	BasePlugin
+}
+
+func (diceBot) Name() string       { return "dice" }
+func (diceBot) Commands() []string { return []string{"roll"} }
+
+func (diceBot) OnCommand(_ context.Context, bot *Bot, cmd Command) {
+	n, sides, err := parseDice(cmd.Args)
+	if err != nil {
+		bot.Whisper(cmd.Room, cmd.Username, err.Error())
+		return
+	}
+	rolls := make([]string, n)
+	total := 0
+	for i := range rolls {
+		roll, _ := rand.Int(rand.Reader, big.NewInt(int64(sides)))
+		total += int(roll.Int64()) + 1
+		rolls[i] = strconv.FormatInt(roll.Int64()+1, 10)
+	}
+	bot.Say(cmd.Room, fmt.Sprintf("%s rolled %dd%d: %s = %d", cmd.Username, n, sides, strings.Join(rolls, " + "), total))
+}
+
+// parseDice reads dice notation such as "2d6" or "d20"
+func parseDice(s string) (n, sides int, err error) {
+	if s == "" {
+		return 1, 6, nil
+	}
+	count, faces, ok := strings.Cut(strings.ToLower(s), "d")
+	if !ok {
+		return 0, 0, errors.New("usage: /roll NdM, e.g. /roll 2d6")
+	}
+	n = 1
+	if count != "" {
+		if n, err = strconv.Atoi(count); err != nil {
+			return 0, 0, errors.New("usage: /roll NdM, e.g. /roll 2d6")
+		}
+	}
+	if sides, err = strconv.Atoi(faces); err != nil {
+		return 0, 0, errors.New("usage: /roll NdM, e.g. /roll 2d6")
+	}
+	if n < 1 || n > maxDice || sides < 2 || sides > maxDieSides {
+		return 0, 0, fmt.Errorf("roll between 1 and %d dice with 2 to %d sides", maxDice, maxDieSides)
+	}
+	return n, sides, nil
+}
+
+// reminderBot answers /remind <duration> <text>, whispering the text back
+// once the duration has passed. Reminders are kept in memory.
+type reminderBot struct {
+	BasePlugin
+
+	mu      sync.Mutex
+	pending map[string]int
+}
+
+func (*reminderBot) Name() string       { return "reminder" }
+func (*reminderBot) Commands() []string { return []string{"remind"} }
+
+func (b *reminderBot) OnCommand(_ context.Context, bot *Bot, cmd Command) {
+	after, text, _ := strings.Cut(cmd.Args, " ")
+	delay, err := time.ParseDuration(after)
+	text = strings.TrimSpace(text)
+	if err != nil || text == "" {
+		bot.Whisper(cmd.Room, cmd.Username, "usage: /remind <duration> <text>, e.g. /remind 10m stand up")
+		return
+	}
+	if delay <= 0 || delay > maxReminderDelay {
+		bot.Whisper(cmd.Room, cmd.Username, fmt.Sprintf("reminders can be set up to %s ahead", maxReminderDelay))
+		return
+	}
+
+	b.mu.Lock()
+	if b.pending[cmd.Username] >= maxRemindersPerUser {
+		b.mu.Unlock()
+		bot.Whisper(cmd.Room, cmd.Username, fmt.Sprintf("you already have %d reminders pending", maxRemindersPerUser))
+		return
+	}
+	b.pending[cmd.Username]++
+	b.mu.Unlock()
+
+	time.AfterFunc(delay, func() {
+		b.mu.Lock()
+		if b.pending[cmd.Username]--; b.pending[cmd.Username] == 0 {
+			delete(b.pending, cmd.Username)
+		}
+		b.mu.Unlock()
+		bot.Whisper(cmd.Room, cmd.Username, "Reminder: "+text)
+	})
+	bot.Whisper(cmd.Room, cmd.Username, fmt.Sprintf("I'll remind you in %s", delay))
+}
@@ -0,0 +1,63 @@
+package main
+
+import "context"
+
+// bridge mirrors chat rooms to another chat network
+type bridge interface {
+	// relay hands the bridge a chat event accepted by this instance. It
+	// must not block.
+	relay(ev bridgeEvent)
+	// run relays events until ctx is done
+	run(ctx context.Context)
+}
+
+// bridgeEvent is a chat event for bridges: a "message", "join" or "leave"
+type bridgeEvent struct {
+	kind     string
+	username string
+	room     string
+	content  string
+	id       string
+	// via lists the federated servers the event came through
+	via []string
+}
+
+// WithBridge mirrors rooms to another network through b
+func WithBridge(b bridge) Option {
+	return func(cs *ChatServer) {
+		cs.bridges = append(cs.bridges, b)
+	}
+}
+
+// relayToBridges hands an event to every bridge
+func (cs *ChatServer) relayToBridges(ev bridgeEvent) {
+	for _, b := range cs.bridges {
+		b.relay(ev)
+	}
+}
+
+// admitBridged checks a chat message from a bridged or federated network
+// before it is published, returning the error refusing it. Their users
+// aren't logged in here, so they post as guests, and the Lua hook sees
+// their messages as it sees local ones.
+func (cs *ChatServer) admitBridged(msg *Message) error {
+	if room := cs.stateRoom(msg.Room); room != nil && !cs.permits(room, PermPost, grantee{}) {
+		return protocolErrorf(codeForbidden, "guests may not post in %s", roomOrLobby(msg.Room))
+	}
+	return cs.scriptInbound(msg, cs.lookupRoom(msg.Room))
+}
+
+// sanitizeUsername replaces the characters usernames can't contain with -
+// and truncates to the longest username
+func sanitizeUsername(name string) string {
+	out := make([]byte, 0, len(name))
+	for i := 0; i < len(name) && len(out) < maxUsernameLength; i++ {
+		c := name[i]
+		if c == '_' || c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			out = append(out, c)
+		} else {
+			out = append(out, '-')
+		}
+	}
+	return string(out)
+}
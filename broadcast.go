@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"time"
+)
+
+const (
+	// defaultBroadcastQueue is how many messages may wait for the
+	// broadcast goroutine
+	defaultBroadcastQueue = 1024
+	// defaultBroadcastTimeout is how long a publisher waits for room in a
+	// full queue before the message is dropped
+	defaultBroadcastTimeout = time.Second
+)
+
+// broadcastQueueDepth is the number of messages last seen waiting for the
+// broadcast goroutine
+var broadcastQueueDepth = new(expvar.Int)
+
+func init() {
+	metrics.Set(metricBroadcastQueueDepth, broadcastQueueDepth)
+}
+
+// WithBroadcastQueue sets how many messages may wait for delivery and how
+// long a publisher waits when the queue is full. Past the timeout the
+// message is dropped, so a stalled fan-out can't hold up connection
+// handlers.
+func WithBroadcastQueue(size int, timeout time.Duration) Option {
+	return func(cs *ChatServer) {
+		cs.broadcastQueue = size
+		cs.broadcastTimeout = timeout
+	}
+}
+
+// publish queues msg for delivery, waiting at most the broadcast timeout
+// for room. It reports whether the message was queued; once the hub has
+// shut down nothing is.
+func (cs *ChatServer) publish(msg Message) bool {
+	select {
+	case <-cs.stopped:
+		return false
+	default:
+	}
+	select {
+	case cs.broadcast <- msg:
+		broadcastQueueDepth.Set(int64(len(cs.broadcast)))
+		return true
+	default:
+	}
+
+	metrics.Add(metricBroadcastQueueFull, 1)
+	timer := time.NewTimer(cs.broadcastTimeout)
+	defer timer.Stop()
+	select {
+	case cs.broadcast <- msg:
+		broadcastQueueDepth.Set(int64(len(cs.broadcast)))
+		return true
+	case <-cs.stopped:
+		return false
+	case <-timer.C:
+		metrics.Add(metricBroadcastDropped, 1)
+		log.Printf("Broadcast queue full, dropped %s message from %s (trace %s)", msg.Type, msg.Username, msg.Trace)
+		return false
+	}
+}
+
+// publishFrom queues a client's message and acknowledges it, telling the
+// client instead if it had to be dropped
+func (cs *ChatServer) publishFrom(ctx context.Context, client *Client, msg Message) {
+	msg.ackedID = newMessageID()
+	if cs.publish(msg) {
+		cs.sendAck(ctx, client, msg)
+		return
+	}
+	// The client may retransmit a message that was never delivered
+	cs.clientIDs.forget(msg.Username, msg.ClientMsgID)
+	err := protocolErrorf(codeServerBusy, "server busy, message not delivered")
+	cs.sendError(ctx, client, err, refFor(msg))
+}
+
+// Ack tells a v3 client its message was accepted, with the ID and
+// timestamp its broadcast will carry. It may arrive before or after the
+// broadcast itself.
+type Ack struct {
+	Type        string `json:"type"`
+	ID          string `json:"id"`
+	Timestamp   int64  `json:"ts"`
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	Trace       string `json:"trace,omitempty"`
+}
+
+// sendAck acknowledges an accepted message to its sender
+func (cs *ChatServer) sendAck(ctx context.Context, client *Client, msg Message) {
+	if client.version < protocolV3 || client.canary {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	err := client.write(ctx, Ack{Type: "ack", ID: msg.ackedID, Timestamp: msg.Timestamp, ClientMsgID: msg.ClientMsgID, Trace: msg.Trace})
+	if err != nil {
+		client.logf("Error acknowledging %s to %s: %v", msg.ackedID, client.username, err)
+	}
+}
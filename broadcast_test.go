@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestPublish_DropsWhenQueueFull(t *testing.T) {
+	// Never Run, so nothing drains the queue
+	server := NewChatServer(WithBroadcastQueue(1, time.Millisecond*10))
+
+	if !server.publish(Message{Type: "message", Content: "first"}) {
+		t.Fatal("Expected the first message to be queued")
+	}
+	dropped := metricValue(metricBroadcastDropped)
+	if server.publish(Message{Type: "message", Content: "second"}) {
+		t.Fatal("Expected the second message to be dropped")
+	}
+	if got := metricValue(metricBroadcastDropped); got != dropped+1 {
+		t.Errorf("Expected the drop to be counted, got %d -> %d", dropped, got)
+	}
+	if got := broadcastQueueDepth.Value(); got != 1 {
+		t.Errorf("Expected a queue depth of 1, got %d", got)
+	}
+}
+
+func TestChatServer_StalledBroadcast(t *testing.T) {
+	server := NewChatServer(WithBroadcastQueue(1, time.Millisecond*10))
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// alice's join fills the queue; bob's join and message find it full
+	for _, name := range []string{"alice", "bob"} {
+		c, _, err := websocket.Dial(ctx, wsURL+"?username="+name,
+			&websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+		if err != nil {
+			t.Fatalf("Failed to connect %s: %v", name, err)
+		}
+		defer c.Close(websocket.StatusNormalClosure, "")
+		if name != "bob" {
+			continue
+		}
+		wsjson.Write(ctx, c, Message{Type: "message", Content: "hello"})
+		var msg Message
+		if err := wsjson.Read(ctx, c, &msg); err != nil || msg.Code != codeServerBusy {
+			t.Errorf("Expected a server_busy error, got %+v (%v)", msg, err)
+		}
+	}
+}
+
+func TestChatServer_Shutdown(t *testing.T) {
+	server := NewChatServer()
+	runCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	server.Run(runCtx)
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username=alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+	var msg Message
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read join notice: %v", err)
+	}
+
+	// Queued before shutdown, so still delivered
+	server.publish(Message{Type: "message", Username: "bob", Content: "last words"})
+	stop()
+	select {
+	case <-server.Done():
+	case <-ctx.Done():
+		t.Fatal("Expected the hub to stop")
+	}
+	if server.publish(Message{Type: "message", Content: "too late"}) {
+		t.Error("Expected publishing after shutdown to fail")
+	}
+
+	if err := wsjson.Read(ctx, c, &msg); err != nil || msg.Content != "last words" {
+		t.Errorf("Expected the queued message to be delivered, got %+v (%v)", msg, err)
+	}
+	if err := wsjson.Read(ctx, c, &msg); websocket.CloseStatus(err) != websocket.StatusGoingAway {
+		t.Errorf("Expected the client to be closed with going away, got %v", err)
+	}
+}
+
+func TestAcks(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username=alice", &websocket.DialOptions{Subprotocols: []string{subprotocolV3}})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.CloseNow()
+	readUntilType(t, ctx, c, "system")
+	bob := dialStatusTest(t, ctx, s, "bob")
+
+	wsjson.Write(ctx, c, Message{Type: "message", Content: "hello", ClientMsgID: "c1"})
+	// The ack and the broadcast race, so take them in either order
+	var ack, echo Message
+	for ack.Type == "" || echo.Type == "" {
+		var msg Message
+		if err := wsjson.Read(ctx, c, &msg); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		switch msg.Type {
+		case "ack":
+			ack = msg
+		case "message":
+			echo = msg
+		}
+	}
+	if ack.ID == "" || ack.ID != echo.ID || ack.Timestamp != echo.Timestamp || ack.ClientMsgID != "c1" {
+		t.Errorf("Expected the ack %+v to match the broadcast %+v", ack, echo)
+	}
+
+	// v2 clients get no acks
+	wsjson.Write(ctx, bob, Message{Type: "message", Content: "hi"})
+	for {
+		var msg Message
+		if err := wsjson.Read(ctx, bob, &msg); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if msg.Type == "ack" {
+			t.Fatalf("Expected no ack for a v2 client")
+		}
+		if msg.Type == "message" && msg.Content == "hi" {
+			break
+		}
+	}
+}
+
+// discardResponse is an SSE response that throws frames away, standing in
+// for a client connection in benchmarks
+type discardResponse struct{ header http.Header }
+
+func (d *discardResponse) Header() http.Header         { return d.header }
+func (d *discardResponse) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardResponse) WriteHeader(int)             {}
+func (d *discardResponse) Flush()                      {}
+
+// addBenchClients connects n simulated clients to the lobby, cycling
+// through the protocol versions and codecs real clients negotiate
+func addBenchClients(server *ChatServer, n int) {
+	kinds := []struct {
+		version int
+		codec   Codec
+	}{{protocolV2, jsonCodec{}}, {protocolV2, msgpackCodec{}}, {protocolV1, jsonCodec{}}}
+	server.clientsMtx.Lock()
+	defer server.clientsMtx.Unlock()
+	for i := range n {
+		w := &discardResponse{header: http.Header{}}
+		kind := kinds[i%len(kinds)]
+		client := &Client{
+			id:       newConnectionID(),
+			username: fmt.Sprintf("user%d", i),
+			version:  kind.version,
+			codec:    kind.codec,
+			events:   &eventStream{w: w, rc: http.NewResponseController(w), done: make(chan struct{})},
+		}
+		server.clients[client] = true
+		server.usernames[client.username] = client
+	}
+}
+
+// BenchmarkBroadcast measures encoding a message and fanning it out to
+// every client in the room. Run make profile for CPU and allocation
+// profiles.
+func BenchmarkBroadcast(b *testing.B) {
+	for _, clients := range []int{100, 1000, 10000} {
+		for _, size := range []int{64, 1024, maxMessageLength} {
+			b.Run(fmt.Sprintf("clients=%d/size=%d", clients, size), func(b *testing.B) {
+				server := NewChatServer()
+				addBenchClients(server, clients)
+				msg := Message{
+					Type:      "message",
+					Username:  "user0",
+					Content:   strings.Repeat("x", size),
+					Time:      time.Now().Format(time.RFC3339),
+					Timestamp: time.Now().UnixMilli(),
+					ID:        newMessageID(),
+					Trace:     newTraceID(),
+				}
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				for b.Loop() {
+					server.deliver(msg)
+				}
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*clients), "ns/client")
+			})
+		}
+	}
+}
+
+// BenchmarkRelay measures the whole path of a local message: stamping,
+// sanitizing, rules and fan-out
+func BenchmarkRelay(b *testing.B) {
+	for _, clients := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			server := NewChatServer(WithContentSanitizer(SanitizeEscape))
+			addBenchClients(server, clients)
+			msg := Message{Type: "message", Username: "user0", Content: strings.Repeat("hello <b>world</b> ", 10)}
+			b.ReportAllocs()
+			for b.Loop() {
+				server.relay(msg)
+			}
+		})
+	}
+}
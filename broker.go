@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// Broker relays broadcast messages between server instances so that clients
+// connected to different instances see the same chat
+type Broker interface {
+	// Publish sends msg to every subscribed instance, including this one
+	Publish(ctx context.Context, msg Message) error
+	// Subscribe registers handler to receive every published message until
+	// ctx is cancelled. Handler calls are sequential.
+	Subscribe(ctx context.Context, handler func(Message)) error
+	// Close releases the broker connection
+	Close() error
+}
+
+// NewBroker creates a broker from a URL. The scheme selects the backend.
+func NewBroker(rawURL string) (Broker, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "nats", "tls":
+		return NewNATSBroker(u)
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme %q", u.Scheme)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// memBroker is an in-process Broker shared by several test servers. It
+// delivers synchronously, so echoes arrive before Publish returns.
+type memBroker struct {
+	mu       sync.Mutex
+	handlers []func(Message)
+	// redeliver sends every message this many extra times
+	redeliver int
+}
+
+func (b *memBroker) Publish(ctx context.Context, msg Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := 0; i <= b.redeliver; i++ {
+		for _, h := range b.handlers {
+			h(msg)
+		}
+	}
+	return nil
+}
+
+func (b *memBroker) Subscribe(ctx context.Context, handler func(Message)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+	return nil
+}
+
+func (b *memBroker) Close() error { return nil }
+
+func TestChatServer_BrokerRelaysBetweenInstances(t *testing.T) {
+	broker := &memBroker{}
+
+	serverA := NewChatServer(WithBroker(broker))
+	serverA.Run(t.Context())
+	sA := httptest.NewServer(http.HandlerFunc(serverA.handleConnection))
+	defer sA.Close()
+
+	serverB := NewChatServer(WithBroker(broker))
+	serverB.Run(t.Context())
+	sB := httptest.NewServer(http.HandlerFunc(serverB.handleConnection))
+	defer sB.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	cA, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(sA.URL, "http")+"?username=alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to instance A: %v", err)
+	}
+	defer cA.Close(websocket.StatusNormalClosure, "")
+
+	var msg Message
+	if err := wsjson.Read(ctx, cA, &msg); err != nil {
+		t.Fatalf("Failed to read welcome message: %v", err)
+	}
+
+	cB, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(sB.URL, "http")+"?username=bob", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to instance B: %v", err)
+	}
+	defer cB.Close(websocket.StatusNormalClosure, "")
+
+	// Bob's join on instance B must reach Alice on instance A
+	if err := wsjson.Read(ctx, cA, &msg); err != nil {
+		t.Fatalf("Failed to read join message: %v", err)
+	}
+	if !strings.Contains(msg.Content, "bob has joined") {
+		t.Errorf("Expected bob's join on instance A, got: %+v", msg)
+	}
+	if err := wsjson.Read(ctx, cB, &msg); err != nil {
+		t.Fatalf("Failed to read welcome message: %v", err)
+	}
+
+	if err := wsjson.Write(ctx, cA, Message{Type: "message", Content: "hello from A"}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if err := wsjson.Read(ctx, cB, &msg); err != nil {
+		t.Fatalf("Failed to read relayed message: %v", err)
+	}
+	if msg.Username != "alice" || msg.Content != "hello from A" {
+		t.Errorf("Unexpected relayed message: %+v", msg)
+	}
+
+	// Alice sees her own message exactly once
+	if err := wsjson.Read(ctx, cA, &msg); err != nil {
+		t.Fatalf("Failed to read echoed message: %v", err)
+	}
+	if msg.Content != "hello from A" {
+		t.Errorf("Unexpected echoed message: %+v", msg)
+	}
+}
+
+func TestNewBroker_UnsupportedScheme(t *testing.T) {
+	if _, err := NewBroker("kafka://localhost:9092"); err == nil {
+		t.Error("Expected error for unsupported broker scheme")
+	}
+	if _, err := NewBroker("nats://localhost:4222?jetstream=true&max_age=forever"); err == nil {
+		t.Error("Expected error for invalid max_age")
+	}
+	if _, err := NewBroker("nats://localhost:4222?jetstream=yes"); err == nil {
+		t.Error("Expected error for invalid jetstream")
+	}
+}
+
+func TestChatServer_BrokerDeduplicatesDelivery(t *testing.T) {
+	// Every message comes back from the broker twice, to its origin as well
+	broker := &memBroker{redeliver: 1}
+
+	var urls []string
+	for i := 0; i < 2; i++ {
+		server := NewChatServer(WithBroker(broker))
+		server.Run(t.Context())
+		s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+		defer s.Close()
+		urls = append(urls, "ws"+strings.TrimPrefix(s.URL, "http"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	// Two clients per instance
+	var conns []*websocket.Conn
+	for i := 0; i < 4; i++ {
+		c, _, err := websocket.Dial(ctx, fmt.Sprintf("%s?username=user%d", urls[i%2], i), nil)
+		if err != nil {
+			t.Fatalf("Failed to connect client %d: %v", i, err)
+		}
+		defer c.Close(websocket.StatusNormalClosure, "")
+		conns = append(conns, c)
+	}
+
+	// Everyone sends concurrently
+	const perClient = 10
+	var wg sync.WaitGroup
+	for i, c := range conns {
+		wg.Add(1)
+		go func(i int, c *websocket.Conn) {
+			defer wg.Done()
+			for j := 0; j < perClient; j++ {
+				msg := Message{Type: "message", Content: fmt.Sprintf("dedup %d-%d", i, j)}
+				if err := wsjson.Write(ctx, c, msg); err != nil {
+					t.Errorf("Failed to send: %v", err)
+					return
+				}
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	// Each client must see each chat message exactly once
+	for i, c := range conns {
+		counts := make(map[string]int)
+		for total := 0; total < len(conns)*perClient; {
+			var msg Message
+			if err := wsjson.Read(ctx, c, &msg); err != nil {
+				t.Fatalf("Client %d: failed to read: %v", i, err)
+			}
+			if msg.Type != "message" {
+				continue
+			}
+			if msg.Origin != "" {
+				t.Errorf("Client %d: origin tag leaked to client: %+v", i, msg)
+			}
+			counts[msg.Content]++
+			total++
+		}
+		for content, n := range counts {
+			if n != 1 {
+				t.Errorf("Client %d: %q delivered %d times", i, content, n)
+			}
+		}
+		if len(counts) != len(conns)*perClient {
+			t.Errorf("Client %d: got %d distinct messages, want %d", i, len(counts), len(conns)*perClient)
+		}
+	}
+}
+
+func TestSeenSet_ForgetsOldest(t *testing.T) {
+	s := newSeenSet(2)
+	if !s.Add("a") || !s.Add("b") {
+		t.Fatal("Expected new IDs to be added")
+	}
+	if s.Add("a") {
+		t.Error("Expected duplicate ID to be rejected")
+	}
+	s.Add("c") // evicts "a"
+	if !s.Add("a") {
+		t.Error("Expected evicted ID to be accepted again")
+	}
+}
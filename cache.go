@@ -0,0 +1,39 @@
+package main
+
+import "time"
+
+// CacheHints tell clients how long they may keep messages, so local caches
+// follow the server's retention and compliance policies
+type CacheHints struct {
+	// MaxAge is how many seconds the server keeps messages, zero if
+	// unlimited
+	MaxAge int64 `json:"max_age,omitempty"`
+	// MaxMessages is how many recent messages the server keeps, zero if
+	// only the history size limits it
+	MaxMessages int `json:"max_messages,omitempty"`
+	// EditWindow is how many seconds messages stay editable. Messages
+	// can't be edited, so it is always zero.
+	EditWindow int64 `json:"edit_window"`
+	// Store is whether clients may persist message content locally
+	Store bool `json:"store"`
+}
+
+// WithClientStorage sets whether clients may persist message content
+func WithClientStorage(allowed bool) Option {
+	return func(cs *ChatServer) {
+		cs.clientStorage = allowed
+	}
+}
+
+// cacheHints describes the retention policy for clients. It returns nil
+// when nothing restricts caching, which clients should read as no limits.
+func (cs *ChatServer) cacheHints() *CacheHints {
+	if cs.retentionAge <= 0 && cs.retentionCount <= 0 && cs.clientStorage {
+		return nil
+	}
+	return &CacheHints{
+		MaxAge:      int64(cs.retentionAge / time.Second),
+		MaxMessages: cs.retentionCount,
+		Store:       cs.clientStorage,
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestCacheHints(t *testing.T) {
+	if hints := NewChatServer().cacheHints(); hints != nil {
+		t.Errorf("Expected no hints without a policy, got %+v", hints)
+	}
+
+	server := NewChatServer(WithRetention(time.Hour, 500), WithClientStorage(false))
+	server.Run(t.Context())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", server.handleConnection)
+	mux.HandleFunc("/api/history", server.handleHistory)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"/ws?username=alice",
+		&websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	var state RoomState
+	if err := wsjson.Read(ctx, c, &state); err != nil {
+		t.Fatalf("Failed to read room state: %v", err)
+	}
+	want := CacheHints{MaxAge: 3600, MaxMessages: 500, Store: false}
+	if state.Type != "room" || state.Cache == nil || *state.Cache != want {
+		t.Errorf("Expected cache hints %+v, got %+v", want, state)
+	}
+
+	resp, err := http.Get(s.URL + "/api/history")
+	if err != nil {
+		t.Fatalf("Failed to fetch history: %v", err)
+	}
+	resp.Body.Close()
+	if cc := resp.Header.Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Expected Cache-Control: no-store, got %q", cc)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bvedant/ideal-guacamole/client"
+)
+
+// canaryHeader marks the upgrade request of a canary connection. Canary
+// connections live in a hidden channel: they only see canary probes, only
+// send canary probes and are never announced to the room.
+const canaryHeader = "X-Chat-Canary"
+
+// canaryStaleAfter is how many probe intervals may pass without a
+// successful probe before the instance reports itself not ready
+const canaryStaleAfter = 3
+
+// canaryLatencyMs is the end-to-end delivery latency of the last successful probe
+var canaryLatencyMs = new(expvar.Int)
+
+func init() {
+	metrics.Set(metricCanaryLatencyMs, canaryLatencyMs)
+}
+
+// canaryState records the outcome of recent canary probes
+type canaryState struct {
+	mu      sync.Mutex
+	lastOK  time.Time
+	lastErr error
+}
+
+// WithCanary runs an internal canary that connects to the public WebSocket
+// endpoint at url and sends a probe through the full delivery path every
+// interval
+func WithCanary(url string, interval time.Duration) Option {
+	return func(cs *ChatServer) {
+		cs.canaryURL = url
+		cs.canaryInterval = interval
+	}
+}
+
+// runCanary probes the delivery path until ctx is cancelled, reconnecting
+// after any failure
+func (cs *ChatServer) runCanary(ctx context.Context) {
+	ticker := time.NewTicker(cs.canaryInterval)
+	defer ticker.Stop()
+
+	var conn *client.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if conn == nil {
+			dialCtx, cancel := context.WithTimeout(ctx, cs.canaryInterval)
+			header := http.Header{canaryHeader: {"1"}}
+			if cs.gate != nil {
+				header.Set(gatePassHeader, cs.gate.pass(cs.now()))
+			}
+			c, err := client.Dial(dialCtx, cs.canaryURL, client.Options{
+				Username:   "canary-" + newConnectionID(),
+				HTTPHeader: header,
+			})
+			cancel()
+			if err != nil {
+				cs.recordCanary(0, fmt.Errorf("connecting: %w", err))
+				continue
+			}
+			conn = c
+		}
+
+		latency, err := cs.canaryProbe(ctx, conn)
+		if err != nil {
+			conn.Close()
+			conn = nil
+		}
+		cs.recordCanary(latency, err)
+	}
+}
+
+// canaryProbe sends one probe and waits for it to be delivered back
+func (cs *ChatServer) canaryProbe(ctx context.Context, conn *client.Conn) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, cs.canaryInterval)
+	defer cancel()
+
+	nonce := newMessageID()
+	sent := time.Now()
+	if err := conn.SendMessage(ctx, client.Message{Type: "canary", Content: nonce}); err != nil {
+		return 0, fmt.Errorf("sending probe: %w", err)
+	}
+	for {
+		msg, err := conn.Read(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("waiting for probe: %w", err)
+		}
+		// Other instances' canaries share the channel
+		if msg.Type == "canary" && msg.Content == nonce {
+			return time.Since(sent), nil
+		}
+	}
+}
+
+// recordCanary stores a probe result and updates the canary metrics
+func (cs *ChatServer) recordCanary(latency time.Duration, err error) {
+	cs.canary.mu.Lock()
+	defer cs.canary.mu.Unlock()
+
+	cs.canary.lastErr = err
+	if err != nil {
+		log.Printf("Canary probe failed: %v", err)
+		metrics.Add(metricCanaryFailures, 1)
+		return
+	}
+	cs.canary.lastOK = time.Now()
+	metrics.Add(metricCanaryProbes, 1)
+	canaryLatencyMs.Set(latency.Milliseconds())
+}
+
+// canaryHealthy reports whether the canary has completed a probe recently.
+// It is always true when the canary is disabled.
+func (cs *ChatServer) canaryHealthy() (bool, error) {
+	if cs.canaryURL == "" {
+		return true, nil
+	}
+
+	cs.canary.mu.Lock()
+	defer cs.canary.mu.Unlock()
+	if time.Since(cs.canary.lastOK) > canaryStaleAfter*cs.canaryInterval {
+		if cs.canary.lastErr != nil {
+			return false, cs.canary.lastErr
+		}
+		return false, fmt.Errorf("no successful canary probe in the last %s", canaryStaleAfter*cs.canaryInterval)
+	}
+	return true, nil
+}
+
+// handleCanaryMessage relays a probe from a canary connection
+func (cs *ChatServer) handleCanaryMessage(ctx context.Context, client *Client, msg Message) {
+	if msg.Type != "canary" {
+		cs.sendError(ctx, client, protocolErrorf(codeInvalidType, "canary connections may only send canary probes"), refFor(msg))
+		return
+	}
+	now := time.Now()
+	msg.Username = client.username
+	msg.Time = now.Format(time.RFC3339)
+	msg.Timestamp = now.UnixMilli()
+	cs.publish(msg)
+}
+
+// handleReady handles GET /readyz, failing while the canary is broken
+func (cs *ChatServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	if ok, err := cs.canaryHealthy(); !ok {
+		http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// waitReady polls /readyz until it answers with want or the deadline passes
+func waitReady(t *testing.T, server *ChatServer, want int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 3)
+	for {
+		rec := httptest.NewRecorder()
+		server.handleReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if rec.Code == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected readiness %d, still %d: %s", want, rec.Code, rec.Body.String())
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+func TestChatServer_Canary(t *testing.T) {
+	var server *ChatServer
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.handleConnection(w, r)
+	}))
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	server = NewChatServer(WithCanary(wsURL, time.Millisecond*50))
+	server.Run(t.Context())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c, _, err := websocket.Dial(ctx, wsURL+"?username=alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+	var msg Message
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read welcome message: %v", err)
+	}
+
+	waitReady(t, server, http.StatusOK)
+	if metricValue(metricCanaryProbes) == 0 {
+		t.Error("Expected successful canary probes to be counted")
+	}
+
+	// The canary is invisible to regular clients
+	if n := len(server.history.Before(0, maxHistoryLimit).Messages); n != 1 {
+		t.Errorf("Expected only alice's join in history, got %d messages", n)
+	}
+	readCtx, readCancel := context.WithTimeout(ctx, time.Millisecond*200)
+	err = wsjson.Read(readCtx, c, &msg)
+	readCancel()
+	if err == nil {
+		t.Errorf("Expected no traffic for regular clients, got: %+v", msg)
+	}
+
+	// Taking the endpoint down fails readiness. Hijacked connections
+	// outlive the listener, so drop the canary's connection by hand.
+	s.Close()
+	server.clientsMtx.Lock()
+	for client := range server.clients {
+		if client.canary {
+			client.conn.CloseNow()
+		}
+	}
+	server.clientsMtx.Unlock()
+	waitReady(t, server, http.StatusServiceUnavailable)
+}
+
+func TestChatServer_ReadyWithoutCanary(t *testing.T) {
+	server := NewChatServer()
+	waitReady(t, server, http.StatusOK)
+}
@@ -0,0 +1,159 @@
+// Package chain signs stored chat messages and links them into a hash
+// chain, so exported history can be checked for tampering.
+//
+// Each message is signed as a Link: its position, identity and the hash of
+// its body (username and content), chained to the previous message's hash.
+// Signing the body's hash rather than the body lets erasure blank a
+// message's content without breaking the chain. A message whose author
+// was erased verifies as redacted, and so does a notice that only named
+// them, once the redacted body is signed again with SignRedaction.
+package chain
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErasedUsername replaces the username of erased messages
+const ErasedUsername = "[deleted]"
+
+// Body is the part of a message erasure may change
+type Body struct {
+	Username    string `json:"username"`
+	Content     string `json:"content"`
+	Ciphertext  string `json:"ciphertext,omitempty"`
+	To          string `json:"to,omitempty"`
+	OldUsername string `json:"old_username,omitempty"`
+}
+
+// Hash returns the hex SHA-256 of the body's canonical encoding
+func (b Body) Hash() string {
+	return digest(b)
+}
+
+// Link is the signed part of a message
+type Link struct {
+	Room      string `json:"room"`
+	Seq       uint64 `json:"seq"`
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Timestamp int64  `json:"ts"`
+	BodyHash  string `json:"body_hash"`
+	PrevHash  string `json:"prev_hash"`
+}
+
+// Hash returns the hex SHA-256 of the link's canonical encoding
+func (l Link) Hash() string {
+	return digest(l)
+}
+
+// digest hashes v's JSON encoding, which is deterministic for structs
+func digest(v any) string {
+	data, _ := json.Marshal(v)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign returns the hash of l and its base64 Ed25519 signature
+func Sign(key ed25519.PrivateKey, l Link) (hash, sig string) {
+	hash = l.Hash()
+	return hash, base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(hash)))
+}
+
+// SignRedaction returns the base64 Ed25519 signature vouching for b as the
+// redacted body of the message whose link hashes to hash
+func SignRedaction(key ed25519.PrivateKey, hash string, b Body) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(redaction(hash, b))))
+}
+
+// redaction is what SignRedaction signs
+func redaction(hash string, b Body) string {
+	return "redacted:" + hash + ":" + b.Hash()
+}
+
+// Record is a signed message as served and exported by the chat server
+type Record struct {
+	Link
+	Body
+	Hash string `json:"hash"`
+	Sig  string `json:"sig"`
+	// RedactionSig, set on redacted notices, signs the redacted body
+	RedactionSig string `json:"redaction_sig,omitempty"`
+}
+
+// Report summarizes a verified run of records
+type Report struct {
+	Verified int
+	FirstSeq uint64
+	LastSeq  uint64
+	Redacted []uint64
+	Unsigned int
+}
+
+// Verify checks that records, oldest first, are signed by pub and form an
+// unbroken chain. The first record's predecessor isn't checked, since older
+// messages may have been pruned. Messages without a signature are counted
+// but otherwise skipped, as are messages never stored, such as presence.
+func Verify(pub ed25519.PublicKey, records []Record) (Report, error) {
+	var report Report
+	prev := ""
+	for _, r := range records {
+		if r.Sig == "" {
+			report.Unsigned++
+			continue
+		}
+		if r.Link.Hash() != r.Hash {
+			return report, fmt.Errorf("seq %d: hash doesn't match the message", r.Seq)
+		}
+		sig, err := base64.StdEncoding.DecodeString(r.Sig)
+		if err != nil || !ed25519.Verify(pub, []byte(r.Hash), sig) {
+			return report, fmt.Errorf("seq %d: bad signature", r.Seq)
+		}
+		if report.Verified > 0 && r.PrevHash != prev {
+			return report, fmt.Errorf("seq %d: chain broken, a message before it was removed, reordered or altered", r.Seq)
+		}
+		if r.Body.Hash() != r.BodyHash {
+			if !erased(r.Body) && !redactionSigned(pub, r) {
+				return report, fmt.Errorf("seq %d: content altered", r.Seq)
+			}
+			report.Redacted = append(report.Redacted, r.Seq)
+		}
+		if report.Verified == 0 {
+			report.FirstSeq = r.Seq
+		}
+		report.LastSeq = r.Seq
+		report.Verified++
+		prev = r.Hash
+	}
+	if report.Verified == 0 {
+		return report, errors.New("no signed messages")
+	}
+	return report, nil
+}
+
+// erased reports whether a body is exactly what erasing its author leaves
+func erased(b Body) bool {
+	return b.Username == ErasedUsername && b.Content == "" && b.Ciphertext == ""
+}
+
+// redactionSigned reports whether the record's body carries a valid
+// redaction signature
+func redactionSigned(pub ed25519.PublicKey, r Record) bool {
+	sig, err := base64.StdEncoding.DecodeString(r.RedactionSig)
+	return err == nil && r.RedactionSig != "" && ed25519.Verify(pub, []byte(redaction(r.Hash, r.Body)), sig)
+}
+
+// ParsePublicKey decodes a base64 Ed25519 public key
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid Ed25519 public key (want 32 bytes, base64)")
+	}
+	return ed25519.PublicKey(key), nil
+}
@@ -0,0 +1,77 @@
+package chain
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+// signed builds a chain of records with the given contents
+func signed(key ed25519.PrivateKey, contents ...string) []Record {
+	var records []Record
+	prev := ""
+	for i, content := range contents {
+		r := Record{
+			Link: Link{Seq: uint64(i + 1), ID: "m" + content, Type: "message", Timestamp: int64(i), PrevHash: prev},
+			Body: Body{Username: "alice", Content: content},
+		}
+		r.BodyHash = r.Body.Hash()
+		r.Hash, r.Sig = Sign(key, r.Link)
+		prev = r.Hash
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestVerify(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(nil)
+	records := signed(key, "a", "b", "c")
+	if report, err := Verify(pub, records); err != nil || report.Verified != 3 || report.FirstSeq != 1 || report.LastSeq != 3 {
+		t.Errorf("Expected 3 verified messages, got %+v (%v)", report, err)
+	}
+
+	// Pruned history verifies from wherever it starts
+	if _, err := Verify(pub, records[1:]); err != nil {
+		t.Errorf("Expected a suffix to verify, got %v", err)
+	}
+
+	// Erasure is reported, not rejected
+	erased := signed(key, "a", "b", "c")
+	erased[1].Username, erased[1].Content = ErasedUsername, ""
+	if report, err := Verify(pub, erased); err != nil || len(report.Redacted) != 1 || report.Redacted[0] != 2 {
+		t.Errorf("Expected seq 2 to be reported as redacted, got %+v (%v)", report, err)
+	}
+
+	// Any other change needs the redacted body signed again
+	notice := signed(key, "a", "alice has joined", "c")
+	notice[1].Content = ErasedUsername + " has joined"
+	if _, err := Verify(pub, notice); err == nil {
+		t.Errorf("Expected an unsigned redaction to be rejected")
+	}
+	notice[1].RedactionSig = SignRedaction(key, notice[1].Hash, notice[1].Body)
+	if report, err := Verify(pub, notice); err != nil || len(report.Redacted) != 1 {
+		t.Errorf("Expected a signed redaction to be reported, got %+v (%v)", report, err)
+	}
+	notice[1].Content = "forged " + ErasedUsername
+	if _, err := Verify(pub, notice); err == nil {
+		t.Errorf("Expected a body differing from the signed redaction to be rejected")
+	}
+
+	for name, tamper := range map[string]func([]Record) []Record{
+		"content":   func(r []Record) []Record { r[1].Content = "forged"; return r },
+		"erased":    func(r []Record) []Record { r[1].Content = "forged " + ErasedUsername; return r },
+		"username":  func(r []Record) []Record { r[1].Username = ErasedUsername; return r },
+		"removal":   func(r []Record) []Record { return append(r[:1], r[2:]...) },
+		"reorder":   func(r []Record) []Record { r[1], r[2] = r[2], r[1]; return r },
+		"seq":       func(r []Record) []Record { r[2].Seq = 9; return r },
+		"signature": func(r []Record) []Record { r[0].Sig = r[1].Sig; return r },
+	} {
+		if _, err := Verify(pub, tamper(signed(key, "a", "b", "c"))); err == nil {
+			t.Errorf("Expected tampering with %s to be detected", name)
+		}
+	}
+
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	if _, err := Verify(otherPub, records); err == nil {
+		t.Error("Expected another key to be rejected")
+	}
+}
@@ -0,0 +1,5 @@
+// Package chatpb holds the protobuf schema and generated gRPC code of the
+// chat hub's gRPC API
+package chatpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative chat.proto
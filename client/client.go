@@ -0,0 +1,163 @@
+// Package client is a small Go client for the chat server's WebSocket protocol.
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// Subprotocol is the protocol version this package speaks
+const Subprotocol = "chat.v2"
+
+// Message mirrors the chat message envelope sent over the wire
+type Message struct {
+	Type     string `json:"type"`
+	Username string `json:"username"`
+	Content  string `json:"content"`
+	Time     string `json:"time"`
+	ID       string `json:"id,omitempty"`
+
+	// Timestamp is the server receive time in Unix milliseconds
+	Timestamp int64  `json:"ts,omitempty"`
+	Seq       uint64 `json:"seq,omitempty"`
+
+	// Trace identifies the message in server logs
+	Trace string `json:"trace,omitempty"`
+
+	// OldUsername is set on "rename" events
+	OldUsername string `json:"old_username,omitempty"`
+
+	// Count and Members summarize large rooms on "presence" messages
+	Count   int      `json:"count,omitempty"`
+	Members []string `json:"members,omitempty"`
+
+	// Code and Ref describe the problem on "error" messages
+	Code string    `json:"code,omitempty"`
+	Ref  *ErrorRef `json:"ref,omitempty"`
+}
+
+// ErrorRef identifies the payload the server rejected
+type ErrorRef struct {
+	Type    string `json:"type,omitempty"`
+	Content string `json:"content,omitempty"`
+	Length  int    `json:"length,omitempty"`
+	Field   string `json:"field,omitempty"`
+	Trace   string `json:"trace,omitempty"`
+}
+
+// Options configures a connection to the chat server
+type Options struct {
+	// Username to join with. Empty lets the server pick one.
+	Username string
+	// Room to join. Servers without room support ignore it.
+	Room string
+	// HTTPHeader is sent with the upgrade request
+	HTTPHeader http.Header
+	// CompressionMode requests permessage-deflate. The zero value disables it.
+	CompressionMode websocket.CompressionMode
+}
+
+// Conn is a client connection to the chat server
+type Conn struct {
+	ws *websocket.Conn
+	id string
+}
+
+// Dial connects to the chat server at server, which may be a ws://, wss://,
+// http:// or https:// URL or a bare host:port
+func Dial(ctx context.Context, server string, opts Options) (*Conn, error) {
+	u, err := WebSocketURL(server)
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	if opts.Username != "" {
+		q.Set("username", opts.Username)
+	}
+	if opts.Room != "" {
+		q.Set("room", opts.Room)
+	}
+	u.RawQuery = q.Encode()
+
+	ws, resp, err := websocket.Dial(ctx, u.String(), &websocket.DialOptions{
+		HTTPHeader:      opts.HTTPHeader,
+		Subprotocols:    []string{Subprotocol},
+		CompressionMode: opts.CompressionMode,
+	})
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("dial %s: %s: %w", u.Redacted(), resp.Status, err)
+		}
+		return nil, fmt.Errorf("dial %s: %w", u.Redacted(), err)
+	}
+	return &Conn{ws: ws, id: resp.Header.Get("X-Chat-Connection")}, nil
+}
+
+// ID returns the server's identifier for this connection, if it sent one.
+// Quote it together with message trace IDs when reporting problems.
+func (c *Conn) ID() string {
+	return c.id
+}
+
+// WebSocketURL normalizes a server address into the URL of the WebSocket endpoint
+func WebSocketURL(server string) (*url.URL, error) {
+	if !strings.Contains(server, "://") {
+		server = "ws://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address %q: %w", server, err)
+	}
+
+	switch u.Scheme {
+	case "ws", "wss":
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid server address %q: missing host", server)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/ws"
+	}
+	return u, nil
+}
+
+// Send sends a chat message with the given content
+func (c *Conn) Send(ctx context.Context, content string) error {
+	return c.SendMessage(ctx, Message{Type: "message", Content: content})
+}
+
+// SendMessage sends an arbitrary message envelope
+func (c *Conn) SendMessage(ctx context.Context, msg Message) error {
+	return wsjson.Write(ctx, c.ws, msg)
+}
+
+// Read blocks until the next message arrives. Cancelling ctx closes the connection.
+func (c *Conn) Read(ctx context.Context) (Message, error) {
+	var msg Message
+	err := wsjson.Read(ctx, c.ws, &msg)
+	return msg, err
+}
+
+// Close closes the connection gracefully
+func (c *Conn) Close() error {
+	return c.ws.Close(websocket.StatusNormalClosure, "")
+}
+
+// IsClosed reports whether err indicates the connection was closed normally
+func IsClosed(err error) bool {
+	status := websocket.CloseStatus(err)
+	return status == websocket.StatusNormalClosure || status == websocket.StatusGoingAway
+}
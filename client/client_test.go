@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestWebSocketURL(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"localhost:8080", "ws://localhost:8080/ws", false},
+		{"http://example.com", "ws://example.com/ws", false},
+		{"https://example.com/", "wss://example.com/ws", false},
+		{"ws://example.com/chat", "ws://example.com/chat", false},
+		{"wss://example.com/ws?x=1", "wss://example.com/ws?x=1", false},
+		{"ftp://example.com", "", true},
+		{"ws://", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			u, err := WebSocketURL(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("WebSocketURL(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if err == nil && u.String() != tt.want {
+				t.Errorf("WebSocketURL(%q) = %q, want %q", tt.in, u.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestConn_SendAndRead(t *testing.T) {
+	// Echo server that records the query it was dialled with
+	queries := make(chan string, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.RawQuery
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.CloseNow()
+
+		var msg Message
+		if err := wsjson.Read(r.Context(), c, &msg); err != nil {
+			return
+		}
+		msg.Username = "echo"
+		wsjson.Write(r.Context(), c, msg)
+		c.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	conn, err := Dial(ctx, s.URL, Options{Username: "alice", Room: "general"})
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	if q := <-queries; q != "room=general&username=alice" {
+		t.Errorf("Unexpected query: %q", q)
+	}
+
+	if err := conn.Send(ctx, "hello"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	msg, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if msg.Type != "message" || msg.Content != "hello" || msg.Username != "echo" {
+		t.Errorf("Unexpected message: %+v", msg)
+	}
+
+	if _, err := conn.Read(ctx); !IsClosed(err) {
+		t.Errorf("Expected normal closure, got %v", err)
+	}
+}
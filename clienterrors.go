@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// clientErrorSamples is how many reports are kept per error code
+	clientErrorSamples = 5
+	// maxClientErrorCodes bounds how many distinct codes are tracked;
+	// reports with further codes are counted together under "other"
+	maxClientErrorCodes = 100
+	// maxClientErrorContent is how much of a report's description is kept
+	maxClientErrorContent = 1000
+)
+
+// validClientErrorCode is what a client may use to classify a report
+var validClientErrorCode = regexp.MustCompile(`^[a-z0-9_.-]{1,64}$`)
+
+// ClientErrorSample is one report kept as an example of its code
+type ClientErrorSample struct {
+	Time         time.Time `json:"time"`
+	ConnectionID string    `json:"connection_id"`
+	Protocol     int       `json:"protocol"`
+	Content      string    `json:"content"`
+}
+
+// ClientErrorStats aggregates the reports of one error code
+type ClientErrorStats struct {
+	Code      string              `json:"code"`
+	Count     int                 `json:"count"`
+	FirstSeen time.Time           `json:"first_seen"`
+	LastSeen  time.Time           `json:"last_seen"`
+	Samples   []ClientErrorSample `json:"samples"`
+}
+
+// clientErrorLog aggregates errors reported by clients. Every report is
+// counted, but only a uniform sample of each code's reports is kept and
+// logged, so a bug hitting every client can't flood the server.
+type clientErrorLog struct {
+	mu    sync.Mutex
+	codes map[string]*ClientErrorStats
+}
+
+// add records a report, returning whether it was sampled
+func (l *clientErrorLog) add(code string, sample ClientErrorSample) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.codes == nil {
+		l.codes = make(map[string]*ClientErrorStats)
+	}
+	stats, ok := l.codes[code]
+	if !ok && len(l.codes) >= maxClientErrorCodes {
+		code = "other"
+		stats, ok = l.codes[code]
+	}
+	if !ok {
+		stats = &ClientErrorStats{Code: code, FirstSeen: sample.Time}
+		l.codes[code] = stats
+	}
+	stats.Count++
+	stats.LastSeen = sample.Time
+
+	// Reservoir sampling keeps every report equally likely to be kept
+	if len(stats.Samples) < clientErrorSamples {
+		stats.Samples = append(stats.Samples, sample)
+		return true
+	}
+	if i := rand.IntN(stats.Count); i < clientErrorSamples {
+		stats.Samples[i] = sample
+		return true
+	}
+	return false
+}
+
+// stats returns the aggregated reports, most frequent first
+func (l *clientErrorLog) stats() []ClientErrorStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := make([]ClientErrorStats, 0, len(l.codes))
+	for _, stats := range l.codes {
+		s := *stats
+		s.Samples = append([]ClientErrorSample(nil), stats.Samples...)
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Code < out[j].Code
+	})
+	return out
+}
+
+// handleClientError records a client's "client_error" report. Reports
+// aren't acknowledged.
+func (cs *ChatServer) handleClientError(client *Client, msg Message) {
+	code := msg.Code
+	if !validClientErrorCode.MatchString(code) {
+		code = "unknown"
+	}
+	content := msg.Content
+	if len(content) > maxClientErrorContent {
+		content = strings.ToValidUTF8(content[:maxClientErrorContent], "")
+	}
+	metrics.Add(metricClientErrors, 1)
+	sampled := cs.clientErrors.add(code, ClientErrorSample{
+		Time:         cs.now(),
+		ConnectionID: client.id,
+		Protocol:     client.version,
+		Content:      content,
+	})
+	if sampled {
+		client.logf("Client reported %s (trace %s): %q", code, msg.Trace, content)
+	}
+}
+
+// handleAdminClientErrors serves GET /admin/client-errors
+func (cs *ChatServer) handleAdminClientErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cs.clientErrors.stats())
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestClientErrorLog_Sampling(t *testing.T) {
+	var l clientErrorLog
+	for i := range 100 {
+		l.add("render", ClientErrorSample{Content: fmt.Sprint(i)})
+	}
+	for i := range maxClientErrorCodes + 5 {
+		l.add(fmt.Sprintf("code-%d", i), ClientErrorSample{})
+	}
+
+	stats := l.stats()
+	if len(stats) != maxClientErrorCodes+1 {
+		t.Fatalf("Expected %d tracked codes and other, got %d", maxClientErrorCodes, len(stats))
+	}
+	if stats[0].Code != "render" || stats[0].Count != 100 || len(stats[0].Samples) != clientErrorSamples {
+		t.Errorf("Expected render counted 100 times with %d samples, got %+v", clientErrorSamples, stats[0])
+	}
+	if stats[1].Code != "other" || stats[1].Count != 6 {
+		t.Errorf("Expected codes past the limit counted as other, got %+v", stats[1])
+	}
+}
+
+func TestAdmin_ClientErrors(t *testing.T) {
+	server := NewChatServer(WithAdminToken("secret"))
+	server.Run(t.Context())
+	s := newAdminTestServer(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"/ws?username=alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+	wsjson.Write(ctx, c, Message{Type: "client_error", Code: "ws.parse", Content: "Unexpected token <"})
+	wsjson.Write(ctx, c, Message{Type: "client_error", Code: "Not A Code!", Content: "oops"})
+	// The ping's echo shows both reports were processed
+	wsjson.Write(ctx, c, Message{Type: "message", Content: "ping"})
+	for {
+		var msg Message
+		if err := wsjson.Read(ctx, c, &msg); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if msg.Content == "ping" {
+			break
+		}
+	}
+
+	resp := adminRequest(t, ctx, http.MethodGet, s.URL+"/admin/client-errors", "secret")
+	defer resp.Body.Close()
+	var stats []ClientErrorStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+	codes := map[string]ClientErrorStats{}
+	for _, s := range stats {
+		codes[s.Code] = s
+	}
+	if got := codes["ws.parse"]; got.Count != 1 || got.Samples[0].Content != "Unexpected token <" {
+		t.Errorf("Expected the parse error to be recorded, got %+v", stats)
+	}
+	if codes["unknown"].Count != 1 {
+		t.Errorf("Expected the invalid code to be recorded as unknown, got %+v", stats)
+	}
+}
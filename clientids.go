@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// clientMsgIDWindow is how long a client message ID is remembered, so
+	// a retransmit within it isn't broadcast twice
+	clientMsgIDWindow = time.Minute * 10
+	// maxClientMsgIDLength bounds the IDs clients may choose
+	maxClientMsgIDLength = 64
+)
+
+// sentMessage is a message sent with a client message ID. Until its
+// broadcast is delivered it has no server ID.
+type sentMessage struct {
+	msg Message
+	at  time.Time
+}
+
+// clientMsgIDs remembers the most recent messages sent with client message
+// IDs, keyed by sender and ID, forgetting the oldest first
+type clientMsgIDs struct {
+	mu    sync.Mutex
+	sent  map[string]*sentMessage
+	order []string
+	next  int
+}
+
+func newClientMsgIDs(size int) *clientMsgIDs {
+	return &clientMsgIDs{
+		sent:  make(map[string]*sentMessage, size),
+		order: make([]string, size),
+	}
+}
+
+// clientMsgKey keys a client message ID by its sender, since IDs are only
+// unique per client
+func clientMsgKey(username, id string) string {
+	return username + "\x00" + id
+}
+
+// lookup returns the message username sent with id within the window
+func (s *clientMsgIDs) lookup(username, id string, now time.Time) (*sentMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sent, ok := s.sent[clientMsgKey(username, id)]
+	if !ok || now.Sub(sent.at) > clientMsgIDWindow {
+		return nil, false
+	}
+	copied := *sent
+	return &copied, true
+}
+
+// claim records that username is sending a message with id
+func (s *clientMsgIDs) claim(username, id string, now time.Time) {
+	if id == "" {
+		return
+	}
+	key := clientMsgKey(username, id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sent[key]; !ok {
+		if old := s.order[s.next]; old != "" {
+			delete(s.sent, old)
+		}
+		s.order[s.next] = key
+		s.next = (s.next + 1) % len(s.order)
+	}
+	s.sent[key] = &sentMessage{at: now}
+}
+
+// complete records the broadcast of a claimed message, so a retransmit
+// can be answered with it
+func (s *clientMsgIDs) complete(username, id string, msg Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sent, ok := s.sent[clientMsgKey(username, id)]; ok && sent.msg.ID == "" {
+		sent.msg = msg
+		sent.msg.ClientMsgID = id
+	}
+}
+
+// forget drops a claim whose message was never broadcast
+func (s *clientMsgIDs) forget(username, id string) {
+	if id == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sent, clientMsgKey(username, id))
+}
+
+// resendDuplicate answers a retransmitted message with the broadcast of the
+// original instead of sending it again, reporting whether msg was one. A
+// retransmit that arrives before the original is delivered is dropped,
+// since the echo is still on its way.
+func (cs *ChatServer) resendDuplicate(ctx context.Context, client *Client, msg Message) bool {
+	if msg.ClientMsgID == "" {
+		return false
+	}
+	if len(msg.ClientMsgID) > maxClientMsgIDLength {
+		cs.sendError(ctx, client, protocolErrorf(codeBadFrame, "client_msg_id too long (max %d bytes)", maxClientMsgIDLength), refFor(msg))
+		return true
+	}
+	sent, ok := cs.clientIDs.lookup(client.username, msg.ClientMsgID, cs.now())
+	if !ok {
+		return false
+	}
+	client.logf("Retransmit %s from %s (trace %s)", msg.ClientMsgID, client.username, msg.Trace)
+	if sent.msg.ID == "" {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	if err := client.writeMessage(ctx, sent.msg); err != nil {
+		client.logf("Error resending %s to %s: %v", sent.msg.ID, client.username, err)
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestClientMsgIDs(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+	bob := dialStatusTest(t, ctx, s, "bob")
+
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "hello", ClientMsgID: "c1"})
+	echo := readUntilType(t, ctx, alice, "message")
+	if echo.ClientMsgID != "c1" || echo.ID == "" {
+		t.Fatalf("Expected the echo to carry the client message ID, got %+v", echo)
+	}
+	if msg := readUntilType(t, ctx, bob, "message"); msg.ClientMsgID != "" {
+		t.Errorf("Expected other clients not to see the client message ID, got %+v", msg)
+	}
+
+	// A retransmit gets the original back, and isn't broadcast again
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "hello", ClientMsgID: "c1"})
+	if msg := readUntilType(t, ctx, alice, "message"); msg.ID != echo.ID || msg.Seq != echo.Seq || msg.ClientMsgID != "c1" {
+		t.Errorf("Expected the original broadcast %+v, got %+v", echo, msg)
+	}
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "again", ClientMsgID: "c2"})
+	if msg := readUntilType(t, ctx, bob, "message"); msg.Content != "again" {
+		t.Errorf("Expected bob to get the next message, not the retransmit, got %+v", msg)
+	}
+
+	// IDs are only unique per client
+	wsjson.Write(ctx, bob, Message{Type: "message", Content: "mine", ClientMsgID: "c1"})
+	if msg := readUntilType(t, ctx, bob, "message"); msg.Content != "mine" || msg.ClientMsgID != "c1" {
+		t.Errorf("Expected bob's own c1 to be sent, got %+v", msg)
+	}
+
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "hi", ClientMsgID: strings.Repeat("x", maxClientMsgIDLength+1)})
+	if msg := readUntilType(t, ctx, alice, "error"); msg.Code != codeBadFrame {
+		t.Errorf("Expected a long client message ID to be refused, got %+v", msg)
+	}
+
+	if _, ok := server.clientIDs.lookup("alice", "c1", time.Now().Add(clientMsgIDWindow+time.Minute)); ok {
+		t.Errorf("Expected client message IDs to be forgotten after the window")
+	}
+}
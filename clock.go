@@ -0,0 +1,121 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clock tells the server what time it is
+type Clock interface {
+	Now() time.Time
+}
+
+// timerClock is a Clock that also runs timers
+type timerClock interface {
+	Clock
+	AfterFunc(d time.Duration, f func())
+}
+
+// systemClock is the wall clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// WithClock makes the server take the time from clock: message timestamps,
+// expiry of polls, bans, invites, reservations, cooldowns and cached
+// logins, the audit log, recurring announcement runs, and retention
+// cutoffs. Polls close when a clock with an AfterFunc method, like
+// ManualClock, says; other timers and tickers run in real time, as do
+// network deadlines and latency measurements.
+func WithClock(clock Clock) Option {
+	return func(cs *ChatServer) {
+		cs.clock = clock
+	}
+}
+
+// now returns the time according to the server's clock
+func (cs *ChatServer) now() time.Time {
+	return cs.clock.Now()
+}
+
+// afterFunc calls f once d has passed on the server's clock
+func (cs *ChatServer) afterFunc(d time.Duration, f func()) {
+	if c, ok := cs.clock.(timerClock); ok {
+		c.AfterFunc(d, f)
+		return
+	}
+	time.AfterFunc(d, f)
+}
+
+// ManualClock is a Clock that only moves when told to, for tests
+type ManualClock struct {
+	mu     sync.Mutex
+	t      time.Time
+	timers []manualTimer
+}
+
+// manualTimer is a function waiting for a ManualClock to reach at
+type manualTimer struct {
+	at time.Time
+	f  func()
+}
+
+// NewManualClock returns a clock stopped at t
+func NewManualClock(t time.Time) *ManualClock {
+	return &ManualClock{t: t}
+}
+
+// Now returns the time the clock was last set to
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// Set moves the clock to t, running the timers that fall due
+func (c *ManualClock) Set(t time.Time) {
+	c.mu.Lock()
+	c.t = t
+	c.fire()
+}
+
+// Advance moves the clock forward by d, running the timers that fall due
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.fire()
+}
+
+// AfterFunc calls f once the clock has moved on by d. Like time.AfterFunc,
+// it calls f on its own goroutine if d isn't positive; otherwise f runs on
+// the goroutine that moves the clock.
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) {
+	if d <= 0 {
+		go f()
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timers = append(c.timers, manualTimer{at: c.t.Add(d), f: f})
+}
+
+// fire unlocks the clock and runs the timers due by now, in the order they
+// fall due
+func (c *ManualClock) fire() {
+	var due []manualTimer
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.t) {
+			pending = append(pending, timer)
+		} else {
+			due = append(due, timer)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+	slices.SortStableFunc(due, func(a, b manualTimer) int { return a.at.Compare(b.at) })
+	for _, timer := range due {
+		timer.f()
+	}
+}
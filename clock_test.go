@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Date(2030, time.January, 2, 3, 4, 5, 0, time.UTC)
+	clock := NewManualClock(start)
+	server := NewChatServer(WithClock(clock), WithRetention(time.Minute, 0))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	for i, username := range []string{"alice", "bob"} {
+		c, _, err := websocket.Dial(ctx, wsURL+"?username="+username, &websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer c.CloseNow()
+		now := clock.Now()
+		msg := readUntilType(t, ctx, c, "system")
+		if msg.Timestamp != now.UnixMilli() || msg.Time != now.Format(time.RFC3339) {
+			t.Errorf("Expected %s's join notice stamped %v, got %+v", username, now, msg)
+		}
+		if i == 0 {
+			if err := wsjson.Write(ctx, c, Message{Type: "message", Content: "hello"}); err != nil {
+				t.Fatalf("Failed to send: %v", err)
+			}
+			clock.Advance(time.Second)
+			if msg := readUntilType(t, ctx, c, "message"); msg.Timestamp != start.Add(time.Second).UnixMilli() {
+				t.Errorf("Expected the message stamped a second in, got %+v", msg)
+			}
+		}
+	}
+
+	// Retention cuts off by the clock too
+	if pruned := server.applyRetention(); pruned != 0 {
+		t.Errorf("Expected nothing old enough to prune, got %d", pruned)
+	}
+	clock.Advance(time.Minute * 2)
+	if pruned := server.applyRetention(); pruned != 3 {
+		t.Errorf("Expected both joins and the message pruned, got %d", pruned)
+	}
+}
+
+func TestManualClock_ClosesPolls(t *testing.T) {
+	clock := NewManualClock(time.Date(2030, time.January, 2, 3, 4, 5, 0, time.UTC))
+	server := NewChatServer(WithClock(clock))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	alice := dialStatusTest(t, ctx, s, "alice")
+	closesAt := clock.Now().Add(time.Hour).Format(time.RFC3339)
+	wsjson.Write(ctx, alice, Message{Type: "poll", Content: "Lunch?", Poll: &Poll{Options: []string{"pizza", "sushi"}, ClosesAt: closesAt}})
+	poll := readUntilType(t, ctx, alice, "poll")
+
+	clock.Advance(time.Hour)
+	if tally := readUntilType(t, ctx, alice, "tally"); tally.PollID != poll.ID || !tally.Poll.Closed {
+		t.Errorf("Expected the poll closed an hour in on the clock, got %+v", tally)
+	}
+}
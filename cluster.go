@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	heartbeatInterval = time.Second * 5
+	// peerTimeout is how long a peer may stay silent before it is forgotten
+	peerTimeout = heartbeatInterval * 3
+)
+
+// InstanceInfo describes one server instance in a cluster
+type InstanceInfo struct {
+	ID        string `json:"id"`
+	Advertise string `json:"advertise,omitempty"`
+	Clients   int    `json:"clients"`
+	// Lobby counts the clients in the lobby rather than a room
+	Lobby     int       `json:"lobby"`
+	Load      float64   `json:"load"`
+	StartedAt time.Time `json:"started_at"`
+	LastSeen  time.Time `json:"last_seen,omitempty"`
+}
+
+// ClusterInfo is the response of /api/cluster
+type ClusterInfo struct {
+	Self  InstanceInfo   `json:"self"`
+	Peers []InstanceInfo `json:"peers"`
+}
+
+// peerTable tracks the other instances heard from over the broker
+type peerTable struct {
+	mu    sync.Mutex
+	peers map[string]InstanceInfo
+}
+
+// WithInstanceID sets the identity this instance uses in the cluster
+func WithInstanceID(id string) Option {
+	return func(cs *ChatServer) {
+		cs.instanceID = id
+	}
+}
+
+// WithAdvertiseURL sets the URL clients should use to reach this instance
+func WithAdvertiseURL(u string) Option {
+	return func(cs *ChatServer) {
+		cs.advertise = u
+	}
+}
+
+// defaultInstanceID derives a stable instance ID from the host name and the
+// port we listen on, so restarts keep their identity
+func defaultInstanceID(addr string) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	if _, port, err := net.SplitHostPort(addr); err == nil && port != "" {
+		return fmt.Sprintf("%s-%s", host, port)
+	}
+	return host
+}
+
+// self describes this instance
+func (cs *ChatServer) self() InstanceInfo {
+	cs.clientsMtx.Lock()
+	clients := len(cs.clients)
+	cs.clientsMtx.Unlock()
+
+	return InstanceInfo{
+		ID:        cs.instanceID,
+		Advertise: cs.advertise,
+		Clients:   clients,
+		Lobby:     cs.roomClients(nil),
+		Load:      cs.load().Score,
+		StartedAt: cs.startedAt,
+	}
+}
+
+// runHeartbeats announces this instance to its peers until ctx is cancelled
+func (cs *ChatServer) runHeartbeats(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		cs.sendHeartbeat(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sendHeartbeat publishes this instance's info over the broker
+func (cs *ChatServer) sendHeartbeat(ctx context.Context) {
+	info := cs.self()
+	ctx, cancel := context.WithTimeout(ctx, heartbeatInterval)
+	defer cancel()
+
+	err := cs.broker.Publish(ctx, Message{
+		Type:     "heartbeat",
+		Origin:   cs.instanceID,
+		Instance: &info,
+	})
+	if err != nil {
+		log.Printf("Heartbeat publish failed: %v", err)
+	}
+}
+
+// recordPeer updates the peer table from a heartbeat
+func (cs *ChatServer) recordPeer(info InstanceInfo) {
+	info.LastSeen = cs.now()
+
+	cs.peers.mu.Lock()
+	defer cs.peers.mu.Unlock()
+	if cs.peers.peers == nil {
+		cs.peers.peers = make(map[string]InstanceInfo)
+	}
+	cs.peers.peers[info.ID] = info
+}
+
+// livePeers returns peers heard from recently, sorted by ID
+func (cs *ChatServer) livePeers() []InstanceInfo {
+	cs.peers.mu.Lock()
+	defer cs.peers.mu.Unlock()
+
+	peers := []InstanceInfo{}
+	now := cs.now()
+	for id, info := range cs.peers.peers {
+		if now.Sub(info.LastSeen) > peerTimeout {
+			delete(cs.peers.peers, id)
+			continue
+		}
+		peers = append(peers, info)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return peers
+}
+
+// handleCluster serves GET /api/cluster
+func (cs *ChatServer) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ClusterInfo{
+		Self:  cs.self(),
+		Peers: cs.livePeers(),
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestChatServer_ClusterTopology(t *testing.T) {
+	broker := &memBroker{}
+	serverA := NewChatServer(WithBroker(broker), WithInstanceID("node-a"), WithAdvertiseURL("ws://a.example/ws"))
+	serverA.Run(t.Context())
+	serverB := NewChatServer(WithBroker(broker), WithInstanceID("node-b"))
+	serverB.Run(t.Context())
+
+	serverB.clientsMtx.Lock()
+	serverB.clients[&Client{username: "bob"}] = true
+	serverB.clientsMtx.Unlock()
+
+	serverA.sendHeartbeat(context.Background())
+	serverB.sendHeartbeat(context.Background())
+
+	rec := httptest.NewRecorder()
+	serverA.handleCluster(rec, httptest.NewRequest(http.MethodGet, "/api/cluster", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+
+	var info ClusterInfo
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if info.Self.ID != "node-a" || info.Self.Advertise != "ws://a.example/ws" {
+		t.Errorf("Unexpected self: %+v", info.Self)
+	}
+	if len(info.Peers) != 1 {
+		t.Fatalf("Expected 1 peer, got %+v", info.Peers)
+	}
+	if info.Peers[0].ID != "node-b" || info.Peers[0].Clients != 1 {
+		t.Errorf("Unexpected peer: %+v", info.Peers[0])
+	}
+}
+
+func TestChatServer_StalePeersExpire(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	server := NewChatServer(WithClock(clock))
+	server.recordPeer(InstanceInfo{ID: "gone"})
+	clock.Advance(peerTimeout * 2)
+	server.recordPeer(InstanceInfo{ID: "alive"})
+
+	peers := server.livePeers()
+	if len(peers) != 1 || peers[0].ID != "alive" {
+		t.Errorf("Expected only the live peer, got %+v", peers)
+	}
+}
+
+func TestDefaultInstanceID(t *testing.T) {
+	if a, b := defaultInstanceID(":8080"), defaultInstanceID(":8081"); a == b {
+		t.Errorf("Expected instances on different ports to get different IDs, both got %q", a)
+	}
+	if a, b := defaultInstanceID(":8080"), defaultInstanceID(":8080"); a != b {
+		t.Errorf("Expected a stable ID, got %q then %q", a, b)
+	}
+}
+
+func TestChatServer_RoutingHintsOnUpgrade(t *testing.T) {
+	server := NewChatServer(WithInstanceID("node-a"))
+	server.Run(t.Context())
+
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username=alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	if got := resp.Header.Get(instanceHeader); got != "node-a" {
+		t.Errorf("Expected %s header node-a, got %q", instanceHeader, got)
+	}
+	var found bool
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == defaultAffinityCookie {
+			found = cookie.Value == "node-a"
+		}
+	}
+	if !found {
+		t.Errorf("Expected %s cookie naming node-a, got %v", defaultAffinityCookie, resp.Cookies())
+	}
+}
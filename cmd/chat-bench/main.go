@@ -0,0 +1,263 @@
+// Command chat-bench load-tests a chat server.
+//
+// It connects a number of simulated clients, has each of them send messages
+// at a fixed rate, and reports broadcast delivery latency percentiles and
+// dropped messages. When the server runs on the same Linux host, pass its
+// process ID with -pid to also report the server's CPU and memory usage.
+//
+// Usage:
+//
+//	chat-bench -server localhost:8080 -clients 200 -rate 2 -duration 30s
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bvedant/ideal-guacamole/client"
+	"github.com/coder/websocket"
+)
+
+// config holds the benchmark parameters
+type config struct {
+	server   string
+	clients  int
+	rate     float64
+	duration time.Duration
+	drain    time.Duration
+	size     int
+	pid      int
+	compress bool
+}
+
+// result holds the measurements of a benchmark run
+type result struct {
+	clients   int
+	sent      int64
+	expected  int64
+	received  int64
+	latencies []time.Duration
+	elapsed   time.Duration
+	before    procStats
+	after     procStats
+	havePid   bool
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.server, "server", "localhost:8080", "chat server address (host:port or ws:// URL)")
+	flag.IntVar(&cfg.clients, "clients", 50, "number of simulated clients")
+	flag.Float64Var(&cfg.rate, "rate", 1, "messages per second sent by each client")
+	flag.DurationVar(&cfg.duration, "duration", time.Second*10, "how long to send messages for")
+	flag.DurationVar(&cfg.drain, "drain", time.Second*2, "how long to wait for in-flight messages after sending stops")
+	flag.IntVar(&cfg.size, "size", 64, "approximate message size in bytes")
+	flag.IntVar(&cfg.pid, "pid", 0, "server process ID to sample CPU and memory usage from (Linux only)")
+	flag.BoolVar(&cfg.compress, "compress", false, "request permessage-deflate compression")
+	flag.Parse()
+
+	if cfg.clients < 1 || cfg.rate <= 0 {
+		log.Fatal("-clients and -rate must be positive")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	res, err := run(ctx, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	res.report(os.Stdout)
+}
+
+// run connects the simulated clients, drives traffic and collects results
+func run(ctx context.Context, cfg config) (*result, error) {
+	runID := strconv.FormatInt(time.Now().UnixNano(), 36)
+	prefix := "bench:" + runID + ":"
+
+	res := &result{clients: cfg.clients}
+	if cfg.pid > 0 {
+		stats, err := readProcStats(cfg.pid)
+		if err != nil {
+			return nil, fmt.Errorf("sampling server process: %w", err)
+		}
+		res.before = stats
+		res.havePid = true
+	}
+
+	// Connect every client before any traffic starts so they all see every message
+	conns := make([]*client.Conn, cfg.clients)
+	for i := range conns {
+		dialCtx, cancel := context.WithTimeout(ctx, time.Second*10)
+		opts := client.Options{Username: fmt.Sprintf("bench-%s-%d", runID, i)}
+		if cfg.compress {
+			opts.CompressionMode = websocket.CompressionContextTakeover
+		}
+		conn, err := client.Dial(dialCtx, cfg.server, opts)
+		cancel()
+		if err != nil {
+			for _, c := range conns[:i] {
+				c.Close()
+			}
+			return nil, fmt.Errorf("connecting client %d: %w", i, err)
+		}
+		conns[i] = conn
+	}
+	log.Printf("Connected %d clients", cfg.clients)
+
+	readCtx, stopReading := context.WithCancel(context.Background())
+	var received atomic.Int64
+	latencies := make([][]time.Duration, cfg.clients)
+	var readers sync.WaitGroup
+	for i, conn := range conns {
+		readers.Add(1)
+		go func(i int, conn *client.Conn) {
+			defer readers.Done()
+			for {
+				msg, err := conn.Read(readCtx)
+				if err != nil {
+					return
+				}
+				sentAt, ok := parseSentAt(msg.Content, prefix)
+				if !ok {
+					continue
+				}
+				received.Add(1)
+				latencies[i] = append(latencies[i], time.Since(sentAt))
+			}
+		}(i, conn)
+	}
+
+	// Each client sends at the configured rate, with a random initial offset
+	// so sends are spread out instead of arriving in lockstep bursts
+	padding := strings.Repeat("x", max(0, cfg.size-len(prefix)-20))
+	interval := time.Duration(float64(time.Second) / cfg.rate)
+	sendCtx, stopSending := context.WithTimeout(ctx, cfg.duration)
+	defer stopSending()
+
+	start := time.Now()
+	var sent atomic.Int64
+	var senders sync.WaitGroup
+	for _, conn := range conns {
+		senders.Add(1)
+		go func(conn *client.Conn) {
+			defer senders.Done()
+			select {
+			case <-time.After(time.Duration(rand.Int63n(int64(interval)))):
+			case <-sendCtx.Done():
+				return
+			}
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				content := prefix + strconv.FormatInt(time.Now().UnixNano(), 10) + ":" + padding
+				writeCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+				err := conn.Send(writeCtx, content)
+				cancel()
+				if err != nil {
+					log.Printf("Send failed: %v", err)
+					return
+				}
+				sent.Add(1)
+
+				select {
+				case <-ticker.C:
+				case <-sendCtx.Done():
+					return
+				}
+			}
+		}(conn)
+	}
+	senders.Wait()
+
+	// Give in-flight broadcasts a chance to arrive before counting drops
+	select {
+	case <-time.After(cfg.drain):
+	case <-ctx.Done():
+	}
+	res.elapsed = time.Since(start)
+
+	if res.havePid {
+		stats, err := readProcStats(cfg.pid)
+		if err != nil {
+			log.Printf("Failed to sample server process: %v", err)
+			res.havePid = false
+		} else {
+			res.after = stats
+		}
+	}
+
+	stopReading()
+	readers.Wait()
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	res.sent = sent.Load()
+	res.expected = res.sent * int64(cfg.clients)
+	res.received = received.Load()
+	for _, l := range latencies {
+		res.latencies = append(res.latencies, l...)
+	}
+	return res, nil
+}
+
+// parseSentAt extracts the send timestamp embedded in a benchmark message
+func parseSentAt(content, prefix string) (time.Time, bool) {
+	rest, ok := strings.CutPrefix(content, prefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	stamp, _, _ := strings.Cut(rest, ":")
+	nanos, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+// percentile returns the p-th percentile of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted)-1) * p / 100)
+	return sorted[idx]
+}
+
+// report prints a human-readable summary of the run
+func (r *result) report(w io.Writer) {
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+
+	dropped := r.expected - r.received
+	dropRate := 0.0
+	if r.expected > 0 {
+		dropRate = float64(dropped) / float64(r.expected) * 100
+	}
+
+	fmt.Fprintf(w, "Clients:    %d\n", r.clients)
+	fmt.Fprintf(w, "Sent:       %d messages (%.1f/s)\n", r.sent, float64(r.sent)/r.elapsed.Seconds())
+	fmt.Fprintf(w, "Delivered:  %d of %d expected (%.1f/s)\n", r.received, r.expected, float64(r.received)/r.elapsed.Seconds())
+	fmt.Fprintf(w, "Dropped:    %d (%.2f%%)\n", dropped, dropRate)
+	fmt.Fprintf(w, "Latency:    p50=%v p90=%v p99=%v max=%v\n",
+		percentile(r.latencies, 50), percentile(r.latencies, 90),
+		percentile(r.latencies, 99), percentile(r.latencies, 100))
+
+	if r.havePid {
+		cpu := r.after.cpu - r.before.cpu
+		fmt.Fprintf(w, "Server CPU: %v (%.1f%% of one core)\n", cpu, cpu.Seconds()/r.elapsed.Seconds()*100)
+		fmt.Fprintf(w, "Server RSS: %.1f MiB (was %.1f MiB)\n",
+			float64(r.after.rss)/(1<<20), float64(r.before.rss)/(1<<20))
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is the kernel's USER_HZ, which is 100 on every mainstream Linux build
+const clockTicks = 100
+
+// procStats is a sample of a process's resource usage
+type procStats struct {
+	cpu time.Duration
+	rss int64
+}
+
+// readProcStats samples CPU time and resident memory of pid from /proc
+func readProcStats(pid int) (procStats, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return procStats{}, err
+	}
+	// The command name may contain spaces, so skip past its closing paren
+	s := string(stat)
+	fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+	if len(fields) < 22 {
+		return procStats{}, fmt.Errorf("unexpected /proc/%d/stat format", pid)
+	}
+	// utime and stime are fields 14 and 15 of the full line
+	utime, err1 := strconv.ParseInt(fields[11], 10, 64)
+	stime, err2 := strconv.ParseInt(fields[12], 10, 64)
+	rssPages, err3 := strconv.ParseInt(fields[21], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return procStats{}, fmt.Errorf("unexpected /proc/%d/stat format", pid)
+	}
+
+	return procStats{
+		cpu: time.Duration(utime+stime) * time.Second / clockTicks,
+		rss: rssPages * int64(os.Getpagesize()),
+	}, nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// procStats is a sample of a process's resource usage
+type procStats struct {
+	cpu time.Duration
+	rss int64
+}
+
+// readProcStats is only implemented on Linux
+func readProcStats(pid int) (procStats, error) {
+	return procStats{}, errors.New("process sampling is only supported on Linux")
+}
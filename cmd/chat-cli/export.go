@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/bvedant/ideal-guacamole/client"
+)
+
+const exportUsage = `Usage: chat-cli export [flags]
+
+Downloads a room's stored history through the admin API as JSON Lines,
+CSV or a standalone HTML transcript. Writes to stdout unless -o is given.`
+
+// export streams a room's history from /admin/export to a file or out
+func export(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.Usage = func() {
+		fmt.Fprintln(out, exportUsage)
+		fs.PrintDefaults()
+	}
+	server := fs.String("server", "localhost:8080", "chat server address (host:port or URL)")
+	token := fs.String("token", os.Getenv("CHAT_ADMIN_TOKEN"), "admin token (defaults to $CHAT_ADMIN_TOKEN)")
+	room := fs.String("room", "", "room to export (default the lobby)")
+	from := fs.String("from", "", "start of the range, RFC 3339 or YYYY-MM-DD")
+	to := fs.String("to", "", "end of the range, RFC 3339 or YYYY-MM-DD (inclusive)")
+	format := fs.String("format", "jsonl", "jsonl, csv or html")
+	output := fs.String("o", "", "file to write (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	u, err := client.WebSocketURL(*server)
+	if err != nil {
+		return err
+	}
+	u.Scheme = map[string]string{"ws": "http", "wss": "https"}[u.Scheme]
+	u.Path = "/admin/export"
+	u.RawQuery = url.Values{"room": {*room}, "from": {*from}, "to": {*to}, "format": {*format}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("export failed: %s: %s", resp.Status, msg)
+	}
+
+	dst := out
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		dst = f
+	}
+	_, err = io.Copy(dst, resp.Body)
+	return err
+}
@@ -0,0 +1,151 @@
+// Command chat-cli is a terminal client for the chat server.
+//
+// Usage:
+//
+//	chat-cli --server localhost:8080 --username alice --room general
+//	chat-cli export --room general --from 2024-01-01 --format html -o general.html
+//	chat-cli verify -key <public key> [file]
+//
+// Lines typed on stdin are sent as chat messages. Lines starting with a slash
+// are commands: /help and /quit are handled locally, anything else is sent to
+// the server as-is.
+//
+// The export subcommand downloads a room's history through the admin API,
+// and verify checks exported history against the server's signing key.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/bvedant/ideal-guacamole/client"
+)
+
+const helpText = `Commands:
+  /help    show this help
+  /quit    leave the chat
+  /nick    change your username, e.g. /nick alice
+Any other /command is sent to the server.`
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		if err := verify(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := export(ctx, os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	server := flag.String("server", "localhost:8080", "chat server address (host:port or ws:// URL)")
+	username := flag.String("username", "", "username to join with (server picks one if empty)")
+	room := flag.String("room", "", "room to join")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := run(ctx, *server, client.Options{Username: *username, Room: *room}, os.Stdin, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run connects to the server and pumps messages between the terminal and the connection
+func run(ctx context.Context, server string, opts client.Options, in io.Reader, out io.Writer) error {
+	dialCtx, cancel := context.WithTimeout(ctx, time.Second*10)
+	conn, err := client.Dial(dialCtx, server, opts)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if id := conn.ID(); id != "" {
+		fmt.Fprintf(out, "Connected (connection %s)\n", id)
+	}
+
+	// Render incoming messages until the connection ends
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := conn.Read(ctx)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			fmt.Fprintln(out, render(msg))
+		}
+	}()
+
+	// Read stdin on its own goroutine so a blocked terminal read can't hold up shutdown
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-readErr:
+			if client.IsClosed(err) || ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("connection lost: %w", err)
+		case line, ok := <-lines:
+			if !ok {
+				return nil
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			switch strings.Fields(line)[0] {
+			case "/quit":
+				return nil
+			case "/help":
+				fmt.Fprintln(out, helpText)
+				continue
+			}
+
+			sendCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+			err := conn.Send(sendCtx, line)
+			cancel()
+			if err != nil {
+				return fmt.Errorf("send failed: %w", err)
+			}
+		}
+	}
+}
+
+// render formats a message for display in the terminal
+func render(msg client.Message) string {
+	stamp := msg.Time
+	if t, err := time.Parse(time.RFC3339, msg.Time); err == nil {
+		stamp = t.Local().Format("15:04")
+	}
+	if msg.Type == "error" {
+		return fmt.Sprintf("[%s] ! %s (%s)", stamp, msg.Content, msg.Code)
+	}
+	if msg.Type == "system" || msg.Type == "rename" || msg.Type == "tombstone" || msg.Type == "presence" {
+		return fmt.Sprintf("[%s] * %s", stamp, msg.Content)
+	}
+	return fmt.Sprintf("[%s] <%s> %s", stamp, msg.Username, msg.Content)
+}
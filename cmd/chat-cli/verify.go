@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/bvedant/ideal-guacamole/chain"
+)
+
+const verifyUsage = `Usage: chat-cli verify -key <public key> [file]
+
+Checks that exported history, as JSON Lines of messages or history pages
+from /api/history, is signed by the server and unaltered. The public key
+is served at /api/signing-key. Reads stdin when no file is given.`
+
+// verify checks a signed history export and prints a summary
+func verify(args []string, stdin io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.Usage = func() { fmt.Fprintln(out, verifyUsage) }
+	key := fs.String("key", "", "base64 Ed25519 public key of the server")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	pub, err := chain.ParsePublicKey(*key)
+	if err != nil {
+		return err
+	}
+
+	in := stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	records, err := readRecords(in)
+	if err != nil {
+		return err
+	}
+
+	report, err := chain.Verify(pub, records)
+	if err != nil {
+		return fmt.Errorf("verification failed: %w", err)
+	}
+	fmt.Fprintf(out, "OK: %d messages verified (seq %d-%d)\n", report.Verified, report.FirstSeq, report.LastSeq)
+	if len(report.Redacted) > 0 {
+		fmt.Fprintf(out, "%d messages were erased since signing: seq %v\n", len(report.Redacted), report.Redacted)
+	}
+	if report.Unsigned > 0 {
+		fmt.Fprintf(out, "%d unsigned messages skipped\n", report.Unsigned)
+	}
+	return nil
+}
+
+// readRecords decodes a stream of messages or history pages, ordered by
+// sequence number
+func readRecords(in io.Reader) ([]chain.Record, error) {
+	var records []chain.Record
+	dec := json.NewDecoder(in)
+	for {
+		var v struct {
+			chain.Record
+			Messages []chain.Record `json:"messages"`
+		}
+		err := dec.Decode(&v)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading export: %w", err)
+		}
+		if v.Messages != nil {
+			records = append(records, v.Messages...)
+		} else {
+			records = append(records, v.Record)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Seq < records[j].Seq })
+	return records, nil
+}
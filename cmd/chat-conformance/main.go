@@ -0,0 +1,55 @@
+// Command chat-conformance checks a running chat server against the
+// WebSocket protocol and prints a compliance report.
+//
+// It exits with status 1 if any check fails, so it can gate CI pipelines.
+//
+// Usage:
+//
+//	chat-conformance -server localhost:8080 [-json] [-only negotiate/]
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/bvedant/ideal-guacamole/client"
+	"github.com/bvedant/ideal-guacamole/conformance"
+)
+
+func main() {
+	server := flag.String("server", "localhost:8080", "chat server address (host:port or ws:// URL)")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	only := flag.String("only", "", "only run checks whose names start with this prefix")
+	timeout := flag.Duration("timeout", time.Second*10, "time limit for each check")
+	flag.Parse()
+
+	u, err := client.WebSocketURL(*server)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report, err := conformance.Run(ctx, u.String(), conformance.Options{Timeout: *timeout, Only: *only})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		fmt.Print(report)
+	}
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
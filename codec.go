@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/coder/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes protocol frames for the wire. The codec is chosen per
+// connection during subprotocol negotiation.
+type Codec interface {
+	// MessageType is the WebSocket frame type the codec writes
+	MessageType() websocket.MessageType
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+	// NewEncoder returns an encoder that appends frames to buf, for
+	// callers reusing one buffer across many frames
+	NewEncoder(buf *bytes.Buffer) Encoder
+}
+
+// Encoder encodes one frame per call
+type Encoder interface {
+	Encode(v any) error
+}
+
+// jsonCodec is the default text codec
+type jsonCodec struct{}
+
+func (jsonCodec) MessageType() websocket.MessageType { return websocket.MessageText }
+
+func (jsonCodec) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+func (jsonCodec) NewEncoder(buf *bytes.Buffer) Encoder {
+	return jsonEncoder{json.NewEncoder(buf), buf}
+}
+
+// jsonEncoder drops the newline json.Encoder ends each value with, so
+// frames match json.Marshal output
+type jsonEncoder struct {
+	enc *json.Encoder
+	buf *bytes.Buffer
+}
+
+func (e jsonEncoder) Encode(v any) error {
+	if err := e.enc.Encode(v); err != nil {
+		return err
+	}
+	e.buf.Truncate(e.buf.Len() - 1)
+	return nil
+}
+
+// msgpackCodec is a binary codec using MessagePack. Field names follow the
+// JSON tags so both codecs describe the same schema.
+type msgpackCodec struct{}
+
+func (msgpackCodec) MessageType() websocket.MessageType { return websocket.MessageBinary }
+
+func (c msgpackCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := c.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) NewEncoder(buf *bytes.Buffer) Encoder {
+	enc := msgpack.NewEncoder(buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	return enc
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// maxRetainedFrameBuffer caps the write buffer a client keeps between
+// frames, so one large history page doesn't pin memory for the life of
+// the connection
+const maxRetainedFrameBuffer = 64 << 10
+
+// frameWriter encodes a client's outgoing frames into a buffer reused
+// across writes, so a steady stream of broadcasts encodes without
+// allocating a new buffer per frame
+type frameWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	enc Encoder
+}
+
+// write encodes v with the client's codec and sends it as a single frame
+func (c *Client) write(ctx context.Context, v any) error {
+	w := &c.out
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.enc == nil || w.buf.Cap() > maxRetainedFrameBuffer {
+		w.buf = bytes.Buffer{}
+		w.enc = c.codec.NewEncoder(&w.buf)
+	}
+	w.buf.Reset()
+	if err := w.enc.Encode(v); err != nil {
+		return fmt.Errorf("failed to encode frame: %w", err)
+	}
+	return c.sendLocked(ctx, w.buf.Bytes())
+}
+
+// writeFrame sends a frame already encoded with the client's codec
+func (c *Client) writeFrame(ctx context.Context, data []byte) error {
+	c.out.mu.Lock()
+	defer c.out.mu.Unlock()
+	return c.sendLocked(ctx, data)
+}
+
+// sendLocked sends an encoded frame. Callers hold c.out.mu.
+func (c *Client) sendLocked(ctx context.Context, data []byte) error {
+	c.observe("out", data)
+	c.countOut(len(data))
+	if c.events != nil {
+		return c.events.send(ctx, data)
+	}
+	return c.conn.Write(ctx, c.codec.MessageType(), data)
+}
+
+// frameKey identifies one encoding of a broadcast. Clients differ only in
+// codec and protocol version, apart from the sequence number global events
+// lose outside the lobby and the client message ID only the sender gets.
+type frameKey struct {
+	codec       Codec
+	v1          bool
+	seq         uint64
+	clientMsgID string
+}
+
+// encodedFrames holds a broadcast's encodings, so a message fanned out to
+// many clients is encoded once per codec and protocol version rather than
+// once per client
+type encodedFrames map[frameKey][]byte
+
+// encode returns msg encoded for client, encoding it on first use
+func (f encodedFrames) encode(client *Client, msg Message) ([]byte, error) {
+	key := frameKey{codec: client.codec, v1: client.version == protocolV1, seq: msg.Seq, clientMsgID: msg.ClientMsgID}
+	if data, ok := f[key]; ok {
+		return data, nil
+	}
+	var v any = msg
+	if key.v1 {
+		v = toV1(msg)
+	}
+	data, err := client.codec.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode frame: %w", err)
+	}
+	f[key] = data
+	return data, nil
+}
+
+// readMessage reads and decodes the next frame from the client
+func (c *Client) readMessage(ctx context.Context, msg *Message) error {
+	typ, data, err := c.conn.Read(ctx)
+	if err != nil {
+		return err
+	}
+	c.observe("in", data)
+	c.countIn(len(data))
+	if typ != c.codec.MessageType() {
+		if typ == websocket.MessageBinary && c.textOnly {
+			return errBinaryFrame
+		}
+		return protocolErrorf(codeBadFrame, "unexpected frame type %v for negotiated codec", typ)
+	}
+	return decodeFrame(c.codec, data, msg, c.lenient)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/coder/websocket"
+)
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	in := Message{Type: "message", Username: "alice", Content: "héllo", Seq: 42, Timestamp: 1700000000000}
+
+	for name, codec := range map[string]Codec{"json": jsonCodec{}, "msgpack": msgpackCodec{}} {
+		data, err := codec.Marshal(in)
+		if err != nil {
+			t.Fatalf("%s: marshal failed: %v", name, err)
+		}
+		var out Message
+		if err := codec.Unmarshal(data, &out); err != nil {
+			t.Fatalf("%s: unmarshal failed: %v", name, err)
+		}
+		if out.Type != in.Type || out.Username != in.Username || out.Content != in.Content ||
+			out.Seq != in.Seq || out.Timestamp != in.Timestamp {
+			t.Errorf("%s: round trip mismatch: got %+v", name, out)
+		}
+	}
+
+	// MessagePack should be the more compact of the two
+	j, _ := jsonCodec{}.Marshal(in)
+	m, _ := msgpackCodec{}.Marshal(in)
+	if len(m) >= len(j) {
+		t.Errorf("Expected msgpack (%d bytes) to be smaller than JSON (%d bytes)", len(m), len(j))
+	}
+}
+
+func TestChatServer_MsgpackClient(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+	c, _, err := websocket.Dial(ctx, wsURL+"?username=packer", &websocket.DialOptions{
+		Subprotocols: []string{subprotocolV2Msgpack, subprotocolV2},
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	if c.Subprotocol() != subprotocolV2Msgpack {
+		t.Fatalf("Expected %q, got %q", subprotocolV2Msgpack, c.Subprotocol())
+	}
+
+	codec := msgpackCodec{}
+	read := func() Message {
+		typ, data, err := c.Read(ctx)
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if typ != websocket.MessageBinary {
+			t.Fatalf("Expected binary frame, got %v", typ)
+		}
+		var msg Message
+		if err := codec.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("Failed to decode: %v", err)
+		}
+		return msg
+	}
+
+	if msg := read(); msg.Type != "system" || !strings.Contains(msg.Content, "packer has joined") {
+		t.Errorf("Unexpected welcome message: %+v", msg)
+	}
+
+	data, _ := codec.Marshal(Message{Type: "message", Content: "binary hello"})
+	if err := c.Write(ctx, websocket.MessageBinary, data); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if msg := read(); msg.Content != "binary hello" || msg.Username != "packer" || msg.Seq == 0 {
+		t.Errorf("Unexpected echoed message: %+v", msg)
+	}
+}
+
+func TestCodecs_EncoderMatchesMarshal(t *testing.T) {
+	msgs := []Message{
+		{Type: "message", Username: "alice", Content: "<b>héllo</b>", Seq: 42, Timestamp: 1700000000000},
+		{Type: "system", Username: "Server", Content: "bob has joined the chat"},
+	}
+	for name, codec := range map[string]Codec{"json": jsonCodec{}, "msgpack": msgpackCodec{}} {
+		var buf bytes.Buffer
+		enc := codec.NewEncoder(&buf)
+		for _, msg := range msgs {
+			buf.Reset()
+			if err := enc.Encode(msg); err != nil {
+				t.Fatalf("%s: encode failed: %v", name, err)
+			}
+			want, _ := codec.Marshal(msg)
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("%s: encoder wrote %q, Marshal %q", name, buf.Bytes(), want)
+			}
+		}
+	}
+}
+
+// newBenchClient connects a Client to a server that discards what it reads
+func newBenchClient(b *testing.B, codec Codec) *Client {
+	b.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.CloseNow()
+		for {
+			if _, _, err := c.Reader(r.Context()); err != nil {
+				return
+			}
+		}
+	}))
+	b.Cleanup(s.Close)
+
+	c, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		b.Fatalf("Failed to connect: %v", err)
+	}
+	b.Cleanup(func() { c.CloseNow() })
+	return &Client{id: "bench", conn: c, codec: codec, version: protocolV2}
+}
+
+func BenchmarkClientWrite(b *testing.B) {
+	msg := Message{
+		Type:      "message",
+		Username:  "alice",
+		Content:   strings.Repeat("hello ", 20),
+		Time:      time.Now().Format(time.RFC3339),
+		ID:        newMessageID(),
+		Timestamp: time.Now().UnixMilli(),
+		Seq:       12345,
+		Trace:     newTraceID(),
+	}
+	for name, codec := range map[string]Codec{"json": jsonCodec{}, "msgpack": msgpackCodec{}} {
+		b.Run(name, func(b *testing.B) {
+			client := newBenchClient(b, codec)
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := client.writeMessage(ctx, msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCodecEncode(b *testing.B) {
+	msg := Message{Type: "message", Username: "alice", Content: strings.Repeat("hello ", 20), Seq: 12345}
+	for name, codec := range map[string]Codec{"json": jsonCodec{}, "msgpack": msgpackCodec{}} {
+		b.Run(name+"/marshal", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				codec.Marshal(msg)
+			}
+		})
+		b.Run(name+"/reused", func(b *testing.B) {
+			var buf bytes.Buffer
+			enc := codec.NewEncoder(&buf)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				enc.Encode(msg)
+			}
+		})
+	}
+}
+
+func TestEncodedFrames(t *testing.T) {
+	msg := Message{Type: "message", Username: "alice", Content: "hi", Seq: 7}
+	alice := &Client{username: "alice", version: protocolV2, codec: jsonCodec{}}
+	bob := &Client{username: "bob", version: protocolV2, codec: jsonCodec{}}
+	old := &Client{username: "old", version: protocolV1, codec: jsonCodec{}}
+	binary := &Client{username: "binary", version: protocolV2, codec: msgpackCodec{}}
+
+	frames := encodedFrames{}
+	encode := func(c *Client, m Message) []byte {
+		data, err := frames.encode(c, m)
+		if err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+		return data
+	}
+	shared := encode(bob, msg)
+	if again := encode(alice, msg); &again[0] != &shared[0] {
+		t.Errorf("Expected clients with the same codec and version to share one encoding")
+	}
+	want, _ := jsonCodec{}.Marshal(msg)
+	if !bytes.Equal(shared, want) {
+		t.Errorf("Expected %s, got %s", want, shared)
+	}
+	v1, _ := jsonCodec{}.Marshal(toV1(msg))
+	if got := encode(old, msg); !bytes.Equal(got, v1) {
+		t.Errorf("Expected the v1 encoding %s, got %s", v1, got)
+	}
+	packed, _ := msgpackCodec{}.Marshal(msg)
+	if got := encode(binary, msg); !bytes.Equal(got, packed) {
+		t.Errorf("Expected the msgpack encoding for msgpack clients")
+	}
+	own := msg
+	own.ClientMsgID = "c1"
+	if got := encode(alice, own); bytes.Equal(got, shared) {
+		t.Errorf("Expected the sender's copy to be encoded on its own")
+	}
+	if len(frames) != 4 {
+		t.Errorf("Expected 4 encodings, got %d", len(frames))
+	}
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	f.Add([]byte(`{"type":"message","content":"hello"}`))
+	f.Add([]byte("{\"type\":\"message\",\"content\":\"bad \xff\xfe utf-8\"}"))
+	f.Add([]byte(`{"type":"message","content":"bell\u0007 and nul\u0000"}`))
+	f.Add([]byte(`{"type":"rename","content":"/nick  bob "}`))
+	f.Add([]byte(`{"type":"poll","content":"?","poll":{"options":["a","b"],"counts":[1]}}`))
+	f.Add([]byte(`{"type":"key","ciphertext":"AAAA","to":"bob"}`))
+	f.Add([]byte(`{"content":` + strings.Repeat(`[`, 20000) + strings.Repeat(`]`, 20000) + `}`))
+	f.Add([]byte(`{"x":` + strings.Repeat(`{"x":`, 5000) + `1` + strings.Repeat(`}`, 5001)))
+	packed, _ := msgpackCodec{}.Marshal(Message{Type: "message", Content: "bad \xff utf-8"})
+	f.Add(packed)
+	encrypted := &Room{Name: "e2ee", Encrypted: true}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, codec := range []Codec{jsonCodec{}, msgpackCodec{}} {
+			var msg Message
+			if err := codec.Unmarshal(data, &msg); err != nil {
+				continue
+			}
+			parseRename(msg)
+			msg.validateIn(encrypted, maxMessageLength)
+			if err := msg.validateIn(nil, maxMessageLength); err == nil {
+				if !utf8.ValidString(msg.Content) || strings.ContainsFunc(msg.Content, isControl) {
+					t.Errorf("Expected content %q to be refused", msg.Content)
+				}
+			}
+			if _, err := codec.Marshal(msg); err != nil {
+				t.Errorf("Failed to encode a decoded message: %v", err)
+			}
+		}
+	})
+}
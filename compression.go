@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/coder/websocket"
+)
+
+// WithCompression configures permessage-deflate for accepted connections.
+// Messages smaller than threshold bytes are sent uncompressed; zero uses
+// the library default.
+func WithCompression(mode websocket.CompressionMode, threshold int) Option {
+	return func(cs *ChatServer) {
+		cs.compressionMode = mode
+		cs.compressionThreshold = threshold
+	}
+}
+
+// parseCompressionMode maps a flag value to a compression mode
+func parseCompressionMode(s string) (websocket.CompressionMode, error) {
+	switch s {
+	case "disabled", "off", "":
+		return websocket.CompressionDisabled, nil
+	case "context-takeover":
+		return websocket.CompressionContextTakeover, nil
+	case "no-context-takeover":
+		return websocket.CompressionNoContextTakeover, nil
+	default:
+		return 0, fmt.Errorf("unknown compression mode %q (want disabled, context-takeover or no-context-takeover)", s)
+	}
+}
+
+// countingConn counts the bytes that actually cross the network, after
+// compression and framing
+type countingConn struct {
+	net.Conn
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	metrics.Add(metricWireBytesIn, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	metrics.Add(metricWireBytesOut, int64(n))
+	return n, err
+}
+
+// countingResponseWriter hands the WebSocket library a counting connection
+// when it hijacks the HTTP connection
+type countingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("http.ResponseWriter does not implement http.Hijacker")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := brw.Writer.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	counted := &countingConn{Conn: conn}
+	// Unread request bytes stay in brw.Reader; the WebSocket library
+	// re-chains them in front of the connection we return
+	return counted, bufio.NewReadWriter(brw.Reader, bufio.NewWriter(counted)), nil
+}
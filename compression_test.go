@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func metricValue(name string) int64 {
+	if v, ok := metrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestChatServer_Compression(t *testing.T) {
+	server := NewChatServer(WithCompression(websocket.CompressionContextTakeover, 128))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username=alice", &websocket.DialOptions{
+		CompressionMode: websocket.CompressionContextTakeover,
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("Expected permessage-deflate to be negotiated, got %q", ext)
+	}
+
+	var msg Message
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read welcome message: %v", err)
+	}
+
+	payloadBefore := metricValue(metricPayloadBytesOut)
+	wireBefore := metricValue(metricWireBytesOut)
+
+	content := strings.Repeat("compress me ", 300)
+	if err := wsjson.Write(ctx, c, Message{Type: "message", Content: content}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if msg.Content != content {
+		t.Fatalf("Message content was corrupted in transit")
+	}
+
+	payload := metricValue(metricPayloadBytesOut) - payloadBefore
+	wire := metricValue(metricWireBytesOut) - wireBefore
+	if payload < int64(len(content)) {
+		t.Errorf("Expected at least %d payload bytes out, got %d", len(content), payload)
+	}
+	if wire <= 0 || wire >= payload {
+		t.Errorf("Expected compressed wire bytes (%d) to be below payload bytes (%d)", wire, payload)
+	}
+}
+
+func TestParseCompressionMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    websocket.CompressionMode
+		wantErr bool
+	}{
+		{"disabled", websocket.CompressionDisabled, false},
+		{"context-takeover", websocket.CompressionContextTakeover, false},
+		{"no-context-takeover", websocket.CompressionNoContextTakeover, false},
+		{"gzip", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCompressionMode(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCompressionMode(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("parseCompressionMode(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
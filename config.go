@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// LiveConfig holds the settings that can change while the server runs. It
+// is read from the -config file at startup and again on SIGHUP or POST
+// /admin/reload, without dropping connections. Settings left out of the
+// file fall back to their command-line flags.
+type LiveConfig struct {
+	// BandwidthBytesPerSecond and BandwidthBurst replace -bandwidth-cap and
+	// -bandwidth-burst
+	BandwidthBytesPerSecond *int64 `json:"bandwidth_bytes_per_second,omitempty"`
+	BandwidthBurst          *int64 `json:"bandwidth_burst,omitempty"`
+	// BannedWords are refused in chat messages, matched as whole words
+	// regardless of case
+	BannedWords []string `json:"banned_words,omitempty"`
+	// AllowedOrigins are the host patterns, such as chat.example.org or
+	// *.example.org, browsers may open WebSockets from. Empty allows any.
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+	// MOTD replaces the message of the day; an empty string clears it
+	MOTD *string `json:"motd,omitempty"`
+	// Features switch protocol features on or off over -features
+	Features map[string]bool `json:"features,omitempty"`
+}
+
+// liveSettings are the compiled settings of the current LiveConfig
+type liveSettings struct {
+	bannedWords *regexp.Regexp
+	origins     []string
+	features    map[string]bool
+}
+
+// configReloader reloads the -config file
+type configReloader struct {
+	path string
+
+	mu sync.Mutex
+	// flagCap is the bandwidth cap the flags set, for settings left out of
+	// the file
+	flagCap BandwidthCap
+}
+
+// LoadLiveConfig reads and checks a live config file
+func LoadLiveConfig(path string, messageLimit int) (LiveConfig, error) {
+	var cfg LiveConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("reading config: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+	return cfg, cfg.Validate(messageLimit)
+}
+
+// Validate checks the config's values, with messages at most messageLimit
+// characters long
+func (cfg *LiveConfig) Validate(messageLimit int) error {
+	if cfg.BandwidthBytesPerSecond != nil && *cfg.BandwidthBytesPerSecond < 0 {
+		return errors.New("bandwidth_bytes_per_second must not be negative")
+	}
+	if cfg.BandwidthBurst != nil && *cfg.BandwidthBurst < 0 {
+		return errors.New("bandwidth_burst must not be negative")
+	}
+	for _, word := range cfg.BannedWords {
+		if strings.TrimSpace(word) == "" {
+			return errors.New("banned_words must not contain empty words")
+		}
+	}
+	for _, pattern := range cfg.AllowedOrigins {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid origin pattern %q", pattern)
+		}
+	}
+	if cfg.MOTD != nil && messageLength(*cfg.MOTD) > messageLimit {
+		return fmt.Errorf("motd is longer than %d characters", messageLimit)
+	}
+	return validateFeatures(cfg.Features)
+}
+
+// WithConfigFile applies the live config at path and reloads it on demand
+func WithConfigFile(path string, cfg LiveConfig) Option {
+	return func(cs *ChatServer) {
+		cs.config = &configReloader{path: path}
+		if limit := cs.bandwidthCap.Load(); limit != nil {
+			cs.config.flagCap = *limit
+		}
+		cs.applyConfig(cfg)
+	}
+}
+
+// applyConfig makes cfg the server's live config
+func (cs *ChatServer) applyConfig(cfg LiveConfig) {
+	cs.config.mu.Lock()
+	defer cs.config.mu.Unlock()
+
+	limit := cs.config.flagCap
+	if cfg.BandwidthBytesPerSecond != nil {
+		// A new rate gets its own default burst unless the file sets one
+		limit.BytesPerSecond, limit.Burst = *cfg.BandwidthBytesPerSecond, 0
+	}
+	if cfg.BandwidthBurst != nil {
+		limit.Burst = *cfg.BandwidthBurst
+	}
+	if limit.Burst <= 0 {
+		limit.Burst = limit.BytesPerSecond * defaultBandwidthBurst
+	}
+	cs.bandwidthCap.Store(&limit)
+
+	settings := &liveSettings{origins: cfg.AllowedOrigins, features: cfg.Features}
+	if len(cfg.BannedWords) > 0 {
+		words := make([]string, len(cfg.BannedWords))
+		for i, word := range cfg.BannedWords {
+			words[i] = regexp.QuoteMeta(strings.TrimSpace(word))
+		}
+		settings.bannedWords = regexp.MustCompile(`(?i)\b(?:` + strings.Join(words, "|") + `)\b`)
+	}
+	cs.live.Store(settings)
+
+	if cfg.MOTD != nil && *cfg.MOTD != cs.notices.MOTD() {
+		if err := cs.notices.SetMOTD(*cfg.MOTD); err != nil {
+			log.Printf("Error saving notices: %v", err)
+		}
+	}
+}
+
+// reloadConfig reads the config file again and applies it, keeping the
+// current settings if it is invalid
+func (cs *ChatServer) reloadConfig(actor string) error {
+	if cs.config == nil {
+		return errors.New("no config file")
+	}
+	cfg, err := LoadLiveConfig(cs.config.path, cs.messageLimit)
+	if err != nil {
+		log.Printf("Config reload failed, keeping the current settings: %v", err)
+		return err
+	}
+	cs.applyConfig(cfg)
+	cs.audit(AuditReload, actor, cs.config.path, "")
+	log.Printf("Reloaded config from %s", cs.config.path)
+	return nil
+}
+
+// reloadOnSIGHUP reloads the config file whenever the process gets SIGHUP,
+// until ctx is done
+func (cs *ChatServer) reloadOnSIGHUP(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			cs.reloadConfig("SIGHUP")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleAdminReload serves POST /admin/reload, reloading the config file
+func (cs *ChatServer) handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cs.config == nil {
+		http.Error(w, "server was started without -config", http.StatusNotFound)
+		return
+	}
+	if err := cs.reloadConfig(adminActor(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// liveConfig returns the compiled live settings
+func (cs *ChatServer) liveConfig() *liveSettings {
+	if s := cs.live.Load(); s != nil {
+		return s
+	}
+	return &liveSettings{}
+}
+
+// bannedWord returns the first banned word in content, if any
+func (cs *ChatServer) bannedWord(content string) string {
+	if re := cs.liveConfig().bannedWords; re != nil {
+		return re.FindString(content)
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestLoadLiveConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"bandwidth_bytes_per_second": 1000, "banned_words": ["spam"], "motd": "hi"}`), 0o644)
+	cfg, err := LoadLiveConfig(path, maxMessageLength)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if *cfg.BandwidthBytesPerSecond != 1000 || cfg.BandwidthBurst != nil || *cfg.MOTD != "hi" {
+		t.Errorf("Expected the config to be read, got %+v", cfg)
+	}
+
+	for _, bad := range []string{
+		`{"rate_limit": 5}`,
+		`{"bandwidth_bytes_per_second": -1}`,
+		`{"banned_words": [" "]}`,
+		`{"allowed_origins": ["[chat"]}`,
+	} {
+		os.WriteFile(path, []byte(bad), 0o644)
+		if _, err := LoadLiveConfig(path, maxMessageLength); err == nil {
+			t.Errorf("Expected %s to be refused", bad)
+		}
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"banned_words": ["spam"]}`), 0o644)
+	cfg, err := LoadLiveConfig(path, maxMessageLength)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	server := NewChatServer(WithAdminToken("secret"), WithBandwidthCap(BandwidthCap{BytesPerSecond: 100000}), WithConfigFile(path, cfg))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	admin := httptest.NewServer(http.HandlerFunc(server.requireAdmin(server.handleAdminReload)))
+	defer admin.Close()
+	reload := func() int {
+		req, _ := http.NewRequest(http.MethodPost, admin.URL, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to reload: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "buy SPAM now"})
+	if msg := readUntilType(t, ctx, alice, "error"); msg.Code != codeRejected {
+		t.Errorf("Expected a banned word to be refused, got %+v", msg)
+	}
+
+	os.WriteFile(path, []byte(`{"banned_words": ["eggs"], "bandwidth_bytes_per_second": 500, "motd": "Welcome back", "allowed_origins": ["chat.example.org"]}`), 0o644)
+	if code := reload(); code != http.StatusNoContent {
+		t.Fatalf("Expected the reload to succeed, got %d", code)
+	}
+	// Alice stays connected through the reload
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "spam is fine now"})
+	if msg := readUntilType(t, ctx, alice, "message"); msg.Content != "spam is fine now" {
+		t.Errorf("Expected the old banned word to be allowed, got %+v", msg)
+	}
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "green eggs"})
+	if msg := readUntilType(t, ctx, alice, "error"); msg.Code != codeRejected {
+		t.Errorf("Expected the new banned word to be refused, got %+v", msg)
+	}
+	if limit := server.bandwidthCap.Load(); limit.BytesPerSecond != 500 || limit.Burst != 2500 {
+		t.Errorf("Expected the new bandwidth cap, got %+v", limit)
+	}
+	if motd := server.notices.MOTD(); motd != "Welcome back" {
+		t.Errorf("Expected the new MOTD, got %q", motd)
+	}
+	for origin, ok := range map[string]bool{"https://chat.example.org": true, "https://evil.example": false} {
+		c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username=u"+strings.TrimPrefix(origin, "https://")[:4],
+			&websocket.DialOptions{HTTPHeader: http.Header{"Origin": {origin}}})
+		if (err == nil) != ok {
+			t.Errorf("Expected origin %s allowed %v, got %v", origin, ok, err)
+		}
+		if c != nil {
+			c.CloseNow()
+		}
+	}
+
+	// Settings left out fall back to the flags, and a broken file changes
+	// nothing
+	os.WriteFile(path, []byte(`{}`), 0o644)
+	reload()
+	if limit := server.bandwidthCap.Load(); limit.BytesPerSecond != 100000 {
+		t.Errorf("Expected the flag's bandwidth cap back, got %+v", limit)
+	}
+	os.WriteFile(path, []byte(`{"banned_words": [`), 0o644)
+	if code := reload(); code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected a broken config to be refused, got %d", code)
+	}
+}
@@ -0,0 +1,286 @@
+package conformance
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Subprotocols defined by the protocol
+const (
+	subprotocolV1        = "chat.v1"
+	subprotocolV2        = "chat.v2"
+	subprotocolV2Msgpack = "chat.v2+msgpack"
+
+	closeUnsupportedVersion websocket.StatusCode = 4001
+)
+
+// message is the protocol envelope, covering every field checks look at
+type message struct {
+	Type        string    `json:"type"`
+	Username    string    `json:"username"`
+	Content     string    `json:"content"`
+	Time        string    `json:"time"`
+	ID          string    `json:"id,omitempty"`
+	Timestamp   int64     `json:"ts,omitempty"`
+	Seq         uint64    `json:"seq,omitempty"`
+	Trace       string    `json:"trace,omitempty"`
+	Code        string    `json:"code,omitempty"`
+	Ref         *errorRef `json:"ref,omitempty"`
+	OldUsername string    `json:"old_username,omitempty"`
+	Limit       int       `json:"limit,omitempty"`
+
+	// History and roster responses
+	Messages []message `json:"messages,omitempty"`
+	Members  []string  `json:"members,omitempty"`
+	HasMore  bool      `json:"has_more,omitempty"`
+}
+
+type errorRef struct {
+	Type    string `json:"type,omitempty"`
+	Content string `json:"content,omitempty"`
+	Length  int    `json:"length,omitempty"`
+	Trace   string `json:"trace,omitempty"`
+}
+
+// Checks is the conformance suite, run in order
+var Checks = []Check{
+	{"negotiate/default-v1", checkDefaultV1},
+	{"negotiate/v2", checkV2},
+	{"negotiate/v2-msgpack", checkMsgpack},
+	{"negotiate/unsupported", checkUnsupported},
+	{"messages/broadcast", checkBroadcast},
+	{"messages/sequence", checkSequence},
+	{"history/request", checkHistory},
+	{"rename", checkRename},
+	{"errors/bad-frame", checkBadFrame},
+	{"errors/validation", checkValidation},
+	{"presence/roster", checkRoster},
+}
+
+// read reads the next JSON frame
+func (t *T) read(c *websocket.Conn) message {
+	var msg message
+	if err := wsjson.Read(t.ctx, c, &msg); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	return msg
+}
+
+// readUntil reads frames until one matches, skipping unrelated traffic
+// such as other users' joins
+func (t *T) readUntil(c *websocket.Conn, match func(message) bool) message {
+	for {
+		if msg := t.read(c); match(msg) {
+			return msg
+		}
+	}
+}
+
+// write sends a JSON frame
+func (t *T) write(c *websocket.Conn, msg any) {
+	if err := wsjson.Write(t.ctx, c, msg); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+}
+
+// join connects as name and waits for its own join notice
+func (t *T) join(name string, subprotocols ...string) (*websocket.Conn, message) {
+	username := t.Username(name)
+	c, _, err := t.Dial(username, subprotocols...)
+	if err != nil {
+		t.Fatalf("connecting as %s: %v", username, err)
+	}
+	msg := t.readUntil(c, func(m message) bool {
+		return m.Type == "system" && strings.HasPrefix(m.Content, username+" ")
+	})
+	return c, msg
+}
+
+func checkDefaultV1(t *T) {
+	c, msg := t.join("v1")
+	defer c.CloseNow()
+	if c.Subprotocol() != "" {
+		t.Fatalf("expected no subprotocol, server chose %q", c.Subprotocol())
+	}
+	if msg.Seq != 0 || msg.ID != "" || msg.Timestamp != 0 {
+		t.Fatalf("v1 join notice carries v2 fields: %+v", msg)
+	}
+	if msg.Username != "Server" || msg.Time == "" {
+		t.Fatalf("malformed join notice: %+v", msg)
+	}
+}
+
+func checkV2(t *T) {
+	c, msg := t.join("v2", subprotocolV2, subprotocolV1)
+	defer c.CloseNow()
+	if c.Subprotocol() != subprotocolV2 {
+		t.Fatalf("expected %s, server chose %q", subprotocolV2, c.Subprotocol())
+	}
+	if msg.Seq == 0 || msg.ID == "" || msg.Timestamp == 0 {
+		t.Fatalf("v2 join notice lacks id, seq or ts: %+v", msg)
+	}
+}
+
+func checkMsgpack(t *T) {
+	username := t.Username("mp")
+	c, _, err := t.Dial(username, subprotocolV2Msgpack)
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	defer c.CloseNow()
+	if c.Subprotocol() != subprotocolV2Msgpack {
+		t.Skipf("server doesn't offer %s", subprotocolV2Msgpack)
+	}
+
+	for {
+		typ, data, err := c.Read(t.ctx)
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if typ != websocket.MessageBinary {
+			t.Fatalf("expected binary frames, got %v", typ)
+		}
+		dec := msgpack.NewDecoder(bytes.NewReader(data))
+		dec.SetCustomStructTag("json")
+		var msg message
+		if err := dec.Decode(&msg); err != nil {
+			t.Fatalf("undecodable MessagePack frame: %v", err)
+		}
+		if msg.Type == "system" && strings.HasPrefix(msg.Content, username+" ") {
+			return
+		}
+	}
+}
+
+func checkUnsupported(t *T) {
+	c, _, err := t.Dial(t.Username("old"), "chat.v99")
+	if err != nil {
+		t.Fatalf("expected the upgrade to succeed before rejection: %v", err)
+	}
+	defer c.CloseNow()
+
+	msg := t.read(c)
+	if msg.Type != "error" || msg.Code != "unsupported_version" {
+		t.Fatalf("expected unsupported_version error, got %+v", msg)
+	}
+	_, _, err = c.Read(t.ctx)
+	if status := websocket.CloseStatus(err); status != closeUnsupportedVersion {
+		t.Fatalf("expected close status %d, got %v", closeUnsupportedVersion, err)
+	}
+}
+
+func checkBroadcast(t *T) {
+	a, _ := t.join("bc-a", subprotocolV2)
+	defer a.CloseNow()
+	b, _ := t.join("bc-b", subprotocolV2)
+	defer b.CloseNow()
+
+	t.write(a, message{Type: "message", Content: "conformance broadcast"})
+	isOurs := func(m message) bool { return m.Type == "message" && m.Content == "conformance broadcast" }
+	got := t.readUntil(b, isOurs)
+	if got.Username != t.Username("bc-a") {
+		t.Fatalf("expected sender %s, got %q", t.Username("bc-a"), got.Username)
+	}
+	if got.ID == "" || got.Trace == "" {
+		t.Fatalf("broadcast lacks id or trace: %+v", got)
+	}
+	if echo := t.readUntil(a, isOurs); echo.ID != got.ID {
+		t.Fatalf("sender's echo has id %q, recipient saw %q", echo.ID, got.ID)
+	}
+}
+
+func checkSequence(t *T) {
+	c, join := t.join("seq", subprotocolV2)
+	defer c.CloseNow()
+
+	last := join.Seq
+	for i := 0; i < 5; i++ {
+		t.write(c, message{Type: "message", Content: "sequence check"})
+		msg := t.readUntil(c, func(m message) bool { return m.Seq != 0 })
+		if msg.Seq <= last {
+			t.Fatalf("sequence went from %d to %d", last, msg.Seq)
+		}
+		last = msg.Seq
+	}
+}
+
+func checkHistory(t *T) {
+	c, _ := t.join("hist", subprotocolV2)
+	defer c.CloseNow()
+
+	t.write(c, message{Type: "message", Content: "remember me"})
+	sent := t.readUntil(c, func(m message) bool { return m.Content == "remember me" })
+
+	t.write(c, message{Type: "history", Limit: 50})
+	page := t.readUntil(c, func(m message) bool { return m.Type == "history" })
+	for _, m := range page.Messages {
+		if m.ID == sent.ID {
+			return
+		}
+	}
+	t.Fatalf("history page doesn't contain message %s", sent.ID)
+}
+
+func checkRename(t *T) {
+	c, _ := t.join("ren", subprotocolV2)
+	defer c.CloseNow()
+
+	newName := t.Username("ren2")
+	t.write(c, message{Type: "message", Content: "/nick " + newName})
+	msg := t.readUntil(c, func(m message) bool { return m.Type == "rename" || m.Type == "error" })
+	if msg.Type == "error" {
+		t.Fatalf("rename refused: %s (%s)", msg.Content, msg.Code)
+	}
+	if msg.Username != newName || msg.OldUsername != t.Username("ren") {
+		t.Fatalf("unexpected rename event: %+v", msg)
+	}
+}
+
+func checkBadFrame(t *T) {
+	c, _ := t.join("bad", subprotocolV2)
+	defer c.CloseNow()
+
+	if err := c.Write(t.ctx, websocket.MessageText, []byte("{not json")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	msg := t.readUntil(c, func(m message) bool { return m.Type == "error" })
+	if msg.Code != "bad_frame" || msg.Ref == nil || msg.Ref.Trace == "" {
+		t.Fatalf("expected bad_frame error with a trace reference, got %+v", msg)
+	}
+
+	// The connection stays usable
+	t.write(c, message{Type: "message", Content: "after bad frame"})
+	t.readUntil(c, func(m message) bool { return m.Content == "after bad frame" })
+}
+
+func checkValidation(t *T) {
+	c, _ := t.join("val", subprotocolV2)
+	defer c.CloseNow()
+
+	t.write(c, message{Type: "message", Content: ""})
+	msg := t.readUntil(c, func(m message) bool { return m.Type == "error" })
+	if msg.Code != "empty_content" || msg.Ref == nil || msg.Ref.Type != "message" {
+		t.Fatalf("expected empty_content error referencing the message, got %+v", msg)
+	}
+}
+
+func checkRoster(t *T) {
+	c, _ := t.join("roster", subprotocolV2)
+	defer c.CloseNow()
+
+	t.write(c, message{Type: "roster", Limit: 500})
+	page := t.readUntil(c, func(m message) bool { return m.Type == "roster" })
+	for _, name := range page.Members {
+		if name == t.Username("roster") {
+			return
+		}
+	}
+	if page.HasMore {
+		t.Skipf("roster is longer than one page")
+	}
+	t.Fatalf("roster doesn't list %s: %v", t.Username("roster"), page.Members)
+}
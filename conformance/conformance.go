@@ -0,0 +1,176 @@
+// Package conformance checks a chat server against the WebSocket protocol.
+//
+// Run connects to a live server, exercises each part of the protocol and
+// returns a report, so client authors can confirm what a server build
+// supports and protocol changes can be verified in CI.
+package conformance
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// Check outcomes
+const (
+	Pass = "pass"
+	Fail = "fail"
+	Skip = "skip"
+)
+
+// Result is the outcome of one check
+type Result struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Detail   string        `json:"detail,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// Report summarizes a conformance run
+type Report struct {
+	Server  string   `json:"server"`
+	Results []Result `json:"results"`
+	Passed  int      `json:"passed"`
+	Failed  int      `json:"failed"`
+	Skipped int      `json:"skipped"`
+}
+
+// OK reports whether no check failed
+func (r Report) OK() bool {
+	return r.Failed == 0
+}
+
+// String formats the report for a terminal
+func (r Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Conformance report for %s\n\n", r.Server)
+	for _, res := range r.Results {
+		fmt.Fprintf(&b, "  %-4s  %-28s %s\n", strings.ToUpper(res.Status), res.Name, res.Detail)
+	}
+	fmt.Fprintf(&b, "\n%d passed, %d failed, %d skipped\n", r.Passed, r.Failed, r.Skipped)
+	return b.String()
+}
+
+// Options configures a conformance run
+type Options struct {
+	// Timeout bounds each check. Zero uses 10 seconds.
+	Timeout time.Duration
+	// Only runs the checks whose names start with this prefix
+	Only string
+}
+
+// Check is a single conformance check
+type Check struct {
+	Name string
+	Run  func(t *T)
+}
+
+// T is handed to a running check
+type T struct {
+	ctx    context.Context
+	server *url.URL
+	prefix string
+	status string
+	detail string
+}
+
+// Context returns the check's context, cancelled at its timeout
+func (t *T) Context() context.Context {
+	return t.ctx
+}
+
+// Username returns a name unique to this run
+func (t *T) Username(name string) string {
+	return t.prefix + name
+}
+
+// Dial connects as username, offering the given subprotocols
+func (t *T) Dial(username string, subprotocols ...string) (*websocket.Conn, *http.Response, error) {
+	u := *t.server
+	q := u.Query()
+	q.Set("username", username)
+	u.RawQuery = q.Encode()
+	return websocket.Dial(t.ctx, u.String(), &websocket.DialOptions{Subprotocols: subprotocols})
+}
+
+// Fatalf fails the check and stops it
+func (t *T) Fatalf(format string, args ...any) {
+	t.status = Fail
+	t.detail = fmt.Sprintf(format, args...)
+	runtime.Goexit()
+}
+
+// Skipf skips the check and stops it
+func (t *T) Skipf(format string, args ...any) {
+	t.status = Skip
+	t.detail = fmt.Sprintf(format, args...)
+	runtime.Goexit()
+}
+
+// Run runs the conformance checks against the WebSocket endpoint at server,
+// given as a ws:// or wss:// URL
+func Run(ctx context.Context, server string, opts Options) (Report, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return Report{}, fmt.Errorf("invalid server URL: %w", err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return Report{}, fmt.Errorf("server URL must be ws:// or wss://, got %q", server)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Second * 10
+	}
+
+	var id [3]byte
+	rand.Read(id[:])
+	prefix := "cf" + hex.EncodeToString(id[:]) + "-"
+
+	report := Report{Server: u.Redacted()}
+	for _, check := range Checks {
+		if !strings.HasPrefix(check.Name, opts.Only) {
+			continue
+		}
+		res := runCheck(ctx, check, &T{server: u, prefix: prefix}, opts.Timeout)
+		switch res.Status {
+		case Pass:
+			report.Passed++
+		case Fail:
+			report.Failed++
+		case Skip:
+			report.Skipped++
+		}
+		report.Results = append(report.Results, res)
+	}
+	return report, nil
+}
+
+// runCheck runs one check on its own goroutine so Fatalf can stop it
+func runCheck(ctx context.Context, check Check, t *T, timeout time.Duration) Result {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	t.ctx = ctx
+	t.status = Pass
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				t.status = Fail
+				t.detail = fmt.Sprintf("panic: %v", r)
+			}
+		}()
+		check.Run(t)
+	}()
+	<-done
+	return Result{Name: check.Name, Status: t.status, Detail: t.detail, Duration: time.Since(start)}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bvedant/ideal-guacamole/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	report, err := conformance.Run(context.Background(), "ws"+strings.TrimPrefix(s.URL, "http"), conformance.Options{})
+	if err != nil {
+		t.Fatalf("Failed to run conformance checks: %v", err)
+	}
+	for _, res := range report.Results {
+		if res.Status != conformance.Pass {
+			t.Errorf("Check %s: %s %s", res.Name, res.Status, res.Detail)
+		}
+	}
+	if len(report.Results) != len(conformance.Checks) {
+		t.Errorf("Expected %d results, got %d", len(conformance.Checks), len(report.Results))
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCron_Next(t *testing.T) {
+	// 2024-01-01 was a Monday
+	from := time.Date(2024, 1, 1, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"* * * * *", "2024-01-01T10:08:00Z"},
+		{"*/15 * * * *", "2024-01-01T10:15:00Z"},
+		{"0 9 * * *", "2024-01-02T09:00:00Z"},
+		{"30 9-17 * * 1-5", "2024-01-01T10:30:00Z"},
+		{"0 0 * * 6,7", "2024-01-06T00:00:00Z"},
+		{"0 12 15 * 5", "2024-01-05T12:00:00Z"},
+		{"0 0 29 2 *", "2024-02-29T00:00:00Z"},
+		{"@monthly", "2024-02-01T00:00:00Z"},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.spec)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", tt.spec, err)
+			continue
+		}
+		if got := c.next(from).Format(time.RFC3339); got != tt.want {
+			t.Errorf("Expected %q to next run at %s, got %s", tt.spec, tt.want, got)
+		}
+	}
+
+	if c, _ := parseCron("0 0 31 2 *"); !c.next(from).IsZero() {
+		t.Errorf("Expected an impossible date never to run")
+	}
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// presenceDebounce holds back leave announcements for a grace period so a
+// user who reconnects in time produces neither a leave nor a join notice
+type presenceDebounce struct {
+	grace time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+}
+
+// WithPresenceGrace delays leave announcements by grace, dropping them and
+// the matching join announcement when the user rejoins the same room within
+// it. Zero announces every join and leave at once.
+func WithPresenceGrace(grace time.Duration) Option {
+	return func(cs *ChatServer) {
+		cs.presenceGrace.grace = grace
+	}
+}
+
+// presenceKey identifies a user in a room
+func presenceKey(room, username string) string {
+	return room + "\x00" + username
+}
+
+// hold schedules announce to run once the grace period passes without the
+// user rejoining, reporting false if there is no grace period
+func (d *presenceDebounce) hold(room, username string, announce func()) bool {
+	if d.grace <= 0 {
+		return false
+	}
+	key := presenceKey(room, username)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending == nil {
+		d.pending = make(map[string]*time.Timer)
+	}
+	if t, ok := d.pending[key]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d.grace, func() {
+		d.mu.Lock()
+		current := d.pending[key] == t
+		if current {
+			delete(d.pending, key)
+		}
+		d.mu.Unlock()
+		if current {
+			announce()
+		}
+	})
+	d.pending[key] = t
+	return true
+}
+
+// rejoin cancels the held leave announcement for a user coming back to a
+// room, reporting whether there was one, in which case the join goes
+// unannounced too
+func (d *presenceDebounce) rejoin(room, username string) bool {
+	key := presenceKey(room, username)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, ok := d.pending[key]
+	if !ok {
+		return false
+	}
+	delete(d.pending, key)
+	// A timer that already fired has found itself gone from pending and
+	// announces nothing
+	t.Stop()
+	return true
+}
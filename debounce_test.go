@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestPresenceGrace(t *testing.T) {
+	server := NewChatServer(WithPresenceGrace(time.Millisecond * 300))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+	bob := dialStatusTest(t, ctx, s, "bob")
+	if msg := readUntilType(t, ctx, alice, "system"); msg.Content != "bob has joined the chat" {
+		t.Fatalf("Expected bob's join notice, got %+v", msg)
+	}
+
+	waitGone := func() {
+		t.Helper()
+		for {
+			if _, ok := server.Client("bob"); !ok {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("Timed out waiting for bob to leave")
+			case <-time.After(time.Millisecond * 10):
+			}
+		}
+	}
+
+	// A quick reconnect is announced to nobody
+	bob.Close(websocket.StatusNormalClosure, "")
+	waitGone()
+	bob, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username=bob",
+		&websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to reconnect bob: %v", err)
+	}
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	time.Sleep(time.Millisecond * 400)
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "still here?"})
+	for {
+		var msg Message
+		if err := wsjson.Read(ctx, alice, &msg); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if msg.Type == "system" && strings.Contains(msg.Content, "bob") {
+			t.Fatalf("Expected no presence notice for a quick reconnect, got %q", msg.Content)
+		}
+		if msg.Content == "still here?" {
+			break
+		}
+	}
+
+	// Staying away past the grace period is
+	bob.Close(websocket.StatusNormalClosure, "")
+	waitGone()
+	started := time.Now()
+	if msg := readUntilType(t, ctx, alice, "system"); msg.Content != "bob has left the chat" {
+		t.Fatalf("Expected bob's leave notice, got %+v", msg)
+	}
+	if waited := time.Since(started); waited < time.Millisecond*200 {
+		t.Errorf("Expected the leave notice to wait for the grace period, got it after %s", waited)
+	}
+}
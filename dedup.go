@@ -0,0 +1,58 @@
+package main
+
+import "sync"
+
+// seenSetSize bounds how many recent message IDs are remembered. It only
+// needs to cover the window in which a broker might redeliver a message.
+const seenSetSize = 8192
+
+// seenSet remembers the most recent message IDs, forgetting the oldest first
+type seenSet struct {
+	mu    sync.Mutex
+	ids   map[string]struct{}
+	order []string
+	next  int
+}
+
+func newSeenSet(size int) *seenSet {
+	return &seenSet{
+		ids:   make(map[string]struct{}, size),
+		order: make([]string, size),
+	}
+}
+
+// Add records id and reports whether it was new
+func (s *seenSet) Add(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	if old := s.order[s.next]; old != "" {
+		delete(s.ids, old)
+	}
+	s.order[s.next] = id
+	s.next = (s.next + 1) % len(s.order)
+	s.ids[id] = struct{}{}
+	return true
+}
+
+// receiveRemote delivers a message that arrived over the broker, unless it
+// is our own message echoed back or a redelivery of one already seen.
+// Heartbeats from other instances update the peer table instead.
+func (cs *ChatServer) receiveRemote(msg Message) {
+	if msg.Origin == cs.instanceID {
+		return
+	}
+	if msg.Type == "heartbeat" {
+		if msg.Instance != nil {
+			cs.recordPeer(*msg.Instance)
+		}
+		return
+	}
+	if msg.ID != "" && !cs.seen.Add(msg.ID) {
+		return
+	}
+	cs.sequence(msg, true)
+}
@@ -0,0 +1,57 @@
+package main
+
+import "unicode/utf8"
+
+// maxCiphertextLength bounds the opaque payload of messages in encrypted
+// rooms, in bytes
+const maxCiphertextLength = 16 << 10
+
+// validateIn checks a message for the room it is sent to. Encrypted rooms
+// relay "message" and "key" payloads as opaque ciphertext, so its size is
+// all that is checked; plaintext content is refused so a misbehaving client
+// can't leak it. Other rooms take plaintext only. A "system" notice is
+// plaintext even in encrypted rooms, which is why clients may not send one:
+// only the admin API and admin gRPC token do.
+func (m *Message) validateIn(room *Room, limit int) error {
+	if room == nil || !room.Encrypted {
+		if m.Ciphertext != "" || m.To != "" || m.Type == "key" {
+			return protocolErrorf(codeNotEncrypted, "ciphertext and key envelopes are only accepted in encrypted rooms")
+		}
+		return m.validate(limit)
+	}
+
+	switch m.Type {
+	case "system":
+		return m.validate(limit)
+	case "message", "key":
+	default:
+		return protocolErrorf(codeInvalidType, "invalid message type: %s", m.Type)
+	}
+	if m.Content != "" {
+		return protocolErrorf(codePlaintextRejected, "encrypted rooms only accept ciphertext")
+	}
+	if m.Ciphertext == "" {
+		return protocolErrorf(codeEmptyContent, "ciphertext cannot be empty")
+	}
+	if len(m.Ciphertext) > maxCiphertextLength {
+		return protocolErrorf(codeContentTooLong, "ciphertext too long (max %d bytes)", maxCiphertextLength)
+	}
+	if !utf8.ValidString(m.Ciphertext) {
+		return protocolErrorf(codeBadFrame, "ciphertext must be text, e.g. base64")
+	}
+	if m.To != "" {
+		if m.Type != "key" {
+			return protocolErrorf(codeInvalidType, "only key envelopes may be addressed to one member")
+		}
+		if !couldBeUsername(m.To) {
+			return protocolErrorf(codeInvalidUsername, "invalid recipient %q", m.To)
+		}
+	}
+	return nil
+}
+
+// reaches reports whether a room message is delivered to username: directed
+// key envelopes only reach their sender and recipient
+func (m *Message) reaches(username string) bool {
+	return m.To == "" || username == m.To || username == m.Username
+}
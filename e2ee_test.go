@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestEncryptedRooms(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	s := newRoomsTestServer(t, server)
+	if status := createTestRoom(t, s, RoomOptions{Name: "vault", Encrypted: true}); status != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", status)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// v1 frames can't carry ciphertext
+	v1, _, err := websocket.Dial(ctx, wsURL+"?username=old&room=vault", nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	if _, _, err := v1.Read(ctx); websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+		t.Errorf("Expected a v1 client to be refused, got %v", err)
+	}
+
+	v2 := &websocket.DialOptions{Subprotocols: []string{subprotocolV2}}
+	dial := func(username string) *websocket.Conn {
+		t.Helper()
+		c, _, err := websocket.Dial(ctx, wsURL+"?username="+username+"&room=vault", v2)
+		if err != nil {
+			t.Fatalf("Failed to join %s: %v", username, err)
+		}
+		t.Cleanup(func() { c.Close(websocket.StatusNormalClosure, "") })
+		return c
+	}
+	alice, bob, carol := dial("alice"), dial("bob"), dial("carol")
+
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "plaintext"})
+	if msg := readUntilType(t, ctx, alice, "error"); msg.Code != codePlaintextRejected {
+		t.Errorf("Expected plaintext to be rejected, got %+v", msg)
+	}
+	wsjson.Write(ctx, alice, Message{Type: "message", Ciphertext: strings.Repeat("A", maxCiphertextLength+1)})
+	if msg := readUntilType(t, ctx, alice, "error"); msg.Code != codeContentTooLong {
+		t.Errorf("Expected oversized ciphertext to be rejected, got %+v", msg)
+	}
+
+	// A directed key envelope reaches only its recipient and sender
+	wsjson.Write(ctx, alice, Message{Type: "key", To: "bob", Ciphertext: "d2VsY29tZQ=="})
+	if msg := readUntilType(t, ctx, bob, "key"); msg.Ciphertext != "d2VsY29tZQ==" || msg.Username != "alice" || msg.To != "bob" {
+		t.Errorf("Expected the key envelope, got %+v", msg)
+	}
+	readUntilType(t, ctx, alice, "key")
+
+	wsjson.Write(ctx, alice, Message{Type: "message", Ciphertext: "c2VjcmV0"})
+	if msg := readUntilType(t, ctx, bob, "message"); msg.Ciphertext != "c2VjcmV0" || msg.Content != "" || msg.Seq == 0 {
+		t.Errorf("Expected the ciphertext message, got %+v", msg)
+	}
+	for {
+		var msg Message
+		if err := wsjson.Read(ctx, carol, &msg); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if msg.Type == "key" {
+			t.Errorf("Expected carol not to get bob's key envelope")
+		}
+		if msg.Type == "message" {
+			break
+		}
+	}
+
+	// Key envelopes for one member aren't kept in history
+	page := server.lookupRoom("vault").history.Before(0, 10)
+	for _, msg := range page.Messages {
+		if msg.Type == "key" {
+			t.Errorf("Expected no key envelopes in history, got %+v", msg)
+		}
+	}
+
+	lobby, _, err := websocket.Dial(ctx, wsURL+"?username=dave", v2)
+	if err != nil {
+		t.Fatalf("Failed to join the lobby: %v", err)
+	}
+	defer lobby.Close(websocket.StatusNormalClosure, "")
+	wsjson.Write(ctx, lobby, Message{Type: "message", Ciphertext: "c2VjcmV0"})
+	if msg := readUntilType(t, ctx, lobby, "error"); msg.Code != codeNotEncrypted {
+		t.Errorf("Expected ciphertext outside encrypted rooms to be rejected, got %+v", msg)
+	}
+}
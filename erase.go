@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bvedant/ideal-guacamole/chain"
+)
+
+// erasedUsername replaces an erased user's name wherever it was stored
+const erasedUsername = chain.ErasedUsername
+
+// redactName replaces name where it appears as a whole word in s
+func redactName(s, name string) string {
+	words := strings.Split(s, " ")
+	for i, w := range words {
+		if w == name {
+			words[i] = erasedUsername
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// Erase anonymizes every stored message from or about username: its own
+// messages lose their content, and notices naming it are redacted. Messages
+// stay in place so sequence numbers remain contiguous.
+func (h *History) Erase(username string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	erased := 0
+	for i := 0; i < h.n; i++ {
+		seq := h.lastSeq - uint64(i)
+		msg := h.slot(seq)
+		if msg.Poll != nil {
+			msg.Poll = msg.Poll.withoutVoter(username)
+		}
+
+		switch {
+		case msg.Type == "rename" && (msg.Username == username || msg.OldUsername == username):
+			msg.Content = redactName(msg.Content, username)
+			if msg.Username == username {
+				msg.Username = erasedUsername
+			}
+			if msg.OldUsername == username {
+				msg.OldUsername = erasedUsername
+			}
+		case msg.Pinned != nil && msg.Pinned.Username == username:
+			msg.Pinned = &Message{ID: msg.Pinned.ID}
+			msg.Content = redactName(msg.Content, username)
+		case msg.Username == username:
+			msg.Username = erasedUsername
+			msg.Content = ""
+			msg.Ciphertext = ""
+			msg.Rendered = ""
+			msg.Preview = nil
+		case msg.Type == "system" && strings.HasPrefix(msg.Content, username+" "):
+			msg.Content = redactName(msg.Content, username)
+		default:
+			continue
+		}
+		h.redactLocked(msg)
+		erased++
+	}
+	return erased
+}
+
+// erase drops username from the rename history
+func (l *renameLog) erase(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.records {
+		r := &l.records[i]
+		if r.OldUsername == username {
+			r.OldUsername = erasedUsername
+		}
+		if r.NewUsername == username {
+			r.NewUsername = erasedUsername
+		}
+	}
+}
+
+// Redact replaces name in every entry's actor, target and reason, rewriting
+// the audit file if there is one. Entries that don't name the user are
+// left exactly as they were.
+func (l *AuditLog) Redact(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	redact := func(e *AuditEntry) bool {
+		before := *e
+		e.Actor = redactField(e.Actor, name)
+		e.Target = redactField(e.Target, name)
+		e.Reason = redactField(e.Reason, name)
+		return *e != before
+	}
+	for i := range l.entries {
+		redact(&l.entries[i])
+	}
+	if l.file == nil {
+		return nil
+	}
+
+	// Rewrite the whole file, which holds more than we keep in memory
+	path := l.file.Name()
+	in, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("redacting audit log: %w", err)
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".audit-*")
+	if err != nil {
+		return fmt.Errorf("redacting audit log: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			tmp.Close()
+			return fmt.Errorf("redacting audit log: %w", err)
+		}
+		data := scanner.Bytes()
+		if redact(&e) {
+			data, _ = json.Marshal(e)
+		}
+		w.Write(data)
+		w.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("redacting audit log: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("redacting audit log: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("redacting audit log: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("redacting audit log: %w", err)
+	}
+
+	l.file.Close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		l.file = nil
+		return fmt.Errorf("reopening audit log: %w", err)
+	}
+	l.file = f
+	return nil
+}
+
+// redactField replaces name in an audit field that is the name itself, or
+// a request such as "POST /admin/erase?username=<name>" whose query names
+// it. Other fields are left alone, so names that are part of an address
+// or another name survive.
+func redactField(s, name string) string {
+	if s == name {
+		return erasedUsername
+	}
+	method, uri, ok := strings.Cut(s, " ")
+	if !ok || !strings.HasPrefix(uri, "/") || !strings.Contains(uri, "?") {
+		return s
+	}
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return s
+	}
+	q := u.Query()
+	redacted := false
+	for _, values := range q {
+		for i, v := range values {
+			if v == name {
+				values[i] = erasedUsername
+				redacted = true
+			}
+		}
+	}
+	if !redacted {
+		return s
+	}
+	u.RawQuery = q.Encode()
+	return method + " " + u.RequestURI()
+}
+
+// handleAdminErase serves POST /admin/erase?username=<name>. It anonymizes
+// the user's stored messages, rename history and audit entries, and tells
+// every instance and connected client to drop the content.
+func (cs *ChatServer) handleAdminErase(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username := r.URL.Query().Get("username")
+	if username == "" || username == erasedUsername {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+
+	n := 0
+	for _, h := range cs.histories() {
+		n += h.Erase(username)
+	}
+	cs.renames.erase(username)
+	if err := cs.auditLog.Redact(username); err != nil {
+		log.Printf("Error redacting audit log: %v", err)
+		http.Error(w, "failed to redact audit log", http.StatusInternalServerError)
+		return
+	}
+	// Record the erasure without naming who was erased
+	cs.audit(AuditErase, adminActor(r), erasedUsername, fmt.Sprintf("%d stored messages", n))
+	cs.export(ExportErase, username, "", cs.now())
+
+	// Other instances erase their history when the tombstone reaches them
+	now := cs.now()
+	ok := cs.publish(Message{
+		Type:        "tombstone",
+		Username:    "Server",
+		OldUsername: username,
+		Content:     "Messages from a deleted user were removed",
+		Time:        now.Format(time.RFC3339),
+		Timestamp:   now.UnixMilli(),
+	})
+	if !ok {
+		http.Error(w, "server busy, erasure not propagated; try again", http.StatusServiceUnavailable)
+		return
+	}
+
+	log.Printf("Erased user data: %d stored messages", n)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"messages": n})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestHistory_Erase(t *testing.T) {
+	h := NewHistory(10)
+	h.Append(Message{Type: "system", Username: "Server", Content: "alice has joined the chat"})
+	h.Append(Message{Type: "system", Username: "Server", Content: "alicia has joined the chat"})
+	h.Append(Message{Type: "message", Username: "alice", Content: "my address is ..."})
+	h.Append(Message{Type: "rename", Username: "al", OldUsername: "alice", Content: "alice is now known as al"})
+	h.Append(Message{Type: "message", Username: "bob", Content: "hi alice"})
+
+	if n := h.Erase("alice"); n != 3 {
+		t.Errorf("Expected 3 messages erased, got %d", n)
+	}
+	want := []Message{
+		{Type: "system", Username: "Server", Content: "[deleted] has joined the chat"},
+		{Type: "system", Username: "Server", Content: "alicia has joined the chat"},
+		{Type: "message", Username: "[deleted]", Content: ""},
+		{Type: "rename", Username: "al", OldUsername: "[deleted]", Content: "[deleted] is now known as al"},
+		{Type: "message", Username: "bob", Content: "hi alice"},
+	}
+	for i, msg := range h.Before(0, 10).Messages {
+		msg.Seq = 0
+		if !reflect.DeepEqual(msg, want[i]) {
+			t.Errorf("Message %d: expected %+v, got %+v", i, want[i], msg)
+		}
+	}
+}
+
+func TestAuditLog_RedactWholeNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := NewAuditLog(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer l.Close()
+	l.Record(AuditBan, "admin@10.0.0.1", "10.0.0.0/8", "abuse from a")
+	l.Record(AuditShadowBan, "admin@10.0.0.1", "a", "spam")
+	l.Record(AuditAdminAPI, "admin@10.0.0.1", "POST /admin/erase?username=a", "")
+	l.Record(AuditAdminAPI, "admin@10.0.0.1", "GET /admin/history?room=a1", "")
+	before, _ := os.ReadFile(path)
+
+	if err := l.Redact("a"); err != nil {
+		t.Fatalf("Failed to redact: %v", err)
+	}
+	after, _ := os.ReadFile(path)
+	was, is := strings.Split(string(before), "\n"), strings.Split(string(after), "\n")
+	for _, i := range []int{0, 3} {
+		if was[i] != is[i] {
+			t.Errorf("Expected an entry not naming a to be untouched, got %s for %s", is[i], was[i])
+		}
+	}
+	if !strings.Contains(is[1], `"target":"`+erasedUsername+`"`) {
+		t.Errorf("Expected the target a to be redacted, got %s", is[1])
+	}
+	if !strings.Contains(is[2], `username=`+url.QueryEscape(erasedUsername)) {
+		t.Errorf("Expected the query naming a to be redacted, got %s", is[2])
+	}
+	if page := l.Before(0, 10); page.Entries[0].Actor != "admin@10.0.0.1" || page.Entries[0].Target != "10.0.0.0/8" {
+		t.Errorf("Expected unrelated entries kept in memory, got %+v", page.Entries[0])
+	}
+}
+
+func TestAdmin_Erase(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := NewAuditLog(auditPath)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer auditLog.Close()
+
+	server := NewChatServer(WithAdminToken("secret"), WithAuditLog(auditLog))
+	server.Run(t.Context())
+	s := newAdminTestServer(t, server)
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	alice, _, err := websocket.Dial(ctx, wsURL+"?username=alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect alice: %v", err)
+	}
+	var msg Message
+	wsjson.Read(ctx, alice, &msg)
+	if err := wsjson.Write(ctx, alice, Message{Type: "message", Content: "personal details"}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	wsjson.Read(ctx, alice, &msg)
+	alice.Close(websocket.StatusNormalClosure, "")
+
+	bob, _, err := websocket.Dial(ctx, wsURL+"?username=bob", &websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to connect bob: %v", err)
+	}
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	for msg.Type != "system" || !strings.Contains(msg.Content, "bob has joined") {
+		if err := wsjson.Read(ctx, bob, &msg); err != nil {
+			t.Fatalf("Failed to read join: %v", err)
+		}
+	}
+
+	resp := adminRequest(t, ctx, http.MethodPost, s.URL+"/admin/erase?username=alice", "secret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+
+	// Connected clients are told to drop the content. Alice's leave may
+	// still be in flight.
+	for msg.Type != "tombstone" {
+		if err := wsjson.Read(ctx, bob, &msg); err != nil {
+			t.Fatalf("Failed to read tombstone: %v", err)
+		}
+	}
+	if msg.OldUsername != "alice" {
+		t.Errorf("Expected tombstone for alice, got: %+v", msg)
+	}
+
+	// Nothing stored mentions alice any more
+	stored, _ := json.Marshal(server.history.Before(0, maxHistoryLimit))
+	if strings.Contains(string(stored), "alice") || strings.Contains(string(stored), "personal details") {
+		t.Errorf("History still holds alice's data: %s", stored)
+	}
+	auditFile, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatalf("Failed to read audit file: %v", err)
+	}
+	if strings.Contains(string(auditFile), "alice") {
+		t.Errorf("Audit file still names alice: %s", auditFile)
+	}
+	if !strings.Contains(string(auditFile), `"action":"erase"`) {
+		t.Errorf("Expected the erasure itself to be audited: %s", auditFile)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Error codes sent to clients on "error" messages
+const (
+	codeBadFrame          = "bad_frame"
+	codeEmptyContent      = "empty_content"
+	codeContentTooLong    = "content_too_long"
+	codeInvalidType       = "invalid_type"
+	codeNotEncrypted      = "not_encrypted"
+	codePlaintextRejected = "plaintext_rejected"
+	codeInvalidUsername   = "invalid_username"
+	codeUsernameTaken     = "username_taken"
+	codeRenameRejected    = "rename_rejected"
+	codeRenameCooldown    = "rename_cooldown"
+	codeUsernameReserved  = "username_reserved"
+	codeImpersonation     = "impersonation"
+	codeInvalidProfile    = "invalid_profile"
+	codeInvalidStatus     = "invalid_status"
+	codeUnknownMessage    = "unknown_message"
+	codeInvalidSchedule   = "invalid_schedule"
+	codeInvalidPoll       = "invalid_poll"
+	codePollClosed        = "poll_closed"
+	codeRateLimited       = "rate_limited"
+	codeMuted             = "muted"
+	codeSlowMode          = "slow_mode"
+	codeRejected          = "rejected"
+	codeForbidden         = "forbidden"
+	codeFeatureDisabled   = "feature_disabled"
+	codeServerBusy        = "server_busy"
+	codeInternal          = "internal_error"
+)
+
+// maxRefContent is how much of a rejected message's content is echoed back
+const maxRefContent = 100
+
+// ProtocolError is a problem with client input that is reported back to the
+// client as an "error" message
+type ProtocolError struct {
+	Code   string
+	Reason string
+	// Field is the frame field at fault, if known
+	Field string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Reason
+}
+
+// protocolErrorf builds a ProtocolError with a formatted reason
+func protocolErrorf(code, format string, args ...any) *ProtocolError {
+	return &ProtocolError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// ErrorRef identifies the payload an "error" message refers to
+type ErrorRef struct {
+	Type string `json:"type,omitempty"`
+	// Content is the start of the rejected content, truncated to maxRefContent bytes
+	Content string `json:"content,omitempty"`
+	// Length is the full length of the rejected content, in characters
+	Length int `json:"length,omitempty"`
+	// Field is the field of the rejected frame at fault, such as "type"
+	Field string `json:"field,omitempty"`
+	// Trace is the server trace ID assigned to the rejected frame
+	Trace string `json:"trace,omitempty"`
+}
+
+// refFor builds a reference to a rejected message
+func refFor(msg Message) *ErrorRef {
+	ref := &ErrorRef{Type: msg.Type, Content: msg.Content, Length: messageLength(msg.Content), Trace: msg.Trace}
+	if len(ref.Content) > maxRefContent {
+		ref.Content = strings.ToValidUTF8(ref.Content[:maxRefContent], "")
+	}
+	return ref
+}
+
+// sendError reports err to a single client. Errors that aren't a
+// ProtocolError are reported as internal errors.
+func (cs *ChatServer) sendError(ctx context.Context, client *Client, err error, ref *ErrorRef) {
+	code := codeInternal
+	var perr *ProtocolError
+	if errors.As(err, &perr) {
+		code = perr.Code
+	}
+
+	now := cs.now()
+	msg := Message{
+		Type:      "error",
+		Username:  "Server",
+		Code:      code,
+		Content:   err.Error(),
+		Ref:       ref,
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	if err := client.writeMessage(ctx, msg); err != nil {
+		client.logf("Error sending error to %s: %v", client.username, err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestChatServer_ErrorMessages(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username=alice", &websocket.DialOptions{
+		Subprotocols: []string{subprotocolV2},
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	var msg Message
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read welcome message: %v", err)
+	}
+
+	long := strings.Repeat("x", maxMessageLength+1)
+	tests := []struct {
+		name     string
+		frame    string
+		wantCode string
+		wantRef  *ErrorRef
+	}{
+		{"undecodable", "invalid json", codeBadFrame, &ErrorRef{}},
+		{"empty", `{"type":"message","content":""}`, codeEmptyContent, &ErrorRef{Type: "message"}},
+		{"too long", `{"type":"message","content":"` + long + `"}`, codeContentTooLong,
+			&ErrorRef{Type: "message", Content: long[:maxRefContent], Length: len(long)}},
+		{"bad type", `{"type":"shout","content":"hi"}`, codeInvalidType, &ErrorRef{Type: "shout", Content: "hi", Length: 2, Field: "type"}},
+		{"unknown type", `{"type":"shout"}`, codeInvalidType, &ErrorRef{Type: "shout", Field: "type"}},
+		{"system notice", `{"type":"system","content":"hi"}`, codeInvalidType, &ErrorRef{Type: "system", Content: "hi", Length: 2, Field: "type"}},
+		{"unknown field", `{"type":"message","content":"hi","colour":"red"}`, codeBadFrame, &ErrorRef{Field: "colour"}},
+		{"wrong field type", `{"type":"message","content":5}`, codeBadFrame, &ErrorRef{Field: "content"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := c.Write(ctx, websocket.MessageText, []byte(tt.frame)); err != nil {
+				t.Fatalf("Failed to send frame: %v", err)
+			}
+			var msg Message
+			if err := wsjson.Read(ctx, c, &msg); err != nil {
+				t.Fatalf("Failed to read error message: %v", err)
+			}
+			if msg.Type != "error" || msg.Code != tt.wantCode || msg.Content == "" {
+				t.Errorf("Expected %s error, got: %+v", tt.wantCode, msg)
+			}
+			if msg.Ref == nil || msg.Ref.Trace == "" {
+				t.Fatalf("Expected ref with a trace ID, got %+v", msg.Ref)
+			}
+			got := *msg.Ref
+			got.Trace = ""
+			if got != *tt.wantRef {
+				t.Errorf("Expected ref %+v, got %+v", tt.wantRef, got)
+			}
+		})
+	}
+
+	// The connection survives rejected input
+	if err := wsjson.Write(ctx, c, Message{Type: "message", Content: "still here"}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if msg.Content != "still here" {
+		t.Errorf("Unexpected message: %+v", msg)
+	}
+}
+
+func TestChatServer_ErrorMessagesV1(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username=alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	var msg Message
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read welcome message: %v", err)
+	}
+
+	if err := wsjson.Write(ctx, c, Message{Type: "message"}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read error notice: %v", err)
+	}
+	if msg.Type != "system" || msg.Code != "" || !strings.Contains(msg.Content, "empty") {
+		t.Errorf("Expected v1 system notice, got: %+v", msg)
+	}
+}
+
+func TestChatServer_TraceAndConnectionIDs(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username=alice", &websocket.DialOptions{
+		Subprotocols: []string{subprotocolV2},
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+	if resp.Header.Get(connectionHeader) == "" {
+		t.Error("Expected connection ID in upgrade response")
+	}
+
+	var msg Message
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read welcome message: %v", err)
+	}
+	if msg.Trace == "" {
+		t.Errorf("Expected trace ID on join message, got: %+v", msg)
+	}
+
+	// A client-supplied trace is replaced by the server's
+	if err := wsjson.Write(ctx, c, Message{Type: "message", Content: "hi", Trace: "forged"}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if msg.Trace == "" || msg.Trace == "forged" {
+		t.Errorf("Expected server-assigned trace ID, got %q", msg.Trace)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	// sessionHeader carries an event stream's session token on POST /send
+	sessionHeader = "X-Chat-Session"
+	// eventKeepalive is how often an idle event stream gets a comment, so
+	// proxies don't time it out
+	eventKeepalive = time.Second * 25
+)
+
+// EventSession is the first event on a stream, naming the session that
+// POST /send takes in the X-Chat-Session header
+type EventSession struct {
+	Type         string `json:"type"`
+	Session      string `json:"session"`
+	ConnectionID string `json:"connection_id"`
+	Username     string `json:"username"`
+}
+
+// eventStream is the transport of a client connected through /events
+// rather than a WebSocket
+type eventStream struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	session string
+
+	// handling serializes messages sent with POST /send, which the
+	// WebSocket read loop does by itself
+	handling sync.Mutex
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// send writes one frame as a Server-Sent Event. Callers hold the client's
+// frameWriter lock.
+func (e *eventStream) send(ctx context.Context, data []byte) error {
+	select {
+	case <-e.done:
+		return io.ErrClosedPipe
+	default:
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		e.rc.SetWriteDeadline(deadline)
+	}
+	// JSON frames never contain raw newlines, so each is one data line
+	if _, err := e.w.Write([]byte("data: ")); err != nil {
+		return err
+	}
+	if len(data) > 0 && data[len(data)-1] == '\n' {
+		data = data[:len(data)-1]
+	}
+	if _, err := e.w.Write(data); err != nil {
+		return err
+	}
+	if _, err := e.w.Write([]byte("\n\n")); err != nil {
+		return err
+	}
+	return e.rc.Flush()
+}
+
+// close ends the stream
+func (e *eventStream) close() {
+	e.closeOnce.Do(func() { close(e.done) })
+}
+
+// close disconnects the client, whichever transport it uses
+func (c *Client) close(code websocket.StatusCode, reason string) {
+	switch {
+	case c.conn != nil:
+		c.conn.Close(code, reason)
+	case c.events != nil:
+		c.events.close()
+	}
+}
+
+// protocol names the client's transport and protocol version
+func (c *Client) protocol() string {
+	switch {
+	case c.conn != nil:
+		return c.conn.Subprotocol()
+	case c.events != nil:
+		return "sse"
+	}
+	return ""
+}
+
+// handleEvents serves GET /events, a Server-Sent Events stream for clients
+// behind proxies that break WebSockets. It takes the same parameters as the
+// WebSocket and carries the same frames as protocol v2 with JSON; clients
+// send with POST /send.
+func (cs *ChatServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client := cs.admit(w, r)
+	if client == nil {
+		return
+	}
+	defer cs.leaveRoom(client.room)
+
+	client.version, client.codec = protocolV2, jsonCodec{}
+	client.events = &eventStream{w: w, rc: http.NewResponseController(w), session: newMessageID(), done: make(chan struct{})}
+
+	cs.setRoutingHints(w)
+	w.Header().Set(connectionHeader, client.id)
+	w.Header().Set(featuresHeader, cs.enabledFeatures())
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*5)
+	err := client.write(ctx, EventSession{Type: "session", Session: client.events.session, ConnectionID: client.id, Username: client.username})
+	cancel()
+	if err != nil {
+		cs.releaseUsername(client)
+		client.logf("Event stream error: %v", err)
+		return
+	}
+
+	cs.clientsMtx.Lock()
+	cs.sessions[client.events.session] = client
+	cs.clientsMtx.Unlock()
+	cs.join(r.Context(), client)
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+loop:
+	for {
+		select {
+		case <-keepalive.C:
+			client.out.mu.Lock()
+			client.events.rc.SetWriteDeadline(time.Now().Add(time.Second * 5))
+			_, err := io.WriteString(w, ": keepalive\n\n")
+			if err == nil {
+				err = client.events.rc.Flush()
+			}
+			client.out.mu.Unlock()
+			if err != nil {
+				client.logf("Event stream error: %v", err)
+				break loop
+			}
+		case <-client.events.done:
+			break loop
+		case <-r.Context().Done():
+			client.logf("Client %s closed the event stream", client.username)
+			break loop
+		}
+	}
+
+	// Frames are written under the frameWriter lock, so none can reach the
+	// ResponseWriter once the handler returns
+	client.out.mu.Lock()
+	client.events.close()
+	client.out.mu.Unlock()
+	cs.clientsMtx.Lock()
+	delete(cs.sessions, client.events.session)
+	cs.clientsMtx.Unlock()
+	cs.leave(client)
+}
+
+// handleSend serves POST /send, taking one message for the event stream
+// named by the X-Chat-Session header. Replies and errors arrive on the
+// stream, as they would on a WebSocket.
+func (cs *ChatServer) handleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cs.rejectBanned(w, r) {
+		return
+	}
+	cs.clientsMtx.Lock()
+	client := cs.sessions[r.Header.Get(sessionHeader)]
+	cs.clientsMtx.Unlock()
+	if client == nil {
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, cs.frames.ReadLimit))
+	if err != nil {
+		http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	client.observe("in", data)
+	client.countIn(len(data))
+	if !cs.meterIn(r.Context(), client, int64(len(data))) {
+		http.Error(w, "bandwidth cap exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	var msg Message
+	err = decodeFrame(client.codec, data, &msg, client.lenient)
+	// Whatever the client sent, the trace is ours
+	msg.Trace = newTraceID()
+	client.touch(cs.now())
+	if err != nil {
+		client.logf("Bad frame from %s (trace %s): %v", client.username, msg.Trace, err)
+		client.events.handling.Lock()
+		cs.noteRejection(client)
+		client.events.handling.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client.events.handling.Lock()
+	cs.handleFrame(r.Context(), client, msg)
+	client.events.handling.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket/wsjson"
+)
+
+// eventReader reads frames from a /events stream
+type eventReader struct {
+	t       *testing.T
+	scanner *bufio.Scanner
+}
+
+// next returns the next frame of the given type, skipping others
+func (e *eventReader) next(typ string) map[string]any {
+	e.t.Helper()
+	for e.scanner.Scan() {
+		data, ok := strings.CutPrefix(e.scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var frame map[string]any
+		if err := json.Unmarshal([]byte(data), &frame); err != nil {
+			e.t.Fatalf("Failed to decode event %q: %v", data, err)
+		}
+		if frame["type"] == typ {
+			return frame
+		}
+	}
+	e.t.Fatalf("Stream ended waiting for %s: %v", typ, e.scanner.Err())
+	return nil
+}
+
+// openEvents connects to /events as username
+func openEvents(t *testing.T, ctx context.Context, s *httptest.Server, username string) *eventReader {
+	t.Helper()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/events?username="+username, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected response %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return &eventReader{t: t, scanner: bufio.NewScanner(resp.Body)}
+}
+
+func TestEvents_SendAndReceive(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", server.handleConnection)
+	mux.HandleFunc("/events", server.handleEvents)
+	mux.HandleFunc("/send", server.handleSend)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	events := openEvents(t, ctx, s, "alice")
+	session := events.next("session")
+	if session["username"] != "alice" || session["session"] == "" {
+		t.Fatalf("Unexpected session event %v", session)
+	}
+	events.next("system")
+
+	send := func(token, body string) int {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, s.URL+"/send", strings.NewReader(body))
+		req.Header.Set(sessionHeader, token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := send("guess", `{"content": "hi"}`); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown session, got %d", status)
+	}
+	token := session["session"].(string)
+	if status := send(token, `{"content": `); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for undecodable JSON, got %d", status)
+	}
+
+	// WebSocket clients share the hub
+	ws := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer ws.Close()
+	bob := dialStatusTest(t, ctx, ws, "bob")
+	events.next("system")
+	if status := send(token, `{"content": "hello over SSE"}`); status != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", status)
+	}
+	if got := events.next("message"); got["content"] != "hello over SSE" || got["username"] != "alice" {
+		t.Errorf("Unexpected echo %v", got)
+	}
+	var msg Message
+	for msg.Type != "message" {
+		if err := wsjson.Read(ctx, bob, &msg); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+	}
+	if msg.Content != "hello over SSE" {
+		t.Errorf("Expected bob to receive alice's message, got %+v", msg)
+	}
+
+	// Validation errors come back on the stream
+	send(token, `{"content": ""}`)
+	if got := events.next("error"); got["code"] == "" {
+		t.Errorf("Expected an error code, got %v", got)
+	}
+}
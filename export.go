@@ -0,0 +1,53 @@
+package main
+
+import "time"
+
+// exportSchemaVersion is bumped whenever ExportEvent changes incompatibly
+const exportSchemaVersion = 1
+
+// Export event types
+const (
+	ExportMessage = "message"
+	ExportJoin    = "join"
+	ExportLeave   = "leave"
+	// ExportErase asks downstream systems to delete the user's data
+	ExportErase = "erase"
+)
+
+// ExportEvent is the stable schema for chat activity published to external
+// systems such as analytics pipelines and compliance archives
+type ExportEvent struct {
+	SchemaVersion int    `json:"schema_version"`
+	Type          string `json:"type"`
+	Username      string `json:"username"`
+	Content       string `json:"content,omitempty"`
+	Time          string `json:"time"`
+}
+
+// Exporter receives every message, join, and leave handled by this instance.
+// Export is called from connection handlers and must never block.
+type Exporter interface {
+	Export(ev ExportEvent)
+	Close() error
+}
+
+// WithExporter publishes chat activity to e
+func WithExporter(e Exporter) Option {
+	return func(cs *ChatServer) {
+		cs.exporter = e
+	}
+}
+
+// export hands an event to the configured exporter, if any
+func (cs *ChatServer) export(eventType, username, content string, t time.Time) {
+	if cs.exporter == nil {
+		return
+	}
+	cs.exporter.Export(ExportEvent{
+		SchemaVersion: exportSchemaVersion,
+		Type:          eventType,
+		Username:      username,
+		Content:       content,
+		Time:          t.UTC().Format(time.RFC3339Nano),
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/segmentio/kafka-go"
+)
+
+// recordingExporter collects exported events for inspection
+type recordingExporter struct {
+	mu     sync.Mutex
+	events []ExportEvent
+}
+
+func (e *recordingExporter) Export(ev ExportEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, ev)
+}
+
+func (e *recordingExporter) Close() error { return nil }
+
+func (e *recordingExporter) snapshot() []ExportEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]ExportEvent(nil), e.events...)
+}
+
+func TestChatServer_ExportsActivity(t *testing.T) {
+	exporter := &recordingExporter{}
+	server := NewChatServer(WithExporter(exporter))
+	server.Run(t.Context())
+
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username=alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	var msg Message
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read welcome message: %v", err)
+	}
+	if err := wsjson.Write(ctx, c, Message{Type: "message", Content: "hello"}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	c.Close(websocket.StatusNormalClosure, "")
+
+	// Wait for the handler to notice the disconnect
+	deadline := time.Now().Add(time.Second * 2)
+	for len(exporter.snapshot()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	events := exporter.snapshot()
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 exported events, got %d: %+v", len(events), events)
+	}
+	wantTypes := []string{ExportJoin, ExportMessage, ExportLeave}
+	for i, ev := range events {
+		if ev.Type != wantTypes[i] || ev.Username != "alice" || ev.SchemaVersion != exportSchemaVersion {
+			t.Errorf("Event %d: unexpected %+v", i, ev)
+		}
+	}
+	if events[1].Content != "hello" {
+		t.Errorf("Expected message content to be exported, got %q", events[1].Content)
+	}
+}
+
+// fakeKafkaWriter records written messages and can be made to block
+type fakeKafkaWriter struct {
+	mu      sync.Mutex
+	msgs    []kafka.Message
+	release chan struct{}
+}
+
+func (w *fakeKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if w.release != nil {
+		<-w.release
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.msgs = append(w.msgs, msgs...)
+	return nil
+}
+
+func (w *fakeKafkaWriter) Close() error { return nil }
+
+func TestKafkaExporter_FlushesOnClose(t *testing.T) {
+	w := &fakeKafkaWriter{}
+	e := newKafkaExporter(w, 16)
+
+	for i := 0; i < 10; i++ {
+		e.Export(ExportEvent{SchemaVersion: exportSchemaVersion, Type: ExportMessage, Username: "alice"})
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if len(w.msgs) != 10 {
+		t.Fatalf("Expected 10 messages written, got %d", len(w.msgs))
+	}
+	var ev ExportEvent
+	if err := json.Unmarshal(w.msgs[0].Value, &ev); err != nil {
+		t.Fatalf("Failed to decode exported value: %v", err)
+	}
+	if string(w.msgs[0].Key) != "alice" || ev.Type != ExportMessage {
+		t.Errorf("Unexpected exported message: key=%q value=%+v", w.msgs[0].Key, ev)
+	}
+
+	// Exporting after close is a no-op rather than a panic
+	e.Export(ExportEvent{Type: ExportJoin})
+}
+
+func TestKafkaExporter_DropsWhenFull(t *testing.T) {
+	w := &fakeKafkaWriter{release: make(chan struct{})}
+	e := newKafkaExporter(w, 2)
+
+	// The first event is picked up by the writer goroutine, which then blocks;
+	// the next two fill the queue and the rest are dropped
+	e.Export(ExportEvent{Type: ExportJoin})
+	time.Sleep(time.Millisecond * 50)
+	for i := 0; i < 5; i++ {
+		e.Export(ExportEvent{Type: ExportMessage})
+	}
+
+	if got := e.Dropped(); got != 3 {
+		t.Errorf("Expected 3 dropped events, got %d", got)
+	}
+	close(w.release)
+	e.Close()
+}
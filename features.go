@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// featuresHeader lists the features switched on, on the upgrade response
+const featuresHeader = "X-Chat-Features"
+
+// Protocol features a deployment can switch off
+const (
+	featureE2EE      = "e2ee"
+	featurePolls     = "polls"
+	featureScheduled = "scheduled"
+	featureReads     = "reads"
+)
+
+// knownFeatures maps every feature to whether it is on by default
+var knownFeatures = map[string]bool{
+	featureE2EE:      true,
+	featurePolls:     true,
+	featureScheduled: true,
+	featureReads:     true,
+}
+
+// errFeatureDisabled refuses encrypted rooms when e2ee is switched off
+var errFeatureDisabled = errors.New("encrypted rooms are disabled on this server")
+
+// Capabilities tells a client which protocol features the server has
+// switched on, in answer to {"type": "capabilities"}. Features can change
+// on a config reload, so clients can ask again at any time.
+type Capabilities struct {
+	Type     string          `json:"type"`
+	Features map[string]bool `json:"features"`
+}
+
+// parseFeatures parses a comma-separated list of feature=on|off settings
+func parseFeatures(s string) (map[string]bool, error) {
+	features := make(map[string]bool)
+	for _, setting := range strings.Split(s, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return nil, fmt.Errorf("feature %q needs =on or =off", setting)
+		}
+		switch value {
+		case "on":
+			features[name] = true
+		case "off":
+			features[name] = false
+		default:
+			return nil, fmt.Errorf("feature %s must be on or off, not %q", name, value)
+		}
+	}
+	return features, validateFeatures(features)
+}
+
+// validateFeatures checks that every feature named is known
+func validateFeatures(features map[string]bool) error {
+	for name := range features {
+		if _, ok := knownFeatures[name]; !ok {
+			return fmt.Errorf("unknown feature %q (known: %s)", name, strings.Join(slices.Sorted(maps.Keys(knownFeatures)), ", "))
+		}
+	}
+	return nil
+}
+
+// WithFeatures switches protocol features on or off. Features left out keep
+// their defaults, and the live config can override them again.
+func WithFeatures(features map[string]bool) Option {
+	return func(cs *ChatServer) {
+		cs.features = features
+	}
+}
+
+// featureEnabled reports whether the named feature is on, checking the
+// live config, then the flags, then the default
+func (cs *ChatServer) featureEnabled(name string) bool {
+	if on, ok := cs.liveConfig().features[name]; ok {
+		return on
+	}
+	if on, ok := cs.features[name]; ok {
+		return on
+	}
+	return knownFeatures[name]
+}
+
+// capabilities returns the state of every known feature
+func (cs *ChatServer) capabilities() Capabilities {
+	features := make(map[string]bool, len(knownFeatures))
+	for name := range knownFeatures {
+		features[name] = cs.featureEnabled(name)
+	}
+	return Capabilities{Type: "capabilities", Features: features}
+}
+
+// enabledFeatures returns the features switched on, sorted and
+// comma-separated, for the upgrade response
+func (cs *ChatServer) enabledFeatures() string {
+	var names []string
+	for _, name := range slices.Sorted(maps.Keys(knownFeatures)) {
+		if cs.featureEnabled(name) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// sendCapabilities tells a client which features are on
+func (cs *ChatServer) sendCapabilities(ctx context.Context, client *Client) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	if err := client.write(ctx, cs.capabilities()); err != nil {
+		client.logf("Error sending capabilities to %s: %v", client.username, err)
+	}
+}
+
+// requireFeature refuses msg with an error if the named feature is off,
+// reporting whether it did
+func (cs *ChatServer) requireFeature(ctx context.Context, client *Client, msg Message, name string) bool {
+	if cs.featureEnabled(name) {
+		return false
+	}
+	client.logf("Refused %s from %s: feature %s is disabled (trace %s)", msg.Type, client.username, name, msg.Trace)
+	cs.sendError(ctx, client, protocolErrorf(codeFeatureDisabled, "%s are disabled on this server", featureNoun(name)), refFor(msg))
+	return true
+}
+
+// featureNoun names a feature in error messages
+func featureNoun(name string) string {
+	switch name {
+	case featurePolls:
+		return "polls"
+	case featureScheduled:
+		return "scheduled messages"
+	case featureReads:
+		return "read markers"
+	case featureE2EE:
+		return "encrypted rooms"
+	}
+	return name
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// readCapabilities reads until the next capabilities message
+func readCapabilities(t *testing.T, ctx context.Context, c *websocket.Conn) Capabilities {
+	t.Helper()
+	for {
+		var caps Capabilities
+		if err := wsjson.Read(ctx, c, &caps); err != nil {
+			t.Fatalf("Failed to read capabilities: %v", err)
+		}
+		if caps.Type == "capabilities" {
+			return caps
+		}
+	}
+}
+
+func TestParseFeatures(t *testing.T) {
+	features, err := parseFeatures("polls=off, e2ee=on")
+	if err != nil {
+		t.Fatalf("Failed to parse features: %v", err)
+	}
+	if features[featurePolls] || !features[featureE2EE] || len(features) != 2 {
+		t.Errorf("Expected polls off and e2ee on, got %v", features)
+	}
+	for _, bad := range []string{"polls", "polls=maybe", "reactions=on"} {
+		if _, err := parseFeatures(bad); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestFeatureFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{}`), 0o644)
+	server := NewChatServer(WithFeatures(map[string]bool{featurePolls: false, featureE2EE: false}), WithConfigFile(path, LiveConfig{}))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c, resp, err := websocket.Dial(ctx, "ws"+s.URL[len("http"):]+"?username=alice",
+		&websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.CloseNow()
+	if got := resp.Header.Get(featuresHeader); got != "reads,scheduled" {
+		t.Errorf("Expected polls and e2ee off on the upgrade response, got %q", got)
+	}
+	wsjson.Write(ctx, c, Message{Type: "capabilities"})
+	if caps := readCapabilities(t, ctx, c); caps.Features[featurePolls] || caps.Features[featureE2EE] || !caps.Features[featureReads] {
+		t.Errorf("Expected polls and e2ee off, got %v", caps.Features)
+	}
+
+	wsjson.Write(ctx, c, Message{Type: "poll", Content: "Lunch?", Poll: &Poll{Options: []string{"pizza", "sushi"}}})
+	if msg := readUntilType(t, ctx, c, "error"); msg.Code != codeFeatureDisabled {
+		t.Errorf("Expected the poll to be refused, got %+v", msg)
+	}
+	if _, _, err := server.createRoom(RoomOptions{Name: "secret", Encrypted: true}); err != errFeatureDisabled {
+		t.Errorf("Expected encrypted rooms to be refused, got %v", err)
+	}
+
+	// The live config overrides the flags
+	os.WriteFile(path, []byte(`{"features": {"polls": true, "scheduled": false}}`), 0o644)
+	if err := server.reloadConfig("test"); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	wsjson.Write(ctx, c, Message{Type: "capabilities"})
+	if caps := readCapabilities(t, ctx, c); !caps.Features[featurePolls] || caps.Features[featureScheduled] {
+		t.Errorf("Expected polls on and scheduled messages off after the reload, got %v", caps.Features)
+	}
+	wsjson.Write(ctx, c, Message{Type: "message", Content: "later", DeliverAt: time.Now().Add(time.Hour).Format(time.RFC3339)})
+	if msg := readUntilType(t, ctx, c, "error"); msg.Code != codeFeatureDisabled {
+		t.Errorf("Expected the scheduled message to be refused, got %+v", msg)
+	}
+	wsjson.Write(ctx, c, Message{Type: "poll", Content: "Lunch?", Poll: &Poll{Options: []string{"pizza", "sushi"}}})
+	if msg := readUntilType(t, ctx, c, "poll"); msg.Content != "Lunch?" {
+		t.Errorf("Expected the poll once polls are back on, got %+v", msg)
+	}
+
+	os.WriteFile(path, []byte(`{"features": {"reactions": true}}`), 0o644)
+	if err := server.reloadConfig("test"); err == nil {
+		t.Errorf("Expected an unknown feature to be refused")
+	}
+}
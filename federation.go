@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+const (
+	// federationHeader names the server on the other end of a federation
+	// link
+	federationHeader     = "X-Chat-Federation"
+	federationQueueSize  = 1024
+	federationMaxBackoff = time.Second * 30
+	federationTimeout    = time.Second * 10
+	// maxFederationHops bounds how many servers an event may pass through
+	maxFederationHops = 8
+)
+
+// FederationConfig links this server to independently operated ones
+type FederationConfig struct {
+	// Name is this server's name in federation, which its peers' links
+	// are configured with
+	Name  string           `json:"name"`
+	Links []FederationLink `json:"links"`
+}
+
+// FederationLink connects selected rooms with one peer server
+type FederationLink struct {
+	// Peer is the name the peer federates under
+	Peer string `json:"peer"`
+	// URL is the peer's federation endpoint, e.g.
+	// wss://chat.example.org/federation. Links without one wait for the
+	// peer to connect.
+	URL string `json:"url,omitempty"`
+	// Key authenticates both directions of the link; both sides configure
+	// the same key
+	Key string `json:"key"`
+	// Rooms maps local rooms, with "lobby" for the lobby, to the peer's
+	// rooms they are linked with
+	Rooms map[string]string `json:"rooms"`
+}
+
+// LoadFederation reads a federation config from a JSON file
+func LoadFederation(path string) (FederationConfig, error) {
+	var cfg FederationConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("reading federation config: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parsing federation config %s: %w", path, err)
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the config's name and links
+func (cfg *FederationConfig) Validate() error {
+	if !validUsernameRegex.MatchString(cfg.Name) {
+		return fmt.Errorf("federation name %q must be letters, digits, _ and -", cfg.Name)
+	}
+	seen := make(map[string]bool)
+	for _, link := range cfg.Links {
+		if !validUsernameRegex.MatchString(link.Peer) || link.Peer == cfg.Name || seen[link.Peer] {
+			return fmt.Errorf("invalid or repeated federation peer %q", link.Peer)
+		}
+		seen[link.Peer] = true
+		if len(link.Key) < 16 {
+			return fmt.Errorf("federation link to %s needs a key of at least 16 characters", link.Peer)
+		}
+		if link.URL != "" && !strings.HasPrefix(link.URL, "ws://") && !strings.HasPrefix(link.URL, "wss://") {
+			return fmt.Errorf("federation link to %s needs a ws(s) url", link.Peer)
+		}
+		if len(link.Rooms) == 0 {
+			return fmt.Errorf("federation link to %s links no rooms", link.Peer)
+		}
+	}
+	return nil
+}
+
+// fedEvent is a chat event exchanged over a federation link
+type fedEvent struct {
+	// Kind is "message", "join" or "leave"
+	Kind string `json:"kind"`
+	// Room is the receiving server's name for the room
+	Room string `json:"room"`
+	// Username is user@server, naming the server the user is on
+	Username string `json:"username"`
+	Content  string `json:"content,omitempty"`
+	// Via lists the servers the event has passed through, starting with
+	// the one it came from
+	Via []string `json:"via"`
+}
+
+// federationLink is a bridge to one peer server. Events go out over the
+// most recent connection, whichever side opened it.
+type federationLink struct {
+	cfg   FederationLink
+	self  string
+	cs    *ChatServer
+	queue chan fedEvent
+	// byRemote maps the peer's room names to ours
+	byRemote map[string]string
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+	// connected is signalled whenever a new connection comes up
+	connected chan struct{}
+}
+
+// WithFederation links rooms with peer servers. Each link is a bridge, so
+// federated users' messages and presence reach the other bridges too.
+func WithFederation(cfg FederationConfig) Option {
+	return func(cs *ChatServer) {
+		for _, link := range cfg.Links {
+			l := &federationLink{
+				cfg:       link,
+				self:      cfg.Name,
+				cs:        cs,
+				queue:     make(chan fedEvent, federationQueueSize),
+				byRemote:  make(map[string]string),
+				connected: make(chan struct{}, 1),
+			}
+			for local, remote := range link.Rooms {
+				l.byRemote[remote] = local
+			}
+			cs.federation = append(cs.federation, l)
+			WithBridge(l)(cs)
+		}
+	}
+}
+
+// remoteRoom returns the peer's name for a local room
+func (l *federationLink) remoteRoom(room string) (string, bool) {
+	remote, ok := l.cfg.Rooms[roomOrLobby(room)]
+	return remote, ok
+}
+
+// relay queues a chat event for the peer, unless its room isn't linked or
+// the peer has already seen it
+func (l *federationLink) relay(ev bridgeEvent) {
+	remote, ok := l.remoteRoom(ev.room)
+	if !ok || slices.Contains(ev.via, l.cfg.Peer) || len(ev.via) >= maxFederationHops {
+		return
+	}
+	username := ev.username
+	if !strings.Contains(username, "@") {
+		username += "@" + l.self
+	}
+	out := fedEvent{Kind: ev.kind, Room: remote, Username: username, Content: ev.content, Via: append(slices.Clone(ev.via), l.self)}
+	select {
+	case l.queue <- out:
+	default:
+		log.Printf("Federation queue to %s full, dropping %s from %s", l.cfg.Peer, ev.kind, ev.username)
+	}
+}
+
+// run sends queued events to the peer until ctx is done, dialing the peer
+// if the link has a URL
+func (l *federationLink) run(ctx context.Context) {
+	if l.cfg.URL != "" {
+		go l.dial(ctx)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-l.queue:
+			l.send(ctx, ev)
+		}
+	}
+}
+
+// send writes an event to the current connection, waiting a while for
+// one if the link is down
+func (l *federationLink) send(ctx context.Context, ev fedEvent) {
+	for {
+		l.mu.Lock()
+		conn := l.conn
+		l.mu.Unlock()
+		if conn != nil {
+			wctx, cancel := context.WithTimeout(ctx, federationTimeout)
+			err := wsjson.Write(wctx, conn, ev)
+			cancel()
+			if err == nil {
+				return
+			}
+			log.Printf("Federation link to %s: %v", l.cfg.Peer, err)
+			l.drop(conn)
+			continue
+		}
+		select {
+		case <-l.connected:
+		case <-time.After(federationTimeout):
+			log.Printf("Federation link to %s down, dropping %s from %s", l.cfg.Peer, ev.Kind, ev.Username)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// attach makes conn the link's connection and reads events from it until
+// it fails
+func (l *federationLink) attach(ctx context.Context, conn *websocket.Conn) error {
+	l.mu.Lock()
+	if l.conn != nil {
+		l.conn.Close(websocket.StatusGoingAway, "replaced by a newer connection")
+	}
+	l.conn = conn
+	l.mu.Unlock()
+	select {
+	case l.connected <- struct{}{}:
+	default:
+	}
+	defer l.drop(conn)
+
+	conn.SetReadLimit(int64(max(l.cs.messageLimit, maxMessageLength)) * 4)
+	for {
+		var ev fedEvent
+		if err := wsjson.Read(ctx, conn, &ev); err != nil {
+			return err
+		}
+		l.receive(ev)
+	}
+}
+
+// drop forgets conn if it is still the link's connection
+func (l *federationLink) drop(conn *websocket.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == conn {
+		l.conn = nil
+	}
+	conn.CloseNow()
+}
+
+// dial keeps an outbound connection to the peer up until ctx is done,
+// reconnecting with backoff
+func (l *federationLink) dial(ctx context.Context) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := l.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Federation link to %s disconnected: %v", l.cfg.Peer, err)
+		if time.Since(start) > federationMaxBackoff {
+			backoff = time.Second
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, federationMaxBackoff)
+	}
+}
+
+// session dials the peer and reads from the connection until it fails
+func (l *federationLink) session(ctx context.Context) error {
+	dctx, cancel := context.WithTimeout(ctx, federationTimeout)
+	defer cancel()
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+l.cfg.Key)
+	header.Set(federationHeader, l.self)
+	conn, _, err := websocket.Dial(dctx, l.cfg.URL, &websocket.DialOptions{HTTPHeader: header})
+	if err != nil {
+		return err
+	}
+	log.Printf("Federation link to %s connected", l.cfg.Peer)
+	return l.attach(ctx, conn)
+}
+
+// receive publishes an event from the peer in the local room it is linked
+// to. Events naming unlinked rooms, events that have already passed
+// through this server, users not from a server on the event's path and
+// messages the room's ACL wouldn't let a guest post are dropped.
+func (l *federationLink) receive(ev fedEvent) {
+	room, ok := l.byRemote[ev.Room]
+	user, server, _ := strings.Cut(ev.Username, "@")
+	switch {
+	case !ok:
+		log.Printf("Federation link to %s: dropping %s for unlinked room %s", l.cfg.Peer, ev.Kind, ev.Room)
+		return
+	case len(ev.Via) == 0 || ev.Via[len(ev.Via)-1] != l.cfg.Peer || len(ev.Via) > maxFederationHops:
+		log.Printf("Federation link to %s: dropping %s with bad path %v", l.cfg.Peer, ev.Kind, ev.Via)
+		return
+	case slices.Contains(ev.Via, l.self):
+		return
+	case !validUsernameRegex.MatchString(user) || server != ev.Via[0]:
+		log.Printf("Federation link to %s: dropping %s from invalid user %q", l.cfg.Peer, ev.Kind, ev.Username)
+		return
+	}
+	if room == lobbyRoom {
+		room = ""
+	}
+
+	now := l.cs.now()
+	msg := Message{
+		Type:      "message",
+		Username:  ev.Username,
+		Content:   ev.Content,
+		Room:      room,
+		Via:       ev.Via,
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+		Trace:     newTraceID(),
+	}
+	switch ev.Kind {
+	case "message":
+		if err := msg.validate(l.cs.messageLimit); err != nil {
+			log.Printf("Federation link to %s: dropping message from %s (trace %s): %v", l.cfg.Peer, ev.Username, msg.Trace, err)
+			return
+		}
+		if err := l.cs.admitBridged(&msg); err != nil {
+			log.Printf("Federation link to %s: dropping message from %s (trace %s): %v", l.cfg.Peer, ev.Username, msg.Trace, err)
+			return
+		}
+	case "join", "leave":
+		// Presence isn't a message, so it is handed to the other bridges
+		// here
+		l.cs.relayToBridges(bridgeEvent{kind: ev.Kind, username: ev.Username, room: room, via: ev.Via})
+		verb := "joined"
+		if ev.Kind == "leave" {
+			verb = "left"
+		}
+		msg.Type, msg.Username, msg.Content = "system", "Server", fmt.Sprintf("%s has %s the chat", ev.Username, verb)
+	default:
+		return
+	}
+	if !l.cs.publish(msg) {
+		log.Printf("Federation link to %s: dropping %s from %s (trace %s): hub busy", l.cfg.Peer, ev.Kind, ev.Username, msg.Trace)
+	}
+}
+
+// handleFederation serves the federation endpoint peers connect to,
+// authenticating them with their link's key
+func (cs *ChatServer) handleFederation(w http.ResponseWriter, r *http.Request) {
+	peer := r.Header.Get(federationHeader)
+	key, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	i := slices.IndexFunc(cs.federation, func(l *federationLink) bool { return l.cfg.Peer == peer })
+	if i < 0 || !hmac.Equal([]byte(key), []byte(cs.federation[i].cfg.Key)) {
+		cs.strike(r, "failed federation authentication")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	link := cs.federation[i]
+
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		log.Printf("Federation accept from %s failed: %v", peer, err)
+		return
+	}
+	log.Printf("Federation link from %s connected", peer)
+	err = link.attach(r.Context(), conn)
+	if !errors.Is(err, context.Canceled) {
+		log.Printf("Federation link from %s disconnected: %v", peer, err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+const testFederationKey = "0123456789abcdef"
+
+// newFederationTestServer serves chat on / and federation on /federation
+func newFederationTestServer(t *testing.T, cfg FederationConfig) (*ChatServer, *httptest.Server) {
+	t.Helper()
+	server := NewChatServer(WithFederation(cfg))
+	server.Run(t.Context())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.handleConnection)
+	mux.HandleFunc("/federation", server.handleFederation)
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return server, s
+}
+
+func TestLoadFederation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "federation.json")
+	os.WriteFile(path, []byte(`{"name": "a", "links": [{"peer": "b", "url": "wss://b.example.org/federation", "key": "0123456789abcdef", "rooms": {"lobby": "lobby"}}]}`), 0o644)
+	cfg, err := LoadFederation(path)
+	if err != nil {
+		t.Fatalf("Failed to load federation config: %v", err)
+	}
+	if cfg.Name != "a" || cfg.Links[0].Rooms["lobby"] != "lobby" {
+		t.Errorf("Expected the config to be read, got %+v", cfg)
+	}
+
+	for _, bad := range []string{
+		`{"name": "a@b", "links": []}`,
+		`{"name": "a", "links": [{"peer": "a", "key": "0123456789abcdef", "rooms": {"lobby": "lobby"}}]}`,
+		`{"name": "a", "links": [{"peer": "b", "key": "short", "rooms": {"lobby": "lobby"}}]}`,
+		`{"name": "a", "links": [{"peer": "b", "url": "https://b", "key": "0123456789abcdef", "rooms": {"lobby": "lobby"}}]}`,
+		`{"name": "a", "links": [{"peer": "b", "key": "0123456789abcdef"}]}`,
+	} {
+		os.WriteFile(path, []byte(bad), 0o644)
+		if _, err := LoadFederation(path); err == nil {
+			t.Errorf("Expected %s to be refused", bad)
+		}
+	}
+}
+
+func TestFederation(t *testing.T) {
+	_, b := newFederationTestServer(t, FederationConfig{Name: "b", Links: []FederationLink{
+		{Peer: "a", Key: testFederationKey, Rooms: map[string]string{"lobby": "lobby"}},
+	}})
+	_, a := newFederationTestServer(t, FederationConfig{Name: "a", Links: []FederationLink{
+		{Peer: "b", URL: "ws" + strings.TrimPrefix(b.URL, "http") + "/federation", Key: testFederationKey, Rooms: map[string]string{"lobby": "lobby"}},
+	}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	bob := dialStatusTest(t, ctx, b, "bob")
+	alice := dialStatusTest(t, ctx, a, "alice")
+
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "hello from a"})
+	if msg := readUntilType(t, ctx, alice, "message"); msg.Username != "alice" || len(msg.Via) != 0 {
+		t.Errorf("Expected alice's own message, got %+v", msg)
+	}
+	msg := readUntilType(t, ctx, bob, "message")
+	if msg.Username != "alice@a" || msg.Content != "hello from a" {
+		t.Errorf("Expected alice's message federated to b, got %+v", msg)
+	}
+
+	wsjson.Write(ctx, bob, Message{Type: "message", Content: "hello from b"})
+	if msg := readUntilType(t, ctx, bob, "message"); msg.Username != "bob" {
+		t.Errorf("Expected bob's own message, got %+v", msg)
+	}
+	// Alice's message must not come back to a, so bob's is the next one
+	if msg := readUntilType(t, ctx, alice, "message"); msg.Username != "bob@b" || msg.Content != "hello from b" {
+		t.Errorf("Expected bob's message federated to a, got %+v", msg)
+	}
+}
+
+func TestFederationRoomACL(t *testing.T) {
+	server := NewChatServer(WithFederation(FederationConfig{Name: "a", Links: []FederationLink{
+		{Peer: "b", Key: testFederationKey, Rooms: map[string]string{"lobby": "lobby"}},
+	}}))
+	link := server.federation[0]
+	ev := fedEvent{Kind: "message", Room: "lobby", Username: "bob@b", Content: "hi", Via: []string{"b"}}
+
+	server.lobby.acl = RoomACL{Post: &Grant{Roles: []string{"speaker"}}}
+	link.receive(ev)
+	if len(server.broadcast) != 0 {
+		t.Errorf("Expected a message the lobby's ACL refuses to be dropped")
+	}
+	server.lobby.acl = RoomACL{}
+	link.receive(ev)
+	if len(server.broadcast) != 1 {
+		t.Errorf("Expected the message once everyone may post")
+	}
+}
+
+func TestFederationRefusesBadKeys(t *testing.T) {
+	_, s := newFederationTestServer(t, FederationConfig{Name: "b", Links: []FederationLink{
+		{Peer: "a", Key: testFederationKey, Rooms: map[string]string{"lobby": "lobby"}},
+	}})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	for _, peer := range []string{"a", "c"} {
+		header := http.Header{}
+		header.Set("Authorization", "Bearer fedcba9876543210")
+		header.Set(federationHeader, peer)
+		_, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"/federation", &websocket.DialOptions{HTTPHeader: header})
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected peer %s with the wrong key to be refused, got %v", peer, err)
+		}
+	}
+}
+
+func TestFederationLoopPrevention(t *testing.T) {
+	server := NewChatServer(WithFederation(FederationConfig{Name: "a", Links: []FederationLink{
+		{Peer: "b", Key: testFederationKey, Rooms: map[string]string{"lobby": "lobby"}},
+	}}))
+	link := server.federation[0]
+
+	link.relay(bridgeEvent{kind: "message", username: "carol@c", content: "hi", via: []string{"c", "b"}})
+	if len(link.queue) != 0 {
+		t.Errorf("Expected an event b has seen not to be sent back to it")
+	}
+	link.relay(bridgeEvent{kind: "message", username: "carol@c", content: "hi", via: []string{"c"}})
+	if ev := <-link.queue; ev.Username != "carol@c" || strings.Join(ev.Via, ",") != "c,a" {
+		t.Errorf("Expected the event forwarded with a on its path, got %+v", ev)
+	}
+
+	for _, ev := range []fedEvent{
+		{Kind: "message", Room: "lobby", Username: "bob@b", Content: "hi", Via: []string{"b", "a", "b"}},
+		{Kind: "message", Room: "lobby", Username: "bob@b", Content: "hi", Via: []string{"c"}},
+		{Kind: "message", Room: "lobby", Username: "bob@c", Content: "hi", Via: []string{"b"}},
+		{Kind: "message", Room: "ops", Username: "bob@b", Content: "hi", Via: []string{"b"}},
+	} {
+		link.receive(ev)
+	}
+	if len(server.broadcast) != 0 {
+		t.Errorf("Expected looping, misrouted and spoofed events to be dropped")
+	}
+}
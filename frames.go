@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// defaultFrameLimit is the largest frame a client may send unless the
+// deployment says otherwise
+const defaultFrameLimit = 32 << 10
+
+// minFrameLimit leaves room for a maximum length message and its envelope
+const minFrameLimit = 4 << 10
+
+// errBinaryFrame is a binary frame from a client under a text-only policy
+var errBinaryFrame = errors.New("binary frames are not accepted")
+
+// FramePolicy says which frames clients may send
+type FramePolicy struct {
+	// ReadLimit is the largest frame, or SSE send body, in bytes. Larger
+	// WebSocket frames close the connection with 1009 (message too big).
+	ReadLimit int64
+	// TextOnly refuses binary frames: the msgpack subprotocol isn't
+	// offered and a binary frame closes the connection with 1003
+	// (unsupported data)
+	TextOnly bool
+	// AllowUnknownFields accepts frames with fields the schema at /schema
+	// doesn't have, ignoring them, as servers did before frames were
+	// decoded strictly
+	AllowUnknownFields bool
+}
+
+// WithFramePolicy sets the frame size limit and whether binary frames are
+// accepted. A zero ReadLimit keeps the default.
+func WithFramePolicy(policy FramePolicy) Option {
+	return func(cs *ChatServer) {
+		if policy.ReadLimit <= 0 {
+			policy.ReadLimit = defaultFrameLimit
+		}
+		cs.frames = policy
+	}
+}
+
+// checkFrameLimit validates a -max-frame-bytes value
+func checkFrameLimit(n int64) error {
+	if n != 0 && n < minFrameLimit {
+		return fmt.Errorf("frame limit must be at least %d bytes", minFrameLimit)
+	}
+	return nil
+}
+
+// subprotocols lists the subprotocols offered under the frame policy
+func (cs *ChatServer) subprotocols() []string {
+	if !cs.frames.TextOnly {
+		return supportedSubprotocols
+	}
+	return slices.DeleteFunc(slices.Clone(supportedSubprotocols), func(p string) bool { return strings.HasSuffix(p, "+msgpack") })
+}
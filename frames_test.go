@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// readClose reads from c until the server closes it and returns the close
+// status
+func readClose(t *testing.T, ctx context.Context, c *websocket.Conn) websocket.StatusCode {
+	t.Helper()
+	for {
+		if _, _, err := c.Read(ctx); err != nil {
+			return websocket.CloseStatus(err)
+		}
+	}
+}
+
+func TestFramePolicy_ReadLimit(t *testing.T) {
+	server := NewChatServer(WithFramePolicy(FramePolicy{ReadLimit: 4096}))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: strings.Repeat("x", 4000)})
+	if msg := readUntilType(t, ctx, alice, "message"); msg.Type != "message" {
+		t.Fatalf("Expected a frame under the limit through, got %+v", msg)
+	}
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: strings.Repeat("x", 4500)})
+	if status := readClose(t, ctx, alice); status != websocket.StatusMessageTooBig {
+		t.Errorf("Expected close status 1009 for an oversized frame, got %v", status)
+	}
+
+	if err := checkFrameLimit(100); err == nil {
+		t.Errorf("Expected a limit too small for a message to be rejected")
+	}
+}
+
+func TestFramePolicy_TextOnly(t *testing.T) {
+	server := NewChatServer(WithFramePolicy(FramePolicy{TextOnly: true}))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	if slices.Contains(server.subprotocols(), subprotocolV2Msgpack) {
+		t.Errorf("Expected msgpack not to be offered, got %v", server.subprotocols())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+	c, _, err := websocket.Dial(ctx, wsURL+"?username=bob", &websocket.DialOptions{Subprotocols: []string{subprotocolV2Msgpack}})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if status := readClose(t, ctx, c); status != closeUnsupportedVersion {
+		t.Errorf("Expected a msgpack only client to be refused, got %v", status)
+	}
+
+	alice := dialStatusTest(t, ctx, s, "alice")
+	alice.Write(ctx, websocket.MessageBinary, []byte(`{"type":"message","content":"hi"}`))
+	if status := readClose(t, ctx, alice); status != websocket.StatusUnsupportedData {
+		t.Errorf("Expected close status 1003 for a binary frame, got %v", status)
+	}
+}
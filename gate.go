@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Connection gate modes
+const (
+	// GateCaptcha asks a CAPTCHA provider to verify the token a client
+	// connects with
+	GateCaptcha = "captcha"
+	// GatePoW has clients solve a proof-of-work challenge before
+	// connecting
+	GatePoW = "pow"
+)
+
+const (
+	defaultPoWDifficulty = 20
+	maxPoWDifficulty     = 32
+	// powChallengeTTL is how long a challenge may be solved and used
+	powChallengeTTL = time.Minute * 2
+	// gatePassHeader carries the pass that lets the server's own canary
+	// probes through the gate
+	gatePassHeader = "X-Chat-Gate-Pass"
+	gatePassTTL    = time.Minute * 5
+	captchaTimeout = time.Second * 5
+	// maxSpentChallenges bounds the solved challenges remembered; beyond
+	// it new connections are refused until old challenges expire
+	maxSpentChallenges = 100000
+)
+
+// errGateUnavailable means the CAPTCHA provider couldn't be asked
+var errGateUnavailable = errors.New("verification unavailable")
+
+// GateConfig configures the anti-bot gate in front of new connections
+type GateConfig struct {
+	Mode string
+	// Key signs challenges and canary passes. Instances sharing a key
+	// accept each other's challenges. Empty generates one per process.
+	Key []byte
+	// Difficulty is the number of leading zero bits a proof-of-work
+	// solution needs
+	Difficulty int
+	// CaptchaURL is a siteverify endpoint, such as hCaptcha's, reCAPTCHA's
+	// or Turnstile's, and CaptchaSecret the deployment's secret for it
+	CaptchaURL    string
+	CaptchaSecret string
+}
+
+// PoWChallenge is the answer to GET /gate/challenge. A client connects with
+// ?pow=<challenge>&nonce=<n> once SHA-256 of "<challenge>:<n>" starts with
+// difficulty zero bits.
+type PoWChallenge struct {
+	Challenge  string    `json:"challenge"`
+	Difficulty int       `json:"difficulty"`
+	Expires    time.Time `json:"expires"`
+}
+
+// connectionGate checks new connections against the configured mode
+type connectionGate struct {
+	cfg    GateConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	spent map[string]time.Time
+}
+
+// WithConnectionGate makes every connection pass a CAPTCHA or proof-of-work
+// check before it is accepted
+func WithConnectionGate(cfg GateConfig) Option {
+	return func(cs *ChatServer) {
+		if len(cfg.Key) == 0 {
+			cfg.Key = make([]byte, 32)
+			rand.Read(cfg.Key)
+		}
+		if cfg.Difficulty <= 0 {
+			cfg.Difficulty = defaultPoWDifficulty
+		}
+		cfg.Difficulty = min(cfg.Difficulty, maxPoWDifficulty)
+		cs.gate = &connectionGate{
+			cfg:    cfg,
+			client: &http.Client{Timeout: captchaTimeout},
+			spent:  make(map[string]time.Time),
+		}
+	}
+}
+
+// parseGateMode checks a -gate flag value
+func parseGateMode(s string) (string, error) {
+	switch s {
+	case "none", "off", "":
+		return "", nil
+	case GateCaptcha, GatePoW:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown gate mode %q (want none, captcha or pow)", s)
+	}
+}
+
+// sign returns the hex MAC of s under the gate key
+func (g *connectionGate) sign(s string) string {
+	mac := hmac.New(sha256.New, g.cfg.Key)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// challenge issues a signed proof-of-work challenge. Challenges carry
+// their own expiry and difficulty, so issuing one stores nothing.
+func (g *connectionGate) challenge(now time.Time) PoWChallenge {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	expires := now.Add(powChallengeTTL).Truncate(time.Second)
+	body := fmt.Sprintf("%s.%d.%d", base64.RawURLEncoding.EncodeToString(nonce), expires.Unix(), g.cfg.Difficulty)
+	return PoWChallenge{
+		Challenge:  body + "." + g.sign(body),
+		Difficulty: g.cfg.Difficulty,
+		Expires:    expires,
+	}
+}
+
+// pass returns a pass for the server's own canary connections
+func (g *connectionGate) pass(now time.Time) string {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	return ts + "." + g.sign("pass:"+ts)
+}
+
+// validPass reports whether pass is a current canary pass
+func (g *connectionGate) validPass(pass string, now time.Time) bool {
+	ts, mac, ok := strings.Cut(pass, ".")
+	if !ok || !hmac.Equal([]byte(mac), []byte(g.sign("pass:"+ts))) {
+		return false
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(unix, 0))
+	return age > -time.Minute && age < gatePassTTL
+}
+
+// check decides whether the connection request r may proceed
+func (g *connectionGate) check(ctx context.Context, r *http.Request, now time.Time) error {
+	if pass := r.Header.Get(gatePassHeader); pass != "" && g.validPass(pass, now) {
+		return nil
+	}
+	q := r.URL.Query()
+	switch g.cfg.Mode {
+	case GatePoW:
+		return g.checkPoW(q.Get("pow"), q.Get("nonce"), now)
+	case GateCaptcha:
+		return g.checkCaptcha(ctx, q.Get("captcha"), r)
+	}
+	return nil
+}
+
+// checkPoW verifies a solved challenge and spends it, so each solution
+// admits one connection
+func (g *connectionGate) checkPoW(challenge, nonce string, now time.Time) error {
+	if challenge == "" || nonce == "" {
+		return errors.New("proof of work required: solve a challenge from /gate/challenge")
+	}
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 4 {
+		return errors.New("malformed challenge")
+	}
+	body := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(g.sign(body))) {
+		return errors.New("challenge was not issued here")
+	}
+	expires, err1 := strconv.ParseInt(parts[1], 10, 64)
+	difficulty, err2 := strconv.Atoi(parts[2])
+	if err1 != nil || err2 != nil {
+		return errors.New("malformed challenge")
+	}
+	if !now.Before(time.Unix(expires, 0)) {
+		return errors.New("challenge expired")
+	}
+	if len(nonce) > 64 || leadingZeroBits(sha256.Sum256([]byte(challenge+":"+nonce))) < difficulty {
+		return errors.New("proof of work does not meet the difficulty")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.spent[challenge]; ok {
+		return errors.New("challenge already used")
+	}
+	if len(g.spent) >= maxSpentChallenges {
+		for c, exp := range g.spent {
+			if !now.Before(exp) {
+				delete(g.spent, c)
+			}
+		}
+		if len(g.spent) >= maxSpentChallenges {
+			return errGateUnavailable
+		}
+	}
+	g.spent[challenge] = time.Unix(expires, 0)
+	return nil
+}
+
+// leadingZeroBits counts the zero bits at the start of sum
+func leadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// checkCaptcha asks the CAPTCHA provider whether token was solved
+func (g *connectionGate) checkCaptcha(ctx context.Context, token string, r *http.Request) error {
+	if token == "" {
+		return errors.New("captcha required")
+	}
+	form := url.Values{"secret": {g.cfg.CaptchaSecret}, "response": {token}}
+	if addr, ok := remoteIP(r); ok {
+		form.Set("remoteip", addr.String())
+	}
+	ctx, cancel := context.WithTimeout(ctx, captchaTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.cfg.CaptchaURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		log.Printf("CAPTCHA verification failed: %v", err)
+		return errGateUnavailable
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&result) != nil {
+		log.Printf("CAPTCHA verification failed: %s", resp.Status)
+		return errGateUnavailable
+	}
+	if !result.Success {
+		return errors.New("captcha not solved")
+	}
+	return nil
+}
+
+// passGate answers an HTTP error and returns false if r doesn't get
+// through the connection gate
+func (cs *ChatServer) passGate(w http.ResponseWriter, r *http.Request) bool {
+	err := cs.gate.check(r.Context(), r, cs.now())
+	switch {
+	case err == nil:
+		metrics.Add(metricGatePassed, 1)
+		return true
+	case errors.Is(err, errGateUnavailable):
+		http.Error(w, "connection gate: "+err.Error(), http.StatusServiceUnavailable)
+	default:
+		cs.strike(r, "failed connection gate")
+		http.Error(w, "connection gate: "+err.Error(), http.StatusForbidden)
+	}
+	metrics.Add(metricGateRejected, 1)
+	return false
+}
+
+// handleGateChallenge serves GET /gate/challenge, issuing a proof-of-work
+// challenge when the gate asks for one
+func (cs *ChatServer) handleGateChallenge(w http.ResponseWriter, r *http.Request) {
+	if cs.gate == nil || cs.gate.cfg.Mode != GatePoW {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(cs.gate.challenge(cs.now()))
+}
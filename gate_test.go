@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// newGateTestServer serves the WebSocket endpoint and challenges
+func newGateTestServer(t *testing.T, server *ChatServer) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", server.handleConnection)
+	mux.HandleFunc("/gate/challenge", server.handleGateChallenge)
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// dialGate connects with query appended to the WebSocket URL and returns
+// the HTTP status of the handshake
+func dialGate(t *testing.T, ctx context.Context, s *httptest.Server, query string, header http.Header) int {
+	t.Helper()
+	c, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"/ws?"+query, &websocket.DialOptions{HTTPHeader: header})
+	if err != nil {
+		if resp == nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		return resp.StatusCode
+	}
+	c.Close(websocket.StatusNormalClosure, "")
+	return http.StatusSwitchingProtocols
+}
+
+// solvePoW finds a nonce meeting the challenge's difficulty
+func solvePoW(c PoWChallenge) string {
+	for n := 0; ; n++ {
+		nonce := strconv.Itoa(n)
+		if leadingZeroBits(sha256.Sum256([]byte(c.Challenge+":"+nonce))) >= c.Difficulty {
+			return nonce
+		}
+	}
+}
+
+func TestConnectionGate_PoW(t *testing.T) {
+	server := NewChatServer(WithConnectionGate(GateConfig{Mode: GatePoW, Difficulty: 8}))
+	server.Run(t.Context())
+	s := newGateTestServer(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if status := dialGate(t, ctx, s, "username=bot", nil); status != http.StatusForbidden {
+		t.Errorf("Expected 403 without a proof of work, got %d", status)
+	}
+
+	resp, err := http.Get(s.URL + "/gate/challenge")
+	if err != nil {
+		t.Fatalf("Failed to get a challenge: %v", err)
+	}
+	var c PoWChallenge
+	json.NewDecoder(resp.Body).Decode(&c)
+	resp.Body.Close()
+	if c.Difficulty != 8 || c.Challenge == "" {
+		t.Fatalf("Expected a challenge of difficulty 8, got %+v", c)
+	}
+	nonce := solvePoW(c)
+
+	// Lowering the difficulty breaks the signature
+	parts := strings.Split(c.Challenge, ".")
+	forged := strings.Join([]string{parts[0], parts[1], "0", parts[3]}, ".")
+	if status := dialGate(t, ctx, s, "username=bot&pow="+forged+"&nonce=x", nil); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a forged challenge, got %d", status)
+	}
+
+	query := "username=alice&pow=" + c.Challenge + "&nonce=" + nonce
+	if status := dialGate(t, ctx, s, query, nil); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected a solved challenge to connect, got %d", status)
+	}
+	if status := dialGate(t, ctx, s, strings.Replace(query, "alice", "bob", 1), nil); status != http.StatusForbidden {
+		t.Errorf("Expected 403 reusing a challenge, got %d", status)
+	}
+
+	// The server's own canary passes on its signed header
+	header := http.Header{gatePassHeader: {server.gate.pass(time.Now())}}
+	if status := dialGate(t, ctx, s, "username=carol", header); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected a canary pass to connect, got %d", status)
+	}
+	header.Set(gatePassHeader, server.gate.pass(time.Now().Add(-time.Hour)))
+	if status := dialGate(t, ctx, s, "username=dave", header); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for an expired pass, got %d", status)
+	}
+}
+
+func TestConnectionGate_Captcha(t *testing.T) {
+	var down atomic.Bool
+	verify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "oops", http.StatusBadGateway)
+			return
+		}
+		r.ParseForm()
+		ok := r.PostForm.Get("secret") == "shh" && r.PostForm.Get("response") == "solved"
+		json.NewEncoder(w).Encode(map[string]bool{"success": ok})
+	}))
+	defer verify.Close()
+
+	server := NewChatServer(WithConnectionGate(GateConfig{Mode: GateCaptcha, CaptchaURL: verify.URL, CaptchaSecret: "shh"}))
+	server.Run(t.Context())
+	s := newGateTestServer(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if status := dialGate(t, ctx, s, "username=alice&captcha=solved", nil); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected a solved captcha to connect, got %d", status)
+	}
+	if status := dialGate(t, ctx, s, "username=bot&captcha=guess", nil); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for an unsolved captcha, got %d", status)
+	}
+	if resp, _ := http.Get(s.URL + "/gate/challenge"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected no challenges in captcha mode, got %d", resp.StatusCode)
+	}
+	down.Store(true)
+	if status := dialGate(t, ctx, s, "username=bob&captcha=solved", nil); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while the provider is down, got %d", status)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+const (
+	// gossipInbox is how many messages routed from other nodes may wait
+	// for delivery before new ones are dropped
+	gossipInbox = 1024
+	// Gossip payloads start with their kind
+	gossipKindState   = 's'
+	gossipKindMessage = 'm'
+)
+
+// GossipConfig sets up cluster membership over gossip, so instances find
+// each other without a broker and know who is connected where
+type GossipConfig struct {
+	// Bind is the host:port gossip listens on, over both UDP and TCP
+	Bind string
+	// Advertise is the ip:port other nodes reach this one at, if not Bind
+	Advertise string
+	// Join lists nodes to join the cluster through; any live one will do
+	Join []string
+	// Key encrypts gossip, and must be 16, 24 or 32 bytes. Without one
+	// gossip is sent in the clear.
+	Key []byte
+	// Interval is how often each node sends its state to the others,
+	// heartbeatInterval by default
+	Interval time.Duration
+}
+
+// gossipState is what a node tells the others about itself
+type gossipState struct {
+	Info InstanceInfo `json:"info"`
+	// Users are the visible users connected to the node, sorted
+	Users []string `json:"users"`
+	// Lobby are the visible users in the node's lobby, sorted
+	Lobby []string `json:"lobby,omitempty"`
+	// Rooms are the rooms the node hosts
+	Rooms []string `json:"rooms"`
+}
+
+// gossip keeps this instance in a memberlist cluster. Each node regularly
+// sends its state to every other node over TCP, and messages addressed to
+// one user go straight to the node holding their connection.
+type gossip struct {
+	cfg   GossipConfig
+	cs    *ChatServer
+	ml    *memberlist.Memberlist
+	inbox chan Message
+
+	mu    sync.Mutex
+	nodes map[string]gossipState
+}
+
+// WithGossip joins the instance to a cluster over gossip
+func WithGossip(cfg GossipConfig) Option {
+	return func(cs *ChatServer) {
+		if cfg.Interval <= 0 {
+			cfg.Interval = heartbeatInterval
+		}
+		cs.gossip = &gossip{cfg: cfg, cs: cs, inbox: make(chan Message, gossipInbox), nodes: make(map[string]gossipState)}
+	}
+}
+
+// splitHostPort splits a gossip address, defaulting the host to every
+// interface
+func splitHostPort(addr string) (string, int, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in %q", addr)
+	}
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	return host, n, nil
+}
+
+// start creates the memberlist, joins the cluster and runs until ctx is
+// done. Failing to reach the nodes to join through isn't fatal, since they
+// may join this one later.
+func (g *gossip) start(ctx context.Context) error {
+	conf := memberlist.DefaultLANConfig()
+	conf.Name = g.cs.instanceID
+	conf.Delegate = g
+	conf.Events = g
+	conf.Logger = log.New(log.Writer(), "gossip: ", log.Flags())
+	if len(g.cfg.Key) > 0 {
+		conf.SecretKey = g.cfg.Key
+	}
+	var err error
+	if conf.BindAddr, conf.BindPort, err = splitHostPort(g.cfg.Bind); err != nil {
+		return fmt.Errorf("gossip bind address: %w", err)
+	}
+	conf.AdvertisePort = conf.BindPort
+	if g.cfg.Advertise != "" {
+		if conf.AdvertiseAddr, conf.AdvertisePort, err = splitHostPort(g.cfg.Advertise); err != nil {
+			return fmt.Errorf("gossip advertise address: %w", err)
+		}
+	}
+	if g.ml, err = memberlist.Create(conf); err != nil {
+		return err
+	}
+	if len(g.cfg.Join) > 0 {
+		if _, err := g.ml.Join(g.cfg.Join); err != nil {
+			log.Printf("Gossip join failed, waiting for other nodes to join: %v", err)
+		}
+	}
+	go g.run(ctx)
+	return nil
+}
+
+// addr returns the address gossip is reachable at
+func (g *gossip) addr() string {
+	node := g.ml.LocalNode()
+	return net.JoinHostPort(node.Addr.String(), strconv.Itoa(int(node.Port)))
+}
+
+// run sends this node's state every interval and delivers routed messages
+// until ctx is done, then leaves the cluster
+func (g *gossip) run(ctx context.Context) {
+	ticker := time.NewTicker(g.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.sendState()
+		case msg := <-g.inbox:
+			g.cs.receiveRemote(msg)
+		case <-ctx.Done():
+			if err := g.ml.Leave(time.Second); err != nil {
+				log.Printf("Gossip leave failed: %v", err)
+			}
+			g.ml.Shutdown()
+			return
+		}
+	}
+}
+
+// state describes this node
+func (g *gossip) state() gossipState {
+	cs := g.cs
+	cs.roomsMtx.Lock()
+	rooms := make([]string, 0, len(cs.rooms))
+	for name := range cs.rooms {
+		rooms = append(rooms, name)
+	}
+	cs.roomsMtx.Unlock()
+	sort.Strings(rooms)
+	return gossipState{Info: cs.self(), Users: cs.localMembers(), Lobby: cs.roomMembers(nil), Rooms: rooms}
+}
+
+// encode prefixes a payload with its kind
+func encodeGossip(kind byte, v any) []byte {
+	data, _ := json.Marshal(v)
+	return append([]byte{kind}, data...)
+}
+
+// sendState sends this node's state to every other node
+func (g *gossip) sendState() {
+	data := encodeGossip(gossipKindState, g.state())
+	for _, node := range g.ml.Members() {
+		if node.Name == g.cs.instanceID {
+			continue
+		}
+		if err := g.ml.SendReliable(node, data); err != nil {
+			log.Printf("Gossip state to %s failed: %v", node.Name, err)
+		}
+	}
+}
+
+// send routes msg to the named node, reporting whether it was sent
+func (g *gossip) send(name string, msg Message) bool {
+	i := slices.IndexFunc(g.ml.Members(), func(n *memberlist.Node) bool { return n.Name == name })
+	if i < 0 {
+		return false
+	}
+	if err := g.ml.SendReliable(g.ml.Members()[i], encodeGossip(gossipKindMessage, msg)); err != nil {
+		log.Printf("Gossip message to %s failed (trace %s): %v", name, msg.Trace, err)
+		return false
+	}
+	return true
+}
+
+// NotifyMsg handles a payload from another node. It runs on memberlist's
+// goroutines, so messages are handed to run for delivery.
+func (g *gossip) NotifyMsg(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	switch data[0] {
+	case gossipKindState:
+		var state gossipState
+		if err := json.Unmarshal(data[1:], &state); err != nil || state.Info.ID == "" {
+			return
+		}
+		g.merge(state)
+	case gossipKindMessage:
+		var msg Message
+		if err := json.Unmarshal(data[1:], &msg); err != nil {
+			return
+		}
+		select {
+		case g.inbox <- msg:
+		default:
+			log.Printf("Gossip inbox full, dropped %s message from %s (trace %s)", msg.Type, msg.Username, msg.Trace)
+		}
+	}
+}
+
+// merge records another node's state
+func (g *gossip) merge(state gossipState) {
+	if state.Info.ID == g.cs.instanceID {
+		return
+	}
+	g.mu.Lock()
+	g.nodes[state.Info.ID] = state
+	g.mu.Unlock()
+	g.cs.recordPeer(state.Info)
+}
+
+// LocalState and MergeRemoteState swap full state with a node on join and
+// on memberlist's periodic push/pull
+func (g *gossip) LocalState(bool) []byte { return encodeGossip(gossipKindState, g.state()) }
+func (g *gossip) MergeRemoteState(data []byte, _ bool) {
+	g.NotifyMsg(data)
+}
+
+func (g *gossip) NodeMeta(int) []byte             { return nil }
+func (g *gossip) GetBroadcasts(int, int) [][]byte { return nil }
+
+func (g *gossip) NotifyJoin(node *memberlist.Node) {
+	log.Printf("Gossip: %s joined the cluster", node.Name)
+}
+
+func (g *gossip) NotifyUpdate(*memberlist.Node) {}
+
+// NotifyLeave forgets a node that left or failed
+func (g *gossip) NotifyLeave(node *memberlist.Node) {
+	log.Printf("Gossip: %s left the cluster", node.Name)
+	g.mu.Lock()
+	delete(g.nodes, node.Name)
+	g.mu.Unlock()
+	g.cs.peers.mu.Lock()
+	delete(g.cs.peers.peers, node.Name)
+	g.cs.peers.mu.Unlock()
+}
+
+// locate returns the node username is connected to, if another one
+func (g *gossip) locate(username string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for name, state := range g.nodes {
+		if _, ok := slices.BinarySearch(state.Users, username); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// roomOwner returns the node hosting a room this one doesn't have
+func (g *gossip) roomOwner(room string) (InstanceInfo, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, state := range g.nodes {
+		if slices.Contains(state.Rooms, room) {
+			return state.Info, true
+		}
+	}
+	return InstanceInfo{}, false
+}
+
+// lobbyUsers returns the visible users in other nodes' lobbies
+func (g *gossip) lobbyUsers() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var names []string
+	for _, state := range g.nodes {
+		names = append(names, state.Lobby...)
+	}
+	return names
+}
+
+// routeDirect sends a message addressed to one user straight to the node
+// holding their connection, reporting whether it needs no broadcast
+func (cs *ChatServer) routeDirect(msg Message) bool {
+	if cs.gossip == nil || msg.To == "" {
+		return false
+	}
+	cs.clientsMtx.Lock()
+	_, local := cs.usernames[msg.To]
+	cs.clientsMtx.Unlock()
+	if local {
+		return true
+	}
+	node := cs.gossip.locate(msg.To)
+	return node != "" && cs.gossip.send(node, msg)
+}
+
+// clusterMembers returns the visible users in the lobby anywhere in the
+// cluster, sorted
+func (cs *ChatServer) clusterMembers() []string {
+	names := cs.roomMembers(nil)
+	if cs.gossip == nil {
+		return names
+	}
+	names = append(names, cs.gossip.lobbyUsers()...)
+	sort.Strings(names)
+	return slices.Compact(names)
+}
+
+// misdirect answers a request for a room another node hosts with 421
+// Misdirected Request, pointing the affinity cookie at that node so a
+// retry through the load balancer reaches it. It reports whether it did.
+func (cs *ChatServer) misdirect(w http.ResponseWriter, room string) bool {
+	if cs.gossip == nil {
+		return false
+	}
+	owner, ok := cs.gossip.roomOwner(room)
+	if !ok {
+		return false
+	}
+	cs.pinTo(w, owner.ID)
+	if owner.Advertise != "" {
+		w.Header().Set("Location", owner.Advertise)
+	}
+	http.Error(w, fmt.Sprintf("room %s is hosted by instance %s", room, owner.ID), http.StatusMisdirectedRequest)
+	return true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// newGossipTestServer starts an instance gossiping on a free local port
+func newGossipTestServer(t *testing.T, id string, join ...string) (*ChatServer, *httptest.Server) {
+	t.Helper()
+	server := NewChatServer(WithInstanceID(id), WithGossip(GossipConfig{Bind: "127.0.0.1:0", Join: join, Interval: time.Millisecond * 50}))
+	ctx, cancel := context.WithCancel(context.Background())
+	server.Run(ctx)
+	t.Cleanup(func() {
+		cancel()
+		<-server.Done()
+	})
+	if server.gossip == nil {
+		t.Fatalf("Failed to start gossip")
+	}
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	t.Cleanup(s.Close)
+	return server, s
+}
+
+// waitFor polls until cond holds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+func TestGossip(t *testing.T) {
+	a, as := newGossipTestServer(t, "a")
+	b, bs := newGossipTestServer(t, "b", a.gossip.addr())
+	if _, _, err := b.createRoom(RoomOptions{Name: "ops"}); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	dialStatusTest(t, ctx, as, "alice")
+	bob := dialStatusTest(t, ctx, bs, "bob")
+
+	waitFor(t, "a to learn where bob is", func() bool { return a.gossip.locate("bob") == "b" })
+	if members := a.clusterMembers(); !slices.Equal(members, []string{"alice", "bob"}) {
+		t.Errorf("Expected both users in a's roster, got %v", members)
+	}
+	if peers := a.livePeers(); len(peers) != 1 || peers[0].ID != "b" {
+		t.Errorf("Expected b as a's only peer, got %+v", peers)
+	}
+
+	// Without a broker, only gossip can get the whisper to bob
+	a.publish(Message{Type: "message", Username: "alice", To: "bob", Content: "psst"})
+	if msg := readUntilType(t, ctx, bob, "message"); msg.Content != "psst" || msg.Username != "alice" {
+		t.Errorf("Expected alice's whisper routed to bob, got %+v", msg)
+	}
+
+	waitFor(t, "a to learn b's rooms", func() bool { _, ok := a.gossip.roomOwner("ops"); return ok })
+	_, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(as.URL, "http")+"?username=carol&room=ops", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusMisdirectedRequest {
+		t.Fatalf("Expected a room hosted by b to be misdirected, got %v", err)
+	}
+	if i := slices.IndexFunc(resp.Cookies(), func(c *http.Cookie) bool { return c.Name == defaultAffinityCookie }); i < 0 || resp.Cookies()[i].Value != "b" {
+		t.Errorf("Expected the affinity cookie to point at b, got %v", resp.Cookies())
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/bvedant/ideal-guacamole/chatpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// subscriberBuffer is how many messages a gRPC subscriber may fall behind
+// before it is disconnected
+const subscriberBuffer = 256
+
+// subscriber receives the messages delivered to one room for a gRPC
+// Subscribe call. The hub closes frames when it drops the subscriber.
+type subscriber struct {
+	room   string
+	frames chan Message
+}
+
+// NewGRPCServer returns a gRPC server exposing the hub as the chat.v1.Chat
+// service. Callers authenticate with the admin token or a token the
+// server's Authenticator accepts.
+func NewGRPCServer(cs *ChatServer, opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(opts...)
+	chatpb.RegisterChatServer(s, &grpcChat{cs: cs})
+	return s
+}
+
+// grpcChat implements chatpb.ChatServer on the hub
+type grpcChat struct {
+	chatpb.UnimplementedChatServer
+	cs *ChatServer
+}
+
+// grpcCaller is who made a gRPC call
+type grpcCaller struct {
+	username string
+	roles    []string
+	admin    bool
+}
+
+// caller authenticates a gRPC call from its bearer token metadata
+func (cs *ChatServer) caller(ctx context.Context) (grpcCaller, error) {
+	if p, ok := peer.FromContext(ctx); ok {
+		if addrPort, err := netip.ParseAddrPort(p.Addr.String()); err == nil {
+			if e, banned := cs.bans.Banned(addrPort.Addr().Unmap()); banned {
+				log.Printf("Rejected gRPC call from banned address %s (%s)", addrPort.Addr(), e.CIDR)
+				return grpcCaller{}, status.Error(codes.PermissionDenied, "banned")
+			}
+		}
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	if values := md.Get("authorization"); len(values) > 0 {
+		token, _ = strings.CutPrefix(values[0], "Bearer ")
+	}
+	if token != "" && cs.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cs.adminToken)) == 1 {
+		return grpcCaller{admin: true}, nil
+	}
+	if token != "" && cs.auth != nil {
+		identity, err := cs.auth.Authenticate(ctx, token)
+		if err == nil && !identity.Guest {
+			return grpcCaller{username: identity.Username, roles: identity.Roles}, nil
+		}
+	}
+	return grpcCaller{}, status.Error(codes.Unauthenticated, "invalid token")
+}
+
+// Subscribe streams the messages delivered to a room
+func (g *grpcChat) Subscribe(req *chatpb.SubscribeRequest, stream grpc.ServerStreamingServer[chatpb.ChatMessage]) error {
+	cs := g.cs
+	caller, err := cs.caller(stream.Context())
+	if err != nil {
+		return err
+	}
+	name := req.GetRoom()
+	if name == lobbyRoom {
+		name = ""
+	}
+	if caller.admin {
+		if name != "" && cs.lookupRoom(name) == nil {
+			return status.Error(codes.NotFound, errRoomNotFound.Error())
+		}
+	} else if _, err := cs.roomHistory(name, req.GetPassword()); err != nil {
+		return roomError(err)
+	}
+
+	sub := &subscriber{room: name, frames: make(chan Message, subscriberBuffer)}
+	cs.clientsMtx.Lock()
+	cs.subscribers[sub] = true
+	cs.clientsMtx.Unlock()
+	defer func() {
+		cs.clientsMtx.Lock()
+		delete(cs.subscribers, sub)
+		cs.clientsMtx.Unlock()
+	}()
+	log.Printf("gRPC subscriber for %s connected", roomOrLobby(name))
+
+	for {
+		select {
+		case msg, ok := <-sub.frames:
+			if !ok {
+				return status.Error(codes.Unavailable, "subscription ended by the server")
+			}
+			if err := stream.Send(toProto(msg)); err != nil {
+				return err
+			}
+		case <-cs.stopped:
+			return status.Error(codes.Unavailable, "server shutting down")
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// Publish validates and broadcasts each message of the stream, answering
+// with an ack
+func (g *grpcChat) Publish(stream grpc.BidiStreamingServer[chatpb.PublishRequest, chatpb.PublishAck]) error {
+	cs := g.cs
+	caller, err := cs.caller(stream.Context())
+	if err != nil {
+		return err
+	}
+	// The stream is scored for spam like a WebSocket connection
+	var spam spamState
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			if errors.Is(err, context.Canceled) || status.Code(err) == codes.Canceled {
+				return nil
+			}
+			return err
+		}
+		ack := &chatpb.PublishAck{Ref: req.GetRef(), Trace: newTraceID()}
+		err = cs.publishRPC(caller, &spam, req, ack.Trace)
+		if err != nil {
+			ack.Code, ack.Error = errorCode(err), err.Error()
+		}
+		if err := stream.Send(ack); err != nil {
+			return err
+		}
+		if errors.Is(err, errSpamDisconnect) {
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+	}
+}
+
+// errSpamDisconnect ends a Publish stream whose spam score reached the
+// disconnect penalty
+var errSpamDisconnect = protocolErrorf(codeRejected, "disconnected for spam")
+
+// publishRPC checks a published message as a WebSocket message would be
+// checked and broadcasts it: the room's ACL, the Lua hook, banned words,
+// the stream's spam score and the room's slow mode, then shadow bans and
+// quarantine, which accept the message without delivering it
+func (cs *ChatServer) publishRPC(caller grpcCaller, spam *spamState, req *chatpb.PublishRequest, trace string) error {
+	username := caller.username
+	if caller.admin {
+		username = req.GetUsername()
+		if username == "" {
+			return protocolErrorf(codeInvalidUsername, "username required")
+		}
+		if err := cs.validateUsername(username); err != nil {
+			return err
+		}
+	} else if req.GetUsername() != "" && req.GetUsername() != username {
+		return protocolErrorf(codeInvalidUsername, "only the admin token may publish as another user")
+	}
+
+	name := req.GetRoom()
+	if name == lobbyRoom {
+		name = ""
+	}
+	if caller.admin {
+		if name != "" && cs.lookupRoom(name) == nil {
+			return errRoomNotFound
+		}
+	} else if _, err := cs.roomHistory(name, ""); err != nil {
+		return err
+	}
+
+	now := cs.now()
+	msg := Message{
+		Type:      req.GetType(),
+		Username:  username,
+		Content:   req.GetContent(),
+		Room:      name,
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+		Trace:     trace,
+	}
+	if msg.Type == "" {
+		msg.Type = "message"
+	}
+	if msg.Type == "system" && !caller.admin {
+		return protocolErrorf(codeInvalidType, "only the admin token may send system messages")
+	}
+	if err := msg.validateIn(cs.lookupRoom(name), cs.messageLimit); err != nil {
+		return err
+	}
+	if !caller.admin && !cs.permits(cs.lookupRoom(name), PermPost, grantee{username: caller.username, roles: caller.roles}) {
+		return protocolErrorf(codeForbidden, "you may not post in %s", roomOrLobby(name))
+	}
+	if msg.Type == "message" {
+		if err := cs.scriptInbound(&msg, cs.lookupRoom(name)); err != nil {
+			log.Printf("Lua hook refused gRPC message from %s (trace %s): %v", username, trace, err)
+			return err
+		}
+		if word := cs.bannedWord(msg.Content); word != "" {
+			log.Printf("Banned word %q from gRPC publisher %s (trace %s)", word, username, trace)
+			return protocolErrorf(codeRejected, "message contains a banned word")
+		}
+		// The admin token is trusted with anyone's messages, and may
+		// moderate every room
+		if !caller.admin {
+			if err := cs.checkSpamRPC(username, spam, msg, now); err != nil {
+				return err
+			}
+			who := grantee{username: caller.username, roles: caller.roles}
+			if wait := cs.slowModeWait(cs.lookupRoom(name), username, who, now); wait > 0 {
+				return protocolErrorf(codeSlowMode, "slow mode is on: wait %s before sending again", wait.Round(time.Second))
+			}
+		}
+	}
+	if cs.shadowBans.banned(username) {
+		log.Printf("Dropped gRPC message from shadow-banned %s (trace %s)", username, trace)
+		return nil
+	}
+	if cs.holdFor(username, msg) {
+		log.Printf("Held gRPC message from quarantined %s (trace %s)", username, trace)
+		return nil
+	}
+	cs.export(ExportMessage, msg.Username, msg.Content, now)
+	if !cs.publish(msg) {
+		return protocolErrorf(codeServerBusy, "server busy, try again")
+	}
+	return nil
+}
+
+// checkSpamRPC scores a published chat message against its stream's spam
+// state. A mute refuses it, and a disconnect also ends the stream.
+func (cs *ChatServer) checkSpamRPC(username string, s *spamState, msg Message, now time.Time) error {
+	if cs.spam == nil {
+		return nil
+	}
+	reason, err := cs.spam.screen(s, msg.Content, now)
+	if reason == "" {
+		return err
+	}
+	penalty, ok := cs.spam.escalate(s, now)
+	if !ok {
+		return err
+	}
+	detail := fmt.Sprintf("%s: %s (score %.0f)", penalty, reason, s.score)
+	log.Printf("Spam penalty for gRPC publisher %s (trace %s): %s", username, msg.Trace, detail)
+	cs.audit(AuditSpam, "system", username, detail)
+	switch penalty {
+	case spamMuted:
+		return protocolErrorf(codeMuted, "muted for spam for %s", cs.spam.cfg.MuteDuration)
+	case spamDisconnected:
+		return errSpamDisconnect
+	}
+	return err
+}
+
+// errorCode returns the protocol error code of err, if it has one
+func errorCode(err error) string {
+	var perr *ProtocolError
+	if errors.As(err, &perr) {
+		return perr.Code
+	}
+	return ""
+}
+
+// roomError maps room errors to gRPC status errors
+func roomError(err error) error {
+	switch {
+	case errors.Is(err, errRoomNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errRoomForbidden), errors.Is(err, errRoomInvite):
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// deliverSubscribersLocked hands a delivered message to the subscribers of
+// its room, dropping any that have fallen too far behind. Callers hold
+// ChatServer.clientsMtx.
+func (cs *ChatServer) deliverSubscribersLocked(msg Message, global bool) {
+	for sub := range cs.subscribers {
+		out := msg
+		if !global && sub.room != msg.Room {
+			continue
+		} else if global && sub.room != "" {
+			out.Seq = 0
+		}
+		select {
+		case sub.frames <- out:
+		default:
+			log.Printf("Dropping slow gRPC subscriber for %s (trace %s)", roomOrLobby(sub.room), msg.Trace)
+			close(sub.frames)
+			delete(cs.subscribers, sub)
+		}
+	}
+}
+
+// closeSubscribersLocked ends every Subscribe call. Callers hold
+// ChatServer.clientsMtx.
+func (cs *ChatServer) closeSubscribersLocked() {
+	for sub := range cs.subscribers {
+		close(sub.frames)
+		delete(cs.subscribers, sub)
+	}
+}
+
+// toProto converts a message to its protobuf form
+func toProto(msg Message) *chatpb.ChatMessage {
+	return &chatpb.ChatMessage{
+		Id:        msg.ID,
+		Type:      msg.Type,
+		Username:  msg.Username,
+		Content:   msg.Content,
+		Room:      msg.Room,
+		Timestamp: msg.Timestamp,
+		Seq:       msg.Seq,
+		Trace:     msg.Trace,
+	}
+}
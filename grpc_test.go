@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bvedant/ideal-guacamole/chatpb"
+	"github.com/coder/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dialGRPC serves the hub's gRPC API in memory and returns a client
+func dialGRPC(t *testing.T, server *ChatServer) chatpb.ChatClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	s := NewGRPCServer(server)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return chatpb.NewChatClient(conn)
+}
+
+func TestGRPC_PublishAndSubscribe(t *testing.T) {
+	server := NewChatServer(WithAdminToken("secret"))
+	server.Run(t.Context())
+	client := dialGRPC(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// Calls without a valid token are refused
+	sub, err := client.Subscribe(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer guess"), &chatpb.SubscribeRequest{})
+	if err == nil {
+		_, err = sub.Recv()
+	}
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected Unauthenticated, got %v", err)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	sub, err = client.Subscribe(ctx, &chatpb.SubscribeRequest{Room: "lobby"})
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	// The subscription is registered once the server has handled the call
+	for {
+		server.clientsMtx.Lock()
+		n := len(server.subscribers)
+		server.clientsMtx.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	pub, err := client.Publish(ctx)
+	if err != nil {
+		t.Fatalf("Failed to open publish stream: %v", err)
+	}
+	pub.Send(&chatpb.PublishRequest{Ref: "1", Username: "deploybot", Content: ""})
+	if ack, err := pub.Recv(); err != nil || ack.Ref != "1" || ack.Code != codeEmptyContent {
+		t.Errorf("Expected an empty_content ack, got %v (%v)", ack, err)
+	}
+	pub.Send(&chatpb.PublishRequest{Ref: "2", Room: "nowhere", Username: "deploybot", Content: "hi"})
+	if ack, err := pub.Recv(); err != nil || ack.Error == "" {
+		t.Errorf("Expected an error for an unknown room, got %v (%v)", ack, err)
+	}
+	pub.Send(&chatpb.PublishRequest{Ref: "3", Username: "deploybot", Content: "build 42 is live"})
+	if ack, err := pub.Recv(); err != nil || ack.Ref != "3" || ack.Error != "" || ack.Trace == "" {
+		t.Errorf("Expected the message to be accepted, got %v (%v)", ack, err)
+	}
+
+	msg, err := sub.Recv()
+	if err != nil {
+		t.Fatalf("Failed to receive: %v", err)
+	}
+	if msg.Username != "deploybot" || msg.Content != "build 42 is live" || msg.Type != "message" || msg.Seq == 0 || msg.Id == "" {
+		t.Errorf("Unexpected message %v", msg)
+	}
+}
+
+func TestGRPC_PublishModeration(t *testing.T) {
+	server := NewChatServer(WithAdminToken("secret"),
+		WithAuthenticator(tokenAuth{"bob-token": {Username: "bob"}, "dave-token": {Username: "dave"}}),
+		WithSpamFilter(SpamConfig{WarnScore: 100, SlowScore: 100, MuteScore: 3, DisconnectScore: 100}))
+	server.live.Store(&liveSettings{bannedWords: regexp.MustCompile(`(?i)\bspam\b`)})
+	server.shadowBans.add(ShadowBan{Username: "carol"})
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	client := dialGRPC(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	dave, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?token=dave-token", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect dave: %v", err)
+	}
+	defer dave.CloseNow()
+	waitFor(t, "dave to connect", func() bool {
+		server.clientsMtx.Lock()
+		defer server.clientsMtx.Unlock()
+		return server.usernames["dave"] != nil
+	})
+	server.clientsMtx.Lock()
+	server.quarantine(server.usernames["dave"], "test", "testing")
+	server.clientsMtx.Unlock()
+
+	admin := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	sub, err := client.Subscribe(admin, &chatpb.SubscribeRequest{Room: "lobby"})
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	waitFor(t, "the subscription", func() bool {
+		server.clientsMtx.Lock()
+		defer server.clientsMtx.Unlock()
+		return len(server.subscribers) == 1
+	})
+
+	publish := func(ctx context.Context, req *chatpb.PublishRequest) *chatpb.PublishAck {
+		t.Helper()
+		pub, err := client.Publish(ctx)
+		if err != nil {
+			t.Fatalf("Failed to open publish stream: %v", err)
+		}
+		pub.Send(req)
+		ack, err := pub.Recv()
+		if err != nil {
+			t.Fatalf("Failed to read ack: %v", err)
+		}
+		return ack
+	}
+	if ack := publish(admin, &chatpb.PublishRequest{Username: "deploybot", Content: "no spam here"}); ack.Code != codeRejected {
+		t.Errorf("Expected a banned word to be refused, got %v", ack)
+	}
+	// Shadow-banned and quarantined users are answered as if delivered
+	if ack := publish(admin, &chatpb.PublishRequest{Username: "carol", Content: "from carol"}); ack.Error != "" {
+		t.Errorf("Expected a quiet drop for carol, got %v", ack)
+	}
+	if ack := publish(admin, &chatpb.PublishRequest{Username: "dave", Content: "from dave"}); ack.Error != "" {
+		t.Errorf("Expected dave's message to be held quietly, got %v", ack)
+	}
+	server.quarantineMtx.Lock()
+	held := 0
+	for _, entry := range server.quarantined {
+		held += len(entry.held)
+	}
+	server.quarantineMtx.Unlock()
+	if held != 1 {
+		t.Errorf("Expected dave's message to be held, got %d held", held)
+	}
+
+	pub, err := client.Publish(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer bob-token"))
+	if err != nil {
+		t.Fatalf("Failed to open publish stream: %v", err)
+	}
+	for i, want := range []string{"", codeMuted} {
+		pub.Send(&chatpb.PublishRequest{Content: "hello there"})
+		if ack, err := pub.Recv(); err != nil || ack.Code != want {
+			t.Errorf("Expected message %d to get %q, got %v (%v)", i, want, ack, err)
+		}
+	}
+
+	for {
+		msg, err := sub.Recv()
+		if err != nil {
+			t.Fatalf("Failed to receive: %v", err)
+		}
+		if msg.Type != "message" {
+			continue
+		}
+		if msg.Username != "bob" || msg.Content != "hello there" {
+			t.Errorf("Expected only bob's first message, got %v", msg)
+		}
+		break
+	}
+}
+
+func TestGRPC_PublishSlowMode(t *testing.T) {
+	server := NewChatServer(WithAdminToken("secret"), WithAuthenticator(tokenAuth{"bob-token": {Username: "bob"}}))
+	server.lobby.slowMode = time.Minute
+	server.Run(t.Context())
+	client := dialGRPC(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	for _, tt := range []struct {
+		token, username string
+		want            []string
+	}{
+		{"bob-token", "", []string{"", codeSlowMode}},
+		// The admin token may moderate, which exempts it
+		{"secret", "deploybot", []string{"", ""}},
+	} {
+		pub, err := client.Publish(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+tt.token))
+		if err != nil {
+			t.Fatalf("Failed to open publish stream: %v", err)
+		}
+		for i, want := range tt.want {
+			pub.Send(&chatpb.PublishRequest{Username: tt.username, Content: fmt.Sprintf("update %d", i)})
+			if ack, err := pub.Recv(); err != nil || ack.Code != want {
+				t.Errorf("Expected message %d with %s to get %q, got %v (%v)", i, tt.token, want, ack, err)
+			}
+		}
+	}
+}
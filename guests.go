@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"math/big"
+)
+
+const (
+	// guestNameAttempts is how many names the generator may propose before
+	// the server falls back to a long random suffix
+	guestNameAttempts = 8
+	// guestSuffixLength is how many base32 characters follow User-
+	guestSuffixLength = 6
+)
+
+// guestEncoding is Crockford's base32, which leaves out I, L, O and U so
+// names are easy to read out
+var guestEncoding = base32.NewEncoding("0123456789ABCDEFGHJKMNPQRSTVWXYZ").WithPadding(base32.NoPadding)
+
+// UsernameGenerator proposes names for clients that connect without one.
+// The server checks each name and asks again if it is invalid or taken.
+type UsernameGenerator interface {
+	Username() string
+}
+
+// WithUsernameGenerator sets where guest names come from
+func WithUsernameGenerator(g UsernameGenerator) Option {
+	return func(cs *ChatServer) {
+		cs.guestNames = g
+	}
+}
+
+// RandomUsernames names guests User- and a random base32 suffix, such as
+// User-7KQ2XM
+type RandomUsernames struct{}
+
+// Username returns a random guest name
+func (RandomUsernames) Username() string {
+	return "User-" + guestSuffix(guestSuffixLength)
+}
+
+// WordUsernames names guests with an adjective and a noun, such as
+// Quiet-Otter
+type WordUsernames struct{}
+
+var (
+	guestAdjectives = []string{
+		"Amber", "Bold", "Brave", "Bright", "Calm", "Clever", "Cosmic", "Crisp",
+		"Dapper", "Eager", "Fancy", "Gentle", "Golden", "Happy", "Jolly", "Keen",
+		"Lively", "Lucky", "Mellow", "Merry", "Nimble", "Noble", "Plucky", "Quick",
+		"Quiet", "Rapid", "Shiny", "Silver", "Swift", "Sunny", "Witty", "Zesty",
+	}
+	guestNouns = []string{
+		"Badger", "Beaver", "Comet", "Crane", "Falcon", "Ferret", "Finch", "Fox",
+		"Gecko", "Heron", "Koala", "Lark", "Lemur", "Lynx", "Marten", "Meteor",
+		"Moose", "Newt", "Otter", "Owl", "Panda", "Puffin", "Quokka", "Raven",
+		"Robin", "Salmon", "Seal", "Sparrow", "Tiger", "Walrus", "Wombat", "Yak",
+	}
+)
+
+// Username returns a random adjective-noun guest name
+func (WordUsernames) Username() string {
+	return pick(guestAdjectives) + "-" + pick(guestNouns)
+}
+
+// parseUsernameGenerator maps a flag value to a guest name generator
+func parseUsernameGenerator(s string) (UsernameGenerator, error) {
+	switch s {
+	case "random", "":
+		return RandomUsernames{}, nil
+	case "words":
+		return WordUsernames{}, nil
+	default:
+		return nil, fmt.Errorf("unknown guest name style %q (want random or words)", s)
+	}
+}
+
+// guestSuffix returns n random base32 characters
+func guestSuffix(n int) string {
+	b := make([]byte, (n*5+7)/8)
+	rand.Read(b)
+	return guestEncoding.EncodeToString(b)[:n]
+}
+
+// pick returns a random element of words
+func pick(words []string) string {
+	n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+	return words[n.Int64()]
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// fixedUsernames always proposes the same name
+type fixedUsernames string
+
+func (f fixedUsernames) Username() string { return string(f) }
+
+func TestGuestNames(t *testing.T) {
+	server := NewChatServer()
+	for _, gen := range []UsernameGenerator{RandomUsernames{}, WordUsernames{}} {
+		for range 50 {
+			name := gen.Username()
+			if err := server.validateUsername(name); err != nil || name == "" {
+				t.Errorf("Expected %T to propose valid names, got %q: %v", gen, name, err)
+			}
+		}
+	}
+	if name := (RandomUsernames{}).Username(); !strings.HasPrefix(name, "User-") || len(name) != len("User-")+guestSuffixLength {
+		t.Errorf("Expected User- and %d characters, got %q", guestSuffixLength, name)
+	}
+	if _, err := parseUsernameGenerator("emoji"); err == nil {
+		t.Errorf("Expected an unknown style to be refused")
+	}
+}
+
+func TestClaimGeneratedUsername(t *testing.T) {
+	server := NewChatServer(WithUsernameGenerator(fixedUsernames("Guest")))
+	if name := server.claimGeneratedUsername(&Client{}); name != "Guest" {
+		t.Errorf("Expected the generator's name, got %q", name)
+	}
+	// Once it is taken, the generator can't offer anything else
+	seen := map[string]bool{"Guest": true}
+	for range 20 {
+		name := server.claimGeneratedUsername(&Client{})
+		if seen[name] || !strings.HasPrefix(name, "User-") || server.validateUsername(name) != nil {
+			t.Errorf("Expected a fresh fallback name, got %q", name)
+		}
+		seen[name] = true
+	}
+
+	// Invalid proposals are skipped too
+	server = NewChatServer(WithUsernameGenerator(fixedUsernames("not a name")))
+	if name := server.claimGeneratedUsername(&Client{}); !strings.HasPrefix(name, "User-") {
+		t.Errorf("Expected a fallback name, got %q", name)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Hello is the first frame a v3 client gets after connecting. It describes
+// what the server will accept, so clients can adapt instead of hard-coding
+// its behaviour.
+type Hello struct {
+	Type string `json:"type"`
+	// Version is the negotiated protocol version
+	Version int `json:"version"`
+	// Server is the instance serving the connection
+	Server   string          `json:"server"`
+	Identity HelloIdentity   `json:"identity"`
+	Features map[string]bool `json:"features"`
+	Limits   HelloLimits     `json:"limits"`
+}
+
+// HelloIdentity is who the server took the client to be
+type HelloIdentity struct {
+	Username string `json:"username"`
+	// Guest is set for names the server assigned
+	Guest bool `json:"guest,omitempty"`
+	// Room is the room joined, empty for the lobby
+	Room string `json:"room,omitempty"`
+	// Connection is the ID the server logs the connection under
+	Connection string `json:"connection"`
+}
+
+// HelloLimits are the limits the server enforces on every client
+type HelloLimits struct {
+	MaxMessageLength  int   `json:"max_message_length"`
+	MaxUsernameLength int   `json:"max_username_length"`
+	MaxFrameBytes     int64 `json:"max_frame_bytes"`
+	MaxHistoryPage    int   `json:"max_history_page"`
+	// BandwidthBytesPerSecond and BandwidthBurst are left out without a
+	// bandwidth cap
+	BandwidthBytesPerSecond int64 `json:"bandwidth_bytes_per_second,omitempty"`
+	BandwidthBurst          int64 `json:"bandwidth_burst,omitempty"`
+}
+
+// hello describes the server to client
+func (cs *ChatServer) hello(client *Client) Hello {
+	limits := HelloLimits{
+		MaxMessageLength:  cs.messageLimit,
+		MaxUsernameLength: cs.usernamePolicy.maxLength(),
+		MaxFrameBytes:     cs.frames.ReadLimit,
+		MaxHistoryPage:    maxHistoryLimit,
+	}
+	if limit := cs.bandwidthCap.Load(); limit != nil {
+		limits.BandwidthBytesPerSecond, limits.BandwidthBurst = limit.BytesPerSecond, limit.Burst
+	}
+	return Hello{
+		Type:    "hello",
+		Version: client.version,
+		Server:  cs.instanceID,
+		Identity: HelloIdentity{
+			Username:   client.username,
+			Guest:      client.guest,
+			Room:       client.roomName(),
+			Connection: client.id,
+		},
+		Features: cs.capabilities().Features,
+		Limits:   limits,
+	}
+}
+
+// sendHello greets a v3 client. Older clients expect the join notice
+// first.
+func (cs *ChatServer) sendHello(ctx context.Context, client *Client) {
+	if client.version < protocolV3 || client.canary {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	if err := client.write(ctx, cs.hello(client)); err != nil {
+		client.logf("Error sending hello to %s: %v", client.username, err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestHello(t *testing.T) {
+	server := NewChatServer(WithInstanceID("a"), WithBandwidthCap(BandwidthCap{BytesPerSecond: 1000}), WithFeatures(map[string]bool{featurePolls: false}))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	c, _, err := websocket.Dial(ctx, wsURL+"?username=alice", &websocket.DialOptions{Subprotocols: []string{subprotocolV3, subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.CloseNow()
+	if c.Subprotocol() != subprotocolV3 {
+		t.Fatalf("Expected %q, got %q", subprotocolV3, c.Subprotocol())
+	}
+	var hello Hello
+	if err := wsjson.Read(ctx, c, &hello); err != nil {
+		t.Fatalf("Failed to read hello: %v", err)
+	}
+	if hello.Type != "hello" || hello.Version != protocolV3 || hello.Server != "a" {
+		t.Errorf("Expected a v3 hello from a first, got %+v", hello)
+	}
+	if hello.Identity.Username != "alice" || hello.Identity.Guest || hello.Identity.Connection == "" {
+		t.Errorf("Expected alice's identity, got %+v", hello.Identity)
+	}
+	if hello.Features[featurePolls] || !hello.Features[featureE2EE] {
+		t.Errorf("Expected polls off and e2ee on, got %v", hello.Features)
+	}
+	want := HelloLimits{
+		MaxMessageLength:        maxMessageLength,
+		MaxUsernameLength:       maxUsernameLength,
+		MaxFrameBytes:           defaultFrameLimit,
+		MaxHistoryPage:          maxHistoryLimit,
+		BandwidthBytesPerSecond: 1000,
+		BandwidthBurst:          5000,
+	}
+	if hello.Limits != want {
+		t.Errorf("Expected limits %+v, got %+v", want, hello.Limits)
+	}
+	if msg := readUntilType(t, ctx, c, "system"); !strings.Contains(msg.Content, "alice has joined") {
+		t.Errorf("Expected the join notice after hello, got %+v", msg)
+	}
+
+	// Guests learn the name they were given
+	guest, _, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{Subprotocols: []string{subprotocolV3}})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer guest.CloseNow()
+	if err := wsjson.Read(ctx, guest, &hello); err != nil {
+		t.Fatalf("Failed to read hello: %v", err)
+	}
+	if !hello.Identity.Guest || hello.Identity.Username == "" {
+		t.Errorf("Expected a guest identity, got %+v", hello.Identity)
+	}
+
+	// v2 clients start with the join notice as before
+	v2, _, err := websocket.Dial(ctx, wsURL+"?username=bob", &websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer v2.CloseNow()
+	var msg Message
+	if err := wsjson.Read(ctx, v2, &msg); err != nil || msg.Type != "system" {
+		t.Errorf("Expected v2 clients to get the join notice first, got %+v (%v)", msg, err)
+	}
+
+	textOnly := NewChatServer(WithFramePolicy(FramePolicy{TextOnly: true}))
+	if slices.Contains(textOnly.subprotocols(), subprotocolV3Msgpack) || !slices.Contains(textOnly.subprotocols(), subprotocolV3) {
+		t.Errorf("Expected text-only servers to offer v3 without msgpack, got %v", textOnly.subprotocols())
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	defaultHistorySize  = 1000
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// History keeps the most recent broadcast messages in a ring buffer and
+// assigns each one a sequence number. Sequence numbers are contiguous, so a
+// message's position in the buffer follows from its number.
+type History struct {
+	mu sync.Mutex
+	// buf is a ring of up to size messages, grown as they arrive so a
+	// quiet history doesn't hold room for a full one
+	buf     []Message
+	size    int
+	lastSeq uint64
+	n       int
+
+	// signer, when set, signs appended messages, chaining each to the
+	// previous one through lastHash
+	signer   ed25519.PrivateKey
+	lastHash string
+}
+
+// HistoryPage is one page of history, oldest message first
+type HistoryPage struct {
+	Type     string    `json:"type,omitempty"`
+	Messages []Message `json:"messages"`
+	HasMore  bool      `json:"has_more"`
+}
+
+// NewHistory creates a history holding up to size messages
+func NewHistory(size int) *History {
+	if size < 1 {
+		size = defaultHistorySize
+	}
+	return &History{size: size}
+}
+
+// slot returns where the message with sequence number seq is kept.
+// Callers hold h.mu.
+func (h *History) slot(seq uint64) *Message {
+	return &h.buf[int((seq-1)%uint64(h.size))]
+}
+
+// WithHistorySize sets how many messages are kept for history requests
+func WithHistorySize(size int) Option {
+	return func(cs *ChatServer) {
+		cs.history = NewHistory(size)
+	}
+}
+
+// Append assigns msg the next sequence number and stores it
+func (h *History) Append(msg Message) Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastSeq++
+	msg.Seq = h.lastSeq
+	if h.signer != nil {
+		msg = h.signLocked(msg)
+	}
+	if i := int((h.lastSeq - 1) % uint64(h.size)); i < len(h.buf) {
+		h.buf[i] = msg
+	} else {
+		if len(h.buf) == cap(h.buf) {
+			grown := make([]Message, len(h.buf), min(h.size, max(len(h.buf)*2, 16)))
+			copy(grown, h.buf)
+			h.buf = grown
+		}
+		h.buf = append(h.buf, msg)
+	}
+	if h.n < h.size {
+		h.n++
+	}
+	return msg
+}
+
+// Before returns up to limit messages with sequence numbers below beforeSeq.
+// A zero beforeSeq returns the most recent messages.
+func (h *History) Before(beforeSeq uint64, limit int) HistoryPage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	page := HistoryPage{Messages: []Message{}}
+	if h.n == 0 || limit < 1 {
+		return page
+	}
+
+	oldest := h.lastSeq - uint64(h.n) + 1
+	end := h.lastSeq
+	if beforeSeq != 0 {
+		if beforeSeq <= oldest {
+			return page
+		}
+		end = min(end, beforeSeq-1)
+	}
+	start := oldest
+	if end-oldest+1 > uint64(limit) {
+		start = end - uint64(limit) + 1
+	}
+
+	for seq := start; seq <= end; seq++ {
+		page.Messages = append(page.Messages, *h.slot(seq))
+	}
+	page.HasMore = start > oldest
+	return page
+}
+
+// After returns up to limit messages with sequence numbers above afterSeq,
+// oldest first
+func (h *History) After(afterSeq uint64, limit int) []Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.n == 0 || limit < 1 {
+		return nil
+	}
+	start := max(afterSeq+1, h.lastSeq-uint64(h.n)+1)
+	var out []Message
+	for seq := start; seq <= h.lastSeq && len(out) < limit; seq++ {
+		out = append(out, *h.slot(seq))
+	}
+	return out
+}
+
+// clampHistoryLimit applies the default and maximum page size
+func clampHistoryLimit(limit int) int {
+	if limit <= 0 {
+		return defaultHistoryLimit
+	}
+	return min(limit, maxHistoryLimit)
+}
+
+// handleHistory serves GET /api/history?before_seq=N&limit=M, reading the
+// lobby unless room (and its password) is given
+func (cs *ChatServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var beforeSeq uint64
+	if v := r.URL.Query().Get("before_seq"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid before_seq", http.StatusBadRequest)
+			return
+		}
+		beforeSeq = n
+	}
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	history, err := cs.roomHistory(r.URL.Query().Get("room"), r.URL.Query().Get("password"))
+	if err != nil {
+		http.Error(w, err.Error(), roomStatus(err))
+		return
+	}
+	page := history.Before(beforeSeq, clampHistoryLimit(limit))
+	w.Header().Set("Content-Type", "application/json")
+	if !cs.clientStorage {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// seqs extracts the sequence numbers of a page's messages
+func seqs(page HistoryPage) []uint64 {
+	out := make([]uint64, len(page.Messages))
+	for i, m := range page.Messages {
+		out[i] = m.Seq
+	}
+	return out
+}
+
+func TestHistory_Before(t *testing.T) {
+	h := NewHistory(5)
+	for i := 1; i <= 8; i++ {
+		h.Append(Message{Content: fmt.Sprintf("msg %d", i)})
+	}
+
+	// Only messages 4-8 are retained
+	tests := []struct {
+		beforeSeq uint64
+		limit     int
+		want      []uint64
+		hasMore   bool
+	}{
+		{0, 2, []uint64{7, 8}, true},
+		{0, 10, []uint64{4, 5, 6, 7, 8}, false},
+		{7, 2, []uint64{5, 6}, true},
+		{6, 5, []uint64{4, 5}, false},
+		{4, 5, []uint64{}, false},
+		{100, 1, []uint64{8}, true},
+	}
+
+	for _, tt := range tests {
+		page := h.Before(tt.beforeSeq, tt.limit)
+		got := seqs(page)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) || page.HasMore != tt.hasMore {
+			t.Errorf("Before(%d, %d) = %v has_more=%v, want %v has_more=%v",
+				tt.beforeSeq, tt.limit, got, page.HasMore, tt.want, tt.hasMore)
+		}
+	}
+
+	if page := h.Before(0, 1); page.Messages[0].Content != "msg 8" {
+		t.Errorf("Unexpected content for latest message: %+v", page.Messages[0])
+	}
+}
+
+func TestChatServer_HistoryOverWebSocket(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username=alice", &websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	var msg Message
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read welcome message: %v", err)
+	}
+	if msg.Seq != 1 {
+		t.Errorf("Expected welcome message to have seq 1, got %d", msg.Seq)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := wsjson.Write(ctx, c, Message{Type: "message", Content: fmt.Sprintf("msg %d", i)}); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+		if err := wsjson.Read(ctx, c, &msg); err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+	}
+
+	if err := wsjson.Write(ctx, c, Message{Type: "history", BeforeSeq: 4, Limit: 2}); err != nil {
+		t.Fatalf("Failed to send history request: %v", err)
+	}
+	var page HistoryPage
+	if err := wsjson.Read(ctx, c, &page); err != nil {
+		t.Fatalf("Failed to read history: %v", err)
+	}
+	if page.Type != "history" || fmt.Sprint(seqs(page)) != "[2 3]" || !page.HasMore {
+		t.Errorf("Unexpected history page: %+v", page)
+	}
+	if page.Messages[0].Content != "msg 0" || page.Messages[0].Username != "alice" {
+		t.Errorf("Unexpected history message: %+v", page.Messages[0])
+	}
+}
+
+func TestChatServer_HistoryREST(t *testing.T) {
+	server := NewChatServer()
+	for i := 0; i < 3; i++ {
+		server.deliver(Message{Type: "message", Content: fmt.Sprintf("msg %d", i)})
+	}
+
+	tests := []struct {
+		query  string
+		status int
+		want   string
+	}{
+		{"", http.StatusOK, "[1 2 3]"},
+		{"?limit=1", http.StatusOK, "[3]"},
+		{"?before_seq=3&limit=5", http.StatusOK, "[1 2]"},
+		{"?before_seq=abc", http.StatusBadRequest, ""},
+		{"?limit=-1", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		server.handleHistory(rec, httptest.NewRequest(http.MethodGet, "/api/history"+tt.query, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%q: expected status %d, got %d", tt.query, tt.status, rec.Code)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var page HistoryPage
+		if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+			t.Fatalf("%q: failed to decode: %v", tt.query, err)
+		}
+		if got := fmt.Sprint(seqs(page)); got != tt.want {
+			t.Errorf("%q: got seqs %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+)
+
+// connectionHeader carries the connection ID in the upgrade response so
+// users can quote it in bug reports
+const connectionHeader = "X-Chat-Connection"
+
+// newMessageID returns a random 128-bit identifier
+func newMessageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// newConnectionID returns a short random identifier for a connection
+func newConnectionID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// newTraceID returns an identifier for one inbound message, shown in logs
+// and sent to clients so bug reports can be matched to server logs
+func newTraceID() string {
+	return newConnectionID()
+}
+
+// logf logs a line tagged with the client's connection ID
+func (c *Client) logf(format string, args ...any) {
+	log.Printf("[conn %s] "+format, append([]any{c.id}, args...)...)
+}
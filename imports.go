@@ -0,0 +1,370 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxImportBody bounds an uploaded archive
+const maxImportBody = 256 << 20
+
+// importSink stores imported messages, counting what it skips
+type importSink struct {
+	history  *History
+	room     string
+	limit    int
+	sanitize ContentSanitizer
+	imported int
+	skipped  int
+}
+
+// add stores a message from an archive in history without delivering it.
+// Usernames are made valid and overlong content is truncated.
+func (s *importSink) add(msg Message) {
+	msg.Room = s.room
+	if msg.Type == "" {
+		msg.Type = "message"
+	}
+	if msg.ID == "" {
+		msg.ID = newMessageID()
+	}
+	if msg.Type == "message" {
+		msg.Username = sanitizeUsername(msg.Username)
+	}
+	if msg.Timestamp == 0 {
+		if t, err := time.Parse(time.RFC3339, msg.Time); err == nil {
+			msg.Timestamp = t.UnixMilli()
+		}
+	} else if msg.Time == "" {
+		msg.Time = time.UnixMilli(msg.Timestamp).UTC().Format(time.RFC3339)
+	}
+	msg.Content = strings.TrimSpace(msg.Content)
+	msg.Content = truncateMessage(strings.ToValidUTF8(msg.Content, ""), s.limit)
+	if msg.Username == "" || msg.Timestamp == 0 || msg.validate(s.limit) != nil {
+		s.skipped++
+		return
+	}
+	if msg.Type == "message" && msg.Ciphertext == "" {
+		msg.Content = s.sanitize.apply(msg.Content)
+	}
+	// Only what was stored as a plain message or notice comes in again
+	msg.Seq, msg.Origin, msg.Trace = 0, "", ""
+	msg.BodyHash, msg.PrevHash, msg.Hash, msg.Sig, msg.RedactionSig = "", "", "", "", ""
+	s.history.Append(msg)
+	s.imported++
+}
+
+// importJSONL reads an export from /admin/export?format=jsonl
+func importJSONL(r io.Reader, sink *importSink) error {
+	dec := json.NewDecoder(r)
+	for {
+		var msg Message
+		err := dec.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid JSON Lines: %w", err)
+		}
+		if msg.Type != "message" && msg.Type != "system" {
+			sink.skipped++
+			continue
+		}
+		sink.add(msg)
+	}
+}
+
+// slackMessage is a message in a Slack export
+type slackMessage struct {
+	Type        string `json:"type"`
+	Subtype     string `json:"subtype"`
+	User        string `json:"user"`
+	Username    string `json:"username"`
+	Text        string `json:"text"`
+	TS          string `json:"ts"`
+	UserProfile struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"display_name"`
+	} `json:"user_profile"`
+}
+
+// slackMention matches user mentions such as <@U024BE7LH> or <@U024BE7LH|bob>
+var slackMention = regexp.MustCompile(`<@([A-Z0-9]+)(?:\|[^>]*)?>`)
+
+// importSlack reads a Slack export: either the zip of a whole workspace,
+// of which channel is imported, or one day's JSON file of a channel
+func importSlack(r io.Reader, channel string, sink *importSink) error {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(4); !bytes.Equal(magic, []byte("PK\x03\x04")) {
+		return importSlackDay(br, nil, sink)
+	}
+	if channel == "" {
+		return errors.New("channel is required to import a Slack workspace export")
+	}
+
+	// Zip archives are read from the end, so spool the upload to disk
+	tmp, err := os.CreateTemp("", "slack-import-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, br)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return fmt.Errorf("invalid zip archive: %w", err)
+	}
+
+	users := make(map[string]string)
+	var days []*zip.File
+	for _, f := range zr.File {
+		switch {
+		case f.Name == "users.json":
+			var list []struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			}
+			if err := decodeZipJSON(f, &list); err != nil {
+				return err
+			}
+			for _, u := range list {
+				users[u.ID] = u.Name
+			}
+		case path.Dir(f.Name) == channel && path.Ext(f.Name) == ".json":
+			days = append(days, f)
+		}
+	}
+	if len(days) == 0 {
+		return fmt.Errorf("no channel %q in the export", channel)
+	}
+	// Day files are named YYYY-MM-DD.json
+	sort.Slice(days, func(i, j int) bool { return days[i].Name < days[j].Name })
+	for _, f := range days {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = importSlackDay(rc, users, sink)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// decodeZipJSON decodes a JSON file from a zip archive into v
+func decodeZipJSON(f *zip.File, v any) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := json.NewDecoder(rc).Decode(v); err != nil {
+		return fmt.Errorf("%s: %w", f.Name, err)
+	}
+	return nil
+}
+
+// importSlackDay streams the messages of one day's JSON array, resolving
+// user IDs through users when known
+func importSlackDay(r io.Reader, users map[string]string, sink *importSink) error {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return errors.New("expected a JSON array of Slack messages")
+	}
+	for dec.More() {
+		var sm slackMessage
+		if err := dec.Decode(&sm); err != nil {
+			return fmt.Errorf("invalid Slack message: %w", err)
+		}
+		switch sm.Subtype {
+		case "", "bot_message", "me_message", "thread_broadcast", "file_share":
+		default:
+			// Joins, topic changes and the like
+			sink.skipped++
+			continue
+		}
+		secs, err := strconv.ParseFloat(sm.TS, 64)
+		if sm.Type != "message" || err != nil {
+			sink.skipped++
+			continue
+		}
+
+		name := sm.UserProfile.Name
+		if name == "" {
+			name = users[sm.User]
+		}
+		if name == "" {
+			name = sm.Username
+		}
+		if name == "" {
+			name = sm.User
+		}
+		text := slackMention.ReplaceAllStringFunc(sm.Text, func(m string) string {
+			id := slackMention.FindStringSubmatch(m)[1]
+			if n, ok := users[id]; ok {
+				return "@" + n
+			}
+			return m
+		})
+		text = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(text)
+		if sm.Subtype == "me_message" {
+			text = "* " + text
+		}
+		sink.add(Message{Username: name, Content: text, Timestamp: int64(secs * 1000)})
+	}
+	return nil
+}
+
+var (
+	// ircDayChanged matches irssi's "--- Day changed Mon Jan 02 2006" and
+	// "--- Log opened Mon Jan 02 15:04:05 2006"
+	ircDayChanged = regexp.MustCompile(`^--- (?:Day changed|Log opened) \w{3} (\w{3} \d{2})(?: [\d:]+)? (\d{4})`)
+	// ircLine matches a message or action stamped with a time of day and
+	// maybe a date, as in irssi's "15:04 <nick> text" and ZNC's
+	// "[15:04:05] <nick> text"
+	ircLine = regexp.MustCompile(`^\[?(\d{4}-\d{2}-\d{2}[ T])?(\d{2}:\d{2}(?::\d{2})?)\]?\s+(?:<[ @+%&~]?([^>\s]+)>|\*\s+([^\s]+))\s?(.*)$`)
+	// ircTab matches weechat's tab separated "2006-01-02 15:04:05\tnick\ttext"
+	ircTab = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2})\t[@+%&~]?([^\t\s]+)\t(.*)$`)
+)
+
+// importIRC reads an irssi, ZNC or weechat log. Lines without a date are
+// dated by the log's "Day changed" lines, else by date.
+func importIRC(r io.Reader, date time.Time, sink *importSink) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if m := ircDayChanged.FindStringSubmatch(line); m != nil {
+			if d, err := time.Parse("Jan 02 2006", m[1]+" "+m[2]); err == nil {
+				date = d
+			}
+			continue
+		}
+		if m := ircTab.FindStringSubmatch(line); m != nil {
+			t, _ := time.Parse(time.DateTime, m[1])
+			switch m[2] {
+			case "-->", "<--", "--":
+				// Joins, parts and network notices
+				sink.skipped++
+			case "*":
+				nick, _, _ := strings.Cut(m[3], " ")
+				sink.add(Message{Username: nick, Content: "* " + m[3], Timestamp: t.UnixMilli()})
+			default:
+				sink.add(Message{Username: m[2], Content: m[3], Timestamp: t.UnixMilli()})
+			}
+			continue
+		}
+		m := ircLine.FindStringSubmatch(line)
+		if m == nil {
+			if strings.TrimSpace(line) != "" {
+				sink.skipped++
+			}
+			continue
+		}
+		day := date
+		if m[1] != "" {
+			if d, err := time.Parse(time.DateOnly, strings.TrimSpace(m[1])); err == nil {
+				day = d
+			}
+		}
+		clock := m[2]
+		if len(clock) == len("15:04") {
+			clock += ":00"
+		}
+		tod, err := time.Parse(time.TimeOnly, clock)
+		if err != nil || day.IsZero() {
+			sink.skipped++
+			continue
+		}
+		ts := day.Add(time.Duration(tod.Hour())*time.Hour + time.Duration(tod.Minute())*time.Minute + time.Duration(tod.Second())*time.Second)
+		if m[3] != "" {
+			sink.add(Message{Username: m[3], Content: m[5], Timestamp: ts.UnixMilli()})
+		} else {
+			sink.add(Message{Username: m[4], Content: "* " + m[4] + " " + m[5], Timestamp: ts.UnixMilli()})
+		}
+	}
+	return scanner.Err()
+}
+
+// ImportResult is the body of a POST /admin/import response
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// handleAdminImport serves POST /admin/import?room=R&format=F, appending
+// the messages of an uploaded archive to a room's history. Formats are
+// jsonl (our own export), slack (a workspace zip, with channel=C, or one
+// day's JSON) and irc (irssi, ZNC or weechat logs, with date=YYYY-MM-DD for
+// logs that don't carry dates).
+func (cs *ChatServer) handleAdminImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	name := query.Get("room")
+	if name == lobbyRoom {
+		name = ""
+	}
+	sink := &importSink{history: cs.history, room: name, limit: cs.messageLimit, sanitize: cs.sanitizer}
+	if name != "" {
+		room := cs.lookupRoom(name)
+		if room == nil {
+			http.Error(w, errRoomNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		sink.history = room.history
+	}
+	var date time.Time
+	if v := query.Get("date"); v != "" {
+		d, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			http.Error(w, "invalid date (want YYYY-MM-DD)", http.StatusBadRequest)
+			return
+		}
+		date = d
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportBody)
+	var err error
+	switch query.Get("format") {
+	case "jsonl":
+		err = importJSONL(body, sink)
+	case "slack":
+		err = importSlack(body, query.Get("channel"), sink)
+	case "irc":
+		err = importIRC(body, date, sink)
+	default:
+		http.Error(w, "unknown format (want jsonl, slack or irc)", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		// What was read before the error stays imported
+		log.Printf("Import into %s stopped after %d messages: %v", roomOrLobby(name), sink.imported, err)
+		http.Error(w, fmt.Sprintf("%v (imported %d messages before the error)", err, sink.imported), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Imported %d messages into %s, skipped %d", sink.imported, roomOrLobby(name), sink.skipped)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ImportResult{Imported: sink.imported, Skipped: sink.skipped})
+}
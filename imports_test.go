@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// importTest posts body to /admin/import and returns the result
+func importTest(t *testing.T, server *ChatServer, query string, body io.Reader) (int, ImportResult) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/admin/import?"+query, body)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	server.requireAdmin(server.handleAdminImport)(rec, req)
+	var result ImportResult
+	json.NewDecoder(rec.Body).Decode(&result)
+	return rec.Code, result
+}
+
+// storedLines renders the history of h as "username: content" lines
+func storedLines(h *History) []string {
+	var lines []string
+	for _, msg := range h.Before(0, maxHistoryLimit).Messages {
+		lines = append(lines, msg.Username+": "+msg.Content)
+	}
+	return lines
+}
+
+func TestAdminImport_IRC(t *testing.T) {
+	server := NewChatServer(WithAdminToken("secret"))
+	log := `--- Log opened Mon Jan 01 09:00:00 2024
+09:00 -!- alice [~alice@host] has joined #ops
+09:01 <@alice> deploy at 10?
+09:02  * bob nods
+--- Day changed Tue Jan 02 2024
+[10:00:05] <carol> done
+2024-01-03 11:00:00	dave.w	weechat too
+2024-01-03 11:00:01	-->	erin joined
+`
+	code, result := importTest(t, server, "format=irc", strings.NewReader(log))
+	if code != http.StatusOK || result.Imported != 4 || result.Skipped != 2 {
+		t.Fatalf("Expected 4 imported and 2 skipped, got %d %+v", code, result)
+	}
+	want := []string{"alice: deploy at 10?", "bob: * bob nods", "carol: done", "dave-w: weechat too"}
+	got := storedLines(server.history)
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if msg := server.history.Before(0, 3).Messages[1]; msg.Time != "2024-01-02T10:00:05Z" {
+		t.Errorf("Expected carol's line dated by the day change, got %s", msg.Time)
+	}
+}
+
+func TestAdminImport_Slack(t *testing.T) {
+	server := NewChatServer(WithAdminToken("secret"))
+	server.createRoom(RoomOptions{Name: "general"})
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"users.json":              `[{"id": "U1", "name": "alice"}, {"id": "U2", "name": "bob"}]`,
+		"general/2024-01-02.json": `[{"type": "message", "user": "U2", "text": "second day", "ts": "1704189600.000100"}]`,
+		"general/2024-01-01.json": `[
+			{"type": "message", "subtype": "channel_join", "user": "U2", "text": "<@U2> has joined", "ts": "1704103200.000100"},
+			{"type": "message", "user": "U1", "text": "hi <@U2> &amp; welcome", "ts": "1704103260.000200"}
+		]`,
+		"random/2024-01-01.json": `[{"type": "message", "user": "U1", "text": "elsewhere", "ts": "1704103200.000100"}]`,
+	} {
+		w, _ := zw.Create(name)
+		io.WriteString(w, content)
+	}
+	zw.Close()
+
+	if code, _ := importTest(t, server, "format=slack&room=general", bytes.NewReader(buf.Bytes())); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a channel, got %d", code)
+	}
+	code, result := importTest(t, server, "format=slack&room=general&channel=general", bytes.NewReader(buf.Bytes()))
+	if code != http.StatusOK || result.Imported != 2 || result.Skipped != 1 {
+		t.Fatalf("Expected 2 imported and 1 skipped, got %d %+v", code, result)
+	}
+	want := []string{"alice: hi @bob & welcome", "bob: second day"}
+	if got := storedLines(server.lookupRoom("general").history); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestAdminImport_JSONL(t *testing.T) {
+	source := NewChatServer(WithAdminToken("secret"))
+	source.history.Append(Message{Type: "message", Username: "alice", Content: "round trip", Time: "2024-01-01T09:00:00Z", Timestamp: 1704099600000, ID: "m1"})
+	source.history.Append(Message{Type: "system", Username: "Server", Content: "alice has left the chat", Time: "2024-01-01T09:01:00Z", Timestamp: 1704099660000, ID: "m2"})
+	var export bytes.Buffer
+	exportHistory(source.history, lobbyRoom, time.Time{}, time.Time{}, &jsonlTranscript{enc: json.NewEncoder(&export)}, func() {})
+
+	server := NewChatServer(WithAdminToken("secret"))
+	code, result := importTest(t, server, "format=jsonl", &export)
+	if code != http.StatusOK || result.Imported != 2 {
+		t.Fatalf("Expected 2 imported, got %d %+v", code, result)
+	}
+	if got := server.history.Before(0, 10).Messages[0]; got.ID != "m1" || got.Content != "round trip" || got.Timestamp != 1704099600000 {
+		t.Errorf("Expected the message to keep its ID and time, got %+v", got)
+	}
+
+	if code, _ := importTest(t, server, "format=mbox", strings.NewReader("")); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown format, got %d", code)
+	}
+	if code, _ := importTest(t, server, "format=jsonl&room=nowhere", strings.NewReader("")); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown room, got %d", code)
+	}
+}
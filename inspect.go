@@ -0,0 +1,209 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// Server events passed to Watch handlers
+const (
+	// EventJoin is sent once a client is registered, before it is greeted
+	EventJoin = "join"
+	// EventLeave is sent once a client is unregistered
+	EventLeave = "leave"
+	// EventMessage is sent for every message delivered to local clients
+	EventMessage = "message"
+)
+
+// ClientInfo describes a client connected to this instance
+type ClientInfo struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	// Room is the room the client is in, empty for the lobby
+	Room string `json:"room,omitempty"`
+	// Status is the client's own status, invisible included
+	Status        string `json:"status"`
+	Version       int    `json:"version"`
+	Guest         bool   `json:"guest,omitempty"`
+	Authenticated bool   `json:"authenticated,omitempty"`
+	RemoteAddr    string `json:"remote_addr"`
+}
+
+// ServerEvent is something that happened on the server, as passed to Watch
+// handlers
+type ServerEvent struct {
+	Type string
+	// Client is who joined or left
+	Client ClientInfo
+	// Message is the message delivered
+	Message Message
+}
+
+// infoLocked describes the client. Callers hold ChatServer.clientsMtx.
+func (c *Client) infoLocked() ClientInfo {
+	status := c.status
+	if status == "" {
+		status = statusOnline
+	}
+	return ClientInfo{
+		ID:            c.id,
+		Username:      c.username,
+		Room:          c.roomName(),
+		Status:        status,
+		Version:       c.version,
+		Guest:         c.guest,
+		Authenticated: c.authenticated,
+		RemoteAddr:    c.remoteAddr,
+	}
+}
+
+// ClientCount returns how many clients are connected to this instance,
+// leaving out the readiness canary
+func (cs *ChatServer) ClientCount() int {
+	cs.clientsMtx.Lock()
+	defer cs.clientsMtx.Unlock()
+	n := 0
+	for client := range cs.clients {
+		if !client.canary {
+			n++
+		}
+	}
+	return n
+}
+
+// Clients describes the clients connected to this instance, ordered by
+// username
+func (cs *ChatServer) Clients() []ClientInfo {
+	cs.clientsMtx.Lock()
+	clients := make([]ClientInfo, 0, len(cs.clients))
+	for client := range cs.clients {
+		if !client.canary {
+			clients = append(clients, client.infoLocked())
+		}
+	}
+	cs.clientsMtx.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Username < clients[j].Username })
+	return clients
+}
+
+// Client describes the client connected to this instance under username
+func (cs *ChatServer) Client(username string) (ClientInfo, bool) {
+	cs.clientsMtx.Lock()
+	defer cs.clientsMtx.Unlock()
+	client, ok := cs.usernames[username]
+	if !ok || client.canary {
+		return ClientInfo{}, false
+	}
+	return client.infoLocked(), true
+}
+
+// RoomInfo describes the named room, private or not, with the members
+// connected to this instance. "" and lobbyRoom describe the lobby.
+func (cs *ChatServer) RoomInfo(name string) (RoomInfo, bool) {
+	if name == "" || name == lobbyRoom {
+		lobby := RoomInfo{Name: lobbyRoom}
+		cs.clientsMtx.Lock()
+		for client := range cs.clients {
+			if client.room == nil && !client.canary {
+				lobby.Members++
+			}
+		}
+		cs.clientsMtx.Unlock()
+		return lobby, true
+	}
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	room, ok := cs.rooms[name]
+	if !ok {
+		return RoomInfo{}, false
+	}
+	return room.info(), true
+}
+
+// observer passes server events to one Watch handler, in order and
+// without holding up the hub
+type observer struct {
+	handler func(ServerEvent)
+
+	mu     sync.Mutex
+	queue  []ServerEvent
+	wake   chan struct{}
+	done   chan struct{}
+	exited chan struct{}
+}
+
+// observers are the handlers registered with Watch
+type observers struct {
+	mu  sync.Mutex
+	set map[*observer]bool
+}
+
+// Watch calls handler with every server event from now on, one at a time
+// and in the order they happened, on a goroutine of its own. The returned
+// function stops the handler, waiting for any call in progress; it must
+// not be called from the handler itself.
+func (cs *ChatServer) Watch(handler func(ServerEvent)) (stop func()) {
+	o := &observer{
+		handler: handler,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+	cs.observers.mu.Lock()
+	if cs.observers.set == nil {
+		cs.observers.set = make(map[*observer]bool)
+	}
+	cs.observers.set[o] = true
+	cs.observers.mu.Unlock()
+	go o.run()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cs.observers.mu.Lock()
+			delete(cs.observers.set, o)
+			cs.observers.mu.Unlock()
+			close(o.done)
+			<-o.exited
+		})
+	}
+}
+
+// notify queues ev for every Watch handler
+func (cs *ChatServer) notify(ev ServerEvent) {
+	cs.observers.mu.Lock()
+	defer cs.observers.mu.Unlock()
+	for o := range cs.observers.set {
+		o.mu.Lock()
+		o.queue = append(o.queue, ev)
+		o.mu.Unlock()
+		select {
+		case o.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run calls the handler with queued events until the observer is stopped
+func (o *observer) run() {
+	defer close(o.exited)
+	for {
+		select {
+		case <-o.wake:
+		case <-o.done:
+			return
+		}
+		o.mu.Lock()
+		queue := o.queue
+		o.queue = nil
+		o.mu.Unlock()
+		for _, ev := range queue {
+			select {
+			case <-o.done:
+				return
+			default:
+			}
+			o.handler(ev)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestInspect(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	if _, _, err := server.createRoom(RoomOptions{Name: "ops", Private: true}); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	var mu sync.Mutex
+	var events []ServerEvent
+	stop := server.Watch(func(ev ServerEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, ev)
+	})
+	defer stop()
+
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	dialStatusTest(t, ctx, s, "bob")
+	alice, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username=alice&room=ops", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer alice.CloseNow()
+	readUntilType(t, ctx, alice, "system")
+
+	if n := server.ClientCount(); n != 2 {
+		t.Errorf("Expected 2 clients, got %d", n)
+	}
+	clients := server.Clients()
+	if len(clients) != 2 || clients[0].Username != "alice" || clients[0].Room != "ops" || clients[1].Username != "bob" || clients[1].Version != protocolV2 {
+		t.Errorf("Expected alice in ops and bob in the lobby, got %+v", clients)
+	}
+	if info, ok := server.Client("bob"); !ok || info.Status != statusOnline || info.ID == "" {
+		t.Errorf("Expected bob online, got %+v", info)
+	}
+	if _, ok := server.Client("carol"); ok {
+		t.Errorf("Expected no client for carol")
+	}
+	if room, ok := server.RoomInfo("ops"); !ok || room.Members != 1 || !room.Private {
+		t.Errorf("Expected private ops with one member, got %+v", room)
+	}
+	if lobby, ok := server.RoomInfo(""); !ok || lobby.Name != lobbyRoom || lobby.Members != 1 {
+		t.Errorf("Expected the lobby with one member, got %+v", lobby)
+	}
+	if _, ok := server.RoomInfo("nowhere"); ok {
+		t.Errorf("Expected no unknown room")
+	}
+
+	if err := wsjson.Write(ctx, alice, Message{Type: "message", Content: "hi"}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	readUntilType(t, ctx, alice, "message")
+	alice.Close(websocket.StatusNormalClosure, "")
+
+	// Events arrive in order: both joins and their notices, the message,
+	// then alice leaving
+	waitFor(t, "alice to leave", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, ev := range events {
+			if ev.Type == EventLeave {
+				return true
+			}
+		}
+		return false
+	})
+	mu.Lock()
+	var got []string
+	for _, ev := range events {
+		switch ev.Type {
+		case EventJoin, EventLeave:
+			got = append(got, ev.Type+" "+ev.Client.Username)
+		case EventMessage:
+			if ev.Message.Type == "message" {
+				got = append(got, "message "+ev.Message.Content)
+			}
+		}
+	}
+	mu.Unlock()
+	want := "join bob,join alice,message hi,leave alice"
+	if strings.Join(got, ",") != want {
+		t.Errorf("Expected events %s, got %s", want, strings.Join(got, ","))
+	}
+
+	// Nothing is passed on once the handler is stopped
+	stop()
+	mu.Lock()
+	n := len(events)
+	mu.Unlock()
+	server.publish(Message{Type: "message", Username: "bob", Content: "late"})
+	time.Sleep(time.Millisecond * 100)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != n {
+		t.Errorf("Expected no events after stop, got %+v", events[n:])
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// Integration kinds
+const (
+	// IntegrationWebhook receives every chat message in the room
+	IntegrationWebhook = "webhook"
+	// IntegrationBot, IntegrationBridge and IntegrationFeed register a bot
+	// account, a bridge to another network and a watched feed for the
+	// services that run them
+	IntegrationBot    = "bot"
+	IntegrationBridge = "bridge"
+	IntegrationFeed   = "feed"
+)
+
+const (
+	// maxIntegrations caps the integrations of one room
+	maxIntegrations = 50
+	// maxIntegrationConfig caps the settings of one integration
+	maxIntegrationConfig = 20
+	// roleModerator may manage the integrations of every room, and
+	// "moderator:<room>" those of one room
+	roleModerator = "moderator"
+	// webhookSigHeader carries the hex HMAC-SHA256 of a webhook delivery
+	webhookSigHeader = "X-Chat-Signature"
+	webhookTimeout   = time.Second * 5
+)
+
+// errWebhookAddress refuses to deliver a room webhook to a non-public
+// address
+var errWebhookAddress = errors.New("address not allowed for room webhooks")
+
+// Integration connects a room to an outside service
+type Integration struct {
+	ID        string            `json:"id"`
+	Kind      string            `json:"kind"`
+	Name      string            `json:"name"`
+	URL       string            `json:"url,omitempty"`
+	Config    map[string]string `json:"config,omitempty"`
+	Created   time.Time         `json:"created"`
+	CreatedBy string            `json:"created_by"`
+
+	// Secret signs webhook deliveries. It is only shown when the
+	// integration is created.
+	Secret string `json:"secret,omitempty"`
+}
+
+// Validate checks the integration's kind, name, URL and settings
+func (i *Integration) Validate() error {
+	switch i.Kind {
+	case IntegrationWebhook, IntegrationBridge, IntegrationFeed:
+		u, err := url.Parse(i.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("%s integrations need an http(s) url", i.Kind)
+		}
+	case IntegrationBot:
+	default:
+		return fmt.Errorf("unknown integration kind %q (webhook, bot, bridge or feed)", i.Kind)
+	}
+	if i.Name == "" || utf8.RuneCountInString(i.Name) > 64 {
+		return fmt.Errorf("integration name must be 1 to 64 characters")
+	}
+	if len(i.Config) > maxIntegrationConfig {
+		return fmt.Errorf("too many config entries (max %d)", maxIntegrationConfig)
+	}
+	return nil
+}
+
+// authorizeModerator returns who is managing the room, if the request
+// carries the room's owner key, the admin token or the token of a user
+// who may moderate the room. The lobby has no owner key.
+func (cs *ChatServer) authorizeModerator(r *http.Request, room *Room) (string, bool) {
+	if cs.authorizeOwner(r, room) {
+		return adminActor(r), true
+	}
+	return cs.authorizeGrant(r, room, PermModerate)
+}
+
+// handleRoomIntegrations serves the integrations of a room, for its owner,
+// its moderators or an admin: GET /rooms/integrations?room=<name> lists
+// them, POST adds one and DELETE ?room=<name>&id=<id> removes one. The
+// lobby is managed with room=lobby.
+func (cs *ChatServer) handleRoomIntegrations(w http.ResponseWriter, r *http.Request) {
+	if cs.rejectBanned(w, r) {
+		return
+	}
+	name := r.URL.Query().Get("room")
+	room := cs.stateRoom(name)
+	if room == nil {
+		http.Error(w, errRoomNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	actor, ok := cs.authorizeModerator(r, room)
+	if !ok {
+		cs.strike(r, "failed room moderator authentication")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="room"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		cs.roomsMtx.Lock()
+		list := make([]Integration, 0, len(room.integrations))
+		for _, in := range room.integrations {
+			listed := *in
+			listed.Secret = ""
+			list = append(list, listed)
+		}
+		cs.roomsMtx.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+
+	case http.MethodPost:
+		var in Integration
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&in); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := in.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		in.ID = newConnectionID()
+		in.Created = cs.now()
+		in.CreatedBy = actor
+		in.Secret = ""
+		if in.Kind == IntegrationWebhook {
+			in.Secret = newMessageID()
+		}
+
+		cs.roomsMtx.Lock()
+		if len(room.integrations) >= maxIntegrations {
+			cs.roomsMtx.Unlock()
+			http.Error(w, "too many integrations", http.StatusConflict)
+			return
+		}
+		if room.integrations == nil {
+			room.integrations = make(map[string]*Integration)
+		}
+		room.integrations[in.ID] = &in
+		cs.roomsMtx.Unlock()
+
+		cs.audit(AuditIntegrationAdd, actor, roomOrLobby(name), in.Kind+" "+in.Name)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(in)
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		cs.roomsMtx.Lock()
+		in, ok := room.integrations[id]
+		delete(room.integrations, id)
+		cs.roomsMtx.Unlock()
+		if !ok {
+			http.Error(w, "no such integration", http.StatusNotFound)
+			return
+		}
+		cs.audit(AuditIntegrationRemove, actor, roomOrLobby(name), in.Kind+" "+in.Name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// webhooks returns the webhook integrations of the named room
+func (cs *ChatServer) webhooks(name string) []Integration {
+	room := cs.stateRoom(name)
+	if room == nil {
+		return nil
+	}
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	var hooks []Integration
+	for _, in := range room.integrations {
+		if in.Kind == IntegrationWebhook {
+			hooks = append(hooks, *in)
+		}
+	}
+	return hooks
+}
+
+// newWebhookClient returns the client room webhooks are delivered with.
+// Anyone who creates a room can add one, so it only dials public addresses
+// on the standard web ports, keeping webhooks away from this host, its
+// admin listener and the internal network.
+func (cs *ChatServer) newWebhookClient() *http.Client {
+	dialer := checkedDialer(webhookTimeout, func(addr netip.AddrPort) bool { return cs.webhookAddr(addr) }, errWebhookAddress)
+	return &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   webhookTimeout,
+			ResponseHeaderTimeout: webhookTimeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       time.Minute,
+		},
+		// A redirect could lead anywhere the dialer allows, but the body
+		// isn't resent, so there is nothing to gain by following it
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// postWebhooks delivers a chat message to webhooks with client, signing
+// the body with each webhook's secret
+func postWebhooks(client *http.Client, hooks []Integration, msg Message) {
+	msg.Origin = ""
+	body, _ := json.Marshal(msg)
+	for _, hook := range hooks {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write(body)
+
+		ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(webhookSigHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("webhook returned %s", resp.Status)
+			}
+		}
+		cancel()
+		if err != nil {
+			log.Printf("Webhook %s of %s failed (trace %s): %v", hook.ID, roomOrLobby(msg.Room), msg.Trace, err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// addIntegration posts in to the named room's integrations with key as the
+// bearer token
+func addIntegration(t *testing.T, s *httptest.Server, room, key string, in Integration) (Integration, int) {
+	t.Helper()
+	body, _ := json.Marshal(in)
+	req, _ := http.NewRequest(http.MethodPost, s.URL+"/rooms/integrations?room="+room, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to add integration: %v", err)
+	}
+	defer resp.Body.Close()
+	var created Integration
+	json.NewDecoder(resp.Body).Decode(&created)
+	return created, resp.StatusCode
+}
+
+func TestIntegrations_Webhook(t *testing.T) {
+	server := NewChatServer()
+	// The test hook listens on loopback
+	server.webhookAddr = func(netip.AddrPort) bool { return true }
+	server.Run(t.Context())
+	s := newRoomsTestServer(t, server)
+
+	type delivery struct {
+		body []byte
+		sig  string
+	}
+	delivered := make(chan delivery, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		delivered <- delivery{body, r.Header.Get(webhookSigHeader)}
+	}))
+	defer hook.Close()
+
+	resp, err := http.Post(s.URL+"/rooms", "application/json", strings.NewReader(`{"name": "team"}`))
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	var room RoomInfo
+	json.NewDecoder(resp.Body).Decode(&room)
+	resp.Body.Close()
+
+	if _, status := addIntegration(t, s, "team", "guess", Integration{Kind: IntegrationWebhook, Name: "ci", URL: hook.URL}); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with a wrong owner key, got %d", status)
+	}
+	if _, status := addIntegration(t, s, "team", room.OwnerKey, Integration{Kind: IntegrationWebhook, Name: "ci", URL: "ftp://example.com"}); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a webhook without an http url, got %d", status)
+	}
+	if _, status := addIntegration(t, s, "team", room.OwnerKey, Integration{Kind: "pager", Name: "ci"}); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown kind, got %d", status)
+	}
+	created, status := addIntegration(t, s, "team", room.OwnerKey, Integration{Kind: IntegrationWebhook, Name: "ci", URL: hook.URL})
+	if status != http.StatusCreated || created.ID == "" || created.Secret == "" {
+		t.Fatalf("Expected a webhook with a secret, got %d %+v", status, created)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"/ws?room=team&username=alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to join team: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+	// Whispers stay between their sender and recipient
+	(&Bot{name: "helper", cs: server}).Whisper("team", "alice", "just for you")
+	wsjson.Write(ctx, c, Message{Type: "message", Content: "deploy done"})
+
+	select {
+	case d := <-delivered:
+		var msg Message
+		json.Unmarshal(d.body, &msg)
+		if msg.Content != "deploy done" || msg.Room != "team" || msg.Username != "alice" {
+			t.Errorf("Unexpected webhook delivery %s", d.body)
+		}
+		mac := hmac.New(sha256.New, []byte(created.Secret))
+		mac.Write(d.body)
+		if d.sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("Expected a valid signature, got %q", d.sig)
+		}
+	case <-ctx.Done():
+		t.Fatal("Expected the webhook to receive the message")
+	}
+
+	// Secrets aren't listed
+	req, _ := http.NewRequest(http.MethodGet, s.URL+"/rooms/integrations?room=team", nil)
+	req.Header.Set("Authorization", "Bearer "+room.OwnerKey)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []Integration
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 1 || list[0].ID != created.ID || list[0].Secret != "" {
+		t.Errorf("Unexpected integrations %+v", list)
+	}
+
+	req, _ = http.NewRequest(http.MethodDelete, s.URL+"/rooms/integrations?room=team&id="+created.ID, nil)
+	req.Header.Set("Authorization", "Bearer "+room.OwnerKey)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 removing the webhook, got %v %v", resp, err)
+	}
+	if hooks := server.webhooks("team"); len(hooks) != 0 {
+		t.Errorf("Expected no webhooks left, got %+v", hooks)
+	}
+	if page := server.auditLog.Before(0, 1); len(page.Entries) != 1 || page.Entries[0].Action != AuditIntegrationRemove {
+		t.Errorf("Expected the removal to be audited, got %+v", page.Entries)
+	}
+}
+
+func TestIntegrations_WebhookInternalAddress(t *testing.T) {
+	var called atomic.Bool
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called.Store(true)
+	}))
+	defer hook.Close()
+
+	server := NewChatServer()
+	hooks := []Integration{{ID: "internal", URL: hook.URL}, {ID: "metadata", URL: "http://169.254.169.254/latest"}}
+	postWebhooks(server.webhookClient, hooks, Message{Type: "message", Content: "secret plans"})
+	if called.Load() {
+		t.Errorf("Expected a room webhook on loopback not to be called")
+	}
+}
+
+func TestIntegrations_Moderator(t *testing.T) {
+	var calls atomic.Int32
+	var down atomic.Bool
+	verify := newVerifyServer(t, &calls, &down)
+	auth, _ := NewWebhookAuthenticator(verify.URL, time.Minute, AuthFallbackDeny)
+	server := NewChatServer(WithAuthenticator(auth))
+	s := newRoomsTestServer(t, server)
+
+	// alice is a moderator and may manage any room, the lobby included
+	if _, status := addIntegration(t, s, "lobby", "alice-token", Integration{Kind: IntegrationBot, Name: "helper"}); status != http.StatusCreated {
+		t.Errorf("Expected 201 for a moderator, got %d", status)
+	}
+	if _, status := addIntegration(t, s, "lobby", "forged", Integration{Kind: IntegrationBot, Name: "helper"}); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unknown token, got %d", status)
+	}
+	if _, status := addIntegration(t, s, "nowhere", "alice-token", Integration{Kind: IntegrationBot, Name: "helper"}); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown room, got %d", status)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxInvites caps the outstanding invites of one room
+const maxInvites = 1000
+
+// Invite lets one person, or anyone holding it until it expires, join an
+// invite-only room
+type Invite struct {
+	Token     string    `json:"token"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires,omitzero"`
+	SingleUse bool      `json:"single_use,omitempty"`
+	Uses      int       `json:"uses"`
+}
+
+// expired reports whether the invite can no longer be redeemed at now
+func (i *Invite) expired(now time.Time) bool {
+	return !i.Expires.IsZero() && !now.Before(i.Expires)
+}
+
+// redeemLocked uses an invite to the room, removing it once spent. Callers
+// hold ChatServer.roomsMtx.
+func (r *Room) redeemLocked(token string, now time.Time) bool {
+	inv, ok := r.invites[token]
+	if !ok || token == "" {
+		return false
+	}
+	if inv.expired(now) {
+		delete(r.invites, token)
+		return false
+	}
+	inv.Uses++
+	if inv.SingleUse {
+		delete(r.invites, token)
+	}
+	return true
+}
+
+// authorizeOwner reports whether the request carries the room's owner key
+// or the admin token as a bearer token
+func (cs *ChatServer) authorizeOwner(r *http.Request, room *Room) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+	if cs.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cs.adminToken)) == 1 {
+		return true
+	}
+	return subtle.ConstantTimeCompare(hashRoomPassword(room.salt, token), room.ownerKey) == 1
+}
+
+// handleRoomInvites serves the invites of an invite-only room, for its
+// owner, an admin or a user the room's ACL lets invite: GET
+// /rooms/invites?room=<name> lists them, POST creates one from
+// {"single_use": true, "expires_in": "24h"} and DELETE
+// ?room=<name>&token=<token> revokes one
+func (cs *ChatServer) handleRoomInvites(w http.ResponseWriter, r *http.Request) {
+	if cs.rejectBanned(w, r) {
+		return
+	}
+	room := cs.lookupRoom(r.URL.Query().Get("room"))
+	if room == nil {
+		http.Error(w, errRoomNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	authorized := cs.authorizeOwner(r, room)
+	if !authorized {
+		_, authorized = cs.authorizeGrant(r, room, PermInvite)
+	}
+	if !authorized {
+		cs.strike(r, "failed room owner authentication")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="room"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !room.InviteOnly {
+		http.Error(w, "room is not invite-only", http.StatusConflict)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		now := cs.now()
+		cs.roomsMtx.Lock()
+		invites := make([]Invite, 0, len(room.invites))
+		for _, inv := range room.invites {
+			if !inv.expired(now) {
+				invites = append(invites, *inv)
+			}
+		}
+		cs.roomsMtx.Unlock()
+		sort.Slice(invites, func(i, j int) bool { return invites[i].Created.Before(invites[j].Created) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(invites)
+
+	case http.MethodPost:
+		var req struct {
+			SingleUse bool   `json:"single_use"`
+			ExpiresIn string `json:"expires_in"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+				http.Error(w, "invalid JSON body", http.StatusBadRequest)
+				return
+			}
+		}
+		inv := &Invite{Token: newMessageID(), Created: cs.now(), SingleUse: req.SingleUse}
+		if req.ExpiresIn != "" {
+			d, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid expires_in", http.StatusBadRequest)
+				return
+			}
+			inv.Expires = inv.Created.Add(d)
+		}
+
+		cs.roomsMtx.Lock()
+		if len(room.invites) >= maxInvites {
+			cs.roomsMtx.Unlock()
+			http.Error(w, "too many outstanding invites", http.StatusConflict)
+			return
+		}
+		room.invites[inv.Token] = inv
+		created := *inv
+		cs.roomsMtx.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+
+	case http.MethodDelete:
+		token := r.URL.Query().Get("token")
+		cs.roomsMtx.Lock()
+		_, ok := room.invites[token]
+		delete(room.invites, token)
+		cs.roomsMtx.Unlock()
+		if !ok {
+			http.Error(w, "no such invite", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestRooms_Invites(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	s := newRoomsTestServer(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	resp, err := http.Post(s.URL+"/rooms", "application/json", strings.NewReader(`{"name": "team", "invite_only": true}`))
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	var created RoomInfo
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if created.OwnerKey == "" || !created.InviteOnly || !created.Private {
+		t.Fatalf("Unexpected created room: %+v", created)
+	}
+
+	invite := func(key, body string) (Invite, int) {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, s.URL+"/rooms/invites?room=team", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to create invite: %v", err)
+		}
+		defer resp.Body.Close()
+		var inv Invite
+		json.NewDecoder(resp.Body).Decode(&inv)
+		return inv, resp.StatusCode
+	}
+	if _, status := invite("guess", `{}`); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with a wrong owner key, got %d", status)
+	}
+
+	join := func(username, token string) int {
+		t.Helper()
+		c, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"/ws?room=team&username="+username+"&invite="+token, nil)
+		if err != nil {
+			if resp == nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			return resp.StatusCode
+		}
+		c.Close(websocket.StatusNormalClosure, "")
+		return http.StatusSwitchingProtocols
+	}
+	if status := join("eve", ""); status != http.StatusForbidden {
+		t.Errorf("Expected 403 without an invite, got %d", status)
+	}
+
+	once, status := invite(created.OwnerKey, `{"single_use": true}`)
+	if status != http.StatusCreated || once.Token == "" {
+		t.Fatalf("Failed to create single-use invite: %d", status)
+	}
+	if status := join("alice", once.Token); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected the invite to admit alice, got %d", status)
+	}
+	if status := join("bob", once.Token); status != http.StatusForbidden {
+		t.Errorf("Expected a used single-use invite to be refused, got %d", status)
+	}
+
+	brief, _ := invite(created.OwnerKey, `{"expires_in": "1ms"}`)
+	time.Sleep(time.Millisecond * 5)
+	if status := join("bob", brief.Token); status != http.StatusForbidden {
+		t.Errorf("Expected an expired invite to be refused, got %d", status)
+	}
+
+	shared, _ := invite(created.OwnerKey, `{}`)
+	if status := join("bob", shared.Token); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected a reusable invite to admit bob, got %d", status)
+	}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodDelete, s.URL+"/rooms/invites?room=team&token="+shared.Token, nil)
+	req.Header.Set("Authorization", "Bearer "+created.OwnerKey)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Failed to revoke invite: %v %v", resp, err)
+	}
+	resp.Body.Close()
+	if status := join("carol", shared.Token); status != http.StatusForbidden {
+		t.Errorf("Expected a revoked invite to be refused, got %d", status)
+	}
+
+	for _, room := range server.listRooms() {
+		if room.Name == "team" {
+			t.Error("Expected invite-only rooms to stay unlisted")
+		}
+	}
+}
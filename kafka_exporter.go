@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	kafkaQueueSize = 4096
+	kafkaBatchSize = 100
+)
+
+// kafkaWriter is the subset of *kafka.Writer used by KafkaExporter
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// KafkaExporter publishes chat events to a Kafka topic. Events are queued and
+// written in batches from a background goroutine; when the queue is full new
+// events are dropped rather than slowing down chat traffic.
+type KafkaExporter struct {
+	writer  kafkaWriter
+	mu      sync.RWMutex
+	closed  bool
+	events  chan ExportEvent
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+// NewKafkaExporter creates an exporter writing to topic on the given brokers
+func NewKafkaExporter(brokers []string, topic string) *KafkaExporter {
+	return newKafkaExporter(&kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		BatchTimeout: time.Millisecond * 50,
+		RequiredAcks: kafka.RequireOne,
+	}, kafkaQueueSize)
+}
+
+func newKafkaExporter(w kafkaWriter, queueSize int) *KafkaExporter {
+	e := &KafkaExporter{
+		writer: w,
+		events: make(chan ExportEvent, queueSize),
+		done:   make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// Export queues ev for publishing without blocking
+func (e *KafkaExporter) Export(ev ExportEvent) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return
+	}
+
+	select {
+	case e.events <- ev:
+	default:
+		if n := e.dropped.Add(1); n%1000 == 1 {
+			log.Printf("Kafka export queue full, %d events dropped so far", n)
+		}
+	}
+}
+
+// Dropped returns how many events were discarded because the queue was full
+func (e *KafkaExporter) Dropped() int64 {
+	return e.dropped.Load()
+}
+
+// run writes queued events to Kafka in batches until the queue is closed
+func (e *KafkaExporter) run() {
+	defer close(e.done)
+
+	batch := make([]kafka.Message, 0, kafkaBatchSize)
+	for ev := range e.events {
+		batch = append(batch[:0], encodeKafkaEvent(ev))
+		// Pick up whatever else is already waiting
+	fill:
+		for len(batch) < kafkaBatchSize {
+			select {
+			case ev, ok := <-e.events:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, encodeKafkaEvent(ev))
+			default:
+				break fill
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		err := e.writer.WriteMessages(ctx, batch...)
+		cancel()
+		if err != nil {
+			log.Printf("Kafka export of %d events failed: %v", len(batch), err)
+		}
+	}
+}
+
+// encodeKafkaEvent keys events by username so each user's activity stays ordered
+func encodeKafkaEvent(ev ExportEvent) kafka.Message {
+	value, _ := json.Marshal(ev)
+	return kafka.Message{Key: []byte(ev.Username), Value: value}
+}
+
+// Close flushes queued events and closes the writer
+func (e *KafkaExporter) Close() error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil
+	}
+	e.closed = true
+	close(e.events)
+	e.mu.Unlock()
+
+	<-e.done
+	return e.writer.Close()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"iter"
+	"unicode"
+)
+
+// zeroWidthJoiner joins emoji into one, as in a family or a profession
+const zeroWidthJoiner = '\u200d'
+
+// WithMessageLimit sets the longest message clients may send, in
+// characters as messageLength counts them
+func WithMessageLimit(n int) Option {
+	return func(cs *ChatServer) {
+		if n > 0 {
+			cs.messageLimit = n
+		}
+	}
+}
+
+// messageLength counts the characters in s as a reader would see them,
+// so a limit means the same in every script. A letter with its combining
+// accents, an emoji with its skin tone or variation selector, emoji joined
+// by zero-width joiners, a flag and a CRLF each count once. It follows the
+// grapheme cluster rules of UAX #29 for these cases rather than in full.
+func messageLength(s string) int {
+	n := 0
+	for range characterStarts(s) {
+		n++
+	}
+	return n
+}
+
+// truncateMessage cuts s to at most limit characters as messageLength
+// counts them, never in the middle of one
+func truncateMessage(s string, limit int) string {
+	n := 0
+	for i := range characterStarts(s) {
+		if n == limit {
+			return s[:i]
+		}
+		n++
+	}
+	return s
+}
+
+// characterStarts yields the byte offset at which each character of s
+// starts. The first code point always starts one, so content made only of
+// joiners or combining marks still has a length.
+func characterStarts(s string) iter.Seq[int] {
+	return func(yield func(int) bool) {
+		var prev rune
+		joined, flag := false, false
+		for i, r := range s {
+			start := false
+			switch {
+			case i == 0:
+				start = true
+				joined, flag = r == zeroWidthJoiner, isRegionalIndicator(r)
+			case r == zeroWidthJoiner:
+				joined = true
+			case extendsCluster(r):
+			case r == '\n' && prev == '\r':
+			case joined:
+				joined = false
+			case isRegionalIndicator(r):
+				// Flags are pairs of regional indicators
+				flag = !flag
+				start = flag
+			default:
+				flag = false
+				start = true
+			}
+			prev = r
+			if start && !yield(i) {
+				return
+			}
+		}
+	}
+}
+
+// extendsCluster reports whether r belongs to the character before it
+func extendsCluster(r rune) bool {
+	switch {
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc, unicode.Variation_Selector):
+		return true
+	case r >= 0x1f3fb && r <= 0x1f3ff:
+		// Emoji skin tones
+		return true
+	case r >= 0xe0020 && r <= 0xe007f:
+		// Tags, as in subdivision flags
+		return true
+	}
+	return false
+}
+
+// isRegionalIndicator reports whether r is one of the letters flags are
+// spelled with
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestMessageLength(t *testing.T) {
+	testCases := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"hello", 5},
+		{"你好世界", 4},
+		{"line\r\nbreak", 10},
+		// e and a combining acute accent
+		{"café", 4},
+		{"👍🏽", 1},
+		{"❤️", 1},
+		// Family, joined with zero-width joiners
+		{"👨‍👩‍👧", 1},
+		{"🇩🇪🇫🇷", 2},
+		{"🏴󠁧󠁢󠁳󠁣󠁴󠁿!", 2},
+		// Nothing to extend still counts
+		{"\u200d\u200d", 1},
+		{"\u0301", 1},
+	}
+	for _, tc := range testCases {
+		if got := messageLength(tc.s); got != tc.want {
+			t.Errorf("Expected %q to be %d characters, got %d", tc.s, tc.want, got)
+		}
+	}
+}
+
+func TestTruncateMessage(t *testing.T) {
+	testCases := []struct {
+		s     string
+		limit int
+		want  string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 3, "hel"},
+		{"café!", 4, "café"},
+		{"👨‍👩‍👧👍🏽", 1, "👨‍👩‍👧"},
+		{"日本語", 2, "日本"},
+	}
+	for _, tc := range testCases {
+		if got := truncateMessage(tc.s, tc.limit); got != tc.want {
+			t.Errorf("Expected %q cut to %d to be %q, got %q", tc.s, tc.limit, tc.want, got)
+		}
+	}
+}
+
+func TestMessageLimit(t *testing.T) {
+	server := NewChatServer(WithMessageLimit(10))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username=alice", &websocket.DialOptions{Subprotocols: []string{subprotocolV3}})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.CloseNow()
+	var hello Hello
+	if err := wsjson.Read(ctx, c, &hello); err != nil {
+		t.Fatalf("Failed to read hello: %v", err)
+	}
+	if hello.Limits.MaxMessageLength != 10 {
+		t.Errorf("Expected hello to report the limit, got %+v", hello.Limits)
+	}
+
+	// Ten CJK characters are 30 bytes but within the limit
+	fits := strings.Repeat("字", 10)
+	if err := wsjson.Write(ctx, c, Message{Type: "message", Content: fits}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if msg := readUntilType(t, ctx, c, "message"); msg.Content != fits {
+		t.Errorf("Expected the message through, got %+v", msg)
+	}
+	long := fits + "字"
+	if err := wsjson.Write(ctx, c, Message{Type: "message", Content: long}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	msg := readUntilType(t, ctx, c, "message")
+	if msg.Code != codeContentTooLong || msg.Ref == nil || msg.Ref.Length != 11 {
+		t.Errorf("Expected content_too_long for 11 characters, got %+v", msg)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCapacity is how many connections an instance is sized for
+	defaultCapacity = 10000
+	// fanoutWindow is how often fan-out utilization is folded into its
+	// moving average
+	fanoutWindow = time.Second
+)
+
+// LoadInfo is the response of GET /api/load. Score is the highest of the
+// normalized load components: 0 is idle and 1 is at capacity.
+type LoadInfo struct {
+	Instance          string  `json:"instance"`
+	Score             float64 `json:"score"`
+	Accepting         bool    `json:"accepting"`
+	Connections       int     `json:"connections"`
+	Capacity          int     `json:"capacity"`
+	QueueDepth        int     `json:"queue_depth"`
+	QueueCapacity     int     `json:"queue_capacity"`
+	FanoutUtilization float64 `json:"fanout_utilization"`
+}
+
+// WithCapacity sets how many connections the instance is sized for, the
+// point at which its connection load reads 1
+func WithCapacity(conns int) Option {
+	return func(cs *ChatServer) {
+		cs.capacity = conns
+	}
+}
+
+// fanoutLoad tracks how busy the broadcast goroutine is, as a moving
+// average of the share of each window spent delivering messages
+type fanoutLoad struct {
+	mu          sync.Mutex
+	busy        time.Duration
+	since       time.Time
+	utilization float64
+}
+
+// observe records time spent delivering a message
+func (l *fanoutLoad) observe(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.busy += d
+	l.rollLocked(time.Now())
+}
+
+// value returns the current utilization
+func (l *fanoutLoad) value() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rollLocked(time.Now())
+	return l.utilization
+}
+
+// rollLocked folds finished windows into the average; idle windows decay
+// it towards zero
+func (l *fanoutLoad) rollLocked(now time.Time) {
+	if l.since.IsZero() {
+		l.since = now
+		return
+	}
+	for elapsed := now.Sub(l.since); elapsed >= fanoutWindow; elapsed = now.Sub(l.since) {
+		share := min(float64(l.busy)/float64(fanoutWindow), 1)
+		l.utilization = (l.utilization + share) / 2
+		l.busy = 0
+		l.since = l.since.Add(fanoutWindow)
+		if elapsed > fanoutWindow*10 {
+			// Long idle: nothing left worth averaging
+			l.utilization = 0
+			l.since = now
+		}
+	}
+}
+
+// load measures the instance's current load
+func (cs *ChatServer) load() LoadInfo {
+	cs.clientsMtx.Lock()
+	conns := len(cs.clients)
+	cs.clientsMtx.Unlock()
+
+	info := LoadInfo{
+		Instance:          cs.instanceID,
+		Connections:       conns,
+		Capacity:          cs.capacity,
+		QueueDepth:        len(cs.broadcast),
+		QueueCapacity:     cap(cs.broadcast),
+		FanoutUtilization: cs.fanout.value(),
+	}
+	if info.Capacity > 0 {
+		info.Score = float64(conns) / float64(info.Capacity)
+	}
+	if info.QueueCapacity > 0 {
+		info.Score = max(info.Score, float64(info.QueueDepth)/float64(info.QueueCapacity))
+	}
+	info.Score = max(info.Score, info.FanoutUtilization)
+
+	select {
+	case <-cs.stopped:
+	default:
+		info.Accepting = info.Score < 1
+	}
+	return info
+}
+
+// handleLoad serves GET /api/load for autoscalers and routers. It answers
+// 503 while the instance shouldn't be given new connections.
+func (cs *ChatServer) handleLoad(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	info := cs.load()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !info.Accepting {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFanoutLoad(t *testing.T) {
+	now := time.Now()
+	l := fanoutLoad{since: now.Add(-fanoutWindow), busy: fanoutWindow / 2}
+	l.rollLocked(now)
+	if l.utilization != 0.25 {
+		t.Errorf("Expected half a busy window to average to 0.25, got %v", l.utilization)
+	}
+	l.rollLocked(now.Add(fanoutWindow * 20))
+	if l.utilization != 0 {
+		t.Errorf("Expected a long idle spell to reset utilization, got %v", l.utilization)
+	}
+}
+
+func TestHandleLoad(t *testing.T) {
+	// Never Run, so published messages stay queued
+	server := NewChatServer(WithCapacity(2), WithBroadcastQueue(4, time.Millisecond))
+	s := httptest.NewServer(http.HandlerFunc(server.handleLoad))
+	defer s.Close()
+
+	get := func() (LoadInfo, int) {
+		t.Helper()
+		resp, err := http.Get(s.URL)
+		if err != nil {
+			t.Fatalf("Failed to get load: %v", err)
+		}
+		defer resp.Body.Close()
+		var info LoadInfo
+		if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+			t.Fatalf("Failed to decode load: %v", err)
+		}
+		return info, resp.StatusCode
+	}
+
+	server.publish(Message{Type: "message", Content: "one"})
+	server.publish(Message{Type: "message", Content: "two"})
+	if info, code := get(); code != http.StatusOK || info.QueueDepth != 2 || info.Score != 0.5 || !info.Accepting {
+		t.Errorf("Expected a half full queue to score 0.5, got %d %+v", code, info)
+	}
+
+	server.clients[&Client{}] = true
+	server.clients[&Client{}] = true
+	if info, code := get(); code != http.StatusServiceUnavailable || info.Score != 1 || info.Accepting {
+		t.Errorf("Expected a full instance to refuse placements, got %d %+v", code, info)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// luaTimeout is how long the script may run for one message
+	luaTimeout = time.Millisecond * 50
+	// luaReloadInterval is how often the script file is checked for
+	// changes
+	luaReloadInterval = time.Second * 2
+	// maxTags caps the tags a script may put on one message
+	maxTags = 10
+)
+
+// LuaHook runs an operator's Lua script on every inbound chat message. The
+// script defines on_message(msg), where msg is a table with type,
+// username, room, content and tags fields. The function may rewrite
+// msg.content and add to msg.tags, or return false and a reason to reject
+// the message. The script is reloaded when its file changes.
+type LuaHook struct {
+	path string
+
+	mu      sync.Mutex
+	state   *lua.LState
+	modTime time.Time
+}
+
+// NewLuaHook loads the script at path
+func NewLuaHook(path string) (*LuaHook, error) {
+	h := &LuaHook{path: path}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// WithLuaHook runs every inbound chat message through h
+func WithLuaHook(h *LuaHook) Option {
+	return func(cs *ChatServer) {
+		cs.luaHook = h
+	}
+}
+
+// newLuaState creates an interpreter with only the libraries that can't
+// reach outside the process
+func newLuaState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true, CallStackSize: 120, RegistryMaxSize: 1 << 16})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	return L
+}
+
+// load compiles the script into a fresh interpreter and swaps it in,
+// keeping the running one if the script doesn't load
+func (h *LuaHook) load() error {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return fmt.Errorf("loading Lua hook: %w", err)
+	}
+	src, err := os.ReadFile(h.path)
+	if err != nil {
+		return fmt.Errorf("loading Lua hook: %w", err)
+	}
+
+	L := newLuaState()
+	ctx, cancel := context.WithTimeout(context.Background(), luaTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	err = L.DoString(string(src))
+	L.RemoveContext()
+	if err != nil {
+		L.Close()
+		return fmt.Errorf("loading Lua hook %s: %w", h.path, err)
+	}
+	if L.GetGlobal("on_message").Type() != lua.LTFunction {
+		L.Close()
+		return fmt.Errorf("loading Lua hook %s: no on_message function", h.path)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.state != nil {
+		h.state.Close()
+	}
+	h.state, h.modTime = L, info.ModTime()
+	return nil
+}
+
+// run reloads the script whenever its file changes, until ctx is done
+func (h *LuaHook) run(ctx context.Context) {
+	ticker := time.NewTicker(luaReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(h.path)
+		if err != nil {
+			continue
+		}
+		h.mu.Lock()
+		changed := !info.ModTime().Equal(h.modTime)
+		h.mu.Unlock()
+		if !changed {
+			continue
+		}
+		if err := h.load(); err != nil {
+			log.Printf("%v; keeping the previous script", err)
+			h.mu.Lock()
+			h.modTime = info.ModTime()
+			h.mu.Unlock()
+			continue
+		}
+		log.Printf("Reloaded Lua hook %s", h.path)
+	}
+}
+
+// apply runs the script on msg, rewriting its content and tags, and
+// returns the reason if the script rejects it. A failing script lets the
+// message through unchanged.
+func (h *LuaHook) apply(msg *Message) (reason string, rejected bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	L := h.state
+
+	tbl := L.NewTable()
+	tbl.RawSetString("type", lua.LString(msg.Type))
+	tbl.RawSetString("username", lua.LString(msg.Username))
+	tbl.RawSetString("room", lua.LString(msg.Room))
+	tbl.RawSetString("content", lua.LString(msg.Content))
+	tags := L.NewTable()
+	for _, tag := range msg.Tags {
+		tags.Append(lua.LString(tag))
+	}
+	tbl.RawSetString("tags", tags)
+
+	ctx, cancel := context.WithTimeout(context.Background(), luaTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	err := L.CallByParam(lua.P{Fn: L.GetGlobal("on_message"), NRet: 2, Protect: true}, tbl)
+	L.RemoveContext()
+	if err != nil {
+		log.Printf("Lua hook failed (trace %s), message let through: %v", msg.Trace, err)
+		return "", false
+	}
+	verdict, why := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+	if verdict == lua.LFalse {
+		reason = "rejected by server policy"
+		if s, ok := why.(lua.LString); ok && s != "" {
+			reason = string(s)
+		}
+		return reason, true
+	}
+
+	if content, ok := tbl.RawGetString("content").(lua.LString); ok {
+		msg.Content = string(content)
+	}
+	msg.Tags = nil
+	if tags, ok := tbl.RawGetString("tags").(*lua.LTable); ok {
+		tags.ForEach(func(_, v lua.LValue) {
+			if s, ok := v.(lua.LString); ok && len(msg.Tags) < maxTags {
+				msg.Tags = append(msg.Tags, string(s))
+			}
+		})
+	}
+	return "", false
+}
+
+// scriptMessage runs an inbound chat message through the Lua hook,
+// answering the client and reporting false if the script rejects it or
+// rewrites it into something invalid
+func (cs *ChatServer) scriptMessage(ctx context.Context, client *Client, msg *Message) bool {
+	original := *msg
+	if err := cs.scriptInbound(msg, client.room); err != nil {
+		client.logf("Lua hook refused message from %s (trace %s): %v", client.username, msg.Trace, err)
+		cs.sendError(ctx, client, err, refFor(original))
+		return false
+	}
+	return true
+}
+
+// scriptInbound runs a chat message bound for room, or the lobby if room
+// is nil, through the Lua hook, whichever way it arrived. It returns the
+// error refusing the message if the script rejects it or rewrites it into
+// something invalid.
+func (cs *ChatServer) scriptInbound(msg *Message, room *Room) error {
+	if cs.luaHook == nil {
+		return nil
+	}
+	original := msg.Content
+	if reason, rejected := cs.luaHook.apply(msg); rejected {
+		return protocolErrorf(codeRejected, "%s", reason)
+	}
+	if msg.Content != original {
+		return msg.validateIn(room, cs.messageLimit)
+	}
+	return nil
+}
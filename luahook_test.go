@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bvedant/ideal-guacamole/chatpb"
+	"github.com/coder/websocket/wsjson"
+)
+
+const testLuaScript = `
+function on_message(msg)
+  if string.find(msg.content, "forbidden") then
+    return false, "no forbidden words"
+  end
+  msg.content = string.gsub(msg.content, "darn", "d**n")
+  table.insert(msg.tags, "checked")
+end
+`
+
+func TestLuaHook(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hook.lua")
+	if err := os.WriteFile(path, []byte(testLuaScript), 0o644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	hook, err := NewLuaHook(path)
+	if err != nil {
+		t.Fatalf("Failed to load script: %v", err)
+	}
+	server := NewChatServer(WithLuaHook(hook))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "darn it", Tags: []string{"forged"}})
+	if msg := readUntilType(t, ctx, alice, "message"); msg.Content != "d**n it" || !slices.Equal(msg.Tags, []string{"checked"}) {
+		t.Errorf("Expected the script to rewrite and tag the message, got %+v", msg)
+	}
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "forbidden fruit"})
+	if msg := readUntilType(t, ctx, alice, "error"); msg.Code != codeRejected || msg.Content != "no forbidden words" {
+		t.Errorf("Expected the script to reject the message, got %+v", msg)
+	}
+
+	// A broken script leaves the running one in place
+	os.WriteFile(path, []byte("function on_message(msg"), 0o644)
+	if err := hook.load(); err == nil {
+		t.Errorf("Expected a broken script to fail to load")
+	}
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "darn"})
+	if msg := readUntilType(t, ctx, alice, "message"); msg.Content != "d**n" {
+		t.Errorf("Expected the previous script to keep running, got %+v", msg)
+	}
+
+	os.WriteFile(path, []byte(`function on_message(msg) msg.content = string.upper(msg.content) end`), 0o644)
+	if err := hook.load(); err != nil {
+		t.Fatalf("Failed to reload script: %v", err)
+	}
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "hello"})
+	if msg := readUntilType(t, ctx, alice, "message"); msg.Content != "HELLO" {
+		t.Errorf("Expected the reloaded script to run, got %+v", msg)
+	}
+}
+
+func TestLuaHook_Sandbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hook.lua")
+	os.WriteFile(path, []byte(`function on_message(msg) while true do end end`), 0o644)
+	hook, err := NewLuaHook(path)
+	if err != nil {
+		t.Fatalf("Failed to load script: %v", err)
+	}
+	started := time.Now()
+	msg := Message{Type: "message", Content: "hi"}
+	if _, rejected := hook.apply(&msg); rejected || msg.Content != "hi" {
+		t.Errorf("Expected a runaway script to let the message through, got %+v", msg)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Expected a runaway script to be stopped, took %s", elapsed)
+	}
+
+	os.WriteFile(path, []byte(`io.open("/etc/passwd") function on_message(msg) end`), 0o644)
+	if err := hook.load(); err == nil {
+		t.Errorf("Expected the io library to be unavailable")
+	}
+}
+
+func TestLuaHook_Inbound(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hook.lua")
+	if err := os.WriteFile(path, []byte(testLuaScript), 0o644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	hook, err := NewLuaHook(path)
+	if err != nil {
+		t.Fatalf("Failed to load script: %v", err)
+	}
+	server := NewChatServer(WithLuaHook(hook))
+	mqtt := &MQTTBridge{cs: server, cfg: MQTTConfig{Bot: "sensors"}}
+
+	// Bridged and gRPC messages are scripted like WebSocket ones
+	mqtt.post("", "alerts", []byte("forbidden door"), false)
+	server.relayMatrixEvent("", "m.room.message", "@bob:example.org", "", "m.text", "forbidden fruit", "")
+	err = server.publishRPC(grpcCaller{admin: true}, &spamState{}, &chatpb.PublishRequest{Username: "deploybot", Content: "forbidden build"}, newTraceID())
+	if errorCode(err) != codeRejected {
+		t.Errorf("Expected the script to reject the gRPC message, got %v", err)
+	}
+	if n := len(server.broadcast); n != 0 {
+		t.Fatalf("Expected rejected messages to be dropped, got %d", n)
+	}
+	mqtt.post("", "alerts", []byte("darn door"), false)
+	if msg := <-server.broadcast; msg.Content != "[alerts] d**n door" || !slices.Equal(msg.Tags, []string{"checked"}) {
+		t.Errorf("Expected the script to rewrite and tag the bridged message, got %+v", msg)
+	}
+}
@@ -2,15 +2,31 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
 	"regexp"
+	"runtime/debug"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/coder/websocket"
-	"github.com/coder/websocket/wsjson"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -28,66 +44,670 @@ type Message struct {
 	Username string `json:"username"`
 	Content  string `json:"content"`
 	Time     string `json:"time"`
+	ID       string `json:"id,omitempty"`
+
+	// Timestamp is the server receive time in Unix milliseconds
+	Timestamp int64 `json:"ts,omitempty"`
+	// Seq increases by one for every message broadcast to the room, so
+	// clients can order messages and spot gaps. It is assigned by the
+	// instance delivering the message; messages sent only to one client
+	// (errors, history pages) carry no sequence number.
+	Seq uint64 `json:"seq,omitempty"`
+
+	// Origin is the instance that accepted the message. It travels over the
+	// broker for deduplication and is stripped before delivery to clients.
+	Origin string `json:"origin,omitempty"`
+
+	// Code identifies the problem on "error" messages, and Ref the
+	// payload that was rejected
+	Code string    `json:"code,omitempty"`
+	Ref  *ErrorRef `json:"ref,omitempty"`
+
+	// Instance is set on "heartbeat" messages exchanged between instances
+	Instance *InstanceInfo `json:"instance,omitempty"`
+
+	// Trace identifies the inbound frame a message was created from, or the
+	// server event that created it, in server logs
+	Trace string `json:"trace,omitempty"`
+
+	// ClientMsgID is chosen by the sender to spot retransmits and match its
+	// message to the broadcast. Only the sender's copy carries it.
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	// ackedID is the ID the sender was acknowledged with, which relay
+	// keeps. It never leaves the server.
+	ackedID string
+
+	// Room names the room a message belongs to, empty for the lobby.
+	// Renames, tombstones and presence summaries concern every room.
+	Room string `json:"room,omitempty"`
+
+	// Topic is set on "topic" events, and Pinned on "pin" and "unpin"
+	// events (carrying only the ID when unpinning)
+	Topic  string   `json:"topic,omitempty"`
+	Pinned *Message `json:"pinned,omitempty"`
+
+	// ExpiresAt is when a pinned message is unpinned or an "announcement"
+	// taken down, as an RFC 3339 time
+	ExpiresAt string `json:"expires_at,omitempty"`
+
+	// SlowMode is the seconds between one user's messages on "slowmode"
+	// events, zero when slow mode is turned off
+	SlowMode int `json:"slow_mode,omitempty"`
+
+	// OldUsername is set on "rename" events
+	OldUsername string `json:"old_username,omitempty"`
+
+	// Count and Members summarize the room on "presence" messages, with
+	// the profiles of those members that have one
+	Count    int                `json:"count,omitempty"`
+	Members  []string           `json:"members,omitempty"`
+	Profiles map[string]Profile `json:"profiles,omitempty"`
+
+	// Status is the user's state on "status" messages
+	Status string `json:"status,omitempty"`
+
+	// LastRead is the ID of the last message read on "read" messages
+	LastRead string `json:"last_read,omitempty"`
+
+	// Profile is set by clients on "profile" messages, and echoed back
+	Profile *Profile `json:"profile,omitempty"`
+
+	// Ciphertext replaces Content on "message" and "key" messages in
+	// encrypted rooms, and To addresses a "key" envelope to one member
+	Ciphertext string `json:"ciphertext,omitempty"`
+	To         string `json:"to,omitempty"`
+
+	// BodyHash, PrevHash, Hash and Sig sign stored messages and chain them
+	// together when the server has a signing key (see package chain), and
+	// RedactionSig signs a body erasure redacted
+	BodyHash     string `json:"body_hash,omitempty"`
+	PrevHash     string `json:"prev_hash,omitempty"`
+	Hash         string `json:"hash,omitempty"`
+	Sig          string `json:"sig,omitempty"`
+	RedactionSig string `json:"redaction_sig,omitempty"`
+
+	// DeliverAt schedules an inbound "message" for delivery at that RFC 3339
+	// time, and is echoed on "scheduled" and "unscheduled" confirmations
+	DeliverAt string `json:"deliver_at,omitempty"`
+
+	// Poll is set on "poll" messages and "tally" events, and PollID and
+	// Option on inbound "vote" messages; tallies name their poll in PollID
+	Poll   *Poll  `json:"poll,omitempty"`
+	PollID string `json:"poll_id,omitempty"`
+	Option *int   `json:"option,omitempty"`
+
+	// Preview is set on "preview" events, and on stored messages once
+	// their link preview has arrived
+	Preview *LinkPreview `json:"preview,omitempty"`
+
+	// Rendered is the sanitized HTML of a chat message's Markdown content,
+	// when the server renders Markdown
+	Rendered string `json:"rendered,omitempty"`
+
+	// Bot is set on messages sent by a server plugin
+	Bot bool `json:"bot,omitempty"`
+
+	// Tags are labels the server's Lua hook and rules put on a message,
+	// and RoutedFrom names the room a rule copied it from
+	Tags       []string `json:"tags,omitempty"`
+	RoutedFrom string   `json:"routed_from,omitempty"`
+
+	// Via lists the federated servers a message from another server
+	// passed through, starting with the sender's
+	Via []string `json:"via,omitempty"`
+
+	// History and roster request parameters, only set on inbound "history"
+	// and "roster" messages
+	BeforeSeq uint64 `json:"before_seq,omitempty"`
+	After     string `json:"after,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
 }
 
 // Validate checks if the message is valid
 func (m *Message) Validate() error {
+	return m.validate(maxMessageLength)
+}
+
+// validate checks a message, allowing up to limit characters of content
+func (m *Message) validate(limit int) error {
 	if m.Content == "" {
-		return fmt.Errorf("message content cannot be empty")
+		return protocolErrorf(codeEmptyContent, "message content cannot be empty")
+	}
+	// JSON decoding replaces invalid UTF-8, but msgpack strings are raw
+	// bytes
+	if !utf8.ValidString(m.Content) {
+		return protocolErrorf(codeBadFrame, "message content must be valid UTF-8")
+	}
+	if messageLength(m.Content) > limit {
+		return protocolErrorf(codeContentTooLong, "message content too long (max %d characters)", limit)
 	}
-	if len(m.Content) > maxMessageLength {
-		return fmt.Errorf("message content too long (max %d characters)", maxMessageLength)
+	if strings.ContainsFunc(m.Content, isControl) {
+		return protocolErrorf(codeBadFrame, "message content contains control characters")
 	}
 	if m.Type != "" && m.Type != "message" && m.Type != "system" {
-		return fmt.Errorf("invalid message type: %s", m.Type)
+		return protocolErrorf(codeInvalidType, "invalid message type: %s", m.Type)
 	}
 	return nil
 }
 
+// isControl reports whether r is a control character other than the tabs
+// and line breaks messages may contain
+func isControl(r rune) bool {
+	return unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r'
+}
+
 // Client represents a connected chat client
 type Client struct {
-	conn     *websocket.Conn
-	username string
+	id         string
+	remoteAddr string
+	conn       *websocket.Conn
+	events     *eventStream
+	version    int
+	codec      Codec
+	out        frameWriter
+	taps       clientTaps
+	canary     bool
+	room       *Room
+
+	// authenticated is set, with the roles, when an Authenticator
+	// verified the client's identity
+	authenticated bool
+	roles         []string
+
+	// lastActive is when the client last sent a frame, in Unix nanoseconds
+	lastActive atomic.Int64
+	// lastTyping is when the client's typing was last passed on, in Unix
+	// nanoseconds
+	lastTyping atomic.Int64
+
+	// username is only changed by the connection's own handler while holding
+	// ChatServer.clientsMtx; other goroutines must hold the lock to read it
+	username   string
+	profile    Profile
+	guest      bool
+	affinity   string
+	status     string
+	autoAway   bool
+	lastRename time.Time
+	rejections []time.Time
+	spam       spamState
+
+	// traffic counts the client's payload bytes, and roomTraffic those of
+	// the room it is in; inBucket meters it against the bandwidth cap
+	traffic     trafficCounter
+	roomTraffic *trafficCounter
+	inBucket    tokenBucket
+
+	// textOnly refuses binary frames under the frame policy
+	textOnly bool
+	// lenient ignores unknown fields under the frame policy
+	lenient bool
 }
 
 // ChatServer manages the chat service
 type ChatServer struct {
-	clients    map[*Client]bool
-	clientsMtx sync.Mutex
-	broadcast  chan Message
+	clients   map[*Client]bool
+	usernames map[string]*Client
+	// skeletons indexes the clients by usernameSkeleton under a Unicode
+	// username policy, guarded by clientsMtx
+	skeletons map[string]*Client
+	sessions  map[string]*Client
+	// subscribers are the gRPC Subscribe calls, guarded by clientsMtx
+	subscribers map[*subscriber]bool
+	clientsMtx  sync.Mutex
+	broadcast   chan Message
+	stopped     chan struct{}
+	broker      Broker
+	exporter    Exporter
+	history     *History
+	signingKey  ed25519.PrivateKey
+	instanceID  string
+	advertise   string
+	startedAt   time.Time
+	clock       Clock
+	guestNames  UsernameGenerator
+	peers       peerTable
+	seen        *seenSet
+	sequencers  *sequencers
+	batcher     batcher
+	clientIDs   *clientMsgIDs
+	observers   observers
+
+	affinityCookie string
+	affinityKey    []byte
+	usernamePolicy UsernamePolicy
+	messageLimit   int
+	adminToken     string
+	auth           Authenticator
+	oidc           *oidcProvider
+	gate           *connectionGate
+	push           PushProvider
+	bridges        []bridge
+	plugins        []*pluginHost
+	luaHook        *LuaHook
+	rules          []Rule
+	federation     []*federationLink
+	gossip         *gossip
+	previews       *previewer
+	// webhookClient delivers room webhooks to the addresses webhookAddr
+	// allows
+	webhookClient *http.Client
+	webhookAddr   func(netip.AddrPort) bool
+	spam          *spamFilter
+	matrix        *MatrixBridge
+	pushSubs      pushSubscriptions
+	bans          *BanList
+	scheduled     *Schedule
+	notices       *Notices
+	memberships   *Memberships
+	auditLog      *AuditLog
+
+	renameCooldown time.Duration
+	renameReserve  time.Duration
+	reserved       map[string]reservation
+	renames        renameLog
+
+	announcements announcementLog
+	clientErrors  clientErrorLog
+
+	shadowBans shadowBans
+
+	quarantineAfter int
+	quarantined     map[*Client]*quarantineEntry
+	quarantineMtx   sync.Mutex
+
+	// bandwidthCap is replaced whole when the config is reloaded
+	bandwidthCap atomic.Pointer[BandwidthCap]
+	config       *configReloader
+	// features are the protocol features the flags switch on or off
+	features map[string]bool
+	live     atomic.Pointer[liveSettings]
+	frames   FramePolicy
+
+	compressionMode      websocket.CompressionMode
+	compressionThreshold int
+
+	rooms           map[string]*Room
+	lobby           *Room
+	roomsMtx        sync.Mutex
+	roomIdleTimeout time.Duration
+	// roomCreators holds when each address created rooms without logging
+	// in, guarded by roomsMtx
+	roomCreators map[netip.Addr][]time.Time
+
+	clientStorage  bool
+	markdown       bool
+	sanitizer      ContentSanitizer
+	awayAfter      time.Duration
+	retentionAge   time.Duration
+	retentionCount int
+	retentionRate  int
+
+	presenceThreshold int
+	presenceGrace     presenceDebounce
+
+	broadcastQueue   int
+	broadcastTimeout time.Duration
+	capacity         int
+	fanout           fanoutLoad
+
+	canaryURL      string
+	canaryInterval time.Duration
+	canary         canaryState
+}
+
+// Option configures a ChatServer
+type Option func(*ChatServer)
+
+// WithBroker relays broadcasts through b so clients connected to other
+// instances sharing the broker receive them too
+func WithBroker(b Broker) Option {
+	return func(cs *ChatServer) {
+		cs.broker = b
+	}
 }
 
 // NewChatServer creates a new chat server instance
-func NewChatServer() *ChatServer {
-	return &ChatServer{
-		clients:   make(map[*Client]bool),
-		broadcast: make(chan Message),
+func NewChatServer(opts ...Option) *ChatServer {
+	cs := &ChatServer{
+		clients:      make(map[*Client]bool),
+		usernames:    make(map[string]*Client),
+		skeletons:    make(map[string]*Client),
+		sessions:     make(map[string]*Client),
+		subscribers:  make(map[*subscriber]bool),
+		history:      NewHistory(defaultHistorySize),
+		instanceID:   newMessageID(),
+		clock:        systemClock{},
+		guestNames:   RandomUsernames{},
+		messageLimit: maxMessageLength,
+		seen:         newSeenSet(seenSetSize),
+		sequencers:   newSequencers(),
+		batcher:      batcher{cfg: BatchConfig{Interval: defaultBatchInterval}},
+		clientIDs:    newClientMsgIDs(seenSetSize),
+		bans:         newBanList(""),
+		scheduled:    newSchedule(""),
+		notices:      newNotices(""),
+		memberships:  newMemberships(""),
+		auditLog:     &AuditLog{now: time.Now},
+		reserved:     make(map[string]reservation),
+		quarantined:  make(map[*Client]*quarantineEntry),
+		rooms:        make(map[string]*Room),
+		lobby:        &Room{Name: lobbyRoom},
+
+		frames: FramePolicy{ReadLimit: defaultFrameLimit},
+
+		renameCooldown: defaultRenameCooldown,
+		renameReserve:  defaultRenameReserve,
+
+		broadcastQueue:   defaultBroadcastQueue,
+		broadcastTimeout: defaultBroadcastTimeout,
+		capacity:         defaultCapacity,
+
+		roomIdleTimeout: defaultRoomIdleTimeout,
+		clientStorage:   true,
+		retentionRate:   defaultRetentionRate,
+
+		affinityCookie: defaultAffinityCookie,
+		webhookAddr:    publicWebAddr,
+	}
+	for _, opt := range opts {
+		opt(cs)
+	}
+	cs.startedAt = cs.now()
+	cs.webhookClient = cs.newWebhookClient()
+	cs.bans.now = cs.now
+	cs.auditLog.now = cs.now
+	cs.notices.setClock(cs.now)
+	if a, ok := cs.auth.(*WebhookAuthenticator); ok {
+		a.now = cs.now
+	}
+	if cs.previews != nil {
+		cs.previews.now = cs.now
+	}
+	cs.history.signer = cs.signingKey
+	if cs.oidc != nil {
+		cs.oidc.next = cs.auth
+		cs.auth = cs.oidc
+	}
+	cs.broadcast = make(chan Message, cs.broadcastQueue)
+	cs.stopped = make(chan struct{})
+	return cs
+}
+
+// Run starts the broadcast goroutine and background tasks. When ctx is
+// cancelled the hub delivers what is already queued, drops anything
+// published afterwards and disconnects every client.
+func (cs *ChatServer) Run(ctx context.Context) {
+	if cs.broker != nil {
+		if err := cs.broker.Subscribe(ctx, cs.receiveRemote); err != nil {
+			log.Printf("Broker subscribe failed, delivering locally only: %v", err)
+			cs.broker = nil
+		} else {
+			go cs.runHeartbeats(ctx)
+		}
+	}
+	if cs.gossip != nil {
+		if err := cs.gossip.start(ctx); err != nil {
+			log.Printf("Gossip failed to start, running without cluster membership: %v", err)
+			cs.gossip = nil
+		}
+	}
+	go cs.handleBroadcasts(ctx)
+	go cs.runBatcher(ctx)
+	go cs.runScheduler(ctx)
+	go cs.runAnnouncer(ctx)
+	if cs.canaryURL != "" {
+		go cs.runCanary(ctx)
+	}
+	if cs.retentionAge > 0 || cs.retentionCount > 0 {
+		go cs.runJanitor(ctx)
+	}
+	if cs.presenceThreshold > 0 {
+		go cs.runPresence(ctx)
+	}
+	if cs.awayAfter > 0 {
+		go cs.runAutoAway(ctx)
+	}
+	for _, b := range cs.bridges {
+		go b.run(ctx)
+	}
+	for _, h := range cs.plugins {
+		go h.run(ctx)
+	}
+	if cs.luaHook != nil {
+		go cs.luaHook.run(ctx)
+	}
+}
+
+// Done is closed once the hub has shut down
+func (cs *ChatServer) Done() <-chan struct{} {
+	return cs.stopped
+}
+
+// handleBroadcasts hands messages to their rooms' sequencers, which deliver
+// them to local clients and publish them to the broker for other
+// instances, until ctx is cancelled
+func (cs *ChatServer) handleBroadcasts(ctx context.Context) {
+	for {
+		select {
+		case msg := <-cs.broadcast:
+			cs.sequence(msg, false)
+		case <-ctx.Done():
+			cs.shutdown()
+			return
+		}
+	}
+}
+
+// relay stamps a queued message, delivers it locally and publishes it to
+// the broker
+func (cs *ChatServer) relay(msg Message) {
+	broadcastQueueDepth.Set(int64(len(cs.broadcast)))
+	start := time.Now()
+	defer func() { cs.fanout.observe(time.Since(start)) }()
+	msg.ID = msg.ackedID
+	if msg.ID == "" {
+		msg.ID = newMessageID()
+	}
+	if msg.Trace == "" {
+		msg.Trace = newTraceID()
+	}
+	msg.Origin = cs.instanceID
+	if msg.Type == "message" {
+		// Rendered HTML and previews come from the server, never the sender
+		msg.Rendered, msg.Preview = "", nil
+		if cs.markdown && msg.Ciphertext == "" {
+			msg.Rendered = renderMarkdown(msg.Content)
+		}
+	}
+	// Sanitized after rendering, which escapes on its own
+	cs.sanitizeMessage(&msg)
+	if !cs.applyRules(&msg) {
+		return
+	}
+	// Mark as seen before publishing so an echo racing back from the
+	// broker can never be delivered ahead of the local copy
+	cs.seen.Add(msg.ID)
+	cs.deliver(msg)
+	if msg.Type == "message" {
+		cs.pluginMessage(msg)
+	}
+	// Whispers are for their recipient alone, mentions or not
+	if cs.push != nil && msg.Type == "message" && msg.To == "" {
+		go cs.notifyMentions(msg)
+	}
+	// Previews are broadcast to the whole room, so whispers get none
+	if cs.previews != nil && msg.Type == "message" && msg.Ciphertext == "" && msg.To == "" {
+		go cs.sendPreview(msg)
+	}
+	// Ciphertext means nothing to bridges and webhooks, and whispers stay
+	// on this network
+	if msg.Type == "message" && msg.Ciphertext == "" && msg.To == "" {
+		cs.relayToBridges(bridgeEvent{kind: "message", username: msg.Username, room: msg.Room, content: msg.Content, id: msg.ID, via: msg.Via})
+	}
+	if msg.Type == "message" && msg.Ciphertext == "" && msg.To == "" {
+		if hooks := cs.webhooks(msg.Room); len(hooks) > 0 {
+			go postWebhooks(cs.webhookClient, hooks, msg)
+		}
+	}
+
+	// Messages for one user go to the node holding their connection when
+	// gossip knows it, rather than to every instance
+	if cs.routeDirect(msg) || cs.broker == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	err := cs.broker.Publish(ctx, msg)
+	cancel()
+	if err != nil {
+		log.Printf("Broker publish failed, message only delivered locally: %v", err)
 	}
 }
 
-// Run starts the broadcast goroutine
-func (cs *ChatServer) Run() {
-	go cs.handleBroadcasts()
+// shutdown stops the hub: it refuses new messages, delivers the ones
+// already queued and disconnects every client
+func (cs *ChatServer) shutdown() {
+	close(cs.stopped)
+	// Only the hub receives, so a non-empty queue never blocks
+	for len(cs.broadcast) > 0 {
+		cs.sequence(<-cs.broadcast, false)
+	}
+	cs.sequencers.stop()
+
+	cs.clientsMtx.Lock()
+	clients := make([]*Client, 0, len(cs.clients))
+	for client := range cs.clients {
+		if client.conn != nil || client.events != nil {
+			clients = append(clients, client)
+		}
+	}
+	cs.closeSubscribersLocked()
+	cs.clientsMtx.Unlock()
+	for _, client := range clients {
+		client.close(websocket.StatusGoingAway, "server shutting down")
+	}
+	log.Printf("Hub stopped, disconnected %d clients", len(clients))
 }
 
-// handleBroadcasts sends messages to all connected clients
-func (cs *ChatServer) handleBroadcasts() {
-	for msg := range cs.broadcast {
-		cs.clientsMtx.Lock()
-		for client := range cs.clients {
+// deliver records a message in its room's history and sends it to the
+// locally connected clients in that room
+func (cs *ChatServer) deliver(msg Message) {
+	history := cs.history
+	if msg.Room != "" {
+		room := cs.lookupRoom(msg.Room)
+		if room == nil {
+			// Rooms are local to an instance, so broadcasts from peers
+			// for rooms this one doesn't have reach nobody here
+			return
+		}
+		history = room.history
+	}
+	var erase []*History
+	switch msg.Type {
+	case "tombstone":
+		erase = cs.histories()
+		cs.unpinUser(msg.OldUsername)
+		cs.moveReads(msg.OldUsername, "")
+		cs.moveVotes(msg.OldUsername, "")
+	case "topic", "pin", "unpin", "slowmode":
+		cs.applyRoomEvent(msg)
+	case "read":
+		cs.applyRead(msg)
+	case "rename":
+		cs.moveReads(msg.OldUsername, msg.Username)
+		cs.moveVotes(msg.OldUsername, msg.Username)
+		cs.shadowBans.move(msg.OldUsername, msg.Username)
+	case "poll":
+		cs.applyPoll(msg)
+	case "preview":
+		cs.applyPreview(msg)
+	case "vote":
+		tally, ok := cs.applyVote(msg)
+		if !ok {
+			return
+		}
+		msg = tally
+	}
+
+	cs.clientsMtx.Lock()
+	defer cs.clientsMtx.Unlock()
+
+	// Sequence under the clients lock so every client sees history order.
+	// Canary probes skip history and only reach canary connections.
+	// Tombstones erase what history holds about a user, and neither they
+	// nor presence summaries, status changes, read markers, poll tallies,
+	// link previews and typing indicators are stored themselves. Neither
+	// are key envelopes directed at one member.
+	msg.Origin = ""
+	hidden := msg.Type == "canary"
+	clientMsgID := msg.ClientMsgID
+	msg.ClientMsgID = ""
+	switch {
+	case msg.Type == "tombstone":
+		for _, h := range erase {
+			h.Erase(msg.OldUsername)
+		}
+	case msg.Type == "presence" || msg.Type == "status" || msg.Type == "read" || msg.Type == "tally" || msg.Type == "preview" || msg.Type == "typing" || msg.To != "":
+	case !hidden:
+		msg = history.Append(msg)
+	}
+	global := isGlobal(msg)
+	if clientMsgID != "" {
+		cs.clientIDs.complete(msg.Username, clientMsgID, msg)
+	}
+	if !hidden {
+		cs.notify(ServerEvent{Type: EventMessage, Message: msg})
+	}
+	if !hidden && cs.batcher.batched(msg) {
+		cs.batcher.add(msg)
+		if msg.Type != "typing" {
+			cs.deliverSubscribersLocked(msg, global)
+		}
+		return
+	}
+
+	frames := encodedFrames{}
+	for client := range cs.clients {
+		if client.canary != hidden {
+			continue
+		}
+		out := msg
+		if !global && (client.roomName() != msg.Room || !msg.reaches(client.username)) {
+			continue
+		} else if global && client.room != nil {
+			// Global events are sequenced in the lobby
+			out.Seq = 0
+		}
+		if clientMsgID != "" && client.username == msg.Username {
+			out.ClientMsgID = clientMsgID
+		}
+		if (msg.Type == "read" || msg.Type == "tally" || msg.Type == "preview") && client.version == protocolV1 {
+			// Read markers, tallies and previews would only be noise as v1
+			// system notices
+			continue
+		}
+		data, err := frames.encode(client, out)
+		if err == nil {
 			// Create a context with timeout for each write
 			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-			err := wsjson.Write(ctx, client.conn, msg)
+			err = client.writeFrame(ctx, data)
 			cancel()
+		}
 
-			if err != nil {
-				log.Printf("Error sending message to client: %v", err)
-				client.conn.Close(websocket.StatusInternalError, "Failed to send message")
-				delete(cs.clients, client)
-			}
+		if err != nil {
+			log.Printf("[conn %s] Error sending message (trace %s): %v", client.id, msg.Trace, err)
+			client.close(websocket.StatusInternalError, "Failed to send message")
+			delete(cs.clients, client)
 		}
-		cs.clientsMtx.Unlock()
 	}
+	if !hidden && msg.To == "" {
+		cs.deliverSubscribersLocked(msg, global)
+	}
+}
+
+// isGlobal reports whether msg goes to every room rather than only its own
+func isGlobal(msg Message) bool {
+	return msg.Type == "rename" || msg.Type == "tombstone" || msg.Type == "presence" || msg.Type == "status"
 }
 
 // validateUsername checks if a username is valid
@@ -95,129 +715,983 @@ func (cs *ChatServer) validateUsername(username string) error {
 	if username == "" {
 		return nil // Empty username will be auto-generated
 	}
-	if len(username) > maxUsernameLength {
-		return fmt.Errorf("username too long (max %d characters)", maxUsernameLength)
+	if max := cs.usernamePolicy.maxLength(); utf8.RuneCountInString(username) > max {
+		return protocolErrorf(codeInvalidUsername, "username too long (max %d characters)", max)
 	}
-	if !validUsernameRegex.MatchString(username) {
-		return fmt.Errorf("username contains invalid characters (only letters, numbers, underscore, and hyphen allowed)")
+	if cs.usernamePolicy.Unicode {
+		if err := checkUnicode(username); err != nil {
+			return err
+		}
+	} else if !validUsernameRegex.MatchString(username) {
+		return protocolErrorf(codeInvalidUsername, "username contains invalid characters (only letters, numbers, underscore, and hyphen allowed)")
+	}
+	if cs.isPlugin(username) {
+		return protocolErrorf(codeUsernameReserved, "username %q belongs to a bot", username)
 	}
 	return nil
 }
 
 // handleConnection manages a WebSocket connection
 func (cs *ChatServer) handleConnection(w http.ResponseWriter, r *http.Request) {
-	// Validate username before upgrading connection
-	username := r.URL.Query().Get("username")
-	if err := cs.validateUsername(username); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	client := cs.admit(w, r)
+	if client == nil {
 		return
 	}
+	defer cs.leaveRoom(client.room)
 
-	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		// Allow connections from any origin for development purposes
-		InsecureSkipVerify: true,
+	cs.setRoutingHints(w)
+	w.Header().Set(connectionHeader, client.id)
+	w.Header().Set(featuresHeader, cs.enabledFeatures())
+	// Without an origin allow-list, connections are allowed from any origin
+	origins := cs.liveConfig().origins
+	c, err := websocket.Accept(countingResponseWriter{w}, r, &websocket.AcceptOptions{
+		InsecureSkipVerify:   len(origins) == 0,
+		OriginPatterns:       origins,
+		Subprotocols:         cs.subprotocols(),
+		CompressionMode:      cs.compressionMode,
+		CompressionThreshold: cs.compressionThreshold,
 	})
 	if err != nil {
+		cs.releaseUsername(client)
 		if websocket.CloseStatus(err) == websocket.StatusProtocolError {
 			http.Error(w, "Upgrade Required", http.StatusUpgradeRequired)
 		} else {
 			http.Error(w, "Bad Request", http.StatusBadRequest)
 		}
-		log.Printf("WebSocket accept error: %v", err)
+		client.logf("WebSocket accept error: %v", err)
 		return
 	}
 	defer c.CloseNow()
+	c.SetReadLimit(cs.frames.ReadLimit)
+	client.conn = c
+	client.textOnly = cs.frames.TextOnly
+	client.lenient = cs.frames.AllowUnknownFields
 
-	// Auto-generate username if not provided
-	if username == "" {
-		username = fmt.Sprintf("User-%d", time.Now().UnixNano()%10000)
+	client.version, client.codec = negotiatedProtocol(r, c)
+	if client.version == 0 {
+		cs.releaseUsername(client)
+		client.logf("Client %s offered unsupported protocol versions %q", client.username, r.Header.Get("Sec-WebSocket-Protocol"))
+		cs.rejectVersion(r.Context(), c, r.Header.Get("Sec-WebSocket-Protocol"), cs.subprotocols())
+		return
 	}
-
-	// Create a new client
-	client := &Client{
-		conn:     c,
-		username: username,
+	if client.version == protocolV1 && client.room != nil && client.room.Encrypted {
+		// v1 frames have no room for ciphertext
+		cs.releaseUsername(client)
+		c.Close(websocket.StatusPolicyViolation, "encrypted rooms require protocol v2")
+		return
 	}
 
-	// Register client
-	cs.clientsMtx.Lock()
-	cs.clients[client] = true
-	cs.clientsMtx.Unlock()
-
-	// Send welcome message
-	joinMsg := Message{
-		Type:     "system",
-		Username: "Server",
-		Content:  fmt.Sprintf("%s has joined the chat", username),
-		Time:     time.Now().Format(time.RFC3339),
-	}
-	cs.broadcast <- joinMsg
+	cs.join(r.Context(), client)
 
 	// Handle messages in a loop
 	for {
 		var msg Message
 		ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
-		err := wsjson.Read(ctx, c, &msg)
+		received := client.traffic.in.Load()
+		err := client.readMessage(ctx, &msg)
 		cancel()
+		// Whatever the client sent, the trace is ours
+		msg.Trace = newTraceID()
+		client.touch(cs.now())
+		if n := client.traffic.in.Load() - received; n > 0 && !cs.meterIn(r.Context(), client, n) {
+			break
+		}
 
+		var perr *ProtocolError
 		if websocket.CloseStatus(err) == websocket.StatusGoingAway ||
 			websocket.CloseStatus(err) == websocket.StatusNormalClosure {
-			log.Printf("Client %s disconnected gracefully", client.username)
+			client.logf("Client %s disconnected gracefully", client.username)
+			break
+		} else if errors.Is(err, errBinaryFrame) {
+			client.logf("Binary frame from %s refused (trace %s)", client.username, msg.Trace)
+			c.Close(websocket.StatusUnsupportedData, "binary frames are not accepted")
 			break
+		} else if errors.As(err, &perr) {
+			// The frame arrived intact but couldn't be decoded
+			client.logf("Bad frame from %s (trace %s): %v", client.username, msg.Trace, err)
+			cs.sendError(r.Context(), client, err, &ErrorRef{Field: perr.Field, Trace: msg.Trace})
+			cs.noteRejection(client)
+			continue
 		} else if err != nil {
-			log.Printf("WebSocket read error: %v", err)
+			client.logf("WebSocket read error: %v", err)
 			break
 		}
 
-		// Add metadata to message
-		msg.Username = client.username
-		msg.Time = time.Now().Format(time.RFC3339)
-		if msg.Type == "" {
-			msg.Type = "message"
+		cs.handleFrame(r.Context(), client, msg)
+	}
+
+	cs.leave(client)
+}
+
+// admit authenticates a connecting client, claims its username and enters
+// it in the requested room, answering with an HTTP error and returning nil
+// if any step fails. Callers leave the room once the client disconnects.
+func (cs *ChatServer) admit(w http.ResponseWriter, r *http.Request) *Client {
+	cs.trustForwarded(r)
+	if cs.rejectBanned(w, r) {
+		return nil
+	}
+	if cs.forwardSession(w, r) {
+		return nil
+	}
+	if cs.gate != nil && !cs.passGate(w, r) {
+		return nil
+	}
+
+	// With an authenticator the verified identity names the client, and
+	// guests admitted by the fallback get a generated name. A client
+	// resuming a session without naming itself gets its name back.
+	username := r.URL.Query().Get("username")
+	resume, resuming := cs.affinityToken(r, cs.now())
+	if resuming && username == "" && cs.auth == nil {
+		username = resume.Username
+	}
+	var identity *Identity
+	if cs.auth != nil {
+		if identity = cs.authenticate(w, r); identity == nil {
+			return nil
 		}
+		username = identity.Username
+	}
 
-		// Validate message
-		if err := msg.Validate(); err != nil {
-			log.Printf("Invalid message from %s: %v", client.username, err)
-			continue
+	// Validate username before upgrading connection
+	username = cs.usernamePolicy.normalize(username)
+	if err := cs.validateUsername(username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if (identity == nil || identity.Guest) && username != "" && cs.usernamePolicy.reserved(username) {
+		http.Error(w, fmt.Sprintf("username %q is reserved", username), http.StatusConflict)
+		return nil
+	}
+
+	// Claim the username (auto-generated if not provided) before upgrading
+	// so a clash can still be reported as a plain HTTP error
+	client := &Client{id: newConnectionID(), remoteAddr: r.RemoteAddr, canary: r.Header.Get(canaryHeader) != ""}
+	if identity != nil {
+		client.roles = identity.Roles
+		client.authenticated = !identity.Guest
+		client.profile.DisplayName = identity.DisplayName
+	}
+	client.touch(cs.now())
+	if username == "" {
+		client.guest = true
+		username = cs.claimGeneratedUsername(client)
+	} else if err := cs.claimUsername(username, client); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return nil
+	}
+	client.username = username
+	resuming = resuming && resume.Username == username && !client.canary
+	if resuming {
+		client.guest = resume.Guest
+		metrics.Add(metricSessionsResumed, 1)
+	}
+
+	// Resumed sessions that don't ask for a room go back to theirs, and
+	// authenticated users to the room they were last in
+	var room *Room
+	var err error
+	if resuming && !r.URL.Query().Has("room") {
+		room = cs.resumeRoom(resume.Room)
+	} else if client.authenticated && !client.canary && !r.URL.Query().Has("room") {
+		room = cs.reenterRoom(username)
+	} else {
+		room, err = cs.enterRoom(r.URL.Query().Get("room"), r.URL.Query().Get("password"), r.URL.Query().Get("invite"))
+	}
+	if err != nil {
+		cs.releaseUsername(client)
+		if errors.Is(err, errRoomNotFound) && cs.misdirect(w, r.URL.Query().Get("room")) {
+			return nil
 		}
+		http.Error(w, err.Error(), roomStatus(err))
+		return nil
+	}
+	client.room = room
+	client.roomTraffic = &cs.lobby.traffic
+	if room != nil {
+		client.roomTraffic = &room.traffic
+	}
+	if client.affinity = cs.issueAffinity(client, cs.now()); client.affinity != "" {
+		w.Header().Set(affinityHeader, client.affinity)
+	}
+	return client
+}
+
+// join registers an admitted client, sends it the room's state and
+// announces it
+func (cs *ChatServer) join(ctx context.Context, client *Client) {
+	cs.clientsMtx.Lock()
+	cs.clients[client] = true
+	info := client.infoLocked()
+	cs.clientsMtx.Unlock()
+	if !client.canary {
+		cs.notify(ServerEvent{Type: EventJoin, Client: info})
+	}
+	if client.room != nil {
+		client.logf("Client %s connected from %s to room %s", client.username, client.remoteAddr, client.room.Name)
+	} else {
+		client.logf("Client %s connected from %s", client.username, client.remoteAddr)
+	}
+
+	cs.sendHello(ctx, client)
+	cs.sendRoomState(ctx, client)
+	cs.sendAffinity(ctx, client)
+	cs.rememberRoom(client)
+	cs.sendMembershipStates(ctx, client)
+	cs.sendUnreadSummary(ctx, client)
+	cs.sendMOTD(ctx, client)
+	cs.noteSpamJoin(ctx, client)
+
+	// Send welcome message, unless the room is too large to announce
+	// every join or the client is back within the presence grace period
+	now := cs.now()
+	rejoined := false
+	if !client.canary {
+		cs.export(ExportJoin, client.username, "", now)
+		rejoined = cs.presenceGrace.rejoin(client.roomName(), client.username)
+	}
+	if !client.canary && client.room == nil && cs.largeRoom(nil) {
+		cs.welcomeToLargeRoom(ctx, client)
+	} else if !client.canary && !rejoined {
+		joinMsg := Message{
+			Type:      "system",
+			Username:  "Server",
+			Content:   fmt.Sprintf("%s has joined the chat", client.username),
+			Time:      now.Format(time.RFC3339),
+			Timestamp: now.UnixMilli(),
+			Room:      client.roomName(),
+		}
+		cs.publish(joinMsg)
+	}
+	if !client.canary && !rejoined {
+		cs.relayToBridges(bridgeEvent{kind: "join", username: client.username, room: client.roomName()})
+	}
+	if !client.canary {
+		cs.pluginPresence(true, client.username, client.roomName())
+	}
+}
+
+// handleFrame handles one decoded frame. A panic is logged and reported to
+// the client as an internal error, so one bad frame can't end the
+// connection or the server.
+func (cs *ChatServer) handleFrame(ctx context.Context, client *Client, msg Message) {
+	defer func() {
+		if p := recover(); p != nil {
+			metrics.Add(metricFramePanics, 1)
+			client.logf("Panic handling %s frame from %s (trace %s): %v\n%s", msg.Type, client.username, msg.Trace, p, debug.Stack())
+			cs.sendError(ctx, client, protocolErrorf(codeInternal, "internal error"), &ErrorRef{Type: msg.Type, Trace: msg.Trace})
+		}
+	}()
+	cs.handleMessage(ctx, client, msg)
+}
+
+// handleMessage acts on one decoded message from a client, whichever
+// transport it arrived on
+func (cs *ChatServer) handleMessage(ctx context.Context, client *Client, msg Message) {
+	if client.canary {
+		cs.handleCanaryMessage(ctx, client, msg)
+		return
+	}
+	if cs.spoofed(ctx, client, msg) {
+		return
+	}
+	if err := checkType(msg); err != nil {
+		client.logf("Invalid message from %s (trace %s): %v", client.username, msg.Trace, err)
+		ref := refFor(msg)
+		ref.Field = err.Field
+		cs.sendError(ctx, client, err, ref)
+		cs.noteRejection(client)
+		return
+	}
+	if msg.Type == "status" {
+		cs.handleStatus(ctx, client, msg)
+		return
+	}
+	cs.wake(client)
+	switch msg.Type {
+	case "history":
+		cs.sendHistory(ctx, client, msg)
+		return
+	case "roster":
+		cs.sendRoster(ctx, client, msg)
+		return
+	case "profile":
+		cs.handleProfile(ctx, client, msg)
+		return
+	case "read":
+		if !cs.requireFeature(ctx, client, msg, featureReads) {
+			cs.handleRead(ctx, client, msg)
+		}
+		return
+	case "part":
+		cs.handlePart(client, msg)
+		return
+	case "client_error":
+		cs.handleClientError(client, msg)
+		return
+	case "unschedule":
+		cs.handleUnschedule(ctx, client, msg)
+		return
+	case "poll":
+		if !cs.requireFeature(ctx, client, msg, featurePolls) && !cs.refusePost(ctx, client, msg) {
+			cs.handlePoll(ctx, client, msg)
+		}
+		return
+	case "vote":
+		if !cs.requireFeature(ctx, client, msg, featurePolls) {
+			cs.handleVote(ctx, client, msg)
+		}
+		return
+	case "capabilities":
+		cs.sendCapabilities(ctx, client)
+		return
+	case "typing":
+		cs.handleTyping(client)
+		return
+	}
+
+	if newName, ok := parseRename(msg); ok {
+		cs.handleRename(ctx, client, newName, msg.Trace)
+		return
+	}
+
+	// Add metadata to message
+	now := cs.now()
+	msg.Username = client.username
+	msg.Room = client.roomName()
+	msg.Time = now.Format(time.RFC3339)
+	msg.Timestamp = now.UnixMilli()
+	msg.Bot, msg.Tags, msg.RoutedFrom, msg.Via = false, nil, "", nil
+	if msg.Type == "" {
+		msg.Type = "message"
+	}
 
-		// Broadcast message to all clients
-		cs.broadcast <- msg
+	if cs.resendDuplicate(ctx, client, msg) {
+		return
 	}
 
-	// Remove client on disconnect
+	// Validate message
+	if err := msg.validateIn(client.room, cs.messageLimit); err != nil {
+		client.logf("Invalid message from %s (trace %s): %v", msg.Username, msg.Trace, err)
+		cs.sendError(ctx, client, err, refFor(msg))
+		cs.noteRejection(client)
+		return
+	}
+	// Key envelopes let members read an encrypted room, so they aren't
+	// posts
+	if msg.Type != "key" && cs.refusePost(ctx, client, msg) {
+		return
+	}
+	if msg.Type == "message" && msg.Ciphertext == "" && !cs.scriptMessage(ctx, client, &msg) {
+		return
+	}
+	if msg.Type == "message" && msg.Ciphertext == "" {
+		if word := cs.bannedWord(msg.Content); word != "" {
+			client.logf("Banned word %q from %s (trace %s)", word, client.username, msg.Trace)
+			cs.sendError(ctx, client, protocolErrorf(codeRejected, "message contains a banned word"), refFor(msg))
+			cs.noteRejection(client)
+			return
+		}
+	}
+	if msg.Type == "message" && msg.Ciphertext == "" && cs.checkSpam(ctx, client, msg) {
+		return
+	}
+	if msg.Type == "message" && msg.DeliverAt == "" && cs.checkSlowMode(ctx, client, msg) {
+		return
+	}
+	if cs.hold(ctx, client, msg) || cs.shadowDrop(ctx, client, msg) {
+		return
+	}
+	if msg.Type == "message" && msg.DeliverAt == "" && cs.dispatchCommand(client, msg) {
+		return
+	}
+	if msg.DeliverAt != "" {
+		if !cs.requireFeature(ctx, client, msg, featureScheduled) {
+			cs.handleSchedule(ctx, client, msg, now)
+		}
+		return
+	}
+
+	// Broadcast message to all clients
+	cs.clientIDs.claim(msg.Username, msg.ClientMsgID, now)
+	cs.export(ExportMessage, msg.Username, msg.Content, now)
+	cs.publishFrom(ctx, client, msg)
+}
+
+// leave unregisters a disconnected client and announces it
+func (cs *ChatServer) leave(client *Client) {
+	client.taps.close()
+	cs.release(client)
 	cs.clientsMtx.Lock()
 	delete(cs.clients, client)
+	cs.dropNameLocked(client.username, client)
+	username := client.username
+	info := client.infoLocked()
 	cs.clientsMtx.Unlock()
+	if client.canary {
+		return
+	}
+	cs.notify(ServerEvent{Type: EventLeave, Client: info})
+	cs.export(ExportLeave, username, "", cs.now())
+	cs.pluginPresence(false, username, client.roomName())
+
+	// Send leave message, once the user hasn't come straight back
+	announce := func() {
+		cs.relayToBridges(bridgeEvent{kind: "leave", username: username, room: client.roomName()})
+		if client.room == nil && cs.largeRoom(nil) {
+			return
+		}
+		now := cs.now()
+		leaveMsg := Message{
+			Type:      "system",
+			Username:  "Server",
+			Content:   fmt.Sprintf("%s has left the chat", username),
+			Time:      now.Format(time.RFC3339),
+			Timestamp: now.UnixMilli(),
+			Room:      client.roomName(),
+		}
+		cs.publish(leaveMsg)
+	}
+	if !cs.presenceGrace.hold(client.roomName(), username, announce) {
+		announce()
+	}
+}
+
+// sendHistory answers a client's history request with a page of past messages
+func (cs *ChatServer) sendHistory(ctx context.Context, client *Client, req Message) {
+	history := cs.history
+	if client.room != nil {
+		history = client.room.history
+	}
+	page := history.Before(req.BeforeSeq, clampHistoryLimit(req.Limit))
+	page.Type = "history"
 
-	// Send leave message
-	leaveMsg := Message{
-		Type:     "system",
-		Username: "Server",
-		Content:  fmt.Sprintf("%s has left the chat", username),
-		Time:     time.Now().Format(time.RFC3339),
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	if err := client.writeHistory(ctx, page); err != nil {
+		client.logf("Error sending history to %s: %v", client.username, err)
 	}
-	cs.broadcast <- leaveMsg
 }
 
 func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	adminAddr := flag.String("admin-addr", "", "separate address for the admin API, metrics and pprof, e.g. 127.0.0.1:9090 (empty serves admin and metrics on -addr, without pprof)")
+	brokerURL := flag.String("broker", "", "cross-instance broker URL, e.g. nats://localhost:4222 (empty runs standalone)")
+	kafkaBrokers := flag.String("kafka", "", "comma-separated Kafka brokers to export chat activity to (empty disables export)")
+	kafkaTopic := flag.String("kafka-topic", "chat-events", "Kafka topic for exported chat activity")
+	historySize := flag.Int("history", defaultHistorySize, "number of recent messages kept for history requests")
+	retentionAge := flag.Duration("retention-age", 0, "delete stored messages older than this (0 keeps them until they are pushed out)")
+	retentionRate := flag.Int("retention-rate", defaultRetentionRate, "maximum messages pruned per second by the retention janitor (0 is unlimited)")
+	presenceGrace := flag.Duration("presence-grace", 0, "hold back leave notices this long and drop them, and the join notice, when the user reconnects in time (0 announces at once)")
+	batchInterval := flag.Duration("batch-interval", defaultBatchInterval, "how often typing indicators, and with -batch-presence presence churn, are sent as one batch frame per room")
+	batchPresence := flag.Bool("batch-presence", false, "batch join and leave notices and status changes with typing indicators")
+	presenceThreshold := flag.Int("presence-threshold", 0, "room size from which joins and leaves are summarized instead of announced (0 always announces)")
+	clientStorage := flag.Bool("client-storage", true, "tell clients they may store message content locally")
+	plugins := flag.String("plugins", "", "comma-separated in-process bots to run, each optionally name=settings, e.g. welcome=Hi {user}!,dice,reminder")
+	wasmPlugins := flag.String("wasm-plugins", "", "comma-separated WebAssembly plugin files to run sandboxed, each named after its file")
+	wasmMemory := flag.Int("wasm-memory-mb", defaultWASMMemory>>20, "most memory, in MiB, a WASM plugin may use")
+	wasmTimeout := flag.Duration("wasm-timeout", defaultWASMTimeout, "how long a WASM plugin may run for one event before it is stopped and restarted")
+	federationFile := flag.String("federation", "", "JSON file linking rooms with independently run servers, which connect to /federation")
+	configFile := flag.String("config", "", "JSON file of settings that can change live: bandwidth limits, banned words, allowed origins, the MOTD and features, reloaded on SIGHUP or POST /admin/reload")
+	featureList := flag.String("features", "", "protocol features to switch on or off, e.g. polls=off,e2ee=off (known: e2ee, polls, reads, scheduled; all on by default)")
+	rulesFile := flag.String("rules", "", "JSON file of rules that tag, route, forward or drop messages as they are broadcast")
+	luaScript := flag.String("lua-script", "", "Lua script whose on_message(msg) may rewrite, tag or reject inbound chat messages, reloaded when the file changes")
+	markdown := flag.Bool("markdown", false, "render a safe Markdown subset of chat messages into sanitized HTML in the rendered field")
+	retentionCount := flag.Int("retention-count", 0, "maximum number of stored messages (0 uses -history)")
+	instanceID := flag.String("instance-id", "", "stable identity of this instance in a cluster (default host name and port)")
+	gossipBind := flag.String("cluster-bind", "", "host:port to gossip cluster membership on, e.g. :7946 (empty disables gossip)")
+	gossipAdvertise := flag.String("cluster-advertise", "", "ip:port other nodes reach this one's gossip at (default the bind address)")
+	gossipJoin := flag.String("cluster-join", "", "comma-separated gossip addresses of nodes to join the cluster through")
+	gossipKey := flag.String("cluster-key", "", "base64 key of 16, 24 or 32 bytes encrypting gossip")
+	advertise := flag.String("advertise", "", "URL clients should use to reach this instance, reported in /api/cluster")
+	adminToken := flag.String("admin-token", os.Getenv("CHAT_ADMIN_TOKEN"), "bearer token for the /admin API (empty disables it; defaults to $CHAT_ADMIN_TOKEN)")
+	gate := flag.String("gate", "none", "anti-bot check before accepting connections: none, captcha or pow")
+	gateKey := flag.String("gate-key", os.Getenv("CHAT_GATE_KEY"), "key signing proof-of-work challenges, shared by instances behind one address (defaults to $CHAT_GATE_KEY; empty generates one)")
+	powDifficulty := flag.Int("pow-difficulty", defaultPoWDifficulty, "leading zero bits a proof-of-work solution needs with -gate pow")
+	captchaURL := flag.String("captcha-verify-url", "", "CAPTCHA siteverify endpoint with -gate captcha, e.g. https://hcaptcha.com/siteverify")
+	captchaSecret := flag.String("captcha-secret", os.Getenv("CHAT_CAPTCHA_SECRET"), "CAPTCHA provider secret (defaults to $CHAT_CAPTCHA_SECRET)")
+	maxFrameBytes := flag.Int64("max-frame-bytes", defaultFrameLimit, "largest frame a client may send; larger frames close the connection with 1009")
+	textOnly := flag.Bool("text-frames-only", false, "refuse binary frames and don't offer the msgpack subprotocol")
+	allowUnknownFields := flag.Bool("allow-unknown-fields", false, "ignore frame fields the published schema doesn't have instead of refusing the frame")
+	bandwidthCap := flag.Int64("bandwidth-cap", 0, "bytes per second each client may send (0 disables the cap)")
+	bandwidthBurst := flag.Int64("bandwidth-burst", 0, "bytes a client may send at once under -bandwidth-cap (0 allows five seconds' worth)")
+	bandwidthAction := flag.String("bandwidth-action", "throttle", "what happens to clients over -bandwidth-cap: throttle or disconnect")
+	spamFilter := flag.Bool("spam-filter", false, "score clients for duplicate bursts, link floods and join/leave cycling, escalating from a warning to slow mode, a mute and a disconnect")
+	sanitize := flag.String("sanitize", "none", "HTML in chat message and poll content: none, escape (show markup as text) or strip (remove tags)")
+	compression := flag.String("compression", "disabled", "permessage-deflate mode: disabled, context-takeover or no-context-takeover")
+	compressionThreshold := flag.Int("compression-threshold", 0, "minimum message size in bytes to compress (0 uses the library default)")
+	canaryURL := flag.String("canary", "", "public WebSocket URL for the built-in canary to probe, e.g. ws://localhost:8080/ws (empty disables)")
+	canaryInterval := flag.Duration("canary-interval", time.Second*10, "how often the canary sends a probe")
+	auditFile := flag.String("audit-file", "", "append-only JSON lines file recording moderation and admin actions (empty keeps it in memory)")
+	banFile := flag.String("ban-file", "", "JSON file the IP ban list is persisted to (empty keeps it in memory)")
+	noticesFile := flag.String("notices-file", "", "JSON file the message of the day and recurring announcements are persisted to (empty keeps them in memory)")
+	membershipsFile := flag.String("memberships-file", "", "JSON file the rooms authenticated users have joined are persisted to, so reconnects restore them (empty keeps them in memory)")
+	scheduleFile := flag.String("schedule-file", "", "JSON file scheduled messages are persisted to, so they survive restarts (empty keeps them in memory)")
+	autoBanStrikes := flag.Int("autoban-strikes", 0, "abuse strikes within -autoban-window that trigger a temporary ban (0 disables)")
+	autoBanWindow := flag.Duration("autoban-window", time.Minute, "window in which abuse strikes are counted")
+	autoBanDuration := flag.Duration("autoban-duration", time.Minute*15, "how long automatic bans last")
+	unicodeUsernames := flag.Bool("unicode-usernames", false, "allow usernames in any script, not just ASCII letters and digits")
+	reservedUsernames := flag.String("reserved-usernames", "", "comma-separated usernames only logged-in clients may use, on top of admin, server and system")
+	maxUsernameRunes := flag.Int("max-username-length", maxUsernameLength, "longest username allowed, in characters")
+	maxMessageRunes := flag.Int("max-message-length", maxMessageLength, "longest message clients may send, in characters")
+	guestNameStyle := flag.String("guest-names", "random", "how to name clients that connect without a username: random (User-7KQ2XM) or words (Quiet-Otter)")
+	renameCooldown := flag.Duration("rename-cooldown", defaultRenameCooldown, "minimum time between renames by one connection (0 disables)")
+	quarantineAfter := flag.Int("quarantine-after", 0, "rejected messages within a minute that put a client in quarantine (0 disables)")
+	awayAfter := flag.Duration("away-after", 0, "mark clients away after this long without sending anything (0 disables)")
+	renameReserve := flag.Duration("rename-reserve", defaultRenameReserve, "how long a name given up through a rename stays reserved (0 disables)")
+	roomIdleTimeout := flag.Duration("room-idle-timeout", defaultRoomIdleTimeout, "how long an empty ephemeral room is kept before it is deleted")
+	authWebhook := flag.String("auth-webhook", "", "URL that verifies client tokens and returns their identity (empty allows anonymous clients)")
+	authCacheTTL := flag.Duration("auth-cache-ttl", defaultAuthCacheTTL, "how long verified identities are cached")
+	authFallback := flag.String("auth-fallback", AuthFallbackDeny, "what to do when -auth-webhook fails: deny, stale (use an expired cached identity) or guest")
+	oidcIssuer := flag.String("oidc-issuer", "", "OpenID Connect issuer URL users log in through at /auth/login (empty disables logging in)")
+	oidcClientID := flag.String("oidc-client-id", "", "client ID registered with the OpenID Connect provider")
+	oidcClientSecret := flag.String("oidc-client-secret", os.Getenv("CHAT_OIDC_CLIENT_SECRET"), "client secret registered with the OpenID Connect provider (defaults to $CHAT_OIDC_CLIENT_SECRET)")
+	oidcRedirectURL := flag.String("oidc-redirect-url", "", "this server's /auth/callback URL, as registered with the provider")
+	oidcScopes := flag.String("oidc-scopes", "profile", "comma-separated scopes requested on top of openid")
+	oidcUsernameClaim := flag.String("oidc-username-claim", "preferred_username", "ID token claim mapped to the username")
+	oidcNameClaim := flag.String("oidc-name-claim", "name", "ID token claim mapped to the display name")
+	oidcRolesClaim := flag.String("oidc-roles-claim", "roles", "ID token claim mapped to the roles")
+	oidcSessionKey := flag.String("oidc-session-key", os.Getenv("CHAT_OIDC_SESSION_KEY"), "key signing session tokens, shared by every instance (defaults to $CHAT_OIDC_SESSION_KEY; empty generates one)")
+	oidcSessionTTL := flag.Duration("oidc-session-ttl", defaultSessionTTL, "how long a session token from a login lets its holder connect")
+	broadcastQueue := flag.Int("broadcast-queue", defaultBroadcastQueue, "messages that may wait for delivery before publishers have to wait for room")
+	broadcastTimeout := flag.Duration("broadcast-timeout", defaultBroadcastTimeout, "how long a publisher waits on a full broadcast queue before the message is dropped")
+	capacity := flag.Int("capacity", defaultCapacity, "connections this instance is sized for, the point where /api/load reports full load")
+	signingKey := flag.String("signing-key", "", "PEM file with an Ed25519 private key (PKCS #8) to sign and hash-chain stored messages with (empty disables signing)")
+	linkPreviews := flag.Bool("link-previews", false, "fetch OpenGraph metadata for links in messages and broadcast it as previews")
+	previewAllow := flag.String("preview-allow", "", "comma-separated domains link previews are limited to (empty allows any public host)")
+	previewDeny := flag.String("preview-deny", "", "comma-separated domains never fetched for link previews")
+	previewTimeout := flag.Duration("preview-timeout", defaultPreviewTimeout, "how long a link preview fetch may take")
+	vapidKey := flag.String("vapid-key", "", "PEM file with the VAPID key for Web Push notifications, created if missing (empty disables push)")
+	vapidSubject := flag.String("vapid-subject", "", "contact URL push services can reach the operator at, e.g. mailto:ops@example.com")
+	matrixHomeserver := flag.String("matrix-homeserver", "", "Matrix homeserver URL to bridge rooms to (empty disables the bridge)")
+	matrixServerName := flag.String("matrix-server-name", "", "the Matrix homeserver's domain, as in @user:domain")
+	matrixRooms := flag.String("matrix-rooms", "", "rooms to bridge, e.g. lobby=!abc:example.org,rust=!def:example.org")
+	matrixASToken := flag.String("matrix-as-token", os.Getenv("CHAT_MATRIX_AS_TOKEN"), "application service as_token (defaults to $CHAT_MATRIX_AS_TOKEN)")
+	matrixHSToken := flag.String("matrix-hs-token", os.Getenv("CHAT_MATRIX_HS_TOKEN"), "application service hs_token (defaults to $CHAT_MATRIX_HS_TOKEN)")
+	xmppComponent := flag.String("xmpp-component", "", "XMPP server component address to bridge rooms to, e.g. localhost:5347 (empty disables the bridge)")
+	xmppDomain := flag.String("xmpp-domain", "", "the bridge's XMPP component domain, e.g. chat.example.org")
+	xmppRooms := flag.String("xmpp-rooms", "", "rooms to bridge, e.g. lobby=ops@conference.example.org")
+	xmppSecret := flag.String("xmpp-secret", os.Getenv("CHAT_XMPP_SECRET"), "XMPP component secret (defaults to $CHAT_XMPP_SECRET)")
+	mqttBroker := flag.String("mqtt-broker", "", "MQTT broker URL to bridge rooms to, e.g. tcp://localhost:1883 (empty disables the bridge)")
+	mqttSubscribe := flag.String("mqtt-subscribe", "", "MQTT topic filters whose payloads are posted to rooms, e.g. alerts/#=ops,sensors/+/alarm=lobby")
+	mqttPublish := flag.String("mqtt-publish", "", "MQTT topics room messages are published to, e.g. chat/ops=ops")
+	mqttBot := flag.String("mqtt-bot", mqttDefaultBot, "username MQTT payloads are posted as")
+	mqttQoS := flag.Uint("mqtt-qos", 1, "MQTT quality of service for subscriptions and publishes (0-2)")
+	mqttUsername := flag.String("mqtt-username", "", "MQTT broker username")
+	mqttPassword := flag.String("mqtt-password", os.Getenv("CHAT_MQTT_PASSWORD"), "MQTT broker password (defaults to $CHAT_MQTT_PASSWORD)")
+	grpcAddr := flag.String("grpc-addr", "", "address for the gRPC API, e.g. :9000 (empty disables it; needs -admin-token, -auth-webhook or -oidc-issuer)")
+	affinitySecret := flag.String("affinity-secret", os.Getenv("CHAT_AFFINITY_SECRET"), "key signing session affinity tokens, shared by every instance, so reconnects are forwarded to or resumed from the instance that served them (defaults to $CHAT_AFFINITY_SECRET; empty disables tokens)")
+	affinityCookie := flag.String("affinity-cookie", defaultAffinityCookie, "cookie naming the serving instance for sticky load balancing (empty disables)")
+	flag.Parse()
+
+	if *instanceID == "" {
+		*instanceID = defaultInstanceID(*addr)
+	}
+	compressionMode, err := parseCompressionMode(*compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	guestNames, err := parseUsernameGenerator(*guestNameStyle)
+	if err != nil {
+		log.Fatal(err)
+	}
+	usernamePolicy := UsernamePolicy{Unicode: *unicodeUsernames, MaxLength: *maxUsernameRunes}
+	if *reservedUsernames != "" {
+		usernamePolicy.Reserved = strings.Split(*reservedUsernames, ",")
+	}
+	sanitizeMode, err := parseSanitizeMode(*sanitize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gateMode, err := parseGateMode(*gate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	features, err := parseFeatures(*featureList)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if gateMode == GateCaptcha && *captchaURL == "" {
+		log.Fatal("-gate captcha needs -captcha-verify-url")
+	}
+	if err := checkFrameLimit(*maxFrameBytes); err != nil {
+		log.Fatal(err)
+	}
+	if *bandwidthAction != "throttle" && *bandwidthAction != "disconnect" {
+		log.Fatalf("unknown bandwidth action %q (want throttle or disconnect)", *bandwidthAction)
+	}
+	bans, err := NewBanList(*banFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bans.AutoBan(*autoBanStrikes, *autoBanWindow, *autoBanDuration)
+	schedule, err := NewSchedule(*scheduleFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	notices, err := NewNotices(*noticesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	memberships, err := NewMemberships(*membershipsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bots, err := NewPlugins(*plugins)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for path := range strings.SplitSeq(*wasmPlugins, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		p, err := NewWASMPlugin(context.Background(), path, WASMLimits{Memory: uint32(*wasmMemory) << 20, Timeout: *wasmTimeout})
+		if err != nil {
+			log.Fatal(err)
+		}
+		bots = append(bots, p)
+	}
+	auditLog, err := NewAuditLog(*auditFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer auditLog.Close()
+	opts := []Option{
+		WithFeatures(features),
+		WithBanList(bans),
+		WithSchedule(schedule),
+		WithNotices(notices),
+		WithMemberships(memberships),
+		WithPlugins(bots...),
+		WithAuditLog(auditLog),
+		WithHistorySize(*historySize),
+		WithRetention(*retentionAge, *retentionCount),
+		WithRetentionRate(*retentionRate),
+		WithClientStorage(*clientStorage),
+		WithMarkdown(*markdown),
+		WithContentSanitizer(sanitizeMode),
+		WithFramePolicy(FramePolicy{ReadLimit: *maxFrameBytes, TextOnly: *textOnly, AllowUnknownFields: *allowUnknownFields}),
+		WithBandwidthCap(BandwidthCap{BytesPerSecond: *bandwidthCap, Burst: *bandwidthBurst, Disconnect: *bandwidthAction == "disconnect"}),
+		WithPresenceThreshold(*presenceThreshold),
+		WithPresenceGrace(*presenceGrace),
+		WithBatching(BatchConfig{Interval: *batchInterval, Presence: *batchPresence}),
+		WithInstanceID(*instanceID),
+		WithAdvertiseURL(*advertise),
+		WithAffinityCookie(*affinityCookie),
+		WithAdminToken(*adminToken),
+		WithCompression(compressionMode, *compressionThreshold),
+		WithCanary(*canaryURL, *canaryInterval),
+		WithRenameLimits(*renameCooldown, *renameReserve),
+		WithUsernameGenerator(guestNames),
+		WithUsernamePolicy(usernamePolicy),
+		WithMessageLimit(*maxMessageRunes),
+		WithAutoQuarantine(*quarantineAfter),
+		WithRoomIdleTimeout(*roomIdleTimeout),
+		WithAutoAway(*awayAfter),
+		WithBroadcastQueue(*broadcastQueue, *broadcastTimeout),
+		WithCapacity(*capacity),
+	}
+	if *affinitySecret != "" {
+		opts = append(opts, WithAffinityTokens([]byte(*affinitySecret)))
+	}
+	if *gossipBind != "" {
+		key, err := base64.StdEncoding.DecodeString(*gossipKey)
+		if err != nil || !slices.Contains([]int{0, 16, 24, 32}, len(key)) {
+			log.Fatal("-cluster-key must be base64 of 16, 24 or 32 bytes")
+		}
+		cfg := GossipConfig{Bind: *gossipBind, Advertise: *gossipAdvertise, Key: key}
+		if *gossipJoin != "" {
+			cfg.Join = strings.Split(*gossipJoin, ",")
+		}
+		opts = append(opts, WithGossip(cfg))
+	}
+	if *authWebhook != "" {
+		auth, err := NewWebhookAuthenticator(*authWebhook, *authCacheTTL, *authFallback)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, WithAuthenticator(auth))
+		log.Printf("Verifying client tokens with %s", *authWebhook)
+	}
+	if *oidcIssuer != "" {
+		if *oidcClientID == "" || *oidcRedirectURL == "" {
+			log.Fatal("-oidc-issuer needs -oidc-client-id and -oidc-redirect-url")
+		}
+		opts = append(opts, WithOIDC(OIDCConfig{
+			Issuer:           *oidcIssuer,
+			ClientID:         *oidcClientID,
+			ClientSecret:     *oidcClientSecret,
+			RedirectURL:      *oidcRedirectURL,
+			Scopes:           strings.Split(*oidcScopes, ","),
+			UsernameClaim:    *oidcUsernameClaim,
+			DisplayNameClaim: *oidcNameClaim,
+			RolesClaim:       *oidcRolesClaim,
+			SessionKey:       []byte(*oidcSessionKey),
+			SessionTTL:       *oidcSessionTTL,
+		}))
+		log.Printf("Logging users in through %s", *oidcIssuer)
+	}
+	if *signingKey != "" {
+		key, err := LoadSigningKey(*signingKey)
+		if err != nil {
+			log.Fatalf("Signing key: %v", err)
+		}
+		opts = append(opts, WithSigningKey(key))
+		log.Printf("Signing stored messages, public key at /api/signing-key")
+	}
+	if *linkPreviews {
+		cfg := PreviewConfig{Timeout: *previewTimeout}
+		if *previewAllow != "" {
+			cfg.Allow = strings.Split(*previewAllow, ",")
+		}
+		if *previewDeny != "" {
+			cfg.Deny = strings.Split(*previewDeny, ",")
+		}
+		opts = append(opts, WithLinkPreviews(cfg))
+	}
+	if *rulesFile != "" {
+		rules, err := LoadRules(*rulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, WithRules(rules))
+	}
+	if *federationFile != "" {
+		cfg, err := LoadFederation(*federationFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, WithFederation(cfg))
+	}
+	if *luaScript != "" {
+		hook, err := NewLuaHook(*luaScript)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, WithLuaHook(hook))
+	}
+	if *spamFilter {
+		opts = append(opts, WithSpamFilter(DefaultSpamConfig()))
+	}
+	if gateMode != "" {
+		opts = append(opts, WithConnectionGate(GateConfig{
+			Mode:          gateMode,
+			Key:           []byte(*gateKey),
+			Difficulty:    *powDifficulty,
+			CaptchaURL:    *captchaURL,
+			CaptchaSecret: *captchaSecret,
+		}))
+	}
+	if *vapidKey != "" {
+		key, err := LoadVAPIDKey(*vapidKey)
+		if err != nil {
+			log.Fatalf("VAPID key: %v", err)
+		}
+		opts = append(opts, WithPush(NewWebPushProvider(key, *vapidSubject)))
+	}
+	if *matrixHomeserver != "" {
+		rooms, err := ParseMatrixRooms(*matrixRooms)
+		if err != nil {
+			log.Fatalf("Matrix bridge: %v", err)
+		}
+		bridge, err := NewMatrixBridge(MatrixConfig{
+			Homeserver: *matrixHomeserver,
+			ServerName: *matrixServerName,
+			ASToken:    *matrixASToken,
+			HSToken:    *matrixHSToken,
+			Rooms:      rooms,
+		})
+		if err != nil {
+			log.Fatalf("Matrix bridge: %v", err)
+		}
+		opts = append(opts, WithMatrixBridge(bridge))
+		log.Printf("Bridging %d rooms to %s", len(rooms), *matrixHomeserver)
+	}
+	if *xmppComponent != "" {
+		rooms, err := ParseXMPPRooms(*xmppRooms)
+		if err != nil {
+			log.Fatalf("XMPP bridge: %v", err)
+		}
+		bridge, err := NewXMPPBridge(XMPPConfig{
+			Addr:   *xmppComponent,
+			Domain: *xmppDomain,
+			Secret: *xmppSecret,
+			Rooms:  rooms,
+		})
+		if err != nil {
+			log.Fatalf("XMPP bridge: %v", err)
+		}
+		opts = append(opts, WithXMPPBridge(bridge))
+		log.Printf("Bridging %d rooms to XMPP via %s", len(rooms), *xmppComponent)
+	}
+	if *mqttBroker != "" {
+		subscribe, err := ParseMQTTTopics(*mqttSubscribe)
+		if err != nil {
+			log.Fatalf("MQTT bridge: %v", err)
+		}
+		publish, err := ParseMQTTTopics(*mqttPublish)
+		if err != nil {
+			log.Fatalf("MQTT bridge: %v", err)
+		}
+		bridge, err := NewMQTTBridge(MQTTConfig{
+			Broker:    *mqttBroker,
+			Username:  *mqttUsername,
+			Password:  *mqttPassword,
+			Bot:       *mqttBot,
+			Subscribe: subscribe,
+			Publish:   publish,
+			QoS:       byte(*mqttQoS),
+		})
+		if err != nil {
+			log.Fatalf("MQTT bridge: %v", err)
+		}
+		opts = append(opts, WithMQTTBridge(bridge))
+		log.Printf("Bridging %d MQTT subscriptions and %d topics via %s", len(subscribe), len(publish), *mqttBroker)
+	}
+	if *brokerURL != "" {
+		broker, err := NewBroker(*brokerURL)
+		if err != nil {
+			log.Fatalf("Broker: %v", err)
+		}
+		defer broker.Close()
+		opts = append(opts, WithBroker(broker))
+		log.Printf("Relaying broadcasts through %s", *brokerURL)
+	}
+	if *kafkaBrokers != "" {
+		exporter := NewKafkaExporter(strings.Split(*kafkaBrokers, ","), *kafkaTopic)
+		defer exporter.Close()
+		opts = append(opts, WithExporter(exporter))
+		log.Printf("Exporting chat activity to Kafka topic %s", *kafkaTopic)
+	}
+
+	// The live config goes last, so that the settings it leaves out fall
+	// back to the ones set above
+	if *configFile != "" {
+		cfg, err := LoadLiveConfig(*configFile, *maxMessageRunes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, WithConfigFile(*configFile, cfg))
+	}
+
 	// Create and run chat server
-	chatServer := NewChatServer()
-	chatServer.Run()
+	chatServer := NewChatServer(opts...)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	chatServer.Run(ctx)
+	if *configFile != "" {
+		go chatServer.reloadOnSIGHUP(ctx)
+	}
+
+	// Public endpoints
+	mux := http.NewServeMux()
 
 	// Create static file server
 	fs := http.FileServer(http.Dir("./static"))
-	http.Handle("/", fs)
+	mux.Handle("/", fs)
 
 	// WebSocket endpoint
-	http.HandleFunc("/ws", chatServer.handleConnection)
+	mux.HandleFunc("/ws", chatServer.handleConnection)
 
-	// Start HTTP server
-	port := "8080"
-	log.Printf("Server starting at http://localhost:%s", port)
-	err := http.ListenAndServe(":"+port, nil)
-	if err != nil {
+	// Room listing and creation
+	mux.HandleFunc("/rooms", chatServer.handleRooms)
+	mux.HandleFunc("/rooms/invites", chatServer.handleRoomInvites)
+	mux.HandleFunc("/rooms/integrations", chatServer.handleRoomIntegrations)
+	mux.HandleFunc("/rooms/slowmode", chatServer.handleRoomSlowMode)
+	mux.HandleFunc("/events", chatServer.handleEvents)
+	mux.HandleFunc("/gate/challenge", chatServer.handleGateChallenge)
+	mux.HandleFunc("/send", chatServer.handleSend)
+
+	// OpenID Connect login, enabled by -oidc-issuer
+	mux.HandleFunc("/auth/login", chatServer.handleAuthLogin)
+	mux.HandleFunc("/auth/callback", chatServer.handleAuthCallback)
+	mux.HandleFunc("/_matrix/app/v1/transactions/", chatServer.handleMatrixTransaction)
+	mux.HandleFunc("/federation", chatServer.handleFederation)
+
+	// REST history, also available over the WebSocket as a "history" request
+	mux.HandleFunc("/api/history", chatServer.handleHistory)
+	mux.HandleFunc("/api/signing-key", chatServer.handleSigningKey)
+
+	// Members connected to this instance, also available over the WebSocket
+	mux.HandleFunc("/api/roster", chatServer.handleRoster)
+
+	// JSON Schema of the frames clients send
+	mux.HandleFunc("/schema", chatServer.handleSchema)
+
+	// Push notification subscriptions, with the key browsers subscribe with
+	mux.HandleFunc("/push/key", chatServer.handlePushKey)
+	mux.HandleFunc("/push/subscriptions", chatServer.handlePushSubscriptions)
+
+	// Profiles of users connected to this instance
+	mux.HandleFunc("/users/{name}", chatServer.handleUser)
+
+	// Instance identity and known peers
+	mux.HandleFunc("/api/cluster", chatServer.handleCluster)
+
+	// Load score for autoscalers and the cluster router
+	mux.HandleFunc("/api/load", chatServer.handleLoad)
+
+	// Readiness, failing while the canary is broken
+	mux.HandleFunc("/readyz", chatServer.handleReady)
+
+	// Admin API, enabled by -admin-token, and metrics share the public
+	// listener unless -admin-addr moves them, along with pprof, to their own
+	internal := mux
+	if *adminAddr != "" {
+		internal = http.NewServeMux()
+		internal.HandleFunc("/readyz", chatServer.handleReady)
+		registerDebugRoutes(internal)
+	}
+	chatServer.registerAdminRoutes(internal)
+	internal.Handle("/debug/vars", expvar.Handler())
+
+	if *adminAddr != "" {
+		go func() {
+			log.Printf("Admin and metrics endpoints listening on %s", *adminAddr)
+			if err := http.ListenAndServe(*adminAddr, internal); err != nil {
+				log.Fatal("Admin ListenAndServe: ", err)
+			}
+		}()
+	}
+
+	var grpcServer *grpc.Server
+	if *grpcAddr != "" {
+		if *adminToken == "" && *authWebhook == "" && *oidcIssuer == "" {
+			log.Fatal("-grpc-addr needs -admin-token, -auth-webhook or -oidc-issuer to authenticate callers")
+		}
+		lis, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatal("gRPC listen: ", err)
+		}
+		grpcServer = NewGRPCServer(chatServer)
+		go func() {
+			log.Printf("gRPC API listening on %s", *grpcAddr)
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Fatal("gRPC Serve: ", err)
+			}
+		}()
+	}
+
+	// Start HTTP server, stopping on SIGINT or SIGTERM once the hub has
+	// said goodbye to its clients
+	server := &http.Server{Addr: *addr, Handler: mux}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		<-chatServer.Done()
+		if grpcServer != nil {
+			// The hub no longer accepts messages, so open Publish
+			// streams are cut rather than waited for
+			grpcServer.Stop()
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	log.Printf("Server %s starting on %s", *instanceID, *addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal("ListenAndServe: ", err)
 	}
+	<-closed
 }
@@ -18,7 +18,7 @@ import (
 
 func TestChatServer_NewConnection(t *testing.T) {
 	server := NewChatServer()
-	server.Run()
+	server.Run(t.Context())
 
 	// Create test server
 	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
@@ -37,11 +37,6 @@ func TestChatServer_NewConnection(t *testing.T) {
 	}
 	defer c.Close(websocket.StatusNormalClosure, "")
 
-	// Verify client was added
-	if len(server.clients) != 1 {
-		t.Errorf("Expected 1 client, got %d", len(server.clients))
-	}
-
 	// Read welcome message
 	var msg Message
 	ctx, cancel = context.WithTimeout(context.Background(), time.Second*5)
@@ -50,6 +45,11 @@ func TestChatServer_NewConnection(t *testing.T) {
 		t.Fatalf("Failed to read message: %v", err)
 	}
 
+	// Verify client was added
+	if n := server.ClientCount(); n != 1 {
+		t.Errorf("Expected 1 client, got %d", n)
+	}
+
 	if msg.Type != "system" || !strings.Contains(msg.Content, "testuser has joined") {
 		t.Errorf("Unexpected welcome message: %+v", msg)
 	}
@@ -57,7 +57,7 @@ func TestChatServer_NewConnection(t *testing.T) {
 
 func TestChatServer_MessageBroadcast(t *testing.T) {
 	server := NewChatServer()
-	server.Run()
+	server.Run(t.Context())
 
 	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
 	defer s.Close()
@@ -139,7 +139,7 @@ func TestChatServer_MessageBroadcast(t *testing.T) {
 
 func TestChatServer_ClientDisconnect(t *testing.T) {
 	server := NewChatServer()
-	server.Run()
+	server.Run(t.Context())
 
 	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
 	defer s.Close()
@@ -172,9 +172,7 @@ func TestChatServer_ClientDisconnect(t *testing.T) {
 	time.Sleep(time.Millisecond * 100)
 
 	// Verify client was removed
-	server.clientsMtx.Lock()
-	clientCount := len(server.clients)
-	server.clientsMtx.Unlock()
+	clientCount := server.ClientCount()
 
 	if clientCount != 0 {
 		t.Errorf("Expected 0 clients after disconnect, got %d", clientCount)
@@ -183,7 +181,7 @@ func TestChatServer_ClientDisconnect(t *testing.T) {
 
 func TestChatServer_AutoGeneratedUsername(t *testing.T) {
 	server := NewChatServer()
-	server.Run()
+	server.Run(t.Context())
 
 	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
 	defer s.Close()
@@ -215,7 +213,7 @@ func TestChatServer_AutoGeneratedUsername(t *testing.T) {
 
 func TestChatServer_InvalidMessage(t *testing.T) {
 	server := NewChatServer()
-	server.Run()
+	server.Run(t.Context())
 
 	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
 	defer s.Close()
@@ -250,7 +248,7 @@ func TestChatServer_InvalidMessage(t *testing.T) {
 
 func TestChatServer_ConcurrentBroadcast(t *testing.T) {
 	server := NewChatServer()
-	server.Run()
+	server.Run(t.Context())
 
 	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
 	defer s.Close()
@@ -340,7 +338,7 @@ func TestStaticFileServer(t *testing.T) {
 
 func TestChatServer_BroadcastErrors(t *testing.T) {
 	server := NewChatServer()
-	server.Run()
+	server.Run(t.Context())
 
 	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
 	defer s.Close()
@@ -404,9 +402,7 @@ func TestChatServer_BroadcastErrors(t *testing.T) {
 	time.Sleep(time.Millisecond * 100)
 
 	// Verify that the dead client was removed
-	server.clientsMtx.Lock()
-	clientCount := len(server.clients)
-	server.clientsMtx.Unlock()
+	clientCount := server.ClientCount()
 
 	if clientCount != 1 {
 		t.Errorf("Expected 1 client after error cleanup, got %d", clientCount)
@@ -426,7 +422,7 @@ func TestChatServer_BroadcastErrors(t *testing.T) {
 
 func TestChatServer_BroadcastConcurrentModification(t *testing.T) {
 	server := NewChatServer()
-	server.Run()
+	server.Run(t.Context())
 
 	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
 	defer s.Close()
@@ -488,9 +484,7 @@ func TestChatServer_BroadcastConcurrentModification(t *testing.T) {
 	time.Sleep(time.Millisecond * 100)
 
 	// Verify client count is correct (should be number of clients that were sending messages)
-	server.clientsMtx.Lock()
-	clientCount := len(server.clients)
-	server.clientsMtx.Unlock()
+	clientCount := server.ClientCount()
 
 	expectedClients := (numClients + 1) / 2 // Round up division
 	if clientCount > expectedClients {
@@ -500,7 +494,7 @@ func TestChatServer_BroadcastConcurrentModification(t *testing.T) {
 
 func TestChatServer_WebSocketAcceptError(t *testing.T) {
 	server := NewChatServer()
-	server.Run()
+	server.Run(t.Context())
 
 	// Create a server that will trigger websocket accept error
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -523,7 +517,7 @@ func TestChatServer_WebSocketAcceptError(t *testing.T) {
 
 func TestChatServer_MessageValidation(t *testing.T) {
 	server := NewChatServer()
-	server.Run()
+	server.Run(t.Context())
 
 	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
 	defer s.Close()
@@ -567,6 +561,14 @@ func TestChatServer_MessageValidation(t *testing.T) {
 			},
 			valid: false,
 		},
+		{
+			name: "Control characters",
+			message: Message{
+				Type:    "message",
+				Content: "ding\u0007",
+			},
+			valid: false,
+		},
 		{
 			name: "Invalid message type",
 			message: Message{
@@ -607,6 +609,18 @@ func TestChatServer_MessageValidation(t *testing.T) {
 				if receivedMsg.Content != tc.message.Content {
 					t.Errorf("Expected content %q, got %q", tc.message.Content, receivedMsg.Content)
 				}
+			} else {
+				// Invalid messages are answered with an error notice
+				ctx, cancel = context.WithTimeout(context.Background(), time.Second*5)
+				var notice Message
+				err := wsjson.Read(ctx, c, &notice)
+				cancel()
+				if err != nil {
+					t.Fatalf("Failed to read error notice: %v", err)
+				}
+				if notice.Type != "system" || notice.Username != "Server" {
+					t.Errorf("Expected error notice, got: %+v", notice)
+				}
 			}
 		})
 	}
@@ -614,7 +628,7 @@ func TestChatServer_MessageValidation(t *testing.T) {
 
 func TestChatServer_UsernameValidation(t *testing.T) {
 	server := NewChatServer()
-	server.Run()
+	server.Run(t.Context())
 
 	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
 	defer s.Close()
@@ -690,7 +704,7 @@ func TestChatServer_UsernameValidation(t *testing.T) {
 
 func TestChatServer_SystemMessages(t *testing.T) {
 	server := NewChatServer()
-	server.Run()
+	server.Run(t.Context())
 
 	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
 	defer s.Close()
@@ -761,3 +775,89 @@ func TestChatServer_SystemMessages(t *testing.T) {
 		t.Errorf("Expected leave notification for user2, got: %s", msg.Content)
 	}
 }
+
+func TestChatServer_MessageTimestampsAndSequence(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	before := time.Now().UnixMilli()
+	c, _, err := websocket.Dial(ctx, wsURL+"?username=testuser", &websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	var lastSeq uint64
+	for i := 0; i < 4; i++ {
+		if i > 0 {
+			if err := wsjson.Write(ctx, c, Message{Type: "message", Content: fmt.Sprintf("msg %d", i)}); err != nil {
+				t.Fatalf("Failed to send message: %v", err)
+			}
+		}
+
+		var msg Message
+		if err := wsjson.Read(ctx, c, &msg); err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		if msg.Seq != lastSeq+1 {
+			t.Errorf("Expected seq %d, got %d", lastSeq+1, msg.Seq)
+		}
+		lastSeq = msg.Seq
+
+		if msg.Timestamp < before || msg.Timestamp > time.Now().UnixMilli() {
+			t.Errorf("Timestamp %d out of range", msg.Timestamp)
+		}
+		parsed, err := time.Parse(time.RFC3339, msg.Time)
+		if err != nil {
+			t.Errorf("Invalid RFC3339 time %q: %v", msg.Time, err)
+		} else if parsed.Unix() != msg.Timestamp/1000 {
+			t.Errorf("Time %q and ts %d disagree", msg.Time, msg.Timestamp)
+		}
+	}
+}
+
+func FuzzHandleMessage(f *testing.F) {
+	for _, seed := range []string{
+		`{"type":"message","content":"hello"}`,
+		`{"type":"message","content":"/nick bob"}`,
+		`{"type":"rename","content":""}`,
+		`{"type":"history","before_seq":18446744073709551615,"limit":-1}`,
+		`{"type":"roster","after":"\u0000","limit":1000000}`,
+		`{"type":"profile","profile":{"display_name":"‮"}}`,
+		`{"type":"read","last_read":""}`,
+		`{"type":"poll","content":"?","poll":{"options":["a"]}}`,
+		`{"type":"vote","poll_id":"nope","option":99}`,
+		`{"type":"unschedule","id":""}`,
+		`{"type":"message","content":"later","deliver_at":"9999-99-99"}`,
+		`{"type":"status","status":"🙂"}`,
+		`{"type":"typing"}`,
+		`{"type":"capabilities"}`,
+		`{"type":"client_error","content":"x"}`,
+		`{"type":"part"}`,
+		`{"type":"message","content":"hi","client_msg_id":"` + strings.Repeat("x", 100) + `"}`,
+	} {
+		f.Add([]byte(seed))
+	}
+	server := NewChatServer()
+	server.Run(f.Context())
+	addBenchClients(server, 1)
+	client := server.usernames["user0"]
+	ctx := f.Context()
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg Message
+		if err := client.codec.Unmarshal(data, &msg); err != nil {
+			return
+		}
+		msg.Trace = newTraceID()
+		// Called directly, since handleFrame would hide a panic
+		server.handleMessage(ctx, client, msg)
+	})
+}
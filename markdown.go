@@ -0,0 +1,198 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// markdownEscapable are the characters a backslash makes literal
+const markdownEscapable = "\\`*_~[]()>#+-.!"
+
+// markdownListItem matches an unordered or ordered list item
+var markdownListItem = regexp.MustCompile(`^(?:[-*+]|(\d{1,9})\.) +`)
+
+// WithMarkdown renders the content of chat messages from a safe Markdown
+// subset into sanitized HTML, delivered and stored in the rendered field
+func WithMarkdown(enabled bool) Option {
+	return func(cs *ChatServer) {
+		cs.markdown = enabled
+	}
+}
+
+// renderMarkdown renders paragraphs, line breaks, fenced code blocks,
+// block quotes, lists, emphasis, strong, strikethrough, inline code and
+// links as HTML. Everything else, raw HTML included, is escaped, so the
+// result is safe to insert into a page as is.
+func renderMarkdown(src string) string {
+	var b strings.Builder
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	var para []string
+	flush := func() {
+		if len(para) == 0 {
+			return
+		}
+		b.WriteString("<p>")
+		writeMarkdownLines(&b, para)
+		b.WriteString("</p>")
+		para = nil
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "```"):
+			flush()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(lines[i], "```"); i++ {
+				code = append(code, lines[i])
+			}
+			b.WriteString("<pre><code>")
+			b.WriteString(html.EscapeString(strings.Join(code, "\n")))
+			b.WriteString("</code></pre>")
+
+		case strings.HasPrefix(line, ">"):
+			flush()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(lines[i], ">"); i++ {
+				quote = append(quote, strings.TrimPrefix(lines[i][1:], " "))
+			}
+			i--
+			b.WriteString("<blockquote>")
+			writeMarkdownLines(&b, quote)
+			b.WriteString("</blockquote>")
+
+		case markdownListItem.MatchString(line):
+			flush()
+			ordered := markdownListItem.FindStringSubmatch(line)[1] != ""
+			tag := "ul"
+			if ordered {
+				tag = "ol"
+			}
+			b.WriteString("<" + tag + ">")
+			for ; i < len(lines); i++ {
+				m := markdownListItem.FindStringSubmatch(lines[i])
+				if m == nil || (m[1] != "") != ordered {
+					break
+				}
+				b.WriteString("<li>")
+				b.WriteString(renderInline(lines[i][len(m[0]):]))
+				b.WriteString("</li>")
+			}
+			i--
+			b.WriteString("</" + tag + ">")
+
+		case strings.TrimSpace(line) == "":
+			flush()
+
+		default:
+			para = append(para, line)
+		}
+	}
+	flush()
+	return b.String()
+}
+
+// writeMarkdownLines renders lines of inline Markdown joined by line breaks
+func writeMarkdownLines(b *strings.Builder, lines []string) {
+	for i, line := range lines {
+		if i > 0 {
+			b.WriteString("<br>")
+		}
+		b.WriteString(renderInline(line))
+	}
+}
+
+// renderInline renders the inline Markdown of one line
+func renderInline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		rest := s[i:]
+		switch {
+		case rest[0] == '\\' && len(rest) > 1 && strings.IndexByte(markdownEscapable, rest[1]) >= 0:
+			b.WriteString(html.EscapeString(rest[1:2]))
+			i += 2
+			continue
+
+		case rest[0] == '`':
+			if end := strings.IndexByte(rest[1:], '`'); end > 0 {
+				b.WriteString("<code>" + html.EscapeString(rest[1:1+end]) + "</code>")
+				i += end + 2
+				continue
+			}
+
+		case strings.HasPrefix(rest, "**"), strings.HasPrefix(rest, "__"), strings.HasPrefix(rest, "~~"):
+			if end := strings.Index(rest[2:], rest[:2]); end > 0 {
+				tag := "strong"
+				if rest[0] == '~' {
+					tag = "del"
+				}
+				b.WriteString("<" + tag + ">" + renderInline(rest[2:2+end]) + "</" + tag + ">")
+				i += end + 4
+				continue
+			}
+
+		case rest[0] == '*', rest[0] == '_':
+			// Underscores inside words, as in snake_case, aren't emphasis
+			if rest[0] == '_' && i > 0 && isWordByte(s[i-1]) {
+				break
+			}
+			if end := strings.IndexByte(rest[1:], rest[0]); end > 0 && rest[1] != ' ' {
+				b.WriteString("<em>" + renderInline(rest[1:1+end]) + "</em>")
+				i += end + 2
+				continue
+			}
+
+		case rest[0] == '[':
+			if text, link, n, ok := parseMarkdownLink(rest); ok {
+				b.WriteString(`<a href="` + html.EscapeString(link) + `" rel="nofollow noopener noreferrer">` + renderInline(text) + "</a>")
+				i += n
+				continue
+			}
+
+		case strings.HasPrefix(rest, "http://"), strings.HasPrefix(rest, "https://"):
+			if i == 0 || !isWordByte(s[i-1]) {
+				if link := firstLink(rest); link != "" {
+					escaped := html.EscapeString(link)
+					b.WriteString(`<a href="` + escaped + `" rel="nofollow noopener noreferrer">` + escaped + "</a>")
+					i += len(link)
+					continue
+				}
+			}
+		}
+		b.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+	return b.String()
+}
+
+// parseMarkdownLink parses a [text](url) link at the start of s, returning
+// its parts and length. Only http, https and mailto links are accepted, so
+// javascript: and data: URLs stay plain text.
+func parseMarkdownLink(s string) (text, link string, n int, ok bool) {
+	closeText := strings.Index(s, "](")
+	if closeText < 1 {
+		return "", "", 0, false
+	}
+	end := strings.IndexByte(s[closeText+2:], ')')
+	if end < 1 {
+		return "", "", 0, false
+	}
+	text, link = s[1:closeText], s[closeText+2:closeText+2+end]
+	u, err := url.Parse(link)
+	if err != nil || strings.ContainsAny(link, " \t") {
+		return "", "", 0, false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+	default:
+		return "", "", 0, false
+	}
+	return text, link, closeText + 3 + end, true
+}
+
+// isWordByte reports whether c is an ASCII letter or digit
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"hello", "<p>hello</p>"},
+		{"**bold** and *em* and _em_ and ~~gone~~", "<p><strong>bold</strong> and <em>em</em> and <em>em</em> and <del>gone</del></p>"},
+		{"**bold _nested_**", "<p><strong>bold <em>nested</em></strong></p>"},
+		{"snake_case_name and 2 * 3 * 4", "<p>snake_case_name and 2 * 3 * 4</p>"},
+		{"`<b>code</b>`", "<p><code>&lt;b&gt;code&lt;/b&gt;</code></p>"},
+		{"one\ntwo\n\nthree", "<p>one<br>two</p><p>three</p>"},
+		{"```\n<script>\n**x**\n```", "<pre><code>&lt;script&gt;\n**x**</code></pre>"},
+		{"> quoted\n> more\nafter", "<blockquote>quoted<br>more</blockquote><p>after</p>"},
+		{"- a\n- b\n1. c", "<ul><li>a</li><li>b</li></ul><ol><li>c</li></ol>"},
+		{"[docs](https://example.com/a?b=1&c=2)", `<p><a href="https://example.com/a?b=1&amp;c=2" rel="nofollow noopener noreferrer">docs</a></p>`},
+		{"see https://example.com/x.", `<p>see <a href="https://example.com/x" rel="nofollow noopener noreferrer">https://example.com/x</a>.</p>`},
+		{`\*literal\*`, "<p>*literal*</p>"},
+		// Unsafe input stays text
+		{"<img src=x onerror=alert(1)>", "<p>&lt;img src=x onerror=alert(1)&gt;</p>"},
+		{"[x](javascript:alert(1))", "<p>[x](javascript:alert(1))</p>"},
+		{"[x](data:text/html,hi)", "<p>[x](data:text/html,hi)</p>"},
+		{`[x](https://a.com/"onmouseover="alert(1))`, `<p><a href="https://a.com/&#34;onmouseover=&#34;alert(1" rel="nofollow noopener noreferrer">x</a>)</p>`},
+	}
+	for _, tt := range tests {
+		if got := renderMarkdown(tt.src); got != tt.want {
+			t.Errorf("renderMarkdown(%q)\n got %s\nwant %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestMarkdownMessages(t *testing.T) {
+	server := NewChatServer(WithMarkdown(true))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "**hi** <b>", Rendered: "<script>forged</script>"})
+	msg := readUntilType(t, ctx, alice, "message")
+	if msg.Content != "**hi** <b>" || msg.Rendered != "<p><strong>hi</strong> &lt;b&gt;</p>" {
+		t.Errorf("Expected the content rendered by the server, got %+v", msg)
+	}
+	if stored, _ := server.history.Find(msg.ID); stored.Rendered != msg.Rendered {
+		t.Errorf("Expected history to keep the rendering, got %q", stored.Rendered)
+	}
+
+	// Without rendering, clients can't supply their own HTML
+	plain := NewChatServer()
+	plain.Run(t.Context())
+	ps := httptest.NewServer(http.HandlerFunc(plain.handleConnection))
+	defer ps.Close()
+	bob := dialStatusTest(t, ctx, ps, "bob")
+	wsjson.Write(ctx, bob, Message{Type: "message", Content: "plain", Rendered: "<script>forged</script>"})
+	if msg := readUntilType(t, ctx, bob, "message"); msg.Rendered != "" {
+		t.Errorf("Expected a client's rendered field to be dropped, got %q", msg.Rendered)
+	}
+}
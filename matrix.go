@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// matrixPuppetPrefix starts the Matrix localparts of chat users
+	matrixPuppetPrefix = "chat_"
+	// matrixUserPrefix starts the chat usernames of Matrix users
+	matrixUserPrefix = "mx-"
+	// matrixQueueSize is how many events may wait to be sent to the
+	// homeserver before new ones are dropped
+	matrixQueueSize = 1024
+	matrixTimeout   = time.Second * 10
+)
+
+// MatrixConfig configures a MatrixBridge, registered with the homeserver as
+// an application service owning the @chat_* user namespace
+type MatrixConfig struct {
+	// Homeserver is the client-server API base URL
+	Homeserver string
+	// ServerName is the homeserver's domain, the part after the colon in
+	// user IDs
+	ServerName string
+	// ASToken authenticates us to the homeserver and HSToken the
+	// homeserver to us, as in the registration file
+	ASToken string
+	HSToken string
+	// Rooms maps chat rooms, with "lobby" for the lobby, to Matrix room IDs
+	Rooms map[string]string
+}
+
+// MatrixBridge mirrors chat rooms to Matrix rooms and back. Chat users
+// appear in Matrix as puppets named @chat_<username>, and Matrix users in
+// chat as mx-<localpart>.
+type MatrixBridge struct {
+	cfg      MatrixConfig
+	byMatrix map[string]string
+	client   *http.Client
+	queue    chan bridgeEvent
+	txns     *seenSet
+
+	// puppets remembers which puppets are registered and which rooms they
+	// have joined, so each is only set up once
+	mu      sync.Mutex
+	puppets map[string]map[string]bool
+}
+
+// NewMatrixBridge checks cfg and returns a bridge for WithMatrixBridge
+func NewMatrixBridge(cfg MatrixConfig) (*MatrixBridge, error) {
+	if cfg.Homeserver == "" || cfg.ServerName == "" || cfg.ASToken == "" || cfg.HSToken == "" {
+		return nil, fmt.Errorf("matrix bridge needs a homeserver, server name, as_token and hs_token")
+	}
+	if len(cfg.Rooms) == 0 {
+		return nil, fmt.Errorf("matrix bridge needs at least one room")
+	}
+	b := &MatrixBridge{
+		cfg:      cfg,
+		byMatrix: make(map[string]string, len(cfg.Rooms)),
+		client:   &http.Client{Timeout: matrixTimeout},
+		queue:    make(chan bridgeEvent, matrixQueueSize),
+		txns:     newSeenSet(1024),
+		puppets:  make(map[string]map[string]bool),
+	}
+	b.cfg.Homeserver = strings.TrimSuffix(cfg.Homeserver, "/")
+	for room, roomID := range cfg.Rooms {
+		if room == lobbyRoom {
+			room = ""
+		}
+		b.byMatrix[roomID] = room
+	}
+	return b, nil
+}
+
+// ParseMatrixRooms parses "room=!id:server,..." into a room map
+func ParseMatrixRooms(s string) (map[string]string, error) {
+	rooms := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		room, roomID, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || room == "" || !strings.HasPrefix(roomID, "!") {
+			return nil, fmt.Errorf("invalid matrix room mapping %q (want room=!id:server)", pair)
+		}
+		rooms[room] = roomID
+	}
+	return rooms, nil
+}
+
+// WithMatrixBridge mirrors the bridge's rooms to Matrix. The homeserver
+// pushes Matrix events to /_matrix/app/v1/transactions/, which must be
+// routed to this server.
+func WithMatrixBridge(b *MatrixBridge) Option {
+	return func(cs *ChatServer) {
+		cs.matrix = b
+		WithBridge(b)(cs)
+	}
+}
+
+// roomID returns the Matrix room a chat room is mirrored to
+func (b *MatrixBridge) roomID(room string) (string, bool) {
+	if room == "" {
+		room = lobbyRoom
+	}
+	id, ok := b.cfg.Rooms[room]
+	return id, ok
+}
+
+// relay queues a chat event for the homeserver, unless it came from
+// Matrix or its room isn't mirrored
+func (b *MatrixBridge) relay(ev bridgeEvent) {
+	if strings.HasPrefix(ev.username, matrixUserPrefix) {
+		return
+	}
+	if _, ok := b.roomID(ev.room); !ok {
+		return
+	}
+	select {
+	case b.queue <- ev:
+	default:
+		log.Printf("Matrix queue full, dropping %s from %s", ev.kind, ev.username)
+	}
+}
+
+// run sends queued events to the homeserver in order until ctx is done
+func (b *MatrixBridge) run(ctx context.Context) {
+	for {
+		select {
+		case ev := <-b.queue:
+			if err := b.send(ctx, ev); err != nil {
+				log.Printf("Matrix bridge failed to relay %s from %s: %v", ev.kind, ev.username, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// send relays one chat event as the user's puppet
+func (b *MatrixBridge) send(ctx context.Context, ev bridgeEvent) error {
+	puppet := b.puppetID(ev.username)
+	roomID, _ := b.roomID(ev.room)
+	if ev.kind == "leave" {
+		b.mu.Lock()
+		joined := b.puppets[puppet][roomID]
+		delete(b.puppets[puppet], roomID)
+		b.mu.Unlock()
+		if !joined {
+			return nil
+		}
+		return b.call(ctx, http.MethodPost, "/rooms/"+url.PathEscape(roomID)+"/leave", puppet, struct{}{})
+	}
+	if err := b.ensureJoined(ctx, ev.username, roomID); err != nil {
+		return err
+	}
+	if ev.kind != "message" {
+		return nil
+	}
+	return b.call(ctx, http.MethodPut, "/rooms/"+url.PathEscape(roomID)+"/send/m.room.message/"+url.PathEscape(ev.id), puppet,
+		map[string]string{"msgtype": "m.text", "body": ev.content})
+}
+
+// ensureJoined registers the user's puppet and joins it to the room, if
+// that hasn't been done yet
+func (b *MatrixBridge) ensureJoined(ctx context.Context, username, roomID string) error {
+	puppet := b.puppetID(username)
+	b.mu.Lock()
+	rooms, registered := b.puppets[puppet]
+	joined := rooms[roomID]
+	b.mu.Unlock()
+	if joined {
+		return nil
+	}
+
+	if !registered {
+		err := b.call(ctx, http.MethodPost, "/register", "", map[string]string{
+			"type":     "m.login.application_service",
+			"username": strings.TrimPrefix(strings.SplitN(puppet, ":", 2)[0], "@"),
+		})
+		if err != nil && !strings.Contains(err.Error(), "M_USER_IN_USE") {
+			return err
+		}
+		if err := b.call(ctx, http.MethodPut, "/profile/"+url.PathEscape(puppet)+"/displayname", puppet,
+			map[string]string{"displayname": username}); err != nil {
+			return err
+		}
+	}
+	if err := b.call(ctx, http.MethodPost, "/rooms/"+url.PathEscape(roomID)+"/join", puppet, struct{}{}); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	if b.puppets[puppet] == nil {
+		b.puppets[puppet] = make(map[string]bool)
+	}
+	b.puppets[puppet][roomID] = true
+	b.mu.Unlock()
+	return nil
+}
+
+// call makes a client-server API request, as the puppet if one is given
+func (b *MatrixBridge) call(ctx context.Context, method, path, puppet string, body any) error {
+	u := b.cfg.Homeserver + "/_matrix/client/v3" + path
+	if puppet != "" {
+		u += "?user_id=" + url.QueryEscape(puppet)
+	}
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.cfg.ASToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	return nil
+}
+
+// puppetID is the Matrix user ID of a chat user's puppet. Matrix localparts
+// are lower case, so upper case letters become _ and the letter, and _
+// becomes __.
+func (b *MatrixBridge) puppetID(username string) string {
+	var sb strings.Builder
+	sb.WriteString("@" + matrixPuppetPrefix)
+	for _, r := range username {
+		switch {
+		case r == '_':
+			sb.WriteString("__")
+		case unicode.IsUpper(r):
+			sb.WriteRune('_')
+			sb.WriteRune(unicode.ToLower(r))
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String() + ":" + b.cfg.ServerName
+}
+
+// isPuppet reports whether a Matrix user is one of our puppets
+func (b *MatrixBridge) isPuppet(userID string) bool {
+	return strings.HasPrefix(userID, "@"+matrixPuppetPrefix) && strings.HasSuffix(userID, ":"+b.cfg.ServerName)
+}
+
+// chatUsername is the chat username a Matrix user appears as
+func chatUsername(userID string) string {
+	localpart := strings.TrimPrefix(strings.SplitN(userID, ":", 2)[0], "@")
+	return sanitizeUsername(matrixUserPrefix + localpart)
+}
+
+// matrixTransaction is a batch of events pushed by the homeserver
+type matrixTransaction struct {
+	Events []struct {
+		Type     string `json:"type"`
+		RoomID   string `json:"room_id"`
+		Sender   string `json:"sender"`
+		StateKey string `json:"state_key"`
+		Content  struct {
+			MsgType    string `json:"msgtype"`
+			Body       string `json:"body"`
+			Membership string `json:"membership"`
+		} `json:"content"`
+	} `json:"events"`
+}
+
+// handleMatrixTransaction serves PUT /_matrix/app/v1/transactions/{txnId},
+// relaying messages, joins and leaves in mirrored Matrix rooms to chat
+func (cs *ChatServer) handleMatrixTransaction(w http.ResponseWriter, r *http.Request) {
+	b := cs.matrix
+	if b == nil {
+		http.NotFound(w, r)
+		return
+	}
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		// Older homeservers send the token as a query parameter
+		token = r.URL.Query().Get("access_token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(b.cfg.HSToken)) != 1 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `{"errcode":"M_FORBIDDEN"}`)
+		return
+	}
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	txnID := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+
+	var txn matrixTransaction
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&txn); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	// The homeserver retries transactions until they're acknowledged, so
+	// each is only relayed once
+	if b.txns.Add(txnID) {
+		for _, ev := range txn.Events {
+			room, ok := b.byMatrix[ev.RoomID]
+			if !ok || b.isPuppet(ev.Sender) {
+				continue
+			}
+			cs.relayMatrixEvent(room, ev.Type, ev.Sender, ev.StateKey, ev.Content.MsgType, ev.Content.Body, ev.Content.Membership)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, "{}")
+}
+
+// relayMatrixEvent publishes a Matrix message, join or leave to a chat room
+func (cs *ChatServer) relayMatrixEvent(room, typ, sender, stateKey, msgType, body, membership string) {
+	now := cs.now()
+	msg := Message{
+		Username:  chatUsername(sender),
+		Room:      room,
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+		Trace:     newTraceID(),
+	}
+	switch {
+	case typ == "m.room.message" && (msgType == "m.text" || msgType == "m.notice" || msgType == "m.emote"):
+		msg.Type = "message"
+		msg.Content = body
+		if msgType == "m.emote" {
+			msg.Content = "* " + body
+		}
+		msg.Content = truncateMessage(strings.ToValidUTF8(msg.Content, ""), cs.messageLimit)
+	case typ == "m.room.member" && stateKey == sender && (membership == "join" || membership == "leave"):
+		msg.Type = "system"
+		msg.Content = fmt.Sprintf("%s has joined the chat", msg.Username)
+		if membership == "leave" {
+			msg.Content = fmt.Sprintf("%s has left the chat", msg.Username)
+		}
+		msg.Username = "Server"
+	default:
+		return
+	}
+	if err := msg.validate(cs.messageLimit); err != nil {
+		log.Printf("Dropping Matrix event from %s (trace %s): %v", sender, msg.Trace, err)
+		return
+	}
+	if msg.Type == "message" {
+		if err := cs.admitBridged(&msg); err != nil {
+			log.Printf("Dropping Matrix event from %s (trace %s): %v", sender, msg.Trace, err)
+			return
+		}
+	}
+	if !cs.publish(msg) {
+		log.Printf("Dropping Matrix event from %s (trace %s): hub busy", sender, msg.Trace)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestMatrixBridge_PuppetID(t *testing.T) {
+	b, _ := NewMatrixBridge(MatrixConfig{Homeserver: "https://hs", ServerName: "example.org", ASToken: "as", HSToken: "hs", Rooms: map[string]string{"lobby": "!l:example.org"}})
+	for username, want := range map[string]string{
+		"alice":     "@chat_alice:example.org",
+		"Bob_Smith": "@chat__bob___smith:example.org",
+	} {
+		if got := b.puppetID(username); got != want {
+			t.Errorf("Expected %s for %s, got %s", want, username, got)
+		}
+	}
+	if got := chatUsername("@bob.jones:matrix.org"); got != "mx-bob-jones" {
+		t.Errorf("Expected mx-bob-jones, got %s", got)
+	}
+}
+
+func TestMatrixBridge(t *testing.T) {
+	calls := make(chan string, 20)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer as-token" {
+			t.Errorf("Expected the as_token, got %q", r.Header.Get("Authorization"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		call := r.Method + " " + strings.TrimPrefix(r.URL.EscapedPath(), "/_matrix/client/v3") + " " + r.URL.Query().Get("user_id")
+		if strings.Contains(r.URL.Path, "/send/") {
+			call += " " + string(body)
+		}
+		calls <- call
+		io.WriteString(w, "{}")
+	}))
+	defer hs.Close()
+
+	bridge, err := NewMatrixBridge(MatrixConfig{
+		Homeserver: hs.URL,
+		ServerName: "example.org",
+		ASToken:    "as-token",
+		HSToken:    "hs-token",
+		Rooms:      map[string]string{"lobby": "!lobby:example.org"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewChatServer(WithMatrixBridge(bridge))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	appService := httptest.NewServer(http.HandlerFunc(server.handleMatrixTransaction))
+	defer appService.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "hello matrix"})
+
+	next := func() string {
+		t.Helper()
+		select {
+		case call := <-calls:
+			return call
+		case <-ctx.Done():
+			t.Fatal("Expected a call to the homeserver")
+			return ""
+		}
+	}
+	for _, want := range []string{
+		"POST /register ",
+		"PUT /profile/@chat_alice:example.org/displayname @chat_alice:example.org",
+		"POST /rooms/%21lobby:example.org/join @chat_alice:example.org",
+	} {
+		if got := next(); got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	}
+	if got := next(); !strings.HasPrefix(got, "PUT /rooms/%21lobby:example.org/send/m.room.message/") || !strings.Contains(got, `"body":"hello matrix"`) {
+		t.Errorf("Expected alice's message to be sent as her puppet, got %q", got)
+	}
+
+	transaction := func(token, txnID string, events ...string) int {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPut, appService.URL+"/_matrix/app/v1/transactions/"+txnID,
+			strings.NewReader(`{"events": [`+strings.Join(events, ",")+`]}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to push transaction: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	event := func(sender, body string) string {
+		data, _ := json.Marshal(map[string]any{
+			"type": "m.room.message", "room_id": "!lobby:example.org", "sender": sender,
+			"content": map[string]string{"msgtype": "m.text", "body": body},
+		})
+		return string(data)
+	}
+
+	if status := transaction("guess", "1", event("@bob:matrix.org", "forged")); status != http.StatusForbidden {
+		t.Errorf("Expected 403 with a wrong hs_token, got %d", status)
+	}
+	// Our own puppets' events are echoes and retried transactions are
+	// relayed once
+	transaction("hs-token", "1", event("@chat_alice:example.org", "echo"), event("@bob:matrix.org", "hi from matrix"))
+	transaction("hs-token", "1", event("@bob:matrix.org", "hi from matrix"))
+	transaction("hs-token", "2", event("@bob:matrix.org", "second"))
+
+	var got []string
+	for len(got) < 2 {
+		var msg Message
+		if err := wsjson.Read(ctx, alice, &msg); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if msg.Type == "message" && msg.Username != "alice" {
+			got = append(got, msg.Username+": "+msg.Content)
+		}
+	}
+	if got[0] != "mx-bob: hi from matrix" || got[1] != "mx-bob: second" {
+		t.Errorf("Unexpected relayed messages %q", got)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// maxMemberships caps the rooms remembered for one user; joining another
+// forgets the one joined longest ago
+const maxMemberships = 50
+
+// Memberships remembers the rooms each authenticated user has joined, most
+// recent first, optionally persisted to a JSON file so they survive
+// restarts
+type Memberships struct {
+	mu    sync.Mutex
+	rooms map[string][]membership
+	path  string
+}
+
+// membership is a room a user joined. The room's ID tells it apart from a
+// room created later under the same name.
+type membership struct {
+	Room string `json:"room"`
+	ID   string `json:"id,omitempty"`
+}
+
+// NewMemberships creates a membership store persisted to path, loading any
+// memberships already saved there. An empty path keeps them in memory only.
+func NewMemberships(path string) (*Memberships, error) {
+	m := newMemberships(path)
+	if path == "" {
+		return m, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading memberships: %w", err)
+	}
+	if err := json.Unmarshal(data, &m.rooms); err != nil {
+		// Files written before rooms had IDs list names only; those
+		// memberships match no room's ID
+		var names map[string][]string
+		if json.Unmarshal(data, &names) != nil {
+			return nil, fmt.Errorf("parsing memberships %s: %w", path, err)
+		}
+		m.rooms = make(map[string][]membership, len(names))
+		for username, rooms := range names {
+			for _, room := range rooms {
+				m.rooms[username] = append(m.rooms[username], membership{Room: room})
+			}
+		}
+	}
+	if m.rooms == nil {
+		m.rooms = make(map[string][]membership)
+	}
+	return m, nil
+}
+
+func newMemberships(path string) *Memberships {
+	return &Memberships{rooms: make(map[string][]membership), path: path}
+}
+
+// WithMemberships remembers room memberships in m instead of the default
+// empty in-memory store
+func WithMemberships(m *Memberships) Option {
+	return func(cs *ChatServer) {
+		cs.memberships = m
+	}
+}
+
+// Rooms returns the names of the rooms username has joined, most recent
+// first
+func (m *Memberships) Rooms(username string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, len(m.rooms[username]))
+	for i, r := range m.rooms[username] {
+		names[i] = r.Room
+	}
+	return names
+}
+
+// list returns the memberships of username, most recent first
+func (m *Memberships) list(username string) []membership {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.rooms[username])
+}
+
+// has reports whether username joined room, rather than an earlier room
+// of the same name
+func (m *Memberships) has(username string, room *Room) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Contains(m.rooms[username], membership{Room: room.Name, ID: room.id})
+}
+
+// add records that username joined room
+func (m *Memberships) add(username string, room *Room) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	joined := membership{Room: room.Name, ID: room.id}
+	rooms := m.rooms[username]
+	if len(rooms) > 0 && rooms[0] == joined {
+		return nil
+	}
+	rooms = slices.DeleteFunc(rooms, func(r membership) bool { return r.Room == room.Name })
+	rooms = slices.Insert(rooms, 0, joined)
+	if len(rooms) > maxMemberships {
+		rooms = rooms[:maxMemberships]
+	}
+	m.rooms[username] = rooms
+	return m.saveLocked()
+}
+
+// remove forgets that username joined any of rooms
+func (m *Memberships) remove(username string, rooms ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := slices.DeleteFunc(m.rooms[username], func(r membership) bool { return slices.Contains(rooms, r.Room) })
+	if len(kept) == len(m.rooms[username]) {
+		return nil
+	}
+	if len(kept) == 0 {
+		delete(m.rooms, username)
+	} else {
+		m.rooms[username] = kept
+	}
+	return m.saveLocked()
+}
+
+// forget drops every membership of room, which was deleted
+func (m *Memberships) forget(room *Room) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	gone := membership{Room: room.Name, ID: room.id}
+	changed := false
+	for username, rooms := range m.rooms {
+		kept := slices.DeleteFunc(rooms, func(r membership) bool { return r == gone })
+		if len(kept) == len(rooms) {
+			continue
+		}
+		changed = true
+		if len(kept) == 0 {
+			delete(m.rooms, username)
+		} else {
+			m.rooms[username] = kept
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return m.saveLocked()
+}
+
+// saveLocked writes the memberships to disk
+func (m *Memberships) saveLocked() error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(m.rooms, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write then rename so a crash never leaves a truncated file
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), ".memberships-*")
+	if err != nil {
+		return fmt.Errorf("saving memberships: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("saving memberships: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("saving memberships: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), m.path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("saving memberships: %w", err)
+	}
+	return nil
+}
+
+// reenterRoom puts a returning member back in the room they were last in.
+// Having been admitted before, they don't need the password or an invite
+// again, but a full room still turns them away. A room now under the name
+// of one they joined must admit them without a password or invite, or is
+// forgotten like rooms that no longer exist; with none left the client
+// stays in the lobby.
+func (cs *ChatServer) reenterRoom(username string) *Room {
+	var gone []string
+	defer func() {
+		if len(gone) > 0 {
+			if err := cs.memberships.remove(username, gone...); err != nil {
+				log.Printf("Error forgetting rooms of %s: %v", username, err)
+			}
+		}
+	}()
+
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	for _, joined := range cs.memberships.list(username) {
+		room, ok := cs.rooms[joined.Room]
+		if !ok || room.id != joined.ID && (room.InviteOnly || !room.admits("")) {
+			gone = append(gone, joined.Room)
+			continue
+		}
+		if room.MaxMembers > 0 && room.members >= room.MaxMembers {
+			continue
+		}
+		seatLocked(room)
+		return room
+	}
+	return nil
+}
+
+// rememberRoom records an authenticated client's room so it is restored
+// when they reconnect
+func (cs *ChatServer) rememberRoom(client *Client) {
+	if !client.authenticated || client.canary || client.room == nil {
+		return
+	}
+	if err := cs.memberships.add(client.username, client.room); err != nil {
+		client.logf("Error saving rooms of %s: %v", client.username, err)
+	}
+}
+
+// sendMembershipStates gives an authenticated client the room state of
+// every other room they have joined, so it can show them without
+// connecting to each
+func (cs *ChatServer) sendMembershipStates(ctx context.Context, client *Client) {
+	if !client.authenticated || client.version == protocolV1 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	for _, joined := range cs.memberships.list(client.username) {
+		room := cs.lookupRoom(joined.Room)
+		if room == nil || room.id != joined.ID || room == client.room {
+			continue
+		}
+		state := cs.roomState(room)
+		state.LastRead, state.Unread = cs.unread(client, room)
+		if err := client.write(ctx, state); err != nil {
+			client.logf("Error sending room state to %s: %v", client.username, err)
+			return
+		}
+	}
+}
+
+// handlePart forgets one of the client's rooms, so reconnecting no longer
+// restores it. The client stays connected to the room it is in.
+func (cs *ChatServer) handlePart(client *Client, msg Message) {
+	if !client.authenticated {
+		return
+	}
+	room := msg.Room
+	if room == "" {
+		room = client.roomName()
+	}
+	if err := cs.memberships.remove(client.username, room); err != nil {
+		client.logf("Error forgetting rooms of %s: %v", client.username, err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestMemberships_Persist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memberships.json")
+	m, err := NewMemberships(path)
+	if err != nil {
+		t.Fatalf("Failed to create memberships: %v", err)
+	}
+	for _, name := range []string{"a", "b", "a", "c"} {
+		if err := m.add("bob", &Room{Name: name, id: "id-" + name}); err != nil {
+			t.Fatalf("Failed to add membership: %v", err)
+		}
+	}
+	if err := m.remove("bob", "b"); err != nil {
+		t.Fatalf("Failed to remove membership: %v", err)
+	}
+
+	reloaded, err := NewMemberships(path)
+	if err != nil {
+		t.Fatalf("Failed to reload memberships: %v", err)
+	}
+	if got, want := reloaded.Rooms("bob"), []string{"c", "a"}; !slices.Equal(got, want) {
+		t.Errorf("Expected rooms %v, got %v", want, got)
+	}
+	if !reloaded.has("bob", &Room{Name: "a", id: "id-a"}) || reloaded.has("bob", &Room{Name: "a", id: "other"}) {
+		t.Errorf("Expected membership of a to depend on its ID")
+	}
+	if err := reloaded.forget(&Room{Name: "c", id: "id-c"}); err != nil {
+		t.Fatalf("Failed to forget room: %v", err)
+	}
+	if got := reloaded.Rooms("bob"); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("Expected c forgotten, got %v", got)
+	}
+}
+
+func TestMemberships_Reconnect(t *testing.T) {
+	server := NewChatServer(WithAuthenticator(tokenAuth{"bob-token": {Username: "bob"}}))
+	server.Run(t.Context())
+	s := newRoomsTestServer(t, server)
+	if _, _, err := server.createRoom(RoomOptions{Name: "alpha", Topic: "all about alpha"}); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	if _, _, err := server.createRoom(RoomOptions{Name: "beta", Password: "secret"}); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?token=bob-token"
+	// connect returns the join notice and the room states sent before it
+	var states []Message
+	connect := func(query string) (*websocket.Conn, Message) {
+		t.Helper()
+		c, _, err := websocket.Dial(ctx, wsURL+query, &websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		states = nil
+		for {
+			var msg Message
+			if err := wsjson.Read(ctx, c, &msg); err != nil {
+				t.Fatalf("Failed to read: %v", err)
+			}
+			if msg.Type == "room" {
+				states = append(states, msg)
+			}
+			if msg.Type == "system" {
+				return c, msg
+			}
+		}
+	}
+	disconnect := func(c *websocket.Conn) {
+		t.Helper()
+		c.Close(websocket.StatusNormalClosure, "")
+		for {
+			if _, ok := server.Client("bob"); !ok {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				t.Fatalf("Timed out waiting for bob to leave")
+			case <-time.After(time.Millisecond * 10):
+			}
+		}
+	}
+
+	c, _ := connect("&room=alpha")
+	disconnect(c)
+	c, _ = connect("&room=beta&password=secret")
+	disconnect(c)
+
+	// Without a room bob is back in beta, without its password, and gets
+	// alpha's state too
+	c, joined := connect("")
+	if joined.Room != "beta" {
+		t.Errorf("Expected bob back in beta, got %+v", joined)
+	}
+	i := slices.IndexFunc(states, func(m Message) bool { return m.Room == "alpha" })
+	if i < 0 || states[i].Topic != "all about alpha" {
+		t.Errorf("Expected alpha's room state with its topic, got %+v", states)
+	}
+
+	// Parting beta leaves alpha to restore
+	wsjson.Write(ctx, c, Message{Type: "part", Room: "beta"})
+	wsjson.Write(ctx, c, Message{Type: "roster"})
+	readUntilType(t, ctx, c, "roster")
+	disconnect(c)
+	c, joined = connect("")
+	defer c.CloseNow()
+	if joined.Room != "alpha" {
+		t.Errorf("Expected bob back in alpha after parting beta, got %+v", joined)
+	}
+
+	// Asking for the lobby is still possible
+	disconnect(c)
+	c, joined = connect("&room=lobby")
+	defer c.CloseNow()
+	if joined.Room != "" {
+		t.Errorf("Expected bob in the lobby, got %+v", joined)
+	}
+
+	// A room recreated under alpha's name with a password doesn't let bob
+	// in on his old membership
+	disconnect(c)
+	server.roomsMtx.Lock()
+	delete(server.rooms, "alpha")
+	server.roomsMtx.Unlock()
+	if _, _, err := server.createRoom(RoomOptions{Name: "alpha", Password: "new"}); err != nil {
+		t.Fatalf("Failed to recreate room: %v", err)
+	}
+	c, joined = connect("")
+	defer c.CloseNow()
+	if joined.Room != "" {
+		t.Errorf("Expected bob in the lobby rather than the new alpha, got %+v", joined)
+	}
+	if rooms := server.memberships.Rooms("bob"); slices.Contains(rooms, "alpha") {
+		t.Errorf("Expected the old alpha forgotten, got %v", rooms)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import "expvar"
+
+// metrics holds the server's counters, published as "chat" on /debug/vars
+var metrics = expvar.NewMap("chat")
+
+// Metric names
+const (
+	metricPayloadBytesIn  = "ws_payload_bytes_in"
+	metricPayloadBytesOut = "ws_payload_bytes_out"
+	metricWireBytesIn     = "ws_wire_bytes_in"
+	metricWireBytesOut    = "ws_wire_bytes_out"
+
+	metricCanaryProbes    = "canary_probes_ok"
+	metricCanaryFailures  = "canary_probes_failed"
+	metricCanaryLatencyMs = "canary_latency_ms"
+
+	metricBroadcastQueueDepth = "broadcast_queue_depth"
+	metricBroadcastQueueFull  = "broadcast_queue_full"
+	metricBroadcastDropped    = "broadcast_dropped"
+
+	metricClientErrors = "client_errors"
+	metricFramePanics  = "frame_panics"
+	metricSpoofed      = "spoofed_frames"
+
+	// metricSpamPenalties is suffixed with the penalty applied, e.g.
+	// spam_penalties_mute
+	metricSpamPenalties = "spam_penalties"
+
+	metricGatePassed   = "gate_passed"
+	metricGateRejected = "gate_rejected"
+
+	metricBandwidthThrottled    = "bandwidth_throttled"
+	metricBandwidthDisconnected = "bandwidth_disconnected"
+
+	metricPluginEventsDropped = "plugin_events_dropped"
+
+	metricRulesMatched = "rules_matched"
+
+	metricSessionsResumed   = "sessions_resumed"
+	metricSessionsForwarded = "sessions_forwarded"
+
+	metricPushSent   = "push_sent"
+	metricPushFailed = "push_failed"
+
+	metricRetentionPruned = "retention_pruned"
+	metricRetentionShards = "retention_shards_done"
+	metricRetentionSweeps = "retention_sweeps"
+	metricRetentionLagMs  = "retention_lag_ms"
+)
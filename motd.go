@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RecurringAnnouncement is an announcement sent to a room's members on a
+// cron schedule, in the server's time zone
+type RecurringAnnouncement struct {
+	ID      string    `json:"id"`
+	Room    string    `json:"room"`
+	Cron    string    `json:"cron"`
+	Content string    `json:"content"`
+	Created time.Time `json:"created"`
+	// ExpiresIn is how long each run stays up before it is taken down,
+	// e.g. "1h"; empty keeps it up
+	ExpiresIn string `json:"expires_in,omitempty"`
+	// Next and LastSent are reported by the admin API; runs missed while
+	// the server was down are skipped, not made up
+	Next     time.Time `json:"next,omitzero"`
+	LastSent time.Time `json:"last_sent,omitzero"`
+
+	schedule cronSchedule
+}
+
+// Notices holds the message of the day and the recurring announcements,
+// optionally persisted to a JSON file
+type Notices struct {
+	mu        sync.Mutex
+	motd      string
+	recurring map[string]*RecurringAnnouncement
+	path      string
+	// wake tells the announcer the earliest run may have changed
+	wake chan struct{}
+	// now is the time runs are scheduled from
+	now func() time.Time
+}
+
+// noticesFile is the layout of the notices file
+type noticesFile struct {
+	MOTD      string                  `json:"motd,omitempty"`
+	Recurring []RecurringAnnouncement `json:"recurring"`
+}
+
+// NewNotices creates notices persisted to path, loading any already
+// stored there. An empty path keeps them in memory only.
+func NewNotices(path string) (*Notices, error) {
+	n := newNotices(path)
+	if path == "" {
+		return n, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return n, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading notices: %w", err)
+	}
+	var stored noticesFile
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("parsing notices %s: %w", path, err)
+	}
+	n.motd = stored.MOTD
+	now := n.now()
+	for _, r := range stored.Recurring {
+		if r.schedule, err = parseCron(r.Cron); err != nil {
+			return nil, fmt.Errorf("parsing notices %s: %s: %w", path, r.ID, err)
+		}
+		r.Next = r.schedule.next(now)
+		n.recurring[r.ID] = &r
+	}
+	return n, nil
+}
+
+func newNotices(path string) *Notices {
+	return &Notices{
+		recurring: make(map[string]*RecurringAnnouncement),
+		path:      path,
+		wake:      make(chan struct{}, 1),
+		now:       time.Now,
+	}
+}
+
+// WithNotices uses n for the message of the day and recurring
+// announcements instead of the default empty in-memory set
+func WithNotices(n *Notices) Option {
+	return func(cs *ChatServer) {
+		cs.notices = n
+	}
+}
+
+// setClock makes n take the time from now, rescheduling the recurring
+// announcements by it
+func (n *Notices) setClock(now func() time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.now = now
+	for _, r := range n.recurring {
+		r.Next = r.schedule.next(now())
+	}
+}
+
+// MOTD returns the message of the day, empty if there is none
+func (n *Notices) MOTD() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.motd
+}
+
+// SetMOTD replaces the message of the day; empty content clears it
+func (n *Notices) SetMOTD(content string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.motd = content
+	return n.saveLocked()
+}
+
+// Add stores a recurring announcement, scheduling its first run. It stays
+// scheduled in memory even if it couldn't be persisted.
+func (n *Notices) Add(r RecurringAnnouncement) (RecurringAnnouncement, error) {
+	n.mu.Lock()
+	r.Next = r.schedule.next(n.now())
+	n.recurring[r.ID] = &r
+	err := n.saveLocked()
+	n.mu.Unlock()
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+	return r, err
+}
+
+// Remove deletes a recurring announcement, reporting whether there was one
+func (n *Notices) Remove(id string) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.recurring[id]; !ok {
+		return false, nil
+	}
+	delete(n.recurring, id)
+	return true, n.saveLocked()
+}
+
+// List returns the recurring announcements by next run
+func (n *Notices) List() []RecurringAnnouncement {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.listLocked()
+}
+
+func (n *Notices) listLocked() []RecurringAnnouncement {
+	list := make([]RecurringAnnouncement, 0, len(n.recurring))
+	for _, r := range n.recurring {
+		list = append(list, *r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Next.Equal(list[j].Next) {
+			return list[i].Next.Before(list[j].Next)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// due returns the announcements to send at now, moving each on to its next
+// run, and when the earliest following run is (zero if there is none)
+func (n *Notices) due(now time.Time) ([]RecurringAnnouncement, time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var due []RecurringAnnouncement
+	var next time.Time
+	for _, r := range n.recurring {
+		if !r.Next.IsZero() && !r.Next.After(now) {
+			r.LastSent = now
+			r.Next = r.schedule.next(now)
+			due = append(due, *r)
+		}
+		if !r.Next.IsZero() && (next.IsZero() || r.Next.Before(next)) {
+			next = r.Next
+		}
+	}
+	return due, next
+}
+
+// saveLocked writes the notices to disk
+func (n *Notices) saveLocked() error {
+	if n.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(noticesFile{MOTD: n.motd, Recurring: n.listLocked()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write then rename so a crash never leaves a truncated file
+	tmp, err := os.CreateTemp(filepath.Dir(n.path), ".notices-*")
+	if err != nil {
+		return fmt.Errorf("saving notices: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("saving notices: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("saving notices: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), n.path); err != nil {
+		return fmt.Errorf("saving notices: %w", err)
+	}
+	return nil
+}
+
+// sendMOTD sends the message of the day to a newly connected client
+func (cs *ChatServer) sendMOTD(ctx context.Context, client *Client) {
+	motd := cs.notices.MOTD()
+	if motd == "" || client.canary {
+		return
+	}
+	now := cs.now()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	err := client.writeMessage(ctx, Message{
+		Type:      "motd",
+		Username:  "Server",
+		Content:   motd,
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+		Room:      client.roomName(),
+	})
+	if err != nil {
+		client.logf("Error sending message of the day to %s: %v", client.username, err)
+	}
+}
+
+// runAnnouncer sends recurring announcements as they fall due, until ctx
+// is cancelled. Each instance announces to its own sessions, so a cluster
+// sharing a notices file sends every member one copy.
+func (cs *ChatServer) runAnnouncer(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-cs.notices.wake:
+		case <-ctx.Done():
+			return
+		}
+		due, next := cs.notices.due(cs.now())
+		for _, r := range due {
+			cs.sendRecurring(ctx, r)
+		}
+		wait := scheduleIdleCheck
+		if !next.IsZero() {
+			wait = next.Sub(cs.now())
+		}
+		timer.Reset(wait)
+	}
+}
+
+// sendRecurring announces r to the members of its room and records it with
+// the other announcements
+func (cs *ChatServer) sendRecurring(ctx context.Context, r RecurringAnnouncement) {
+	now := cs.now()
+	a := Announcement{
+		ID:      newMessageID(),
+		Time:    now,
+		Actor:   "recurring:" + r.ID,
+		Content: r.Content,
+		Segment: Segment{Rooms: []string{r.Room}},
+	}
+	msg := Message{
+		Type:      "announcement",
+		Username:  "Server",
+		Content:   r.Content,
+		ID:        a.ID,
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+		Trace:     newTraceID(),
+	}
+	if ttl, _ := parseExpiry(r.ExpiresIn); ttl > 0 {
+		a.Expires = now.Add(ttl)
+		msg.ExpiresAt = a.Expires.UTC().Format(time.RFC3339)
+	}
+	a.Targeted, a.Delivered = cs.announce(ctx, msg, a.Segment, 0)
+	cs.announcements.add(a)
+	cs.expireAnnouncement(a)
+	log.Printf("Sent recurring announcement %s to %d of %d members of %s", r.ID, a.Delivered, a.Targeted, r.Room)
+}
+
+// handleAdminMOTD serves GET, PUT and DELETE /admin/motd, reading, setting
+// with {"content": "..."} and clearing the message of the day
+func (cs *ChatServer) handleAdminMOTD(w http.ResponseWriter, r *http.Request) {
+	var content string
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"content": cs.notices.MOTD()})
+		return
+
+	case http.MethodPut:
+		var req struct {
+			Content string `json:"content"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if req.Content == "" || messageLength(req.Content) > cs.messageLimit {
+			http.Error(w, fmt.Sprintf("content is required and at most %d characters", cs.messageLimit), http.StatusBadRequest)
+			return
+		}
+		content = req.Content
+
+	case http.MethodDelete:
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := cs.notices.SetMOTD(content)
+	cs.audit(AuditMOTD, adminActor(r), "", content)
+	if err != nil {
+		log.Printf("Error saving notices: %v", err)
+		http.Error(w, "message of the day changed but not persisted", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminRecurring serves GET /admin/recurring, listing recurring
+// announcements, POST /admin/recurring with {"room", "cron", "content",
+// "expires_in"}, adding one, and DELETE /admin/recurring?id=ID, removing one
+func (cs *ChatServer) handleAdminRecurring(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cs.notices.List())
+
+	case http.MethodPost:
+		var req struct {
+			Room      string `json:"room"`
+			Cron      string `json:"cron"`
+			Content   string `json:"content"`
+			ExpiresIn string `json:"expires_in"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if req.Content == "" || messageLength(req.Content) > cs.messageLimit {
+			http.Error(w, fmt.Sprintf("content is required and at most %d characters", cs.messageLimit), http.StatusBadRequest)
+			return
+		}
+		schedule, err := parseCron(req.Cron)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := parseExpiry(req.ExpiresIn); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		entry, err := cs.notices.Add(RecurringAnnouncement{
+			ID:        newMessageID(),
+			Room:      roomOrLobby(req.Room),
+			Cron:      req.Cron,
+			Content:   req.Content,
+			Created:   cs.now(),
+			ExpiresIn: req.ExpiresIn,
+			schedule:  schedule,
+		})
+		cs.audit(AuditRecurringAdd, adminActor(r), entry.ID, req.Content)
+		if err != nil {
+			log.Printf("Error saving notices: %v", err)
+			http.Error(w, "announcement scheduled but not persisted", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Added recurring announcement %s for %s (%s)", entry.ID, entry.Room, entry.Cron)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(entry)
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		removed, err := cs.notices.Remove(id)
+		if removed {
+			cs.audit(AuditRecurringRemove, adminActor(r), id, "")
+		}
+		if err != nil {
+			log.Printf("Error saving notices: %v", err)
+			http.Error(w, "announcement removed but not persisted", http.StatusInternalServerError)
+			return
+		}
+		if !removed {
+			http.Error(w, "no such recurring announcement", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestMOTD(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	rec := httptest.NewRecorder()
+	server.handleAdminMOTD(rec, httptest.NewRequest(http.MethodPut, "/admin/motd", strings.NewReader(`{"content": "Welcome! Be kind."}`)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", rec.Code)
+	}
+	// The message of the day comes before the join notice, and v1 clients
+	// see it as a system notice
+	for username, opts := range map[string]*websocket.DialOptions{
+		"alice": {Subprotocols: []string{subprotocolV2}},
+		"bob":   nil,
+	} {
+		c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username="+username, opts)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer c.Close(websocket.StatusNormalClosure, "")
+		want := "motd"
+		if opts == nil {
+			want = "system"
+		}
+		var msg Message
+		if err := wsjson.Read(ctx, c, &msg); err != nil || msg.Type != want || msg.Content != "Welcome! Be kind." || msg.Username != "Server" {
+			t.Errorf("Expected %s to get the message of the day first, got %+v (%v)", username, msg, err)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	server.handleAdminMOTD(rec, httptest.NewRequest(http.MethodDelete, "/admin/motd", nil))
+	if server.notices.MOTD() != "" {
+		t.Errorf("Expected the message of the day to be cleared")
+	}
+}
+
+func TestRecurringAnnouncements(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notices.json")
+	notices, err := NewNotices(path)
+	if err != nil {
+		t.Fatalf("Failed to create notices: %v", err)
+	}
+	server := NewChatServer(WithNotices(notices))
+	server.Run(t.Context())
+	s := newRoomsTestServer(t, server)
+	createTestRoom(t, s, RoomOptions{Name: "ops"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.handleAdminRecurring(rec, httptest.NewRequest(http.MethodPost, "/admin/recurring", strings.NewReader(body)))
+		return rec
+	}
+	if rec := post(`{"room": "ops", "cron": "0 25 * * *", "content": "x"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad cron expression, got %d", rec.Code)
+	}
+	rec := post(`{"room": "ops", "cron": "0 3 * * 0", "content": "Maintenance tonight at 03:00"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	var entry RecurringAnnouncement
+	json.NewDecoder(rec.Body).Decode(&entry)
+	if entry.Next.IsZero() || entry.Next.Weekday() != time.Sunday || entry.Next.Hour() != 3 {
+		t.Errorf("Expected the next run on Sunday at 03:00, got %v", entry.Next)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+	v2 := &websocket.DialOptions{Subprotocols: []string{subprotocolV2}}
+	ops, _, err := websocket.Dial(ctx, wsURL+"?username=alice&room=ops", v2)
+	if err != nil {
+		t.Fatalf("Failed to join: %v", err)
+	}
+	defer ops.Close(websocket.StatusNormalClosure, "")
+	lobby, _, err := websocket.Dial(ctx, wsURL+"?username=bob", v2)
+	if err != nil {
+		t.Fatalf("Failed to join: %v", err)
+	}
+	defer lobby.Close(websocket.StatusNormalClosure, "")
+	readUntilType(t, ctx, ops, "system")
+	readUntilType(t, ctx, lobby, "system")
+
+	due, next := server.notices.due(entry.Next)
+	if len(due) != 1 || !next.After(entry.Next) {
+		t.Fatalf("Expected one announcement due and the next a week later, got %+v, %v", due, next)
+	}
+	server.sendRecurring(ctx, due[0])
+	if msg := readUntilType(t, ctx, ops, "announcement"); msg.Content != "Maintenance tonight at 03:00" {
+		t.Errorf("Expected the announcement, got %+v", msg)
+	}
+	if got := server.announcements.list(); len(got) != 1 || got[0].Delivered != 1 || got[0].Actor != "recurring:"+entry.ID {
+		t.Errorf("Expected the announcement to be logged, got %+v", got)
+	}
+
+	// Recurring announcements survive a restart
+	reloaded, err := NewNotices(path)
+	if err != nil {
+		t.Fatalf("Failed to reload notices: %v", err)
+	}
+	if list := reloaded.List(); len(list) != 1 || list[0].Cron != "0 3 * * 0" || list[0].Next.IsZero() {
+		t.Errorf("Expected the announcement after a restart, got %+v", list)
+	}
+
+	rec = httptest.NewRecorder()
+	server.handleAdminRecurring(rec, httptest.NewRequest(http.MethodDelete, "/admin/recurring?id="+entry.ID, nil))
+	if rec.Code != http.StatusNoContent || len(server.notices.List()) != 0 {
+		t.Errorf("Expected the announcement to be removed, got %d", rec.Code)
+	}
+}
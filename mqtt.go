@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	mqttQueueSize = 1024
+	mqttTimeout   = time.Second * 10
+	// mqttDefaultBot is the username MQTT payloads are posted as
+	mqttDefaultBot = "mqtt"
+)
+
+// mqttClient is the subset of mqtt.Client used by MQTTBridge
+type mqttClient interface {
+	Connect() mqtt.Token
+	Disconnect(quiesce uint)
+	Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token
+	Publish(topic string, qos byte, retained bool, payload any) mqtt.Token
+}
+
+// MQTTConfig configures an MQTTBridge
+type MQTTConfig struct {
+	// Broker is the broker URL, e.g. tcp://localhost:1883 or ssl://host:8883
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	// Bot is the username payloads are posted to rooms as
+	Bot string
+	// Subscribe maps topic filters, wildcards allowed, to the rooms their
+	// payloads are posted to, with "lobby" for the lobby
+	Subscribe map[string]string
+	// Publish maps topics to the rooms whose messages are published there
+	Publish map[string]string
+	QoS     byte
+}
+
+// MQTTBridge posts the payloads of subscribed MQTT topics to rooms as bot
+// messages and, optionally, publishes room messages to MQTT topics
+type MQTTBridge struct {
+	cfg    MQTTConfig
+	client mqttClient
+	queue  chan bridgeEvent
+	cs     *ChatServer
+}
+
+// MQTTPayload is published for each room message relayed to MQTT
+type MQTTPayload struct {
+	ID        string `json:"id"`
+	Room      string `json:"room"`
+	Username  string `json:"username"`
+	Content   string `json:"content"`
+	Timestamp int64  `json:"ts"`
+}
+
+// NewMQTTBridge checks cfg and returns a bridge for WithMQTTBridge
+func NewMQTTBridge(cfg MQTTConfig) (*MQTTBridge, error) {
+	if cfg.Broker == "" {
+		return nil, fmt.Errorf("mqtt bridge needs a broker URL")
+	}
+	b, err := newMQTTBridge(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(b.cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectTimeout(mqttTimeout).
+		SetOnConnectHandler(func(mqtt.Client) { b.subscribe() }).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) { log.Printf("MQTT connection lost: %v", err) })
+	b.client = mqtt.NewClient(opts)
+	return b, nil
+}
+
+func newMQTTBridge(cfg MQTTConfig, client mqttClient) (*MQTTBridge, error) {
+	if len(cfg.Subscribe) == 0 && len(cfg.Publish) == 0 {
+		return nil, fmt.Errorf("mqtt bridge needs at least one topic to subscribe or publish to")
+	}
+	if cfg.QoS > 2 {
+		return nil, fmt.Errorf("invalid mqtt qos %d", cfg.QoS)
+	}
+	if cfg.Bot == "" {
+		cfg.Bot = mqttDefaultBot
+	}
+	if len(cfg.Bot) > maxUsernameLength || !validUsernameRegex.MatchString(cfg.Bot) {
+		return nil, fmt.Errorf("invalid mqtt bot username %q", cfg.Bot)
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "chat-" + newTraceID()
+	}
+	return &MQTTBridge{cfg: cfg, client: client, queue: make(chan bridgeEvent, mqttQueueSize)}, nil
+}
+
+// ParseMQTTTopics parses "topic=room,..." into a topic map
+func ParseMQTTTopics(s string) (map[string]string, error) {
+	topics := make(map[string]string)
+	if s == "" {
+		return topics, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		topic, room, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || topic == "" || room == "" {
+			return nil, fmt.Errorf("invalid mqtt topic mapping %q (want topic=room)", pair)
+		}
+		topics[topic] = room
+	}
+	return topics, nil
+}
+
+// WithMQTTBridge posts MQTT payloads to rooms and publishes room messages
+// through the bridge
+func WithMQTTBridge(b *MQTTBridge) Option {
+	return func(cs *ChatServer) {
+		b.cs = cs
+		WithBridge(b)(cs)
+	}
+}
+
+// relay queues a room message for the topics publishing its room
+func (b *MQTTBridge) relay(ev bridgeEvent) {
+	if ev.kind != "message" || ev.username == b.cfg.Bot || len(b.cfg.Publish) == 0 {
+		return
+	}
+	select {
+	case b.queue <- ev:
+	default:
+		log.Printf("MQTT queue full, dropping message from %s", ev.username)
+	}
+}
+
+// run connects to the broker and publishes queued messages until ctx is
+// done. The client reconnects by itself and resubscribes on connect.
+func (b *MQTTBridge) run(ctx context.Context) {
+	token := b.client.Connect()
+	select {
+	case <-token.Done():
+		if err := token.Error(); err != nil {
+			log.Printf("MQTT bridge failed to connect to %s: %v", b.cfg.Broker, err)
+		}
+	case <-ctx.Done():
+	}
+	defer b.client.Disconnect(250)
+
+	for {
+		select {
+		case ev := <-b.queue:
+			b.publishMQTT(ev)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// subscribe subscribes to every configured topic filter
+func (b *MQTTBridge) subscribe() {
+	for filter, room := range b.cfg.Subscribe {
+		if room == lobbyRoom {
+			room = ""
+		}
+		token := b.client.Subscribe(filter, b.cfg.QoS, func(_ mqtt.Client, m mqtt.Message) {
+			b.post(room, m.Topic(), m.Payload(), m.Retained())
+		})
+		go func() {
+			if token.WaitTimeout(mqttTimeout) && token.Error() != nil {
+				log.Printf("MQTT subscribe to %s failed: %v", filter, token.Error())
+			}
+		}()
+	}
+}
+
+// post relays an MQTT payload to a room. Retained payloads are replayed on
+// every subscribe, so they are skipped.
+func (b *MQTTBridge) post(room, topic string, payload []byte, retained bool) {
+	if retained {
+		return
+	}
+	text := mqttText(payload)
+	if text == "" {
+		return
+	}
+	now := b.cs.now()
+	msg := Message{
+		Type:      "message",
+		Username:  b.cfg.Bot,
+		Content:   "[" + topic + "] " + text,
+		Room:      room,
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+		Trace:     newTraceID(),
+	}
+	msg.Content = truncateMessage(strings.ToValidUTF8(msg.Content, ""), b.cs.messageLimit)
+	if err := msg.validate(b.cs.messageLimit); err != nil {
+		log.Printf("Dropping MQTT payload from %s (trace %s): %v", topic, msg.Trace, err)
+		return
+	}
+	if err := b.cs.admitBridged(&msg); err != nil {
+		log.Printf("Dropping MQTT payload from %s (trace %s): %v", topic, msg.Trace, err)
+		return
+	}
+	if !b.cs.publish(msg) {
+		log.Printf("Dropping MQTT payload from %s (trace %s): hub busy", topic, msg.Trace)
+	}
+}
+
+// mqttText returns the text of a payload: the "text" or "message" field of
+// a JSON object, or else the payload itself. Binary payloads yield "".
+func mqttText(payload []byte) string {
+	if !utf8.Valid(payload) {
+		return ""
+	}
+	var obj map[string]any
+	if json.Unmarshal(payload, &obj) == nil {
+		for _, key := range []string{"text", "message"} {
+			if s, ok := obj[key].(string); ok && s != "" {
+				return strings.TrimSpace(s)
+			}
+		}
+	}
+	return strings.TrimSpace(string(payload))
+}
+
+// publishMQTT publishes a room message to every topic its room maps to
+func (b *MQTTBridge) publishMQTT(ev bridgeEvent) {
+	room := ev.room
+	if room == "" {
+		room = lobbyRoom
+	}
+	var payload []byte
+	for topic, r := range b.cfg.Publish {
+		if r != room {
+			continue
+		}
+		if payload == nil {
+			payload, _ = json.Marshal(MQTTPayload{ID: ev.id, Room: room, Username: ev.username, Content: ev.content, Timestamp: b.cs.now().UnixMilli()})
+		}
+		token := b.client.Publish(topic, b.cfg.QoS, false, payload)
+		if !token.WaitTimeout(mqttTimeout) {
+			log.Printf("MQTT publish to %s timed out", topic)
+		} else if err := token.Error(); err != nil {
+			log.Printf("MQTT publish to %s failed: %v", topic, err)
+		}
+	}
+}
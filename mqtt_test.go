@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket/wsjson"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeMQTTToken is an already completed token
+type fakeMQTTToken struct{}
+
+func (fakeMQTTToken) Wait() bool                     { return true }
+func (fakeMQTTToken) WaitTimeout(time.Duration) bool { return true }
+func (fakeMQTTToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (fakeMQTTToken) Error() error { return nil }
+
+// fakeMQTTMessage is a received MQTT message
+type fakeMQTTMessage struct {
+	topic    string
+	payload  string
+	retained bool
+}
+
+func (m fakeMQTTMessage) Duplicate() bool   { return false }
+func (m fakeMQTTMessage) Qos() byte         { return 0 }
+func (m fakeMQTTMessage) Retained() bool    { return m.retained }
+func (m fakeMQTTMessage) Topic() string     { return m.topic }
+func (m fakeMQTTMessage) MessageID() uint16 { return 0 }
+func (m fakeMQTTMessage) Payload() []byte   { return []byte(m.payload) }
+func (m fakeMQTTMessage) Ack()              {}
+
+// fakeMQTTClient records subscriptions and publishes
+type fakeMQTTClient struct {
+	mu        sync.Mutex
+	onConnect func()
+	handlers  map[string]mqtt.MessageHandler
+	published chan string
+}
+
+func (c *fakeMQTTClient) Connect() mqtt.Token {
+	c.onConnect()
+	return fakeMQTTToken{}
+}
+
+func (c *fakeMQTTClient) Disconnect(uint) {}
+
+func (c *fakeMQTTClient) Subscribe(topic string, _ byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[topic] = callback
+	return fakeMQTTToken{}
+}
+
+func (c *fakeMQTTClient) Publish(topic string, _ byte, _ bool, payload any) mqtt.Token {
+	c.published <- topic + " " + string(payload.([]byte))
+	return fakeMQTTToken{}
+}
+
+// deliver hands a message to the handler subscribed with filter, once the
+// bridge has subscribed
+func (c *fakeMQTTClient) deliver(filter string, m fakeMQTTMessage) {
+	for {
+		c.mu.Lock()
+		handler := c.handlers[filter]
+		c.mu.Unlock()
+		if handler != nil {
+			handler(nil, m)
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMQTTText(t *testing.T) {
+	for payload, want := range map[string]string{
+		"door open\n":                        "door open",
+		`{"text": "disk 91% full"}`:          "disk 91% full",
+		`{"message": "battery low", "v": 3}`: "battery low",
+		`{"temp": 21.5}`:                     `{"temp": 21.5}`,
+		"\xff\xfe":                           "",
+	} {
+		if got := mqttText([]byte(payload)); got != want {
+			t.Errorf("Expected %q for %q, got %q", want, payload, got)
+		}
+	}
+}
+
+func TestMQTTBridge(t *testing.T) {
+	client := &fakeMQTTClient{handlers: make(map[string]mqtt.MessageHandler), published: make(chan string, 10)}
+	bridge, err := newMQTTBridge(MQTTConfig{
+		Bot:       "sensors",
+		Subscribe: map[string]string{"alerts/#": "lobby"},
+		Publish:   map[string]string{"chat/lobby": "lobby"},
+	}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.onConnect = bridge.subscribe
+	server := NewChatServer(WithMQTTBridge(bridge))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+
+	// Retained payloads are old news
+	client.deliver("alerts/#", fakeMQTTMessage{topic: "alerts/door", payload: "stale", retained: true})
+	client.deliver("alerts/#", fakeMQTTMessage{topic: "alerts/rack-4", payload: `{"text": "temperature 41C"}`})
+	for {
+		var msg Message
+		if err := wsjson.Read(ctx, alice, &msg); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if msg.Type != "message" {
+			continue
+		}
+		if msg.Username != "sensors" || msg.Content != "[alerts/rack-4] temperature 41C" {
+			t.Errorf("Unexpected message %s: %q", msg.Username, msg.Content)
+		}
+		break
+	}
+
+	// The bot's own messages aren't published back
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "on it"})
+	select {
+	case got := <-client.published:
+		var payload MQTTPayload
+		if err := json.Unmarshal([]byte(got[len("chat/lobby "):]), &payload); err != nil || got[:len("chat/lobby")] != "chat/lobby" {
+			t.Fatalf("Unexpected publish %q (%v)", got, err)
+		}
+		if payload.Username != "alice" || payload.Content != "on it" || payload.Room != "lobby" || payload.ID == "" {
+			t.Errorf("Unexpected payload %+v", payload)
+		}
+	case <-ctx.Done():
+		t.Fatal("Expected alice's message to be published")
+	}
+	select {
+	case got := <-client.published:
+		t.Errorf("Unexpected publish %q", got)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	defaultNATSSubject = "chat.broadcast"
+	defaultNATSStream  = "CHAT"
+)
+
+// NATSBroker relays broadcasts over NATS. In core mode messages are
+// fire-and-forget; with JetStream enabled they are persisted to a stream so
+// an instance with a durable consumer catches up on what it missed while
+// restarting.
+type NATSBroker struct {
+	nc      *nats.Conn
+	js      jetstream.JetStream
+	subject string
+	stream  string
+	durable string
+	maxAge  time.Duration
+}
+
+// NewNATSBroker connects to the NATS server at u. Supported query parameters:
+//
+//	subject   subject to publish on (default chat.broadcast)
+//	jetstream "true" to persist the broadcast stream with JetStream
+//	stream    JetStream stream name (default CHAT)
+//	durable   durable consumer name, unique per instance; empty uses an ephemeral consumer
+//	max_age   how long JetStream keeps messages, e.g. 24h (default unlimited)
+func NewNATSBroker(u *url.URL) (*NATSBroker, error) {
+	q := u.Query()
+	b := &NATSBroker{
+		subject: q.Get("subject"),
+		stream:  q.Get("stream"),
+		durable: q.Get("durable"),
+	}
+	if b.subject == "" {
+		b.subject = defaultNATSSubject
+	}
+	if b.stream == "" {
+		b.stream = defaultNATSStream
+	}
+	var useJetStream bool
+	if v := q.Get("jetstream"); v != "" {
+		var err error
+		if useJetStream, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid jetstream: %w", err)
+		}
+	}
+	if v := q.Get("max_age"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_age: %w", err)
+		}
+		b.maxAge = d
+	}
+
+	// The NATS client doesn't understand our query parameters
+	server := *u
+	server.RawQuery = ""
+	nc, err := nats.Connect(server.String(),
+		nats.Name("ideal-guacamole"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Printf("NATS disconnected: %v", err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Printf("NATS reconnected to %s", nc.ConnectedUrlRedacted())
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to NATS: %w", err)
+	}
+	b.nc = nc
+
+	if useJetStream {
+		if err := b.setupJetStream(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// setupJetStream makes sure the broadcast stream exists
+func (b *NATSBroker) setupJetStream() error {
+	js, err := jetstream.New(b.nc)
+	if err != nil {
+		return fmt.Errorf("JetStream: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     b.stream,
+		Subjects: []string{b.subject},
+		MaxAge:   b.maxAge,
+	})
+	if err != nil {
+		return fmt.Errorf("creating JetStream stream %s: %w", b.stream, err)
+	}
+	b.js = js
+	return nil
+}
+
+// Publish sends msg on the broadcast subject
+func (b *NATSBroker) Publish(ctx context.Context, msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if b.js != nil {
+		_, err = b.js.Publish(ctx, b.subject, data)
+		return err
+	}
+	return b.nc.Publish(b.subject, data)
+}
+
+// Subscribe delivers messages from the broadcast subject to handler
+func (b *NATSBroker) Subscribe(ctx context.Context, handler func(Message)) error {
+	if b.js != nil {
+		return b.subscribeJetStream(ctx, handler)
+	}
+
+	sub, err := b.nc.Subscribe(b.subject, func(m *nats.Msg) {
+		if msg, ok := decodeBrokerMessage(m.Data); ok {
+			handler(msg)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		sub.Unsubscribe()
+	}()
+	return nil
+}
+
+// subscribeJetStream consumes the broadcast stream, starting from new
+// messages the first time a consumer is created
+func (b *NATSBroker) subscribeJetStream(ctx context.Context, handler func(Message)) error {
+	var (
+		consumer jetstream.Consumer
+		err      error
+	)
+	if b.durable != "" {
+		consumer, err = b.js.CreateOrUpdateConsumer(ctx, b.stream, jetstream.ConsumerConfig{
+			Durable:       b.durable,
+			DeliverPolicy: jetstream.DeliverNewPolicy,
+			AckPolicy:     jetstream.AckExplicitPolicy,
+			FilterSubject: b.subject,
+		})
+	} else {
+		consumer, err = b.js.OrderedConsumer(ctx, b.stream, jetstream.OrderedConsumerConfig{
+			DeliverPolicy:  jetstream.DeliverNewPolicy,
+			FilterSubjects: []string{b.subject},
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("creating JetStream consumer: %w", err)
+	}
+
+	cc, err := consumer.Consume(func(m jetstream.Msg) {
+		if msg, ok := decodeBrokerMessage(m.Data()); ok {
+			handler(msg)
+		}
+		if b.durable != "" {
+			m.Ack()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		cc.Stop()
+	}()
+	return nil
+}
+
+// Close drains pending publishes and disconnects
+func (b *NATSBroker) Close() error {
+	return b.nc.Drain()
+}
+
+// decodeBrokerMessage parses a message received from the broker
+func decodeBrokerMessage(data []byte) (Message, bool) {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Printf("Dropping undecodable broker message: %v", err)
+		return msg, false
+	}
+	return msg, true
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// defaultSessionTTL is how long a session token from an OIDC login
+	// lets its holder connect
+	defaultSessionTTL = time.Hour
+	// oidcLoginTTL is how long a user may take to log in at the provider
+	oidcLoginTTL = time.Minute * 10
+	// oidcCookie carries the state of a login in progress
+	oidcCookie  = "chat_oidc"
+	oidcTimeout = time.Second * 10
+	// oidcClockSkew is how far the provider's clock may be ahead of ours
+	oidcClockSkew = time.Minute
+	// jwksRefreshInterval is the least time between fetches of the
+	// provider's keys, so unknown key IDs can't make us hammer it
+	jwksRefreshInterval = time.Minute
+	// sessionIssuer is the iss claim of the session tokens we issue
+	sessionIssuer = "chat"
+)
+
+// OIDCConfig configures logging in through an OpenID Connect provider
+type OIDCConfig struct {
+	// Issuer is the provider's issuer URL, under which its discovery
+	// document is published
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is this server's /auth/callback, as registered with the
+	// provider
+	RedirectURL string
+	// Scopes are requested on top of openid; profile if empty
+	Scopes []string
+	// UsernameClaim, DisplayNameClaim and RolesClaim name the ID token
+	// claims mapped to the username, the profile's display name and the
+	// roles. They default to preferred_username, name and roles.
+	UsernameClaim    string
+	DisplayNameClaim string
+	RolesClaim       string
+	// SessionKey signs session tokens. Instances sharing a key accept each
+	// other's sessions. Empty generates one per process.
+	SessionKey []byte
+	// SessionTTL is how long a session token is valid, or
+	// defaultSessionTTL if zero
+	SessionTTL time.Duration
+}
+
+// oidcDiscovery is the part of a provider's discovery document we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider logs users in through the provider and verifies the session
+// tokens it issues, passing other tokens on to next
+type oidcProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+	now    func() time.Time
+	next   Authenticator
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+}
+
+// loginState is what the login cookie remembers between /auth/login and
+// /auth/callback
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Room     string `json:"room,omitempty"`
+	Expires  int64  `json:"exp"`
+}
+
+// sessionClaims are the claims of a session token
+type sessionClaims struct {
+	Issuer      string   `json:"iss"`
+	Subject     string   `json:"sub"`
+	DisplayName string   `json:"name,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	IssuedAt    int64    `json:"iat"`
+	Expires     int64    `json:"exp"`
+}
+
+// WithOIDC lets users log in at /auth/login through an OpenID Connect
+// provider. The session token they come back with authenticates their
+// connections; any other token goes to the authenticator set with
+// WithAuthenticator, if there is one.
+func WithOIDC(cfg OIDCConfig) Option {
+	return func(cs *ChatServer) {
+		if len(cfg.SessionKey) == 0 {
+			cfg.SessionKey = make([]byte, 32)
+			rand.Read(cfg.SessionKey)
+		}
+		if cfg.SessionTTL <= 0 {
+			cfg.SessionTTL = defaultSessionTTL
+		}
+		if len(cfg.Scopes) == 0 {
+			cfg.Scopes = []string{"profile"}
+		}
+		cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+		cfg.UsernameClaim = orDefault(cfg.UsernameClaim, "preferred_username")
+		cfg.DisplayNameClaim = orDefault(cfg.DisplayNameClaim, "name")
+		cfg.RolesClaim = orDefault(cfg.RolesClaim, "roles")
+		cs.oidc = &oidcProvider{
+			cfg:    cfg,
+			client: &http.Client{Timeout: oidcTimeout},
+			now:    cs.now,
+			keys:   make(map[string]crypto.PublicKey),
+		}
+	}
+}
+
+// orDefault returns s, or def if s is empty
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// getJSON fetches url and decodes its JSON body into v
+func (p *oidcProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover returns the provider's endpoints, fetching its discovery
+// document the first time
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	d := p.discovery
+	p.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+	d = new(oidcDiscovery)
+	if err := p.getJSON(ctx, p.cfg.Issuer+"/.well-known/openid-configuration", d); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("provider claims to be %q, not %q", d.Issuer, p.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("discovery document lacks an endpoint")
+	}
+	p.mu.Lock()
+	p.discovery = d
+	p.mu.Unlock()
+	return d, nil
+}
+
+// key returns the provider's signing key kid, fetching its keys again if
+// it is new to us
+func (p *oidcProvider) key(ctx context.Context, d *oidcDiscovery, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	stale := p.now().Sub(p.fetched) >= jwksRefreshInterval
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := p.getJSON(ctx, d.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, raw := range jwks.Keys {
+		id, key, err := parseJWK(raw)
+		if err != nil {
+			// Keys we can't use don't spoil the ones we can
+			continue
+		}
+		keys[id] = key
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.fetched = p.now()
+	p.mu.Unlock()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// parseJWK decodes an RSA or P-256 public key from its JWK form
+func parseJWK(raw json.RawMessage) (string, crypto.PublicKey, error) {
+	var jwk struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return "", nil, err
+	}
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return "", nil, errors.New("not a signing key")
+	}
+	b64 := base64.RawURLEncoding
+	switch jwk.Kty {
+	case "RSA":
+		n, err1 := b64.DecodeString(jwk.N)
+		e, err2 := b64.DecodeString(jwk.E)
+		if err := errors.Join(err1, err2); err != nil || len(e) > 4 {
+			return "", nil, errors.New("invalid RSA key")
+		}
+		return jwk.Kid, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		x, err1 := b64.DecodeString(jwk.X)
+		y, err2 := b64.DecodeString(jwk.Y)
+		if err := errors.Join(err1, err2); err != nil || jwk.Crv != "P-256" {
+			return "", nil, errors.New("invalid or unsupported EC key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return "", nil, errors.New("EC key is not on its curve")
+		}
+		return jwk.Kid, key, nil
+	}
+	return "", nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// splitJWT decodes the header and claims of a compact JWT, returning the
+// signed part and the signature
+func splitJWT(token string, claims any) (header struct{ Alg, Kid string }, signed string, sig []byte, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return header, "", nil, errors.New("malformed token")
+	}
+	b64 := base64.RawURLEncoding
+	h, err1 := b64.DecodeString(parts[0])
+	c, err2 := b64.DecodeString(parts[1])
+	sig, err3 := b64.DecodeString(parts[2])
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return header, "", nil, errors.New("malformed token")
+	}
+	var raw struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if json.Unmarshal(h, &raw) != nil || json.Unmarshal(c, claims) != nil {
+		return header, "", nil, errors.New("malformed token")
+	}
+	header.Alg, header.Kid = raw.Alg, raw.Kid
+	return header, parts[0] + "." + parts[1], sig, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of
+// an ID token, returning its claims
+func (p *oidcProvider) verifyIDToken(ctx context.Context, d *oidcDiscovery, token, nonce string) (map[string]any, error) {
+	var claims map[string]any
+	header, signed, sig, err := splitJWT(token, &claims)
+	if err != nil {
+		return nil, err
+	}
+	key, err := p.key(ctx, d, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(signed))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("invalid ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("invalid ID token signature")
+		}
+	default:
+		return nil, errors.New("unsupported ID token key")
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("ID token issued by %q", iss)
+	}
+	if !slices.Contains(stringsClaim(claims["aud"]), p.cfg.ClientID) {
+		return nil, errors.New("ID token issued to another client")
+	}
+	exp, _ := claims["exp"].(float64)
+	if p.now().Add(-oidcClockSkew).Unix() >= int64(exp) {
+		return nil, errors.New("ID token expired")
+	}
+	if got, _ := claims["nonce"].(string); got == "" || !hmac.Equal([]byte(got), []byte(nonce)) {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// stringsClaim reads a claim that is a string, an array of strings or, as
+// some providers send roles, space-separated strings
+func stringsClaim(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		var out []string
+		for _, s := range v {
+			if s, ok := s.(string); ok && s != "" {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// identity maps the claims of an ID token to who the user is here
+func (p *oidcProvider) identity(claims map[string]any) *Identity {
+	username, _ := claims[p.cfg.UsernameClaim].(string)
+	displayName, _ := claims[p.cfg.DisplayNameClaim].(string)
+	if utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+		displayName = string([]rune(displayName)[:maxDisplayNameLength])
+	}
+	return &Identity{Username: username, DisplayName: displayName, Roles: stringsClaim(claims[p.cfg.RolesClaim])}
+}
+
+// mac signs s with the session key
+func (p *oidcProvider) mac(s string) []byte {
+	m := hmac.New(sha256.New, p.cfg.SessionKey)
+	m.Write([]byte(s))
+	return m.Sum(nil)
+}
+
+// issueSession returns a session token for identity, signed with HS256
+func (p *oidcProvider) issueSession(identity *Identity) string {
+	now := p.now()
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "HS256"})
+	claims, _ := json.Marshal(sessionClaims{
+		Issuer:      sessionIssuer,
+		Subject:     identity.Username,
+		DisplayName: identity.DisplayName,
+		Roles:       identity.Roles,
+		IssuedAt:    now.Unix(),
+		Expires:     now.Add(p.cfg.SessionTTL).Unix(),
+	})
+	b64 := base64.RawURLEncoding
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(claims)
+	return signed + "." + b64.EncodeToString(p.mac(signed))
+}
+
+// Authenticate accepts a session token we issued that hasn't expired.
+// Tokens we didn't sign go to the next authenticator, if there is one.
+func (p *oidcProvider) Authenticate(ctx context.Context, token string) (*Identity, error) {
+	var claims sessionClaims
+	header, signed, sig, err := splitJWT(token, &claims)
+	if err != nil || header.Alg != "HS256" || !hmac.Equal(sig, p.mac(signed)) {
+		if p.next != nil {
+			return p.next.Authenticate(ctx, token)
+		}
+		return nil, errUnauthenticated
+	}
+	if claims.Issuer != sessionIssuer || p.now().Unix() >= claims.Expires {
+		return nil, errUnauthenticated
+	}
+	return &Identity{Username: claims.Subject, DisplayName: claims.DisplayName, Roles: claims.Roles}, nil
+}
+
+// encodeLoginState signs state for the login cookie
+func (p *oidcProvider) encodeLoginState(state loginState) string {
+	body, _ := json.Marshal(state)
+	encoded := base64.RawURLEncoding.EncodeToString(body)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(p.mac("login."+encoded))
+}
+
+// decodeLoginState checks the login cookie's signature and expiry
+func (p *oidcProvider) decodeLoginState(cookie string) (loginState, bool) {
+	var state loginState
+	encoded, sig, ok := strings.Cut(cookie, ".")
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if !ok || err != nil || !hmac.Equal(mac, p.mac("login."+encoded)) {
+		return state, false
+	}
+	body, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(body, &state) != nil {
+		return state, false
+	}
+	return state, p.now().Unix() < state.Expires
+}
+
+// randomToken returns 32 random bytes, base64url-encoded
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// handleAuthLogin serves GET /auth/login, sending the browser to the
+// provider. ?room=<name> brings the user back to that room. HEAD answers
+// 204, so the web client can tell whether to offer logging in.
+func (cs *ChatServer) handleAuthLogin(w http.ResponseWriter, r *http.Request) {
+	p := cs.oidc
+	if p == nil {
+		http.Error(w, "login not configured", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cs.rejectBanned(w, r) {
+		return
+	}
+	d, err := p.discover(r.Context())
+	if err != nil {
+		log.Printf("OIDC discovery failed: %v", err)
+		http.Error(w, "login provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state := loginState{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		Room:     r.URL.Query().Get("room"),
+		Expires:  cs.now().Add(oidcLoginTTL).Unix(),
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    p.encodeLoginState(state),
+		Path:     "/auth/",
+		MaxAge:   int(oidcLoginTTL / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(p.cfg.RedirectURL, "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, p.cfg.Scopes...), " ")},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// exchange trades an authorization code for the provider's ID token
+func (p *oidcProvider) exchange(ctx context.Context, d *oidcDiscovery, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {verifier},
+		"client_id":     {p.cfg.ClientID},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body)
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("token endpoint answered %s %s", resp.Status, body.Error)
+	}
+	return body.IDToken, nil
+}
+
+// handleAuthCallback serves GET /auth/callback, where the provider sends
+// the browser back. It checks the login, then sends the browser to the web
+// client with a session token in the URL fragment, which the client
+// presents as ?token= when it connects.
+func (cs *ChatServer) handleAuthCallback(w http.ResponseWriter, r *http.Request) {
+	p := cs.oidc
+	if p == nil {
+		http.Error(w, "login not configured", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cs.rejectBanned(w, r) {
+		return
+	}
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		http.Error(w, "no login in progress", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/auth/", MaxAge: -1})
+	state, ok := p.decodeLoginState(cookie.Value)
+	q := r.URL.Query()
+	if !ok || !hmac.Equal([]byte(q.Get("state")), []byte(state.State)) {
+		http.Error(w, "login expired or forged, try again", http.StatusBadRequest)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "login refused by the provider: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	d, err := p.discover(r.Context())
+	if err != nil {
+		log.Printf("OIDC discovery failed: %v", err)
+		http.Error(w, "login provider unavailable", http.StatusBadGateway)
+		return
+	}
+	idToken, err := p.exchange(r.Context(), d, q.Get("code"), state.Verifier)
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		http.Error(w, "login provider unavailable", http.StatusBadGateway)
+		return
+	}
+	claims, err := p.verifyIDToken(r.Context(), d, idToken, state.Nonce)
+	if err != nil {
+		log.Printf("Refused OIDC login from %s: %v", r.RemoteAddr, err)
+		cs.strike(r, "invalid OIDC ID token")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	identity := p.identity(claims)
+	identity.Username = cs.usernamePolicy.normalize(identity.Username)
+	if identity.Username == "" {
+		http.Error(w, fmt.Sprintf("the provider sent no %s claim", p.cfg.UsernameClaim), http.StatusForbidden)
+		return
+	}
+	if err := cs.validateUsername(identity.Username); err != nil {
+		http.Error(w, fmt.Sprintf("%s %q can't be a username here: %v", p.cfg.UsernameClaim, identity.Username, err), http.StatusForbidden)
+		return
+	}
+	log.Printf("OIDC login by %s from %s", identity.Username, r.RemoteAddr)
+
+	target := "/"
+	if state.Room != "" {
+		target += "?" + url.Values{"room": {state.Room}}.Encode()
+	}
+	http.Redirect(w, r, target+"#token="+p.issueSession(identity), http.StatusFound)
+}
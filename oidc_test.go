@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// fakeProvider is an OpenID Connect provider that logs everyone in with
+// the claims it is given
+type fakeProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]any
+	// nonce and challenge are taken from the last authorization request
+	nonce, challenge string
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+			JWKSURI:               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kid": "k1", "kty": "RSA", "use": "sig",
+			"n": b64.EncodeToString(key.N.Bytes()),
+			"e": b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if id, secret, _ := r.BasicAuth(); id != "chat" || secret != "s3cret" || r.PostForm.Get("code") != "good-code" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != p.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := map[string]any{"iss": p.URL, "aud": "chat", "exp": time.Now().Add(time.Minute).Unix(), "nonce": p.nonce}
+		for k, v := range p.claims {
+			claims[k] = v
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.sign(t, claims)})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// sign returns claims as an RS256 ID token
+func (p *fakeProvider) sign(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+	body, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+// login runs /auth/login and /auth/callback with code, returning the
+// callback's response
+func (p *fakeProvider) login(t *testing.T, s *httptest.Server, code string) *http.Response {
+	t.Helper()
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(s.URL + "/auth/login?room=ops")
+	if err != nil {
+		t.Fatalf("Failed to start login: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected a redirect to the provider, got %s", resp.Status)
+	}
+	authorize, _ := url.Parse(resp.Header.Get("Location"))
+	q := authorize.Query()
+	if !strings.HasPrefix(authorize.String(), p.URL+"/authorize") || q.Get("client_id") != "chat" || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("Unexpected authorization request %s", authorize)
+	}
+	p.nonce, p.challenge = q.Get("nonce"), q.Get("code_challenge")
+
+	req, _ := http.NewRequest(http.MethodGet, s.URL+"/auth/callback?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), nil)
+	for _, c := range resp.Cookies() {
+		req.AddCookie(c)
+	}
+	resp, err = noRedirect.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to call back: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestOIDC(t *testing.T) {
+	provider := newFakeProvider(t)
+	provider.claims = map[string]any{"preferred_username": "alice", "name": "Alice Liddell", "roles": []string{"moderator"}}
+	clock := NewManualClock(time.Now())
+	server := NewChatServer(WithClock(clock), WithOIDC(OIDCConfig{
+		Issuer:       provider.URL,
+		ClientID:     "chat",
+		ClientSecret: "s3cret",
+		RedirectURL:  "http://chat.example/auth/callback",
+	}))
+	server.Run(t.Context())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", server.handleConnection)
+	mux.HandleFunc("/auth/login", server.handleAuthLogin)
+	mux.HandleFunc("/auth/callback", server.handleAuthCallback)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	if resp := provider.login(t, s, "bad-code"); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502 when the code is refused, got %s", resp.Status)
+	}
+	resp := provider.login(t, s, "good-code")
+	target, _ := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || target.Path != "/" || target.Query().Get("room") != "ops" {
+		t.Fatalf("Expected a redirect to the web client, got %s %s", resp.Status, target)
+	}
+	token := strings.TrimPrefix(target.Fragment, "token=")
+
+	identity, err := server.auth.Authenticate(context.Background(), token)
+	if err != nil || identity.Username != "alice" || identity.DisplayName != "Alice Liddell" || len(identity.Roles) != 1 {
+		t.Fatalf("Expected alice's identity from the session token, got %+v, %v", identity, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"/ws?token="+url.QueryEscape(token), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect with the session token: %v", err)
+	}
+	defer c.CloseNow()
+	if info, ok := server.Client("alice"); !ok || !info.Authenticated {
+		t.Errorf("Expected alice to be logged in, got %+v", info)
+	}
+	if profiles := server.profiles([]string{"alice"}); profiles["alice"].DisplayName != "Alice Liddell" {
+		t.Errorf("Expected the display name from the claims, got %+v", profiles)
+	}
+
+	if _, err := server.auth.Authenticate(context.Background(), token[:len(token)-2]+"xx"); err == nil {
+		t.Errorf("Expected a tampered token to be refused")
+	}
+	clock.Advance(defaultSessionTTL)
+	if _, err := server.auth.Authenticate(context.Background(), token); err == nil {
+		t.Errorf("Expected an expired session to be refused")
+	}
+}
+
+func TestOIDC_Refused(t *testing.T) {
+	provider := newFakeProvider(t)
+	server := NewChatServer(WithOIDC(OIDCConfig{Issuer: provider.URL, ClientID: "chat", ClientSecret: "s3cret", RedirectURL: "http://chat.example/auth/callback"}))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/login", server.handleAuthLogin)
+	mux.HandleFunc("/auth/callback", server.handleAuthCallback)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	// A username that isn't valid here is refused
+	provider.claims = map[string]any{"preferred_username": "alice@example.com"}
+	if resp := provider.login(t, s, "good-code"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for an unusable username, got %s", resp.Status)
+	}
+	// So is an ID token for another client
+	provider.claims = map[string]any{"preferred_username": "alice", "aud": []string{"other"}}
+	if resp := provider.login(t, s, "good-code"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for another client's ID token, got %s", resp.Status)
+	}
+
+	// Without a login cookie the callback is refused
+	resp, err := http.Get(s.URL + "/auth/callback?code=good-code&state=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a login in progress, got %s", resp.Status)
+	}
+
+	disabled := httptest.NewRecorder()
+	NewChatServer().handleAuthLogin(disabled, httptest.NewRequest(http.MethodHead, "/auth/login", nil))
+	if disabled.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without OIDC, got %d", disabled.Code)
+	}
+}
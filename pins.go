@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// maxPins is how many messages a room may have pinned at once
+const maxPins = 50
+
+// RoomState is the snapshot of a room's topic, pinned messages, read
+// markers and cache hints sent to v2 clients joining a room that has any
+// of them
+type RoomState struct {
+	Type  string      `json:"type"`
+	Room  string      `json:"room,omitempty"`
+	Topic string      `json:"topic,omitempty"`
+	Pins  []Message   `json:"pins"`
+	Cache *CacheHints `json:"cache,omitempty"`
+	// SlowMode is the seconds between one user's messages, if slow mode
+	// is on
+	SlowMode int `json:"slow_mode,omitempty"`
+
+	// Reads maps users to the last message they read. LastRead and Unread
+	// are the joining client's own marker and how many messages arrived
+	// after it.
+	Reads    map[string]string `json:"reads,omitempty"`
+	LastRead string            `json:"last_read,omitempty"`
+	Unread   int               `json:"unread,omitempty"`
+}
+
+// Find returns the stored message with the given ID
+func (h *History) Find(id string) (Message, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := 0; i < h.n; i++ {
+		seq := h.lastSeq - uint64(i)
+		if msg := h.slot(seq); msg.ID == id {
+			return *msg, true
+		}
+	}
+	return Message{}, false
+}
+
+// stateRoom returns the Room holding the named room's topic and pins; the
+// lobby's live in cs.lobby
+func (cs *ChatServer) stateRoom(name string) *Room {
+	if name == "" || name == lobbyRoom {
+		return cs.lobby
+	}
+	return cs.lookupRoom(name)
+}
+
+// roomState snapshots the topic and pins of a room
+func (cs *ChatServer) roomState(room *Room) RoomState {
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	state := RoomState{Type: "room", Topic: room.Topic, Pins: slices.Clone(room.pins), Cache: cs.cacheHints(), Reads: readsLocked(room), SlowMode: int(room.slowMode / time.Second)}
+	if room != cs.lobby {
+		state.Room = room.Name
+	}
+	if state.Pins == nil {
+		state.Pins = []Message{}
+	}
+	return state
+}
+
+// sendRoomState gives a joining client the room's topic, pins, read
+// markers and cache hints, if there are any. v1 clients only learn the topic, as a system
+// notice.
+func (cs *ChatServer) sendRoomState(ctx context.Context, client *Client) {
+	room := client.room
+	if room == nil {
+		room = cs.lobby
+	}
+	state := cs.roomState(room)
+	state.LastRead, state.Unread = cs.unread(client, room)
+	if state.Topic == "" && len(state.Pins) == 0 && state.Cache == nil && state.Reads == nil && state.SlowMode == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	var err error
+	if client.version == protocolV1 {
+		if state.Topic == "" {
+			return
+		}
+		err = client.writeMessage(ctx, Message{
+			Type:     "system",
+			Username: "Server",
+			Content:  "Topic: " + state.Topic,
+			Time:     cs.now().Format(time.RFC3339),
+		})
+	} else {
+		err = client.write(ctx, state)
+	}
+	if err != nil {
+		client.logf("Error sending room state to %s: %v", client.username, err)
+	}
+}
+
+// applyRoomEvent updates a room's topic or pins from a "topic", "pin" or
+// "unpin" event. It runs as the event is delivered, so every instance
+// sharing a broker keeps the lobby's state in step.
+func (cs *ChatServer) applyRoomEvent(msg Message) {
+	room := cs.stateRoom(msg.Room)
+	if room == nil {
+		return
+	}
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+
+	switch msg.Type {
+	case "topic":
+		room.Topic = msg.Topic
+	case "pin":
+		if msg.Pinned != nil && !slices.ContainsFunc(room.pins, func(m Message) bool { return m.ID == msg.Pinned.ID }) {
+			room.pins = append(room.pins, *msg.Pinned)
+		}
+	case "unpin":
+		if msg.Pinned != nil {
+			room.pins = slices.DeleteFunc(room.pins, func(m Message) bool { return m.ID == msg.Pinned.ID })
+		}
+	case "slowmode":
+		room.slowMode = time.Duration(msg.SlowMode) * time.Second
+		if room.slowMode == 0 {
+			room.lastPosted = nil
+		}
+	}
+}
+
+// unpinUser drops pinned messages sent by an erased user from every room
+func (cs *ChatServer) unpinUser(username string) {
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	fromUser := func(m Message) bool { return m.Username == username }
+	cs.lobby.pins = slices.DeleteFunc(cs.lobby.pins, fromUser)
+	for _, room := range cs.rooms {
+		room.pins = slices.DeleteFunc(room.pins, fromUser)
+	}
+}
+
+// roomEvent builds a topic, pin or slow mode event for the named room
+func (cs *ChatServer) roomEvent(typ, room, content string) Message {
+	now := cs.now()
+	if room == lobbyRoom {
+		room = ""
+	}
+	return Message{
+		Type:      typ,
+		Username:  "Server",
+		Content:   content,
+		Room:      room,
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+	}
+}
+
+// handleAdminTopic serves POST /admin/topic?room=<name> with
+// {"topic": "..."}, setting the room's topic. An empty topic clears it.
+func (cs *ChatServer) handleAdminTopic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("room")
+	if cs.stateRoom(name) == nil {
+		http.Error(w, errRoomNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	var body struct {
+		Topic string `json:"topic"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if len(body.Topic) > maxRoomTopicLength {
+		http.Error(w, fmt.Sprintf("room topic too long (max %d characters)", maxRoomTopicLength), http.StatusBadRequest)
+		return
+	}
+
+	msg := cs.roomEvent("topic", name, "Topic changed to: "+body.Topic)
+	if body.Topic == "" {
+		msg.Content = "Topic cleared"
+	}
+	msg.Topic = body.Topic
+	if !cs.publish(msg) {
+		http.Error(w, "server busy, try again", http.StatusServiceUnavailable)
+		return
+	}
+	cs.audit(AuditTopic, adminActor(r), roomOrLobby(name), body.Topic)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminPins serves the pins of a room: GET /admin/pins?room=<name>
+// lists them, POST /admin/pins?room=<name>&id=<message id>&expires_in=24h
+// pins a stored message, until it expires if expires_in is set, and DELETE
+// with the same room and id unpins it
+func (cs *ChatServer) handleAdminPins(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("room")
+	room := cs.stateRoom(name)
+	if room == nil {
+		http.Error(w, errRoomNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	id := r.URL.Query().Get("id")
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cs.roomState(room).Pins)
+
+	case http.MethodPost:
+		ttl, err := parseExpiry(r.URL.Query().Get("expires_in"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		history := cs.history
+		if room != cs.lobby {
+			history = room.history
+		}
+		pinned, ok := history.Find(id)
+		if !ok {
+			http.Error(w, "no such message in the room's history", http.StatusNotFound)
+			return
+		}
+		if err := cs.checkPinLimit(room); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		msg := cs.roomEvent("pin", name, fmt.Sprintf("A message from %s was pinned", pinned.Username))
+		if ttl > 0 {
+			pinned.ExpiresAt = cs.now().Add(ttl).UTC().Format(time.RFC3339)
+		}
+		msg.Pinned = &pinned
+		if !cs.publish(msg) {
+			http.Error(w, "server busy, try again", http.StatusServiceUnavailable)
+			return
+		}
+		if ttl > 0 {
+			cs.afterFunc(ttl, func() { cs.expirePin(name, pinned) })
+		}
+		cs.audit(AuditPin, adminActor(r), roomOrLobby(name), id)
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if !slices.ContainsFunc(cs.roomState(room).Pins, func(m Message) bool { return m.ID == id }) {
+			http.Error(w, "message is not pinned", http.StatusNotFound)
+			return
+		}
+		msg := cs.roomEvent("unpin", name, "A message was unpinned")
+		msg.Pinned = &Message{ID: id}
+		if !cs.publish(msg) {
+			http.Error(w, "server busy, try again", http.StatusServiceUnavailable)
+			return
+		}
+		cs.audit(AuditUnpin, adminActor(r), roomOrLobby(name), id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// expirePin unpins a pin whose time is up, unless it has been unpinned
+// since or pinned again with another expiry
+func (cs *ChatServer) expirePin(name string, pin Message) {
+	room := cs.stateRoom(name)
+	if room == nil || !slices.ContainsFunc(cs.roomState(room).Pins, func(m Message) bool { return m.ID == pin.ID && m.ExpiresAt == pin.ExpiresAt }) {
+		return
+	}
+	msg := cs.roomEvent("unpin", name, "A pinned message expired")
+	msg.Pinned = &Message{ID: pin.ID}
+	if !cs.publish(msg) {
+		log.Printf("Error unpinning expired message %s in %s: server busy", pin.ID, roomOrLobby(name))
+		return
+	}
+	cs.audit(AuditUnpin, "system", roomOrLobby(name), pin.ID)
+}
+
+// parseExpiry parses an expires_in duration, zero when it is empty
+func parseExpiry(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errors.New("invalid expires_in")
+	}
+	return d, nil
+}
+
+// checkPinLimit reports an error if the room can't take another pin
+func (cs *ChatServer) checkPinLimit(room *Room) error {
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	if len(room.pins) >= maxPins {
+		return errors.New("too many pinned messages (max 50)")
+	}
+	return nil
+}
+
+// roomOrLobby names a room for logs and the audit log
+func roomOrLobby(name string) string {
+	if name == "" {
+		return lobbyRoom
+	}
+	return name
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestRoomState_TopicAndPins(t *testing.T) {
+	server := NewChatServer(WithAdminToken("secret"))
+	server.Run(t.Context())
+	s := newAdminTestServer(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+	v2 := &websocket.DialOptions{Subprotocols: []string{subprotocolV2}}
+
+	alice, _, err := websocket.Dial(ctx, wsURL+"?username=alice", v2)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	read := func() Message {
+		t.Helper()
+		var msg Message
+		if err := wsjson.Read(ctx, alice, &msg); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		return msg
+	}
+	read() // join notice
+
+	if err := wsjson.Write(ctx, alice, Message{Type: "message", Content: "read the rules"}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	rules := read()
+
+	resp := adminRequest(t, ctx, http.MethodPost, s.URL+"/admin/pins?id=nope", "secret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 pinning an unknown message, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, s.URL+"/admin/topic", strings.NewReader(`{"topic": "Be nice"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Failed to set topic: %v %v", resp, err)
+	}
+	resp.Body.Close()
+	if msg := read(); msg.Type != "topic" || msg.Topic != "Be nice" {
+		t.Errorf("Expected a topic event, got %+v", msg)
+	}
+
+	resp = adminRequest(t, ctx, http.MethodPost, s.URL+"/admin/pins?id="+rules.ID, "secret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Failed to pin: %d", resp.StatusCode)
+	}
+	if msg := read(); msg.Type != "pin" || msg.Pinned == nil || msg.Pinned.Content != "read the rules" {
+		t.Errorf("Expected a pin event, got %+v", msg)
+	}
+
+	// Joining clients get the state before anything else
+	bob, _, err := websocket.Dial(ctx, wsURL+"?username=bob", v2)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer bob.Close(websocket.StatusNormalClosure, "")
+	var state RoomState
+	if err := wsjson.Read(ctx, bob, &state); err != nil {
+		t.Fatalf("Failed to read room state: %v", err)
+	}
+	if state.Type != "room" || state.Topic != "Be nice" || len(state.Pins) != 1 || state.Pins[0].ID != rules.ID {
+		t.Errorf("Unexpected room state: %+v", state)
+	}
+	read() // bob's join notice
+
+	resp = adminRequest(t, ctx, http.MethodDelete, s.URL+"/admin/pins?id="+rules.ID, "secret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Failed to unpin: %d", resp.StatusCode)
+	}
+	if msg := read(); msg.Type != "unpin" || msg.Pinned == nil || msg.Pinned.ID != rules.ID {
+		t.Errorf("Expected an unpin event, got %+v", msg)
+	}
+
+	resp = adminRequest(t, ctx, http.MethodGet, s.URL+"/admin/pins", "secret")
+	defer resp.Body.Close()
+	var pins []Message
+	json.NewDecoder(resp.Body).Decode(&pins)
+	if len(pins) != 0 {
+		t.Errorf("Expected no pins left, got %+v", pins)
+	}
+}
+
+func TestPins_Expire(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	server := NewChatServer(WithAdminToken("secret"), WithClock(clock))
+	server.Run(t.Context())
+	s := newAdminTestServer(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+	alice, _, err := websocket.Dial(ctx, wsURL+"?username=alice", &websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer alice.Close(websocket.StatusNormalClosure, "")
+	readUntilType(t, ctx, alice, "system")
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "sale ends friday"})
+	sale := readUntilType(t, ctx, alice, "message")
+
+	resp := adminRequest(t, ctx, http.MethodPost, s.URL+"/admin/pins?id="+sale.ID+"&expires_in=forever", "secret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid expires_in, got %d", resp.StatusCode)
+	}
+	resp = adminRequest(t, ctx, http.MethodPost, s.URL+"/admin/pins?id="+sale.ID+"&expires_in=1h", "secret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Failed to pin: %d", resp.StatusCode)
+	}
+	want := clock.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if msg := readUntilType(t, ctx, alice, "pin"); msg.Pinned == nil || msg.Pinned.ExpiresAt != want {
+		t.Errorf("Expected a pin expiring at %s, got %+v", want, msg.Pinned)
+	}
+
+	clock.Advance(time.Hour)
+	if msg := readUntilType(t, ctx, alice, "unpin"); msg.Pinned == nil || msg.Pinned.ID != sale.ID {
+		t.Errorf("Expected the expired pin to be unpinned, got %+v", msg)
+	}
+	if pins := server.roomState(server.lobby).Pins; len(pins) != 0 {
+		t.Errorf("Expected no pins left, got %+v", pins)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pluginQueue is how many events a plugin may fall behind by before new
+// ones are dropped
+const pluginQueue = 256
+
+// Plugin is a bot running inside the server. Its hooks are called one at a
+// time on the plugin's own goroutine, so a slow plugin never holds up chat;
+// embed BasePlugin to implement only some of them.
+type Plugin interface {
+	// Name is the username the plugin's messages are sent under
+	Name() string
+	// Commands lists the slash commands the plugin answers, without the
+	// slash. Commands are taken out of the chat and handed to OnCommand.
+	Commands() []string
+	// OnConnect is called when a user connects to this instance
+	OnConnect(ctx context.Context, bot *Bot, ev PresenceEvent)
+	// OnMessage is called for every plaintext chat message accepted by
+	// this instance, apart from messages sent by plugins
+	OnMessage(ctx context.Context, bot *Bot, msg Message)
+	// OnCommand is called for each of the plugin's slash commands
+	OnCommand(ctx context.Context, bot *Bot, cmd Command)
+	// OnDisconnect is called when a user disconnects from this instance
+	OnDisconnect(ctx context.Context, bot *Bot, ev PresenceEvent)
+}
+
+// BasePlugin implements every Plugin hook as a no-op, for plugins to embed
+type BasePlugin struct{}
+
+func (BasePlugin) Commands() []string                                { return nil }
+func (BasePlugin) OnConnect(context.Context, *Bot, PresenceEvent)    {}
+func (BasePlugin) OnMessage(context.Context, *Bot, Message)          {}
+func (BasePlugin) OnCommand(context.Context, *Bot, Command)          {}
+func (BasePlugin) OnDisconnect(context.Context, *Bot, PresenceEvent) {}
+
+// PresenceEvent is a user connecting to or disconnecting from a room, empty
+// for the lobby
+type PresenceEvent struct {
+	Username string
+	Room     string
+}
+
+// Command is a slash command sent by a user: "/roll 2d6" has the name
+// "roll" and the arguments "2d6"
+type Command struct {
+	Name     string
+	Args     string
+	Username string
+	Room     string
+	Trace    string
+}
+
+// PluginFactory creates a plugin from its settings, the text after "=" in
+// a -plugins entry
+type PluginFactory func(config string) (Plugin, error)
+
+var (
+	pluginsMu sync.Mutex
+	factories = make(map[string]PluginFactory)
+)
+
+// RegisterPlugin makes a plugin available by name to -plugins. Plugins
+// compiled into the server call it from an init function. It panics if the
+// name is taken.
+func RegisterPlugin(name string, factory PluginFactory) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	if _, ok := factories[name]; ok {
+		panic("plugin registered twice: " + name)
+	}
+	factories[name] = factory
+}
+
+// registeredPlugins returns the names of the registered plugins, sorted
+func registeredPlugins() []string {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewPlugins creates the plugins named in a comma-separated list, each
+// optionally followed by "=" and its settings
+func NewPlugins(list string) ([]Plugin, error) {
+	var plugins []Plugin
+	for spec := range strings.SplitSeq(list, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, config, _ := strings.Cut(spec, "=")
+		pluginsMu.Lock()
+		factory, ok := factories[name]
+		pluginsMu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown plugin %q (registered: %s)", name, strings.Join(registeredPlugins(), ", "))
+		}
+		p, err := factory(config)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: %w", name, err)
+		}
+		plugins = append(plugins, p)
+	}
+	return plugins, nil
+}
+
+// WithPlugins runs plugins inside the server
+func WithPlugins(plugins ...Plugin) Option {
+	return func(cs *ChatServer) {
+		for _, p := range plugins {
+			cs.plugins = append(cs.plugins, &pluginHost{
+				plugin: p,
+				bot:    &Bot{name: p.Name(), cs: cs},
+				events: make(chan func(context.Context), pluginQueue),
+			})
+		}
+	}
+}
+
+// Bot is a plugin's handle on the server
+type Bot struct {
+	name string
+	cs   *ChatServer
+}
+
+// Name returns the username the bot sends under
+func (b *Bot) Name() string {
+	return b.name
+}
+
+// Say sends a chat message to a room, empty for the lobby, reporting
+// whether it was accepted
+func (b *Bot) Say(room, content string) bool {
+	return b.cs.publish(b.message(room, content))
+}
+
+// Whisper sends a chat message in a room that only username sees
+func (b *Bot) Whisper(room, username, content string) bool {
+	msg := b.message(room, content)
+	msg.To = username
+	return b.cs.publish(msg)
+}
+
+// message builds a chat message from the bot
+func (b *Bot) message(room, content string) Message {
+	now := b.cs.now()
+	return Message{
+		Type:      "message",
+		Username:  b.name,
+		Content:   content,
+		Room:      room,
+		Bot:       true,
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+	}
+}
+
+// pluginHost runs one plugin's hooks in order on its own goroutine
+type pluginHost struct {
+	plugin Plugin
+	bot    *Bot
+	events chan func(context.Context)
+}
+
+// enqueue hands a hook call to the plugin, dropping it if the plugin has
+// fallen too far behind
+func (h *pluginHost) enqueue(call func(context.Context)) {
+	select {
+	case h.events <- call:
+	default:
+		metrics.Add(metricPluginEventsDropped, 1)
+		log.Printf("Plugin %s is falling behind, event dropped", h.bot.name)
+	}
+}
+
+// run calls the plugin's hooks until ctx is done, then closes the plugin
+// if it is an io.Closer. A panicking hook is logged and doesn't take the
+// server down.
+func (h *pluginHost) run(ctx context.Context) {
+	if c, ok := h.plugin.(io.Closer); ok {
+		defer c.Close()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case call := <-h.events:
+			func() {
+				defer func() {
+					if err := recover(); err != nil {
+						log.Printf("Plugin %s panicked: %v", h.bot.name, err)
+					}
+				}()
+				call(ctx)
+			}()
+		}
+	}
+}
+
+// pluginPresence tells every plugin a user connected or disconnected
+func (cs *ChatServer) pluginPresence(connected bool, username, room string) {
+	ev := PresenceEvent{Username: username, Room: room}
+	for _, h := range cs.plugins {
+		if connected {
+			h.enqueue(func(ctx context.Context) { h.plugin.OnConnect(ctx, h.bot, ev) })
+		} else {
+			h.enqueue(func(ctx context.Context) { h.plugin.OnDisconnect(ctx, h.bot, ev) })
+		}
+	}
+}
+
+// pluginMessage shows every plugin a chat message
+func (cs *ChatServer) pluginMessage(msg Message) {
+	if msg.Bot || msg.Ciphertext != "" || msg.To != "" {
+		return
+	}
+	for _, h := range cs.plugins {
+		h.enqueue(func(ctx context.Context) { h.plugin.OnMessage(ctx, h.bot, msg) })
+	}
+}
+
+// parseCommand splits "/name args" into a command name and its arguments
+func parseCommand(content string) (name, args string, ok bool) {
+	rest, ok := strings.CutPrefix(content, "/")
+	if !ok {
+		return "", "", false
+	}
+	name, args, _ = strings.Cut(rest, " ")
+	return name, strings.TrimSpace(args), name != ""
+}
+
+// dispatchCommand hands a slash command to the plugin that answers it,
+// reporting whether one did. Commands no plugin answers are sent as chat.
+func (cs *ChatServer) dispatchCommand(client *Client, msg Message) bool {
+	name, args, ok := parseCommand(msg.Content)
+	if !ok {
+		return false
+	}
+	for _, h := range cs.plugins {
+		if !slices.Contains(h.plugin.Commands(), name) {
+			continue
+		}
+		cmd := Command{Name: name, Args: args, Username: client.username, Room: client.roomName(), Trace: msg.Trace}
+		client.logf("Command /%s from %s for plugin %s (trace %s)", name, client.username, h.bot.name, msg.Trace)
+		h.enqueue(func(ctx context.Context) { h.plugin.OnCommand(ctx, h.bot, cmd) })
+		return true
+	}
+	return false
+}
+
+// isPlugin reports whether username belongs to a plugin
+func (cs *ChatServer) isPlugin(username string) bool {
+	return slices.ContainsFunc(cs.plugins, func(h *pluginHost) bool { return h.bot.name == username })
+}
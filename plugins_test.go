@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// recordingPlugin reports every hook call on events
+type recordingPlugin struct {
+	BasePlugin
+	events chan string
+}
+
+func (*recordingPlugin) Name() string       { return "recorder" }
+func (*recordingPlugin) Commands() []string { return []string{"echo"} }
+
+func (p *recordingPlugin) OnConnect(_ context.Context, _ *Bot, ev PresenceEvent) {
+	p.events <- "connect " + ev.Username
+}
+
+func (p *recordingPlugin) OnMessage(_ context.Context, _ *Bot, msg Message) {
+	p.events <- "message " + msg.Username + ": " + msg.Content
+}
+
+func (p *recordingPlugin) OnCommand(_ context.Context, bot *Bot, cmd Command) {
+	p.events <- "command " + cmd.Name + " " + cmd.Args
+	bot.Say(cmd.Room, cmd.Args)
+}
+
+func (p *recordingPlugin) OnDisconnect(_ context.Context, _ *Bot, ev PresenceEvent) {
+	p.events <- "disconnect " + ev.Username
+}
+
+// readFrom reads until a chat message from username
+func readFrom(t *testing.T, ctx context.Context, c *websocket.Conn, username string) Message {
+	t.Helper()
+	for {
+		var msg Message
+		if err := wsjson.Read(ctx, c, &msg); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if msg.Type == "message" && msg.Username == username {
+			return msg
+		}
+	}
+}
+
+func TestPlugins(t *testing.T) {
+	welcome, err := NewPlugins("welcome=Hi {user} in {room},dice")
+	if err != nil {
+		t.Fatalf("Failed to create plugins: %v", err)
+	}
+	recorder := &recordingPlugin{events: make(chan string, 10)}
+	server := NewChatServer(WithPlugins(append(welcome, recorder)...))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-recorder.events:
+			if got != want {
+				t.Errorf("Expected plugin event %q, got %q", want, got)
+			}
+		case <-ctx.Done():
+			t.Fatalf("Timed out waiting for plugin event %q", want)
+		}
+	}
+
+	alice := dialStatusTest(t, ctx, s, "alice")
+	expect("connect alice")
+	if msg := readFrom(t, ctx, alice, "welcome"); msg.Content != "Hi alice in lobby" || !msg.Bot || msg.To != "alice" {
+		t.Errorf("Expected a private greeting from the welcome bot, got %+v", msg)
+	}
+
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "/roll 3d6"})
+	if msg := readFrom(t, ctx, alice, "dice"); !strings.HasPrefix(msg.Content, "alice rolled 3d6: ") {
+		t.Errorf("Expected a dice roll, got %+v", msg)
+	}
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "/echo hi there"})
+	expect("command echo hi there")
+	readFrom(t, ctx, alice, "recorder")
+
+	// Clients can't pass themselves off as bots
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "hello", Bot: true})
+	expect("message alice: hello")
+	if msg := readFrom(t, ctx, alice, "alice"); msg.Bot {
+		t.Errorf("Expected the bot flag dropped from a client message, got %+v", msg)
+	}
+
+	alice.Close(websocket.StatusNormalClosure, "")
+	expect("disconnect alice")
+
+	if err := server.validateUsername("dice"); err == nil {
+		t.Errorf("Expected a bot's name to be refused")
+	}
+	if _, err := NewPlugins("nope"); err == nil {
+		t.Errorf("Expected an unknown plugin to be refused")
+	}
+}
+
+func TestParseDice(t *testing.T) {
+	tests := []struct {
+		in       string
+		n, sides int
+		ok       bool
+	}{
+		{"", 1, 6, true},
+		{"2d6", 2, 6, true},
+		{"d20", 1, 20, true},
+		{"0d6", 0, 0, false},
+		{"2d1", 0, 0, false},
+		{"1000d6", 0, 0, false},
+		{"two", 0, 0, false},
+	}
+	for _, tt := range tests {
+		n, sides, err := parseDice(tt.in)
+		if (err == nil) != tt.ok || n != tt.n || sides != tt.sides {
+			t.Errorf("parseDice(%q) = %d, %d, %v", tt.in, n, sides, err)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"strings"
+	"time"
+)
+
+const (
+	maxPollOptions      = 10
+	maxPollOptionLength = 200
+	maxPollDuration     = 30 * 24 * time.Hour
+	// maxRoomPolls is how many polls a room tracks votes for; the oldest
+	// is forgotten, and stops taking votes, beyond that
+	maxRoomPolls = 100
+)
+
+// Poll is set on "poll" messages, with the options clients vote on, and on
+// "tally" events carrying the current counts
+type Poll struct {
+	Options   []string `json:"options,omitempty"`
+	Anonymous bool     `json:"anonymous,omitempty"`
+	// ClosesAt is when voting ends, as an RFC 3339 time; empty polls stay
+	// open
+	ClosesAt string `json:"closes_at,omitempty"`
+	Counts   []int  `json:"counts"`
+	// Voters maps each voter to their option, unless the poll is anonymous
+	Voters map[string]int `json:"voters,omitempty"`
+	Closed bool           `json:"closed,omitempty"`
+}
+
+// pollState tracks the votes on one poll. It is guarded by
+// ChatServer.roomsMtx.
+type pollState struct {
+	options   int
+	anonymous bool
+	closesAt  time.Time
+	closed    bool
+	created   time.Time
+	votes     map[string]int
+	// erased counts votes by users who have since been erased
+	erased []int
+}
+
+// open reports whether the poll still takes votes at now
+func (p *pollState) open(now time.Time) bool {
+	return !p.closed && (p.closesAt.IsZero() || now.Before(p.closesAt))
+}
+
+// tally returns the poll's current counts, and its voters unless it is
+// anonymous
+func (p *pollState) tally() Poll {
+	t := Poll{Counts: make([]int, p.options), Closed: p.closed, Anonymous: p.anonymous}
+	copy(t.Counts, p.erased)
+	for _, option := range p.votes {
+		t.Counts[option]++
+	}
+	if !p.anonymous && len(p.votes) > 0 {
+		t.Voters = maps.Clone(p.votes)
+	}
+	return t
+}
+
+// withoutVoter returns the poll without username among its voters
+func (p *Poll) withoutVoter(username string) *Poll {
+	if _, ok := p.Voters[username]; !ok {
+		return p
+	}
+	out := *p
+	out.Voters = maps.Clone(p.Voters)
+	delete(out.Voters, username)
+	return &out
+}
+
+// validatePoll checks a "poll" message, whose question may be at most limit
+// characters, and resets its tally
+func validatePoll(msg *Message, room *Room, limit int, now time.Time) error {
+	if room != nil && room.Encrypted {
+		return protocolErrorf(codeInvalidPoll, "polls aren't available in encrypted rooms")
+	}
+	if msg.Content == "" {
+		return protocolErrorf(codeEmptyContent, "poll question cannot be empty")
+	}
+	if messageLength(msg.Content) > limit {
+		return protocolErrorf(codeContentTooLong, "poll question too long (max %d characters)", limit)
+	}
+	p := msg.Poll
+	if p == nil || len(p.Options) < 2 || len(p.Options) > maxPollOptions {
+		return protocolErrorf(codeInvalidPoll, "a poll needs 2 to %d options", maxPollOptions)
+	}
+	for _, option := range p.Options {
+		if strings.TrimSpace(option) == "" || messageLength(option) > maxPollOptionLength {
+			return protocolErrorf(codeInvalidPoll, "poll options must be non-empty and at most %d characters", maxPollOptionLength)
+		}
+	}
+	if p.ClosesAt != "" {
+		closesAt, err := time.Parse(time.RFC3339, p.ClosesAt)
+		if err != nil || !closesAt.After(now) || closesAt.Sub(now) > maxPollDuration {
+			return protocolErrorf(codeInvalidPoll, "closes_at must be an RFC 3339 time within %d days", maxPollDuration/(24*time.Hour))
+		}
+	}
+	msg.Poll = &Poll{Options: p.Options, Anonymous: p.Anonymous, ClosesAt: p.ClosesAt, Counts: make([]int, len(p.Options))}
+	return nil
+}
+
+// handlePoll validates and broadcasts a client's poll
+func (cs *ChatServer) handlePoll(ctx context.Context, client *Client, msg Message) {
+	now := cs.now()
+	msg.Username = client.username
+	msg.Room = client.roomName()
+	msg.Time = now.Format(time.RFC3339)
+	msg.Timestamp = now.UnixMilli()
+	if err := validatePoll(&msg, client.room, cs.messageLimit, now); err != nil {
+		client.logf("Invalid poll from %s (trace %s): %v", msg.Username, msg.Trace, err)
+		cs.sendError(ctx, client, err, refFor(msg))
+		cs.noteRejection(client)
+		return
+	}
+	if cs.hold(ctx, client, msg) || cs.shadowDrop(ctx, client, msg) {
+		return
+	}
+	cs.publishFrom(ctx, client, msg)
+}
+
+// handleVote checks a client's vote against the poll and broadcasts it.
+// Voting again replaces the user's earlier vote.
+func (cs *ChatServer) handleVote(ctx context.Context, client *Client, msg Message) {
+	room := client.room
+	if room == nil {
+		room = cs.lobby
+	}
+	cs.roomsMtx.Lock()
+	p := room.polls[msg.PollID]
+	var err error
+	switch {
+	case p == nil:
+		err = protocolErrorf(codeUnknownMessage, "no poll %q in this room", msg.PollID)
+	case !p.open(cs.now()):
+		err = protocolErrorf(codePollClosed, "poll %s is closed", msg.PollID)
+	case msg.Option == nil || *msg.Option < 0 || *msg.Option >= p.options:
+		err = protocolErrorf(codeInvalidPoll, "option must be between 0 and %d", p.options-1)
+	}
+	cs.roomsMtx.Unlock()
+	if err != nil {
+		client.logf("Invalid vote from %s (trace %s): %v", client.username, msg.Trace, err)
+		cs.sendError(ctx, client, err, &ErrorRef{Type: "vote", Trace: msg.Trace})
+		return
+	}
+	if cs.shadowBans.banned(client.username) {
+		client.logf("Dropped vote from shadow-banned %s (trace %s)", client.username, msg.Trace)
+		return
+	}
+
+	now := cs.now()
+	cs.publish(Message{
+		Type:      "vote",
+		Username:  client.username,
+		Room:      client.roomName(),
+		PollID:    msg.PollID,
+		Option:    msg.Option,
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+		Trace:     msg.Trace,
+	})
+}
+
+// applyPoll starts tracking votes on a poll as it is delivered, so every
+// instance sharing a broker counts them, and arranges for it to close
+func (cs *ChatServer) applyPoll(msg Message) {
+	room := cs.stateRoom(msg.Room)
+	if room == nil || msg.Poll == nil {
+		return
+	}
+	p := &pollState{
+		options:   len(msg.Poll.Options),
+		anonymous: msg.Poll.Anonymous,
+		created:   cs.now(),
+		votes:     make(map[string]int),
+	}
+	if msg.Poll.ClosesAt != "" {
+		p.closesAt, _ = time.Parse(time.RFC3339, msg.Poll.ClosesAt)
+	}
+
+	cs.roomsMtx.Lock()
+	if room.polls == nil {
+		room.polls = make(map[string]*pollState)
+	}
+	if len(room.polls) >= maxRoomPolls {
+		var oldest string
+		for id, other := range room.polls {
+			if oldest == "" || other.created.Before(room.polls[oldest].created) {
+				oldest = id
+			}
+		}
+		delete(room.polls, oldest)
+	}
+	room.polls[msg.ID] = p
+	cs.roomsMtx.Unlock()
+
+	if !p.closesAt.IsZero() {
+		cs.afterFunc(p.closesAt.Sub(cs.now()), func() { cs.closePoll(msg.Room, msg.ID) })
+	}
+}
+
+// applyVote counts a "vote" event and returns the "tally" event clients
+// receive instead. It reports false if the vote changes nothing.
+func (cs *ChatServer) applyVote(msg Message) (Message, bool) {
+	room := cs.stateRoom(msg.Room)
+	if room == nil || msg.Option == nil {
+		return Message{}, false
+	}
+	cs.roomsMtx.Lock()
+	p := room.polls[msg.PollID]
+	if p == nil || !p.open(cs.now()) || *msg.Option < 0 || *msg.Option >= p.options {
+		cs.roomsMtx.Unlock()
+		return Message{}, false
+	}
+	if old, ok := p.votes[msg.Username]; ok && old == *msg.Option {
+		cs.roomsMtx.Unlock()
+		return Message{}, false
+	}
+	p.votes[msg.Username] = *msg.Option
+	tally := p.tally()
+	cs.roomsMtx.Unlock()
+
+	cs.historyOf(room).updatePoll(msg.PollID, tally)
+	msg.Type = "tally"
+	msg.Username = "Server"
+	msg.Option = nil
+	msg.Poll = &tally
+	return msg, true
+}
+
+// closePoll ends voting on a poll at its deadline and sends the final
+// tally. Every instance closes its own copy, so the tally is only
+// delivered locally.
+func (cs *ChatServer) closePoll(roomName, id string) {
+	room := cs.stateRoom(roomName)
+	if room == nil {
+		return
+	}
+	cs.roomsMtx.Lock()
+	p := room.polls[id]
+	if p == nil || p.closed {
+		cs.roomsMtx.Unlock()
+		return
+	}
+	p.closed = true
+	tally := p.tally()
+	cs.roomsMtx.Unlock()
+
+	cs.historyOf(room).updatePoll(id, tally)
+	now := cs.now()
+	cs.sequence(Message{
+		Type:      "tally",
+		Username:  "Server",
+		Room:      roomName,
+		PollID:    id,
+		Poll:      &tally,
+		ID:        newMessageID(),
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+		Trace:     newTraceID(),
+	}, true)
+}
+
+// moveVotes carries a user's poll votes over to their new name. When
+// newName is empty the user was erased: their votes still count but no
+// longer name them.
+func (cs *ChatServer) moveVotes(oldName, newName string) {
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	move := func(room *Room) {
+		for _, p := range room.polls {
+			option, ok := p.votes[oldName]
+			if !ok {
+				continue
+			}
+			delete(p.votes, oldName)
+			if newName != "" {
+				p.votes[newName] = option
+				continue
+			}
+			if p.erased == nil {
+				p.erased = make([]int, p.options)
+			}
+			p.erased[option]++
+		}
+	}
+	move(cs.lobby)
+	for _, room := range cs.rooms {
+		move(room)
+	}
+}
+
+// updatePoll replaces the tally on a stored poll, so history shows the
+// latest counts
+func (h *History) updatePoll(id string, tally Poll) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := 0; i < h.n; i++ {
+		seq := h.lastSeq - uint64(i)
+		msg := h.slot(seq)
+		if msg.ID != id || msg.Poll == nil {
+			continue
+		}
+		p := *msg.Poll
+		p.Counts, p.Voters, p.Closed = tally.Counts, tally.Voters, tally.Closed
+		msg.Poll = &p
+		return
+	}
+}
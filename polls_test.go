@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestPolls(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+	bob := dialStatusTest(t, ctx, s, "bob")
+
+	wsjson.Write(ctx, alice, Message{Type: "poll", Content: "Lunch?", Poll: &Poll{Options: []string{"pizza"}}})
+	if msg := readUntilType(t, ctx, alice, "error"); msg.Code != codeInvalidPoll {
+		t.Errorf("Expected a one option poll to be rejected, got %+v", msg)
+	}
+	wsjson.Write(ctx, alice, Message{Type: "poll", Content: "Lunch?", Poll: &Poll{Options: []string{"pizza", "sushi"}, ClosesAt: "2001-01-01T00:00:00Z"}})
+	if msg := readUntilType(t, ctx, alice, "error"); msg.Code != codeInvalidPoll {
+		t.Errorf("Expected a poll closing in the past to be rejected, got %+v", msg)
+	}
+
+	wsjson.Write(ctx, alice, Message{Type: "poll", Content: "Lunch?", Poll: &Poll{Options: []string{"pizza", "sushi"}, Counts: []int{5, 0}}})
+	poll := readUntilType(t, ctx, bob, "poll")
+	if poll.ID == "" || poll.Username != "alice" || poll.Poll == nil || len(poll.Poll.Counts) != 2 || poll.Poll.Counts[0] != 0 {
+		t.Fatalf("Expected the poll with an empty tally, got %+v", poll)
+	}
+
+	one, zero, nine := 1, 0, 9
+	wsjson.Write(ctx, bob, Message{Type: "vote", PollID: poll.ID, Option: &nine})
+	if msg := readUntilType(t, ctx, bob, "error"); msg.Code != codeInvalidPoll {
+		t.Errorf("Expected an out of range option to be rejected, got %+v", msg)
+	}
+	wsjson.Write(ctx, bob, Message{Type: "vote", PollID: "nope", Option: &one})
+	if msg := readUntilType(t, ctx, bob, "error"); msg.Code != codeUnknownMessage {
+		t.Errorf("Expected a vote on an unknown poll to be rejected, got %+v", msg)
+	}
+
+	wsjson.Write(ctx, bob, Message{Type: "vote", PollID: poll.ID, Option: &one})
+	tally := readUntilType(t, ctx, alice, "tally")
+	if tally.PollID != poll.ID || tally.Poll.Counts[1] != 1 || tally.Poll.Voters["bob"] != 1 {
+		t.Errorf("Expected bob's vote in the tally, got %+v", tally.Poll)
+	}
+	// Voting again moves the vote
+	wsjson.Write(ctx, bob, Message{Type: "vote", PollID: poll.ID, Option: &zero})
+	if tally := readUntilType(t, ctx, alice, "tally"); tally.Poll.Counts[0] != 1 || tally.Poll.Counts[1] != 0 {
+		t.Errorf("Expected bob's vote to move, got %+v", tally.Poll)
+	}
+	wsjson.Write(ctx, alice, Message{Type: "vote", PollID: poll.ID, Option: &zero})
+	readUntilType(t, ctx, alice, "tally")
+
+	stored, _ := server.history.Find(poll.ID)
+	if stored.Poll.Counts[0] != 2 || len(stored.Poll.Voters) != 2 {
+		t.Errorf("Expected history to hold the latest tally, got %+v", stored.Poll)
+	}
+
+	// Closing sends a final tally and refuses further votes
+	server.closePoll("", poll.ID)
+	tally = readUntilType(t, ctx, bob, "tally")
+	for tally.Poll != nil && !tally.Poll.Closed {
+		tally = readUntilType(t, ctx, bob, "tally")
+	}
+	if tally.Poll == nil || tally.Poll.Counts[0] != 2 {
+		t.Errorf("Expected the final tally, got %+v", tally)
+	}
+	wsjson.Write(ctx, bob, Message{Type: "vote", PollID: poll.ID, Option: &one})
+	if msg := readUntilType(t, ctx, bob, "error"); msg.Code != codePollClosed {
+		t.Errorf("Expected a vote on a closed poll to be rejected, got %+v", msg)
+	}
+}
+
+func TestPolls_Anonymous(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+
+	closesAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	wsjson.Write(ctx, alice, Message{Type: "poll", Content: "Rate the sprint", Poll: &Poll{Options: []string{"good", "bad"}, Anonymous: true, ClosesAt: closesAt}})
+	poll := readUntilType(t, ctx, alice, "poll")
+	if !poll.Poll.Anonymous || poll.Poll.ClosesAt != closesAt {
+		t.Errorf("Expected an anonymous poll closing at %s, got %+v", closesAt, poll.Poll)
+	}
+	one := 1
+	wsjson.Write(ctx, alice, Message{Type: "vote", PollID: poll.ID, Option: &one})
+	tally := readUntilType(t, ctx, alice, "tally")
+	if tally.Poll.Counts[1] != 1 || tally.Poll.Voters != nil || tally.Username != "Server" {
+		t.Errorf("Expected a tally without voters, got %+v", tally)
+	}
+}
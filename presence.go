@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// presenceInterval is how often large rooms get a presence summary
+	presenceInterval = time.Second * 10
+	// presenceSampleSize is how many names a presence summary carries
+	presenceSampleSize = 10
+
+	defaultRosterLimit = 100
+	maxRosterLimit     = 500
+)
+
+// WithPresenceThreshold switches the room to aggregate presence once it has
+// at least n members: instead of a join and leave notice for everyone,
+// clients get a periodic summary and can page through the roster on
+// demand. Zero always announces joins and leaves.
+func WithPresenceThreshold(n int) Option {
+	return func(cs *ChatServer) {
+		cs.presenceThreshold = n
+	}
+}
+
+// RosterPage is one page of the members of a room, ordered by username.
+// The lobby's roster covers the whole cluster when it gossips.
+type RosterPage struct {
+	Type     string             `json:"type,omitempty"`
+	Members  []string           `json:"members"`
+	Profiles map[string]Profile `json:"profiles,omitempty"`
+	Statuses map[string]string  `json:"statuses,omitempty"`
+	HasMore  bool               `json:"has_more"`
+}
+
+// roomSize counts a room's members, or the lobby's (nil) across the
+// cluster using the lobby counts peers report in their heartbeats. Other
+// rooms live on one instance.
+func (cs *ChatServer) roomSize(room *Room) int {
+	if room != nil {
+		return cs.roomClients(room)
+	}
+	n := cs.self().Lobby
+	for _, peer := range cs.livePeers() {
+		n += peer.Lobby
+	}
+	return n
+}
+
+// roomClients counts the clients connected to this instance in a room, or
+// in the lobby for nil
+func (cs *ChatServer) roomClients(room *Room) int {
+	cs.clientsMtx.Lock()
+	defer cs.clientsMtx.Unlock()
+	n := 0
+	for client := range cs.clients {
+		if client.room == room && !client.canary {
+			n++
+		}
+	}
+	return n
+}
+
+// largeRoom reports whether a room, or the lobby for nil, uses aggregate
+// presence
+func (cs *ChatServer) largeRoom(room *Room) bool {
+	return cs.presenceThreshold > 0 && cs.roomSize(room) >= cs.presenceThreshold
+}
+
+// localMembers returns the usernames connected to this instance, sorted,
+// leaving out invisible users
+func (cs *ChatServer) localMembers() []string {
+	return cs.members(func(*Client) bool { return true })
+}
+
+// roomMembers returns the usernames connected to this instance in a room,
+// or in the lobby for nil, sorted and leaving out invisible users
+func (cs *ChatServer) roomMembers(room *Room) []string {
+	return cs.members(func(client *Client) bool { return client.room == room })
+}
+
+// members returns the sorted usernames of the visible clients keep accepts
+func (cs *ChatServer) members(keep func(*Client) bool) []string {
+	cs.clientsMtx.Lock()
+	names := make([]string, 0, len(cs.clients))
+	for client := range cs.clients {
+		if client.visibleLocked() && keep(client) {
+			names = append(names, client.username)
+		}
+	}
+	cs.clientsMtx.Unlock()
+	sort.Strings(names)
+	return names
+}
+
+// roster returns up to limit members of a room, or of the lobby for nil,
+// sorting after the given name. The lobby's covers the cluster when it
+// gossips.
+func (cs *ChatServer) roster(room *Room, after string, limit int) RosterPage {
+	names := cs.roomMembers(room)
+	if room == nil {
+		names = cs.clusterMembers()
+	}
+	start := sort.SearchStrings(names, after)
+	if start < len(names) && names[start] == after {
+		start++
+	}
+	end := min(start+limit, len(names))
+	page := names[start:end]
+	cs.clientsMtx.Lock()
+	statuses := cs.statusesLocked(page)
+	cs.clientsMtx.Unlock()
+	return RosterPage{Members: page, Profiles: cs.profiles(page), Statuses: statuses, HasMore: end < len(names)}
+}
+
+// clampRosterLimit applies the default and maximum roster page size
+func clampRosterLimit(limit int) int {
+	if limit <= 0 {
+		return defaultRosterLimit
+	}
+	return min(limit, maxRosterLimit)
+}
+
+// runPresence sends a large lobby a presence summary whenever the member
+// count has changed, until ctx is cancelled
+func (cs *ChatServer) runPresence(ctx context.Context) {
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+
+	last := -1
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if !cs.largeRoom(nil) {
+			last = -1
+			continue
+		}
+		count := cs.roomSize(nil)
+		if count == last {
+			continue
+		}
+		last = count
+		cs.sendPresence(count)
+	}
+}
+
+// presenceMessage builds a presence summary for a lobby of count members
+func (cs *ChatServer) presenceMessage(count int) Message {
+	sample := cs.roomMembers(nil)
+	if len(sample) > presenceSampleSize {
+		sample = sample[:presenceSampleSize]
+	}
+	now := cs.now()
+	return Message{
+		Type:      "presence",
+		Username:  "Server",
+		Content:   fmt.Sprintf("%d members online", count),
+		Count:     count,
+		Members:   sample,
+		Profiles:  cs.profiles(sample),
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+		Trace:     newTraceID(),
+	}
+}
+
+// sendPresence delivers a presence summary to this instance's lobby. Each
+// instance sends its own, so it never goes through the broker.
+func (cs *ChatServer) sendPresence(count int) {
+	cs.deliver(cs.presenceMessage(count))
+}
+
+// welcomeToLargeRoom gives a client joining a large lobby the current
+// summary in place of the join notice
+func (cs *ChatServer) welcomeToLargeRoom(ctx context.Context, client *Client) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	if err := client.writeMessage(ctx, cs.presenceMessage(cs.roomSize(nil))); err != nil {
+		client.logf("Error sending presence to %s: %v", client.username, err)
+	}
+}
+
+// sendRoster answers a client's roster request with their room's members
+func (cs *ChatServer) sendRoster(ctx context.Context, client *Client, req Message) {
+	page := cs.roster(client.room, req.After, clampRosterLimit(req.Limit))
+	page.Type = "roster"
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	if err := client.write(ctx, page); err != nil {
+		client.logf("Error sending roster to %s: %v", client.username, err)
+	}
+}
+
+// handleRoster serves GET /api/roster?room=<name>&password=<pw>&after=<name>&limit=M,
+// the lobby's roster when room is empty
+func (cs *ChatServer) handleRoster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	room, err := cs.readableRoom(r.URL.Query().Get("room"), r.URL.Query().Get("password"))
+	if err != nil {
+		http.Error(w, err.Error(), roomStatus(err))
+		return
+	}
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	page := cs.roster(room, r.URL.Query().Get("after"), clampRosterLimit(limit))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
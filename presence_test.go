@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestChatServer_LargeRoomPresence(t *testing.T) {
+	server := NewChatServer(WithPresenceThreshold(2))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	dial := func(name string) *websocket.Conn {
+		c, _, err := websocket.Dial(ctx, wsURL+"?username="+name, &websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+		if err != nil {
+			t.Fatalf("Failed to connect %s: %v", name, err)
+		}
+		t.Cleanup(func() { c.Close(websocket.StatusNormalClosure, "") })
+		return c
+	}
+
+	// Below the threshold joins are announced as usual
+	alice := dial("alice")
+	var msg Message
+	if err := wsjson.Read(ctx, alice, &msg); err != nil || msg.Type != "system" {
+		t.Fatalf("Expected join notice, got %+v, %v", msg, err)
+	}
+
+	// From the threshold on, the newcomer gets a summary and nobody else hears of it
+	bob := dial("bob")
+	if err := wsjson.Read(ctx, bob, &msg); err != nil {
+		t.Fatalf("Failed to read presence: %v", err)
+	}
+	if msg.Type != "presence" || msg.Count != 2 || !reflect.DeepEqual(msg.Members, []string{"alice", "bob"}) {
+		t.Errorf("Unexpected presence summary: %+v", msg)
+	}
+
+	server.sendPresence(server.roomSize(nil))
+	for _, c := range []*websocket.Conn{alice, bob} {
+		if err := wsjson.Read(ctx, c, &msg); err != nil {
+			t.Fatalf("Failed to read presence: %v", err)
+		}
+		if msg.Type != "presence" || msg.Count != 2 {
+			t.Errorf("Expected presence summary instead of bob's join, got: %+v", msg)
+		}
+	}
+
+	// The roster is paged on request
+	var page RosterPage
+	for _, want := range []RosterPage{
+		{Type: "roster", Members: []string{"alice"}, HasMore: true},
+		{Type: "roster", Members: []string{"bob"}, HasMore: false},
+	} {
+		after := ""
+		if len(page.Members) > 0 {
+			after = page.Members[len(page.Members)-1]
+		}
+		if err := wsjson.Write(ctx, bob, Message{Type: "roster", After: after, Limit: 1}); err != nil {
+			t.Fatalf("Failed to request roster: %v", err)
+		}
+		page = RosterPage{}
+		if err := wsjson.Read(ctx, bob, &page); err != nil {
+			t.Fatalf("Failed to read roster: %v", err)
+		}
+		if !reflect.DeepEqual(page, want) {
+			t.Errorf("Expected roster page %+v, got %+v", want, page)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	server.handleRoster(rec, httptest.NewRequest(http.MethodGet, "/api/roster?after=alice", nil))
+	page = RosterPage{}
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatalf("Failed to decode roster: %v", err)
+	}
+	if !reflect.DeepEqual(page.Members, []string{"bob"}) {
+		t.Errorf("Unexpected REST roster: %+v", page)
+	}
+}
+
+func TestChatServer_RosterScopedToRoom(t *testing.T) {
+	server := NewChatServer(WithPresenceThreshold(2))
+	server.Run(t.Context())
+	s := newRoomsTestServer(t, server)
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+	if code := createTestRoom(t, s, RoomOptions{Name: "secret", Password: "hunter2"}); code != http.StatusCreated {
+		t.Fatalf("Failed to create room: %d", code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	for _, query := range []string{"?username=alice", "?username=bob&room=secret&password=hunter2"} {
+		c, _, err := websocket.Dial(ctx, wsURL+query, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect %s: %v", query, err)
+		}
+		defer c.Close(websocket.StatusNormalClosure, "")
+	}
+	waitFor(t, "both clients", func() bool { return server.self().Clients == 2 })
+
+	// bob is in another room, so the lobby stays below the threshold
+	if n := server.roomSize(nil); n != 1 || server.largeRoom(nil) {
+		t.Errorf("Expected a lobby of 1 below the threshold, got %d", n)
+	}
+	if page := server.roster(nil, "", 10); !reflect.DeepEqual(page.Members, []string{"alice"}) {
+		t.Errorf("Expected only alice in the lobby roster, got %+v", page.Members)
+	}
+
+	for query, want := range map[string]int{
+		"?room=secret":                  http.StatusForbidden,
+		"?room=secret&password=letmein": http.StatusForbidden,
+		"?room=nowhere":                 http.StatusNotFound,
+		"?room=secret&password=hunter2": http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		server.handleRoster(rec, httptest.NewRequest(http.MethodGet, "/api/roster"+query, nil))
+		if rec.Code != want {
+			t.Errorf("Expected %d for %s, got %d", want, query, rec.Code)
+			continue
+		}
+		if want == http.StatusOK {
+			var page RosterPage
+			json.NewDecoder(rec.Body).Decode(&page)
+			if !reflect.DeepEqual(page.Members, []string{"bob"}) {
+				t.Errorf("Expected only bob in the room's roster, got %+v", page.Members)
+			}
+		}
+	}
+}
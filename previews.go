@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	defaultPreviewTimeout = time.Second * 5
+	defaultPreviewTTL     = time.Hour
+	// previewNegativeTTL is how long a page without a preview is remembered
+	previewNegativeTTL = time.Minute * 10
+	previewCacheSize   = 1000
+	// maxPreviewBody is how much of a page is read looking for its metadata
+	maxPreviewBody      = 512 << 10
+	maxPreviewRedirects = 3
+	// maxPreviewFetches bounds the fetches in flight; links posted beyond
+	// that get no preview
+	maxPreviewFetches = 8
+	maxPreviewField   = 500
+)
+
+// previewURL finds links in message content
+var previewURL = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// errPreviewAddress refuses connections to addresses previews may not reach
+var errPreviewAddress = errors.New("address not allowed for link previews")
+
+// nonPublicPrefixes are ranges netip doesn't classify as private or local
+// but that still aren't the public internet
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// LinkPreview is the OpenGraph metadata of the first link in a message
+type LinkPreview struct {
+	MessageID   string `json:"message_id,omitempty"`
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+}
+
+// PreviewConfig configures link previews
+type PreviewConfig struct {
+	// Allow limits previews to these domains and their subdomains; empty
+	// allows every public host. Deny always wins.
+	Allow []string
+	Deny  []string
+	// Timeout bounds each fetch, redirects included
+	Timeout time.Duration
+	// CacheTTL is how long a fetched preview is reused
+	CacheTTL time.Duration
+}
+
+// previewCacheEntry is a cached fetch; preview is nil if the page had none
+type previewCacheEntry struct {
+	preview *LinkPreview
+	expires time.Time
+}
+
+// previewer fetches and caches link previews
+type previewer struct {
+	cfg    PreviewConfig
+	client *http.Client
+	slots  chan struct{}
+	// allowAddr decides which resolved addresses may be dialled
+	allowAddr func(netip.AddrPort) bool
+
+	mu    sync.Mutex
+	cache map[string]previewCacheEntry
+	// now is the time cached previews expire by
+	now func() time.Time
+}
+
+// WithLinkPreviews fetches OpenGraph metadata for the first link in each
+// chat message and broadcasts it as a "preview" event
+func WithLinkPreviews(cfg PreviewConfig) Option {
+	return func(cs *ChatServer) {
+		cs.previews = newPreviewer(cfg)
+	}
+}
+
+func newPreviewer(cfg PreviewConfig) *previewer {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultPreviewTimeout
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = defaultPreviewTTL
+	}
+	p := &previewer{
+		cfg:       cfg,
+		slots:     make(chan struct{}, maxPreviewFetches),
+		allowAddr: publicWebAddr,
+		cache:     make(map[string]previewCacheEntry),
+		now:       time.Now,
+	}
+	dialer := checkedDialer(cfg.Timeout, func(addr netip.AddrPort) bool { return p.allowAddr(addr) }, errPreviewAddress)
+	p.client = &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   cfg.Timeout,
+			ResponseHeaderTimeout: cfg.Timeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       time.Minute,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxPreviewRedirects {
+				return errors.New("too many redirects")
+			}
+			return p.check(req.URL)
+		},
+	}
+	return p
+}
+
+// checkedDialer dials only the addresses allow accepts, failing with
+// refused otherwise. Addresses are checked as they are dialled, after
+// resolution, so a name can't be rebound to an internal address between
+// check and use.
+func checkedDialer(timeout time.Duration, allow func(netip.AddrPort) bool, refused error) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil || !allow(addr) {
+				return refused
+			}
+			return nil
+		},
+	}
+}
+
+// publicWebAddr allows public addresses on the standard web ports
+func publicWebAddr(addr netip.AddrPort) bool {
+	ip := addr.Addr().Unmap()
+	if addr.Port() != 80 && addr.Port() != 443 {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// check applies the scheme and domain lists to u
+func (p *previewer) check(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme %q not allowed", u.Scheme)
+	}
+	if u.User != nil {
+		return errors.New("credentials in URL")
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if domainListed(host, p.cfg.Deny) {
+		return fmt.Errorf("host %s is denied", host)
+	}
+	if len(p.cfg.Allow) > 0 && !domainListed(host, p.cfg.Allow) {
+		return fmt.Errorf("host %s is not allowed", host)
+	}
+	return nil
+}
+
+// domainListed reports whether host is one of domains or below one
+func domainListed(host string, domains []string) bool {
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "."))
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstLink returns the first http(s) link in content, without trailing
+// punctuation
+func firstLink(content string) string {
+	link := previewURL.FindString(content)
+	return strings.TrimRight(link, ".,;:!?)]}'")
+}
+
+// preview returns the preview for link, from the cache if it can. It
+// returns nil when the page has none or can't be fetched.
+func (p *previewer) preview(ctx context.Context, link string) *LinkPreview {
+	now := p.now()
+	p.mu.Lock()
+	entry, ok := p.cache[link]
+	p.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.preview
+	}
+
+	preview, err := p.fetch(ctx, link)
+	ttl := p.cfg.CacheTTL
+	if err != nil {
+		log.Printf("No link preview for %s: %v", link, err)
+		ttl = previewNegativeTTL
+	}
+	p.mu.Lock()
+	if len(p.cache) >= previewCacheSize {
+		for k, e := range p.cache {
+			if !now.Before(e.expires) {
+				delete(p.cache, k)
+			}
+		}
+	}
+	if len(p.cache) < previewCacheSize {
+		p.cache[link] = previewCacheEntry{preview: preview, expires: now.Add(ttl)}
+	}
+	p.mu.Unlock()
+	return preview
+}
+
+// fetch downloads link and reads its metadata
+func (p *previewer) fetch(ctx context.Context, link string) (*LinkPreview, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.check(u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "ideal-guacamole-preview/1.0")
+	req.Header.Set("Accept", "text/html")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" {
+		return nil, fmt.Errorf("content type %q isn't HTML", mediaType)
+	}
+
+	preview := parsePreview(io.LimitReader(resp.Body, maxPreviewBody), resp.Request.URL)
+	if preview.Title == "" && preview.Description == "" {
+		return nil, errors.New("no title or description")
+	}
+	preview.URL = link
+	return preview, nil
+}
+
+// parsePreview reads OpenGraph tags, falling back to the page title and
+// description, from the head of an HTML page served from base
+func parsePreview(r io.Reader, base *url.URL) *LinkPreview {
+	var preview LinkPreview
+	var title, description string
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		tok := z.Token()
+		if tok.DataAtom == atom.Body || tt == html.EndTagToken && tok.DataAtom == atom.Head {
+			break
+		}
+		if tt == html.StartTagToken && tok.DataAtom == atom.Title && title == "" {
+			if z.Next() == html.TextToken {
+				title = string(z.Text())
+			}
+			continue
+		}
+		if tok.DataAtom != atom.Meta {
+			continue
+		}
+		var key, content string
+		for _, a := range tok.Attr {
+			switch a.Key {
+			case "property", "name":
+				key = strings.ToLower(a.Val)
+			case "content":
+				content = a.Val
+			}
+		}
+		switch key {
+		case "og:title":
+			preview.Title = content
+		case "og:description":
+			preview.Description = content
+		case "og:site_name":
+			preview.SiteName = content
+		case "og:image":
+			if img, err := base.Parse(content); err == nil && (img.Scheme == "https" || img.Scheme == "http") {
+				preview.Image = img.String()
+			}
+		case "description":
+			description = content
+		}
+	}
+	if preview.Title == "" {
+		preview.Title = title
+	}
+	if preview.Description == "" {
+		preview.Description = description
+	}
+	preview.Title = clipPreviewField(preview.Title)
+	preview.Description = clipPreviewField(preview.Description)
+	preview.SiteName = clipPreviewField(preview.SiteName)
+	return &preview
+}
+
+// clipPreviewField trims whitespace and limits a field's length
+func clipPreviewField(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) > maxPreviewField {
+		s = strings.ToValidUTF8(s[:maxPreviewField], "")
+	}
+	return s
+}
+
+// sendPreview fetches the preview for the first link in msg and broadcasts
+// it. Fetches beyond maxPreviewFetches are skipped rather than queued.
+func (cs *ChatServer) sendPreview(msg Message) {
+	link := firstLink(msg.Content)
+	if link == "" {
+		return
+	}
+	select {
+	case cs.previews.slots <- struct{}{}:
+	default:
+		log.Printf("Skipped link preview for message %s: too many fetches in flight", msg.ID)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cs.previews.cfg.Timeout)
+	preview := cs.previews.preview(ctx, link)
+	cancel()
+	<-cs.previews.slots
+	if preview == nil {
+		return
+	}
+
+	out := *preview
+	out.MessageID = msg.ID
+	now := cs.now()
+	cs.publish(Message{
+		Type:      "preview",
+		Username:  "Server",
+		Room:      msg.Room,
+		Preview:   &out,
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+		Trace:     msg.Trace,
+	})
+}
+
+// applyPreview attaches a delivered preview to the stored message it
+// belongs to, so history carries it too
+func (cs *ChatServer) applyPreview(msg Message) {
+	room := cs.stateRoom(msg.Room)
+	if room == nil || msg.Preview == nil {
+		return
+	}
+	cs.historyOf(room).attachPreview(msg.Preview.MessageID, *msg.Preview)
+}
+
+// attachPreview sets the preview of a stored message
+func (h *History) attachPreview(id string, preview LinkPreview) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := 0; i < h.n; i++ {
+		seq := h.lastSeq - uint64(i)
+		msg := h.slot(seq)
+		if msg.ID == id {
+			msg.Preview = &preview
+			return
+		}
+	}
+}
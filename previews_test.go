@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestPublicWebAddr(t *testing.T) {
+	tests := map[string]bool{
+		"93.184.216.34:443":     true,
+		"[2606:4700::1]:80":     true,
+		"93.184.216.34:8080":    false,
+		"127.0.0.1:80":          false,
+		"10.1.2.3:443":          false,
+		"192.168.1.1:80":        false,
+		"169.254.169.254:80":    false,
+		"100.64.0.1:80":         false,
+		"0.0.0.0:80":            false,
+		"[::1]:443":             false,
+		"[::ffff:127.0.0.1]:80": false,
+		"[fd00::1]:443":         false,
+		"[64:ff9b::a00:1]:80":   false,
+	}
+	for addr, want := range tests {
+		if got := publicWebAddr(netip.MustParseAddrPort(addr)); got != want {
+			t.Errorf("Expected %s allowed=%v, got %v", addr, want, got)
+		}
+	}
+}
+
+func TestPreviewer_Check(t *testing.T) {
+	p := newPreviewer(PreviewConfig{Allow: []string{"example.com"}, Deny: []string{"private.example.com"}})
+	tests := map[string]bool{
+		"https://example.com/a":           true,
+		"https://www.example.com/a":       true,
+		"https://EXAMPLE.com./a":          true,
+		"https://notexample.com/a":        false,
+		"https://private.example.com/a":   false,
+		"https://a.private.example.com/a": false,
+		"ftp://example.com/a":             false,
+		"https://user:pw@example.com/a":   false,
+		"https://example.com.evil.org/a":  false,
+	}
+	for link, want := range tests {
+		u, _ := url.Parse(link)
+		if err := p.check(u); (err == nil) != want {
+			t.Errorf("Expected %s allowed=%v, got %v", link, want, err)
+		}
+	}
+}
+
+func TestLinkPreviews(t *testing.T) {
+	var hits, whispered atomic.Int32
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/whisper" {
+			whispered.Add(1)
+		}
+		hits.Add(1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<!DOCTYPE html><html><head>
+<title>Fallback title</title>
+<meta property="og:title" content="The  Article">
+<meta property="og:description" content="What it is about">
+<meta property="og:image" content="/cover.png">
+<meta property="og:site_name" content="Example News">
+</head><body><meta property="og:title" content="ignored"></body></html>`)
+	}))
+	defer site.Close()
+
+	// The default policy refuses loopback addresses
+	if p := newPreviewer(PreviewConfig{}); p.preview(context.Background(), site.URL+"/private") != nil {
+		t.Fatalf("Expected a loopback link to get no preview")
+	}
+
+	server := NewChatServer(WithLinkPreviews(PreviewConfig{}))
+	server.previews.allowAddr = func(netip.AddrPort) bool { return true }
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+	bob := dialStatusTest(t, ctx, s, "bob")
+
+	// A whisper's preview would reach the whole room
+	(&Bot{name: "helper", cs: server}).Whisper("", "alice", site.URL+"/whisper")
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "look (" + site.URL + "/article)."})
+	msg := readUntilType(t, ctx, bob, "message")
+	preview := readUntilType(t, ctx, bob, "preview").Preview
+	if preview == nil || preview.MessageID != msg.ID || preview.URL != site.URL+"/article" {
+		t.Fatalf("Expected a preview of the link, got %+v", preview)
+	}
+	if preview.Title != "The Article" || preview.Description != "What it is about" ||
+		preview.Image != site.URL+"/cover.png" || preview.SiteName != "Example News" {
+		t.Errorf("Expected the OpenGraph metadata, got %+v", preview)
+	}
+	if stored, _ := server.history.Find(msg.ID); stored.Preview == nil || stored.Preview.Title != "The Article" {
+		t.Errorf("Expected the stored message to carry the preview, got %+v", stored.Preview)
+	}
+
+	// A second post of the same link is answered from the cache
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: site.URL + "/article"})
+	readUntilType(t, ctx, bob, "preview")
+	if n := hits.Load(); n != 1 {
+		t.Errorf("Expected the page to be fetched once, got %d", n)
+	}
+	if n := whispered.Load(); n != 0 {
+		t.Errorf("Expected no preview of a whispered link, got %d fetches", n)
+	}
+}
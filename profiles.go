@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxDisplayNameLength = 64
+	maxAvatarURLLength   = 512
+	maxStatusTextLength  = 140
+)
+
+// Profile is what a user shows besides their username. Until there are
+// accounts, a profile belongs to the connection holding the username and
+// follows it through renames.
+type Profile struct {
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	StatusText  string `json:"status_text,omitempty"`
+}
+
+// UserInfo is the response of GET /users/{name}
+type UserInfo struct {
+	Username string `json:"username"`
+	Profile
+}
+
+// Validate checks the profile's lengths and that the avatar is an
+// absolute http(s) URL
+func (p *Profile) Validate() error {
+	if utf8.RuneCountInString(p.DisplayName) > maxDisplayNameLength {
+		return protocolErrorf(codeInvalidProfile, "display name too long (max %d characters)", maxDisplayNameLength)
+	}
+	if utf8.RuneCountInString(p.StatusText) > maxStatusTextLength {
+		return protocolErrorf(codeInvalidProfile, "status text too long (max %d characters)", maxStatusTextLength)
+	}
+	if p.AvatarURL != "" {
+		u, err := url.Parse(p.AvatarURL)
+		if err != nil || len(p.AvatarURL) > maxAvatarURLLength || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return protocolErrorf(codeInvalidProfile, "avatar must be an http(s) URL of at most %d characters", maxAvatarURLLength)
+		}
+	}
+	return nil
+}
+
+// isZero reports whether the profile is unset
+func (p Profile) isZero() bool {
+	return p == Profile{}
+}
+
+// profiles returns the profiles of the given usernames that have one
+func (cs *ChatServer) profiles(names []string) map[string]Profile {
+	cs.clientsMtx.Lock()
+	defer cs.clientsMtx.Unlock()
+
+	var profiles map[string]Profile
+	for _, name := range names {
+		client, ok := cs.usernames[name]
+		if !ok || client.profile.isZero() {
+			continue
+		}
+		if profiles == nil {
+			profiles = make(map[string]Profile)
+		}
+		profiles[name] = client.profile
+	}
+	return profiles
+}
+
+// handleProfile replaces the client's profile and confirms it back
+func (cs *ChatServer) handleProfile(ctx context.Context, client *Client, msg Message) {
+	var p Profile
+	if msg.Profile != nil {
+		p = *msg.Profile
+	}
+	if err := p.Validate(); err != nil {
+		client.logf("Invalid profile from %s (trace %s): %v", client.username, msg.Trace, err)
+		cs.sendError(ctx, client, err, &ErrorRef{Type: "profile", Trace: msg.Trace})
+		cs.noteRejection(client)
+		return
+	}
+
+	cs.clientsMtx.Lock()
+	client.profile = p
+	username := client.username
+	cs.clientsMtx.Unlock()
+
+	now := cs.now()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	err := client.writeMessage(ctx, Message{
+		Type:      "profile",
+		Username:  username,
+		Content:   "Profile updated",
+		Profile:   &p,
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+		Trace:     msg.Trace,
+	})
+	if err != nil {
+		client.logf("Error confirming profile to %s: %v", username, err)
+	}
+}
+
+// handleUser serves GET /users/{name} for users connected to this instance
+func (cs *ChatServer) handleUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.PathValue("name")
+
+	cs.clientsMtx.Lock()
+	client, ok := cs.usernames[name]
+	var info UserInfo
+	if ok {
+		info = UserInfo{Username: name, Profile: client.profile}
+	}
+	cs.clientsMtx.Unlock()
+	if !ok || client.canary || client.status == statusInvisible {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
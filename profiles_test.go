@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestProfiles(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", server.handleConnection)
+	mux.HandleFunc("/users/{name}", server.handleUser)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"/ws?username=alice",
+		&websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+	var msg Message
+	wsjson.Read(ctx, c, &msg) // join notice
+
+	bad := Profile{AvatarURL: "javascript:alert(1)"}
+	if err := wsjson.Write(ctx, c, Message{Type: "profile", Profile: &bad}); err != nil {
+		t.Fatalf("Failed to send profile: %v", err)
+	}
+	msg = Message{}
+	if err := wsjson.Read(ctx, c, &msg); err != nil || msg.Type != "error" || msg.Code != codeInvalidProfile {
+		t.Errorf("Expected an invalid_profile error, got %+v (%v)", msg, err)
+	}
+
+	profile := Profile{DisplayName: "Alice A.", AvatarURL: "https://example.com/alice.png", StatusText: "on call"}
+	if err := wsjson.Write(ctx, c, Message{Type: "profile", Profile: &profile}); err != nil {
+		t.Fatalf("Failed to send profile: %v", err)
+	}
+	msg = Message{}
+	if err := wsjson.Read(ctx, c, &msg); err != nil || msg.Type != "profile" || msg.Profile == nil || *msg.Profile != profile {
+		t.Errorf("Expected the profile to be confirmed, got %+v (%v)", msg, err)
+	}
+
+	resp, err := http.Get(s.URL + "/users/alice")
+	if err != nil {
+		t.Fatalf("Failed to fetch user: %v", err)
+	}
+	var info UserInfo
+	json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if info.Username != "alice" || info.Profile != profile {
+		t.Errorf("Unexpected user info: %+v", info)
+	}
+	resp, err = http.Get(s.URL + "/users/nobody")
+	if err != nil {
+		t.Fatalf("Failed to fetch user: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown user, got %d", resp.StatusCode)
+	}
+
+	if page := server.roster(nil, "", 10); page.Profiles["alice"] != profile {
+		t.Errorf("Expected the roster to carry alice's profile, got %+v", page)
+	}
+}
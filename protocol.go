@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// Protocol versions, negotiated through the WebSocket subprotocol. Clients
+// that don't ask for a subprotocol get v1, the original message schema.
+// v2 and v3 are also available MessagePack-encoded in binary frames. v3 is
+// v2 with a hello frame before anything else and an ack for every message
+// the server accepts.
+const (
+	protocolV1 = 1
+	protocolV2 = 2
+	protocolV3 = 3
+
+	subprotocolV1        = "chat.v1"
+	subprotocolV2        = "chat.v2"
+	subprotocolV2Msgpack = "chat.v2+msgpack"
+	subprotocolV3        = "chat.v3"
+	subprotocolV3Msgpack = "chat.v3+msgpack"
+)
+
+// supportedSubprotocols lists the subprotocols we accept, most preferred first
+var supportedSubprotocols = []string{subprotocolV3Msgpack, subprotocolV3, subprotocolV2Msgpack, subprotocolV2, subprotocolV1}
+
+// closeUnsupportedVersion is sent when the client only offers protocol
+// versions this server doesn't speak
+const closeUnsupportedVersion websocket.StatusCode = 4001
+
+// v1Message is the message envelope spoken by protocol v1 clients
+type v1Message struct {
+	Type     string `json:"type"`
+	Username string `json:"username"`
+	Content  string `json:"content"`
+	Time     string `json:"time"`
+}
+
+// v1HistoryPage is a history page as seen by protocol v1 clients
+type v1HistoryPage struct {
+	Type     string      `json:"type,omitempty"`
+	Messages []v1Message `json:"messages"`
+	HasMore  bool        `json:"has_more"`
+}
+
+// negotiatedProtocol maps the subprotocol chosen during the handshake to a
+// protocol version and codec. It returns version 0 if the client offered
+// subprotocols but none that we support.
+func negotiatedProtocol(r *http.Request, c *websocket.Conn) (int, Codec) {
+	switch c.Subprotocol() {
+	case subprotocolV3Msgpack:
+		return protocolV3, msgpackCodec{}
+	case subprotocolV3:
+		return protocolV3, jsonCodec{}
+	case subprotocolV2Msgpack:
+		return protocolV2, msgpackCodec{}
+	case subprotocolV2:
+		return protocolV2, jsonCodec{}
+	case subprotocolV1:
+		return protocolV1, jsonCodec{}
+	}
+	if r.Header.Get("Sec-WebSocket-Protocol") != "" {
+		return 0, nil
+	}
+	return protocolV1, jsonCodec{}
+}
+
+// rejectVersion tells a client its protocol versions are unsupported and
+// closes the connection
+func (cs *ChatServer) rejectVersion(ctx context.Context, c *websocket.Conn, offered string, supported []string) {
+	now := cs.now()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+
+	wsjson.Write(ctx, c, Message{
+		Type:      "error",
+		Username:  "Server",
+		Code:      "unsupported_version",
+		Content:   "unsupported protocol version " + offered + "; supported: " + strings.Join(supported, ", "),
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+	})
+	c.Close(closeUnsupportedVersion, "unsupported protocol version")
+}
+
+// toV1 downgrades a message to the v1 schema. Events v1 doesn't know about,
+// renames, errors, tombstones, presence summaries, room events and
+// announcements, become system notices.
+func toV1(msg Message) v1Message {
+	out := v1Message{
+		Type:     msg.Type,
+		Username: msg.Username,
+		Content:  msg.Content,
+		Time:     msg.Time,
+	}
+	switch msg.Type {
+	case "rename", "error", "tombstone", "presence", "topic", "pin", "unpin", "announcement", "unannounce", "profile", "status", "scheduled", "unscheduled", "motd", "slowmode":
+		out.Type = "system"
+		out.Username = "Server"
+	case "poll":
+		// v1 clients can't vote, but can read the question
+		out.Type = "message"
+		if msg.Poll != nil {
+			out.Content = "Poll: " + msg.Content + " (" + strings.Join(msg.Poll.Options, " / ") + ")"
+		}
+	}
+	return out
+}
+
+// writeMessage sends msg to the client in its negotiated protocol version
+func (c *Client) writeMessage(ctx context.Context, msg Message) error {
+	if c.version == protocolV1 {
+		return c.write(ctx, toV1(msg))
+	}
+	return c.write(ctx, msg)
+}
+
+// writeHistory sends a history page in the client's protocol version
+func (c *Client) writeHistory(ctx context.Context, page HistoryPage) error {
+	if c.version != protocolV1 {
+		return c.write(ctx, page)
+	}
+
+	out := v1HistoryPage{Type: page.Type, Messages: make([]v1Message, len(page.Messages)), HasMore: page.HasMore}
+	for i, msg := range page.Messages {
+		out.Messages[i] = toV1(msg)
+	}
+	return c.write(ctx, out)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestChatServer_ProtocolNegotiation(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	tests := []struct {
+		name         string
+		subprotocols []string
+		want         string
+		wantV2Fields bool
+	}{
+		{"no subprotocol defaults to v1", nil, "", false},
+		{"explicit v1", []string{subprotocolV1}, subprotocolV1, false},
+		{"v2", []string{subprotocolV2}, subprotocolV2, true},
+		{"server prefers v2", []string{subprotocolV1, subprotocolV2}, subprotocolV2, true},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+
+			username := "user" + string(rune('a'+i))
+			c, _, err := websocket.Dial(ctx, wsURL+"?username="+username, &websocket.DialOptions{Subprotocols: tt.subprotocols})
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer c.Close(websocket.StatusNormalClosure, "")
+
+			if c.Subprotocol() != tt.want {
+				t.Errorf("Expected subprotocol %q, got %q", tt.want, c.Subprotocol())
+			}
+
+			// Inspect the raw frame so we see exactly which fields were sent
+			for {
+				_, data, err := c.Read(ctx)
+				if err != nil {
+					t.Fatalf("Failed to read: %v", err)
+				}
+				var raw map[string]any
+				if err := json.Unmarshal(data, &raw); err != nil {
+					t.Fatalf("Invalid JSON: %v", err)
+				}
+				if !strings.Contains(raw["content"].(string), username+" has joined") {
+					continue
+				}
+				_, hasSeq := raw["seq"]
+				_, hasTS := raw["ts"]
+				if hasSeq != tt.wantV2Fields || hasTS != tt.wantV2Fields {
+					t.Errorf("Unexpected fields for %q: %s", tt.want, data)
+				}
+				break
+			}
+		})
+	}
+}
+
+func TestChatServer_UnsupportedProtocolVersion(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+	c, _, err := websocket.Dial(ctx, wsURL+"?username=future", &websocket.DialOptions{Subprotocols: []string{"chat.v9"}})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.CloseNow()
+
+	var msg Message
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read error frame: %v", err)
+	}
+	if msg.Type != "error" || msg.Code != "unsupported_version" {
+		t.Errorf("Expected unsupported_version error, got: %+v", msg)
+	}
+
+	_, _, err = c.Read(ctx)
+	if websocket.CloseStatus(err) != closeUnsupportedVersion {
+		t.Errorf("Expected close code %d, got %v", closeUnsupportedVersion, err)
+	}
+
+	// The rejected client must not keep its username
+	c2, _, err := websocket.Dial(ctx, wsURL+"?username=future", nil)
+	if err != nil {
+		t.Fatalf("Expected username to be released: %v", err)
+	}
+	c2.Close(websocket.StatusNormalClosure, "")
+}
+
+func TestToV1_RenameBecomesSystemNotice(t *testing.T) {
+	got := toV1(Message{Type: "rename", Username: "bob", OldUsername: "alice", Content: "alice is now known as bob", Seq: 3})
+	want := v1Message{Type: "system", Username: "Server", Content: "alice is now known as bob"}
+	if got != want {
+		t.Errorf("toV1() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxPushSubscriptions is how many devices one user may subscribe
+	maxPushSubscriptions = 10
+	// maxMentions is how many users one message can notify
+	maxMentions = 20
+	// maxPushBody is how much of a message a notification carries
+	maxPushBody = 200
+	pushTimeout = time.Second * 10
+)
+
+// errSubscriptionGone means the push service no longer knows the
+// subscription, which should be forgotten
+var errSubscriptionGone = errors.New("push subscription expired")
+
+// mentionPattern finds @username mentions in message content
+var mentionPattern = regexp.MustCompile(`@([\p{L}\p{M}\p{Nd}_-]+)`)
+
+// PushSubscription is a device subscribed to notifications, as produced by
+// the browser's PushSubscription.toJSON()
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256DH string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// PushNotification is the payload delivered to a subscribed device
+type PushNotification struct {
+	Title string `json:"title"`
+	Body  string `json:"body,omitempty"`
+	Room  string `json:"room,omitempty"`
+	ID    string `json:"id,omitempty"`
+}
+
+// PushProvider delivers notifications to subscribed devices. It returns
+// errSubscriptionGone for subscriptions the push service has dropped.
+type PushProvider interface {
+	Push(ctx context.Context, sub PushSubscription, payload []byte) error
+}
+
+// WithPush notifies users mentioned while they aren't connected through
+// provider. Subscriptions are managed at /push/subscriptions by users
+// authenticated with an Authenticator.
+func WithPush(provider PushProvider) Option {
+	return func(cs *ChatServer) {
+		cs.push = provider
+	}
+}
+
+// pushSubscriptions holds each user's subscribed devices
+type pushSubscriptions struct {
+	mu     sync.Mutex
+	byUser map[string][]PushSubscription
+}
+
+// add subscribes a device, replacing any earlier subscription with the
+// same endpoint
+func (p *pushSubscriptions) add(username string, sub PushSubscription) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.byUser == nil {
+		p.byUser = make(map[string][]PushSubscription)
+	}
+	subs := slices.DeleteFunc(p.byUser[username], func(s PushSubscription) bool { return s.Endpoint == sub.Endpoint })
+	if len(subs) >= maxPushSubscriptions {
+		return errors.New("too many push subscriptions")
+	}
+	p.byUser[username] = append(subs, sub)
+	return nil
+}
+
+// remove unsubscribes a device, reporting whether it was subscribed
+func (p *pushSubscriptions) remove(username, endpoint string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	subs := p.byUser[username]
+	n := len(subs)
+	subs = slices.DeleteFunc(subs, func(s PushSubscription) bool { return s.Endpoint == endpoint })
+	if len(subs) == 0 {
+		delete(p.byUser, username)
+	} else {
+		p.byUser[username] = subs
+	}
+	return len(subs) < n
+}
+
+// list returns a user's subscribed devices
+func (p *pushSubscriptions) list(username string) []PushSubscription {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.byUser[username])
+}
+
+// mentions returns the users mentioned in content, at most maxMentions
+func mentions(content string) []string {
+	var names []string
+	for _, m := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		if !slices.Contains(names, m[1]) {
+			names = append(names, m[1])
+		}
+		if len(names) == maxMentions {
+			break
+		}
+	}
+	return names
+}
+
+// notifyMentions pushes a notification to every user mentioned in msg who
+// isn't connected to this instance. In a private, password-protected or
+// invite-only room only users who have joined it are notified. It runs on
+// the instance that accepted the message, so each mention is pushed once.
+func (cs *ChatServer) notifyMentions(msg Message) {
+	names := mentions(msg.Content)
+	if len(names) == 0 {
+		return
+	}
+	room := cs.lookupRoom(msg.Room)
+
+	// Only say what was written if anyone could have read it
+	n := PushNotification{Title: msg.Username + " mentioned you", Room: msg.Room, ID: msg.ID}
+	if room == nil || !room.Private {
+		n.Body = msg.Content
+		if utf8.RuneCountInString(n.Body) > maxPushBody {
+			n.Body = string([]rune(n.Body)[:maxPushBody]) + "…"
+		}
+	}
+	payload, _ := json.Marshal(n)
+
+	for _, name := range names {
+		name = cs.usernamePolicy.normalize(name)
+		if name == msg.Username || cs.connected(name) {
+			continue
+		}
+		if room != nil && room.restricted() && !cs.memberships.has(name, room) {
+			continue
+		}
+		for _, sub := range cs.pushSubs.list(name) {
+			ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+			err := cs.push.Push(ctx, sub, payload)
+			cancel()
+			switch {
+			case errors.Is(err, errSubscriptionGone):
+				cs.pushSubs.remove(name, sub.Endpoint)
+			case err != nil:
+				log.Printf("Push to a device of %s failed (trace %s): %v", name, msg.Trace, err)
+				metrics.Add(metricPushFailed, 1)
+			default:
+				metrics.Add(metricPushSent, 1)
+			}
+		}
+	}
+}
+
+// connected reports whether a user has a connection to this instance
+func (cs *ChatServer) connected(username string) bool {
+	cs.clientsMtx.Lock()
+	defer cs.clientsMtx.Unlock()
+	_, ok := cs.usernames[username]
+	return ok
+}
+
+// handlePushKey serves GET /push/key, the application server key browsers
+// subscribe with
+func (cs *ChatServer) handlePushKey(w http.ResponseWriter, r *http.Request) {
+	keyed, ok := cs.push.(interface{ PublicKey() string })
+	if !ok {
+		http.Error(w, "push not available", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"public_key": keyed.PublicKey()})
+}
+
+// handlePushSubscriptions serves the caller's subscriptions: GET lists
+// them, POST with a PushSubscription adds one and DELETE ?endpoint=<url>
+// removes one. Callers authenticate as for the WebSocket.
+func (cs *ChatServer) handlePushSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if cs.push == nil || cs.auth == nil {
+		http.Error(w, "push not available", http.StatusNotFound)
+		return
+	}
+	identity := cs.authenticate(w, r)
+	if identity == nil {
+		return
+	}
+	if identity.Guest {
+		http.Error(w, "guests can't subscribe to notifications", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		subs := cs.pushSubs.list(identity.Username)
+		if subs == nil {
+			subs = []PushSubscription{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(subs)
+
+	case http.MethodPost:
+		var sub PushSubscription
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&sub); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if u, err := url.Parse(sub.Endpoint); err != nil || u.Scheme != "https" || u.Host == "" || sub.Keys.P256DH == "" || sub.Keys.Auth == "" {
+			http.Error(w, "subscription needs an https endpoint and p256dh and auth keys", http.StatusBadRequest)
+			return
+		}
+		if err := cs.pushSubs.add(identity.Username, sub); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	case http.MethodDelete:
+		if !cs.pushSubs.remove(identity.Username, r.URL.Query().Get("endpoint")) {
+			http.Error(w, "no such subscription", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// testSubscription creates a browser-side key pair and its subscription
+func testSubscription(t *testing.T, endpoint string) (PushSubscription, *ecdh.PrivateKey, []byte) {
+	t.Helper()
+	ua, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	var sub PushSubscription
+	sub.Endpoint = endpoint
+	sub.Keys.P256DH = base64.RawURLEncoding.EncodeToString(ua.PublicKey().Bytes())
+	sub.Keys.Auth = base64.RawURLEncoding.EncodeToString(secret)
+	return sub, ua, secret
+}
+
+func TestWebPushProvider(t *testing.T) {
+	var gotAuth string
+	var gotBody []byte
+	var gone atomic.Bool
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if gone.Load() {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		gotAuth = r.Header.Get("Authorization")
+		gotBody, _ = io.ReadAll(r.Body)
+		if r.Header.Get("Content-Encoding") != "aes128gcm" || r.Header.Get("TTL") == "" {
+			t.Errorf("Unexpected headers %v", r.Header)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer s.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	provider := NewWebPushProvider(key, "mailto:ops@example.com")
+	provider.client = s.Client()
+	sub, ua, secret := testSubscription(t, s.URL+"/push/abc")
+
+	if err := provider.Push(context.Background(), sub, []byte(`{"title":"hi"}`)); err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+
+	// The browser decrypts with its private key and auth secret
+	salt, idLen := gotBody[:16], int(gotBody[20])
+	asPublic := gotBody[21 : 21+idLen]
+	as, err := ecdh.P256().NewPublicKey(asPublic)
+	if err != nil {
+		t.Fatalf("Expected our public key as key ID: %v", err)
+	}
+	shared, _ := ua.ECDH(as)
+	cek, nonce, _ := webPushKeys(shared, secret, salt, ua.PublicKey().Bytes(), asPublic)
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plain, err := gcm.Open(nil, nonce, gotBody[21+idLen:], nil)
+	if err != nil || !bytes.Equal(plain, []byte("{\"title\":\"hi\"}\x02")) {
+		t.Errorf("Failed to decrypt the notification: %q (%v)", plain, err)
+	}
+
+	// The VAPID token is signed by the key it names
+	token, pub, ok := strings.Cut(strings.TrimPrefix(gotAuth, "vapid t="), ", k=")
+	if !ok || pub != provider.PublicKey() {
+		t.Fatalf("Unexpected Authorization header %q", gotAuth)
+	}
+	dot := strings.LastIndex(token, ".")
+	sig, _ := base64.RawURLEncoding.DecodeString(token[dot+1:])
+	digest := sha256.Sum256([]byte(token[:dot]))
+	if len(sig) != 64 || !ecdsa.Verify(&key.PublicKey, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Error("Expected a valid VAPID signature")
+	}
+
+	gone.Store(true)
+	if err := provider.Push(context.Background(), sub, []byte("{}")); !errors.Is(err, errSubscriptionGone) {
+		t.Errorf("Expected an expired subscription, got %v", err)
+	}
+}
+
+// fakePush records the endpoints notified
+type fakePush struct {
+	pushed chan string
+}
+
+func (f *fakePush) Push(ctx context.Context, sub PushSubscription, payload []byte) error {
+	var n PushNotification
+	json.Unmarshal(payload, &n)
+	f.pushed <- sub.Endpoint + " " + n.Title
+	return nil
+}
+
+func TestPush_OfflineMentions(t *testing.T) {
+	push := &fakePush{pushed: make(chan string, 10)}
+	server := NewChatServer(WithPush(push))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	for _, name := range []string{"alice", "bob", "carol"} {
+		sub, _, _ := testSubscription(t, "https://push.example/"+name)
+		server.pushSubs.add(name, sub)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+	dialStatusTest(t, ctx, s, "carol")
+
+	// Only bob is offline; alice doesn't notify herself
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "@bob @carol @alice @bob lunch?"})
+	select {
+	case got := <-push.pushed:
+		if got != "https://push.example/bob alice mentioned you" {
+			t.Errorf("Unexpected push %q", got)
+		}
+	case <-ctx.Done():
+		t.Fatal("Expected bob to be notified")
+	}
+	select {
+	case got := <-push.pushed:
+		t.Errorf("Expected a single push, also got %q", got)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestPush_WhispersAndRestrictedRooms(t *testing.T) {
+	push := &fakePush{pushed: make(chan string, 10)}
+	server := NewChatServer(WithPush(push), WithUsernamePolicy(UsernamePolicy{Unicode: true}))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	for _, name := range []string{"bob", "josé"} {
+		sub, _, _ := testSubscription(t, "https://push.example/"+name)
+		server.pushSubs.add(name, sub)
+	}
+	vault, _, err := server.createRoom(RoomOptions{Name: "vault", Password: "hunter2"})
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	server.memberships.add("josé", vault)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	dave := dialStatusTest(t, ctx, s, "dave")
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+	inVault, _, err := websocket.Dial(ctx, wsURL+"?username=carol&room=vault&password=hunter2", &websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to join vault: %v", err)
+	}
+	defer inVault.CloseNow()
+	readUntilType(t, ctx, inVault, "system")
+
+	// Neither a whisper nor a room bob hasn't joined notifies him; josé
+	// has joined the vault
+	bot := &Bot{name: "helper", cs: server}
+	bot.Whisper("", "dave", "don't tell @bob")
+	if msg := readUntilType(t, ctx, dave, "message"); msg.To != "dave" {
+		t.Fatalf("Expected the bot's whisper, got %+v", msg)
+	}
+	wsjson.Write(ctx, inVault, Message{Type: "message", Content: "@bob @josé the code is 1234"})
+	select {
+	case got := <-push.pushed:
+		if got != "https://push.example/josé carol mentioned you" {
+			t.Errorf("Unexpected push %q", got)
+		}
+	case <-ctx.Done():
+		t.Fatal("Expected josé to be notified")
+	}
+	select {
+	case got := <-push.pushed:
+		t.Errorf("Expected a single push, also got %q", got)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestPush_Subscriptions(t *testing.T) {
+	var calls atomic.Int32
+	var down atomic.Bool
+	verify := newVerifyServer(t, &calls, &down)
+	auth, _ := NewWebhookAuthenticator(verify.URL, time.Minute, AuthFallbackDeny)
+	server := NewChatServer(WithAuthenticator(auth), WithPush(&fakePush{}))
+	s := httptest.NewServer(http.HandlerFunc(server.handlePushSubscriptions))
+	defer s.Close()
+
+	request := func(method, url, token string, body any) *http.Response {
+		t.Helper()
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, url, bytes.NewReader(data))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	sub, _, _ := testSubscription(t, "https://push.example/device")
+	if resp := request(http.MethodPost, s.URL, "forged", sub); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a valid token, got %d", resp.StatusCode)
+	}
+	plain := sub
+	plain.Endpoint = "http://push.example/device"
+	if resp := request(http.MethodPost, s.URL, "alice-token", plain); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a plain http endpoint, got %d", resp.StatusCode)
+	}
+	if resp := request(http.MethodPost, s.URL, "alice-token", sub); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", resp.StatusCode)
+	}
+	if subs := server.pushSubs.list("alice"); len(subs) != 1 || subs[0].Endpoint != sub.Endpoint {
+		t.Errorf("Expected alice's device to be subscribed, got %+v", subs)
+	}
+	if resp := request(http.MethodDelete, s.URL+"?endpoint="+sub.Endpoint, "alice-token", nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", resp.StatusCode)
+	}
+	if subs := server.pushSubs.list("alice"); len(subs) != 0 {
+		t.Errorf("Expected no subscriptions left, got %+v", subs)
+	}
+}
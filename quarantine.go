@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// quarantineWindow is the period over which rejected messages are counted
+// towards automatic quarantine
+const quarantineWindow = time.Minute
+
+// WithAutoQuarantine quarantines a client once it has sent limit rejected
+// messages within a minute. Zero disables automatic quarantine.
+func WithAutoQuarantine(limit int) Option {
+	return func(cs *ChatServer) {
+		cs.quarantineAfter = limit
+	}
+}
+
+// quarantineEntry holds a flagged client's messages until a moderator
+// reviews them
+type quarantineEntry struct {
+	reason string
+	since  time.Time
+	held   []Message
+}
+
+// QuarantineInfo describes a quarantined client for the admin API
+type QuarantineInfo struct {
+	ConnectionID string    `json:"connection_id"`
+	Username     string    `json:"username"`
+	Reason       string    `json:"reason"`
+	Since        time.Time `json:"since"`
+	Held         []Message `json:"held"`
+}
+
+// quarantine flags client so its messages only reach moderators
+func (cs *ChatServer) quarantine(client *Client, actor, reason string) bool {
+	cs.quarantineMtx.Lock()
+	defer cs.quarantineMtx.Unlock()
+	if _, ok := cs.quarantined[client]; ok {
+		return false
+	}
+	cs.quarantined[client] = &quarantineEntry{reason: reason, since: cs.now()}
+	client.logf("Quarantined by %s: %s", actor, reason)
+	cs.audit(AuditQuarantine, actor, client.id, reason)
+	return true
+}
+
+// release lifts the quarantine on client and returns its held messages
+func (cs *ChatServer) release(client *Client) ([]Message, bool) {
+	cs.quarantineMtx.Lock()
+	defer cs.quarantineMtx.Unlock()
+	entry, ok := cs.quarantined[client]
+	if !ok {
+		return nil, false
+	}
+	delete(cs.quarantined, client)
+	return entry.held, true
+}
+
+// hold keeps msg for review if client is quarantined. The sender still sees
+// its own message, so the quarantine isn't obvious to them.
+func (cs *ChatServer) hold(ctx context.Context, client *Client, msg Message) bool {
+	cs.quarantineMtx.Lock()
+	entry, ok := cs.quarantined[client]
+	if ok {
+		msg.ID = newMessageID()
+		entry.held = append(entry.held, msg)
+	}
+	cs.quarantineMtx.Unlock()
+	if !ok {
+		return false
+	}
+
+	client.logf("Held message from quarantined %s (trace %s)", msg.Username, msg.Trace)
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	if err := client.writeMessage(ctx, msg); err != nil {
+		client.logf("Error echoing held message to %s: %v", msg.Username, err)
+	}
+	return true
+}
+
+// holdFor keeps msg for review if the named user's connection is
+// quarantined, for messages that arrive without one, such as over gRPC
+func (cs *ChatServer) holdFor(username string, msg Message) bool {
+	cs.clientsMtx.Lock()
+	defer cs.clientsMtx.Unlock()
+	client, ok := cs.usernames[username]
+	if !ok {
+		return false
+	}
+	cs.quarantineMtx.Lock()
+	defer cs.quarantineMtx.Unlock()
+	entry, ok := cs.quarantined[client]
+	if ok {
+		msg.ID = newMessageID()
+		entry.held = append(entry.held, msg)
+	}
+	return ok
+}
+
+// noteRejection counts a rejected message and quarantines clients that
+// keep sending them. Only the client's own handler calls it, under
+// events.handling for POST /send.
+func (cs *ChatServer) noteRejection(client *Client) {
+	if cs.quarantineAfter <= 0 {
+		return
+	}
+	now := cs.now()
+	recent := client.rejections[:0]
+	for _, t := range client.rejections {
+		if now.Sub(t) < quarantineWindow {
+			recent = append(recent, t)
+		}
+	}
+	client.rejections = append(recent, now)
+	if len(client.rejections) >= cs.quarantineAfter {
+		cs.quarantine(client, "system", "repeatedly sent rejected messages")
+	}
+}
+
+// handleAdminQuarantine serves GET /admin/quarantine, listing quarantined
+// clients and their held messages, and POST /admin/quarantine?conn=<id>,
+// quarantining a client
+func (cs *ChatServer) handleAdminQuarantine(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		cs.clientsMtx.Lock()
+		cs.quarantineMtx.Lock()
+		list := make([]QuarantineInfo, 0, len(cs.quarantined))
+		for client, entry := range cs.quarantined {
+			list = append(list, QuarantineInfo{
+				ConnectionID: client.id,
+				Username:     client.username,
+				Reason:       entry.reason,
+				Since:        entry.since,
+				Held:         append([]Message{}, entry.held...),
+			})
+		}
+		cs.quarantineMtx.Unlock()
+		cs.clientsMtx.Unlock()
+
+		sort.Slice(list, func(i, j int) bool { return list[i].Since.Before(list[j].Since) })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+
+	case http.MethodPost:
+		client := cs.clientByID(r.URL.Query().Get("conn"))
+		if client == nil {
+			http.Error(w, "no such connection", http.StatusNotFound)
+			return
+		}
+		reason := r.URL.Query().Get("reason")
+		if reason == "" {
+			reason = "flagged by moderator"
+		}
+		if !cs.quarantine(client, adminActor(r), reason) {
+			http.Error(w, "already quarantined", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminRelease serves POST /admin/quarantine/release?conn=<id>,
+// lifting the quarantine and delivering the held messages to the room
+func (cs *ChatServer) handleAdminRelease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client := cs.clientByID(r.URL.Query().Get("conn"))
+	if client == nil {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+	held, ok := cs.release(client)
+	if !ok {
+		http.Error(w, "not quarantined", http.StatusNotFound)
+		return
+	}
+
+	client.logf("Released from quarantine with %d held messages", len(held))
+	cs.audit(AuditRelease, adminActor(r), client.id, r.URL.Query().Get("reason"))
+	for _, msg := range held {
+		cs.replayHeld(r.Context(), client, msg)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// replayHeld sends a released message through the stages holding skipped:
+// slash commands reach their plugin and scheduled messages wait for their
+// time, unless it passed while they were held. The rest are published.
+func (cs *ChatServer) replayHeld(ctx context.Context, client *Client, msg Message) {
+	if msg.Type == "message" && msg.DeliverAt == "" && cs.dispatchCommand(client, msg) {
+		return
+	}
+	if msg.DeliverAt != "" {
+		now := cs.now()
+		if at, err := time.Parse(time.RFC3339, msg.DeliverAt); err != nil || at.After(now) {
+			if !cs.requireFeature(ctx, client, msg, featureScheduled) {
+				cs.handleSchedule(ctx, client, msg, now)
+			}
+			return
+		}
+		msg.DeliverAt = ""
+	}
+	cs.export(ExportMessage, msg.Username, msg.Content, time.UnixMilli(msg.Timestamp))
+	cs.publish(msg)
+}
+
+// handleAdminRemove serves POST /admin/quarantine/remove?conn=<id>,
+// discarding the held messages and disconnecting the client
+func (cs *ChatServer) handleAdminRemove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client := cs.clientByID(r.URL.Query().Get("conn"))
+	if client == nil {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+	held, ok := cs.release(client)
+	if !ok {
+		http.Error(w, "not quarantined", http.StatusNotFound)
+		return
+	}
+
+	client.logf("Removed from quarantine, discarding %d held messages", len(held))
+	cs.audit(AuditRemove, adminActor(r), client.id, r.URL.Query().Get("reason"))
+	// The close handshake waits for the client, so don't hold up the response
+	go client.close(websocket.StatusPolicyViolation, "removed by moderator")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestChatServer_Quarantine(t *testing.T) {
+	server := NewChatServer(WithAutoQuarantine(2), WithAdminToken("secret"))
+	server.Run(t.Context())
+	s := newAdminTestServer(t, server)
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	dial := func(name string) *websocket.Conn {
+		c, _, err := websocket.Dial(ctx, wsURL+"?username="+name, &websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+		if err != nil {
+			t.Fatalf("Failed to connect %s: %v", name, err)
+		}
+		t.Cleanup(func() { c.Close(websocket.StatusNormalClosure, "") })
+		return c
+	}
+	read := func(c *websocket.Conn) Message {
+		var msg Message
+		if err := wsjson.Read(ctx, c, &msg); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		return msg
+	}
+
+	alice := dial("alice")
+	read(alice)
+	bob := dial("bob")
+	read(bob)
+	read(alice) // bob's join
+
+	// Two rejected messages put alice in quarantine
+	for i := 0; i < 2; i++ {
+		if err := wsjson.Write(ctx, alice, Message{Type: "message"}); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+		if msg := read(alice); msg.Type != "error" {
+			t.Fatalf("Expected error, got: %+v", msg)
+		}
+	}
+
+	// Her next message is echoed to her but held back from the room
+	if err := wsjson.Write(ctx, alice, Message{Type: "message", Content: "held"}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if msg := read(alice); msg.Content != "held" {
+		t.Errorf("Expected alice to see her own message, got: %+v", msg)
+	}
+	// and so is a message she schedules
+	deliverAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if err := wsjson.Write(ctx, alice, Message{Type: "message", Content: "later", DeliverAt: deliverAt}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	read(alice)
+
+	resp := adminRequest(t, ctx, http.MethodGet, s.URL+"/admin/quarantine", "secret")
+	var list []QuarantineInfo
+	err := json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Failed to decode quarantine list: %v", err)
+	}
+	if len(list) != 1 || list[0].Username != "alice" || len(list[0].Held) != 2 || list[0].Held[0].Content != "held" {
+		t.Fatalf("Unexpected quarantine list: %+v", list)
+	}
+
+	// Releasing her delivers the held message to the room, and schedules
+	// the scheduled one instead of sending it straight away
+	resp = adminRequest(t, ctx, http.MethodPost, s.URL+"/admin/quarantine/release?conn="+list[0].ConnectionID, "secret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 on release, got %d", resp.StatusCode)
+	}
+	if msg := read(bob); msg.Content != "held" || msg.Username != "alice" {
+		t.Errorf("Expected bob to receive the released message, got: %+v", msg)
+	}
+	if msg := readUntilType(t, ctx, alice, "scheduled"); msg.Content != "later" || msg.DeliverAt != deliverAt {
+		t.Errorf("Expected the held message to be scheduled on release, got: %+v", msg)
+	}
+	if n := server.scheduled.count("alice"); n != 1 {
+		t.Errorf("Expected 1 scheduled message, got %d", n)
+	}
+
+	// A moderator can quarantine bob and then remove him
+	info, _ := server.Client("bob")
+	bobID := info.ID
+	for _, path := range []string{"/admin/quarantine", "/admin/quarantine/remove"} {
+		resp = adminRequest(t, ctx, http.MethodPost, s.URL+path+"?conn="+bobID, "secret")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("Expected 204 from %s, got %d", path, resp.StatusCode)
+		}
+	}
+	_, _, err = bob.Read(ctx)
+	if websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+		t.Errorf("Expected bob to be disconnected with a policy violation, got %v", err)
+	}
+}
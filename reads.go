@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ReadMarker is the last message a user has read in a room
+type ReadMarker struct {
+	ID string
+	// Seq is the message's sequence number on this instance, zero if it
+	// isn't in the local history
+	Seq uint64
+}
+
+// historyOf returns the history of room; the lobby's is the server's
+func (cs *ChatServer) historyOf(room *Room) *History {
+	if room == cs.lobby {
+		return cs.history
+	}
+	return room.history
+}
+
+// CountAfter counts stored chat messages after seq that weren't sent by
+// username
+func (h *History) CountAfter(seq uint64, username string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := 0
+	for i := 0; i < h.n; i++ {
+		s := h.lastSeq - uint64(i)
+		if s <= seq {
+			break
+		}
+		if msg := h.slot(s); msg.Type == "message" && msg.Username != username {
+			n++
+		}
+	}
+	return n
+}
+
+// readsLocked returns who has read up to which message in room. Callers
+// hold ChatServer.roomsMtx.
+func readsLocked(room *Room) map[string]string {
+	if len(room.reads) == 0 {
+		return nil
+	}
+	reads := make(map[string]string, len(room.reads))
+	for username, marker := range room.reads {
+		reads[username] = marker.ID
+	}
+	return reads
+}
+
+// unread returns the client's read marker in its room and how many
+// messages arrived after it, if the marker is in the local history
+func (cs *ChatServer) unread(client *Client, room *Room) (string, int) {
+	cs.roomsMtx.Lock()
+	marker, ok := room.reads[client.username]
+	cs.roomsMtx.Unlock()
+	if !ok || marker.Seq == 0 {
+		return "", 0
+	}
+	return marker.ID, cs.historyOf(room).CountAfter(marker.Seq, client.username)
+}
+
+// UnreadSummary tells a joining v2 client how much it missed in every
+// room it has read in
+type UnreadSummary struct {
+	Type  string       `json:"type"`
+	Rooms []RoomUnread `json:"rooms"`
+}
+
+// RoomUnread is one room's entry in an UnreadSummary; the lobby's Room is
+// empty
+type RoomUnread struct {
+	Room     string `json:"room,omitempty"`
+	LastRead string `json:"last_read"`
+	Unread   int    `json:"unread"`
+}
+
+// unreadSummary counts the unread messages in every room the user has a
+// read marker in, lobby first and then by name
+func (cs *ChatServer) unreadSummary(username string) []RoomUnread {
+	type marked struct {
+		room   *Room
+		marker ReadMarker
+	}
+	var rooms []marked
+	cs.roomsMtx.Lock()
+	if marker, ok := cs.lobby.reads[username]; ok {
+		rooms = append(rooms, marked{cs.lobby, marker})
+	}
+	for _, room := range cs.rooms {
+		if marker, ok := room.reads[username]; ok {
+			rooms = append(rooms, marked{room, marker})
+		}
+	}
+	cs.roomsMtx.Unlock()
+
+	var summary []RoomUnread
+	for _, m := range rooms {
+		if m.marker.Seq == 0 {
+			continue
+		}
+		entry := RoomUnread{LastRead: m.marker.ID, Unread: cs.historyOf(m.room).CountAfter(m.marker.Seq, username)}
+		if m.room != cs.lobby {
+			entry.Room = m.room.Name
+		}
+		summary = append(summary, entry)
+	}
+	sort.Slice(summary, func(i, j int) bool { return summary[i].Room < summary[j].Room })
+	return summary
+}
+
+// sendUnreadSummary gives a joining v2 client its unread counts, if it has
+// read in any room
+func (cs *ChatServer) sendUnreadSummary(ctx context.Context, client *Client) {
+	if client.version == protocolV1 {
+		return
+	}
+	rooms := cs.unreadSummary(client.username)
+	if len(rooms) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	if err := client.write(ctx, UnreadSummary{Type: "unread", Rooms: rooms}); err != nil {
+		client.logf("Error sending unread summary to %s: %v", client.username, err)
+	}
+}
+
+// applyRead moves a user's read marker forward from a "read" event. It
+// runs as the event is delivered so every instance keeps the lobby's
+// markers in step, resolving the message against its own history.
+// Markers never move backwards.
+func (cs *ChatServer) applyRead(msg Message) {
+	room := cs.stateRoom(msg.Room)
+	if room == nil {
+		return
+	}
+	read, _ := cs.historyOf(room).Find(msg.LastRead)
+
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	if old, ok := room.reads[msg.Username]; ok && (read.Seq == 0 || old.Seq >= read.Seq) {
+		return
+	}
+	if room.reads == nil {
+		room.reads = make(map[string]ReadMarker)
+	}
+	room.reads[msg.Username] = ReadMarker{ID: msg.LastRead, Seq: read.Seq}
+}
+
+// moveReads carries a user's read markers over to their new name, or drops
+// them when newName is empty
+func (cs *ChatServer) moveReads(oldName, newName string) {
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	move := func(room *Room) {
+		marker, ok := room.reads[oldName]
+		if !ok {
+			return
+		}
+		delete(room.reads, oldName)
+		if newName != "" {
+			room.reads[newName] = marker
+		}
+	}
+	move(cs.lobby)
+	for _, room := range cs.rooms {
+		move(room)
+	}
+}
+
+// handleRead processes a client's "read" message, moving its marker to the
+// given message and telling the room
+func (cs *ChatServer) handleRead(ctx context.Context, client *Client, msg Message) {
+	room := client.room
+	if room == nil {
+		room = cs.lobby
+	}
+	if _, ok := cs.historyOf(room).Find(msg.LastRead); !ok {
+		err := protocolErrorf(codeUnknownMessage, "no message %q in the room's history", msg.LastRead)
+		client.logf("Invalid read marker from %s (trace %s): %v", client.username, msg.Trace, err)
+		cs.sendError(ctx, client, err, &ErrorRef{Type: "read", Trace: msg.Trace})
+		cs.noteRejection(client)
+		return
+	}
+
+	now := cs.now()
+	cs.publish(Message{
+		Type:      "read",
+		Username:  client.username,
+		LastRead:  msg.LastRead,
+		Room:      client.roomName(),
+		Content:   fmt.Sprintf("%s has read up to %s", client.username, msg.LastRead),
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+		Trace:     msg.Trace,
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// readUntilType reads until a message of the given type or an error
+func readUntilType(t *testing.T, ctx context.Context, c *websocket.Conn, typ string) Message {
+	t.Helper()
+	for {
+		var msg Message
+		if err := wsjson.Read(ctx, c, &msg); err != nil {
+			t.Fatalf("Failed to read %s: %v", typ, err)
+		}
+		if msg.Type == typ || msg.Type == "error" {
+			return msg
+		}
+	}
+}
+
+func TestReadMarkers(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+	bob := dialStatusTest(t, ctx, s, "bob")
+
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "first"})
+	first := readUntilType(t, ctx, bob, "message")
+
+	wsjson.Write(ctx, bob, Message{Type: "read", LastRead: "no-such-id"})
+	if msg := readUntilType(t, ctx, bob, "read"); msg.Code != codeUnknownMessage {
+		t.Errorf("Expected an unknown_message error, got %+v", msg)
+	}
+	wsjson.Write(ctx, bob, Message{Type: "read", LastRead: first.ID})
+	if msg := readUntilType(t, ctx, alice, "read"); msg.Username != "bob" || msg.LastRead != first.ID {
+		t.Errorf("Expected bob's read marker, got %+v", msg)
+	}
+
+	// bob misses two messages while away
+	bob.Close(websocket.StatusNormalClosure, "")
+	readUntilType(t, ctx, alice, "system")
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "second"})
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "third"})
+	readUntilType(t, ctx, alice, "message")
+	readUntilType(t, ctx, alice, "message")
+
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username=bob",
+		&websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to reconnect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+	var state RoomState
+	if err := wsjson.Read(ctx, c, &state); err != nil {
+		t.Fatalf("Failed to read room state: %v", err)
+	}
+	if state.Type != "room" || state.LastRead != first.ID || state.Unread != 2 || state.Reads["bob"] != first.ID {
+		t.Errorf("Expected bob's marker with 2 unread, got %+v", state)
+	}
+	var summary UnreadSummary
+	if err := wsjson.Read(ctx, c, &summary); err != nil {
+		t.Fatalf("Failed to read unread summary: %v", err)
+	}
+	if summary.Type != "unread" || len(summary.Rooms) != 1 || summary.Rooms[0] != (RoomUnread{LastRead: first.ID, Unread: 2}) {
+		t.Errorf("Expected 2 unread in the lobby, got %+v", summary)
+	}
+}
+
+func TestUnreadSummary(t *testing.T) {
+	server := NewChatServer()
+	ops, _, err := server.createRoom(RoomOptions{Name: "ops"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.createRoom(RoomOptions{Name: "dev"})
+	read := ops.history.Append(Message{Type: "message", Username: "alice", Content: "deploy?", ID: "m1"})
+	ops.history.Append(Message{Type: "message", Username: "bob", Content: "mine"})
+	ops.history.Append(Message{Type: "message", Username: "alice", Content: "now", ID: "m3"})
+	lobby := server.history.Append(Message{Type: "message", Username: "alice", Content: "hi", ID: "m4"})
+
+	server.applyRead(Message{Type: "read", Username: "bob", Room: "ops", LastRead: read.ID})
+	server.applyRead(Message{Type: "read", Username: "bob", LastRead: lobby.ID})
+	// A marker this instance can't resolve doesn't replace one it can
+	server.applyRead(Message{Type: "read", Username: "bob", LastRead: "unknown"})
+
+	want := []RoomUnread{{LastRead: "m4"}, {Room: "ops", LastRead: "m1", Unread: 1}}
+	if got := server.unreadSummary("bob"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	if got := server.unreadSummary("carol"); got != nil {
+		t.Errorf("Expected nothing for a user without markers, got %+v", got)
+	}
+}
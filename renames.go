@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Rename limits applied unless configured otherwise
+const (
+	defaultRenameCooldown = time.Second * 30
+	defaultRenameReserve  = time.Minute * 5
+	renameLogSize         = 1000
+)
+
+// WithRenameLimits sets how long a client must wait between renames and how
+// long a name abandoned through a rename stays reserved for its previous
+// holder. Zero disables either limit.
+func WithRenameLimits(cooldown, reserve time.Duration) Option {
+	return func(cs *ChatServer) {
+		cs.renameCooldown = cooldown
+		cs.renameReserve = reserve
+	}
+}
+
+// reservation holds an abandoned name for the connection that gave it up
+type reservation struct {
+	connID string
+	until  time.Time
+}
+
+// reservedLocked reports whether name is reserved for a connection other
+// than client. Callers hold clientsMtx.
+func (cs *ChatServer) reservedLocked(name string, client *Client) bool {
+	r, ok := cs.reserved[name]
+	if !ok {
+		return false
+	}
+	if cs.now().After(r.until) {
+		delete(cs.reserved, name)
+		return false
+	}
+	return r.connID != client.id
+}
+
+// RenameRecord is one entry in the rename history kept for moderators
+type RenameRecord struct {
+	Time         time.Time `json:"time"`
+	ConnectionID string    `json:"connection_id"`
+	OldUsername  string    `json:"old_username"`
+	NewUsername  string    `json:"new_username"`
+	Trace        string    `json:"trace,omitempty"`
+}
+
+// renameLog keeps the most recent renames
+type renameLog struct {
+	mu      sync.Mutex
+	records []RenameRecord
+}
+
+func (l *renameLog) add(r RenameRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.records) == renameLogSize {
+		l.records = append(l.records[:0], l.records[1:]...)
+	}
+	l.records = append(l.records, r)
+}
+
+// find returns renames to or from username, newest first. An empty
+// username matches every rename.
+func (l *renameLog) find(username string) []RenameRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []RenameRecord{}
+	for i := len(l.records) - 1; i >= 0; i-- {
+		r := l.records[i]
+		if username == "" || r.OldUsername == username || r.NewUsername == username {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// handleAdminRenames serves GET /admin/renames[?username=<name>]
+func (cs *ChatServer) handleAdminRenames(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cs.renames.find(r.URL.Query().Get("username")))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// retentionSweepInterval is how often the janitor applies the retention
+	// policy
+	retentionSweepInterval = time.Minute
+	// retentionBatchSize is the most messages pruned from one room while
+	// holding its history lock
+	retentionBatchSize = 500
+	// defaultRetentionRate is how many messages per second the janitor
+	// prunes at most
+	defaultRetentionRate = 10000
+)
+
+// retentionLagMs is how far past the retention cutoff the oldest stored
+// message was at the end of the last sweep
+var retentionLagMs = new(expvar.Int)
+
+func init() {
+	metrics.Set(metricRetentionLagMs, retentionLagMs)
+}
+
+// WithRetention drops stored messages older than maxAge and keeps at most
+// maxCount of them. Zero disables either limit; the history size always
+// caps the count.
+func WithRetention(maxAge time.Duration, maxCount int) Option {
+	return func(cs *ChatServer) {
+		cs.retentionAge = maxAge
+		cs.retentionCount = maxCount
+	}
+}
+
+// WithRetentionRate limits the janitor to pruning perSecond messages a
+// second, so large backlogs are worked off without starving live traffic
+// of the history locks. Zero removes the limit.
+func WithRetentionRate(perSecond int) Option {
+	return func(cs *ChatServer) {
+		cs.retentionRate = perSecond
+	}
+}
+
+// Prune removes messages stamped before cutoff, and the oldest messages
+// beyond keep, returning how many were removed. A zero cutoff or keep
+// skips that check. At most limit messages are removed, or all of them if
+// limit is zero.
+func (h *History) Prune(cutoff time.Time, keep, limit int) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	removed := 0
+	if keep > 0 && h.n > keep {
+		removed = h.n - keep
+		if limit > 0 {
+			removed = min(removed, limit)
+		}
+		h.n -= removed
+	}
+	if cutoff.IsZero() {
+		return removed
+	}
+	for h.n > 0 && (limit == 0 || removed < limit) {
+		oldest := h.lastSeq - uint64(h.n) + 1
+		if h.slot(oldest).Timestamp >= cutoff.UnixMilli() {
+			break
+		}
+		h.n--
+		removed++
+	}
+	return removed
+}
+
+// oldest returns the timestamp of the oldest stored message
+func (h *History) oldest() (int64, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.n == 0 {
+		return 0, false
+	}
+	oldest := h.lastSeq - uint64(h.n) + 1
+	return h.slot(oldest).Timestamp, true
+}
+
+// Purge removes every stored message. Sequence numbers carry on from where
+// they were.
+func (h *History) Purge() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	removed := h.n
+	h.n = 0
+	return removed
+}
+
+// applyRetention prunes history according to the retention policy. Each
+// room's history is a shard: the janitor takes a batch from every shard
+// in turn until none has anything left to prune, pausing between batches
+// to stay within the retention rate.
+func (cs *ChatServer) applyRetention() int {
+	start := cs.now()
+	var cutoff time.Time
+	if cs.retentionAge > 0 {
+		cutoff = start.Add(-cs.retentionAge)
+	}
+
+	n := 0
+	shards := cs.histories()
+	for len(shards) > 0 {
+		pending := shards[:0]
+		for _, h := range shards {
+			removed := h.Prune(cutoff, cs.retentionCount, retentionBatchSize)
+			if removed == 0 {
+				metrics.Add(metricRetentionShards, 1)
+				continue
+			}
+			n += removed
+			metrics.Add(metricRetentionPruned, int64(removed))
+			if removed == retentionBatchSize {
+				pending = append(pending, h)
+			}
+			if cs.retentionRate > 0 {
+				time.Sleep(time.Second * time.Duration(removed) / time.Duration(cs.retentionRate))
+			}
+		}
+		shards = pending
+	}
+
+	retentionLagMs.Set(cs.retentionLag(cutoff).Milliseconds())
+	metrics.Add(metricRetentionSweeps, 1)
+	return n
+}
+
+// retentionLag returns how far the oldest stored message is past cutoff,
+// which stays above zero while the janitor is behind
+func (cs *ChatServer) retentionLag(cutoff time.Time) time.Duration {
+	if cutoff.IsZero() {
+		return 0
+	}
+	var lag time.Duration
+	for _, h := range cs.histories() {
+		if ts, ok := h.oldest(); ok {
+			lag = max(lag, cutoff.Sub(time.UnixMilli(ts)))
+		}
+	}
+	return lag
+}
+
+// runJanitor applies the retention policy periodically until ctx is
+// cancelled
+func (cs *ChatServer) runJanitor(ctx context.Context) {
+	ticker := time.NewTicker(retentionSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		start := time.Now()
+		if n := cs.applyRetention(); n > 0 {
+			log.Printf("Retention pruned %d messages in %v", n, time.Since(start).Round(time.Millisecond))
+		}
+	}
+}
+
+// handleAdminPurge serves POST /admin/purge, deleting all stored history
+func (cs *ChatServer) handleAdminPurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n := 0
+	for _, h := range cs.histories() {
+		n += h.Purge()
+	}
+	log.Printf("Purged %d messages from history", n)
+	cs.audit(AuditPurge, adminActor(r), "history", r.URL.Query().Get("reason"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"purged": n})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHistory_Prune(t *testing.T) {
+	h := NewHistory(10)
+	now := time.Now()
+	for i := 0; i < 6; i++ {
+		// Two old messages followed by four recent ones
+		ts := now
+		if i < 2 {
+			ts = now.Add(-time.Hour)
+		}
+		h.Append(Message{Content: "m", Timestamp: ts.UnixMilli()})
+	}
+
+	if n := h.Prune(now.Add(-time.Minute), 0, 0); n != 2 {
+		t.Errorf("Expected 2 messages pruned by age, got %d", n)
+	}
+	if n := h.Prune(time.Time{}, 3, 0); n != 1 {
+		t.Errorf("Expected 1 message pruned by count, got %d", n)
+	}
+	page := h.Before(0, 10)
+	if len(page.Messages) != 3 || page.Messages[0].Seq != 4 || page.HasMore {
+		t.Errorf("Unexpected history after pruning: %+v", page)
+	}
+
+	if n := h.Purge(); n != 3 {
+		t.Errorf("Expected 3 messages purged, got %d", n)
+	}
+	if msg := h.Append(Message{Content: "after"}); msg.Seq != 7 {
+		t.Errorf("Expected sequence to continue after purge, got %d", msg.Seq)
+	}
+}
+
+func TestAdmin_Purge(t *testing.T) {
+	server := NewChatServer(WithAdminToken("secret"))
+	server.history.Append(Message{Content: "secret plans"})
+	s := newAdminTestServer(t, server)
+
+	resp := adminRequest(t, context.Background(), http.MethodPost, s.URL+"/admin/purge", "secret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	if page := server.history.Before(0, 10); len(page.Messages) != 0 {
+		t.Errorf("Expected empty history after purge, got %+v", page)
+	}
+	if page := server.auditLog.Before(0, 10); page.Entries[len(page.Entries)-1].Action != AuditPurge {
+		t.Errorf("Expected purge to be audited, got %+v", page.Entries)
+	}
+}
+
+func TestApplyRetention_Sharded(t *testing.T) {
+	server := NewChatServer(WithHistorySize(2000), WithRetention(time.Minute, 0), WithRetentionRate(0))
+	room, _, err := server.createRoom(RoomOptions{Name: "ops"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour).UnixMilli()
+	// The lobby needs several batches; the room just one
+	for range retentionBatchSize*2 + 10 {
+		server.history.Append(Message{Content: "old", Timestamp: old})
+	}
+	for range 3 {
+		room.history.Append(Message{Content: "old", Timestamp: old})
+	}
+	room.history.Append(Message{Content: "new", Timestamp: time.Now().UnixMilli()})
+
+	if n := room.history.Prune(time.Now().Add(-time.Minute), 0, 2); n != 2 {
+		t.Errorf("Expected the limit to cap pruning at 2, got %d", n)
+	}
+	pruned := metricValue(metricRetentionPruned)
+	if n := server.applyRetention(); n != retentionBatchSize*2+11 {
+		t.Errorf("Expected every old message to be pruned, got %d", n)
+	}
+	if got := metricValue(metricRetentionPruned) - pruned; got != retentionBatchSize*2+11 {
+		t.Errorf("Expected pruning progress to be counted, got %d", got)
+	}
+	if page := room.history.Before(0, 10); len(page.Messages) != 1 || page.Messages[0].Content != "new" {
+		t.Errorf("Expected only the new message to remain, got %+v", page.Messages)
+	}
+	if lag := retentionLagMs.Value(); lag != 0 {
+		t.Errorf("Expected no retention lag after a full sweep, got %dms", lag)
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+const (
+	// lobbyRoom names the default room clients join without ?room=
+	lobbyRoom = "lobby"
+
+	maxRoomNameLength      = 50
+	maxRoomTopicLength     = 200
+	maxRooms               = 1000
+	defaultRoomIdleTimeout = time.Minute * 5
+
+	// anonymousRooms is how many rooms one address may create without
+	// logging in per anonymousRoomWindow
+	anonymousRooms      = 5
+	anonymousRoomWindow = time.Hour
+)
+
+var (
+	errRoomNotFound  = errors.New("room not found")
+	errRoomForbidden = errors.New("wrong room password")
+	errRoomFull      = errors.New("room is full")
+	errRoomInvite    = errors.New("room requires a valid invite")
+)
+
+// Room is a chat room created through the rooms API. Clients that don't
+// ask for a room share the lobby, which isn't represented by a Room.
+// Rooms live on the instance they were created on.
+type Room struct {
+	Name       string
+	Topic      string
+	Private    bool
+	MaxMembers int
+	Ephemeral  bool
+	InviteOnly bool
+	// Encrypted rooms relay ciphertext from end-to-end encrypting clients
+	// instead of plaintext. It can't be changed once the room exists.
+	Encrypted bool
+	Created   time.Time
+
+	// id tells the room apart from others created under its name
+	id       string
+	salt     []byte
+	password []byte
+	ownerKey []byte
+	history  *History
+
+	// Topic and pins are guarded by ChatServer.roomsMtx once the room is
+	// registered
+	pins []Message
+
+	// invites is guarded by ChatServer.roomsMtx
+	invites map[string]*Invite
+
+	// reads holds each user's read marker, guarded by ChatServer.roomsMtx
+	reads map[string]ReadMarker
+
+	// polls tracks votes by poll ID, guarded by ChatServer.roomsMtx
+	polls map[string]*pollState
+
+	// integrations is guarded by ChatServer.roomsMtx
+	integrations map[string]*Integration
+
+	// acl is guarded by ChatServer.roomsMtx
+	acl RoomACL
+
+	// slowMode is the interval between one user's messages, and
+	// lastPosted when each user last posted, guarded by ChatServer.roomsMtx
+	slowMode   time.Duration
+	lastPosted map[string]time.Time
+
+	// traffic counts the payload bytes of the room's connections
+	traffic trafficCounter
+
+	// members and idle are guarded by ChatServer.roomsMtx
+	members int
+	idle    *time.Timer
+}
+
+// RoomOptions is the body of a POST /rooms request
+type RoomOptions struct {
+	Name       string `json:"name"`
+	Topic      string `json:"topic,omitempty"`
+	Private    bool   `json:"private,omitempty"`
+	Password   string `json:"password,omitempty"`
+	MaxMembers int    `json:"max_members,omitempty"`
+	Ephemeral  bool   `json:"ephemeral,omitempty"`
+	InviteOnly bool   `json:"invite_only,omitempty"`
+	Encrypted  bool   `json:"encrypted,omitempty"`
+	// ACL restricts who may post, invite and moderate
+	ACL *RoomACL `json:"acl,omitempty"`
+}
+
+// RoomInfo describes a room in the rooms API
+type RoomInfo struct {
+	Name        string    `json:"name"`
+	Topic       string    `json:"topic,omitempty"`
+	Private     bool      `json:"private,omitempty"`
+	HasPassword bool      `json:"has_password"`
+	Members     int       `json:"members"`
+	MaxMembers  int       `json:"max_members,omitempty"`
+	Ephemeral   bool      `json:"ephemeral,omitempty"`
+	InviteOnly  bool      `json:"invite_only,omitempty"`
+	Encrypted   bool      `json:"encrypted,omitempty"`
+	Created     time.Time `json:"created,omitzero"`
+
+	// OwnerKey authorizes managing the room's invites. It is only returned
+	// when the room is created.
+	OwnerKey string `json:"owner_key,omitempty"`
+}
+
+// WithRoomIdleTimeout sets how long an ephemeral room may stay empty
+// before it is deleted
+func WithRoomIdleTimeout(d time.Duration) Option {
+	return func(cs *ChatServer) {
+		cs.roomIdleTimeout = d
+	}
+}
+
+// Validate checks the options of a room to be created
+func (o *RoomOptions) Validate() error {
+	if o.Name == "" || o.Name == lobbyRoom {
+		return errors.New("room name is required and may not be " + lobbyRoom)
+	}
+	if len(o.Name) > maxRoomNameLength || !validUsernameRegex.MatchString(o.Name) {
+		return errors.New("invalid room name (letters, numbers, underscore and hyphen, at most 50 characters)")
+	}
+	if len(o.Topic) > maxRoomTopicLength {
+		return errors.New("room topic too long (max 200 characters)")
+	}
+	if o.MaxMembers < 0 {
+		return errors.New("max_members may not be negative")
+	}
+	if o.ACL != nil {
+		return o.ACL.Validate()
+	}
+	return nil
+}
+
+// hashRoomPassword hashes a room password with the room's salt
+func hashRoomPassword(salt []byte, password string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
+
+// restricted reports whether joining the room takes more than its name:
+// it is private, password-protected or invite-only
+func (r *Room) restricted() bool {
+	return r.Private || r.InviteOnly || r.password != nil
+}
+
+// admits reports whether password opens the room
+func (r *Room) admits(password string) bool {
+	if r.password == nil {
+		return true
+	}
+	return subtle.ConstantTimeCompare(hashRoomPassword(r.salt, password), r.password) == 1
+}
+
+// info describes the room; callers hold ChatServer.roomsMtx
+func (r *Room) info() RoomInfo {
+	return RoomInfo{
+		Name:        r.Name,
+		Topic:       r.Topic,
+		Private:     r.Private,
+		HasPassword: r.password != nil,
+		Members:     r.members,
+		MaxMembers:  r.MaxMembers,
+		Ephemeral:   r.Ephemeral,
+		InviteOnly:  r.InviteOnly,
+		Encrypted:   r.Encrypted,
+		Created:     r.Created,
+	}
+}
+
+// roomName returns the name of the room the client is in
+func (c *Client) roomName() string {
+	if c.room == nil {
+		return ""
+	}
+	return c.room.Name
+}
+
+// createRoom registers a new room, returning it with the key that lets its
+// creator manage invites
+func (cs *ChatServer) createRoom(opts RoomOptions) (*Room, string, error) {
+	if opts.Encrypted && !cs.featureEnabled(featureE2EE) {
+		return nil, "", errFeatureDisabled
+	}
+	room := &Room{
+		Name:       opts.Name,
+		Topic:      opts.Topic,
+		Private:    opts.Private || opts.InviteOnly,
+		MaxMembers: opts.MaxMembers,
+		Ephemeral:  opts.Ephemeral,
+		InviteOnly: opts.InviteOnly,
+		Encrypted:  opts.Encrypted,
+		Created:    cs.now(),
+		id:         newMessageID(),
+		salt:       make([]byte, 16),
+		history:    NewHistory(cs.history.size),
+		invites:    make(map[string]*Invite),
+	}
+	rand.Read(room.salt)
+	if opts.ACL != nil {
+		room.acl = *opts.ACL
+	}
+	room.history.signer = cs.signingKey
+	if opts.Password != "" {
+		room.password = hashRoomPassword(room.salt, opts.Password)
+	}
+	ownerKey := newMessageID()
+	room.ownerKey = hashRoomPassword(room.salt, ownerKey)
+
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	if _, exists := cs.rooms[room.Name]; exists {
+		return nil, "", errors.New("room already exists")
+	}
+	if len(cs.rooms) >= maxRooms {
+		return nil, "", errors.New("too many rooms")
+	}
+	cs.rooms[room.Name] = room
+	// An ephemeral room nobody joins goes away like one everybody left
+	cs.armIdleLocked(room)
+	return room, ownerKey, nil
+}
+
+// lookupRoom returns the named room, or nil for the lobby or an unknown room
+func (cs *ChatServer) lookupRoom(name string) *Room {
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	return cs.rooms[name]
+}
+
+// enterRoom admits a client to the named room, counting it as a member. The
+// lobby, named by "" or lobbyRoom, returns nil and admits everyone. Joining
+// an invite-only room redeems the invite, even if the connection then
+// fails to upgrade.
+func (cs *ChatServer) enterRoom(name, password, invite string) (*Room, error) {
+	if name == "" || name == lobbyRoom {
+		return nil, nil
+	}
+
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	room, ok := cs.rooms[name]
+	if !ok {
+		return nil, errRoomNotFound
+	}
+	if !room.admits(password) {
+		return nil, errRoomForbidden
+	}
+	if room.MaxMembers > 0 && room.members >= room.MaxMembers {
+		return nil, errRoomFull
+	}
+	if room.InviteOnly && !room.redeemLocked(invite, cs.now()) {
+		return nil, errRoomInvite
+	}
+	seatLocked(room)
+	return room, nil
+}
+
+// seatLocked counts a new member of room, keeping it from being deleted
+// while it is in use
+func seatLocked(room *Room) {
+	room.members++
+	if room.idle != nil {
+		room.idle.Stop()
+		room.idle = nil
+	}
+}
+
+// leaveRoom gives up a membership taken by enterRoom
+func (cs *ChatServer) leaveRoom(room *Room) {
+	if room == nil {
+		return
+	}
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	room.members--
+	cs.armIdleLocked(room)
+}
+
+// armIdleLocked schedules deletion of an empty ephemeral room
+func (cs *ChatServer) armIdleLocked(room *Room) {
+	if !room.Ephemeral || room.members > 0 || room.idle != nil {
+		return
+	}
+	room.idle = time.AfterFunc(cs.roomIdleTimeout, func() {
+		cs.roomsMtx.Lock()
+		if room.members > 0 || cs.rooms[room.Name] != room {
+			cs.roomsMtx.Unlock()
+			return
+		}
+		delete(cs.rooms, room.Name)
+		cs.roomsMtx.Unlock()
+		log.Printf("Deleted idle room %s", room.Name)
+		if err := cs.memberships.forget(room); err != nil {
+			log.Printf("Error forgetting members of %s: %v", room.Name, err)
+		}
+	})
+}
+
+// histories returns the history of the lobby followed by every room's
+func (cs *ChatServer) histories() []*History {
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	hs := make([]*History, 0, len(cs.rooms)+1)
+	hs = append(hs, cs.history)
+	for _, room := range cs.rooms {
+		hs = append(hs, room.history)
+	}
+	return hs
+}
+
+// roomHistory returns the history of the named room for a reader who knows
+// its password. Invite-only rooms only share history with members.
+func (cs *ChatServer) roomHistory(name, password string) (*History, error) {
+	room, err := cs.readableRoom(name, password)
+	if err != nil {
+		return nil, err
+	}
+	if room == nil {
+		return cs.history, nil
+	}
+	return room.history, nil
+}
+
+// readableRoom returns the named room for a reader outside it who knows its
+// password, or nil for the lobby. Invite-only rooms are never readable from
+// outside.
+func (cs *ChatServer) readableRoom(name, password string) (*Room, error) {
+	if name == "" || name == lobbyRoom {
+		return nil, nil
+	}
+	room := cs.lookupRoom(name)
+	if room == nil {
+		return nil, errRoomNotFound
+	}
+	if !room.admits(password) {
+		return nil, errRoomForbidden
+	}
+	if room.InviteOnly {
+		return nil, errRoomInvite
+	}
+	return room, nil
+}
+
+// roomStatus maps room errors to HTTP status codes
+func roomStatus(err error) int {
+	switch {
+	case errors.Is(err, errRoomNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errRoomForbidden), errors.Is(err, errRoomFull), errors.Is(err, errRoomInvite):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// listRooms describes the lobby and every public room
+func (cs *ChatServer) listRooms() []RoomInfo {
+	lobby := RoomInfo{Name: lobbyRoom}
+	cs.clientsMtx.Lock()
+	for client := range cs.clients {
+		if client.room == nil && !client.canary {
+			lobby.Members++
+		}
+	}
+	cs.clientsMtx.Unlock()
+
+	cs.roomsMtx.Lock()
+	rooms := make([]RoomInfo, 0, len(cs.rooms))
+	for _, room := range cs.rooms {
+		if !room.Private {
+			rooms = append(rooms, room.info())
+		}
+	}
+	cs.roomsMtx.Unlock()
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return append([]RoomInfo{lobby}, rooms...)
+}
+
+// loggedIn reports whether a request carries the admin token or the token
+// of a user who isn't a guest
+func (cs *ChatServer) loggedIn(r *http.Request) bool {
+	token := requestToken(r)
+	if token == "" {
+		return false
+	}
+	if cs.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cs.adminToken)) == 1 {
+		return true
+	}
+	if cs.auth == nil {
+		return false
+	}
+	identity, err := cs.auth.Authenticate(r.Context(), token)
+	return err == nil && !identity.Guest
+}
+
+// countAnonymousRoom counts a room created from addr without logging in,
+// reporting false once the address has created its share for the window
+func (cs *ChatServer) countAnonymousRoom(addr netip.Addr, now time.Time) bool {
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	if cs.roomCreators == nil {
+		cs.roomCreators = make(map[netip.Addr][]time.Time)
+	}
+	if _, ok := cs.roomCreators[addr]; !ok && len(cs.roomCreators) >= spamHostLimit {
+		for a, times := range cs.roomCreators {
+			if now.Sub(times[len(times)-1]) >= anonymousRoomWindow {
+				delete(cs.roomCreators, a)
+			}
+		}
+		if len(cs.roomCreators) >= spamHostLimit {
+			return false
+		}
+	}
+	recent := cs.roomCreators[addr][:0]
+	for _, t := range cs.roomCreators[addr] {
+		if now.Sub(t) < anonymousRoomWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= anonymousRooms {
+		cs.roomCreators[addr] = recent
+		return false
+	}
+	cs.roomCreators[addr] = append(recent, now)
+	return true
+}
+
+// handleRooms serves GET /rooms, listing public rooms, and POST /rooms,
+// creating one
+func (cs *ChatServer) handleRooms(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cs.listRooms())
+
+	case http.MethodPost:
+		if cs.rejectBanned(w, r) {
+			return
+		}
+		var opts RoomOptions
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&opts); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := opts.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !cs.loggedIn(r) {
+			if addr, ok := remoteIP(r); ok && !cs.countAnonymousRoom(addr, cs.now()) {
+				http.Error(w, "too many rooms created from this address, log in to create more", http.StatusTooManyRequests)
+				return
+			}
+			// Nobody answers for the room, so it goes once it is empty
+			opts.Ephemeral = true
+		}
+		room, ownerKey, err := cs.createRoom(opts)
+		if errors.Is(err, errFeatureDisabled) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("Room %s created from %s", room.Name, r.RemoteAddr)
+
+		cs.roomsMtx.Lock()
+		info := room.info()
+		cs.roomsMtx.Unlock()
+		info.OwnerKey = ownerKey
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(info)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// newRoomsTestServer serves the chat endpoint and rooms API on one mux
+func newRoomsTestServer(t *testing.T, server *ChatServer) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", server.handleConnection)
+	mux.HandleFunc("/rooms", server.handleRooms)
+	mux.HandleFunc("/rooms/invites", server.handleRoomInvites)
+	mux.HandleFunc("/rooms/integrations", server.handleRoomIntegrations)
+	mux.HandleFunc("/rooms/slowmode", server.handleRoomSlowMode)
+	mux.HandleFunc("/api/history", server.handleHistory)
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// createTestRoom posts opts to /rooms and returns the response status
+func createTestRoom(t *testing.T, s *httptest.Server, opts RoomOptions) int {
+	t.Helper()
+	return createRoomAs(t, s, "", opts).StatusCode
+}
+
+// createRoomAs posts opts to /rooms with token, if any, as the bearer
+// token and returns the response, its body read into Info
+func createRoomAs(t *testing.T, s *httptest.Server, token string, opts RoomOptions) *roomResponse {
+	t.Helper()
+	body, _ := json.Marshal(opts)
+	req, _ := http.NewRequest(http.MethodPost, s.URL+"/rooms", bytes.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	defer resp.Body.Close()
+	out := &roomResponse{StatusCode: resp.StatusCode}
+	json.NewDecoder(resp.Body).Decode(&out.Info)
+	return out
+}
+
+// roomResponse is the answer to a POST /rooms
+type roomResponse struct {
+	StatusCode int
+	Info       RoomInfo
+}
+
+func TestRooms_CreateAndList(t *testing.T) {
+	server := NewChatServer()
+	s := newRoomsTestServer(t, server)
+
+	for opts, want := range map[RoomOptions]int{
+		{Name: "general", Topic: "anything goes"}:            http.StatusCreated,
+		{Name: "secret", Private: true, Password: "hunter2"}: http.StatusCreated,
+		{Name: "small", MaxMembers: 2}:                       http.StatusCreated,
+		{Name: "lobby"}:                                      http.StatusBadRequest,
+		{Name: "bad name"}:                                   http.StatusBadRequest,
+		{Name: "negative", MaxMembers: -1}:                   http.StatusBadRequest,
+	} {
+		if got := createTestRoom(t, s, opts); got != want {
+			t.Errorf("Creating %+v: expected %d, got %d", opts, want, got)
+		}
+	}
+	if got := createTestRoom(t, s, RoomOptions{Name: "general"}); got != http.StatusConflict {
+		t.Errorf("Expected 409 for a duplicate room, got %d", got)
+	}
+
+	resp, err := http.Get(s.URL + "/rooms")
+	if err != nil {
+		t.Fatalf("Failed to list rooms: %v", err)
+	}
+	defer resp.Body.Close()
+	var rooms []RoomInfo
+	if err := json.NewDecoder(resp.Body).Decode(&rooms); err != nil {
+		t.Fatalf("Failed to decode rooms: %v", err)
+	}
+	var names []string
+	for _, room := range rooms {
+		names = append(names, room.Name)
+	}
+	if strings.Join(names, ",") != "lobby,general,small" {
+		t.Errorf("Expected the lobby and public rooms, got %v", names)
+	}
+	if rooms[1].Topic != "anything goes" || rooms[2].MaxMembers != 2 {
+		t.Errorf("Unexpected room details: %+v", rooms)
+	}
+}
+
+func TestRooms_Join(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	s := newRoomsTestServer(t, server)
+	createTestRoom(t, s, RoomOptions{Name: "secret", Password: "hunter2", MaxMembers: 1})
+
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	for query, want := range map[string]int{
+		"?username=eve&room=nope":                    http.StatusNotFound,
+		"?username=eve&room=secret":                  http.StatusForbidden,
+		"?username=eve&room=secret&password=letmein": http.StatusForbidden,
+	} {
+		_, resp, err := websocket.Dial(ctx, wsURL+query, nil)
+		if err == nil || resp == nil || resp.StatusCode != want {
+			t.Errorf("Dialing %s: expected %d, got %v", query, want, resp)
+		}
+	}
+
+	v2 := &websocket.DialOptions{Subprotocols: []string{subprotocolV2}}
+	inRoom, _, err := websocket.Dial(ctx, wsURL+"?username=alice&room=secret&password=hunter2", v2)
+	if err != nil {
+		t.Fatalf("Failed to join room: %v", err)
+	}
+	defer inRoom.Close(websocket.StatusNormalClosure, "")
+	var msg Message
+	if err := wsjson.Read(ctx, inRoom, &msg); err != nil || msg.Room != "secret" {
+		t.Fatalf("Expected a join notice for the room, got %+v (%v)", msg, err)
+	}
+
+	_, resp, err := websocket.Dial(ctx, wsURL+"?username=bob&room=secret&password=hunter2", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a full room to refuse a second member, got %v", resp)
+	}
+
+	lobby, _, err := websocket.Dial(ctx, wsURL+"?username=carol", v2)
+	if err != nil {
+		t.Fatalf("Failed to join lobby: %v", err)
+	}
+	defer lobby.Close(websocket.StatusNormalClosure, "")
+	if err := wsjson.Read(ctx, lobby, &msg); err != nil {
+		t.Fatalf("Failed to read welcome message: %v", err)
+	}
+
+	// Messages stay in their room
+	if err := wsjson.Write(ctx, inRoom, Message{Type: "message", Content: "room only"}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if err := wsjson.Write(ctx, lobby, Message{Type: "message", Content: "lobby only"}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if err := wsjson.Read(ctx, inRoom, &msg); err != nil || msg.Content != "room only" || msg.Room != "secret" {
+		t.Errorf("Expected the room message, got %+v (%v)", msg, err)
+	}
+	msg = Message{}
+	if err := wsjson.Read(ctx, lobby, &msg); err != nil || msg.Content != "lobby only" || msg.Room != "" {
+		t.Errorf("Expected the lobby message, got %+v (%v)", msg, err)
+	}
+
+	// Room history needs the password
+	resp, err = http.Get(s.URL + "/api/history?room=secret")
+	if err != nil {
+		t.Fatalf("Failed to fetch history: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 without the password, got %d", resp.StatusCode)
+	}
+	resp, err = http.Get(s.URL + "/api/history?room=secret&password=hunter2")
+	if err != nil {
+		t.Fatalf("Failed to fetch history: %v", err)
+	}
+	defer resp.Body.Close()
+	var page HistoryPage
+	json.NewDecoder(resp.Body).Decode(&page)
+	if len(page.Messages) != 2 || page.Messages[1].Content != "room only" {
+		t.Errorf("Expected the join notice and room message, got %+v", page.Messages)
+	}
+}
+
+func TestRooms_EphemeralExpiry(t *testing.T) {
+	server := NewChatServer(WithRoomIdleTimeout(time.Millisecond*50), WithAdminToken("secret"))
+	server.Run(t.Context())
+	s := newRoomsTestServer(t, server)
+	createTestRoom(t, s, RoomOptions{Name: "pop-up", Ephemeral: true})
+	createRoomAs(t, s, "secret", RoomOptions{Name: "lasting"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"/ws?username=alice&room=pop-up", nil)
+	if err != nil {
+		t.Fatalf("Failed to join room: %v", err)
+	}
+
+	// Occupied rooms stay however long they are used
+	time.Sleep(time.Millisecond * 100)
+	if server.lookupRoom("pop-up") == nil {
+		t.Fatal("Expected an occupied ephemeral room to survive")
+	}
+
+	c.Close(websocket.StatusNormalClosure, "")
+	deadline := time.Now().Add(time.Second * 2)
+	for server.lookupRoom("pop-up") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the empty ephemeral room to be deleted")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if server.lookupRoom("lasting") == nil {
+		t.Error("Expected the permanent room to remain")
+	}
+}
+
+func TestRooms_AnonymousCreation(t *testing.T) {
+	server := NewChatServer(WithAdminToken("secret"), WithAuthenticator(tokenAuth{"alice-token": {Username: "alice"}}))
+	s := newRoomsTestServer(t, server)
+
+	// Rooms created without logging in go away once empty, and each
+	// address may only create a few
+	for i := range anonymousRooms {
+		if resp := createRoomAs(t, s, "", RoomOptions{Name: fmt.Sprintf("anon-%d", i)}); resp.StatusCode != http.StatusCreated || !resp.Info.Ephemeral {
+			t.Errorf("Expected an ephemeral room, got %d %+v", resp.StatusCode, resp.Info)
+		}
+	}
+	if resp := createRoomAs(t, s, "guess", RoomOptions{Name: "one-more"}); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 once the address created its share, got %d", resp.StatusCode)
+	}
+
+	for _, token := range []string{"alice-token", "secret"} {
+		if resp := createRoomAs(t, s, token, RoomOptions{Name: "by-" + token}); resp.StatusCode != http.StatusCreated || resp.Info.Ephemeral {
+			t.Errorf("Expected %s to create a lasting room, got %d %+v", token, resp.StatusCode, resp.Info)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+)
+
+// Rule matches messages as they are broadcast and acts on them. Empty match
+// fields match anything, except Type, which defaults to chat messages.
+type Rule struct {
+	Name string `json:"name"`
+
+	// Type is the message type to match, "message" if empty or "*" for
+	// every type
+	Type string `json:"type,omitempty"`
+	// Room is the room to match, "lobby" for the lobby
+	Room string `json:"room,omitempty"`
+	// Content is a regular expression the content must match
+	Content string `json:"content,omitempty"`
+	// Role is a role the sender must hold, for the whole server or the
+	// message's room
+	Role string `json:"role,omitempty"`
+
+	// RouteTo copies the message into another room
+	RouteTo string `json:"route_to,omitempty"`
+	// Tags are added to the message
+	Tags []string `json:"tags,omitempty"`
+	// Webhook receives the message, signed with WebhookSecret like a
+	// room's webhook integrations
+	Webhook       string `json:"webhook,omitempty"`
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+	// Drop stops the message from being delivered, after routing it and
+	// calling the webhook, and ends rule evaluation
+	Drop bool `json:"drop,omitempty"`
+
+	content *regexp.Regexp
+}
+
+// LoadRules reads a JSON array of rules, evaluated in order
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading rules: %w", err)
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing rules %s: %w", path, err)
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %w", i+1, rules[i].Name, err)
+		}
+	}
+	return rules, nil
+}
+
+// compile checks the rule and prepares its content pattern
+func (r *Rule) compile() error {
+	if r.RouteTo == "" && len(r.Tags) == 0 && r.Webhook == "" && !r.Drop {
+		return errors.New("no action")
+	}
+	if r.Webhook != "" {
+		u, err := url.Parse(r.Webhook)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errors.New("webhook needs an http(s) url")
+		}
+	}
+	if len(r.Tags) > maxTags {
+		return fmt.Errorf("more than %d tags", maxTags)
+	}
+	if r.Content != "" {
+		re, err := regexp.Compile(r.Content)
+		if err != nil {
+			return err
+		}
+		r.content = re
+	}
+	return nil
+}
+
+// WithRules evaluates rules on every message broadcast by this instance.
+// Invalid rules are logged and left out.
+func WithRules(rules []Rule) Option {
+	return func(cs *ChatServer) {
+		cs.rules = nil
+		for _, rule := range rules {
+			if err := rule.compile(); err != nil {
+				log.Printf("Ignoring rule %s: %v", rule.Name, err)
+				continue
+			}
+			cs.rules = append(cs.rules, rule)
+		}
+	}
+}
+
+// matches reports whether the rule applies to msg from a sender holding
+// roles
+func (r *Rule) matches(msg Message, roles []string) bool {
+	switch r.Type {
+	case "*":
+	case "":
+		if msg.Type != "message" {
+			return false
+		}
+	default:
+		if msg.Type != r.Type {
+			return false
+		}
+	}
+	if r.Room != "" && r.Room != roomOrLobby(msg.Room) {
+		return false
+	}
+	if r.content != nil && !r.content.MatchString(msg.Content) {
+		return false
+	}
+	if r.Role != "" && !slices.Contains(roles, r.Role) && !slices.Contains(roles, r.Role+":"+roomOrLobby(msg.Room)) {
+		return false
+	}
+	return true
+}
+
+// rolesOf returns the roles of the user connected here under username
+func (cs *ChatServer) rolesOf(username string) []string {
+	cs.clientsMtx.Lock()
+	defer cs.clientsMtx.Unlock()
+	if client, ok := cs.usernames[username]; ok {
+		return client.roles
+	}
+	return nil
+}
+
+// applyRules runs the rules on a message about to be broadcast, and
+// reports whether it should still be delivered. Copies routed to other
+// rooms aren't evaluated again.
+func (cs *ChatServer) applyRules(msg *Message) bool {
+	if len(cs.rules) == 0 || msg.RoutedFrom != "" {
+		return true
+	}
+	var roles []string
+	if slices.ContainsFunc(cs.rules, func(r Rule) bool { return r.Role != "" }) {
+		roles = cs.rolesOf(msg.Username)
+	}
+	for i := range cs.rules {
+		rule := &cs.rules[i]
+		if !rule.matches(*msg, roles) {
+			continue
+		}
+		metrics.Add(metricRulesMatched, 1)
+		for _, tag := range rule.Tags {
+			if !slices.Contains(msg.Tags, tag) && len(msg.Tags) < maxTags {
+				msg.Tags = append(msg.Tags, tag)
+			}
+		}
+		if rule.RouteTo != "" {
+			cs.route(*msg, rule)
+		}
+		if rule.Webhook != "" {
+			go postWebhooks(&http.Client{Timeout: webhookTimeout}, []Integration{{ID: rule.Name, URL: rule.Webhook, Secret: rule.WebhookSecret}}, *msg)
+		}
+		if rule.Drop {
+			log.Printf("Rule %s dropped a %s from %s (trace %s)", rule.Name, msg.Type, msg.Username, msg.Trace)
+			return false
+		}
+	}
+	return true
+}
+
+// route copies msg into the room a rule names
+func (cs *ChatServer) route(msg Message, rule *Rule) {
+	target := rule.RouteTo
+	if target == lobbyRoom {
+		target = ""
+	}
+	if target == msg.Room {
+		return
+	}
+	if target != "" && cs.lookupRoom(target) == nil {
+		log.Printf("Rule %s routes to missing room %s (trace %s)", rule.Name, target, msg.Trace)
+		return
+	}
+	msg.RoutedFrom = roomOrLobby(msg.Room)
+	msg.Room = target
+	msg.ID, msg.Seq = "", 0
+	// The hub is the one draining the queue, so it mustn't wait on it
+	go cs.publish(msg)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestLoadRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	os.WriteFile(path, []byte(`[{"name": "alerts", "content": "^ALERT", "tags": ["alert"]}]`), 0o644)
+	rules, err := LoadRules(path)
+	if err != nil {
+		t.Fatalf("Failed to load rules: %v", err)
+	}
+	if !rules[0].matches(Message{Type: "message", Content: "ALERT: disk full"}, nil) {
+		t.Errorf("Expected the rule to match an alert")
+	}
+	if rules[0].matches(Message{Type: "system", Content: "ALERT: disk full"}, nil) {
+		t.Errorf("Expected the rule to only match chat messages")
+	}
+
+	for _, bad := range []string{
+		`[{"name": "idle", "content": "x"}]`,
+		`[{"name": "bad", "content": "(", "drop": true}]`,
+		`[{"name": "hook", "webhook": "ftp://example.com"}]`,
+	} {
+		os.WriteFile(path, []byte(bad), 0o644)
+		if _, err := LoadRules(path); err == nil {
+			t.Errorf("Expected %s to be refused", bad)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	hooked := make(chan Message, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var msg Message
+		json.Unmarshal(body, &msg)
+		hooked <- msg
+	}))
+	defer hook.Close()
+
+	server := NewChatServer(WithRules([]Rule{
+		{Name: "alerts", Content: "^ALERT", Tags: []string{"alert"}, RouteTo: "ops", Webhook: hook.URL},
+		{Name: "quiet", Content: "(?i)spoiler", Drop: true},
+		{Name: "staff", Role: roleModerator, Tags: []string{"staff"}},
+	}))
+	server.Run(t.Context())
+	if _, _, err := server.createRoom(RoomOptions{Name: "ops"}); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+	ops, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username=oncall&room=ops",
+		&websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer ops.CloseNow()
+
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "ALERT: disk full"})
+	if msg := readUntilType(t, ctx, alice, "message"); !slices.Equal(msg.Tags, []string{"alert"}) {
+		t.Errorf("Expected the alert tagged in the lobby, got %+v", msg)
+	}
+	if msg := readUntilType(t, ctx, ops, "message"); msg.Content != "ALERT: disk full" || msg.RoutedFrom != lobbyRoom || msg.Room != "ops" {
+		t.Errorf("Expected the alert routed to ops, got %+v", msg)
+	}
+	select {
+	case msg := <-hooked:
+		if msg.Content != "ALERT: disk full" {
+			t.Errorf("Expected the alert posted to the webhook, got %+v", msg)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Timed out waiting for the webhook")
+	}
+
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "Spoiler: it was the butler"})
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "nothing to see"})
+	if msg := readUntilType(t, ctx, alice, "message"); msg.Content != "nothing to see" || len(msg.Tags) != 0 {
+		t.Errorf("Expected the spoiler dropped and an untagged message, got %+v", msg)
+	}
+}
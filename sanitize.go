@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	nethtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// ContentSanitizer says what is done to HTML in user-written content
+type ContentSanitizer int
+
+const (
+	// SanitizeNone leaves content as the sender wrote it
+	SanitizeNone ContentSanitizer = iota
+	// SanitizeEscape escapes <, >, &, ' and ", so markup shows as text
+	SanitizeEscape
+	// SanitizeStrip removes tags, comments and script and style contents,
+	// keeping the text around them
+	SanitizeStrip
+)
+
+// WithContentSanitizer escapes or strips HTML in the content of chat
+// messages and polls before they are delivered, stored or relayed, so
+// clients that insert content into a page as HTML can't be scripted
+func WithContentSanitizer(mode ContentSanitizer) Option {
+	return func(cs *ChatServer) {
+		cs.sanitizer = mode
+	}
+}
+
+// parseSanitizeMode maps a flag value to a content sanitizer
+func parseSanitizeMode(s string) (ContentSanitizer, error) {
+	switch s {
+	case "none", "off", "":
+		return SanitizeNone, nil
+	case "escape":
+		return SanitizeEscape, nil
+	case "strip":
+		return SanitizeStrip, nil
+	default:
+		return 0, fmt.Errorf("unknown sanitize mode %q (want none, escape or strip)", s)
+	}
+}
+
+// apply returns s sanitized by mode
+func (mode ContentSanitizer) apply(s string) string {
+	switch mode {
+	case SanitizeEscape:
+		return html.EscapeString(s)
+	case SanitizeStrip:
+		return stripHTML(s)
+	default:
+		return s
+	}
+}
+
+// sanitizeMessage sanitizes the user-written text of a chat message or
+// poll. Encrypted messages are left alone; the server can't read them.
+func (cs *ChatServer) sanitizeMessage(msg *Message) {
+	if cs.sanitizer == SanitizeNone || msg.Ciphertext != "" {
+		return
+	}
+	if msg.Type != "message" && msg.Type != "poll" {
+		return
+	}
+	msg.Content = cs.sanitizer.apply(msg.Content)
+	if msg.Poll != nil {
+		options := make([]string, len(msg.Poll.Options))
+		for i, o := range msg.Poll.Options {
+			options[i] = cs.sanitizer.apply(o)
+		}
+		poll := *msg.Poll
+		poll.Options = options
+		msg.Poll = &poll
+	}
+}
+
+// stripHTML drops tags, comments and doctypes from s. Text keeps its
+// original form, entities included, so stripping never decodes &lt; into
+// a tag; a bare < or > left over is escaped.
+func stripHTML(s string) string {
+	var b strings.Builder
+	z := nethtml.NewTokenizer(strings.NewReader(s))
+	skip := 0
+	for {
+		tt := z.Next()
+		if tt == nethtml.ErrorToken {
+			break
+		}
+		switch tt {
+		case nethtml.TextToken:
+			if skip == 0 {
+				text := string(z.Raw())
+				text = strings.ReplaceAll(text, "<", "&lt;")
+				text = strings.ReplaceAll(text, ">", "&gt;")
+				b.WriteString(text)
+			}
+		case nethtml.StartTagToken, nethtml.EndTagToken:
+			name, _ := z.TagName()
+			switch atom.Lookup(name) {
+			case atom.Script, atom.Style, atom.Iframe, atom.Noscript, atom.Textarea, atom.Title, atom.Xmp, atom.Noembed, atom.Noframes, atom.Plaintext:
+				if tt == nethtml.StartTagToken {
+					skip++
+				} else if skip > 0 {
+					skip--
+				}
+			}
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestContentSanitizer(t *testing.T) {
+	tests := []struct {
+		mode ContentSanitizer
+		in   string
+		want string
+	}{
+		{SanitizeNone, "<b>hi</b>", "<b>hi</b>"},
+		{SanitizeEscape, `<img src=x onerror="alert(1)">`, "&lt;img src=x onerror=&#34;alert(1)&#34;&gt;"},
+		{SanitizeEscape, "fish & chips", "fish &amp; chips"},
+		{SanitizeStrip, "<b>bold</b> move", "bold move"},
+		{SanitizeStrip, "hi<script>alert(1)</script> there", "hi there"},
+		{SanitizeStrip, `<img src=x onerror="alert(1)">`, ""},
+		{SanitizeStrip, "<style>p{}</style><!-- c -->text", "text"},
+		{SanitizeStrip, "&lt;script&gt; stays escaped", "&lt;script&gt; stays escaped"},
+		{SanitizeStrip, "1 < 2 > 0", "1 &lt; 2 &gt; 0"},
+	}
+	for _, tt := range tests {
+		if got := tt.mode.apply(tt.in); got != tt.want {
+			t.Errorf("Expected %q to become %q, got %q", tt.in, tt.want, got)
+		}
+	}
+}
+
+func TestParseSanitizeMode(t *testing.T) {
+	if mode, err := parseSanitizeMode("strip"); err != nil || mode != SanitizeStrip {
+		t.Errorf("Expected strip, got %v, %v", mode, err)
+	}
+	if _, err := parseSanitizeMode("scrub"); err == nil {
+		t.Errorf("Expected an unknown mode to be rejected")
+	}
+}
+
+func TestSanitizedMessages(t *testing.T) {
+	server := NewChatServer(WithContentSanitizer(SanitizeEscape))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+	bob := dialStatusTest(t, ctx, s, "bob")
+
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "<script>alert(1)</script>"})
+	msg := readUntilType(t, ctx, bob, "message")
+	if msg.Content != "&lt;script&gt;alert(1)&lt;/script&gt;" {
+		t.Errorf("Expected escaped content, got %q", msg.Content)
+	}
+	if stored, _ := server.history.Find(msg.ID); stored.Content != msg.Content {
+		t.Errorf("Expected history to hold the escaped content, got %q", stored.Content)
+	}
+
+	wsjson.Write(ctx, alice, Message{Type: "poll", Content: "<i>Lunch</i>?", Poll: &Poll{Options: []string{"<b>pizza</b>", "sushi"}}})
+	poll := readUntilType(t, ctx, bob, "poll")
+	if poll.Content != "&lt;i&gt;Lunch&lt;/i&gt;?" || poll.Poll.Options[0] != "&lt;b&gt;pizza&lt;/b&gt;" {
+		t.Errorf("Expected the poll question and options escaped, got %q %q", poll.Content, poll.Poll.Options)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxScheduleAhead is how far in the future a message may be scheduled
+	maxScheduleAhead = 30 * 24 * time.Hour
+	// maxScheduledPerUser caps the messages one user may have pending
+	maxScheduledPerUser = 25
+	// scheduleIdleCheck is how often the scheduler looks for work while
+	// nothing is pending
+	scheduleIdleCheck = time.Hour
+)
+
+// ScheduledMessage is a message waiting for its delivery time
+type ScheduledMessage struct {
+	ID        string    `json:"id"`
+	DeliverAt time.Time `json:"deliver_at"`
+	Created   time.Time `json:"created"`
+	Message   Message   `json:"message"`
+}
+
+// Schedule holds messages waiting for delivery, optionally persisted to a
+// JSON file so they survive restarts
+type Schedule struct {
+	mu      sync.Mutex
+	pending map[string]ScheduledMessage
+	path    string
+	// wake tells the scheduler the earliest delivery time may have changed
+	wake chan struct{}
+}
+
+// NewSchedule creates a schedule persisted to path, loading any messages
+// already pending there. An empty path keeps the schedule in memory only.
+func NewSchedule(path string) (*Schedule, error) {
+	s := newSchedule(path)
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading schedule: %w", err)
+	}
+	var entries []ScheduledMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parsing schedule %s: %w", path, err)
+	}
+	for _, e := range entries {
+		s.pending[e.ID] = e
+	}
+	return s, nil
+}
+
+func newSchedule(path string) *Schedule {
+	return &Schedule{
+		pending: make(map[string]ScheduledMessage),
+		path:    path,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// WithSchedule keeps scheduled messages in s instead of the default empty
+// in-memory schedule
+func WithSchedule(s *Schedule) Option {
+	return func(cs *ChatServer) {
+		cs.scheduled = s
+	}
+}
+
+// Add stores a scheduled message. It stays scheduled in memory even if it
+// couldn't be persisted.
+func (s *Schedule) Add(e ScheduledMessage) error {
+	s.mu.Lock()
+	s.pending[e.ID] = e
+	err := s.saveLocked()
+	s.mu.Unlock()
+	s.notify()
+	return err
+}
+
+// Cancel removes a pending message, returning it if there was one
+func (s *Schedule) Cancel(id string) (ScheduledMessage, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.pending[id]
+	if !ok {
+		return ScheduledMessage{}, false, nil
+	}
+	delete(s.pending, id)
+	return e, true, s.saveLocked()
+}
+
+// List returns the pending messages by delivery time, only those of
+// username unless it is empty
+func (s *Schedule) List(username string) []ScheduledMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]ScheduledMessage, 0, len(s.pending))
+	for _, e := range s.pending {
+		if username == "" || e.Message.Username == username {
+			list = append(list, e)
+		}
+	}
+	sortSchedule(list)
+	return list
+}
+
+// count returns how many messages username has pending
+func (s *Schedule) count(username string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, e := range s.pending {
+		if e.Message.Username == username {
+			n++
+		}
+	}
+	return n
+}
+
+// due returns the messages to deliver by now, in delivery order, and the
+// delivery time of the next one after that (zero if there is none)
+func (s *Schedule) due(now time.Time) ([]ScheduledMessage, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []ScheduledMessage
+	var next time.Time
+	for _, e := range s.pending {
+		if !e.DeliverAt.After(now) {
+			due = append(due, e)
+		} else if next.IsZero() || e.DeliverAt.Before(next) {
+			next = e.DeliverAt
+		}
+	}
+	sortSchedule(due)
+	return due, next
+}
+
+// notify wakes the scheduler without blocking
+func (s *Schedule) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sortSchedule orders messages by delivery time, then by ID
+func sortSchedule(list []ScheduledMessage) {
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].DeliverAt.Equal(list[j].DeliverAt) {
+			return list[i].DeliverAt.Before(list[j].DeliverAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+}
+
+// saveLocked writes the pending messages to disk
+func (s *Schedule) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	entries := make([]ScheduledMessage, 0, len(s.pending))
+	for _, e := range s.pending {
+		entries = append(entries, e)
+	}
+	sortSchedule(entries)
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write then rename so a crash never leaves a truncated schedule
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".schedule-*")
+	if err != nil {
+		return fmt.Errorf("saving schedule: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("saving schedule: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("saving schedule: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("saving schedule: %w", err)
+	}
+	return nil
+}
+
+// scheduleMessage validates msg, already stamped with its sender and room,
+// and stores it for delivery at its deliver_at time. Clients are held to
+// maxScheduledPerUser pending messages; the admin API isn't.
+func (cs *ChatServer) scheduleMessage(msg Message, room *Room, fromClient bool, now time.Time) (ScheduledMessage, error) {
+	deliverAt, err := time.Parse(time.RFC3339, msg.DeliverAt)
+	if err != nil {
+		return ScheduledMessage{}, protocolErrorf(codeInvalidSchedule, "deliver_at must be an RFC 3339 time")
+	}
+	if !deliverAt.After(now) {
+		return ScheduledMessage{}, protocolErrorf(codeInvalidSchedule, "deliver_at must be in the future")
+	}
+	if deliverAt.Sub(now) > maxScheduleAhead {
+		return ScheduledMessage{}, protocolErrorf(codeInvalidSchedule, "deliver_at is more than %d days away", maxScheduleAhead/(24*time.Hour))
+	}
+	if msg.Type != "message" && (msg.Type != "system" || fromClient) {
+		return ScheduledMessage{}, protocolErrorf(codeInvalidSchedule, "only chat messages can be scheduled")
+	}
+	if err := msg.validateIn(room, cs.messageLimit); err != nil {
+		return ScheduledMessage{}, err
+	}
+	if fromClient && cs.scheduled.count(msg.Username) >= maxScheduledPerUser {
+		return ScheduledMessage{}, protocolErrorf(codeInvalidSchedule, "too many scheduled messages (max %d)", maxScheduledPerUser)
+	}
+
+	msg.DeliverAt = ""
+	msg.ID = ""
+	e := ScheduledMessage{ID: newMessageID(), DeliverAt: deliverAt.UTC(), Created: now, Message: msg}
+	if err := cs.scheduled.Add(e); err != nil {
+		log.Printf("Error saving schedule: %v", err)
+	}
+	log.Printf("Scheduled message %s from %s for %s (trace %s)", e.ID, msg.Username, e.DeliverAt.Format(time.RFC3339), msg.Trace)
+	return e, nil
+}
+
+// handleSchedule schedules a client's message and confirms it with a
+// "scheduled" message carrying the schedule ID
+func (cs *ChatServer) handleSchedule(ctx context.Context, client *Client, msg Message, now time.Time) {
+	e, err := cs.scheduleMessage(msg, client.room, true, now)
+	if err != nil {
+		client.logf("Rejected scheduled message from %s (trace %s): %v", msg.Username, msg.Trace, err)
+		cs.sendError(ctx, client, err, refFor(msg))
+		return
+	}
+	cs.confirmSchedule(ctx, client, "scheduled", e)
+}
+
+// handleUnschedule cancels one of the client's own scheduled messages
+func (cs *ChatServer) handleUnschedule(ctx context.Context, client *Client, msg Message) {
+	e, ok := cs.scheduledBy(msg.ID, client.username)
+	if ok {
+		_, ok, _ = cs.scheduled.Cancel(e.ID)
+	}
+	if !ok {
+		cs.sendError(ctx, client, protocolErrorf(codeUnknownMessage, "no scheduled message %q", msg.ID), refFor(msg))
+		return
+	}
+	log.Printf("Cancelled scheduled message %s from %s", e.ID, client.username)
+	cs.confirmSchedule(ctx, client, "unscheduled", e)
+}
+
+// scheduledBy returns the pending message id if username scheduled it
+func (cs *ChatServer) scheduledBy(id, username string) (ScheduledMessage, bool) {
+	for _, e := range cs.scheduled.List(username) {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return ScheduledMessage{}, false
+}
+
+// confirmSchedule tells a client its message was scheduled or cancelled
+func (cs *ChatServer) confirmSchedule(ctx context.Context, client *Client, typ string, e ScheduledMessage) {
+	now := cs.now()
+	ack := e.Message
+	ack.Type = typ
+	ack.ID = e.ID
+	ack.DeliverAt = e.DeliverAt.Format(time.RFC3339)
+	ack.Time = now.Format(time.RFC3339)
+	ack.Timestamp = now.UnixMilli()
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	if err := client.writeMessage(ctx, ack); err != nil {
+		client.logf("Error confirming scheduled message to %s: %v", client.username, err)
+	}
+}
+
+// runScheduler publishes scheduled messages as they fall due, until ctx
+// is cancelled. Messages that came due while the server was down are
+// delivered as soon as it starts.
+func (cs *ChatServer) runScheduler(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-cs.scheduled.wake:
+		case <-ctx.Done():
+			return
+		}
+		next := cs.deliverScheduled(cs.now())
+		wait := scheduleIdleCheck
+		if !next.IsZero() {
+			wait = next.Sub(cs.now())
+		}
+		timer.Reset(wait)
+	}
+}
+
+// deliverScheduled publishes the messages due by now and returns when the
+// next one is due. A message stays scheduled until the hub accepts it, so
+// one that can't be queued is retried, after a restart if need be.
+func (cs *ChatServer) deliverScheduled(now time.Time) time.Time {
+	due, next := cs.scheduled.due(now)
+	for _, e := range due {
+		msg := e.Message
+		var room *Room
+		if msg.Room != "" {
+			if room = cs.lookupRoom(msg.Room); room == nil {
+				log.Printf("Dropped scheduled message %s from %s: room %s is gone", e.ID, msg.Username, msg.Room)
+				cs.scheduled.Cancel(e.ID)
+				continue
+			}
+		}
+		if err := msg.validateIn(room, cs.messageLimit); err != nil {
+			log.Printf("Dropped scheduled message %s from %s: %v", e.ID, msg.Username, err)
+			cs.scheduled.Cancel(e.ID)
+			continue
+		}
+
+		sent := cs.now()
+		msg.Time = sent.Format(time.RFC3339)
+		msg.Timestamp = sent.UnixMilli()
+		if !cs.publish(msg) {
+			// Retry once the queue drains
+			return cs.now().Add(time.Second)
+		}
+		cs.export(ExportMessage, msg.Username, msg.Content, sent)
+		if _, _, err := cs.scheduled.Cancel(e.ID); err != nil {
+			log.Printf("Error saving schedule: %v", err)
+		}
+		log.Printf("Delivered scheduled message %s from %s (trace %s)", e.ID, msg.Username, msg.Trace)
+	}
+	return next
+}
+
+// scheduleRequest is the body of POST /admin/scheduled
+type scheduleRequest struct {
+	Room      string `json:"room"`
+	Content   string `json:"content"`
+	DeliverAt string `json:"deliver_at"`
+	// Username sends the message as that user; empty sends it as a system
+	// message from the server
+	Username string `json:"username"`
+}
+
+// handleAdminScheduled serves GET /admin/scheduled?username=U, listing
+// pending messages, POST /admin/scheduled, scheduling one, and DELETE
+// /admin/scheduled?id=ID, cancelling one
+func (cs *ChatServer) handleAdminScheduled(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cs.scheduled.List(r.URL.Query().Get("username")))
+
+	case http.MethodPost:
+		var req scheduleRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		now := cs.now()
+		msg := Message{Type: "message", Username: req.Username, Content: req.Content, DeliverAt: req.DeliverAt, Trace: newTraceID()}
+		if req.Username == "" {
+			msg.Type = "system"
+			msg.Username = "Server"
+		} else if len(req.Username) > maxUsernameLength || !validUsernameRegex.MatchString(req.Username) {
+			http.Error(w, "invalid username", http.StatusBadRequest)
+			return
+		}
+		var room *Room
+		if name := roomOrLobby(req.Room); name != lobbyRoom {
+			if room = cs.lookupRoom(name); room == nil {
+				http.Error(w, errRoomNotFound.Error(), http.StatusNotFound)
+				return
+			}
+			msg.Room = name
+		}
+		e, err := cs.scheduleMessage(msg, room, false, now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cs.audit(AuditSchedule, adminActor(r), e.ID, req.Content)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(e)
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		_, ok, err := cs.scheduled.Cancel(id)
+		if ok {
+			cs.audit(AuditUnschedule, adminActor(r), id, "")
+		}
+		if err != nil {
+			log.Printf("Error saving schedule: %v", err)
+			http.Error(w, "message cancelled but not persisted", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "no such scheduled message", http.StatusNotFound)
+			return
+		}
+		log.Printf("Cancelled scheduled message %s", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
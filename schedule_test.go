@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestScheduledMessages(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+	bob := dialStatusTest(t, ctx, s, "bob")
+
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "too late", DeliverAt: time.Now().Add(-time.Minute).Format(time.RFC3339)})
+	if msg := readUntilType(t, ctx, alice, "error"); msg.Code != codeInvalidSchedule {
+		t.Errorf("Expected a past deliver_at to be rejected, got %+v", msg)
+	}
+
+	deliverAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "later", DeliverAt: deliverAt})
+	later := readUntilType(t, ctx, alice, "scheduled")
+	if later.ID == "" || later.DeliverAt != deliverAt || later.Content != "later" {
+		t.Fatalf("Expected a scheduled confirmation, got %+v", later)
+	}
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "never", DeliverAt: deliverAt})
+	never := readUntilType(t, ctx, alice, "scheduled")
+
+	// Only the sender can cancel
+	wsjson.Write(ctx, bob, Message{Type: "unschedule", ID: never.ID})
+	if msg := readUntilType(t, ctx, bob, "error"); msg.Code != codeUnknownMessage {
+		t.Errorf("Expected bob's cancel to be rejected, got %+v", msg)
+	}
+	wsjson.Write(ctx, alice, Message{Type: "unschedule", ID: never.ID})
+	if msg := readUntilType(t, ctx, alice, "unscheduled"); msg.ID != never.ID {
+		t.Errorf("Expected an unscheduled confirmation, got %+v", msg)
+	}
+
+	server.deliverScheduled(time.Now().Add(2 * time.Hour))
+	msg := readUntilType(t, ctx, bob, "message")
+	if msg.Content != "later" || msg.Username != "alice" || msg.Seq == 0 || msg.DeliverAt != "" {
+		t.Errorf("Expected the scheduled message to be delivered, got %+v", msg)
+	}
+	if n := len(server.scheduled.List("")); n != 0 {
+		t.Errorf("Expected nothing left scheduled, got %d", n)
+	}
+}
+
+func TestSchedule_SurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedule.json")
+	s, err := NewSchedule(path)
+	if err != nil {
+		t.Fatalf("Failed to create schedule: %v", err)
+	}
+	server := NewChatServer(WithSchedule(s), WithAdminToken("secret"))
+
+	body, _ := json.Marshal(scheduleRequest{Content: "maintenance at noon", DeliverAt: time.Now().Add(time.Minute).Format(time.RFC3339)})
+	req := httptest.NewRequest(http.MethodPost, "/admin/scheduled", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	server.handleAdminScheduled(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+
+	reloaded, err := NewSchedule(path)
+	if err != nil {
+		t.Fatalf("Failed to reload schedule: %v", err)
+	}
+	list := reloaded.List("")
+	if len(list) != 1 || list[0].Message.Type != "system" || list[0].Message.Content != "maintenance at noon" {
+		t.Fatalf("Expected the scheduled message after a restart, got %+v", list)
+	}
+
+	// Overdue messages go out as soon as the restarted server runs
+	restarted := NewChatServer(WithSchedule(reloaded))
+	restarted.Run(t.Context())
+	restarted.deliverScheduled(time.Now().Add(time.Hour))
+	deadline := time.Now().Add(time.Second * 5)
+	for len(restarted.history.Before(0, 10).Messages) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if got := restarted.history.Before(0, 10).Messages; len(got) != 1 || got[0].Content != "maintenance at noon" {
+		t.Errorf("Expected the message in history, got %+v", got)
+	}
+	if again, _ := NewSchedule(path); len(again.List("")) != 0 {
+		t.Errorf("Expected the delivered message to be removed from the file")
+	}
+
+	rec = httptest.NewRecorder()
+	server.handleAdminScheduled(rec, httptest.NewRequest(http.MethodDelete, "/admin/scheduled?id=nope", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 cancelling an unknown message, got %d", rec.Code)
+	}
+}
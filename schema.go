@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// inboundTypes are the frame types clients may send. A frame without a
+// type is a chat message. System notices come only from the server.
+var inboundTypes = []string{
+	"message", "key", "rename", "status", "typing", "history",
+	"roster", "profile", "read", "part", "client_error", "capabilities",
+	"poll", "vote", "unschedule",
+}
+
+// unknownFieldRegex extracts the field name from the unknown field errors
+// of both codecs
+var unknownFieldRegex = regexp.MustCompile(`unknown field "(.*)"`)
+
+// strictCodec is a Codec that can refuse fields its target doesn't have
+type strictCodec interface {
+	UnmarshalStrict(data []byte, v any) error
+}
+
+func (jsonCodec) UnmarshalStrict(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after the frame")
+	}
+	return nil
+}
+
+func (msgpackCodec) UnmarshalStrict(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	dec.DisallowUnknownFields(true)
+	return dec.Decode(v)
+}
+
+// decodeFrame decodes an inbound frame into msg. Unless lenient, fields
+// the schema doesn't have are refused.
+func decodeFrame(codec Codec, data []byte, msg *Message, lenient bool) error {
+	var err error
+	if sc, ok := codec.(strictCodec); ok && !lenient {
+		err = sc.UnmarshalStrict(data, msg)
+	} else {
+		err = codec.Unmarshal(data, msg)
+	}
+	if err == nil {
+		return nil
+	}
+	perr := protocolErrorf(codeBadFrame, "undecodable frame: %v", err)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		perr.Field = typeErr.Field
+		perr.Reason = "field " + typeErr.Field + " must be " + schemaTypeName(typeErr.Type) + ", not " + typeErr.Value
+	} else if m := unknownFieldRegex.FindStringSubmatch(err.Error()); m != nil {
+		perr.Field = m[1]
+		perr.Reason = "unknown field " + m[1] + " (see /schema)"
+	}
+	return perr
+}
+
+// checkType refuses a frame whose type clients may not send
+func checkType(msg Message) *ProtocolError {
+	if msg.Type == "" || slices.Contains(inboundTypes, msg.Type) {
+		return nil
+	}
+	err := protocolErrorf(codeInvalidType, "invalid message type: %s", msg.Type)
+	err.Field = "type"
+	return err
+}
+
+// schemaTypeName names the JSON type Go type t decodes from
+func schemaTypeName(t reflect.Type) string {
+	switch s := frameSchema(t, nil); s["type"] {
+	case "array":
+		return "an array"
+	case "integer":
+		return "an integer"
+	case "object":
+		return "an object"
+	case nil:
+		return "an object"
+	default:
+		return "a " + s["type"].(string)
+	}
+}
+
+var (
+	messageType = reflect.TypeFor[Message]()
+	timeType    = reflect.TypeFor[time.Time]()
+)
+
+// frameSchema describes how values of type t are encoded, adding the
+// structs it refers to to defs
+func frameSchema(t reflect.Type, defs map[string]any) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return frameSchema(t.Elem(), defs)
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": frameSchema(t.Elem(), defs)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": frameSchema(t.Elem(), defs)}
+	case reflect.Struct:
+		switch {
+		case t == timeType:
+			return map[string]any{"type": "string", "format": "date-time"}
+		case t == messageType:
+			return map[string]any{"$ref": "#"}
+		case defs == nil:
+			return map[string]any{"type": "object"}
+		}
+		if _, ok := defs[t.Name()]; !ok {
+			// Claim the name first, in case the struct refers to itself
+			defs[t.Name()] = nil
+			defs[t.Name()] = structSchema(t, defs)
+		}
+		return map[string]any{"$ref": "#/$defs/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+// structSchema describes the fields of struct type t
+func structSchema(t reflect.Type, defs map[string]any) map[string]any {
+	props := make(map[string]any)
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		props[name] = frameSchema(field.Type, defs)
+	}
+	return map[string]any{"type": "object", "properties": props, "additionalProperties": false}
+}
+
+// inboundSchema is the JSON Schema of the frames clients send
+func inboundSchema() map[string]any {
+	defs := make(map[string]any)
+	schema := structSchema(messageType, defs)
+	schema["properties"].(map[string]any)["type"] = map[string]any{
+		"type":        "string",
+		"enum":        append([]string{""}, inboundTypes...),
+		"description": "What the frame is; empty for a chat message",
+	}
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["$id"] = "/schema"
+	schema["title"] = "Chat frame"
+	schema["description"] = "A frame sent by a client of any protocol version, as JSON or, on v2 and v3, as MessagePack with the same field names. The server sets username, time, ts, id, seq and the other fields it sends itself, whatever the client puts in them."
+	schema["$defs"] = defs
+	return schema
+}
+
+// handleSchema serves GET /schema, the JSON Schema of inbound frames
+func (cs *ChatServer) handleSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(inboundSchema())
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestSchema(t *testing.T) {
+	server := NewChatServer()
+	w := httptest.NewRecorder()
+	server.handleSchema(w, httptest.NewRequest(http.MethodGet, "/schema", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/schema+json" {
+		t.Fatalf("Expected a JSON Schema, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	var schema struct {
+		AdditionalProperties bool `json:"additionalProperties"`
+		Properties           map[string]struct {
+			Type string   `json:"type"`
+			Ref  string   `json:"$ref"`
+			Enum []string `json:"enum"`
+		} `json:"properties"`
+		Defs map[string]json.RawMessage `json:"$defs"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &schema); err != nil {
+		t.Fatalf("Failed to decode schema: %v", err)
+	}
+	if schema.AdditionalProperties {
+		t.Errorf("Expected unknown fields to be refused")
+	}
+	if typ := schema.Properties["type"]; !slices.Contains(typ.Enum, "message") || slices.Contains(typ.Enum, "shout") {
+		t.Errorf("Expected an enum of inbound types, got %v", typ.Enum)
+	}
+	if content := schema.Properties["content"]; content.Type != "string" {
+		t.Errorf("Expected content to be a string, got %+v", content)
+	}
+	if poll := schema.Properties["poll"]; poll.Ref != "#/$defs/Poll" || schema.Defs["Poll"] == nil {
+		t.Errorf("Expected poll to refer to a definition, got %+v", poll)
+	}
+}
+
+func TestDecodeFrame(t *testing.T) {
+	unknown, _ := msgpack.Marshal(map[string]any{"type": "message", "content": "hi", "colour": "red"})
+	tests := []struct {
+		name      string
+		codec     Codec
+		frame     []byte
+		lenient   bool
+		wantField string
+		wantErr   bool
+	}{
+		{"json", jsonCodec{}, []byte(`{"type":"message","content":"hi"}`), false, "", false},
+		{"json unknown field", jsonCodec{}, []byte(`{"content":"hi","colour":"red"}`), false, "colour", true},
+		{"json unknown field lenient", jsonCodec{}, []byte(`{"content":"hi","colour":"red"}`), true, "", false},
+		{"json nested type", jsonCodec{}, []byte(`{"type":"poll","poll":{"options":"a"}}`), false, "poll.options", true},
+		{"json trailing data", jsonCodec{}, []byte(`{"content":"hi"}{}`), false, "", true},
+		{"msgpack unknown field", msgpackCodec{}, unknown, false, "colour", true},
+		{"msgpack unknown field lenient", msgpackCodec{}, unknown, true, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg Message
+			err := decodeFrame(tt.codec, tt.frame, &msg, tt.lenient)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil {
+				if msg.Content != "hi" {
+					t.Errorf("Expected content hi, got %+v", msg)
+				}
+				return
+			}
+			perr, ok := err.(*ProtocolError)
+			if !ok || perr.Code != codeBadFrame || perr.Field != tt.wantField {
+				t.Errorf("Expected a bad frame error on %q, got %#v", tt.wantField, err)
+			}
+		})
+	}
+}
+
+func TestAllowUnknownFields(t *testing.T) {
+	server := NewChatServer(WithFramePolicy(FramePolicy{AllowUnknownFields: true}))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c := dialStatusTest(t, ctx, s, "alice")
+	if err := c.Write(ctx, websocket.MessageText, []byte(`{"type":"message","content":"hi","colour":"red"}`)); err != nil {
+		t.Fatalf("Failed to send frame: %v", err)
+	}
+	if msg := readUntilType(t, ctx, c, "message"); msg.Content != "hi" {
+		t.Errorf("Expected the message despite the unknown field, got %+v", msg)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// sequencerQueue is how many messages may wait for a room's sequencer
+	// before senders block
+	sequencerQueue = 256
+	// sequencerIdle is how long a room's sequencer waits for a message
+	// before it exits
+	sequencerIdle = time.Minute
+)
+
+// sequenced is a message waiting for its room's sequencer
+type sequenced struct {
+	msg Message
+	// deliverOnly is set for messages relayed elsewhere already, such as
+	// broadcasts from other instances
+	deliverOnly bool
+	// flushed is closed once everything queued before it is delivered
+	flushed chan struct{}
+}
+
+// sequencer relays one room's messages, one at a time in the order they
+// were queued, so every client in the room sees the same order
+type sequencer struct {
+	room  string
+	queue chan sequenced
+}
+
+// sequencers holds the sequencer of every room with recent traffic
+type sequencers struct {
+	mu      sync.Mutex
+	rooms   map[string]*sequencer
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+func newSequencers() *sequencers {
+	return &sequencers{rooms: make(map[string]*sequencer)}
+}
+
+// sequence hands msg to its room's sequencer, starting one if needed.
+// Rooms are sequenced independently, so a slow room doesn't hold up the
+// others. Global events such as renames concern every room, so they wait
+// for every sequencer to catch up and are delivered before anything
+// queued after them.
+func (cs *ChatServer) sequence(msg Message, deliverOnly bool) {
+	s := cs.sequencers
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	if isGlobal(msg) {
+		s.flushLocked()
+		cs.sequenced(sequenced{msg: msg, deliverOnly: deliverOnly})
+		return
+	}
+	seq, ok := s.rooms[msg.Room]
+	if !ok {
+		seq = &sequencer{room: msg.Room, queue: make(chan sequenced, sequencerQueue)}
+		s.rooms[msg.Room] = seq
+		s.wg.Add(1)
+		go cs.runSequencer(seq)
+	}
+	// Queued under the lock, so the sequencer can't exit with it waiting
+	seq.queue <- sequenced{msg: msg, deliverOnly: deliverOnly}
+}
+
+// flushLocked waits until every sequencer has delivered what is queued
+func (s *sequencers) flushLocked() {
+	var flushes []chan struct{}
+	for _, seq := range s.rooms {
+		flushed := make(chan struct{})
+		seq.queue <- sequenced{flushed: flushed}
+		flushes = append(flushes, flushed)
+	}
+	for _, flushed := range flushes {
+		<-flushed
+	}
+}
+
+// stop delivers what the sequencers hold and waits for them to exit.
+// Messages sequenced afterwards are dropped.
+func (s *sequencers) stop() {
+	s.mu.Lock()
+	s.stopped = true
+	for _, seq := range s.rooms {
+		close(seq.queue)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// sequenced relays or delivers one message
+func (cs *ChatServer) sequenced(item sequenced) {
+	switch {
+	case item.flushed != nil:
+		close(item.flushed)
+	case item.deliverOnly:
+		cs.deliver(item.msg)
+	default:
+		cs.relay(item.msg)
+	}
+}
+
+// runSequencer relays a room's messages until its queue is closed or it
+// has been idle for sequencerIdle
+func (cs *ChatServer) runSequencer(seq *sequencer) {
+	s := cs.sequencers
+	defer s.wg.Done()
+	idle := time.NewTimer(sequencerIdle)
+	defer idle.Stop()
+	for {
+		select {
+		case item, ok := <-seq.queue:
+			if !ok {
+				return
+			}
+			cs.sequenced(item)
+			idle.Reset(sequencerIdle)
+		case <-idle.C:
+			// A flush holds the lock while it waits for this sequencer,
+			// so don't wait for it here
+			if s.mu.TryLock() {
+				if len(seq.queue) == 0 && !s.stopped {
+					delete(s.rooms, seq.room)
+					s.mu.Unlock()
+					return
+				}
+				s.mu.Unlock()
+			}
+			idle.Reset(sequencerIdle)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestSequencerOrdering(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	hub, stop := context.WithCancel(ctx)
+	server := NewChatServer()
+	server.Run(hub)
+	if _, _, err := server.createRoom(RoomOptions{Name: "ops"}); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	const senders, each = 4, 25
+	conns := make([]*websocket.Conn, senders)
+	for i := range conns {
+		c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+fmt.Sprintf("?username=u%d&room=ops", i),
+			&websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer c.CloseNow()
+		conns[i] = c
+	}
+	// Wait until everyone is in before sending, so every client sees
+	// every message
+	waitFor(t, "everyone to join", func() bool {
+		return server.ClientCount() == senders
+	})
+
+	var wg sync.WaitGroup
+	for i, c := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range each {
+				wsjson.Write(ctx, c, Message{Type: "message", Content: fmt.Sprintf("%d-%d", i, j)})
+			}
+		}()
+	}
+	seen := make([][]string, senders)
+	for i, c := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var last uint64
+			for len(seen[i]) < senders*each {
+				var msg Message
+				if err := wsjson.Read(ctx, c, &msg); err != nil {
+					t.Errorf("Failed to read: %v", err)
+					return
+				}
+				if msg.Type != "message" {
+					continue
+				}
+				if msg.Seq <= last {
+					t.Errorf("Expected increasing sequence numbers, got %d after %d", msg.Seq, last)
+				}
+				last = msg.Seq
+				seen[i] = append(seen[i], msg.Content)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := 1; i < senders; i++ {
+		if !slices.Equal(seen[0], seen[i]) {
+			t.Fatalf("Expected every client to see the same order, got %v and %v", seen[0], seen[i])
+		}
+	}
+
+	server.sequencers.mu.Lock()
+	_, ok := server.sequencers.rooms["ops"]
+	server.sequencers.mu.Unlock()
+	if !ok {
+		t.Errorf("Expected ops to have a sequencer")
+	}
+	// Messages sequenced after shutdown are dropped, not sent on a closed
+	// queue
+	stop()
+	<-server.Done()
+	server.sequence(Message{Type: "message", Room: "ops"}, false)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ShadowBan is a user whose messages only reach themselves
+type ShadowBan struct {
+	Username string    `json:"username"`
+	Reason   string    `json:"reason,omitempty"`
+	By       string    `json:"by"`
+	Since    time.Time `json:"since"`
+}
+
+// shadowBans holds the shadow-banned users by username. They follow a
+// user through renames and reconnects.
+type shadowBans struct {
+	mu    sync.Mutex
+	users map[string]ShadowBan
+}
+
+// banned reports whether username is shadow-banned
+func (s *shadowBans) banned(username string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.users[username]
+	return ok
+}
+
+// add shadow-bans a user, reporting false if they already were
+func (s *shadowBans) add(ban ShadowBan) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[ban.Username]; ok {
+		return false
+	}
+	if s.users == nil {
+		s.users = make(map[string]ShadowBan)
+	}
+	s.users[ban.Username] = ban
+	return true
+}
+
+// remove lifts a shadow ban, reporting false if there was none
+func (s *shadowBans) remove(username string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[username]; !ok {
+		return false
+	}
+	delete(s.users, username)
+	return true
+}
+
+// move carries a shadow ban over to a user's new name
+func (s *shadowBans) move(oldName, newName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ban, ok := s.users[oldName]; ok {
+		delete(s.users, oldName)
+		ban.Username = newName
+		s.users[newName] = ban
+	}
+}
+
+// list returns the shadow bans, oldest first
+func (s *shadowBans) list() []ShadowBan {
+	s.mu.Lock()
+	list := make([]ShadowBan, 0, len(s.users))
+	for _, ban := range s.users {
+		list = append(list, ban)
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Since.Before(list[j].Since) })
+	return list
+}
+
+// shadowDrop echoes msg back to a shadow-banned sender as if it had been
+// delivered, and reports whether it did. Nobody else sees the message.
+func (cs *ChatServer) shadowDrop(ctx context.Context, client *Client, msg Message) bool {
+	if !cs.shadowBans.banned(client.username) {
+		return false
+	}
+	msg.ID = newMessageID()
+	client.logf("Dropped message from shadow-banned %s (trace %s)", msg.Username, msg.Trace)
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	if err := client.writeMessage(ctx, msg); err != nil {
+		client.logf("Error echoing dropped message to %s: %v", msg.Username, err)
+	}
+	return true
+}
+
+// handleAdminShadowBans serves GET /admin/shadowbans, listing shadow-banned
+// users, POST /admin/shadowbans?username=<name>&reason=<text>, shadow-banning
+// a user, and DELETE /admin/shadowbans?username=<name>, lifting it
+func (cs *ChatServer) handleAdminShadowBans(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cs.shadowBans.list())
+
+	case http.MethodPost:
+		if username == "" {
+			http.Error(w, "username is required", http.StatusBadRequest)
+			return
+		}
+		reason := r.URL.Query().Get("reason")
+		ban := ShadowBan{Username: username, Reason: reason, By: adminActor(r), Since: cs.now()}
+		if !cs.shadowBans.add(ban) {
+			http.Error(w, "already shadow-banned", http.StatusConflict)
+			return
+		}
+		cs.audit(AuditShadowBan, ban.By, username, reason)
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if !cs.shadowBans.remove(username) {
+			http.Error(w, "not shadow-banned", http.StatusNotFound)
+			return
+		}
+		cs.audit(AuditShadowLift, adminActor(r), username, r.URL.Query().Get("reason"))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
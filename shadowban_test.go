@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestShadowBans(t *testing.T) {
+	server := NewChatServer(WithAdminToken("secret"))
+	server.Run(t.Context())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.handleConnection)
+	server.registerAdminRoutes(mux)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+	bob := dialStatusTest(t, ctx, s, "bob")
+
+	if resp := adminRequest(t, ctx, http.MethodPost, s.URL+"/admin/shadowbans?username=alice&reason=trolling", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the admin token, got %d", resp.StatusCode)
+	}
+	if resp := adminRequest(t, ctx, http.MethodPost, s.URL+"/admin/shadowbans?username=alice&reason=trolling", "secret"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 shadow-banning alice, got %d", resp.StatusCode)
+	}
+	if resp := adminRequest(t, ctx, http.MethodPost, s.URL+"/admin/shadowbans?username=alice", "secret"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 shadow-banning alice twice, got %d", resp.StatusCode)
+	}
+
+	// alice sees her message delivered, bob never gets it
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "you all smell"})
+	if msg := readUntilType(t, ctx, alice, "message"); msg.Content != "you all smell" || msg.ID == "" {
+		t.Errorf("Expected alice's message echoed back, got %+v", msg)
+	}
+	wsjson.Write(ctx, bob, Message{Type: "message", Content: "hello"})
+	if msg := readUntilType(t, ctx, bob, "message"); msg.Content != "hello" {
+		t.Errorf("Expected bob to see only his own message, got %+v", msg)
+	}
+	for _, m := range server.history.Before(0, 10).Messages {
+		if m.Username == "alice" && m.Type == "message" {
+			t.Errorf("Expected alice's message kept out of history, got %+v", m)
+		}
+	}
+
+	// The ban follows a rename
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "/nick alicia"})
+	readUntilType(t, ctx, alice, "rename")
+	resp := adminRequest(t, ctx, http.MethodGet, s.URL+"/admin/shadowbans", "secret")
+	var bans []ShadowBan
+	json.NewDecoder(resp.Body).Decode(&bans)
+	resp.Body.Close()
+	if len(bans) != 1 || bans[0].Username != "alicia" || bans[0].Reason != "trolling" {
+		t.Errorf("Expected alicia's shadow ban, got %+v", bans)
+	}
+
+	if resp := adminRequest(t, ctx, http.MethodDelete, s.URL+"/admin/shadowbans?username=alicia", "secret"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 lifting the shadow ban, got %d", resp.StatusCode)
+	}
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "sorry"})
+	if msg := readUntilType(t, ctx, bob, "message"); msg.Content != "sorry" {
+		t.Errorf("Expected bob to see alicia again, got %+v", msg)
+	}
+
+	var actions []string
+	for _, e := range server.auditLog.Before(0, 20).Entries {
+		if e.Action == AuditShadowBan || e.Action == AuditShadowLift {
+			actions = append(actions, e.Action+" "+e.Target)
+		}
+	}
+	if strings.Join(actions, ",") != "shadow_ban alice,shadow_unban alicia" {
+		t.Errorf("Expected the ban and its lifting audited, got %v", actions)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/bvedant/ideal-guacamole/chain"
+)
+
+// SigningKeyInfo is the body of GET /api/signing-key
+type SigningKeyInfo struct {
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"public_key"`
+}
+
+// WithSigningKey signs every stored message with key and chains their
+// hashes, so exported history can be verified with chat-cli verify
+func WithSigningKey(key ed25519.PrivateKey) Option {
+	return func(cs *ChatServer) {
+		cs.signingKey = key
+	}
+}
+
+// LoadSigningKey reads a PEM encoded PKCS #8 Ed25519 private key, as
+// written by openssl genpkey -algorithm ed25519
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("no PEM private key found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%T is not an Ed25519 key", key)
+	}
+	return edKey, nil
+}
+
+// signLocked signs msg, chaining it to the previously stored message.
+// Callers hold h.mu.
+func (h *History) signLocked(msg Message) Message {
+	msg.BodyHash = chainBody(msg).Hash()
+	msg.PrevHash = h.lastHash
+	msg.Hash, msg.Sig = chain.Sign(h.signer, chain.Link{
+		Room:      msg.Room,
+		Seq:       msg.Seq,
+		ID:        msg.ID,
+		Type:      msg.Type,
+		Timestamp: msg.Timestamp,
+		BodyHash:  msg.BodyHash,
+		PrevHash:  msg.PrevHash,
+	})
+	h.lastHash = msg.Hash
+	return msg
+}
+
+// redactLocked signs the body erasure left a signed message with, so it
+// verifies without its original. Callers hold h.mu.
+func (h *History) redactLocked(msg *Message) {
+	if h.signer != nil && msg.Sig != "" {
+		msg.RedactionSig = chain.SignRedaction(h.signer, msg.Hash, chainBody(*msg))
+	}
+}
+
+// chainBody returns the part of msg its body hash covers
+func chainBody(msg Message) chain.Body {
+	return chain.Body{
+		Username:    msg.Username,
+		Content:     msg.Content,
+		Ciphertext:  msg.Ciphertext,
+		To:          msg.To,
+		OldUsername: msg.OldUsername,
+	}
+}
+
+// handleSigningKey serves GET /api/signing-key, the public key history is
+// signed with
+func (cs *ChatServer) handleSigningKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cs.signingKey == nil {
+		http.Error(w, "message signing is disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SigningKeyInfo{
+		Algorithm: "ed25519",
+		PublicKey: base64.StdEncoding.EncodeToString(cs.signingKey.Public().(ed25519.PublicKey)),
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bvedant/ideal-guacamole/chain"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestSignedHistory(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	server := NewChatServer(WithSigningKey(key))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+	for _, content := range []string{"one", "two", "three"} {
+		wsjson.Write(ctx, alice, Message{Type: "message", Content: content})
+	}
+	for received := 0; received < 3; {
+		msg := readUntilType(t, ctx, alice, "message")
+		if msg.Hash == "" || msg.Sig == "" {
+			t.Errorf("Expected a signed message, got %+v", msg)
+		}
+		received++
+	}
+
+	rec := httptest.NewRecorder()
+	server.handleSigningKey(rec, httptest.NewRequest(http.MethodGet, "/api/signing-key", nil))
+	var info SigningKeyInfo
+	json.NewDecoder(rec.Body).Decode(&info)
+	pub, err := chain.ParsePublicKey(info.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to parse the public key %q: %v", info.PublicKey, err)
+	}
+
+	// Verify what a client exporting /api/history would see
+	records := func() []chain.Record {
+		page := server.history.Before(0, maxHistoryLimit)
+		data, _ := json.Marshal(page)
+		var out struct{ Messages []chain.Record }
+		json.Unmarshal(data, &out)
+		return out.Messages
+	}
+	if report, err := chain.Verify(pub, records()); err != nil || report.Verified != 4 {
+		t.Errorf("Expected the join notice and 3 messages to verify, got %+v (%v)", report, err)
+	}
+
+	server.history.Erase("alice")
+	if report, err := chain.Verify(pub, records()); err != nil || len(report.Redacted) != 4 {
+		t.Errorf("Expected erased messages to verify as redacted, got %+v (%v)", report, err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// maxSlowMode is the longest interval slow mode may impose
+	maxSlowMode = time.Hour * 6
+	// slowModePosters bounds the posting times a room remembers before
+	// the stale ones are dropped
+	slowModePosters = 1000
+)
+
+// slowModeBody is the body of a PUT /rooms/slowmode request and the answer
+// to a GET
+type slowModeBody struct {
+	// Seconds is the interval between one user's messages; zero turns slow
+	// mode off
+	Seconds int `json:"seconds"`
+}
+
+// checkSlowMode refuses a message sent before the room's slow mode
+// interval has passed since the sender's last one, telling the sender how
+// long is left. Users who may moderate the room are exempt.
+func (cs *ChatServer) checkSlowMode(ctx context.Context, client *Client, msg Message) bool {
+	wait := cs.slowModeWait(client.room, client.username, client.grantee(), cs.now())
+	if wait <= 0 {
+		return false
+	}
+
+	err := protocolErrorf(codeSlowMode, "slow mode is on: wait %s before sending again", wait.Round(time.Second))
+	client.logf("Refused message from %s (trace %s): %v", client.username, msg.Trace, err)
+	cs.sendError(ctx, client, err, refFor(msg))
+	return true
+}
+
+// slowModeWait returns how long username must still wait before posting
+// in room, or in the lobby if room is nil, and records the post when
+// nothing is left
+func (cs *ChatServer) slowModeWait(room *Room, username string, who grantee, now time.Time) time.Duration {
+	if room == nil {
+		room = cs.lobby
+	}
+	if cs.permits(room, PermModerate, who) {
+		return 0
+	}
+
+	cs.roomsMtx.Lock()
+	defer cs.roomsMtx.Unlock()
+	interval := room.slowMode
+	if interval <= 0 {
+		return 0
+	}
+	wait := room.lastPosted[username].Add(interval).Sub(now)
+	if wait <= 0 {
+		if room.lastPosted == nil {
+			room.lastPosted = make(map[string]time.Time)
+		}
+		if len(room.lastPosted) >= slowModePosters {
+			for username, t := range room.lastPosted {
+				if now.Sub(t) >= interval {
+					delete(room.lastPosted, username)
+				}
+			}
+		}
+		room.lastPosted[username] = now
+	}
+	return wait
+}
+
+// handleRoomSlowMode serves the slow mode of a room, for its owner, its
+// moderators or an admin: GET /rooms/slowmode?room=<name> reports the
+// interval and PUT sets it from {"seconds": n}, zero turning it off. The
+// lobby is managed with room=lobby.
+func (cs *ChatServer) handleRoomSlowMode(w http.ResponseWriter, r *http.Request) {
+	if cs.rejectBanned(w, r) {
+		return
+	}
+	name := r.URL.Query().Get("room")
+	room := cs.stateRoom(name)
+	if room == nil {
+		http.Error(w, errRoomNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	actor, ok := cs.authorizeModerator(r, room)
+	if !ok {
+		cs.strike(r, "failed room moderator authentication")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="room"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		cs.roomsMtx.Lock()
+		body := slowModeBody{Seconds: int(room.slowMode / time.Second)}
+		cs.roomsMtx.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+
+	case http.MethodPut:
+		var body slowModeBody
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&body); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		interval := time.Duration(body.Seconds) * time.Second
+		if body.Seconds < 0 || interval > maxSlowMode {
+			http.Error(w, fmt.Sprintf("seconds must be between 0 and %d", int(maxSlowMode/time.Second)), http.StatusBadRequest)
+			return
+		}
+
+		msg := cs.roomEvent("slowmode", name, fmt.Sprintf("Slow mode is on: one message every %s", interval))
+		if interval == 0 {
+			msg.Content = "Slow mode is off"
+		}
+		msg.SlowMode = body.Seconds
+		if !cs.publish(msg) {
+			http.Error(w, "server busy, try again", http.StatusServiceUnavailable)
+			return
+		}
+		cs.audit(AuditSlowMode, actor, roomOrLobby(name), interval.String())
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// tokenAuth maps bearer tokens to identities
+type tokenAuth map[string]Identity
+
+func (a tokenAuth) Authenticate(_ context.Context, token string) (*Identity, error) {
+	identity, ok := a[token]
+	if !ok {
+		return nil, errUnauthenticated
+	}
+	return &identity, nil
+}
+
+// setSlowMode puts body to the named room's slow mode with key as the
+// bearer token
+func setSlowMode(t *testing.T, s *httptest.Server, room, key, body string) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPut, s.URL+"/rooms/slowmode?room="+room, strings.NewReader(body))
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to set slow mode: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestSlowMode(t *testing.T) {
+	server := NewChatServer(WithAuthenticator(tokenAuth{
+		"alice-token": {Username: "alice", Roles: []string{roleModerator}},
+		"bob-token":   {Username: "bob"},
+	}))
+	server.Run(t.Context())
+	s := newRoomsTestServer(t, server)
+
+	if status := setSlowMode(t, s, "lobby", "", `{"seconds": 60}`); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a moderator token, got %d", status)
+	}
+	if status := setSlowMode(t, s, "lobby", "alice-token", `{"seconds": -1}`); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a negative interval, got %d", status)
+	}
+	if status := setSlowMode(t, s, "lobby", "alice-token", `{"seconds": 60}`); status != http.StatusNoContent {
+		t.Fatalf("Expected 204 for a moderator, got %d", status)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, s.URL+"/rooms/slowmode?room=lobby", nil)
+	req.Header.Set("Authorization", "Bearer alice-token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to get slow mode: %v", err)
+	}
+	var body slowModeBody
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if body.Seconds != 60 {
+		t.Errorf("Expected 60 seconds, got %d", body.Seconds)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+	opts := &websocket.DialOptions{Subprotocols: []string{subprotocolV2}}
+	bob, _, err := websocket.Dial(ctx, wsURL+"?token=bob-token", opts)
+	if err != nil {
+		t.Fatalf("Failed to connect bob: %v", err)
+	}
+	defer bob.CloseNow()
+	if state := readUntilType(t, ctx, bob, "room"); state.Type != "room" {
+		t.Fatalf("Expected the room state, got %+v", state)
+	}
+
+	wsjson.Write(ctx, bob, Message{Type: "message", Content: "first"})
+	readUntilType(t, ctx, bob, "message")
+	wsjson.Write(ctx, bob, Message{Type: "message", Content: "second"})
+	if msg := readUntilType(t, ctx, bob, "message"); msg.Code != codeSlowMode || !strings.Contains(msg.Content, "wait 1m0s") {
+		t.Errorf("Expected a slow mode error with the time left, got %+v", msg)
+	}
+
+	// Moderators are exempt
+	alice, _, err := websocket.Dial(ctx, wsURL+"?token=alice-token", opts)
+	if err != nil {
+		t.Fatalf("Failed to connect alice: %v", err)
+	}
+	defer alice.CloseNow()
+	for _, content := range []string{"one", "two"} {
+		wsjson.Write(ctx, alice, Message{Type: "message", Content: content})
+		if msg := readUntilType(t, ctx, alice, "message"); msg.Type != "message" || msg.Content != content {
+			t.Errorf("Expected a moderator's message through, got %+v", msg)
+		}
+	}
+
+	// Turning it off lets bob post again
+	if status := setSlowMode(t, s, "lobby", "alice-token", `{"seconds": 0}`); status != http.StatusNoContent {
+		t.Fatalf("Expected 204 turning slow mode off, got %d", status)
+	}
+	readUntilType(t, ctx, bob, "slowmode")
+	wsjson.Write(ctx, bob, Message{Type: "message", Content: "third"})
+	if msg := readUntilType(t, ctx, bob, "message"); msg.Type != "message" {
+		t.Errorf("Expected the message through once slow mode is off, got %+v", msg)
+	}
+}
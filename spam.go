@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	// spamHalfLife is how long it takes a spam score to halve
+	spamHalfLife = time.Minute
+	// spamDuplicateWindow is how far back repeated content counts
+	spamDuplicateWindow = time.Second * 30
+	spamRecentMessages  = 5
+	// spamLinkFloodWindow is how close together link messages count as
+	// a flood
+	spamLinkFloodWindow = time.Second * 10
+	// spamJoinWindow is the period over which joins from one address are
+	// counted, and spamJoinsAllowed how many pass without penalty
+	spamJoinWindow   = time.Minute
+	spamJoinsAllowed = 3
+	spamHostLimit    = 10000
+
+	// Points added by each heuristic
+	spamDuplicatePoints = 3
+	spamLinkPoints      = 1
+	spamLinkFloodPoints = 2
+	spamJoinPoints      = 4
+	spamEvasionPoints   = 1
+
+	defaultSpamSlowInterval = time.Second * 10
+	defaultSpamMuteDuration = time.Minute * 2
+)
+
+// spamPenalty is how hard a client is being throttled; each level includes
+// the ones before it
+type spamPenalty int
+
+const (
+	spamNone spamPenalty = iota
+	spamWarned
+	spamSlowed
+	spamMuted
+	spamDisconnected
+)
+
+var spamPenaltyNames = [...]string{"none", "warning", "slow_mode", "mute", "disconnect"}
+
+func (p spamPenalty) String() string {
+	return spamPenaltyNames[p]
+}
+
+// SpamConfig configures spam scoring. A client's score rises with each
+// heuristic that fires and halves every minute; crossing a threshold
+// applies the next penalty.
+type SpamConfig struct {
+	WarnScore       float64
+	SlowScore       float64
+	MuteScore       float64
+	DisconnectScore float64
+	// SlowInterval is the minimum gap between messages in slow mode
+	SlowInterval time.Duration
+	// MuteDuration is how long a mute lasts
+	MuteDuration time.Duration
+}
+
+// DefaultSpamConfig returns the thresholds used by -spam-filter
+func DefaultSpamConfig() SpamConfig {
+	return SpamConfig{
+		WarnScore:       6,
+		SlowScore:       12,
+		MuteScore:       20,
+		DisconnectScore: 30,
+		SlowInterval:    defaultSpamSlowInterval,
+		MuteDuration:    defaultSpamMuteDuration,
+	}
+}
+
+// spamFilter holds the spam configuration and the joins seen per address
+type spamFilter struct {
+	cfg SpamConfig
+
+	mu    sync.Mutex
+	joins map[string][]time.Time
+}
+
+// spamState is a client's score and penalty. Only the client's own handler
+// touches it.
+type spamState struct {
+	score     float64
+	updated   time.Time
+	penalty   spamPenalty
+	mutedTill time.Time
+	lastSent  time.Time
+	lastLink  time.Time
+	recent    []spamRecent
+}
+
+// spamRecent is a recently sent message, normalized for comparison
+type spamRecent struct {
+	content string
+	at      time.Time
+}
+
+// WithSpamFilter scores clients for duplicate bursts, link floods and
+// join/leave cycling, and throttles the ones that score high
+func WithSpamFilter(cfg SpamConfig) Option {
+	return func(cs *ChatServer) {
+		defaults := DefaultSpamConfig()
+		if cfg.WarnScore <= 0 {
+			cfg.WarnScore = defaults.WarnScore
+		}
+		if cfg.SlowScore <= 0 {
+			cfg.SlowScore = defaults.SlowScore
+		}
+		if cfg.MuteScore <= 0 {
+			cfg.MuteScore = defaults.MuteScore
+		}
+		if cfg.DisconnectScore <= 0 {
+			cfg.DisconnectScore = defaults.DisconnectScore
+		}
+		if cfg.SlowInterval <= 0 {
+			cfg.SlowInterval = defaults.SlowInterval
+		}
+		if cfg.MuteDuration <= 0 {
+			cfg.MuteDuration = defaults.MuteDuration
+		}
+		cs.spam = &spamFilter{cfg: cfg, joins: make(map[string][]time.Time)}
+	}
+}
+
+// penaltyFor maps a score to the penalty it earns
+func (f *spamFilter) penaltyFor(score float64) spamPenalty {
+	switch {
+	case score >= f.cfg.DisconnectScore:
+		return spamDisconnected
+	case score >= f.cfg.MuteScore:
+		return spamMuted
+	case score >= f.cfg.SlowScore:
+		return spamSlowed
+	case score >= f.cfg.WarnScore:
+		return spamWarned
+	}
+	return spamNone
+}
+
+// noteJoin counts a join from the client's address and returns the points
+// it earns: nothing until the address joins more than spamJoinsAllowed
+// times a minute, then more for every extra join. A new connection starts
+// with a clean score, so cycling has to cost more each time.
+func (f *spamFilter) noteJoin(remoteAddr string, now time.Time) float64 {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.joins[host]; !ok && len(f.joins) >= spamHostLimit {
+		for h, times := range f.joins {
+			if now.Sub(times[len(times)-1]) >= spamJoinWindow {
+				delete(f.joins, h)
+			}
+		}
+		if len(f.joins) >= spamHostLimit {
+			return 0
+		}
+	}
+	recent := f.joins[host][:0]
+	for _, t := range f.joins[host] {
+		if now.Sub(t) < spamJoinWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	f.joins[host] = recent
+	return float64(max(len(recent)-spamJoinsAllowed, 0)) * spamJoinPoints
+}
+
+// decay brings a client's score up to now and eases the penalty once the
+// score has fallen below it. A mute runs its full course.
+func (s *spamState) decay(f *spamFilter, now time.Time) {
+	if !s.updated.IsZero() {
+		s.score *= math.Pow(0.5, float64(now.Sub(s.updated))/float64(spamHalfLife))
+	}
+	s.updated = now
+	if p := f.penaltyFor(s.score); p < s.penalty && !now.Before(s.mutedTill) {
+		s.penalty = p
+	}
+}
+
+// normalizeSpam reduces content to what duplicate detection compares
+func normalizeSpam(content string) string {
+	return strings.Join(strings.Fields(strings.ToLower(content)), " ")
+}
+
+// scoreMessage adds the points a message earns and returns the first
+// heuristic that fired, or "" if none did
+func (s *spamState) scoreMessage(content string, now time.Time) string {
+	var points float64
+	var reason string
+	add := func(p float64, why string) {
+		if p > 0 && reason == "" {
+			reason = why
+		}
+		points += p
+	}
+
+	norm := normalizeSpam(content)
+	recent := s.recent[:0]
+	for _, r := range s.recent {
+		if now.Sub(r.at) < spamDuplicateWindow {
+			recent = append(recent, r)
+		}
+	}
+	for _, r := range recent {
+		if r.content == norm {
+			add(spamDuplicatePoints, "duplicate messages")
+			break
+		}
+	}
+	if len(recent) >= spamRecentMessages {
+		recent = recent[1:]
+	}
+	s.recent = append(recent, spamRecent{content: norm, at: now})
+
+	if links := len(previewURL.FindAllString(content, -1)); links > 0 {
+		add(float64(links-1)*spamLinkPoints, "too many links")
+		if now.Sub(s.lastLink) < spamLinkFloodWindow {
+			add(spamLinkFloodPoints, "link flood")
+		}
+		s.lastLink = now
+	}
+	s.score += points
+	return reason
+}
+
+// noteSpamJoin scores a joining client for join/leave cycling from its
+// address
+func (cs *ChatServer) noteSpamJoin(ctx context.Context, client *Client) {
+	if cs.spam == nil {
+		return
+	}
+	now := cs.now()
+	client.spam.decay(cs.spam, now)
+	if points := cs.spam.noteJoin(client.remoteAddr, now); points > 0 {
+		client.spam.score += points
+		cs.escalateSpam(ctx, client, "join/leave cycling", now)
+	}
+}
+
+// checkSpam scores a chat message and applies the client's penalty,
+// reporting whether the message was refused
+func (cs *ChatServer) checkSpam(ctx context.Context, client *Client, msg Message) bool {
+	if cs.spam == nil {
+		return false
+	}
+	now := cs.now()
+	reason, err := cs.spam.screen(&client.spam, msg.Content, now)
+	if err != nil {
+		client.logf("Refused message from %s (trace %s): %v", client.username, msg.Trace, err)
+		cs.sendError(ctx, client, err, refFor(msg))
+		cs.escalateSpam(ctx, client, reason, now)
+		return true
+	}
+	if reason != "" {
+		return cs.escalateSpam(ctx, client, reason, now)
+	}
+	return false
+}
+
+// screen applies a sender's penalty to a chat message and scores it. It
+// returns the reason the score rose, if it did, and the error refusing the
+// message, if the penalty refuses it.
+func (f *spamFilter) screen(s *spamState, content string, now time.Time) (string, error) {
+	s.decay(f, now)
+	var err error
+	switch {
+	case now.Before(s.mutedTill):
+		err = protocolErrorf(codeMuted, "muted for spam for another %s", s.mutedTill.Sub(now).Round(time.Second))
+	case s.penalty >= spamSlowed && now.Sub(s.lastSent) < f.cfg.SlowInterval:
+		err = protocolErrorf(codeRateLimited, "slow mode: wait %s between messages", f.cfg.SlowInterval)
+	}
+	if err != nil {
+		// Pushing through a penalty keeps raising the score
+		s.score += spamEvasionPoints
+		return "ignoring spam penalties", err
+	}
+
+	reason := s.scoreMessage(content, now)
+	s.lastSent = now
+	return reason, nil
+}
+
+// escalate applies the penalty a sender's score has reached and returns
+// it, reporting false if it isn't harsher than the current one
+func (f *spamFilter) escalate(s *spamState, now time.Time) (spamPenalty, bool) {
+	penalty := f.penaltyFor(s.score)
+	if penalty <= s.penalty {
+		return s.penalty, false
+	}
+	s.penalty = penalty
+	if penalty == spamMuted {
+		s.mutedTill = now.Add(f.cfg.MuteDuration)
+	}
+	metrics.Add(metricSpamPenalties+"_"+penalty.String(), 1)
+	return penalty, true
+}
+
+// escalateSpam applies the penalty a client's score has reached, if it is
+// harsher than the current one, and reports whether it stops the message
+// at hand: a mute or a disconnect does, so the message that earns one
+// isn't delivered
+func (cs *ChatServer) escalateSpam(ctx context.Context, client *Client, reason string, now time.Time) bool {
+	s := &client.spam
+	penalty, ok := cs.spam.escalate(s, now)
+	if !ok {
+		return false
+	}
+	detail := fmt.Sprintf("%s: %s (score %.0f)", penalty, reason, s.score)
+	client.logf("Spam penalty for %s: %s", client.username, detail)
+	cs.audit(AuditSpam, "system", client.id, detail)
+
+	var notice string
+	switch penalty {
+	case spamWarned:
+		notice = "Please slow down: your messages look like spam (" + reason + ")"
+	case spamSlowed:
+		notice = fmt.Sprintf("Slow mode: you may send one message every %s (%s)", cs.spam.cfg.SlowInterval, reason)
+	case spamMuted:
+		notice = fmt.Sprintf("You are muted for %s for spam (%s)", cs.spam.cfg.MuteDuration, reason)
+	case spamDisconnected:
+		client.close(websocket.StatusPolicyViolation, "disconnected for spam")
+		return true
+	}
+	wctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	err := client.writeMessage(wctx, Message{
+		Type:      "system",
+		Username:  "Server",
+		Content:   notice,
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+	})
+	if err != nil {
+		client.logf("Error sending spam notice to %s: %v", client.username, err)
+	}
+	return penalty >= spamMuted
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// readSpamNotice reads until the next server notice that isn't a join or
+// leave, or an error
+func readSpamNotice(t *testing.T, ctx context.Context, c *websocket.Conn) Message {
+	t.Helper()
+	for {
+		msg := readUntilType(t, ctx, c, "system")
+		if msg.Type == "error" || !strings.HasSuffix(msg.Content, "the chat") {
+			return msg
+		}
+	}
+}
+
+func TestSpamFilter_Escalation(t *testing.T) {
+	server := NewChatServer(WithSpamFilter(SpamConfig{WarnScore: 5.5, SlowScore: 11.5, SlowInterval: time.Millisecond * 50}))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+
+	send := func() { wsjson.Write(ctx, alice, Message{Type: "message", Content: "BUY  now"}) }
+	for range 2 {
+		send()
+		readUntilType(t, ctx, alice, "message")
+	}
+	// The third copy scores about 6 and earns a warning, but is still delivered
+	send()
+	if msg := readSpamNotice(t, ctx, alice); !strings.HasPrefix(msg.Content, "Please slow down") {
+		t.Fatalf("Expected a spam warning, got %+v", msg)
+	}
+	readUntilType(t, ctx, alice, "message")
+
+	send()
+	readUntilType(t, ctx, alice, "message")
+	send()
+	if msg := readSpamNotice(t, ctx, alice); !strings.HasPrefix(msg.Content, "Slow mode") {
+		t.Fatalf("Expected slow mode, got %+v", msg)
+	}
+	send()
+	if msg := readUntilType(t, ctx, alice, "error"); msg.Code != codeRateLimited {
+		t.Fatalf("Expected a message inside the slow mode interval to be refused, got %+v", msg)
+	}
+
+	// Keeping it up gets a mute, then a disconnect
+	for muted := false; !muted; {
+		time.Sleep(time.Millisecond * 60)
+		send()
+		var msg Message
+		if err := wsjson.Read(ctx, alice, &msg); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		switch {
+		case msg.Type == "error":
+			t.Fatalf("Expected the message through slow mode, got %+v", msg)
+		case msg.Type == "system" && strings.HasPrefix(msg.Content, "You are muted"):
+			muted = true
+		}
+	}
+	send()
+	if msg := readUntilType(t, ctx, alice, "error"); msg.Code != codeMuted {
+		t.Fatalf("Expected a muted client's message to be refused, got %+v", msg)
+	}
+	for {
+		send()
+		var msg Message
+		if err := wsjson.Read(ctx, alice, &msg); err != nil {
+			if websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+				t.Fatalf("Expected a policy violation close, got %v", err)
+			}
+			break
+		}
+	}
+
+	var penalties []string
+	for _, e := range server.auditLog.Before(0, 100).Entries {
+		if e.Action == AuditSpam {
+			penalties = append(penalties, strings.SplitN(e.Reason, ":", 2)[0])
+		}
+	}
+	if strings.Join(penalties, ",") != "warning,slow_mode,mute,disconnect" {
+		t.Errorf("Expected each penalty in the audit log, got %v", penalties)
+	}
+}
+
+func TestSpamFilter_Links(t *testing.T) {
+	var s spamState
+	now := time.Now()
+	if reason := s.scoreMessage("see https://a.example and https://b.example, https://c.example", now); reason != "too many links" || s.score != 2 {
+		t.Errorf("Expected 2 points for extra links, got %v for %q", s.score, reason)
+	}
+	if reason := s.scoreMessage("and https://d.example", now.Add(time.Second)); reason != "link flood" || s.score != 4 {
+		t.Errorf("Expected 2 more points for a link flood, got %v for %q", s.score, reason)
+	}
+	if reason := s.scoreMessage("hello", now.Add(time.Second*2)); reason != "" || s.score != 4 {
+		t.Errorf("Expected no points for a plain message, got %v for %q", s.score, reason)
+	}
+}
+
+func TestSpamFilter_JoinCycling(t *testing.T) {
+	server := NewChatServer(WithSpamFilter(SpamConfig{}))
+	now := time.Now()
+	var got []float64
+	for i := range 5 {
+		got = append(got, server.spam.noteJoin("203.0.113.9:4000", now.Add(time.Duration(i)*time.Second)))
+	}
+	if want := []float64{0, 0, 0, 4, 8}; !slices.Equal(got, want) {
+		t.Errorf("Expected join points %v, got %v", want, got)
+	}
+	if p := server.spam.noteJoin("203.0.113.10:4000", now); p != 0 {
+		t.Errorf("Expected another address to start clean, got %v", p)
+	}
+	if p := server.spam.noteJoin("203.0.113.9:4001", now.Add(spamJoinWindow*2)); p != 0 {
+		t.Errorf("Expected old joins to expire, got %v", p)
+	}
+}
@@ -15,6 +15,24 @@ document.addEventListener('DOMContentLoaded', () => {
     let socket = null;
     let activeUserCount = 0;
 
+    // A login through /auth/login comes back with a session token in the
+    // URL fragment. Keep it for reconnects, but out of the address bar.
+    const fragment = new URLSearchParams(window.location.hash.slice(1));
+    if (fragment.get('token')) {
+        sessionStorage.setItem('chatToken', fragment.get('token'));
+        history.replaceState(null, '', window.location.pathname + window.location.search);
+    }
+    let token = sessionStorage.getItem('chatToken');
+
+    // Offer single sign-on when the server has it configured
+    const ssoLink = document.getElementById('sso-login');
+    fetch('/auth/login', { method: 'HEAD' }).then((response) => {
+        if (response.status === 204) {
+            ssoLink.href = '/auth/login' + window.location.search;
+            ssoLink.classList.remove('d-none');
+        }
+    }).catch(() => {});
+
     // Login Form Submit
     loginForm.addEventListener('submit', (e) => {
         e.preventDefault();
@@ -24,6 +42,11 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     });
 
+    // Logged-in users skip the username form
+    if (token) {
+        connectToChat('');
+    }
+
     // Message Form Submit
     messageForm.addEventListener('submit', (e) => {
         e.preventDefault();
@@ -37,12 +60,21 @@ document.addEventListener('DOMContentLoaded', () => {
 
         // Create WebSocket connection
         const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-        const wsUrl = `${protocol}//${window.location.host}/ws?username=${encodeURIComponent(username)}`;
+        // Logged-in users are named by their session token
+        let wsUrl = token
+            ? `${protocol}//${window.location.host}/ws?token=${encodeURIComponent(token)}`
+            : `${protocol}//${window.location.host}/ws?username=${encodeURIComponent(username)}`;
+        const room = new URLSearchParams(window.location.search).get('room');
+        if (room) {
+            wsUrl += `&room=${encodeURIComponent(room)}`;
+        }
         
-        socket = new WebSocket(wsUrl);
+        socket = new WebSocket(wsUrl, ['chat.v2']);
+        let opened = false;
 
         // Connection opened
         socket.addEventListener('open', () => {
+            opened = true;
             // Update UI for connected state
             loginContainer.classList.add('d-none');
             chatMain.classList.remove('d-none');
@@ -62,6 +94,15 @@ document.addEventListener('DOMContentLoaded', () => {
         // Listen for socket closure
         socket.addEventListener('close', (event) => {
             updateConnectionStatus('disconnected', 'Disconnected');
+            if (!opened && token) {
+                // The session expired; log in again
+                sessionStorage.removeItem('chatToken');
+                token = null;
+                loginContainer.classList.remove('d-none');
+                chatMain.classList.add('d-none');
+                userCountElement.classList.add('d-none');
+                return;
+            }
             
             // Show reconnect option after a delay
             setTimeout(() => {
@@ -104,18 +145,49 @@ document.addEventListener('DOMContentLoaded', () => {
 
     // Display a message in the chat
     function displayMessage(message) {
+        // Large rooms send a member count instead of every join and leave
+        if (message.type === 'presence') {
+            countDisplay.textContent = message.count;
+            activeUserCount = message.count;
+            return;
+        }
+        
+        // The room state snapshot only carries a topic worth showing
+        if (message.type === 'room') {
+            if (!message.topic) {
+                return;
+            }
+            message = { type: 'system', content: 'Topic: ' + message.topic };
+        }
+        
         // Create message element
         const messageElement = document.createElement('div');
         messageElement.classList.add('message', 'mb-3');
         
+        // Drop everything shown from an erased user
+        if (message.type === 'tombstone') {
+            messagesContainer.querySelectorAll('.message[data-username="' + CSS.escape(message.old_username) + '"]')
+                .forEach((element) => element.remove());
+        }
+        
+        // Follow our own renames so our messages keep their styling
+        if (message.type === 'rename' && message.old_username === username) {
+            username = message.username;
+        }
+        
         // Add appropriate class based on message type
-        if (message.type === 'system') {
+        if (message.type === 'error') {
+            // Our last input was rejected
+            messageElement.classList.add('message-error', 'text-center', 'text-danger', 'small', 'py-2');
+            messageElement.textContent = message.content;
+        } else if (['system', 'rename', 'tombstone', 'topic', 'pin', 'unpin', 'announcement', 'status'].includes(message.type)) {
             // System message
             messageElement.classList.add('message-system', 'text-center', 'text-muted', 'small', 'py-2', 'fst-italic');
             messageElement.textContent = message.content;
         } else {
             // User message
             const isCurrentUser = message.username === username;
+            messageElement.dataset.username = message.username;
             
             if (isCurrentUser) {
                 messageElement.classList.add('message-user', 'alert', 'alert-primary', 'mw-75');
@@ -160,6 +232,11 @@ document.addEventListener('DOMContentLoaded', () => {
             messageElement.appendChild(contentDiv);
         }
         
+        // Trace IDs let bug reports be matched to server logs
+        if (message.trace) {
+            messageElement.title = 'trace ' + message.trace;
+        }
+        
         // Add to messages container
         messagesContainer.appendChild(messageElement);
         
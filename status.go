@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// User states set with "status" messages. Online is the default and is
+// never listed.
+const (
+	statusOnline    = "online"
+	statusAway      = "away"
+	statusBusy      = "busy"
+	statusInvisible = "invisible"
+
+	// statusOffline is what others see when a user turns invisible
+	statusOffline = "offline"
+)
+
+// maxAwayCheckInterval bounds how late an idle client is marked away
+const maxAwayCheckInterval = time.Second * 30
+
+// WithAutoAway marks clients away once they have sent nothing for d, until
+// they next send something. Zero disables it.
+func WithAutoAway(d time.Duration) Option {
+	return func(cs *ChatServer) {
+		cs.awayAfter = d
+	}
+}
+
+// publicStatus is the state others see for a user in state
+func publicStatus(state string) string {
+	switch state {
+	case "":
+		return statusOnline
+	case statusInvisible:
+		return statusOffline
+	}
+	return state
+}
+
+// visibleLocked reports whether the client appears in rosters and presence.
+// Callers hold ChatServer.clientsMtx.
+func (c *Client) visibleLocked() bool {
+	return !c.canary && c.status != statusInvisible
+}
+
+// statusesLocked returns the state of the given users that aren't simply
+// online. Callers hold ChatServer.clientsMtx.
+func (cs *ChatServer) statusesLocked(names []string) map[string]string {
+	var statuses map[string]string
+	for _, name := range names {
+		client, ok := cs.usernames[name]
+		if !ok || client.status == "" {
+			continue
+		}
+		if statuses == nil {
+			statuses = make(map[string]string)
+		}
+		statuses[name] = client.status
+	}
+	return statuses
+}
+
+// changeStatus applies update to the client under the clients lock and
+// tells everyone if the state others see changed. update reports whether
+// it changed anything.
+func (cs *ChatServer) changeStatus(client *Client, update func(c *Client) bool, trace string) {
+	cs.clientsMtx.Lock()
+	old := client.status
+	if !update(client) {
+		cs.clientsMtx.Unlock()
+		return
+	}
+	state := client.status
+	username := client.username
+	cs.clientsMtx.Unlock()
+
+	shown := publicStatus(state)
+	if publicStatus(old) == shown {
+		return
+	}
+	now := cs.now()
+	cs.publish(Message{
+		Type:      "status",
+		Username:  username,
+		Status:    shown,
+		Content:   fmt.Sprintf("%s is %s", username, shown),
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+		Trace:     trace,
+	})
+}
+
+// handleStatus processes a client's "status" message
+func (cs *ChatServer) handleStatus(ctx context.Context, client *Client, msg Message) {
+	switch msg.Status {
+	case statusOnline, statusAway, statusBusy, statusInvisible:
+	default:
+		err := protocolErrorf(codeInvalidStatus, "invalid status %q (online, away, busy or invisible)", msg.Status)
+		client.logf("Invalid status from %s (trace %s): %v", client.username, msg.Trace, err)
+		cs.sendError(ctx, client, err, &ErrorRef{Type: "status", Content: msg.Status, Trace: msg.Trace})
+		cs.noteRejection(client)
+		return
+	}
+	state := msg.Status
+	if state == statusOnline {
+		state = ""
+	}
+	cs.changeStatus(client, func(c *Client) bool {
+		c.status = state
+		c.autoAway = false
+		return true
+	}, msg.Trace)
+}
+
+// wake brings a client marked away automatically back online
+func (cs *ChatServer) wake(client *Client) {
+	cs.changeStatus(client, func(c *Client) bool {
+		if !c.autoAway {
+			return false
+		}
+		c.status = ""
+		c.autoAway = false
+		return true
+	}, "")
+}
+
+// runAutoAway periodically marks idle online clients away until ctx is
+// cancelled
+func (cs *ChatServer) runAutoAway(ctx context.Context) {
+	ticker := time.NewTicker(min(cs.awayAfter/2, maxAwayCheckInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		cutoff := cs.now().Add(-cs.awayAfter).UnixNano()
+		cs.clientsMtx.Lock()
+		var idle []*Client
+		for client := range cs.clients {
+			if !client.canary && client.status == "" && client.lastActive.Load() < cutoff {
+				idle = append(idle, client)
+			}
+		}
+		cs.clientsMtx.Unlock()
+
+		// Recheck under the lock, as the client may have spoken since
+		for _, client := range idle {
+			cs.changeStatus(client, func(c *Client) bool {
+				if c.status != "" || c.lastActive.Load() >= cutoff {
+					return false
+				}
+				c.status = statusAway
+				c.autoAway = true
+				return true
+			}, "")
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// dialStatusTest connects a v2 client and reads its join notice
+func dialStatusTest(t *testing.T, ctx context.Context, s *httptest.Server, username string) *websocket.Conn {
+	t.Helper()
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username="+username,
+		&websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to connect %s: %v", username, err)
+	}
+	t.Cleanup(func() { c.Close(websocket.StatusNormalClosure, "") })
+	var msg Message
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read join notice: %v", err)
+	}
+	return c
+}
+
+// readStatus reads until the next status event or error
+func readStatus(t *testing.T, ctx context.Context, c *websocket.Conn) Message {
+	t.Helper()
+	for {
+		var msg Message
+		if err := wsjson.Read(ctx, c, &msg); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if msg.Type == "status" || msg.Type == "error" {
+			return msg
+		}
+	}
+}
+
+func TestStatus_SetByClient(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+	bob := dialStatusTest(t, ctx, s, "bob")
+
+	wsjson.Write(ctx, bob, Message{Type: "status", Status: "sleeping"})
+	if msg := readStatus(t, ctx, bob); msg.Type != "error" || msg.Code != codeInvalidStatus {
+		t.Errorf("Expected an invalid_status error, got %+v", msg)
+	}
+
+	wsjson.Write(ctx, bob, Message{Type: "status", Status: statusBusy})
+	if msg := readStatus(t, ctx, alice); msg.Username != "bob" || msg.Status != statusBusy {
+		t.Errorf("Expected bob to be busy, got %+v", msg)
+	}
+	if page := server.roster(nil, "", 10); page.Statuses["bob"] != statusBusy || page.Statuses["alice"] != "" {
+		t.Errorf("Expected the roster to show bob busy, got %+v", page)
+	}
+
+	// Invisible users look like they left
+	wsjson.Write(ctx, bob, Message{Type: "status", Status: statusInvisible})
+	if msg := readStatus(t, ctx, alice); msg.Username != "bob" || msg.Status != statusOffline {
+		t.Errorf("Expected bob to appear offline, got %+v", msg)
+	}
+	if page := server.roster(nil, "", 10); slices.Contains(page.Members, "bob") {
+		t.Errorf("Expected bob to be hidden from the roster, got %+v", page)
+	}
+	if msg := server.presenceMessage(2); slices.Contains(msg.Members, "bob") {
+		t.Errorf("Expected bob to be hidden from presence, got %+v", msg.Members)
+	}
+}
+
+func TestStatus_AutoAway(t *testing.T) {
+	server := NewChatServer(WithAutoAway(time.Millisecond * 50))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	alice := dialStatusTest(t, ctx, s, "alice")
+
+	if msg := readStatus(t, ctx, alice); msg.Username != "alice" || msg.Status != statusAway {
+		t.Fatalf("Expected alice to go away when idle, got %+v", msg)
+	}
+
+	// Speaking brings her back before her message goes out
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "back"})
+	if msg := readStatus(t, ctx, alice); msg.Status != statusOnline {
+		t.Errorf("Expected alice to be back online, got %+v", msg)
+	}
+	var msg Message
+	if err := wsjson.Read(ctx, alice, &msg); err != nil || msg.Content != "back" {
+		t.Errorf("Expected alice's message after the status change, got %+v (%v)", msg, err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tapBuffer is how many frames a slow tap viewer may fall behind before
+// frames are dropped from its stream
+const tapBuffer = 256
+
+// TapFrame is one frame observed on a tapped connection
+type TapFrame struct {
+	Time      time.Time       `json:"time"`
+	Direction string          `json:"direction"`
+	Size      int             `json:"size"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// tap is a live, read-only observer of one connection's frames
+type tap struct {
+	frames chan TapFrame
+	redact bool
+}
+
+// clientTaps holds the taps attached to a client
+type clientTaps struct {
+	mu     sync.Mutex
+	taps   map[*tap]struct{}
+	closed bool
+}
+
+// attach adds a tap, unless the connection has already gone away
+func (ct *clientTaps) attach(t *tap) bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.closed {
+		return false
+	}
+	if ct.taps == nil {
+		ct.taps = make(map[*tap]struct{})
+	}
+	ct.taps[t] = struct{}{}
+	return true
+}
+
+// detach removes a tap
+func (ct *clientTaps) detach(t *tap) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	delete(ct.taps, t)
+}
+
+// close ends every tap when the connection closes
+func (ct *clientTaps) close() {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.closed = true
+	for t := range ct.taps {
+		close(t.frames)
+	}
+	ct.taps = nil
+}
+
+// observe copies a frame to every attached tap without blocking
+func (c *Client) observe(direction string, data []byte) {
+	c.taps.mu.Lock()
+	defer c.taps.mu.Unlock()
+	if len(c.taps.taps) == 0 {
+		return
+	}
+
+	now := time.Now()
+	for t := range c.taps.taps {
+		frame := TapFrame{Time: now, Direction: direction, Size: len(data)}
+		payload, err := tapPayload(c.codec, data, t.redact)
+		if err != nil {
+			frame.Error = err.Error()
+		} else {
+			frame.Payload = payload
+		}
+		select {
+		case t.frames <- frame:
+		default:
+		}
+	}
+}
+
+// tapPayload renders a frame as JSON for the tap stream, blanking message
+// content when redact is set
+func tapPayload(codec Codec, data []byte, redact bool) (json.RawMessage, error) {
+	if _, isJSON := codec.(jsonCodec); isJSON && !redact {
+		if !json.Valid(data) {
+			return json.Marshal(string(data))
+		}
+		// The client reuses its write buffer once the frame is sent
+		return bytes.Clone(data), nil
+	}
+
+	var v any
+	if err := codec.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("undecodable frame: %w", err)
+	}
+	if redact {
+		redactContent(v)
+	}
+	return json.Marshal(v)
+}
+
+// redactContent replaces every "content" field in a decoded frame
+func redactContent(v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if k == "content" {
+				v[k] = "[redacted]"
+				continue
+			}
+			redactContent(child)
+		}
+	case []any:
+		for _, child := range v {
+			redactContent(child)
+		}
+	}
+}
+
+// handleAdminTap serves GET /admin/tap?conn=<id>[&redact=true], streaming the
+// connection's frames as Server-Sent Events until either side goes away
+func (cs *ChatServer) handleAdminTap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	target := cs.clientByID(r.URL.Query().Get("conn"))
+	if target == nil {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+	redact, _ := strconv.ParseBool(r.URL.Query().Get("redact"))
+
+	t := &tap{frames: make(chan TapFrame, tapBuffer), redact: redact}
+	if !target.taps.attach(t) {
+		http.Error(w, "connection closed", http.StatusGone)
+		return
+	}
+	defer target.taps.detach(t)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case frame, ok := <-t.frames:
+			if !ok {
+				fmt.Fprint(w, "event: closed\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+			data, _ := json.Marshal(frame)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// clientByID finds a connected client by connection ID
+func (cs *ChatServer) clientByID(id string) *Client {
+	if id == "" {
+		return nil
+	}
+	cs.clientsMtx.Lock()
+	defer cs.clientsMtx.Unlock()
+	for client := range cs.clients {
+		if client.id == id {
+			return client
+		}
+	}
+	return nil
+}
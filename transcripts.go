@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transcriptChunk is how many messages are copied out of history at a time
+// while streaming an export
+const transcriptChunk = 500
+
+// transcriptWriter renders an exported room history in one format
+type transcriptWriter interface {
+	begin(room string, from, to time.Time) error
+	write(msg Message) error
+	end() error
+}
+
+// newTranscriptWriter returns the writer for format with its content type
+// and file extension
+func newTranscriptWriter(format string, w io.Writer) (transcriptWriter, string, string, error) {
+	switch format {
+	case "", "jsonl":
+		return &jsonlTranscript{enc: json.NewEncoder(w)}, "application/jsonl", "jsonl", nil
+	case "csv":
+		return &csvTranscript{w: csv.NewWriter(w)}, "text/csv; charset=utf-8", "csv", nil
+	case "html":
+		return &htmlTranscript{w: w}, "text/html; charset=utf-8", "html", nil
+	}
+	return nil, "", "", fmt.Errorf("unknown format %q (want jsonl, csv or html)", format)
+}
+
+// jsonlTranscript writes one message per line, as served by /api/history,
+// so signed exports can be checked with chat-cli verify
+type jsonlTranscript struct {
+	enc *json.Encoder
+}
+
+func (t *jsonlTranscript) begin(string, time.Time, time.Time) error { return nil }
+func (t *jsonlTranscript) write(msg Message) error                  { return t.enc.Encode(msg) }
+func (t *jsonlTranscript) end() error                               { return nil }
+
+// csvTranscript writes a header row and one row per message
+type csvTranscript struct {
+	w *csv.Writer
+}
+
+func (t *csvTranscript) begin(string, time.Time, time.Time) error {
+	return t.w.Write([]string{"seq", "id", "time", "type", "username", "content"})
+}
+
+func (t *csvTranscript) write(msg Message) error {
+	content := msg.Content
+	if msg.Ciphertext != "" {
+		content = "[encrypted]"
+	}
+	// Spreadsheets run cells starting with these as formulas
+	if content != "" && strings.ContainsRune("=+-@", rune(content[0])) {
+		content = "'" + content
+	}
+	return t.w.Write([]string{strconv.FormatUint(msg.Seq, 10), msg.ID, msg.Time, msg.Type, msg.Username, content})
+}
+
+func (t *csvTranscript) end() error {
+	t.w.Flush()
+	return t.w.Error()
+}
+
+// htmlTranscript writes a standalone, styled HTML page
+type htmlTranscript struct {
+	w io.Writer
+}
+
+var transcriptTemplate = template.Must(template.New("").Parse(`
+{{define "begin"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Room}} transcript</title>
+<style>
+body { font: 14px/1.5 system-ui, sans-serif; margin: 2em auto; max-width: 50em; color: #222; }
+h1 { font-size: 1.4em; margin-bottom: 0; }
+.range { color: #777; margin-top: 0; }
+.msg { display: flex; gap: 0.75em; padding: 0.2em 0; border-bottom: 1px solid #eee; }
+.time { color: #999; white-space: nowrap; font-variant-numeric: tabular-nums; }
+.user { font-weight: 600; white-space: nowrap; }
+.text { white-space: pre-wrap; overflow-wrap: anywhere; }
+.system .text, .system .user { color: #777; font-style: italic; }
+</style>
+</head>
+<body>
+<h1>#{{.Room}}</h1>
+<p class="range">{{.From}} – {{.To}}</p>
+{{end}}
+{{define "msg"}}<div class="msg {{.Type}}"><span class="time">{{.Time}}</span><span class="user">{{.Username}}</span><span class="text">{{.Content}}</span></div>
+{{end}}
+{{define "end"}}</body>
+</html>
+{{end}}`))
+
+func (t *htmlTranscript) begin(room string, from, to time.Time) error {
+	data := struct{ Room, From, To string }{Room: room, From: "beginning", To: "now"}
+	if !from.IsZero() {
+		data.From = from.UTC().Format(time.RFC3339)
+	}
+	if !to.IsZero() {
+		data.To = to.UTC().Format(time.RFC3339)
+	}
+	return transcriptTemplate.ExecuteTemplate(t.w, "begin", data)
+}
+
+func (t *htmlTranscript) write(msg Message) error {
+	if msg.Ciphertext != "" {
+		msg.Content = "[encrypted]"
+	}
+	return transcriptTemplate.ExecuteTemplate(t.w, "msg", msg)
+}
+
+func (t *htmlTranscript) end() error {
+	return transcriptTemplate.ExecuteTemplate(t.w, "end", nil)
+}
+
+// parseExportTime parses an RFC 3339 time or a date. A date ends at the end
+// of that day when it bounds the end of the range.
+func parseExportTime(v string, end bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q (want RFC 3339 or YYYY-MM-DD)", v)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// handleAdminExport serves GET /admin/export?room=R&from=T&to=T&format=F,
+// streaming a room's stored history between from (inclusive) and to
+// (exclusive) as JSON Lines, CSV or an HTML transcript
+func (cs *ChatServer) handleAdminExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	name := query.Get("room")
+	if name == "" {
+		name = lobbyRoom
+	}
+	history := cs.history
+	if name != lobbyRoom {
+		room := cs.lookupRoom(name)
+		if room == nil {
+			http.Error(w, errRoomNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		history = room.history
+	}
+	from, err := parseExportTime(query.Get("from"), false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseExportTime(query.Get("to"), true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	out, contentType, ext, err := newTranscriptWriter(query.Get("format"), w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, name, ext))
+	w.Header().Set("Cache-Control", "no-store")
+	rc := http.NewResponseController(w)
+	n, err := exportHistory(history, name, from, to, out, func() { rc.Flush() })
+	if err != nil {
+		// Headers are gone, so all that's left is cutting the stream short
+		log.Printf("Export of %s failed after %d messages: %v", name, n, err)
+		return
+	}
+	log.Printf("Exported %d messages from %s", n, name)
+}
+
+// exportHistory writes the messages stored between from and to, a chunk
+// at a time so a large history is never copied whole, calling flush after
+// each chunk
+func exportHistory(h *History, room string, from, to time.Time, out transcriptWriter, flush func()) (int, error) {
+	if err := out.begin(room, from, to); err != nil {
+		return 0, err
+	}
+	n := 0
+	for after := uint64(0); ; {
+		chunk := h.After(after, transcriptChunk)
+		if len(chunk) == 0 {
+			break
+		}
+		for _, msg := range chunk {
+			ts := time.UnixMilli(msg.Timestamp)
+			if !from.IsZero() && ts.Before(from) || !to.IsZero() && !ts.Before(to) {
+				continue
+			}
+			if err := out.write(msg); err != nil {
+				return n, err
+			}
+			n++
+		}
+		after = chunk[len(chunk)-1].Seq
+		flush()
+	}
+	return n, out.end()
+}
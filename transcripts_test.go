@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminExport(t *testing.T) {
+	server := NewChatServer(WithAdminToken("secret"))
+	day := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, content := range []string{"before", `=HYPERLINK("x")`, "<script>alert(1)</script>", "after"} {
+		ts := day.AddDate(0, 0, i-1)
+		server.history.Append(Message{Type: "message", Username: "alice", Content: content, Time: ts.Format(time.RFC3339), Timestamp: ts.UnixMilli(), ID: newMessageID()})
+	}
+	handler := server.requireAdmin(server.handleAdminExport)
+	export := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/admin/export?"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	// A date as the end of the range includes that whole day
+	rec := export("from=2024-03-01&to=2024-03-02")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/jsonl" {
+		t.Fatalf("Expected JSON Lines, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	lines := 0
+	for scanner := bufio.NewScanner(rec.Body); scanner.Scan(); lines++ {
+	}
+	if lines != 2 {
+		t.Errorf("Expected 2 messages in range, got %d", lines)
+	}
+
+	rows, err := csv.NewReader(export("format=csv").Body).ReadAll()
+	if err != nil || len(rows) != 5 || rows[0][5] != "content" {
+		t.Fatalf("Expected a header and 4 rows, got %q (%v)", rows, err)
+	}
+	if !strings.HasPrefix(rows[2][5], "'=") {
+		t.Errorf("Expected formulas to be defused, got %q", rows[2][5])
+	}
+
+	html := export("format=html&from=2024-03-02T00:00:00Z").Body.String()
+	if !strings.Contains(html, "<!DOCTYPE html>") || !strings.Contains(html, "&lt;script&gt;") || strings.Contains(html, "<script>") {
+		t.Errorf("Expected an escaped HTML transcript, got %s", html)
+	}
+	if strings.Contains(html, "before") || !strings.Contains(html, "after") {
+		t.Errorf("Expected only messages from the range, got %s", html)
+	}
+
+	for query, want := range map[string]int{
+		"format=pdf":   http.StatusBadRequest,
+		"from=monday":  http.StatusBadRequest,
+		"room=nowhere": http.StatusNotFound,
+	} {
+		if rec := export(query); rec.Code != want {
+			t.Errorf("Expected %d for %s, got %d", want, query, rec.Code)
+		}
+	}
+}
+
+func TestHistory_After(t *testing.T) {
+	h := NewHistory(3)
+	for range 5 {
+		h.Append(Message{Type: "message"})
+	}
+	// Only seq 3-5 are still stored
+	if got := h.After(0, 10); len(got) != 3 || got[0].Seq != 3 {
+		t.Errorf("Expected seq 3-5, got %+v", got)
+	}
+	if got := h.After(3, 1); len(got) != 1 || got[0].Seq != 4 {
+		t.Errorf("Expected seq 4, got %+v", got)
+	}
+	if got := h.After(5, 10); len(got) != 0 {
+		t.Errorf("Expected nothing after the last message, got %+v", got)
+	}
+}
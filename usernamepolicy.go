@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// defaultReservedUsernames can never be claimed without logging in, as
+// they would pass for the server itself
+var defaultReservedUsernames = []string{"admin", "server", "system"}
+
+// UsernamePolicy sets which usernames clients may pick
+type UsernamePolicy struct {
+	// Unicode allows letters and digits from any script instead of only
+	// ASCII. Names are NFKC-normalized, may not mix scripts, and may not
+	// be told apart from a name in use only by case or lookalike
+	// characters.
+	Unicode bool
+	// MaxLength is the longest name allowed, in characters, or
+	// maxUsernameLength if zero
+	MaxLength int
+	// Reserved names, on top of defaultReservedUsernames, can't be claimed
+	// by clients that haven't logged in. Case and lookalike characters
+	// don't get around them.
+	Reserved []string
+}
+
+// WithUsernamePolicy sets which usernames clients may pick
+func WithUsernamePolicy(p UsernamePolicy) Option {
+	return func(cs *ChatServer) {
+		cs.usernamePolicy = p
+	}
+}
+
+// maxLength returns the longest name allowed, in characters
+func (p UsernamePolicy) maxLength() int {
+	if p.MaxLength > 0 {
+		return p.MaxLength
+	}
+	return maxUsernameLength
+}
+
+// normalize returns the form of name the server registers
+func (p UsernamePolicy) normalize(name string) string {
+	if !p.Unicode {
+		return name
+	}
+	return norm.NFKC.String(name)
+}
+
+// reserved reports whether name is, or looks like, a reserved name
+func (p UsernamePolicy) reserved(name string) bool {
+	skeleton := usernameSkeleton(name)
+	for _, r := range slices.Concat(defaultReservedUsernames, p.Reserved) {
+		if usernameSkeleton(r) == skeleton {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUnicode checks a Unicode name's characters and scripts
+func checkUnicode(name string) error {
+	scripts := make(map[string]bool)
+	for _, r := range name {
+		if !usernameRune(r) {
+			return protocolErrorf(codeInvalidUsername, "username contains invalid characters (only letters, numbers, underscore, and hyphen allowed)")
+		}
+		if script := scriptOf(r); script != "" {
+			scripts[script] = true
+		}
+	}
+	if !singleScript(scripts) {
+		return protocolErrorf(codeInvalidUsername, "username mixes letters from different scripts")
+	}
+	return nil
+}
+
+// usernameRune reports whether r may appear in a Unicode name
+func usernameRune(r rune) bool {
+	return r == '_' || r == '-' || unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsDigit(r)
+}
+
+// couldBeUsername reports whether name could be a username under any
+// policy, for checks made without the server's policy at hand
+func couldBeUsername(name string) bool {
+	return name != "" && !strings.ContainsFunc(name, func(r rune) bool { return !usernameRune(r) })
+}
+
+// scriptOf names the script of r, or "" for characters shared between
+// scripts such as digits and combining marks
+func scriptOf(r rune) string {
+	for name, table := range unicode.Scripts {
+		if name != "Common" && name != "Inherited" && unicode.Is(table, r) {
+			return name
+		}
+	}
+	return ""
+}
+
+// scriptGroups are scripts written together, so names mixing them are
+// allowed
+var scriptGroups = [][]string{
+	{"Han", "Hiragana", "Katakana"},
+	{"Han", "Hangul"},
+	{"Han", "Bopomofo"},
+}
+
+// singleScript reports whether scripts are one script, or scripts that are
+// written together
+func singleScript(scripts map[string]bool) bool {
+	if len(scripts) <= 1 {
+		return true
+	}
+	for _, group := range scriptGroups {
+		inGroup := true
+		for script := range scripts {
+			inGroup = inGroup && slices.Contains(group, script)
+		}
+		if inGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// confusables maps characters that look like Latin letters or digits to
+// what they look like
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'с': 'c', 'ԁ': 'd', 'е': 'e', 'һ': 'h', 'і': 'i', 'ј': 'j',
+	'ӏ': 'l', 'о': 'o', 'р': 'p', 'ԛ': 'q', 'ѕ': 's', 'ԝ': 'w', 'х': 'x',
+	'у': 'y',
+	// Greek
+	'α': 'a', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'υ': 'u',
+	'χ': 'x',
+	// Latin and digits
+	'ɡ': 'g', 'ı': 'i', '0': 'o', '1': 'l',
+}
+
+// usernameSkeleton reduces name to what it looks like, so names that only
+// differ in case, width or lookalike characters have the same skeleton
+func usernameSkeleton(name string) string {
+	name = strings.ToLower(norm.NFKC.String(name))
+	var b strings.Builder
+	b.Grow(len(name))
+	for _, r := range name {
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// spoofed refuses a frame that names a sender other than the client,
+// reporting whether it did. Clients needn't set username at all; the
+// server fills it in.
+func (cs *ChatServer) spoofed(ctx context.Context, client *Client, msg Message) bool {
+	if msg.Username == "" || msg.Username == client.username {
+		return false
+	}
+	metrics.Add(metricSpoofed, 1)
+	client.logf("Refused %s from %s claiming to be %q (trace %s)", msg.Type, client.username, msg.Username, msg.Trace)
+	cs.sendError(ctx, client, protocolErrorf(codeImpersonation, "you are %s, not %s", client.username, msg.Username), refFor(msg))
+	cs.noteRejection(client)
+	return true
+}
+
+// nameTakenLocked reports whether another client holds name or, under a
+// Unicode policy, a name that looks the same. Callers hold clientsMtx.
+func (cs *ChatServer) nameTakenLocked(name string, client *Client) bool {
+	if holder, ok := cs.usernames[name]; ok && holder != client {
+		return true
+	}
+	if !cs.usernamePolicy.Unicode {
+		return false
+	}
+	holder, ok := cs.skeletons[usernameSkeleton(name)]
+	return ok && holder != client
+}
+
+// holdNameLocked registers name for client. Callers hold clientsMtx.
+func (cs *ChatServer) holdNameLocked(name string, client *Client) {
+	cs.usernames[name] = client
+	if cs.usernamePolicy.Unicode {
+		cs.skeletons[usernameSkeleton(name)] = client
+	}
+}
+
+// dropNameLocked unregisters name, which client held. Callers hold
+// clientsMtx.
+func (cs *ChatServer) dropNameLocked(name string, client *Client) {
+	delete(cs.usernames, name)
+	if skeleton := usernameSkeleton(name); cs.usernamePolicy.Unicode && cs.skeletons[skeleton] == client {
+		delete(cs.skeletons, skeleton)
+	}
+}
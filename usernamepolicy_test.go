@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestUsernamePolicy_Validate(t *testing.T) {
+	ascii := NewChatServer()
+	unicodeNames := NewChatServer(WithUsernamePolicy(UsernamePolicy{Unicode: true, MaxLength: 5}))
+	testCases := []struct {
+		name    string
+		ascii   bool
+		unicode bool
+	}{
+		{"alice", true, true},
+		{"José", false, true},
+		{"山田太郎", false, true},
+		{"やまだ太郎", false, true},
+		{"김민준", false, true},
+		{"Ольга", false, true},
+		// Latin with a Cyrillic а
+		{"pаypal", false, false},
+		{"bob!", false, false},
+		{"Zoë_12", false, false},
+		// Five characters, though far more bytes
+		{"ааааа", false, true},
+		{"аааааа", false, false},
+	}
+	for _, tc := range testCases {
+		if err := ascii.validateUsername(tc.name); (err == nil) != tc.ascii {
+			t.Errorf("Expected ASCII policy to accept %q: %v, got %v", tc.name, tc.ascii, err)
+		}
+		if err := unicodeNames.validateUsername(unicodeNames.usernamePolicy.normalize(tc.name)); (err == nil) != tc.unicode {
+			t.Errorf("Expected Unicode policy to accept %q: %v, got %v", tc.name, tc.unicode, err)
+		}
+	}
+}
+
+func TestUsernamePolicy_Reserved(t *testing.T) {
+	p := UsernamePolicy{Reserved: []string{"moderator"}}
+	for _, name := range []string{"admin", "Server", "SYSTEM", "Moderator", "m0derator", "аdmin", "ＡＤＭＩＮ"} {
+		if !p.reserved(name) {
+			t.Errorf("Expected %q to be reserved", name)
+		}
+	}
+	for _, name := range []string{"alice", "admins", "serverless"} {
+		if p.reserved(name) {
+			t.Errorf("Expected %q to be free", name)
+		}
+	}
+}
+
+func TestUsernamePolicy_Connect(t *testing.T) {
+	server := NewChatServer(WithUsernamePolicy(UsernamePolicy{Unicode: true}))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	dial := func(username string) (*websocket.Conn, int) {
+		t.Helper()
+		c, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"?username="+url.QueryEscape(username), nil)
+		if err != nil {
+			if resp == nil {
+				t.Fatalf("Failed to connect %s: %v", username, err)
+			}
+			return nil, resp.StatusCode
+		}
+		t.Cleanup(func() { c.CloseNow() })
+		return c, http.StatusSwitchingProtocols
+	}
+
+	// Full-width letters are registered in their NFKC form
+	dial("ｊｏｓé")
+	waitFor(t, "josé to join", func() bool {
+		_, ok := server.Client("josé")
+		return ok
+	})
+	paco, _ := dial("paco")
+	waitFor(t, "paco to join", func() bool {
+		_, ok := server.Client("paco")
+		return ok
+	})
+	// Lookalikes of a name in use are taken, and mixing scripts is refused
+	if _, status := dial("jоsé"); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for mixed scripts, got %d", status)
+	}
+	for _, name := range []string{"José", "расо"} {
+		if _, status := dial(name); status != http.StatusConflict {
+			t.Errorf("Expected 409 for %q, got %d", name, status)
+		}
+	}
+	if _, status := dial("Admin"); status != http.StatusConflict {
+		t.Errorf("Expected 409 for a reserved name, got %d", status)
+	}
+	if _, status := dial("Ольга"); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected a Cyrillic name to be accepted, got %d", status)
+	}
+
+	// Once paco leaves, names that look like his are free
+	paco.Close(websocket.StatusNormalClosure, "")
+	waitFor(t, "paco to leave", func() bool {
+		_, ok := server.Client("paco")
+		return !ok
+	})
+	if _, status := dial("расо"); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected a lookalike of a name given up to be accepted, got %d", status)
+	}
+}
+
+func TestUsernamePolicy_ReservedForLogins(t *testing.T) {
+	server := NewChatServer(
+		WithUsernamePolicy(UsernamePolicy{Reserved: []string{"moderator"}}),
+		WithAuthenticator(tokenAuth{
+			"mod-token":   {Username: "moderator"},
+			"guest-token": {Username: "Moderator", Guest: true},
+		}),
+	)
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	_, resp, err := websocket.Dial(ctx, wsURL+"?token=guest-token", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 for a guest taking a reserved name, got %v", err)
+	}
+	c, _, err := websocket.Dial(ctx, wsURL+"?token=mod-token", nil)
+	if err != nil {
+		t.Fatalf("Expected the logged-in moderator to connect: %v", err)
+	}
+	c.CloseNow()
+}
+
+func TestImpersonation(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	bob := dialStatusTest(t, ctx, s, "bob")
+
+	spoofed := metricValue(metricSpoofed)
+	for _, username := range []string{"alice", "Server"} {
+		if err := wsjson.Write(ctx, bob, Message{Type: "message", Username: username, Content: "trust me"}); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+		if msg := readUntilType(t, ctx, bob, "message"); msg.Type != "error" || msg.Code != codeImpersonation {
+			t.Errorf("Expected an impersonation error for %s, got %+v", username, msg)
+		}
+	}
+	if got := metricValue(metricSpoofed) - spoofed; got != 2 {
+		t.Errorf("Expected 2 spoofed frames counted, got %d", got)
+	}
+
+	// Naming yourself is harmless
+	if err := wsjson.Write(ctx, bob, Message{Type: "message", Username: "bob", Content: "it's me"}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if msg := readUntilType(t, ctx, bob, "message"); msg.Type != "message" || msg.Username != "bob" {
+		t.Errorf("Expected bob's message, got %+v", msg)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// claimUsername registers username for client if nobody else holds or
+// has reserved it
+func (cs *ChatServer) claimUsername(username string, client *Client) error {
+	cs.clientsMtx.Lock()
+	defer cs.clientsMtx.Unlock()
+
+	if cs.nameTakenLocked(username, client) {
+		return fmt.Errorf("username %q is already taken", username)
+	}
+	if cs.reservedLocked(username, client) {
+		return fmt.Errorf("username %q was recently given up and is reserved", username)
+	}
+	cs.holdNameLocked(username, client)
+	return nil
+}
+
+// claimGeneratedUsername picks and registers an unused guest name for
+// client. Names the generator proposes that are invalid or taken are
+// skipped, and if it keeps proposing them the name gets a suffix long
+// enough not to collide.
+func (cs *ChatServer) claimGeneratedUsername(client *Client) string {
+	for range guestNameAttempts {
+		username := cs.guestNames.Username()
+		if username != "" && cs.validateUsername(username) == nil && !cs.usernamePolicy.reserved(username) && cs.claimUsername(username, client) == nil {
+			return username
+		}
+	}
+	for {
+		username := "User-" + guestSuffix(guestSuffixLength*2)
+		if cs.claimUsername(username, client) == nil {
+			return username
+		}
+	}
+}
+
+// releaseUsername frees the name held by client
+func (cs *ChatServer) releaseUsername(client *Client) {
+	cs.clientsMtx.Lock()
+	defer cs.clientsMtx.Unlock()
+
+	if cs.usernames[client.username] == client {
+		cs.dropNameLocked(client.username, client)
+	}
+}
+
+// parseRename reports whether msg is a rename request (either a "rename"
+// message or a "/nick newname" command) and returns the requested name
+func parseRename(msg Message) (string, bool) {
+	if msg.Type == "rename" {
+		return strings.TrimSpace(msg.Content), true
+	}
+	if msg.Type != "" && msg.Type != "message" {
+		return "", false
+	}
+	rest, ok := strings.CutPrefix(msg.Content, "/nick")
+	if !ok || (rest != "" && rest[0] != ' ') {
+		return "", false
+	}
+	return strings.TrimSpace(rest), true
+}
+
+// renameClient atomically moves client to newName in the username registry
+func (cs *ChatServer) renameClient(client *Client, newName string) (string, error) {
+	if newName == "" {
+		return "", protocolErrorf(codeRenameRejected, "usage: /nick newname")
+	}
+	if client.authenticated {
+		return "", protocolErrorf(codeRenameRejected, "your name comes from your login and can't be changed")
+	}
+	if err := cs.validateUsername(newName); err != nil {
+		return "", err
+	}
+	if cs.usernamePolicy.reserved(newName) {
+		return "", protocolErrorf(codeUsernameReserved, "username %q is reserved", newName)
+	}
+
+	cs.clientsMtx.Lock()
+	defer cs.clientsMtx.Unlock()
+
+	oldName := client.username
+	if newName == oldName {
+		return "", protocolErrorf(codeRenameRejected, "you are already known as %s", newName)
+	}
+	if wait := client.lastRename.Add(cs.renameCooldown).Sub(cs.now()); wait > 0 {
+		return "", protocolErrorf(codeRenameCooldown, "you can change your name again in %s", wait.Round(time.Second))
+	}
+	if cs.nameTakenLocked(newName, client) {
+		return "", protocolErrorf(codeUsernameTaken, "username %q is already taken", newName)
+	}
+	if cs.reservedLocked(newName, client) {
+		return "", protocolErrorf(codeUsernameReserved, "username %q was recently given up and is reserved", newName)
+	}
+	cs.dropNameLocked(oldName, client)
+	delete(cs.reserved, newName)
+	cs.holdNameLocked(newName, client)
+	client.username = newName
+	client.lastRename = cs.now()
+	client.guest = false
+
+	// Hold the old name so nobody else can pick it up straight away
+	if cs.renameReserve > 0 {
+		cs.reserved[oldName] = reservation{connID: client.id, until: client.lastRename.Add(cs.renameReserve)}
+	}
+	return oldName, nil
+}
+
+// handleRename processes a rename request and announces the change
+func (cs *ChatServer) handleRename(ctx context.Context, client *Client, newName, trace string) {
+	newName = cs.usernamePolicy.normalize(newName)
+	oldName, err := cs.renameClient(client, newName)
+	if err != nil {
+		client.logf("Rename by %s rejected (trace %s): %v", client.username, trace, err)
+		cs.sendError(ctx, client, err, &ErrorRef{Type: "rename", Content: newName, Length: len(newName), Trace: trace})
+		return
+	}
+
+	client.logf("Client %s renamed to %s (trace %s)", oldName, newName, trace)
+	cs.renames.add(RenameRecord{
+		Time:         cs.now(),
+		ConnectionID: client.id,
+		OldUsername:  oldName,
+		NewUsername:  newName,
+		Trace:        trace,
+	})
+	now := cs.now()
+	cs.publish(Message{
+		Type:        "rename",
+		Username:    newName,
+		OldUsername: oldName,
+		Content:     fmt.Sprintf("%s is now known as %s", oldName, newName),
+		Time:        now.Format(time.RFC3339),
+		Timestamp:   now.UnixMilli(),
+		Trace:       trace,
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestParseRename(t *testing.T) {
+	tests := []struct {
+		msg    Message
+		want   string
+		wantOK bool
+	}{
+		{Message{Type: "message", Content: "/nick bob"}, "bob", true},
+		{Message{Content: "/nick   bob  "}, "bob", true},
+		{Message{Type: "message", Content: "/nick"}, "", true},
+		{Message{Type: "rename", Content: "bob"}, "bob", true},
+		{Message{Type: "message", Content: "/nickname bob"}, "", false},
+		{Message{Type: "message", Content: "hello /nick bob"}, "", false},
+		{Message{Type: "system", Content: "/nick bob"}, "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseRename(tt.msg)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseRename(%+v) = %q, %v; want %q, %v", tt.msg, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestChatServer_DuplicateUsernameRejected(t *testing.T) {
+	server := NewChatServer()
+	server.Run(t.Context())
+
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c, _, err := websocket.Dial(ctx, wsURL+"?username=alice", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	_, resp, err := websocket.Dial(ctx, wsURL+"?username=alice", nil)
+	if err == nil {
+		t.Fatal("Expected second connection with the same username to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 Conflict, got %v", resp)
+	}
+}
+
+func TestChatServer_Rename(t *testing.T) {
+	server := NewChatServer(WithRenameLimits(0, 0))
+	server.Run(t.Context())
+
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c1, _, err := websocket.Dial(ctx, wsURL+"?username=alice", &websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to connect client 1: %v", err)
+	}
+	defer c1.Close(websocket.StatusNormalClosure, "")
+	var msg Message
+	if err := wsjson.Read(ctx, c1, &msg); err != nil {
+		t.Fatalf("Failed to read welcome message: %v", err)
+	}
+
+	c2, _, err := websocket.Dial(ctx, wsURL+"?username=bob", &websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to connect client 2: %v", err)
+	}
+	defer c2.Close(websocket.StatusNormalClosure, "")
+	if err := wsjson.Read(ctx, c2, &msg); err != nil {
+		t.Fatalf("Failed to read welcome message: %v", err)
+	}
+	if err := wsjson.Read(ctx, c1, &msg); err != nil {
+		t.Fatalf("Failed to read join message: %v", err)
+	}
+
+	// Renaming to a taken name is refused privately
+	if err := wsjson.Write(ctx, c1, Message{Type: "message", Content: "/nick bob"}); err != nil {
+		t.Fatalf("Failed to send rename: %v", err)
+	}
+	if err := wsjson.Read(ctx, c1, &msg); err != nil {
+		t.Fatalf("Failed to read rename error: %v", err)
+	}
+	if msg.Type != "error" || msg.Code != codeUsernameTaken || !strings.Contains(msg.Content, "already taken") {
+		t.Errorf("Expected rename error, got: %+v", msg)
+	}
+
+	// A valid rename is announced to everyone
+	if err := wsjson.Write(ctx, c1, Message{Type: "message", Content: "/nick carol"}); err != nil {
+		t.Fatalf("Failed to send rename: %v", err)
+	}
+	for _, c := range []*websocket.Conn{c1, c2} {
+		if err := wsjson.Read(ctx, c, &msg); err != nil {
+			t.Fatalf("Failed to read rename event: %v", err)
+		}
+		if msg.Type != "rename" || msg.Username != "carol" || msg.OldUsername != "alice" {
+			t.Errorf("Unexpected rename event: %+v", msg)
+		}
+	}
+
+	// Subsequent messages carry the new name, and without a reservation the
+	// old one is free again
+	if err := wsjson.Write(ctx, c1, Message{Type: "message", Content: "hi"}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if err := wsjson.Read(ctx, c2, &msg); err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if msg.Username != "carol" {
+		t.Errorf("Expected message from carol, got: %+v", msg)
+	}
+
+	c3, _, err := websocket.Dial(ctx, wsURL+"?username=alice", nil)
+	if err != nil {
+		t.Fatalf("Expected old name to be reusable: %v", err)
+	}
+	c3.Close(websocket.StatusNormalClosure, "")
+}
+
+func TestChatServer_RenameLimits(t *testing.T) {
+	server := NewChatServer(WithRenameLimits(time.Hour, time.Hour), WithAdminToken("secret"))
+	server.Run(t.Context())
+	s := newAdminTestServer(t, server)
+
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c, _, err := websocket.Dial(ctx, wsURL+"?username=alice", &websocket.DialOptions{Subprotocols: []string{subprotocolV2}})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+	var msg Message
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read welcome message: %v", err)
+	}
+
+	if err := wsjson.Write(ctx, c, Message{Type: "rename", Content: "carol"}); err != nil {
+		t.Fatalf("Failed to send rename: %v", err)
+	}
+	if err := wsjson.Read(ctx, c, &msg); err != nil || msg.Type != "rename" {
+		t.Fatalf("Expected rename event, got %+v, %v", msg, err)
+	}
+
+	// A second rename within the cooldown is refused
+	if err := wsjson.Write(ctx, c, Message{Type: "rename", Content: "alice"}); err != nil {
+		t.Fatalf("Failed to send rename: %v", err)
+	}
+	if err := wsjson.Read(ctx, c, &msg); err != nil {
+		t.Fatalf("Failed to read rename error: %v", err)
+	}
+	if msg.Type != "error" || msg.Code != codeRenameCooldown {
+		t.Errorf("Expected cooldown error, got: %+v", msg)
+	}
+
+	// Nobody else may pick up the abandoned name
+	_, resp, err := websocket.Dial(ctx, wsURL+"?username=alice", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 for reserved name, got %v", err)
+	}
+
+	// Moderators can see the rename history
+	resp = adminRequest(t, ctx, http.MethodGet, s.URL+"/admin/renames?username=alice", "secret")
+	defer resp.Body.Close()
+	var records []RenameRecord
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		t.Fatalf("Failed to decode rename history: %v", err)
+	}
+	if len(records) != 1 || records[0].OldUsername != "alice" || records[0].NewUsername != "carol" || records[0].ConnectionID == "" {
+		t.Errorf("Unexpected rename history: %+v", records)
+	}
+}
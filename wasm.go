@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+const (
+	// wasmPageSize is the size of a WebAssembly memory page
+	wasmPageSize = 64 << 10
+	// defaultWASMMemory and defaultWASMTimeout bound a WASM plugin's memory
+	// and the time it may spend on one event
+	defaultWASMMemory  = 16 << 20
+	defaultWASMTimeout = time.Millisecond * 100
+	// maxWASMEmits caps the messages a WASM plugin may send per event
+	maxWASMEmits = 10
+)
+
+// WASMLimits bounds what a WASM plugin may use
+type WASMLimits struct {
+	// Memory is the most linear memory, in bytes, the plugin may have
+	Memory uint32
+	// Timeout is how long the plugin may run for one event before it is
+	// stopped and restarted
+	Timeout time.Duration
+}
+
+// wasmEvent is what a WASM plugin's on_event export receives, as JSON
+type wasmEvent struct {
+	// Type is "connect", "disconnect", "message" or "command"
+	Type     string   `json:"type"`
+	Username string   `json:"username,omitempty"`
+	Room     string   `json:"room,omitempty"`
+	Message  *Message `json:"message,omitempty"`
+	Command  string   `json:"command,omitempty"`
+	Args     string   `json:"args,omitempty"`
+}
+
+// wasmEmit is what a WASM plugin passes to the chat.emit import, as JSON.
+// A missing room answers in the event's room; To sends privately.
+type wasmEmit struct {
+	Room    *string `json:"room"`
+	Content string  `json:"content"`
+	To      string  `json:"to"`
+}
+
+// wasmPlugin runs an untrusted WebAssembly module as a plugin. The module
+// only reaches the outside world through the chat.emit import, and WASI
+// without a file system, network or environment.
+//
+// The module exports memory, alloc(size i32) i32, which returns where the
+// host may write an event of that size, and on_event(ptr, len i32), which
+// handles the event JSON found there. It may also export commands() i64,
+// returning the pointer to a JSON array of slash command names in the high
+// 32 bits and its length in the low 32 bits.
+type wasmPlugin struct {
+	name     string
+	commands []string
+	limits   WASMLimits
+
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+
+	// Only the plugin's goroutine touches the instance and the state of
+	// the event being handled
+	mod   api.Module
+	bot   *Bot
+	room  string
+	emits int
+
+	closeOnce sync.Once
+}
+
+// NewWASMPlugin compiles the WebAssembly module at path into a plugin
+// named after the file
+func NewWASMPlugin(ctx context.Context, path string, limits WASMLimits) (Plugin, error) {
+	wasm, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading WASM plugin: %w", err)
+	}
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	return newWASMPlugin(ctx, name, wasm, limits)
+}
+
+func newWASMPlugin(ctx context.Context, name string, wasm []byte, limits WASMLimits) (*wasmPlugin, error) {
+	if limits.Memory == 0 {
+		limits.Memory = defaultWASMMemory
+	}
+	if limits.Timeout <= 0 {
+		limits.Timeout = defaultWASMTimeout
+	}
+	p := &wasmPlugin{name: name, limits: limits}
+	p.runtime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(max(limits.Memory/wasmPageSize, 1)).
+		WithCloseOnContextDone(true))
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, p.runtime); err != nil {
+		p.runtime.Close(ctx)
+		return nil, err
+	}
+	_, err := p.runtime.NewHostModuleBuilder("chat").
+		NewFunctionBuilder().WithFunc(p.emit).Export("emit").
+		Instantiate(ctx)
+	if err != nil {
+		p.runtime.Close(ctx)
+		return nil, err
+	}
+	if p.compiled, err = p.runtime.CompileModule(ctx, wasm); err != nil {
+		p.runtime.Close(ctx)
+		return nil, fmt.Errorf("compiling WASM plugin %s: %w", name, err)
+	}
+	for _, export := range []string{"alloc", "on_event"} {
+		if _, ok := p.compiled.ExportedFunctions()[export]; !ok {
+			p.runtime.Close(ctx)
+			return nil, fmt.Errorf("WASM plugin %s doesn't export %s", name, export)
+		}
+	}
+	if err := p.instantiate(ctx); err != nil {
+		p.runtime.Close(ctx)
+		return nil, err
+	}
+	if p.mod.Memory() == nil {
+		p.runtime.Close(ctx)
+		return nil, fmt.Errorf("WASM plugin %s doesn't export its memory", name)
+	}
+	if err := p.loadCommands(ctx); err != nil {
+		p.runtime.Close(ctx)
+		return nil, err
+	}
+	return p, nil
+}
+
+// instantiate starts a fresh instance of the module, replacing any
+// previous one
+func (p *wasmPlugin) instantiate(ctx context.Context) error {
+	if p.mod != nil {
+		p.mod.Close(ctx)
+		p.mod = nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.limits.Timeout)
+	defer cancel()
+	mod, err := p.runtime.InstantiateModule(ctx, p.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+	if err != nil {
+		return fmt.Errorf("starting WASM plugin %s: %w", p.name, err)
+	}
+	p.mod = mod
+	return nil
+}
+
+// loadCommands asks the module for the slash commands it answers
+func (p *wasmPlugin) loadCommands(ctx context.Context) error {
+	fn := p.mod.ExportedFunction("commands")
+	if fn == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.limits.Timeout)
+	defer cancel()
+	res, err := fn.Call(ctx)
+	if err != nil || len(res) != 1 {
+		return fmt.Errorf("WASM plugin %s: listing commands: %v", p.name, err)
+	}
+	ptr, size := uint32(res[0]>>32), uint32(res[0])
+	data, ok := p.mod.Memory().Read(ptr, size)
+	if !ok || json.Unmarshal(data, &p.commands) != nil {
+		return fmt.Errorf("WASM plugin %s: commands() returned invalid JSON", p.name)
+	}
+	return nil
+}
+
+// emit is the chat.emit import: it sends the message described by the
+// JSON at ptr
+func (p *wasmPlugin) emit(ctx context.Context, m api.Module, ptr, size uint32) {
+	if p.bot == nil {
+		return
+	}
+	if p.emits++; p.emits > maxWASMEmits {
+		if p.emits == maxWASMEmits+1 {
+			log.Printf("WASM plugin %s sent more than %d messages for one event, dropping the rest", p.name, maxWASMEmits)
+		}
+		return
+	}
+	data, ok := m.Memory().Read(ptr, size)
+	var out wasmEmit
+	if !ok || json.Unmarshal(data, &out) != nil || out.Content == "" {
+		log.Printf("WASM plugin %s emitted an invalid message", p.name)
+		return
+	}
+	room := p.room
+	if out.Room != nil {
+		room = *out.Room
+	}
+	if out.To != "" {
+		p.bot.Whisper(room, out.To, out.Content)
+	} else {
+		p.bot.Say(room, out.Content)
+	}
+}
+
+// deliver hands an event to the module. A module that traps or runs out
+// of time is restarted, losing its state, for the next event.
+func (p *wasmPlugin) deliver(ctx context.Context, bot *Bot, ev wasmEvent) {
+	if p.mod == nil {
+		if err := p.instantiate(ctx); err != nil {
+			log.Print(err)
+			return
+		}
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	p.bot, p.room, p.emits = bot, ev.Room, 0
+	defer func() { p.bot = nil }()
+	ctx, cancel := context.WithTimeout(ctx, p.limits.Timeout)
+	defer cancel()
+	err = p.call(ctx, data)
+	if err != nil {
+		log.Printf("WASM plugin %s failed on a %s event, restarting it: %v", p.name, ev.Type, err)
+		p.mod.Close(ctx)
+		p.mod = nil
+	}
+}
+
+// call writes data into the module's memory and passes it to on_event
+func (p *wasmPlugin) call(ctx context.Context, data []byte) error {
+	res, err := p.mod.ExportedFunction("alloc").Call(ctx, uint64(len(data)))
+	if err != nil {
+		return err
+	}
+	if len(res) != 1 {
+		return errors.New("alloc returned no pointer")
+	}
+	ptr := uint32(res[0])
+	if !p.mod.Memory().Write(ptr, data) {
+		return fmt.Errorf("alloc returned %d, outside memory", ptr)
+	}
+	_, err = p.mod.ExportedFunction("on_event").Call(ctx, uint64(ptr), uint64(len(data)))
+	return err
+}
+
+func (p *wasmPlugin) Name() string       { return p.name }
+func (p *wasmPlugin) Commands() []string { return p.commands }
+
+func (p *wasmPlugin) OnConnect(ctx context.Context, bot *Bot, ev PresenceEvent) {
+	p.deliver(ctx, bot, wasmEvent{Type: "connect", Username: ev.Username, Room: ev.Room})
+}
+
+func (p *wasmPlugin) OnMessage(ctx context.Context, bot *Bot, msg Message) {
+	p.deliver(ctx, bot, wasmEvent{Type: "message", Username: msg.Username, Room: msg.Room, Message: &msg})
+}
+
+func (p *wasmPlugin) OnCommand(ctx context.Context, bot *Bot, cmd Command) {
+	p.deliver(ctx, bot, wasmEvent{Type: "command", Username: cmd.Username, Room: cmd.Room, Command: cmd.Name, Args: cmd.Args})
+}
+
+func (p *wasmPlugin) OnDisconnect(ctx context.Context, bot *Bot, ev PresenceEvent) {
+	p.deliver(ctx, bot, wasmEvent{Type: "disconnect", Username: ev.Username, Room: ev.Room})
+}
+
+// Close releases the module and its runtime
+func (p *wasmPlugin) Close() error {
+	var err error
+	p.closeOnce.Do(func() { err = p.runtime.Close(context.Background()) })
+	return err
+}
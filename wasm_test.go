@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket/wsjson"
+)
+
+// Bodies of a test module's on_event export
+var (
+	// wasmPong emits the JSON at address 0
+	wasmPong = []byte{0x41, 0x00, 0x41, byte(len(wasmPongJSON)), 0x10, 0x00}
+	// wasmSpin loops forever
+	wasmSpin = []byte{0x03, 0x40, 0x0c, 0x00, 0x0b}
+)
+
+const (
+	wasmPongJSON     = `{"content":"pong"}`
+	wasmCommandsJSON = `["ping"]`
+)
+
+func uleb(n uint64) []byte {
+	var b []byte
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n != 0 {
+			b = append(b, c|0x80)
+			continue
+		}
+		return append(b, c)
+	}
+}
+
+func sleb(n int64) []byte {
+	var b []byte
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if (n == 0 && c&0x40 == 0) || (n == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func wasmVec(items ...[]byte) []byte {
+	b := uleb(uint64(len(items)))
+	for _, item := range items {
+		b = append(b, item...)
+	}
+	return b
+}
+
+func wasmName(s string) []byte {
+	return append(uleb(uint64(len(s))), s...)
+}
+
+func wasmSection(id byte, content []byte) []byte {
+	return append(append([]byte{id}, uleb(uint64(len(content)))...), content...)
+}
+
+func wasmBody(code []byte) []byte {
+	body := append(append([]byte{0x00}, code...), 0x0b)
+	return append(uleb(uint64(len(body))), body...)
+}
+
+// wasmModule assembles a plugin module importing chat.emit and exporting
+// memory, alloc, on_event with the given body and commands
+func wasmModule(onEvent []byte, pages byte) []byte {
+	commands := uint64(64)<<32 | uint64(len(wasmCommandsJSON))
+	m := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	m = append(m, wasmSection(1, wasmVec(
+		[]byte{0x60, 0x02, 0x7f, 0x7f, 0x00},
+		[]byte{0x60, 0x01, 0x7f, 0x01, 0x7f},
+		[]byte{0x60, 0x00, 0x01, 0x7e},
+	))...)
+	m = append(m, wasmSection(2, wasmVec(append(append(wasmName("chat"), wasmName("emit")...), 0x00, 0x00)))...)
+	m = append(m, wasmSection(3, wasmVec([]byte{0x01}, []byte{0x00}, []byte{0x02}))...)
+	m = append(m, wasmSection(5, wasmVec([]byte{0x00, pages}))...)
+	m = append(m, wasmSection(7, wasmVec(
+		append(wasmName("memory"), 0x02, 0x00),
+		append(wasmName("alloc"), 0x00, 0x01),
+		append(wasmName("on_event"), 0x00, 0x02),
+		append(wasmName("commands"), 0x00, 0x03),
+	))...)
+	m = append(m, wasmSection(10, wasmVec(
+		wasmBody([]byte{0x41, 0x80, 0x08}),
+		wasmBody(onEvent),
+		wasmBody(append([]byte{0x42}, sleb(int64(commands))...)),
+	))...)
+	m = append(m, wasmSection(11, wasmVec(
+		append([]byte{0x00, 0x41, 0x00, 0x0b}, wasmName(wasmPongJSON)...),
+		append([]byte{0x00, 0x41, 0xc0, 0x00, 0x0b}, wasmName(wasmCommandsJSON)...),
+	))...)
+	return m
+}
+
+func TestWASMPlugin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	p, err := newWASMPlugin(ctx, "pong", wasmModule(wasmPong, 1), WASMLimits{})
+	if err != nil {
+		t.Fatalf("Failed to load WASM plugin: %v", err)
+	}
+	if !slices.Equal(p.Commands(), []string{"ping"}) {
+		t.Errorf("Expected the module's commands, got %v", p.Commands())
+	}
+
+	server := NewChatServer(WithPlugins(p))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	alice := dialStatusTest(t, ctx, s, "alice")
+	if msg := readFrom(t, ctx, alice, "pong"); msg.Content != "pong" || !msg.Bot {
+		t.Errorf("Expected the module to answer the connect event, got %+v", msg)
+	}
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "/ping"})
+	if msg := readFrom(t, ctx, alice, "pong"); msg.Content != "pong" {
+		t.Errorf("Expected the module to answer its command, got %+v", msg)
+	}
+}
+
+func TestWASMPlugin_Limits(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := newWASMPlugin(ctx, "big", wasmModule(wasmPong, 2), WASMLimits{Memory: wasmPageSize}); err == nil {
+		t.Errorf("Expected a module needing more memory than allowed to be refused")
+	}
+
+	p, err := newWASMPlugin(ctx, "spin", wasmModule(wasmSpin, 1), WASMLimits{Timeout: time.Millisecond * 50})
+	if err != nil {
+		t.Fatalf("Failed to load WASM plugin: %v", err)
+	}
+	defer p.Close()
+	bot := &Bot{name: "spin", cs: NewChatServer()}
+	started := time.Now()
+	p.OnMessage(ctx, bot, Message{Type: "message", Content: "hi"})
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Expected a spinning module to be stopped, took %s", elapsed)
+	}
+	if p.mod != nil {
+		t.Errorf("Expected the stopped module to be dropped for a fresh instance")
+	}
+	p.OnMessage(ctx, bot, Message{Type: "message", Content: "again"})
+	if p.mod != nil {
+		t.Errorf("Expected the restarted module to be stopped again")
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// webPushTTL is how long push services keep an undelivered notification
+	webPushTTL = 24 * 60 * 60
+	// webPushRecordSize is the aes128gcm record size; notifications always
+	// fit in one record
+	webPushRecordSize = 4096
+)
+
+// WebPushProvider sends notifications through browser push services using
+// Web Push (RFC 8030) with VAPID (RFC 8292) and aes128gcm payload
+// encryption (RFC 8291)
+type WebPushProvider struct {
+	key     *ecdsa.PrivateKey
+	subject string
+	client  *http.Client
+}
+
+// NewWebPushProvider signs requests with key, identifying the operator to
+// push services by subject, a mailto: or https: URL
+func NewWebPushProvider(key *ecdsa.PrivateKey, subject string) *WebPushProvider {
+	return &WebPushProvider{key: key, subject: subject, client: &http.Client{Timeout: pushTimeout}}
+}
+
+// LoadVAPIDKey reads a PEM encoded P-256 key from path, generating and
+// saving one if the file doesn't exist. Subscriptions are bound to the key,
+// so it must survive restarts.
+func LoadVAPIDKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+			return nil, fmt.Errorf("saving VAPID key: %w", err)
+		}
+		return key, nil
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("%s: VAPID keys must be P-256", path)
+	}
+	return key, nil
+}
+
+// PublicKey returns the application server key browsers subscribe with,
+// base64url encoded
+func (p *WebPushProvider) PublicKey() string {
+	pub, _ := p.key.PublicKey.ECDH()
+	return base64.RawURLEncoding.EncodeToString(pub.Bytes())
+}
+
+// Push encrypts payload for the subscription and posts it to its push
+// service
+func (p *WebPushProvider) Push(ctx context.Context, sub PushSubscription, payload []byte) error {
+	body, err := encryptWebPush(sub, payload)
+	if err != nil {
+		return err
+	}
+	auth, err := p.vapid(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprint(webPushTTL))
+	req.Header.Set("Urgency", "high")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errSubscriptionGone
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("push service returned %s", resp.Status)
+	}
+	return nil
+}
+
+// vapid builds the Authorization header identifying us to the push
+// service behind endpoint
+func (p *WebPushProvider) vapid(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]any{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(time.Hour * 12).Unix(),
+		"sub": p.subject,
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, p.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return fmt.Sprintf("vapid t=%s.%s, k=%s", unsigned, base64.RawURLEncoding.EncodeToString(sig), p.PublicKey()), nil
+}
+
+// encryptWebPush encrypts payload for the subscription's browser as a
+// single aes128gcm record
+func encryptWebPush(sub PushSubscription, payload []byte) ([]byte, error) {
+	uaBytes, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Keys.P256DH, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Keys.Auth, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth secret: %w", err)
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+	secret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	cek, nonce, err := webPushKeys(secret, authSecret, salt, uaBytes, asPublic)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Header: salt, record size, key ID length and our public key
+	out := make([]byte, 0, 16+4+1+len(asPublic)+len(payload)+1+gcm.Overhead())
+	out = append(out, salt...)
+	out = binary.BigEndian.AppendUint32(out, webPushRecordSize)
+	out = append(out, byte(len(asPublic)))
+	out = append(out, asPublic...)
+	// 0x02 pads and marks the last record
+	plaintext := append(append([]byte(nil), payload...), 0x02)
+	return gcm.Seal(out, nonce, plaintext, nil), nil
+}
+
+// webPushKeys derives the content encryption key and nonce from the shared
+// secret (RFC 8291 section 3.4)
+func webPushKeys(secret, authSecret, salt, uaPublic, asPublic []byte) (cek, nonce []byte, err error) {
+	keyInfo := "WebPush: info\x00" + string(uaPublic) + string(asPublic)
+	ikm, err := hkdf.Key(sha256.New, secret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cek, err = hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16); err != nil {
+		return nil, nil, err
+	}
+	nonce, err = hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	return cek, nonce, err
+}
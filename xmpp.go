@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// xmppUserPrefix starts the chat usernames of XMPP users
+	xmppUserPrefix = "xmpp-"
+	// xmppListenerNick is the nick the bridge reads each MUC room as
+	xmppListenerNick = "chat-bridge"
+	xmppQueueSize    = 1024
+	xmppMaxBackoff   = time.Second * 30
+	xmppTimeout      = time.Second * 10
+)
+
+// XMPPConfig configures an XMPPBridge, connecting to the server as an
+// external component (XEP-0114)
+type XMPPConfig struct {
+	// Addr is the server's component port, e.g. localhost:5347
+	Addr string
+	// Domain is the component's domain, e.g. chat.example.org
+	Domain string
+	Secret string
+	// Rooms maps chat rooms, with "lobby" for the lobby, to MUC rooms such
+	// as ops@conference.example.org
+	Rooms map[string]string
+}
+
+// XMPPBridge relays messages, joins and leaves between chat rooms and MUC
+// rooms. Chat users join the MUC as <username>@<domain> with their
+// username as nick, and MUC occupants appear in chat as xmpp-<nick>.
+type XMPPBridge struct {
+	cfg    XMPPConfig
+	byMUC  map[string]string
+	queue  chan bridgeEvent
+	cs     *ChatServer
+	dialer net.Dialer
+
+	// mu guards the per-connection MUC state
+	mu sync.Mutex
+	// puppets holds the nicks our chat users have in each MUC room
+	puppets map[string]map[string]bool
+	// occupants holds the other occupants of each MUC room, and ready the
+	// rooms whose initial occupant list has been received
+	occupants map[string]map[string]bool
+	ready     map[string]bool
+}
+
+// NewXMPPBridge checks cfg and returns a bridge for WithXMPPBridge
+func NewXMPPBridge(cfg XMPPConfig) (*XMPPBridge, error) {
+	if cfg.Addr == "" || cfg.Domain == "" || cfg.Secret == "" {
+		return nil, fmt.Errorf("xmpp bridge needs a server address, component domain and secret")
+	}
+	if len(cfg.Rooms) == 0 {
+		return nil, fmt.Errorf("xmpp bridge needs at least one room")
+	}
+	b := &XMPPBridge{cfg: cfg, byMUC: make(map[string]string), queue: make(chan bridgeEvent, xmppQueueSize)}
+	for room, muc := range cfg.Rooms {
+		if room == lobbyRoom {
+			room = ""
+		}
+		b.byMUC[muc] = room
+	}
+	return b, nil
+}
+
+// ParseXMPPRooms parses "room=muc@conference.example.org,..." into a room
+// map
+func ParseXMPPRooms(s string) (map[string]string, error) {
+	rooms := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		room, muc, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || room == "" || !strings.Contains(muc, "@") {
+			return nil, fmt.Errorf("invalid xmpp room mapping %q (want room=muc@conference.example.org)", pair)
+		}
+		rooms[room] = muc
+	}
+	return rooms, nil
+}
+
+// WithXMPPBridge mirrors the bridge's rooms to XMPP MUC rooms
+func WithXMPPBridge(b *XMPPBridge) Option {
+	return func(cs *ChatServer) {
+		b.cs = cs
+		WithBridge(b)(cs)
+	}
+}
+
+// muc returns the MUC room a chat room is mirrored to
+func (b *XMPPBridge) muc(room string) (string, bool) {
+	if room == "" {
+		room = lobbyRoom
+	}
+	muc, ok := b.cfg.Rooms[room]
+	return muc, ok
+}
+
+// listener is the JID the bridge reads the MUC rooms as
+func (b *XMPPBridge) listener() string {
+	return "bridge@" + b.cfg.Domain + "/bridge"
+}
+
+// relay queues a chat event for the XMPP server, unless it came from XMPP
+// or its room isn't mirrored
+func (b *XMPPBridge) relay(ev bridgeEvent) {
+	if strings.HasPrefix(ev.username, xmppUserPrefix) {
+		return
+	}
+	if _, ok := b.muc(ev.room); !ok {
+		return
+	}
+	select {
+	case b.queue <- ev:
+	default:
+		log.Printf("XMPP queue full, dropping %s from %s", ev.kind, ev.username)
+	}
+}
+
+// run keeps a component connection up until ctx is done, reconnecting with
+// backoff
+func (b *XMPPBridge) run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := b.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("XMPP bridge disconnected: %v", err)
+		if time.Since(start) > xmppMaxBackoff {
+			backoff = time.Second
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, xmppMaxBackoff)
+	}
+}
+
+// xmppStanza is a top-level element of the component stream
+type xmppStanza struct {
+	XMLName xml.Name
+	From    string    `xml:"from,attr"`
+	To      string    `xml:"to,attr"`
+	Type    string    `xml:"type,attr"`
+	Body    string    `xml:"body"`
+	Delay   *struct{} `xml:"urn:xmpp:delay delay"`
+	Status  []struct {
+		Code string `xml:"code,attr"`
+	} `xml:"http://jabber.org/protocol/muc#user x>status"`
+}
+
+// session runs one component connection until it fails or ctx is done
+func (b *XMPPBridge) session(ctx context.Context) error {
+	dialCtx, cancel := context.WithTimeout(ctx, xmppTimeout)
+	conn, err := b.dialer.DialContext(dialCtx, "tcp", b.cfg.Addr)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	dec := xml.NewDecoder(conn)
+	conn.SetDeadline(time.Now().Add(xmppTimeout))
+	if err := b.handshake(conn, dec); err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("XMPP bridge connected to %s as %s", b.cfg.Addr, b.cfg.Domain)
+
+	b.mu.Lock()
+	b.puppets = make(map[string]map[string]bool)
+	b.occupants = make(map[string]map[string]bool)
+	b.ready = make(map[string]bool)
+	b.mu.Unlock()
+	for muc := range b.byMUC {
+		if err := b.write(conn, presence(b.listener(), muc+"/"+xmppListenerNick, "")); err != nil {
+			return err
+		}
+	}
+
+	readErr := make(chan error, 1)
+	go func() { readErr <- b.read(dec) }()
+	for {
+		select {
+		case ev := <-b.queue:
+			if err := b.send(conn, ev); err != nil {
+				return err
+			}
+		case err := <-readErr:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// handshake opens the stream and authenticates with the shared secret
+func (b *XMPPBridge) handshake(conn net.Conn, dec *xml.Decoder) error {
+	if _, err := fmt.Fprintf(conn, "<?xml version='1.0'?><stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' to='%s'>", escapeXML(b.cfg.Domain)); err != nil {
+		return err
+	}
+	var id string
+	for id == "" {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Local == "stream" {
+			for _, attr := range start.Attr {
+				if attr.Name.Local == "id" {
+					id = attr.Value
+				}
+			}
+			if id == "" {
+				return errors.New("stream header without id")
+			}
+		}
+	}
+	digest := sha1.Sum([]byte(id + b.cfg.Secret))
+	if _, err := fmt.Fprintf(conn, "<handshake>%s</handshake>", hex.EncodeToString(digest[:])); err != nil {
+		return err
+	}
+	var reply xmppStanza
+	if err := decodeStanza(dec, &reply); err != nil {
+		return err
+	}
+	if reply.XMLName.Local != "handshake" {
+		return fmt.Errorf("server refused the component: %s", reply.XMLName.Local)
+	}
+	return nil
+}
+
+// decodeStanza reads the next top-level element of the stream
+func decodeStanza(dec *xml.Decoder, v *xmppStanza) error {
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			return dec.DecodeElement(v, &tok)
+		case xml.EndElement:
+			return io.EOF
+		}
+	}
+}
+
+// read relays MUC traffic addressed to the listener until the stream ends
+func (b *XMPPBridge) read(dec *xml.Decoder) error {
+	for {
+		var st xmppStanza
+		if err := decodeStanza(dec, &st); err != nil {
+			return err
+		}
+		if st.XMLName.Local == "error" {
+			return fmt.Errorf("stream error from server")
+		}
+		if st.To != b.listener() {
+			// Our puppets get their own copy of everything
+			continue
+		}
+		muc, nick, _ := strings.Cut(st.From, "/")
+		room, ok := b.byMUC[muc]
+		if !ok || nick == "" || nick == xmppListenerNick {
+			if st.XMLName.Local == "presence" && nick == xmppListenerNick && st.hasStatus("110") {
+				b.mu.Lock()
+				b.ready[muc] = true
+				b.mu.Unlock()
+			}
+			continue
+		}
+
+		b.mu.Lock()
+		if b.puppets[muc][nick] {
+			b.mu.Unlock()
+			continue
+		}
+		switch st.XMLName.Local {
+		case "message":
+			b.mu.Unlock()
+			if st.Type == "groupchat" && st.Body != "" && st.Delay == nil {
+				b.publish(room, xmppUserPrefix+nick, "message", st.Body)
+			}
+		case "presence":
+			if b.occupants[muc] == nil {
+				b.occupants[muc] = make(map[string]bool)
+			}
+			present := b.occupants[muc][nick]
+			ready := b.ready[muc]
+			if st.Type == "unavailable" {
+				delete(b.occupants[muc], nick)
+			} else if st.Type == "" {
+				b.occupants[muc][nick] = true
+			}
+			b.mu.Unlock()
+			// The occupant list sent when the listener joins isn't news
+			switch {
+			case !ready:
+			case st.Type == "" && !present:
+				b.publish(room, xmppUserPrefix+nick, "join", "")
+			case st.Type == "unavailable" && present:
+				b.publish(room, xmppUserPrefix+nick, "leave", "")
+			}
+		default:
+			b.mu.Unlock()
+		}
+	}
+}
+
+// hasStatus reports whether a MUC presence carries the status code
+func (st *xmppStanza) hasStatus(code string) bool {
+	for _, s := range st.Status {
+		if s.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// publish relays an XMPP message, join or leave to a chat room
+func (b *XMPPBridge) publish(room, nick, kind, body string) {
+	now := b.cs.now()
+	msg := Message{
+		Type:      "message",
+		Username:  sanitizeUsername(nick),
+		Content:   body,
+		Room:      room,
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.UnixMilli(),
+		Trace:     newTraceID(),
+	}
+	switch kind {
+	case "join":
+		msg.Type, msg.Username, msg.Content = "system", "Server", fmt.Sprintf("%s has joined the chat", msg.Username)
+	case "leave":
+		msg.Type, msg.Username, msg.Content = "system", "Server", fmt.Sprintf("%s has left the chat", msg.Username)
+	}
+	msg.Content = truncateMessage(strings.ToValidUTF8(msg.Content, ""), b.cs.messageLimit)
+	if err := msg.validate(b.cs.messageLimit); err != nil {
+		log.Printf("Dropping XMPP %s from %s (trace %s): %v", kind, nick, msg.Trace, err)
+		return
+	}
+	if msg.Type == "message" {
+		if err := b.cs.admitBridged(&msg); err != nil {
+			log.Printf("Dropping XMPP %s from %s (trace %s): %v", kind, nick, msg.Trace, err)
+			return
+		}
+	}
+	if !b.cs.publish(msg) {
+		log.Printf("Dropping XMPP %s from %s (trace %s): hub busy", kind, nick, msg.Trace)
+	}
+}
+
+// send relays one chat event as the user's MUC occupant
+func (b *XMPPBridge) send(conn net.Conn, ev bridgeEvent) error {
+	muc, _ := b.muc(ev.room)
+	from := ev.username + "@" + b.cfg.Domain + "/chat"
+	occupant := muc + "/" + ev.username
+
+	b.mu.Lock()
+	joined := b.puppets[muc][ev.username]
+	switch {
+	case ev.kind == "leave":
+		delete(b.puppets[muc], ev.username)
+	case !joined:
+		if b.puppets[muc] == nil {
+			b.puppets[muc] = make(map[string]bool)
+		}
+		b.puppets[muc][ev.username] = true
+	}
+	b.mu.Unlock()
+
+	if ev.kind == "leave" {
+		if !joined {
+			return nil
+		}
+		return b.write(conn, presence(from, occupant, "unavailable"))
+	}
+	if !joined {
+		if err := b.write(conn, presence(from, occupant, "")); err != nil {
+			return err
+		}
+	}
+	if ev.kind != "message" {
+		return nil
+	}
+	return b.write(conn, fmt.Sprintf("<message from='%s' to='%s' type='groupchat' id='%s'><body>%s</body></message>",
+		escapeXML(from), escapeXML(muc), escapeXML(ev.id), escapeXML(ev.content)))
+}
+
+// write sends a stanza
+func (b *XMPPBridge) write(conn net.Conn, stanza string) error {
+	conn.SetWriteDeadline(time.Now().Add(xmppTimeout))
+	_, err := io.WriteString(conn, stanza)
+	return err
+}
+
+// presence builds a MUC join or, with typ "unavailable", leave
+func presence(from, to, typ string) string {
+	if typ != "" {
+		return fmt.Sprintf("<presence from='%s' to='%s' type='%s'/>", escapeXML(from), escapeXML(to), escapeXML(typ))
+	}
+	return fmt.Sprintf("<presence from='%s' to='%s'><x xmlns='http://jabber.org/protocol/muc'><history maxstanzas='0'/></x></presence>", escapeXML(from), escapeXML(to))
+}
+
+// escapeXML escapes s for use in XML text and attributes
+func escapeXML(s string) string {
+	var sb strings.Builder
+	xml.EscapeText(&sb, []byte(s))
+	return sb.String()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestParseXMPPRooms(t *testing.T) {
+	rooms, err := ParseXMPPRooms("lobby=ops@conference.example.org, rust=rust@conference.example.org")
+	if err != nil || rooms["lobby"] != "ops@conference.example.org" || rooms["rust"] != "rust@conference.example.org" {
+		t.Errorf("Unexpected rooms %v (%v)", rooms, err)
+	}
+	if _, err := ParseXMPPRooms("lobby=ops"); err == nil {
+		t.Error("Expected an error for a MUC room without a domain")
+	}
+}
+
+func TestXMPPBridge(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	bridge, err := NewXMPPBridge(XMPPConfig{
+		Addr:   lis.Addr().String(),
+		Domain: "chat.example.org",
+		Secret: "s3cret",
+		Rooms:  map[string]string{"lobby": "ops@conference.example.org"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewChatServer(WithXMPPBridge(bridge))
+	server.Run(t.Context())
+	s := httptest.NewServer(http.HandlerFunc(server.handleConnection))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// Play the XMPP server's side of the component protocol
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept the component: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	dec := xml.NewDecoder(conn)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			t.Fatalf("Failed to read the stream header: %v", err)
+		}
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Local == "stream" {
+			break
+		}
+	}
+	io.WriteString(conn, "<?xml version='1.0'?><stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' from='chat.example.org' id='abc123'>")
+	next := func() xmppStanza {
+		t.Helper()
+		var st xmppStanza
+		if err := decodeStanza(dec, &st); err != nil {
+			t.Fatalf("Failed to read a stanza: %v", err)
+		}
+		return st
+	}
+	digest := sha1.Sum([]byte("abc123s3cret"))
+	var handshake struct {
+		XMLName xml.Name
+		Digest  string `xml:",chardata"`
+	}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			t.Fatalf("Failed to read the handshake: %v", err)
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			dec.DecodeElement(&handshake, &start)
+			break
+		}
+	}
+	if handshake.XMLName.Local != "handshake" || handshake.Digest != hex.EncodeToString(digest[:]) {
+		t.Fatalf("Expected the handshake digest, got %+v", handshake)
+	}
+	io.WriteString(conn, "<handshake/>")
+
+	listener := "bridge@chat.example.org/bridge"
+	if st := next(); st.XMLName.Local != "presence" || st.From != listener || st.To != "ops@conference.example.org/chat-bridge" {
+		t.Fatalf("Expected the listener to join the MUC, got %+v", st)
+	}
+	// carol is already in the room, so she isn't announced
+	fmt.Fprintf(conn, "<presence from='ops@conference.example.org/carol' to='%s'/>", listener)
+	fmt.Fprintf(conn, "<presence from='ops@conference.example.org/chat-bridge' to='%s'><x xmlns='http://jabber.org/protocol/muc#user'><status code='110'/></x></presence>", listener)
+
+	alice := dialStatusTest(t, ctx, s, "alice")
+	if st := next(); st.XMLName.Local != "presence" || st.From != "alice@chat.example.org/chat" || st.To != "ops@conference.example.org/alice" {
+		t.Errorf("Expected alice's puppet to join the MUC, got %+v", st)
+	}
+	wsjson.Write(ctx, alice, Message{Type: "message", Content: "hello <xmpp> & co"})
+	if st := next(); st.XMLName.Local != "message" || st.From != "alice@chat.example.org/chat" || st.Type != "groupchat" || st.Body != "hello <xmpp> & co" {
+		t.Errorf("Expected alice's message from her puppet, got %+v", st)
+	}
+
+	// History, our puppet's echo and copies sent to puppets are skipped
+	fmt.Fprintf(conn, "<message from='ops@conference.example.org/dave' to='%s' type='groupchat'><body>old</body><delay xmlns='urn:xmpp:delay' stamp='2024-01-01T00:00:00Z'/></message>", listener)
+	fmt.Fprintf(conn, "<message from='ops@conference.example.org/alice' to='%s' type='groupchat'><body>echo</body></message>", listener)
+	fmt.Fprintf(conn, "<message from='ops@conference.example.org/dave' to='alice@chat.example.org/chat' type='groupchat'><body>copy</body></message>")
+	fmt.Fprintf(conn, "<presence from='ops@conference.example.org/dave' to='%s'/>", listener)
+	fmt.Fprintf(conn, "<message from='ops@conference.example.org/dave' to='%s' type='groupchat'><body>hi from xmpp</body></message>", listener)
+	fmt.Fprintf(conn, "<presence from='ops@conference.example.org/carol' to='%s' type='unavailable'/>", listener)
+
+	var got []string
+	for len(got) < 3 {
+		var msg Message
+		if err := wsjson.Read(ctx, alice, &msg); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if (msg.Type == "message" || msg.Type == "system") && msg.Username != "alice" && !strings.HasPrefix(msg.Content, "alice ") {
+			got = append(got, msg.Username+": "+msg.Content)
+		}
+	}
+	want := []string{"Server: xmpp-dave has joined the chat", "xmpp-dave: hi from xmpp", "Server: xmpp-carol has left the chat"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected %q, got %q", want[i], got[i])
+		}
+	}
+}